@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"os"
+	"syscall"
+)
+
+// whether users other than the one running the file system can use the mount, which needs
+// user_allow_other in /etc/fuse.conf unless it is run by root
+var ALLOW_OTHER bool
+
+// the bits of the mask of access(2)
+const ACCESS_READ uint32 = 4
+const ACCESS_WRITE uint32 = 2
+const ACCESS_EXEC uint32 = 1
+
+/*
+Returns the permissions of the inode. They are not stored, so directories have 0755, symbolic links
+0777, and other files 0644, like the files of a file system mounted with a umask of 022.
+*/
+func (i *Inode) perm() os.FileMode {
+	switch {
+	case i.isDir():
+		return 0755
+	case i.isSymlink():
+		return 0777
+	}
+	return 0644
+}
+
+/*
+Returns nil if the user of header may access the inode for mask (the ACCESS_* bits), as access(2)
+checks it against the owner of the inode and its permissions, or EACCES if not. Root may read and
+write anything, and search directories. The supplementary groups of the user are not known, so only
+its primary group counts as the group of the inode. File systems that do not keep owners (see
+inodeOwners) let every user through, as they did before owners were kept. Writing to a mount made
+read-only by failed writes to S3 is refused with EROFS.
+*/
+func checkAccess(inode *Inode, header fuse.Header, mask uint32) error {
+	if mask&ACCESS_WRITE != 0 {
+		err := health.check()
+		if err != nil {
+			return err
+		}
+	}
+	if !inodeOwners {
+		return nil
+	}
+	perm := uint32(inode.perm())
+	if header.Uid == 0 {
+		if mask&ACCESS_EXEC != 0 && !inode.isDir() && perm&0111 == 0 {
+			return fuse.Errno(syscall.EACCES)
+		}
+		return nil
+	}
+	switch {
+	case header.Uid == inode.Uid:
+		perm >>= 6
+	case header.Gid == inode.Gid:
+		perm >>= 3
+	}
+	if mask&^perm&7 != 0 {
+		return fuse.Errno(syscall.EACCES)
+	}
+	return nil
+}
+
+var _ = fs.NodeAccesser(&Dir{})
+
+/*
+FUSE method that checks whether the user of the request may access the directory, see checkAccess.
+*/
+func (d *Dir) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	defer trackOp("Access")()
+	defer recoverPanic("Access")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Access")()
+	debugOp(d.path, "Access", "inode=%d mask=%o uid=%d", d.inodeNum, req.Mask, req.Uid)
+	return checkAccess(d.inode, req.Header, req.Mask)
+}
+
+var _ = fs.NodeAccesser(&File{})
+
+/*
+FUSE method that checks whether the user of the request may access the file, see checkAccess.
+*/
+func (f *File) Access(ctx context.Context, req *fuse.AccessRequest) error {
+	defer trackOp("Access")()
+	defer recoverPanic("Access")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Access")()
+	debugOp(f.path, "Access", "inode=%d mask=%o uid=%d", f.inodeNum, req.Mask, req.Uid)
+	return checkAccess(f.inode, req.Header, req.Mask)
+}
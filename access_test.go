@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"syscall"
+	"testing"
+)
+
+/*
+Checks that access(2) is answered from the owner and permissions of files and directories: their
+owner may write them, other users and the group may only read them and search directories, and root
+may do anything but execute files.
+*/
+func TestAccess(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	owner := fuse.Header{Uid: 1000, Gid: 100}
+	node, handle, err := root.Create(ctx, &fuse.CreateRequest{Header: owner, Name: "file"}, new(fuse.CreateResponse))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	handle.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	file := node.(*File)
+	dirNode, err := root.Mkdir(ctx, &fuse.MkdirRequest{Header: owner, Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	dir := dirNode.(*Dir)
+
+	var attr fuse.Attr
+	file.Attr(ctx, &attr)
+	if attr.Mode != 0644 {
+		t.Fatalf("file has mode %v", attr.Mode)
+	}
+	dir.Attr(ctx, &attr)
+	if attr.Mode.Perm() != 0755 || !attr.Mode.IsDir() {
+		t.Fatalf("directory has mode %v", attr.Mode)
+	}
+
+	denied := fuse.Errno(syscall.EACCES)
+	group := fuse.Header{Uid: 1001, Gid: 100}
+	other := fuse.Header{Uid: 1002, Gid: 200}
+	checks := []struct {
+		name   string
+		header fuse.Header
+		mask   uint32
+		want   error
+	}{
+		{"owner reading and writing the file", owner, ACCESS_READ | ACCESS_WRITE, nil},
+		{"owner executing the file", owner, ACCESS_EXEC, denied},
+		{"group reading the file", group, ACCESS_READ, nil},
+		{"group writing the file", group, ACCESS_WRITE, denied},
+		{"other user writing the file", other, ACCESS_WRITE, denied},
+		{"root writing the file", fuse.Header{}, ACCESS_WRITE, nil},
+		{"root executing the file", fuse.Header{}, ACCESS_EXEC, denied},
+	}
+	for _, c := range checks {
+		err := file.Access(ctx, &fuse.AccessRequest{Header: c.header, Mask: c.mask})
+		if err != c.want {
+			t.Errorf("%s returned %v", c.name, err)
+		}
+	}
+	if err := dir.Access(ctx, &fuse.AccessRequest{Header: other, Mask: ACCESS_READ | ACCESS_EXEC}); err != nil {
+		t.Errorf("other user listing the directory returned %v", err)
+	}
+	if err := dir.Access(ctx, &fuse.AccessRequest{Header: other, Mask: ACCESS_WRITE}); err != denied {
+		t.Errorf("other user writing to the directory returned %v", err)
+	}
+
+	// file systems that do not keep owners let everyone through
+	inodeOwners = false
+	defer func() { inodeOwners = true }()
+	if err := file.Access(ctx, &fuse.AccessRequest{Header: other, Mask: ACCESS_WRITE}); err != nil {
+		t.Errorf("writing a file without owners returned %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// the unix socket the admin API is served on, or "" to not serve it
+var ADMIN_SOCKET_PATH string
+
+/*
+Struct representing a request to the admin socket, sent as a line of JSON.
+*/
+type adminRequest struct {
+	Command string   `json:"command"`
+	Path    string   `json:"path,omitempty"`
+	Paths   []string `json:"paths,omitempty"` // the files to prefetch, read from a manifest
+	Inode   uint64   `json:"inode,omitempty"` // the inode to find the path of
+}
+
+/*
+Struct representing the reply to a request to the admin socket.
+*/
+type adminResponse struct {
+	OK    bool   `json:"ok,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// the commands served on the admin socket. Each writes its replies to the client, returning an
+// error only if the connection fails.
+var adminCommands = map[string]func(req *adminRequest, conn net.Conn, enc *json.Encoder) error{
+	"watch":      watchCommand,
+	"metrics":    metricsCommand,
+	"prefetch":   prefetchCommand,
+	"health":     healthCommand,
+	"open-files": openFilesCommand,
+	"path":       pathCommand,
+	"compact":    compactCommand,
+}
+
+/*
+Serves the admin API on a unix socket at socketPath, which only the user running the file system
+can connect to. A socket left behind by a file system that was not shut down cleanly is replaced,
+but one that another file system is still serving on is not.
+*/
+func startAdminSocket(socketPath string) error {
+	info, err := os.Lstat(socketPath)
+	if err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return errors.New("Admin socket path " + socketPath + " exists and is not a socket.")
+		}
+		if conn, err := net.DialTimeout("unix", socketPath, time.Second); err == nil {
+			conn.Close()
+			return errors.New("Admin socket path " + socketPath + " is in use by another file system.")
+		}
+		os.Remove(socketPath)
+	}
+	// the socket is created without permissions for others, rather than changed after, so that
+	// there is no window in which they can connect to it
+	oldMask := syscall.Umask(0077)
+	listener, err := net.Listen("unix", socketPath)
+	syscall.Umask(oldMask)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				fmt.Println("Admin socket failed: " + err.Error())
+				return
+			}
+			go serveAdminConn(conn)
+		}
+	}()
+	return nil
+}
+
+/*
+Serves the requests of a connection to the admin socket until it is closed.
+*/
+func serveAdminConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		req := new(adminRequest)
+		err = json.Unmarshal(line, req)
+		if err != nil {
+			err = enc.Encode(&adminResponse{Error: "malformed request: " + err.Error()})
+		} else if command := adminCommands[req.Command]; command == nil {
+			err = enc.Encode(&adminResponse{Error: "unknown command " + req.Command})
+		} else {
+			err = command(req, &bufferedConn{conn, reader}, enc)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+/*
+Struct representing a connection whose reads go through the buffer that requests were read into.
+*/
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
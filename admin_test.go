@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+Checks that the admin socket is only accessible to its owner, that a socket another file system is
+serving on is not replaced, and that one left behind by a file system that exited is.
+*/
+func TestAdminSocketPath(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "admin.sock")
+	err := startAdminSocket(socketPath)
+	if err != nil {
+		t.Fatalf("startAdminSocket: %v", err)
+	}
+	info, err := os.Lstat(socketPath)
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("admin socket mode %v is accessible to others", info.Mode())
+	}
+	if startAdminSocket(socketPath) == nil {
+		t.Errorf("the admin socket of a running file system was replaced")
+	}
+
+	stalePath := filepath.Join(dir, "stale.sock")
+	listener, err := net.Listen("unix", stalePath)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	err = startAdminSocket(stalePath)
+	if err != nil {
+		t.Errorf("a stale admin socket was not replaced: %v", err)
+	}
+}
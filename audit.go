@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AUDIT_S3 string = "s3"
+const AUDIT_CLOUDWATCH_PREFIX string = "cloudwatch:"
+const AUDIT_OBJECT_PREFIX string = "audit/"   // prefix of the audit log objects in the bucket
+const AUDIT_BATCH_SIZE int = 256              // events buffered before the log is written out
+const AUDIT_FLUSH_INTERVAL = 10 * time.Second // longest time an event is buffered
+
+// the audit log of the mounted file system, or nil if the config does not enable one
+var auditLog *AuditLog
+
+/*
+Struct representing one audited file operation. NewPath is only set for renames.
+*/
+type AuditEvent struct {
+	Time    time.Time
+	Op      string
+	Uid     uint32
+	Gid     uint32
+	Pid     uint32
+	Path    string
+	NewPath string `json:",omitempty"`
+	Inode   uint64
+}
+
+/*
+Interface for the append-only destination of the audit log. Events are written in the order
+they happened, and a sink must never overwrite events it was given before.
+*/
+type AuditSink interface {
+	WriteEvents(events []AuditEvent) error
+}
+
+/*
+Struct that buffers audited file operations and writes them to an AuditSink in batches, both when
+AUDIT_BATCH_SIZE events are buffered and every AUDIT_FLUSH_INTERVAL.
+*/
+type AuditLog struct {
+	sink    AuditSink
+	lock    sync.Mutex
+	pending []AuditEvent
+	stop    chan bool
+}
+
+/*
+Returns a pointer to an AuditLog writing to sink. Call start to flush it periodically.
+*/
+func newAuditLog(sink AuditSink) *AuditLog {
+	return &AuditLog{
+		sink: sink,
+		stop: make(chan bool),
+	}
+}
+
+/*
+Starts a goroutine that flushes the log every AUDIT_FLUSH_INTERVAL until close is called.
+*/
+func (a *AuditLog) start() {
+	go func() {
+		ticker := time.NewTicker(AUDIT_FLUSH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.flush()
+			case <-a.stop:
+				return
+			}
+		}
+	}()
+}
+
+/*
+Records that the process described by header did op on the inode at path (moving it to newPath,
+for renames).
+*/
+func (a *AuditLog) record(op string, header fuse.Header, path, newPath string, inodeNum uint64) {
+	a.lock.Lock()
+	a.pending = append(a.pending, AuditEvent{
+		Time:    time.Now().UTC(),
+		Op:      op,
+		Uid:     header.Uid,
+		Gid:     header.Gid,
+		Pid:     header.Pid,
+		Path:    path,
+		NewPath: newPath,
+		Inode:   inodeNum,
+	})
+	full := len(a.pending) >= AUDIT_BATCH_SIZE
+	a.lock.Unlock()
+	if full {
+		a.flush()
+	}
+}
+
+/*
+Writes the buffered events to the sink. If that fails they are kept, to be written with the next batch.
+*/
+func (a *AuditLog) flush() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.pending) == 0 {
+		return nil
+	}
+	err := a.sink.WriteEvents(a.pending)
+	if err != nil {
+		fmt.Println("Error writing the audit log: " + err.Error())
+		return err
+	}
+	a.pending = nil
+	return nil
+}
+
+/*
+Stops the periodic flushes and writes out the buffered events.
+*/
+func (a *AuditLog) close() error {
+	close(a.stop)
+	return a.flush()
+}
+
+/*
+Records op in the audit log if one is configured. Called by the FUSE handlers after the operation succeeds.
+*/
+func audit(op string, header fuse.Header, path, newPath string, inodeNum uint64) {
+	if auditLog != nil {
+		auditLog.record(op, header, path, newPath, inodeNum)
+	}
+}
+
+/*
+Returns the audit log described by config, or nil if it does not enable one. Audit logs kept in
+S3 are written to the bucket of the file system, unencrypted and bypassing the cache.
+*/
+func initializeAuditLog(config *Config) (*AuditLog, error) {
+	var sink AuditSink
+	switch {
+	case config.AuditLog == "":
+		return nil, nil
+	case config.AuditLog == AUDIT_S3 && config.Backend == LOCAL_BACKEND:
+		auditStore, err := newLocalStore(filepath.Join(config.LocalPath, "audit"))
+		if err != nil {
+			return nil, err
+		}
+		sink = newObjectAuditSink(auditStore, "")
+	case config.AuditLog == AUDIT_S3:
+		sink = newObjectAuditSink(sandboxStore(newS3Store(getClient())), AUDIT_OBJECT_PREFIX)
+	case strings.HasPrefix(config.AuditLog, AUDIT_CLOUDWATCH_PREFIX):
+		parts := strings.Split(strings.TrimPrefix(config.AuditLog, AUDIT_CLOUDWATCH_PREFIX), ":")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.New("AuditLog must be of the form cloudwatch:GROUP:STREAM, not " + config.AuditLog)
+		}
+		cwSink, err := newCloudWatchAuditSink(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		sink = cwSink
+	default:
+		return nil, errors.New("unknown AuditLog " + config.AuditLog + ", must be \"s3\" or \"cloudwatch:GROUP:STREAM\"")
+	}
+	a := newAuditLog(sink)
+	a.start()
+	return a, nil
+}
+
+/*
+Returns the events as JSON, one per line.
+*/
+func marshalAuditEvents(events []AuditEvent) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		err := encoder.Encode(event)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+/*
+AuditSink that writes each batch of events to a new object in an ObjectStore. The objects are
+named by the time of their first event and the mount that wrote them, so names sort by time and
+mounts sharing a bucket never overwrite each other's objects.
+*/
+type objectAuditSink struct {
+	store  ObjectStore
+	prefix string
+	mount  string
+	seq    int
+}
+
+/*
+Returns a pointer to an objectAuditSink writing objects with the given key prefix to store.
+*/
+func newObjectAuditSink(store ObjectStore, prefix string) *objectAuditSink {
+	return &objectAuditSink{
+		store:  store,
+		prefix: prefix,
+		mount:  newUUID(),
+	}
+}
+
+/*
+Writes events to a new object as JSON lines.
+*/
+func (s *objectAuditSink) WriteEvents(events []AuditEvent) error {
+	data, err := marshalAuditEvents(events)
+	if err != nil {
+		return err
+	}
+	s.seq++
+	key := s.prefix + events[0].Time.Format("20060102T150405.000000000Z") + "-" + s.mount + "-" + strconv.Itoa(s.seq) + ".jsonl"
+	return s.store.PutObject(key, data)
+}
+
+/*
+AuditSink that writes events to a CloudWatch Logs stream.
+*/
+type cloudWatchAuditSink struct {
+	client *cloudwatchlogs.CloudWatchLogs
+	group  string
+	stream string
+	token  *string
+}
+
+/*
+Returns a pointer to a cloudWatchAuditSink writing to the given stream of the given log group,
+creating the stream if it does not exist. The log group must already exist.
+*/
+func newCloudWatchAuditSink(group, stream string) (*cloudWatchAuditSink, error) {
+	client := cloudwatchlogs.New(session.New(newAWSConfig("logs", S3_REGION)))
+	// fails if the stream already exists, in which case its sequence token is looked up below
+	client.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(stream),
+	})
+	resp, err := client.DescribeLogStreams(&cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        aws.String(group),
+		LogStreamNamePrefix: aws.String(stream),
+	})
+	if err != nil {
+		return nil, errors.New("Could not open audit log stream " + group + ":" + stream + ": " + err.Error())
+	}
+	sink := &cloudWatchAuditSink{
+		client: client,
+		group:  group,
+		stream: stream,
+	}
+	for _, logStream := range resp.LogStreams {
+		if aws.StringValue(logStream.LogStreamName) == stream {
+			sink.token = logStream.UploadSequenceToken
+		}
+	}
+	return sink, nil
+}
+
+/*
+Writes events to the log stream, one JSON log event each.
+*/
+func (s *cloudWatchAuditSink) WriteEvents(events []AuditEvent) error {
+	logEvents := make([]*cloudwatchlogs.InputLogEvent, 0, len(events))
+	for _, event := range events {
+		message, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		logEvents = append(logEvents, &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(string(message)),
+			Timestamp: aws.Int64(event.Time.UnixNano() / int64(time.Millisecond)),
+		})
+	}
+	resp, err := s.client.PutLogEvents(&cloudwatchlogs.PutLogEventsInput{
+		LogEvents:     logEvents,
+		LogGroupName:  aws.String(s.group),
+		LogStreamName: aws.String(s.stream),
+		SequenceToken: s.token,
+	})
+	if err != nil {
+		return err
+	}
+	s.token = resp.NextSequenceToken
+	return nil
+}
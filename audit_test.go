@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+)
+
+/*
+AuditSink that keeps the events written to it in memory.
+*/
+type memAuditSink struct {
+	events []AuditEvent
+}
+
+/*
+Appends events to the sink.
+*/
+func (s *memAuditSink) WriteEvents(events []AuditEvent) error {
+	s.events = append(s.events, events...)
+	return nil
+}
+
+/*
+Checks that creates, writes, renames, and removes are audited with the user, path, and inode, and
+that reads are not.
+*/
+func TestAuditLog(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	sink := new(memAuditSink)
+	auditLog = newAuditLog(sink)
+	defer func() { auditLog = nil }()
+	user := fuse.Header{Uid: 1000, Gid: 100, Pid: 42}
+
+	_, err := root.Mkdir(ctx, &fuse.MkdirRequest{Header: user, Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	node, _, err := root.Create(ctx, &fuse.CreateRequest{Header: user, Name: "file"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	file := node.(*File)
+	file.Open(ctx, &fuse.OpenRequest{Header: user, Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	file.Open(ctx, &fuse.OpenRequest{Header: user, Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	dirNode, _ := root.lookup(ctx, "dir")
+	err = root.Rename(ctx, &fuse.RenameRequest{Header: user, OldName: "file", NewName: "moved"}, dirNode)
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	err = dirNode.(*Dir).Remove(ctx, &fuse.RemoveRequest{Header: user, Name: "moved"})
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if len(sink.events) != 0 {
+		t.Fatalf("%d events written before the log was flushed", len(sink.events))
+	}
+	auditLog.flush()
+
+	want := []AuditEvent{
+		{Op: "mkdir", Path: "/dir"},
+		{Op: "create", Path: "/file", Inode: file.inodeNum},
+		{Op: "open-write", Path: "/file", Inode: file.inodeNum},
+		{Op: "rename", Path: "/file", NewPath: "/dir/moved", Inode: file.inodeNum},
+		{Op: "remove", Path: "/dir/moved", Inode: file.inodeNum},
+	}
+	if len(sink.events) != len(want) {
+		t.Fatalf("audit log has %d events, want %d: %+v", len(sink.events), len(want), sink.events)
+	}
+	for i, event := range sink.events {
+		if event.Op != want[i].Op || event.Path != want[i].Path || event.NewPath != want[i].NewPath {
+			t.Errorf("event %d = %+v, want %+v", i, event, want[i])
+		}
+		if want[i].Inode != 0 && event.Inode != want[i].Inode {
+			t.Errorf("event %d has inode %d, want %d", i, event.Inode, want[i].Inode)
+		}
+		if event.Uid != user.Uid || event.Gid != user.Gid || event.Pid != user.Pid || event.Time.IsZero() {
+			t.Errorf("event %d does not record who did it and when: %+v", i, event)
+		}
+	}
+}
+
+/*
+Checks that the object sink writes each batch to a new object of JSON lines.
+*/
+func TestObjectAuditSink(t *testing.T) {
+	objects := newMemStore()
+	a := newAuditLog(newObjectAuditSink(objects, AUDIT_OBJECT_PREFIX))
+	for batch := 0; batch < 2; batch++ {
+		a.record("create", fuse.Header{Uid: 1}, "/a", "", 2)
+		a.record("remove", fuse.Header{Uid: 1}, "/a", "", 2)
+		a.flush()
+	}
+	if objects.Len() != 2 {
+		t.Fatalf("%d audit objects, want 2", objects.Len())
+	}
+	for key, data := range objects.items {
+		if !strings.HasPrefix(key, AUDIT_OBJECT_PREFIX) {
+			t.Errorf("audit object %s is not under %s", key, AUDIT_OBJECT_PREFIX)
+		}
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) != 2 {
+			t.Fatalf("audit object has %d lines, want 2", len(lines))
+		}
+		var event AuditEvent
+		err := json.Unmarshal([]byte(lines[1]), &event)
+		if err != nil || event.Op != "remove" {
+			t.Errorf("second line of audit object = %q (%v)", lines[1], err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"io/ioutil"
+	"net/http"
+)
+
+// set from the config file for environments that cannot rely on the SDK's defaults
+var CA_BUNDLE_PATH string      // PEM file of the CAs trusted for AWS endpoints, or "" for the system CAs
+var MIN_TLS_VERSION string     // the lowest TLS version used with AWS endpoints, e.g. "1.2", or "" for Go's default
+var USE_FIPS_ENDPOINTS bool    // whether to use the FIPS 140-2 endpoints of S3, DynamoDB, and KMS
+var awsHTTPClient *http.Client // the HTTP client used by all AWS clients, or nil for the SDK's default
+
+/*
+Returns the TLS version constant for a version string such as "1.2".
+*/
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.New("unknown TLS version \"" + version + "\", must be one of 1.0, 1.1, 1.2, or 1.3")
+}
+
+/*
+Returns an HTTP client that trusts only the CAs in the bundle at caBundlePath (if it is not "") and
+uses at least minTLSVersion (if it is not ""), or nil if neither is set.
+*/
+func newHTTPClient(caBundlePath, minTLSVersion string) (*http.Client, error) {
+	if caBundlePath == "" && minTLSVersion == "" {
+		return nil, nil
+	}
+	tlsConfig := new(tls.Config)
+	if caBundlePath != "" {
+		pem, err := ioutil.ReadFile(caBundlePath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA bundle " + caBundlePath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if minTLSVersion != "" {
+		version, err := parseTLSVersion(minTLSVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = version
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport: transport,
+	}, nil
+}
+
+/*
+Returns the FIPS endpoint of an AWS service (named as in its endpoint, e.g. "s3") in region.
+*/
+func fipsEndpoint(service, region string) string {
+	return fmt.Sprintf("https://%s-fips.%s.amazonaws.com", service, region)
+}
+
+/*
+Returns the SDK config for a client of the given AWS service in region, using the configured
+credentials profile, HTTP client, and endpoints.
+*/
+func newAWSConfig(service, region string) *aws.Config {
+	config := &aws.Config{
+		Region:      aws.String(region),
+		Credentials: credentials.NewSharedCredentials("", credentialsProfile),
+	}
+	if awsHTTPClient != nil {
+		config.HTTPClient = awsHTTPClient
+	}
+	if USE_FIPS_ENDPOINTS {
+		config.Endpoint = aws.String(fipsEndpoint(service, region))
+	}
+	return config
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+/*
+Checks that the TLS settings from the config are applied to the HTTP client, and that invalid
+settings are rejected.
+*/
+func TestNewHTTPClient(t *testing.T) {
+	client, err := newHTTPClient("", "")
+	if client != nil || err != nil {
+		t.Fatalf("newHTTPClient with no settings = %v, %v; want the SDK default", client, err)
+	}
+	client, err = newHTTPClient("", "1.3")
+	if err != nil {
+		t.Fatalf("newHTTPClient: %v", err)
+	}
+	if version := client.Transport.(*http.Transport).TLSClientConfig.MinVersion; version != tls.VersionTLS13 {
+		t.Errorf("MinVersion = %x, want TLS 1.3", version)
+	}
+	if _, err := newHTTPClient("", "1.4"); err == nil {
+		t.Errorf("unknown TLS version accepted")
+	}
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(bundle, []byte("not a certificate"), 0644)
+	if _, err := newHTTPClient(bundle, ""); err == nil {
+		t.Errorf("CA bundle without certificates accepted")
+	}
+	if _, err := newHTTPClient(filepath.Join(t.TempDir(), "missing.pem"), ""); err == nil {
+		t.Errorf("missing CA bundle accepted")
+	}
+}
+
+/*
+Checks that FIPS endpoints are only used when configured.
+*/
+func TestFIPSEndpoints(t *testing.T) {
+	defer func() { USE_FIPS_ENDPOINTS = false }()
+	if config := newAWSConfig("s3", "us-east-1"); config.Endpoint != nil {
+		t.Errorf("endpoint set without FIPSEndpoints: %s", *config.Endpoint)
+	}
+	USE_FIPS_ENDPOINTS = true
+	config := newAWSConfig("dynamodb", "us-west-2")
+	if config.Endpoint == nil || *config.Endpoint != "https://dynamodb-fips.us-west-2.amazonaws.com" {
+		t.Errorf("FIPS endpoint = %v", config.Endpoint)
+	}
+}
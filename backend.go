@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Interface for the durable store that blocks are written back to when they are evicted from the cache.
+In production this is an S3 bucket.
+*/
+type ObjectStore interface {
+	GetObject(key string) ([]byte, error)
+	PutObject(key string, data []byte) error
+	DeleteObject(key string) error
+}
+
+/*
+Interface implemented by ObjectStores that keep a checksum of each object. VerifyObject gets an object
+like GetObject, but returns an error if its data does not match the checksum.
+*/
+type VerifyingStore interface {
+	VerifyObject(key string) ([]byte, error)
+}
+
+/*
+Interface implemented by ObjectStores that can copy an object without it being downloaded and
+uploaded again, as S3 does server-side.
+*/
+type CopyingStore interface {
+	CopyObject(srcKey, dstKey string) error
+}
+
+/*
+Interface implemented by ObjectStores that can get part of an object without getting all of it, as S3
+does for GETs with a Range header. GetObjectRange returns the length bytes of the object at offset.
+*/
+type RangeStore interface {
+	GetObjectRange(key string, offset, length uint64) ([]byte, error)
+}
+
+/*
+Interface implemented by ObjectStores that can delete many objects with one request, as S3 does with
+DeleteObjects. DeleteObjects returns the error deleting each of keys, nil for those deleted.
+*/
+type BatchDeletingStore interface {
+	DeleteObjects(keys []string) []error
+}
+
+/*
+Deletes the objects with keys from s, with one request if s is a BatchDeletingStore, and one at a
+time if it is not. Returns the error deleting each of keys, nil for those deleted.
+*/
+func deleteObjects(s ObjectStore, keys []string) []error {
+	if batches, ok := s.(BatchDeletingStore); ok {
+		return batches.DeleteObjects(keys)
+	}
+	errs := make([]error, len(keys))
+	for n, key := range keys {
+		errs[n] = s.DeleteObject(key)
+	}
+	return errs
+}
+
+/*
+Struct identifying a version of an object kept by a bucket with versioning enabled.
+*/
+type objectVersion struct {
+	ID       string
+	Modified time.Time
+}
+
+/*
+Interface implemented by ObjectStores that keep the earlier versions of their objects, as S3 does in
+buckets with versioning enabled. GetObjectAt gets the version of the object that was current at the
+given time, returning an error if the object did not exist then.
+*/
+type VersionedStore interface {
+	GetObjectAt(key string, at time.Time) ([]byte, *objectVersion, error)
+}
+
+/*
+Returns the length bytes at offset of the object with key in s, getting only them if s is a
+RangeStore, and cutting them out of the whole object if it is not.
+*/
+func getObjectRange(s ObjectStore, key string, offset, length uint64) ([]byte, error) {
+	if ranges, ok := s.(RangeStore); ok {
+		return ranges.GetObjectRange(key, offset, length)
+	}
+	data, err := s.GetObject(key)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) < offset+length {
+		return nil, fmt.Errorf("Object %s has %d bytes, not %d.", key, len(data), offset+length)
+	}
+	return data[offset : offset+length], nil
+}
+
+/*
+Returns whether err, returned by GetObject, means that the store holds no object with the key, rather
+than that the object could not be read, as when S3 throttles the request or cannot be reached. S3
+only says that an object is missing to those allowed s3:ListBucket, and AccessDenied otherwise. The
+same goes for errors returned by GetInode of a MetadataStore, which says when it has no such inode.
+*/
+func isMissingObject(err error) bool {
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		return failure.StatusCode() == http.StatusNotFound
+	}
+	// the stores used for testing and local file systems, and the metadata stores
+	return strings.HasPrefix(err.Error(), "No item in memory with key ") || strings.HasPrefix(err.Error(), "No local item with key ") ||
+		strings.HasPrefix(err.Error(), "No inode ")
+}
+
+/*
+Interface for the table that caches recently used blocks. In production this is a DynamoDB table.
+DeleteItem returns the data of the deleted item, so that it can be written back to the ObjectStore.
+*/
+type CacheTable interface {
+	GetItem(key string) ([]byte, error)
+	PutItem(key string, data []byte) error
+	DeleteItem(key string) ([]byte, error)
+}
+
+/*
+Interface implemented by CacheTables that can list the keys of their items, so that the items left by
+a mount that was not cleanly unmounted can be found, see recoverCacheTable.
+*/
+type ListingTable interface {
+	ListItems() ([]string, error)
+}
+
+// the store backing the file system, declared globally for use by the block functions
+var store ObjectStore
+
+const LOCAL_BACKEND string = "local"
+const TOOL_CACHE_SIZE int = 1024 // cache size used by commands that read the file system without mounting it
+
+/*
+Sets up the global store and cache for mounting the file system described by config, creating
+the bucket and table (or local directories) if they do not exist. Exits the program on failure.
+*/
+func initializeBackend(config *Config, cacheSize int) {
+	keyManager = new(kmsKeyManager)
+	tieringSource = configuredTieringSource(config)
+	if config.Backend == LOCAL_BACKEND {
+		objects, err := newLocalStore(filepath.Join(config.LocalPath, "objects"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		table, err := newLocalStore(filepath.Join(config.LocalPath, "table"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = objects
+		cache = newCache(table, cacheSize)
+		backendMetadataStore = nil
+		backendLockStore = nil
+		sandboxBackend()
+		return
+	}
+	initializeBucket()
+	store = newS3Store(getClient())
+	cache = initializeCache(cacheSize)
+	metadata := newDynamoMetadataStore(getDynamoClient(), DYNAMO_TABLE_NAME+METADATA_TABLE_SUFFIX)
+	if METADATA_ITEMS {
+		// only file systems that keep their metadata as items use the table, so it is created
+		// along with them
+		metadata.initialize()
+	}
+	backendMetadataStore = metadata
+	backendLockStore = nil
+	if SHARED_LOCKS {
+		locks := newDynamoLockStore(getDynamoClient(), DYNAMO_TABLE_NAME+LOCK_TABLE_SUFFIX)
+		locks.initialize()
+		backendLockStore = locks
+	}
+	sandboxBackend()
+}
+
+/*
+Sets up the global store for commands that read the file system described by config without
+mounting it. The cache is kept in memory, so these commands never write to the cache table, and
+do not see blocks left in it by a file system that was not cleanly unmounted.
+*/
+func initializeToolBackend(config *Config) error {
+	keyManager = new(kmsKeyManager)
+	tieringSource = configuredTieringSource(config)
+	if config.Backend == LOCAL_BACKEND {
+		objects, err := newLocalStore(filepath.Join(config.LocalPath, "objects"))
+		if err != nil {
+			return err
+		}
+		store = objects
+		backendMetadataStore = nil
+	} else {
+		store = newS3Store(getClient())
+		backendMetadataStore = newDynamoMetadataStore(getDynamoClient(), DYNAMO_TABLE_NAME+METADATA_TABLE_SUFFIX)
+	}
+	cache = newCache(newMemStore(), TOOL_CACHE_SIZE)
+	sandboxBackend()
+	return nil
+}
+
+/*
+Reads the superblock from the store and returns the file system it describes, setting up
+encryption if the file system is encrypted.
+*/
+func openFs() (*FS, error) {
+	super, err := getStoredDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err != nil {
+		return nil, errors.New("Could not read the superblock: " + err.Error())
+	}
+	filesys, err := makeFs(super)
+	if err != nil {
+		return nil, err
+	}
+	err = initializeEncryption(filesys.info, false)
+	if err != nil {
+		return nil, err
+	}
+	return filesys, nil
+}
+
+/*
+ObjectStore backed by the configured S3 bucket.
+*/
+type s3Store struct {
+	client    *s3.S3
+	uploads   *bandwidthLimiter // see S3_UPLOAD_BANDWIDTH
+	downloads *bandwidthLimiter // see S3_DOWNLOAD_BANDWIDTH
+}
+
+var _ VerifyingStore = (*s3Store)(nil)
+
+/*
+Returns an ObjectStore that uses the configured S3 bucket.
+*/
+func newS3Store(client *s3.S3) *s3Store {
+	return &s3Store{
+		client:    client,
+		uploads:   newBandwidthLimiter(S3_UPLOAD_BANDWIDTH),
+		downloads: newBandwidthLimiter(S3_DOWNLOAD_BANDWIDTH),
+	}
+}
+
+/*
+Gets the object with the given key from S3, no faster than S3_DOWNLOAD_BANDWIDTH.
+*/
+func (s *s3Store) GetObject(key string) ([]byte, error) {
+	output, err := s.client.GetObjectWithContext(awsContext(), &s3.GetObjectInput{
+		Bucket: aws.String(S3_BUCKET_NAME),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	return ioutil.ReadAll(&throttledReader{inner: output.Body, limiter: s.downloads})
+}
+
+var _ RangeStore = (*s3Store)(nil)
+
+/*
+Gets length bytes at offset of the object with the given key from S3 with a Range GET, so that only
+they are downloaded, no faster than S3_DOWNLOAD_BANDWIDTH.
+*/
+func (s *s3Store) GetObjectRange(key string, offset, length uint64) ([]byte, error) {
+	output, err := s.client.GetObjectWithContext(awsContext(), &s3.GetObjectInput{
+		Bucket: aws.String(S3_BUCKET_NAME),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(&throttledReader{inner: output.Body, limiter: s.downloads})
+	if err == nil && uint64(len(data)) != length {
+		err = fmt.Errorf("Object %s has %d bytes at %d, not %d.", key, len(data), offset, length)
+	}
+	return data, err
+}
+
+/*
+Gets the object with the given key from S3, checking it against its ETag, which is the MD5 of the
+object for objects put with a single request. Objects whose ETag is not an MD5 (multipart uploads,
+or buckets encrypted with SSE-KMS) are not checked.
+*/
+func (s *s3Store) VerifyObject(key string) ([]byte, error) {
+	output, err := s.client.GetObjectWithContext(awsContext(), &s3.GetObjectInput{
+		Bucket: aws.String(S3_BUCKET_NAME),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(&throttledReader{inner: output.Body, limiter: s.downloads})
+	if err != nil {
+		return nil, err
+	}
+	etag := strings.Trim(aws.StringValue(output.ETag), "\"")
+	if len(etag) == 2*md5.Size && !strings.Contains(etag, "-") {
+		sum := md5.Sum(data)
+		if hex.EncodeToString(sum[:]) != etag {
+			return nil, errors.New("Object " + key + " does not match its ETag.")
+		}
+	}
+	return data, nil
+}
+
+/*
+Puts an object with the given key to S3. The MD5 of the data is sent with it, so that S3 rejects
+the object if it is corrupted on the way. Waits first for the data to fit in S3_UPLOAD_BANDWIDTH.
+*/
+func (s *s3Store) PutObject(key string, data []byte) error {
+	s.uploads.wait(len(data))
+	_, err := s.client.PutObjectWithContext(awsContext(), s.putObjectInput(key, data))
+	return err
+}
+
+/*
+Returns the request that puts an object with the given key and data to S3, in S3_STORAGE_CLASS.
+*/
+func (s *s3Store) putObjectInput(key string, data []byte) *s3.PutObjectInput {
+	reader := bytes.NewReader(data)
+	sum := md5.Sum(data)
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(S3_BUCKET_NAME),
+		Key:           aws.String(key),
+		Body:          reader,
+		ContentLength: aws.Int64(int64(reader.Len())),
+		ContentMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}
+	if S3_STORAGE_CLASS != "" {
+		input.StorageClass = aws.String(S3_STORAGE_CLASS)
+	}
+	return input
+}
+
+var _ CopyingStore = (*s3Store)(nil)
+
+/*
+Copies the object with srcKey to dstKey within the bucket, server-side, in S3_STORAGE_CLASS. The
+copy keeps the metadata of the object, including its checksum.
+*/
+func (s *s3Store) CopyObject(srcKey, dstKey string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(S3_BUCKET_NAME),
+		CopySource: aws.String(S3_BUCKET_NAME + "/" + srcKey),
+		Key:        aws.String(dstKey),
+	}
+	if S3_STORAGE_CLASS != "" {
+		input.StorageClass = aws.String(S3_STORAGE_CLASS)
+	}
+	_, err := s.client.CopyObjectWithContext(awsContext(), input)
+	return err
+}
+
+var _ VersionedStore = (*s3Store)(nil)
+
+/*
+Gets the version of the object with the given key that was current at the given time, the latest
+one written no later than it, no faster than S3_DOWNLOAD_BANDWIDTH. The versions are listed by the
+key as a prefix, so those of other keys that start with it are skipped. Returns an error if there
+was no version then, or the object was deleted.
+*/
+func (s *s3Store) GetObjectAt(key string, at time.Time) ([]byte, *objectVersion, error) {
+	var current *objectVersion
+	deleted := false
+	consider := func(versionKey *string, id *string, modified *time.Time, isDelete bool) {
+		if aws.StringValue(versionKey) != key || aws.TimeValue(modified).After(at) {
+			return
+		}
+		if current == nil || aws.TimeValue(modified).After(current.Modified) {
+			current = &objectVersion{ID: aws.StringValue(id), Modified: aws.TimeValue(modified)}
+			deleted = isDelete
+		}
+	}
+	err := s.client.ListObjectVersionsPagesWithContext(awsContext(), &s3.ListObjectVersionsInput{
+		Bucket: aws.String(S3_BUCKET_NAME),
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, version := range page.Versions {
+			consider(version.Key, version.VersionId, version.LastModified, false)
+		}
+		for _, marker := range page.DeleteMarkers {
+			consider(marker.Key, marker.VersionId, marker.LastModified, true)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if current == nil || deleted {
+		return nil, nil, errors.New("Object " + key + " did not exist at " + at.Format(time.RFC3339) + ".")
+	}
+	output, err := s.client.GetObjectWithContext(awsContext(), &s3.GetObjectInput{
+		Bucket:    aws.String(S3_BUCKET_NAME),
+		Key:       aws.String(key),
+		VersionId: aws.String(current.ID),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer output.Body.Close()
+	data, err := ioutil.ReadAll(&throttledReader{inner: output.Body, limiter: s.downloads})
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, current, nil
+}
+
+/*
+Deletes the object with the given key from S3.
+*/
+func (s *s3Store) DeleteObject(key string) error {
+	_, err := s.client.DeleteObjectWithContext(awsContext(), &s3.DeleteObjectInput{
+		Bucket: aws.String(S3_BUCKET_NAME),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+var _ BatchDeletingStore = (*s3Store)(nil)
+
+/*
+Deletes the objects with keys from S3 with one DeleteObjects request, so there must be no more of
+them than the 1000 it takes. Returns the error S3 gave for each key it could not delete, or the error
+of the request for every key if it failed.
+*/
+func (s *s3Store) DeleteObjects(keys []string) []error {
+	objects := make([]*s3.ObjectIdentifier, len(keys))
+	for n, key := range keys {
+		objects[n] = &s3.ObjectIdentifier{Key: aws.String(key)}
+	}
+	output, err := s.client.DeleteObjectsWithContext(awsContext(), &s3.DeleteObjectsInput{
+		Bucket: aws.String(S3_BUCKET_NAME),
+		Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+	})
+	errs := make([]error, len(keys))
+	if err != nil {
+		for n := range errs {
+			errs[n] = err
+		}
+		return errs
+	}
+	failed := make(map[string]error)
+	for _, failure := range output.Errors {
+		failed[aws.StringValue(failure.Key)] = errors.New(aws.StringValue(failure.Code) + ": " + aws.StringValue(failure.Message))
+	}
+	for n, key := range keys {
+		errs[n] = failed[key]
+	}
+	return errs
+}
+
+/*
+CacheTable backed by the configured DynamoDB table. Items have a string "Name" key and a
+binary "Value" holding the block.
+*/
+type dynamoTable struct {
+	client *dynamodb.DynamoDB
+	name   string
+}
+
+/*
+Returns a CacheTable that uses the DynamoDB table with the given name.
+*/
+func newDynamoTable(client *dynamodb.DynamoDB, name string) *dynamoTable {
+	return &dynamoTable{
+		client: client,
+		name:   name,
+	}
+}
+
+/*
+Does a consistent read of the item with the given key from DynamoDB.
+*/
+func (t *dynamoTable) GetItem(key string) ([]byte, error) {
+	params := &dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"Name": {
+				S: aws.String(key),
+			},
+		},
+		TableName:      aws.String(t.name),
+		ConsistentRead: aws.Bool(true),
+	}
+	resp, err := t.client.GetItemWithContext(awsContext(), params)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Item["Value"] == nil {
+		return nil, errors.New("No item in DynamoDB with key " + key + ".")
+	}
+	return resp.Item["Value"].B, nil
+}
+
+/*
+Puts an item with the given key to DynamoDB.
+*/
+func (t *dynamoTable) PutItem(key string, data []byte) error {
+	params := &dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			"Name": {
+				S: aws.String(key),
+			},
+			"Value": {
+				B: data,
+			},
+		},
+		TableName: aws.String(t.name),
+	}
+	_, err := t.client.PutItemWithContext(awsContext(), params)
+	return err
+}
+
+/*
+Deletes the item with the given key from DynamoDB, returning its value.
+*/
+func (t *dynamoTable) DeleteItem(key string) ([]byte, error) {
+	params := &dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"Name": {
+				S: aws.String(key),
+			},
+		},
+		TableName:    aws.String(t.name),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	}
+	resp, err := t.client.DeleteItemWithContext(awsContext(), params)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Attributes["Value"] == nil {
+		return nil, errors.New("No item in DynamoDB with key " + key + ".")
+	}
+	return resp.Attributes["Value"].B, nil
+}
+
+var _ ListingTable = (*dynamoTable)(nil)
+
+/*
+Returns the keys of all the items in the table, scanning it a page at a time, with consistent
+reads. Only the keys are read.
+*/
+func (t *dynamoTable) ListItems() ([]string, error) {
+	params := &dynamodb.ScanInput{
+		TableName:            aws.String(t.name),
+		ProjectionExpression: aws.String("#n"),
+		ExpressionAttributeNames: map[string]*string{
+			"#n": aws.String("Name"),
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	var keys []string
+	err := t.client.ScanPagesWithContext(awsContext(), params, func(page *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range page.Items {
+			if item["Name"] != nil && item["Name"].S != nil {
+				keys = append(keys, *item["Name"].S)
+			}
+		}
+		return true
+	})
+	return keys, err
+}
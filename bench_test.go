@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"math/rand"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// BLOCK_SIZE is a compile-time constant, so block sizes are compared by changing it in datablock.go,
+// running these benchmarks once per value with -count, and comparing the results with benchstat.
+// The "store" and "table" metrics count requests that would go to S3 and DynamoDB, which dominate
+// real run time far more than the CPU time measured here. The cache only has an LRU eviction
+// policy, so the cache benchmarks compare cache sizes.
+
+var benchFileSizes = []int{4 * 1000, 128 * 1000, 1000 * 1000}
+var benchCacheSizes = []int{4, 16, 64, 256}
+
+/*
+ObjectStore and CacheTable that counts the requests made to the wrapped store.
+*/
+type countingStore struct {
+	store *MemStore
+	gets  int64
+	puts  int64
+	dels  int64
+}
+
+/*
+ObjectStore method that counts the request and passes it to the wrapped store.
+*/
+func (c *countingStore) GetObject(key string) ([]byte, error) {
+	atomic.AddInt64(&c.gets, 1)
+	return c.store.GetObject(key)
+}
+
+/*
+ObjectStore method that counts the request and passes it to the wrapped store.
+*/
+func (c *countingStore) PutObject(key string, data []byte) error {
+	atomic.AddInt64(&c.puts, 1)
+	return c.store.PutObject(key, data)
+}
+
+/*
+ObjectStore method that counts the request and passes it to the wrapped store.
+*/
+func (c *countingStore) DeleteObject(key string) error {
+	atomic.AddInt64(&c.dels, 1)
+	return c.store.DeleteObject(key)
+}
+
+/*
+CacheTable method that counts the request and passes it to the wrapped store.
+*/
+func (c *countingStore) GetItem(key string) ([]byte, error) {
+	atomic.AddInt64(&c.gets, 1)
+	return c.store.GetItem(key)
+}
+
+/*
+CacheTable method that counts the request and passes it to the wrapped store.
+*/
+func (c *countingStore) PutItem(key string, data []byte) error {
+	atomic.AddInt64(&c.puts, 1)
+	return c.store.PutItem(key, data)
+}
+
+/*
+CacheTable method that counts the request and passes it to the wrapped store.
+*/
+func (c *countingStore) DeleteItem(key string) ([]byte, error) {
+	atomic.AddInt64(&c.dels, 1)
+	return c.store.DeleteItem(key)
+}
+
+/*
+Clears the request counts.
+*/
+func (c *countingStore) reset() {
+	atomic.StoreInt64(&c.gets, 0)
+	atomic.StoreInt64(&c.puts, 0)
+	atomic.StoreInt64(&c.dels, 0)
+}
+
+/*
+Reports the number of requests made per benchmark iteration, under the given name.
+*/
+func (c *countingStore) report(b *testing.B, name string) {
+	n := float64(b.N)
+	b.ReportMetric(float64(atomic.LoadInt64(&c.gets))/n, name+"-gets/op")
+	b.ReportMetric(float64(atomic.LoadInt64(&c.puts))/n, name+"-puts/op")
+	b.ReportMetric(float64(atomic.LoadInt64(&c.dels))/n, name+"-deletes/op")
+}
+
+/*
+Sets up a new, empty file system like newTestFs, but with the store and cache table wrapped so
+that requests to them are counted.
+*/
+func newBenchFs(b *testing.B, cacheSize int) (*FS, *countingStore, *countingStore) {
+	b.Helper()
+	filesys, objects := newTestFs(b, cacheSize)
+	counted := &countingStore{store: objects}
+	table := &countingStore{store: cache.table.(*MemStore)}
+	store = counted
+	cache.table = table
+	return filesys, counted, table
+}
+
+/*
+Writes data to a new inode in kernel-sized chunks, returning the inode.
+*/
+func benchWrite(data []byte, inodeNum uint64) *Inode {
+	const chunkSize = 4096
+	inode := createInode(0)
+	inode.init(ROOT_INODE, inodeNum)
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		inode.writeToData(data[offset:end], uint64(offset))
+	}
+	return inode
+}
+
+/*
+Measures writing whole files sequentially, for several file and cache sizes. Each file is deleted
+again outside of the timer, and the request counts include the deletes.
+*/
+func BenchmarkSequentialWrite(b *testing.B) {
+	for _, fileSize := range benchFileSizes {
+		for _, cacheSize := range benchCacheSizes {
+			b.Run("file="+strconv.Itoa(fileSize)+"/cache="+strconv.Itoa(cacheSize), func(b *testing.B) {
+				_, objects, table := newBenchFs(b, cacheSize)
+				data := testData(fileSize, 1)
+				b.SetBytes(int64(fileSize))
+				objects.reset()
+				table.reset()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					inode := benchWrite(data, 2)
+					b.StopTimer()
+					inode.deleteAllData()
+					b.StartTimer()
+				}
+				objects.report(b, "store")
+				table.report(b, "table")
+			})
+		}
+	}
+}
+
+/*
+Measures reading whole files sequentially in kernel-sized chunks, for several file and cache sizes.
+*/
+func BenchmarkSequentialRead(b *testing.B) {
+	for _, fileSize := range benchFileSizes {
+		for _, cacheSize := range benchCacheSizes {
+			b.Run("file="+strconv.Itoa(fileSize)+"/cache="+strconv.Itoa(cacheSize), func(b *testing.B) {
+				_, objects, table := newBenchFs(b, cacheSize)
+				inode := benchWrite(testData(fileSize, 1), 2)
+				b.SetBytes(int64(fileSize))
+				objects.reset()
+				table.reset()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for offset := 0; offset < fileSize; offset += 4096 {
+						size := 4096
+						if offset+size > fileSize {
+							size = fileSize - offset
+						}
+						inode.readFromData(uint64(offset), uint64(size))
+					}
+				}
+				objects.report(b, "store")
+				table.report(b, "table")
+			})
+		}
+	}
+}
+
+/*
+Measures 4KB reads at random offsets in a file of 64 blocks, showing how the hit rate of the LRU
+cache changes with its size.
+*/
+func BenchmarkRandomRead(b *testing.B) {
+	fileSize := 64 * int(BLOCK_SIZE)
+	for _, cacheSize := range benchCacheSizes {
+		b.Run("cache="+strconv.Itoa(cacheSize), func(b *testing.B) {
+			_, objects, table := newBenchFs(b, cacheSize)
+			inode := benchWrite(testData(fileSize, 1), 2)
+			r := rand.New(rand.NewSource(1))
+			b.SetBytes(4096)
+			objects.reset()
+			table.reset()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				inode.readFromData(uint64(r.Intn(fileSize-4096)), 4096)
+			}
+			objects.report(b, "store")
+			table.report(b, "table")
+		})
+	}
+}
+
+/*
+Measures small create/write/read requests issued concurrently through the FUSE handlers, with
+several numbers of goroutines per CPU. The handlers are serialized by fsLock, so this shows the cost
+of contention rather than any speedup.
+*/
+func BenchmarkParallelHandlers(b *testing.B) {
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run("parallelism="+strconv.Itoa(parallelism), func(b *testing.B) {
+			filesys, _, _ := newBenchFs(b, 64)
+			root := testRoot(b, filesys)
+			ctx := context.Background()
+			data := testData(8*1000, 1)
+			var worker int64
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				name := "file" + strconv.FormatInt(atomic.AddInt64(&worker, 1), 10)
+				for pb.Next() {
+					_, handle, err := root.Create(ctx, &fuse.CreateRequest{Name: name}, &fuse.CreateResponse{})
+					if err != nil {
+						b.Errorf("Create: %v", err)
+						return
+					}
+					fh := handle.(*FileHandle)
+					fh.Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{})
+					fh.Read(ctx, &fuse.ReadRequest{Size: 4096}, &fuse.ReadResponse{})
+					fh.Release(ctx, &fuse.ReleaseRequest{})
+				}
+			})
+		})
+	}
+}
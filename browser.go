@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// the prefix of the URLs of the pages of the file browser
+const HTTP_BROWSE_PREFIX string = "/browse/"
+
+/*
+Struct holding what a page of the file browser shows: the entries of a directory, or the metadata
+of a file.
+*/
+type browserPage struct {
+	Path    string
+	Crumbs  []browserLink // the directories above Path, each linking to its page
+	Entries []browserEntry
+	File    *browserFile
+}
+
+/*
+Struct representing a link to a page of the file browser or a download.
+*/
+type browserLink struct {
+	Name string
+	URL  string
+}
+
+/*
+Struct representing an entry in a directory page.
+*/
+type browserEntry struct {
+	httpDirEntry
+	URL string
+}
+
+/*
+Struct holding the metadata shown on a file page.
+*/
+type browserFile struct {
+	Size        uint64
+	Mtime       time.Time
+	Inode       uint64
+	DataBlocks  uint64
+	DownloadURL string
+}
+
+var browserTemplate = template.Must(template.New("browser").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 MST") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Path}} - CloudFusion</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em; text-align: left; }
+td.size { text-align: right; }
+</style>
+</head>
+<body>
+<h1>{{range .Crumbs}}<a href="{{.URL}}">{{.Name}}</a>{{end}}</h1>
+{{if .File}}
+<table>
+<tr><th>Size</th><td>{{.File.Size}} bytes</td></tr>
+<tr><th>Modified</th><td>{{time .File.Mtime}}</td></tr>
+<tr><th>Inode</th><td>{{.File.Inode}}</td></tr>
+<tr><th>Data blocks</th><td>{{.File.DataBlocks}}</td></tr>
+</table>
+<p><a href="{{.File.DownloadURL}}">Download</a></p>
+{{else}}
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td class="size">{{if not .Dir}}{{.Size}}{{end}}</td><td>{{time .Mtime}}</td></tr>
+{{else}}<tr><td colspan="3">empty directory</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+/*
+Returns the URL of path p under prefix, with each of its names escaped.
+*/
+func browserURL(prefix string, p string) string {
+	return (&url.URL{Path: prefix + strings.TrimPrefix(p, "/")}).EscapedPath()
+}
+
+/*
+Returns links to the pages of the root and each directory down to path p.
+*/
+func browserCrumbs(p string) []browserLink {
+	crumbs := []browserLink{{Name: "/", URL: HTTP_BROWSE_PREFIX}}
+	if p == "/" {
+		return crumbs
+	}
+	names := strings.Split(p[1:], "/")
+	for i, name := range names {
+		crumbs = append(crumbs, browserLink{Name: name, URL: browserURL(HTTP_BROWSE_PREFIX, strings.Join(names[:i+1], "/"))})
+		if i < len(names)-1 {
+			crumbs[len(crumbs)-1].Name += "/"
+		}
+	}
+	return crumbs
+}
+
+/*
+Serves the page of the file browser for the directory or file at path p.
+*/
+func (g *httpGateway) browse(w http.ResponseWriter, r *http.Request, p string) {
+	node, err := g.lookup(p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	page := &browserPage{Path: p, Crumbs: browserCrumbs(p)}
+	switch node := node.(type) {
+	case *Dir:
+		entries, err := listDir(node)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		for _, entry := range entries {
+			page.Entries = append(page.Entries, browserEntry{
+				httpDirEntry: entry,
+				URL:          browserURL(HTTP_BROWSE_PREFIX, path.Join(p, entry.Name)),
+			})
+		}
+	case *File:
+		var attr fuse.Attr
+		err = node.Attr(context.Background(), &attr)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		fsLock.Lock()
+		dataBlocks := node.inode.numDataBlocks()
+		fsLock.Unlock()
+		page.File = &browserFile{
+			Size:        attr.Size,
+			Mtime:       attr.Mtime,
+			Inode:       node.inodeNum,
+			DataBlocks:  dataBlocks,
+			DownloadURL: browserURL(HTTP_FILES_PREFIX, p),
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	browserTemplate.Execute(w, page)
+}
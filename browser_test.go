@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+/*
+Browses a directory and a file through the file browser, and checks that it is read-only.
+*/
+func TestBrowser(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	writer := newHTTPGateway(filesys, "")
+	httpDo(writer, "PUT", "/files/my%20dir/", nil)
+	httpDo(writer, "PUT", "/files/my%20dir/a&b.txt", []byte("hello"))
+
+	g := newHTTPGateway(filesys, "secret")
+	g.browser = true
+	if rec := httpDo(g, "GET", "/browse/", nil); rec.Code != http.StatusUnauthorized || rec.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("GET without a password: status %d, want 401 with a challenge", rec.Code)
+	}
+	auth := "Basic " + "dXNlcjpzZWNyZXQ=" // user:secret
+	if rec := httpDo(g, "GET", "/", nil, "Authorization", auth); rec.Code != http.StatusFound {
+		t.Errorf("GET of / returned status %d, want a redirect", rec.Code)
+	}
+
+	rec := httpDo(g, "GET", "/browse/my%20dir", nil, "Authorization", auth)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `href="/browse/my%20dir/a&amp;b.txt"`) {
+		t.Fatalf("directory page: status %d\n%s", rec.Code, rec.Body)
+	}
+	rec = httpDo(g, "GET", "/browse/my%20dir/a&b.txt", nil, "Authorization", auth)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "5 bytes") || !strings.Contains(body, `href="/files/my%20dir/a&amp;b.txt"`) {
+		t.Fatalf("file page: status %d\n%s", rec.Code, body)
+	}
+	if rec := httpDo(g, "GET", "/files/my%20dir/a&b.txt", nil, "Authorization", auth); rec.Body.String() != "hello" {
+		t.Errorf("download returned %q", rec.Body)
+	}
+	if rec := httpDo(g, "DELETE", "/files/my%20dir/a&b.txt", nil, "Authorization", auth); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE through the file browser: status %d, want 405", rec.Code)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"golang.org/x/net/context"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the key of OpTimeouts in the config giving the budget of the kinds of requests it does not name
+const OP_TIMEOUT_DEFAULT string = "*"
+
+// the longest each kind of request (by the name its latency is tracked under, e.g. "Attr" or
+// "Read") may spend on the file system once it holds fsLock, from the config. The AWS calls a
+// request makes once its budget runs out are aborted, so that it fails with EIO rather than leaving
+// "ls" hanging on a wedged connection. Kinds of requests without a budget have no limit.
+var OP_TIMEOUTS map[string]time.Duration
+
+// the contexts that the AWS calls of each goroutine are made with, by the id of the goroutine: that
+// of the request it serves holding fsLock, so that the calls are canceled along with it (as when
+// the kernel interrupts it) and carry its values, and canceled too when its budget runs out, or one
+// given with useAWSContext. They are kept by goroutine rather than passed down through the cache
+// and block layers, and by goroutine rather than for whichever request holds fsLock, so that the
+// calls of goroutines working in the background meanwhile, such as those deleting or prefetching
+// blocks, are not aborted along with it.
+var awsContexts sync.Map
+
+/*
+Returns the budgets given by OpTimeouts in the config, or an error if one is not a duration.
+*/
+func parseOpTimeouts(timeouts map[string]string) (map[string]time.Duration, error) {
+	budgets := make(map[string]time.Duration, len(timeouts))
+	for op, timeout := range timeouts {
+		budget, err := time.ParseDuration(timeout)
+		if err != nil || budget <= 0 {
+			return nil, fmt.Errorf("OpTimeouts must give durations such as \"2s\", not %q for %s.", timeout, op)
+		}
+		budgets[op] = budget
+	}
+	return budgets, nil
+}
+
+/*
+Returns the budget of requests of kind op, or 0 if they have none.
+*/
+func opTimeout(op string) time.Duration {
+	if budget, ok := OP_TIMEOUTS[op]; ok {
+		return budget
+	}
+	return OP_TIMEOUTS[OP_TIMEOUT_DEFAULT]
+}
+
+/*
+Starts the budget of a request of kind op with context ctx, which must hold fsLock, returning the
+function that ends it, counting the request as timed out if its budget ran out. Handlers defer the
+function right after taking fsLock, as in defer startBudget(ctx, "Attr")(). Root, which is called
+without a context, passes context.Background().
+*/
+func startBudget(ctx context.Context, op string) func() {
+	budget := opTimeout(op)
+	if budget <= 0 {
+		return useAWSContext(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	restore := useAWSContext(ctx)
+	return func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			requests.timedOut(op)
+			fmt.Printf("%s ran out of its budget of %s\n", op, budget)
+		}
+		restore()
+		cancel()
+	}
+}
+
+/*
+Makes the AWS calls of the calling goroutine with ctx until the returned function is called, which
+puts back the context it used before. Goroutines working in the background defer
+useAWSContext(context.Background())() to make clear that their calls are not those of a request.
+*/
+func useAWSContext(ctx context.Context) func() {
+	id := goroutineID()
+	previous, had := awsContexts.Load(id)
+	awsContexts.Store(id, ctx)
+	return func() {
+		if had {
+			awsContexts.Store(id, previous)
+		} else {
+			awsContexts.Delete(id)
+		}
+	}
+}
+
+/*
+Returns the id of the calling goroutine, which the runtime only gives in the header of its stack
+trace, "goroutine 12 [running]:".
+*/
+func goroutineID() uint64 {
+	var buf [64]byte
+	header := bytes.TrimPrefix(buf[:runtime.Stack(buf[:], false)], []byte("goroutine "))
+	if end := bytes.IndexByte(header, ' '); end >= 0 {
+		header = header[:end]
+	}
+	id, _ := strconv.ParseUint(string(header), 10, 64)
+	return id
+}
+
+/*
+Returns the context to make AWS calls for blocks and metadata with: that of the request the calling
+goroutine serves, or given it with useAWSContext, or one that is never canceled otherwise.
+*/
+func awsContext() aws.Context {
+	if ctx, ok := awsContexts.Load(goroutineID()); ok {
+		return ctx.(context.Context)
+	}
+	return context.Background()
+}
+
+/*
+Returns whether the request the calling goroutine serves was interrupted or ran out of its budget,
+so that loops fetching one block after another stop rather than make calls that are only aborted in
+turn.
+*/
+func requestDone() bool {
+	return awsContext().Err() != nil
+}
+
+/*
+Returns the error for the request the calling goroutine serves if it was cut short: fuse.EINTR if
+the kernel interrupted it, as when a read is Ctrl-C'd, or fuse.EIO if it ran out of its budget.
+Returns nil if it was not cut short.
+*/
+func requestErr() error {
+	switch awsContext().Err() {
+	case nil:
+		return nil
+	case context.Canceled:
+		return fuse.EINTR
+	default:
+		return fuse.EIO
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+/*
+Checks that requests with a budget make their AWS calls with a context that is canceled when it runs
+out, and counted as timed out, that the context is never canceled between requests or for kinds of
+requests without a budget, and that OP_TIMEOUT_DEFAULT gives the budget of kinds not named.
+*/
+func TestOpBudgets(t *testing.T) {
+	defer func() { OP_TIMEOUTS = nil }()
+	var err error
+	OP_TIMEOUTS, err = parseOpTimeouts(map[string]string{"Attr": "20ms", OP_TIMEOUT_DEFAULT: "1m"})
+	if err != nil {
+		t.Fatalf("parseOpTimeouts: %v", err)
+	}
+	if _, err := parseOpTimeouts(map[string]string{"Read": "soon"}); err == nil {
+		t.Fatalf("a budget that is not a duration was taken")
+	}
+	if opTimeout("Read") != time.Minute || opTimeout("Attr") != 20*time.Millisecond {
+		t.Fatalf("Read has budget %s and Attr %s", opTimeout("Read"), opTimeout("Attr"))
+	}
+
+	requests = newOpTracker()
+	end := startBudget(context.Background(), "Attr")
+	ctx := awsContext()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Fatalf("the AWS calls of a request with a budget have no deadline")
+	}
+	<-ctx.Done()
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Fatalf("the context of a request that ran out of its budget has error %v", ctx.Err())
+	}
+	end()
+	if awsContext().Err() != nil {
+		t.Fatalf("the context is still canceled after the request ended")
+	}
+	if _, _, _, ops := requests.snapshot(); ops["Attr"] == nil || ops["Attr"].TimedOut != 1 {
+		t.Fatalf("the request that ran out of its budget was not counted: %+v", ops["Attr"])
+	}
+
+	OP_TIMEOUTS = nil
+	end = startBudget(context.Background(), "Read")
+	if _, ok := awsContext().Deadline(); ok {
+		t.Fatalf("a request without a budget has a deadline")
+	}
+	end()
+}
+
+/*
+Checks that the AWS calls of a request are made with its context, so that they are canceled when it
+is, with or without a budget, and carry its values, and that those of other goroutines are not.
+*/
+func TestRequestContext(t *testing.T) {
+	defer func() { OP_TIMEOUTS = nil }()
+	type traceKey struct{}
+	for _, timeouts := range []map[string]time.Duration{nil, {"Read": time.Minute}} {
+		OP_TIMEOUTS = timeouts
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), traceKey{}, "trace"))
+		end := startBudget(ctx, "Read")
+		if awsContext().Value(traceKey{}) != "trace" {
+			t.Fatalf("the AWS calls of a request do not carry its values")
+		}
+		cancel()
+		if awsContext().Err() != context.Canceled {
+			t.Fatalf("the context of a canceled request has error %v", awsContext().Err())
+		}
+		background := make(chan error)
+		go func() { background <- awsContext().Err() }()
+		if err := <-background; err != nil {
+			t.Fatalf("a goroutine running alongside a canceled request has a context with error %v", err)
+		}
+		end()
+		if awsContext().Err() != nil {
+			t.Fatalf("the context is still canceled after the request ended")
+		}
+	}
+}
+
+/*
+Checks that a read of a file interrupted by the kernel fails with EINTR without reading its blocks,
+and that the next read of the file reads it whole.
+*/
+func TestInterruptedRead(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	data := testData(int(FIRST_SINGLY_INDIRECT_BYTE+4*BLOCK_SIZE), 1)
+	file := writeTestFile(t, root, "large", data, 1<<16)
+	cache.empty()
+	cache = newCache(newMemStore(), 64)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handle, err := file.Open(context.Background(), &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := handle.(*FileHandle)
+	// Open reads the generation block of the file, which the read does not count against
+	opened := len(cache.keyHash)
+	resp := &fuse.ReadResponse{}
+	if err := fh.Read(ctx, &fuse.ReadRequest{Size: len(data)}, resp); err != fuse.EINTR {
+		t.Fatalf("the interrupted read returned %v, want EINTR", err)
+	}
+	if read := len(cache.keyHash) - opened; len(resp.Data) != 0 || read != 0 {
+		t.Fatalf("the interrupted read returned %d bytes and read %d blocks", len(resp.Data), read)
+	}
+	if err := fh.Read(context.Background(), &fuse.ReadRequest{Size: len(data)}, resp); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if !bytes.Equal(resp.Data, data[:len(resp.Data)]) || len(resp.Data) == 0 {
+		t.Fatalf("the read after the interrupted one differs")
+	}
+}
@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"container/list"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"os"
 	"time"
 )
@@ -16,9 +14,17 @@ import (
 const READ_WRITE_CAPACITY int64 = 100
 
 type Cache struct {
+	table             CacheTable
 	cacheCapacity     int
 	recentlyUsedQueue *list.List               // stores cache entries so that the front is the least recently used
 	keyHash           map[string]*list.Element // maps from file name keys to elements of the queue
+	lockOnEvict       map[string]bool          // keys of the blocks to lock in the store when they are evicted
+	dirtySince        map[string]time.Time     // when each block changed since it was last written to the store
+	pinned            map[string]bool          // keys of the blocks evicted only once every block in the cache is pinned
+	readaheadShift    uint                     // how many times the readahead window is halved, see readaheadWindow
+	lastThrottle      time.Time                // when DynamoDB last throttled the cache, or the window last grew
+	storeRetryTime    time.Time                // when to next try to evict a block after S3 did not take one
+	fetching          map[string]bool          // keys of the blocks being read outside fsLock, see startFetch
 }
 
 /*
@@ -41,60 +47,73 @@ func initializeCache(cacheSize int) *Cache {
 			isReady, _ = checkTableReady(DYNAMO_TABLE_NAME, client)
 		}
 	}
-	cache := &Cache{
+	return newCache(newDynamoTable(client, DYNAMO_TABLE_NAME), cacheSize)
+}
+
+/*
+Returns a pointer to a new, empty cache of blocks held in table.
+*/
+func newCache(table CacheTable, cacheSize int) *Cache {
+	return &Cache{
+		table:             table,
 		cacheCapacity:     cacheSize,
 		keyHash:           make(map[string]*list.Element),
 		recentlyUsedQueue: new(list.List),
+		lockOnEvict:       make(map[string]bool),
+		dirtySince:        make(map[string]time.Time),
+		pinned:            make(map[string]bool),
+		fetching:          make(map[string]bool),
+	}
+}
+
+/*
+Adds a changed data block to the DynamoDB table, where it is the only copy of the change until it is
+evicted or flushed. See putBlock.
+*/
+func (c *Cache) addBlock(data *DataBlock, key string) error {
+	err := c.putBlock(data, key)
+	if err == nil {
+		if _, ok := c.dirtySince[key]; !ok {
+			c.dirtySince[key] = time.Now()
+		}
 	}
-	return cache
+	return err
+}
+
+/*
+Adds a data block that was just read from S3 to the DynamoDB table. See putBlock.
+*/
+func (c *Cache) fillBlock(data *DataBlock, key string) error {
+	return c.putBlock(data, key)
 }
 
 /*
 Adds a data block to the DynamoDB table. If the block was already in the cache, it is
 moved to the back of the eviction queue. Otherwise, a new block is added to the eviction queue,
-and the front of the queue is evicted if the queue is full.
+after making room for it (see makeRoom) if the queue is full.
 */
-func (c *Cache) addBlock(data *DataBlock, key string) error {
-	params := &dynamodb.PutItemInput{
-		Item: map[string]*dynamodb.AttributeValue{
-			"Name": {
-				S: aws.String(key),
-			},
-			"Value": {
-				B: data.Data[:],
-			},
-		},
-		TableName: aws.String(DYNAMO_TABLE_NAME),
+func (c *Cache) putBlock(data *DataBlock, key string) error {
+	delete(c.fetching, key)
+	elt := c.keyHash[key]
+	if elt == nil {
+		// cache miss, so adding a new block, thus must check capacity. If there is no room, the
+		// block is added anyway, so that the change is not lost, and under OUTAGE_FAIL the next
+		// request that writes fails instead
+		c.makeRoom()
 	}
-	client := getDynamoClient()
-	_, err := client.PutItem(params)
+	err := c.table.PutItem(key, data.Data[:])
 	if err != nil {
+		c.noteError(err)
 		return err
+	}
+	if elt == nil {
+		// new block previously in cache, so add it at front
+		c.keyHash[key] = c.recentlyUsedQueue.PushBack(key)
 	} else {
-		elt := c.keyHash[key]
-		if elt == nil {
-			// cache miss, so adding a new block, thus must check capacity
-			if c.recentlyUsedQueue.Len() == c.cacheCapacity {
-				// cache is full, evict LRU element
-				// fmt.Printf("about to evict with queue length: %d, capacity: %d\n", c.recentlyUsedQueue.Len(), c.cacheCapacity)
-
-				evictElt := c.recentlyUsedQueue.Front()
-				evictKey := c.recentlyUsedQueue.Remove(evictElt).(string)
-				c.keyHash[evictKey] = nil
-				c.evictBlock(evictKey)
-			}
-			// new block previously in cache, so add it at front
-			newElt := c.recentlyUsedQueue.PushBack(key)
-			c.keyHash[key] = newElt
-			return nil
-		} else {
-			// cache hit, so do not need to check capacity
-			// just move block to front
-			c.recentlyUsedQueue.MoveToBack(elt)
-			return nil
-		}
+		// cache hit, so just move block to front
+		c.recentlyUsedQueue.MoveToBack(elt)
 	}
-
+	return nil
 }
 
 /*
@@ -102,23 +121,17 @@ Deletes a block from DynamoDB without writing to S3, for use in rm calls. Also r
 from the eviction queue.
 */
 func (c *Cache) deleteBlock(key string) error {
-	// fmt.Println("doing cache.deleteBlock for key: " + key)
+	delete(c.fetching, key)
 	elt := c.keyHash[key]
 	if elt == nil {
 		return errors.New("Failed to removeBlock from cache.")
 	}
 	c.recentlyUsedQueue.Remove(elt)
 	c.keyHash[key] = nil
-	params := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"Name": {
-				S: aws.String(key),
-			},
-		},
-		TableName: aws.String(DYNAMO_TABLE_NAME),
-	}
-	dynamoClient := getDynamoClient()
-	_, err := dynamoClient.DeleteItem(params)
+	delete(c.lockOnEvict, key)
+	delete(c.dirtySince, key)
+	delete(c.pinned, key)
+	_, err := c.table.DeleteItem(key)
 	if err != nil {
 		fmt.Println("Failed to removeBlock from cache: " + err.Error())
 		return errors.New("Failed to removeBlock from cache: " + err.Error())
@@ -128,54 +141,150 @@ func (c *Cache) deleteBlock(key string) error {
 
 /*
 Writes the contents of the entire DynamoDB table to S3, and deletes all entries from the DynamoDB table.
+Each block is removed from the eviction queue once it is written, so that the cache can be used again.
 */
 func (c *Cache) empty() error {
-	for e := c.recentlyUsedQueue.Front(); e != nil; e = e.Next() {
+	for e := c.recentlyUsedQueue.Front(); e != nil; {
+		next := e.Next()
 		key := e.Value.(string)
-		err := c.evictBlock(key)
+		_, err := c.evictBlock(key)
 		if err != nil {
 			return err
 		}
+		c.recentlyUsedQueue.Remove(e)
+		c.keyHash[key] = nil
+		e = next
 	}
 	return nil
 }
 
 /*
-Removes a block from the DynamoDB table and writes it to S3.
+Removes a block from the DynamoDB table and writes it to S3. If S3 does not take it, the block is
+put back in the table, so that it is not lost. Returns whether the error, if any, was S3 not taking
+the block, which may pass, rather than the table failing.
 */
-func (c *Cache) evictBlock(key string) error {
-	// fmt.Println("doing cache.evictBlock for key: " + key)
-	params := &dynamodb.DeleteItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"Name": {
-				S: aws.String(key),
-			},
-		},
-		TableName:    aws.String(DYNAMO_TABLE_NAME),
-		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
-	}
-	dynamoClient := getDynamoClient()
-	resp, err := dynamoClient.DeleteItem(params)
-	if err != nil || resp.Attributes["Value"] == nil {
+func (c *Cache) evictBlock(key string) (bool, error) {
+	debugBlock("cache evict key=%s", key)
+	data, err := c.table.DeleteItem(key)
+	if err != nil {
 		fmt.Println("Failed to removeBlock from cache: " + err.Error())
-		return errors.New("Failed to removeBlock from cache: " + err.Error())
+		return false, errors.New("Failed to removeBlock from cache: " + err.Error())
 	}
+	if c.lockOnEvict[key] {
+		err = putLockedObject(key, data)
+	} else {
+		err = store.PutObject(key, data)
+	}
+	if err != nil {
+		restoreErr := c.table.PutItem(key, data)
+		if restoreErr != nil {
+			fmt.Println("VERY BAD ERROR: block " + key + " was lost putting it back in the cache: " + restoreErr.Error())
+		}
+		return true, err
+	}
+	delete(c.lockOnEvict, key)
+	delete(c.dirtySince, key)
+	delete(c.pinned, key)
+	return false, nil
+}
 
-	data := resp.Attributes["Value"].B
+/*
+Writes the blocks that changed at least maxAge ago, and have not been written to S3 since, to S3,
+leaving them in the DynamoDB table, so that a loss of the table loses no change older than maxAge.
+*/
+func (c *Cache) flush(maxAge time.Duration) error {
+	for _, key := range c.dueBlocks(maxAge) {
+		err := c.flushBlock(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Returns the keys of the blocks that changed at least maxAge ago and have not been written to S3
+since.
+*/
+func (c *Cache) dueBlocks(maxAge time.Duration) []string {
+	var keys []string
+	now := time.Now()
+	for key, since := range c.dirtySince {
+		if now.Sub(since) >= maxAge {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
 
-	s3Client := getClient()
-	reader := bytes.NewReader(data)
-	intPtr := new(int64)
-	*intPtr = int64(reader.Len())
-	_, err = s3Client.PutObject(&s3.PutObjectInput{
-		Bucket:        aws.String(S3_BUCKET_NAME),
-		Key:           aws.String(key),
-		Body:          reader,
-		ContentLength: intPtr,
-	})
+/*
+Writes the block with key to S3, leaving it in the DynamoDB table, if it has changed since it was
+last written there.
+*/
+func (c *Cache) flushBlock(key string) error {
+	if _, dirty := c.dirtySince[key]; !dirty {
+		return nil
+	}
+	debugBlock("cache flush key=%s", key)
+	data, err := c.table.GetItem(key)
+	if err != nil {
+		return errors.New("Failed to read block " + key + " to flush from cache: " + err.Error())
+	}
+	if c.lockOnEvict[key] {
+		// it stays marked, since a change made later has to be locked too
+		err = putLockedObject(key, data)
+	} else {
+		err = store.PutObject(key, data)
+	}
+	if err != nil {
+		return err
+	}
+	delete(c.dirtySince, key)
 	return nil
 }
 
+/*
+Returns the number of blocks that have changed since they were last written to S3, and how long
+ago the oldest of them changed, which is how much would be lost if the DynamoDB table were.
+*/
+func (c *Cache) dirtyBlocks() (int, time.Duration) {
+	var oldest time.Duration
+	now := time.Now()
+	for _, since := range c.dirtySince {
+		if age := now.Sub(since); age > oldest {
+			oldest = age
+		}
+	}
+	return len(c.dirtySince), oldest
+}
+
+/*
+Keeps the block with key in the cache until it is deleted or unpinned, unless the cache fills up with
+pinned blocks. Does nothing if the block is not in the cache.
+*/
+func (c *Cache) pin(key string) {
+	if c.keyHash[key] != nil {
+		c.pinned[key] = true
+	}
+}
+
+/*
+Lets the block with key be evicted like any other.
+*/
+func (c *Cache) unpin(key string) {
+	delete(c.pinned, key)
+}
+
+/*
+Moves the block with key to the front of the eviction queue, so that it is the next to be evicted
+rather than a block that was used before it. Does nothing if the block is not in the cache.
+*/
+func (c *Cache) demote(key string) {
+	if elt := c.keyHash[key]; elt != nil {
+		c.recentlyUsedQueue.MoveToFront(elt)
+	}
+}
+
 /*
 Gets the associated data from DynamoDB, and moves the block to the back of the eviction queue. This method returns an error
 if the relevant block is not in cache.
@@ -186,23 +295,14 @@ func (c *Cache) getBlock(key string) ([]byte, error) {
 		return nil, errors.New("Error doing GetItem to DynamoDB (cache miss).")
 	}
 
-	params := &dynamodb.GetItemInput{
-		Key: map[string]*dynamodb.AttributeValue{
-			"Name": {
-				S: aws.String(key),
-			},
-		},
-		TableName:      aws.String(DYNAMO_TABLE_NAME),
-		ConsistentRead: aws.Bool(true),
-	}
-	client := getDynamoClient()
-	resp, err := client.GetItem(params)
-	if err != nil || resp.Item["Value"] == nil {
+	data, err := c.table.GetItem(key)
+	if err != nil {
+		c.noteError(err)
 		return nil, errors.New("Error doing GetItem to DynamoDB on supposed cache hit.")
 	}
 
 	c.recentlyUsedQueue.MoveToBack(elt)
-	return resp.Item["Value"].B, err
+	return data, nil
 }
 
 /*
@@ -210,7 +310,7 @@ Does a DescribeTable request and returns a bool representing whether or not the
 */
 func checkTableReady(name string, client *dynamodb.DynamoDB) (bool, error) {
 	describeParams := &dynamodb.DescribeTableInput{
-		TableName: aws.String(DYNAMO_TABLE_NAME), // Required
+		TableName: aws.String(name), // Required
 	}
 	resp, err := client.DescribeTable(describeParams)
 	if err != nil {
@@ -221,8 +321,8 @@ func checkTableReady(name string, client *dynamodb.DynamoDB) (bool, error) {
 }
 
 /*
-Creates a new table with the name specified from the config file. Hard-coded to use 100 units of read/write
-capacity (which is more than the free amount).
+Creates a new table with the name specified from the config file, with the tags and encryption of
+the config. Hard-coded to use 100 units of read/write capacity (which is more than the free amount).
 */
 func createNewTable(name string, client *dynamodb.DynamoDB) (*dynamodb.CreateTableOutput, error) {
 	params := &dynamodb.CreateTableInput{
@@ -244,5 +344,5 @@ func createNewTable(name string, client *dynamodb.DynamoDB) (*dynamodb.CreateTab
 		},
 		TableName: aws.String(name), // Required
 	}
-	return client.CreateTable(params)
+	return client.CreateTable(provisionTable(params))
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/context"
+	"strconv"
+	"syscall"
+)
+
+// the extended attribute giving how a file's blocks are cached, e.g. set with
+// setfattr -n user.cloudfusion.cache -v none FILE
+const CACHE_XATTR string = "user.cloudfusion.cache"
+
+// the extended attribute giving how many blocks to read into the cache ahead of each read of a file
+const READAHEAD_XATTR string = "user.cloudfusion.readahead"
+
+// the values of CACHE_XATTR and the hints they set
+var cacheHintNames = map[string]int8{
+	"none": FILE_CACHE_NONE,
+	"pin":  FILE_CACHE_PIN,
+}
+
+/*
+Returns the value of CACHE_XATTR for the given hint, or "" if none is set.
+*/
+func cacheHintName(hint int8) string {
+	for name, h := range cacheHintNames {
+		if hint == h {
+			return name
+		}
+	}
+	return ""
+}
+
+/*
+Reads the data block with blockNum of the inode, following its cache hint: the blocks of files that
+are not to be cached are read from S3 without being added to the cache, unless they are already in
+it, and those of pinned files are pinned once they are in it.
+*/
+func (i *Inode) getBlockData(blockNum uint64) (*DataBlock, error) {
+	key := genDataKey(blockNum)
+	switch i.cacheHint() {
+	case FILE_CACHE_NONE:
+		if cache.keyHash[key] != nil {
+			data, err := getData(blockNum)
+			cache.demote(key)
+			return data, err
+		}
+		debugBlock("uncached read block=%d key=%s", blockNum, key)
+		data, err := getStoredDataByKey(key)
+		if err == nil && fileKeys != nil {
+			err = fileKeys.open(DATA_KEY_KIND, blockNum, data.Data[:])
+		}
+		return data, err
+	case FILE_CACHE_PIN:
+		data, err := getData(blockNum)
+		cache.pin(key)
+		return data, err
+	}
+	return getData(blockNum)
+}
+
+/*
+Returns the length bytes at offset of the data block with blockNum of a file whose blocks are not to
+be cached, getting only them from S3 with a Range GET, so that sparse reads of a huge file do not
+download the whole of every block they touch. Returns false, for getBlockData to read the whole
+block, if the block is in the cache, if the store cannot get ranges, or if the blocks have keys of
+their own, since a block encrypted with its key can only be decrypted whole; the blocks of encrypted
+file systems are encrypted whole by the store, which then cannot get ranges either.
+*/
+func (i *Inode) getBlockRange(blockNum, offset, length uint64) ([]byte, bool) {
+	if i.cacheHint() != FILE_CACHE_NONE || length == BLOCK_SIZE || fileKeys != nil {
+		return nil, false
+	}
+	if _, ok := store.(RangeStore); !ok {
+		return nil, false
+	}
+	key := genDataKey(blockNum)
+	if cache.keyHash[key] != nil {
+		return nil, false
+	}
+	debugBlock("range read block=%d key=%s offset=%d length=%d", blockNum, key, offset, length)
+	data, err := getObjectRange(store, key, offset, length)
+	if err != nil {
+		fmt.Printf("Failed to read part of block %s, reading all of it: %v\n", key, err)
+		return nil, false
+	}
+	return data, true
+}
+
+/*
+Writes the data block with blockNum of the inode, following its cache hint. Writes go through the
+cache either way, so that small writes to a block are not each sent to S3, but the blocks of files
+that are not to be cached are the next to be evicted.
+*/
+func (i *Inode) putBlockData(blockNum uint64, data *DataBlock) error {
+	err := putData(blockNum, data)
+	if err != nil {
+		return err
+	}
+	switch i.cacheHint() {
+	case FILE_CACHE_NONE:
+		cache.demote(genDataKey(blockNum))
+	case FILE_CACHE_PIN:
+		cache.pin(genDataKey(blockNum))
+	}
+	return nil
+}
+
+/*
+Sets the cache hint of the inode, and applies it to the blocks of the file already in the cache:
+pinning them, unpinning them, or making them the next to be evicted.
+*/
+func (i *Inode) setCacheHint(hint int8) error {
+	i.IsDir = i.IsDir&^FILE_CACHE_HINTS | hint
+	return i.forEachBlock(func(blockNum uint64, indirect bool) error {
+		key := genDataKey(blockNum)
+		if indirect || cache.keyHash[key] == nil {
+			return nil
+		}
+		switch hint {
+		case FILE_CACHE_PIN:
+			cache.pin(key)
+		case FILE_CACHE_NONE:
+			cache.unpin(key)
+			cache.demote(key)
+		default:
+			cache.unpin(key)
+		}
+		return nil
+	})
+}
+
+/*
+Returns the number of the data block at index in the file, counting from the first block past the
+inode buffer, or 0 if it is in a hole. Mirrors forEachBlock.
+*/
+func (i *Inode) dataBlockNum(index uint64) (uint64, error) {
+	if index < NUM_DATA_BLOCKS {
+		return i.Data[index], nil
+	}
+	index -= NUM_DATA_BLOCKS
+	perBlock := BLOCK_POINTERS
+	span := perBlock
+	for _, slot := range []uint8{IND_BLOCK, DOUB_IND_BLOCK, TRIP_IND_BLOCK} {
+		if index < span {
+			blockNum := i.Data[slot]
+			for span > 1 && blockNum != 0 {
+				span /= perBlock
+				indBlock, err := getData(blockNum)
+				if err != nil {
+					return 0, err
+				}
+				j := index / span * 8
+				blockNum = binary.LittleEndian.Uint64(indBlock.Data[j : j+8])
+				index %= span
+			}
+			return blockNum, nil
+		}
+		index -= span
+		span *= perBlock
+	}
+	return 0, fmt.Errorf("block %d is past the triply indirect block", index)
+}
+
+/*
+Returns the value of the cache hint extended attribute name on the inode, or nil if it is not set.
+*/
+func cacheHintXattr(inode *Inode, name string) []byte {
+	switch name {
+	case CACHE_XATTR:
+		if hint := cacheHintName(inode.cacheHint()); hint != "" {
+			return []byte(hint)
+		}
+	case READAHEAD_XATTR:
+		if blocks := inode.readahead(); blocks != 0 {
+			return []byte(strconv.FormatUint(blocks, 10))
+		}
+	}
+	return nil
+}
+
+var _ = fs.NodeSetxattrer(&File{})
+
+/*
+FUSE method that sets the cache hint of the file with CACHE_XATTR, or its readahead in blocks, up
+to MAX_FILE_READAHEAD, with READAHEAD_XATTR.
+*/
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	defer trackOp("Setxattr")()
+	defer recoverPanic("Setxattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Setxattr")()
+	debugOp(f.path, "Setxattr", "inode=%d name=%s value=%q", f.inodeNum, req.Name, req.Xattr)
+	if err := health.check(); err != nil {
+		return err
+	}
+	switch req.Name {
+	case CACHE_XATTR:
+		hint, ok := cacheHintNames[string(req.Xattr)]
+		if !ok {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		err := f.inode.setCacheHint(hint)
+		if err != nil {
+			return err
+		}
+	case READAHEAD_XATTR:
+		blocks, err := strconv.ParseUint(string(req.Xattr), 10, 64)
+		if err != nil || blocks > MAX_FILE_READAHEAD {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		f.inode.IsDir = f.inode.IsDir&^FILE_READAHEAD_MASK | int8(blocks)<<FILE_READAHEAD_SHIFT
+	default:
+		return fuse.ENOTSUP
+	}
+	f.inode.changed()
+	return putInode(f.inode, f.inodeNum)
+}
+
+var _ = fs.NodeRemovexattrer(&File{})
+
+/*
+FUSE method that clears the cache hint or the readahead of the file.
+*/
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	defer trackOp("Removexattr")()
+	defer recoverPanic("Removexattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Removexattr")()
+	debugOp(f.path, "Removexattr", "inode=%d name=%s", f.inodeNum, req.Name)
+	if err := health.check(); err != nil {
+		return err
+	}
+	if cacheHintXattr(f.inode, req.Name) == nil {
+		return fuse.ErrNoXattr
+	}
+	if req.Name == CACHE_XATTR {
+		err := f.inode.setCacheHint(0)
+		if err != nil {
+			return err
+		}
+	} else {
+		f.inode.IsDir &^= FILE_READAHEAD_MASK
+	}
+	f.inode.changed()
+	return putInode(f.inode, f.inodeNum)
+}
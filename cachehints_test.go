@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+/*
+Sets the extended attribute name on file to value.
+*/
+func setFileXattr(file *File, name, value string) error {
+	return file.Setxattr(context.Background(), &fuse.SetxattrRequest{Name: name, Xattr: []byte(value)})
+}
+
+/*
+Returns the number of the data blocks of file that are in the cache.
+*/
+func cachedBlocks(t *testing.T, file *File) int {
+	t.Helper()
+	cached := 0
+	err := file.inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		if !indirect && cache.keyHash[genDataKey(blockNum)] != nil {
+			cached++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("forEachBlock: %v", err)
+	}
+	return cached
+}
+
+/*
+Checks that cache hints are kept in the inode, read back and listed as extended attributes, and
+that bad values are refused.
+*/
+func TestCacheHintXattrs(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "file", testData(1000, 1), 1000)
+
+	for _, bad := range [][2]string{{CACHE_XATTR, "always"}, {READAHEAD_XATTR, "16"}, {READAHEAD_XATTR, "x"}} {
+		if err := setFileXattr(file, bad[0], bad[1]); err == nil {
+			t.Fatalf("set %s to %q", bad[0], bad[1])
+		}
+	}
+	if err := setFileXattr(file, CACHE_XATTR, "pin"); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	if err := setFileXattr(file, READAHEAD_XATTR, "8"); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	inode, _ := getInode(file.inodeNum)
+	if inode.isDir() || inode.dirFlags() != 0 || inode.cacheHint() != FILE_CACHE_PIN || inode.readahead() != 8 {
+		t.Fatalf("stored inode has IsDir %#x", inode.IsDir)
+	}
+	node, _ := root.lookup(ctx, "file")
+	file = node.(*File)
+	list := new(fuse.ListxattrResponse)
+	file.Listxattr(ctx, new(fuse.ListxattrRequest), list)
+	if !bytes.Contains(list.Xattr, []byte(CACHE_XATTR)) || !bytes.Contains(list.Xattr, []byte(READAHEAD_XATTR)) {
+		t.Fatalf("Listxattr = %q", list.Xattr)
+	}
+	for name, want := range map[string]string{CACHE_XATTR: "pin", READAHEAD_XATTR: "8"} {
+		resp := new(fuse.GetxattrResponse)
+		err := file.Getxattr(ctx, &fuse.GetxattrRequest{Name: name}, resp)
+		if err != nil || string(resp.Xattr) != want {
+			t.Fatalf("Getxattr %s = %q, %v, want %q", name, resp.Xattr, err, want)
+		}
+	}
+
+	// the hints survive writing the file through a handle opened before they were removed
+	handle, _ := file.Open(ctx, new(fuse.OpenRequest), new(fuse.OpenResponse))
+	node, _ = root.lookup(ctx, "file")
+	other := node.(*File)
+	other.Removexattr(ctx, &fuse.RemovexattrRequest{Name: READAHEAD_XATTR})
+	other.Setxattr(ctx, &fuse.SetxattrRequest{Name: CACHE_XATTR, Xattr: []byte("none")})
+	handle.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	inode, _ = getInode(file.inodeNum)
+	if inode.cacheHint() != FILE_CACHE_NONE || inode.readahead() != 0 {
+		t.Fatalf("stored inode has IsDir %#x after release", inode.IsDir)
+	}
+	if err := other.Removexattr(ctx, &fuse.RemovexattrRequest{Name: READAHEAD_XATTR}); err != fuse.ErrNoXattr {
+		t.Fatalf("Removexattr of an unset hint returned %v", err)
+	}
+}
+
+/*
+Checks that reading a file that is not to be cached leaves the cache as it was, and that the blocks
+of a pinned file stay in the cache while a bigger file is read through it.
+*/
+func TestCacheHints(t *testing.T) {
+	filesys, _ := newTestFs(t, 8)
+	root := testRoot(t, filesys)
+	archiveData := testData(int(INODE_BUFFER_SIZE+20*BLOCK_SIZE), 1)
+	configData := testData(int(INODE_BUFFER_SIZE+3*BLOCK_SIZE), 2)
+	archive := writeTestFile(t, root, "archive", archiveData, 1<<16)
+	config := writeTestFile(t, root, "config", configData, 1<<16)
+	setFileXattr(archive, CACHE_XATTR, "none")
+	setFileXattr(config, CACHE_XATTR, "pin")
+	cache.empty()
+	cache = newCache(newMemStore(), 8)
+
+	data, err := config.inode.readFromData(0, config.inode.Size)
+	if err != nil || !bytes.Equal(data, configData) {
+		t.Fatalf("reading the pinned file: %v", err)
+	}
+	data, err = archive.inode.readFromData(0, archive.inode.Size)
+	if err != nil || !bytes.Equal(data, archiveData) {
+		t.Fatalf("reading the uncached file: %v", err)
+	}
+	if n := cachedBlocks(t, archive); n != 0 {
+		t.Fatalf("%d blocks of the uncached file are in the cache", n)
+	}
+	setFileXattr(archive, CACHE_XATTR, "pin")
+	archive.Removexattr(context.Background(), &fuse.RemovexattrRequest{Name: CACHE_XATTR})
+	archive.inode.readFromData(0, archive.inode.Size)
+	if n := cachedBlocks(t, config); n != 3 {
+		t.Fatalf("%d of the 3 blocks of the pinned file are in the cache", n)
+	}
+}
+
+/*
+ObjectStore that counts the whole objects and the bytes of the ranges got from the wrapped store.
+*/
+type rangeCountingStore struct {
+	*MemStore
+	gets       int
+	rangeBytes uint64
+}
+
+/*
+ObjectStore method that counts the request and passes it to the wrapped store.
+*/
+func (s *rangeCountingStore) GetObject(key string) ([]byte, error) {
+	s.gets++
+	return s.MemStore.GetObject(key)
+}
+
+/*
+RangeStore method that counts the bytes asked for and passes the request to the wrapped store.
+*/
+func (s *rangeCountingStore) GetObjectRange(key string, offset, length uint64) ([]byte, error) {
+	s.rangeBytes += length
+	return s.MemStore.GetObjectRange(key, offset, length)
+}
+
+/*
+Checks that reading part of a block of a file that is not to be cached gets only that part from the
+store, and that reading whole blocks, or reading a block that is in the cache, gets no ranges.
+*/
+func TestRangeReads(t *testing.T) {
+	filesys, objects := newTestFs(t, 8)
+	root := testRoot(t, filesys)
+	archiveData := testData(int(INODE_BUFFER_SIZE+8*BLOCK_SIZE), 1)
+	archive := writeTestFile(t, root, "archive", archiveData, 1<<16)
+	setFileXattr(archive, CACHE_XATTR, "none")
+	cache.empty()
+	cache = newCache(newMemStore(), 8)
+	counting := &rangeCountingStore{MemStore: objects}
+	store = counting
+	defer func() { store = objects }()
+
+	offset := INODE_BUFFER_SIZE + 5*BLOCK_SIZE + 1000
+	data, err := archive.inode.readFromData(offset, 100)
+	if err != nil || !bytes.Equal(data, archiveData[offset:offset+100]) {
+		t.Fatalf("reading part of a block: %v", err)
+	}
+	if counting.gets != 0 || counting.rangeBytes != 100 {
+		t.Fatalf("reading 100 bytes got %d objects and %d bytes of ranges", counting.gets, counting.rangeBytes)
+	}
+	data, _ = archive.inode.readFromData(INODE_BUFFER_SIZE+BLOCK_SIZE, BLOCK_SIZE)
+	if !bytes.Equal(data, archiveData[INODE_BUFFER_SIZE+BLOCK_SIZE:INODE_BUFFER_SIZE+2*BLOCK_SIZE]) || counting.gets != 1 || counting.rangeBytes != 100 {
+		t.Fatalf("reading a whole block got %d objects and %d bytes of ranges", counting.gets, counting.rangeBytes)
+	}
+
+	// a block in the cache is read from it, as it may hold changes not yet in the store
+	archive.inode.writeToData([]byte("changed"), offset)
+	data, _ = archive.inode.readFromData(offset, 7)
+	if string(data) != "changed" || counting.rangeBytes != 100 {
+		t.Fatalf("reading a changed block read %q with %d bytes of ranges", data, counting.rangeBytes)
+	}
+}
+
+/*
+Checks that reading the start of a file with a readahead reads the blocks that follow into the
+cache, including ones past the singly indirect block.
+*/
+func TestReadahead(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "file", testData(int(INODE_BUFFER_SIZE+16*BLOCK_SIZE), 1), 1<<16)
+	setFileXattr(file, READAHEAD_XATTR, "6")
+	cache.empty()
+	cache = newCache(newMemStore(), 16)
+
+	handle, _ := file.Open(ctx, new(fuse.OpenRequest), new(fuse.OpenResponse))
+	fh := handle.(*FileHandle)
+	// two reads in a row, the second ending in the 10th block, so that the readahead runs into the
+	// singly indirect block
+	for _, req := range []*fuse.ReadRequest{
+		{Offset: int64(INODE_BUFFER_SIZE + 8*BLOCK_SIZE), Size: int(BLOCK_SIZE)},
+		{Offset: int64(INODE_BUFFER_SIZE + 9*BLOCK_SIZE), Size: 100},
+	} {
+		if err := fh.Read(ctx, req, new(fuse.ReadResponse)); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	// the blocks are read ahead under fsLock, so the cache is only looked at with it held
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		fsLock.Lock()
+		cached := cachedBlocks(t, file)
+		fsLock.Unlock()
+		if cached >= 8 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	for index := uint64(0); index < 16; index++ {
+		blockNum, err := file.inode.dataBlockNum(index)
+		if err != nil {
+			t.Fatalf("dataBlockNum: %v", err)
+		}
+		cached := cache.keyHash[genDataKey(blockNum)] != nil
+		if cached != (index >= 8 && index <= 15) {
+			t.Fatalf("block %d cached: %v", index, cached)
+		}
+	}
+}
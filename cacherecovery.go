@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// the key of the object marking that a mount may hold blocks in the cache table that are not in the
+// store. It is put when the file system is mounted and deleted once Destroy has emptied the cache,
+// so finding it on the next mount means the last one crashed, or its Destroy did not finish.
+const CACHE_MARKER_NAME string = "cachemarker"
+
+/*
+Struct representing the cache marker of a mount.
+*/
+type cacheMarker struct {
+	Mount string `json:"mount"` // the ID of the mount, which it writes the superblock as
+	Base  string `json:"base"`  // the writer of the superblock it was mounted from
+}
+
+/*
+Struct counting what recoverCacheTable did with the items left in the cache table.
+*/
+type cacheRecovery struct {
+	Written   int // the blocks written to the store
+	Stored    int // the blocks the store already held
+	Discarded int // the blocks dropped, since the file system was changed without them since
+}
+
+/*
+Puts the cache marker of the mount of filesys, which was read from a superblock written by base.
+Called once the superblock is read, before any block is put in the cache table.
+*/
+func markCache(filesys *FS, base string) error {
+	data, err := json.Marshal(&cacheMarker{Mount: filesys.id, Base: base})
+	if err != nil {
+		return err
+	}
+	err = store.PutObject(CACHE_MARKER_NAME, data)
+	if err != nil {
+		return err
+	}
+	filesys.cacheMarked = true
+	return nil
+}
+
+/*
+Reconciles the cache table with the store if the last mount of the file system left its cache marker
+behind, so that blocks held only in the table when it crashed, or when its Destroy failed partway,
+are not lost, and stale copies of them are not read later. Called before the superblock is read,
+since it may be one of them, and before encryption is set up, so items are copied as they are.
+
+If the superblock in the store was written by that mount or is the one it was mounted from, nothing
+else changed the file system since, so each item is the latest copy of its block, and is written to
+the store unless the store already holds the same data. Otherwise a command such as cp or sync
+changed the file system since, so the items are discarded. Every item is then deleted from the
+table. Returns nil if there was no marker, and an error if whether there is one cannot be told, so
+that the mount does not replace a marker it could not read, or if the superblock cannot be read, so
+that the items are not discarded for want of knowing who wrote it. The marker is left to be replaced by
+that of the new mount, so if any item cannot be reconciled, the next mount tries again.
+*/
+func recoverCacheTable() (*cacheRecovery, error) {
+	data, err := store.GetObject(CACHE_MARKER_NAME)
+	if err != nil && isMissingObject(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("Could not read the cache marker: " + err.Error())
+	}
+	var marker cacheMarker
+	err = json.Unmarshal(data, &marker)
+	if err != nil {
+		return nil, errors.New("Could not decode the cache marker: " + err.Error())
+	}
+	lister, ok := cache.table.(ListingTable)
+	if !ok {
+		return nil, errors.New("the cache table cannot list its items")
+	}
+	keys, err := lister.ListItems()
+	if err != nil {
+		return nil, errors.New("Could not list the items of the cache table: " + err.Error())
+	}
+	writer := ""
+	super, err := getStoredDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err != nil && !isMissingObject(err) {
+		return nil, errors.New("Could not read the superblock: " + err.Error())
+	}
+	if err == nil {
+		contents, err := readSuperblockHead(super, getStoredDataByKey)
+		if err != nil {
+			return nil, err
+		}
+		writer = contents.info.Writer
+	}
+	current := writer == marker.Mount || writer == marker.Base
+	recovery := new(cacheRecovery)
+	for _, key := range keys {
+		item, err := cache.table.GetItem(key)
+		if err != nil {
+			return recovery, fmt.Errorf("Could not read block %s from the cache table: %v", key, err)
+		}
+		if !current {
+			recovery.Discarded++
+		} else if stored, err := store.GetObject(key); err == nil && bytes.Equal(stored, item) {
+			recovery.Stored++
+		} else {
+			err = store.PutObject(key, item)
+			if err != nil {
+				return recovery, fmt.Errorf("Could not write block %s to the store: %v", key, err)
+			}
+			recovery.Written++
+		}
+		_, err = cache.table.DeleteItem(key)
+		if err != nil {
+			return recovery, fmt.Errorf("Could not delete block %s from the cache table: %v", key, err)
+		}
+	}
+	return recovery, nil
+}
+
+/*
+Prints what recoverCacheTable did.
+*/
+func (r *cacheRecovery) report() {
+	fmt.Printf("The file system was not cleanly unmounted, and left %d blocks in the cache table.\n",
+		r.Written+r.Stored+r.Discarded)
+	if r.Discarded > 0 {
+		fmt.Printf("It was changed by a command since, so the %d blocks were discarded.\n", r.Discarded)
+		return
+	}
+	fmt.Printf("%d were written to the store, and %d were already in it.\n", r.Written, r.Stored)
+}
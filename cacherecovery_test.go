@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"testing"
+)
+
+/*
+Checks that the blocks a crashed mount left in the cache table are written to the store on the next
+mount, and that they are discarded instead if the file system was changed by a command since.
+*/
+func TestRecoverCacheTable(t *testing.T) {
+	filesys, objects := newTestFs(t, 64)
+	filesys.Destroy()
+	mount := func(table *MemStore) *FS {
+		cache = newCache(table, 64)
+		super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+		if err != nil {
+			t.Fatalf("getDataByKey for superblock: %v", err)
+		}
+		filesys, err := makeFs(super)
+		if err != nil {
+			t.Fatalf("makeFs: %v", err)
+		}
+		err = markCache(filesys, filesys.info.Writer)
+		if err != nil {
+			t.Fatalf("markCache: %v", err)
+		}
+		return filesys
+	}
+
+	table := newMemStore()
+	crashed := mount(table)
+	data := testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1)
+	writeTestFile(t, testRoot(t, crashed), "file", data, 1<<16)
+	left := table.Len()
+	cache = newCache(table, 64)
+	recovery, err := recoverCacheTable()
+	if err != nil || recovery == nil || recovery.Written == 0 || recovery.Written+recovery.Stored != left || table.Len() != 0 {
+		t.Fatalf("recovering %d blocks: %+v, %v, %d left in the table", left, recovery, err, table.Len())
+	}
+	filesys = mount(newMemStore())
+	node, err := lookupNode(filesys, "/file")
+	if err != nil {
+		t.Fatalf("the file written before the crash is gone: %v", err)
+	}
+	fsLock.Lock()
+	got, _ := node.(*File).inode.readFromData(0, uint64(len(data)))
+	fsLock.Unlock()
+	if !bytes.Equal(got, data) {
+		t.Fatalf("the file written before the crash differs")
+	}
+	filesys.Destroy()
+	if _, err := objects.GetObject(CACHE_MARKER_NAME); err == nil {
+		t.Fatalf("the cache marker is left after a clean unmount")
+	}
+	if recovery, _ := recoverCacheTable(); recovery != nil {
+		t.Fatalf("recovered %+v after a clean unmount", recovery)
+	}
+
+	table = newMemStore()
+	crashed = mount(table)
+	writeTestFile(t, testRoot(t, crashed), "other", testData(1000, 2), 1000)
+	left = table.Len()
+	// a command writes the superblock from before the crash
+	cache = newCache(newMemStore(), 64)
+	super, _ := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+	command, _ := makeFs(super)
+	command.Destroy()
+	cache = newCache(table, 64)
+	recovery, err = recoverCacheTable()
+	if err != nil || recovery == nil || recovery.Discarded != left || table.Len() != 0 {
+		t.Fatalf("discarding %d blocks: %+v, %v, %d left in the table", left, recovery, err, table.Len())
+	}
+	filesys = mount(newMemStore())
+	if _, err := lookupNode(filesys, "/other"); err != fuse.ENOENT {
+		t.Fatalf("looking up a file whose blocks were discarded returned %v", err)
+	}
+
+	// a marker that cannot be read is not taken for a missing one
+	faults := newFaultInjector(FaultConfig{})
+	store = faults.wrapStore(objects)
+	faults.failNextCalls(errInjectedThrottle)
+	if recovery, err := recoverCacheTable(); err == nil {
+		t.Fatalf("recovering with a marker that could not be read returned %+v", recovery)
+	}
+
+	// nor is a superblock that cannot be read, which would discard the blocks
+	faults.failNextCalls(nil, errInjectedThrottle)
+	if recovery, err := recoverCacheTable(); err == nil {
+		t.Fatalf("recovering with a superblock that could not be read returned %+v", recovery)
+	}
+}
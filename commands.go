@@ -0,0 +1,869 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// the uid that requests served over 9P and HTTP are made as when the user is not known
+const NOBODY_UID uint32 = 65534
+
+/*
+Struct representing a subcommand that can be run in place of mounting the file system.
+*/
+type command struct {
+	name        string
+	args        string
+	description string
+	run         func(args []string) int
+}
+
+var commands []*command
+
+// commands is populated in init because the subcommands refer back to it when printing their usage
+func init() {
+	commands = []*command{
+		{
+			name:        "version",
+			description: "print the binary version and the on-disk format versions it supports",
+			run:         versionCommand,
+		},
+		{
+			name:        "info",
+			args:        "CONFIG_PATH",
+			description: "print the label, format version, UUID, block size, and usage of a file system",
+			run:         infoCommand,
+		},
+		{
+			name:        "stats",
+			args:        "CONFIG_PATH",
+			description: "print the requests, bytes, and files a file system has seen over all its mounts",
+			run:         statsCommand,
+		},
+		{
+			name:        "fsck",
+			args:        "CONFIG_PATH",
+			description: "check the directory tree and block allocation of an unmounted file system",
+			run:         fsckCommand,
+		},
+		{
+			name:        "verify",
+			args:        "CONFIG_PATH [PATH]",
+			description: "read every block of an unmounted file system, or of PATH in it, and report corrupt ones",
+			run:         verifyCommand,
+		},
+		{
+			name:        "read-at",
+			args:        "[-block] CONFIG_PATH TIME PATH",
+			description: "write the file at PATH, or with -block the block with key PATH, as it was in a versioned bucket at TIME to stdout",
+			run:         readAtCommand,
+		},
+		{
+			name:        "cp",
+			args:        "[-r] CONFIG_PATH SRC DST",
+			description: "copy a file, or with -r a directory tree, within an unmounted file system without going through FUSE",
+			run:         copyCommand,
+		},
+		{
+			name:        "sync",
+			args:        "[-n] [-delete] SRC_CONFIG_PATH DST_CONFIG_PATH",
+			description: "make an unmounted file system match another, copying only the blocks of files that differ",
+			run:         syncCommand,
+		},
+		{
+			name:        "serve-9p",
+			args:        "CONFIG_PATH CACHESIZE ADDRESS",
+			description: "serve the file system over 9P2000.L on ADDRESS (HOST:PORT or unix:PATH) instead of mounting it",
+			run:         serveNinePCommand,
+		},
+		{
+			name:        "serve-http",
+			args:        "CONFIG_PATH CACHESIZE ADDRESS",
+			description: "serve the files of the file system over HTTP on ADDRESS (HOST:PORT or unix:PATH) instead of mounting it",
+			run:         serveHTTPCommand,
+		},
+		{
+			name:        "serve-browser",
+			args:        "CONFIG_PATH CACHESIZE ADDRESS",
+			description: "serve a read-only web UI for browsing and downloading the files of the file system on ADDRESS",
+			run:         serveBrowserCommand,
+		},
+		{
+			name:        "share-token",
+			args:        "PATH DURATION",
+			description: "print a token for reading the subtree at PATH through serve-http or serve-browser until DURATION from now",
+			run:         shareTokenCommand,
+		},
+		{
+			name:        "standby",
+			args:        "CONFIG_PATH CACHESIZE",
+			description: "wait to mount the file system at the mountpoint of the config as soon as the mount holding its lease is gone, following the changes it makes over its admin socket",
+			run:         standbyCommand,
+		},
+		{
+			name:        "watch",
+			args:        "CONFIG_PATH [PATH]",
+			description: "print the changes made to a mounted file system, or under PATH in it, as JSON lines",
+			run:         watchClientCommand,
+		},
+		{
+			name:        "prefetch",
+			args:        "CONFIG_PATH PATH | -f MANIFEST CONFIG_PATH",
+			description: "start pulling the blocks of the file at PATH, or of the files listed in MANIFEST, in a mounted file system into the cache",
+			run:         prefetchClientCommand,
+		},
+		{
+			name:        "metrics",
+			args:        "CONFIG_PATH",
+			description: "print how many blocks of a mounted file system are only in DynamoDB, and for how long",
+			run:         metricsClientCommand,
+		},
+		{
+			name:        "health",
+			args:        "CONFIG_PATH",
+			description: "print whether a mounted file system is taking changes, exiting with status 1 if it was made read-only",
+			run:         healthClientCommand,
+		},
+		{
+			name:        "open-files",
+			args:        "CONFIG_PATH",
+			description: "print the files open in a mounted file system, and how many handles read and write each",
+			run:         openFilesClientCommand,
+		},
+		{
+			name:        "path",
+			args:        "CONFIG_PATH INODE",
+			description: "print the path of an inode of a mounted file system that keeps a path index",
+			run:         pathClientCommand,
+		},
+		{
+			name:        "compact",
+			args:        "CONFIG_PATH PATH...",
+			description: "rewrite the blocks of the files at the PATHs in a mounted file system into consecutive new blocks",
+			run:         compactClientCommand,
+		},
+		{
+			name:        "iam-policy",
+			args:        "[-no-create] CONFIG_PATH",
+			description: "print the least-privilege IAM policy needed to mount a file system",
+			run:         iamPolicyCommand,
+		},
+	}
+}
+
+/*
+Returns whether name is the name of a subcommand.
+*/
+func isCommand(name string) bool {
+	return findCommand(name) != nil
+}
+
+/*
+Returns the subcommand with the given name, or nil if there is none.
+*/
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+/*
+Runs the named subcommand with args, returning the exit code of the program.
+*/
+func runCommand(name string, args []string) int {
+	return findCommand(name).run(args)
+}
+
+/*
+Prints the name, arguments, and description of each subcommand.
+*/
+func printCommands() {
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", cmd.name, cmd.args)
+		fmt.Fprintf(os.Stderr, "\t%s\n", cmd.description)
+	}
+}
+
+/*
+Prints the usage of a single subcommand.
+*/
+func commandUsage(name string) {
+	cmd := findCommand(name)
+	fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", progName, cmd.name, cmd.args)
+}
+
+/*
+Prints the version of this binary and the on-disk format versions it can mount.
+*/
+func versionCommand(args []string) int {
+	if len(args) != 0 {
+		commandUsage("version")
+		return 2
+	}
+	fmt.Print(versionText())
+	return 0
+}
+
+/*
+Reads the superblock of the file system described by the config directly from S3, and prints
+its format information and a usage summary. The superblock is only written when the file system
+is unmounted, so the usage reflects the last clean unmount.
+*/
+func infoCommand(args []string) int {
+	if len(args) != 1 {
+		commandUsage("info")
+		return 2
+	}
+	contents := readToolSuperblock(args[0])
+	if contents == nil {
+		return 1
+	}
+
+	inodeStream := new(IntStream)
+	inodeStream.decompressStream(contents.lastInode)
+	if len(contents.inodeListData) > 0 {
+		inodeStream.UnmarshalBinary(contents.inodeListData)
+	} else {
+		inodeStream.stack = new(list.List)
+	}
+	blockStream := new(IntStream)
+	blockStream.decompressStream(contents.lastData)
+
+	info := contents.info
+	fmt.Printf("bucket:          %s\n", S3_BUCKET_NAME)
+	if info.Label != "" {
+		fmt.Printf("label:           %s\n", info.Label)
+	}
+	if info.Description != "" {
+		fmt.Printf("description:     %s\n", info.Description)
+	}
+	fmt.Printf("format version:  %d\n", info.FormatVersion)
+	if err := checkFormatSupported(info); err != nil {
+		fmt.Printf("                 (%s)\n", err.Error())
+	}
+	if info.UUID != "" {
+		fmt.Printf("UUID:            %s\n", info.UUID)
+	}
+	if info.CreatedTime != 0 {
+		fmt.Printf("created:         %s\n", time.Unix(info.CreatedTime, 0).Format(time.RFC1123))
+	}
+	if info.WrappedKey != nil {
+		fmt.Printf("encryption:      AES-256-GCM, key wrapped by %s\n", info.KMSKeyARN)
+	} else {
+		fmt.Printf("encryption:      none\n")
+	}
+	fmt.Printf("block size:      %d\n", info.BlockSize)
+	fmt.Printf("inode size:      %d\n", info.InodeSize)
+	if info.MetadataItems {
+		fmt.Printf("metadata:        DynamoDB items in %s\n", DYNAMO_TABLE_NAME+METADATA_TABLE_SUFFIX)
+	} else {
+		fmt.Printf("metadata:        blocks\n")
+	}
+	if info.InodeOwners {
+		fmt.Printf("owners:          kept\n")
+	} else {
+		fmt.Printf("owners:          root\n")
+	}
+	if info.InodeTimes {
+		fmt.Printf("times:           access, change, and modification\n")
+	} else {
+		fmt.Printf("times:           modification\n")
+	}
+	if info.InodeGenerations {
+		fmt.Printf("generations:     kept\n")
+	} else {
+		fmt.Printf("generations:     none\n")
+	}
+	if info.PathIndex {
+		fmt.Printf("path index:      kept\n")
+	} else {
+		fmt.Printf("path index:      none\n")
+	}
+	keyScheme := info.KeyScheme
+	if keyScheme == "" {
+		keyScheme = KEY_SCHEME_MD5
+	}
+	fmt.Printf("key scheme:      %s\n", keyScheme)
+	fmt.Printf("root inode:      %d\n", contents.rootInode)
+	// both streams start at 1, and the root inode is allocated without using the inode stream, which
+	// skips the reserved inodes in file systems that reserve them
+	inodesInUse := inodeStream.lastInt - uint64(inodeStream.stack.Len())
+	if info.FirstUserInode != 0 {
+		inodesInUse -= info.FirstUserInode - ROOT_INODE - 1
+	}
+	blocksAllocated := blockStream.lastInt - 1
+	fmt.Printf("inodes in use:   %d (%d free for reuse)\n", inodesInUse, inodeStream.stack.Len())
+	fmt.Printf("data blocks:     %d (%d bytes)\n", blocksAllocated, blocksAllocated*info.BlockSize)
+	return 0
+}
+
+/*
+Reads the superblock of the file system described by the config at configPath, which need not be
+mounted, printing why and returning nil if it cannot be read.
+*/
+func readToolSuperblock(configPath string) *superblockContents {
+	err := initializeToolBackend(loadConfig(configPath))
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil
+	}
+	super, err := getStoredDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err != nil {
+		fmt.Println("Could not read the superblock from bucket " + S3_BUCKET_NAME + ": " + err.Error())
+		return nil
+	}
+	contents, err := readSuperblock(super, getStoredDataByKey)
+	if err != nil {
+		fmt.Println("Could not decode the superblock: " + err.Error())
+		return nil
+	}
+	return contents
+}
+
+/*
+Prints the lifetime counters of the file system described by the config. They are added to the
+superblock when a mount ends, so the current mount of a mounted file system is not counted. If
+blocks are put in Intelligent-Tiering, the usage of its access tiers is read from CloudWatch, or
+taken from the superblock if it cannot be.
+*/
+func statsCommand(args []string) int {
+	if len(args) != 1 {
+		commandUsage("stats")
+		return 2
+	}
+	contents := readToolSuperblock(args[0])
+	if contents == nil {
+		return 1
+	}
+	if tieringSource != nil {
+		usage, err := tieringSource()
+		if err != nil {
+			fmt.Println(err.Error())
+		} else if usage.Time != 0 {
+			contents.info.Tiering = *usage
+		}
+	}
+	printStats(contents.info)
+	return 0
+}
+
+/*
+Checks the file system described by the config, which must not be mounted, and prints any
+problems found. Changes made since the file system was last cleanly unmounted are not seen.
+*/
+func fsckCommand(args []string) int {
+	if len(args) != 1 {
+		commandUsage("fsck")
+		return 2
+	}
+	err := initializeToolBackend(loadConfig(args[0]))
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	filesys, err := openFs()
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	if !printFsckReport(fsck(filesys)) {
+		return 1
+	}
+	return 0
+}
+
+/*
+Reads every block of the file system described by the config (or of the file or directory at the
+path given after the config), which must not be mounted, and prints the blocks that are unreadable
+or corrupt along with the files they belong to.
+*/
+func verifyCommand(args []string) int {
+	if len(args) != 1 && len(args) != 2 {
+		commandUsage("verify")
+		return 2
+	}
+	err := initializeToolBackend(loadConfig(args[0]))
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	filesys, err := openFs()
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	p := "/"
+	if len(args) == 2 {
+		p = args[1]
+	}
+	report, err := verify(filesys, p)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	if !printVerifyReport(report) {
+		return 1
+	}
+	return 0
+}
+
+/*
+Serves the file system described by the config over 9P instead of mounting it, so that it can be
+mounted by VM guests and WSL2.
+*/
+func serveNinePCommand(args []string) int {
+	filesys, listener, code := startServing("serve-9p", args)
+	if filesys == nil {
+		return code
+	}
+	fmt.Println("Serving the file system over 9P on " + listener.Addr().String() + ".")
+	err := newNinePServer(filesys).serve(listener)
+	fmt.Println(err.Error())
+	shutdown()
+	return 1
+}
+
+/*
+Serves the files of the file system described by the config over HTTP instead of mounting it.
+*/
+func serveHTTPCommand(args []string) int {
+	filesys, listener, code := startServing("serve-http", args)
+	if filesys == nil {
+		return code
+	}
+	fmt.Println("Serving the file system over HTTP on " + listener.Addr().String() + ".")
+	err := http.Serve(listener, newHTTPGateway(filesys, os.Getenv(HTTP_TOKEN_ENV)))
+	fmt.Println(err.Error())
+	shutdown()
+	return 1
+}
+
+/*
+Serves a read-only web UI for browsing the file system described by the config, and downloading
+its files, instead of mounting it.
+*/
+func serveBrowserCommand(args []string) int {
+	filesys, listener, code := startServing("serve-browser", args)
+	if filesys == nil {
+		return code
+	}
+	fmt.Println("Serving the file browser on http://" + listener.Addr().String() + HTTP_BROWSE_PREFIX + ".")
+	gateway := newHTTPGateway(filesys, os.Getenv(HTTP_TOKEN_ENV))
+	gateway.browser = true
+	err := http.Serve(listener, gateway)
+	fmt.Println(err.Error())
+	shutdown()
+	return 1
+}
+
+/*
+Prints a share token for reading the file or directory at PATH, and everything under it, through
+the HTTP gateway or file browser until DURATION (as in "24h") from now. It is signed with the
+gateway token in CLOUDFUSION_HTTP_TOKEN, so the gateway must be started with the same one, and no
+config or AWS credentials are needed to issue it.
+*/
+func shareTokenCommand(args []string) int {
+	if len(args) != 2 {
+		commandUsage("share-token")
+		return 2
+	}
+	duration, err := time.ParseDuration(args[1])
+	if err != nil || duration <= 0 {
+		fmt.Println("Invalid duration " + args[1] + ".")
+		return 2
+	}
+	secret := os.Getenv(HTTP_TOKEN_ENV)
+	if secret == "" {
+		fmt.Println(HTTP_TOKEN_ENV + " must be set to the token the gateway is started with.")
+		return 1
+	}
+	expires := time.Now().Add(duration)
+	fmt.Println(issueShareToken(secret, args[0], expires))
+	fmt.Fprintln(os.Stderr, "Expires at "+expires.Format(time.RFC3339)+".")
+	return 0
+}
+
+/*
+Does the setup shared by the commands that serve the file system instead of mounting it, whose
+arguments are CONFIG_PATH CACHESIZE ADDRESS: opens the file system described by the config, listens
+on the address, and cleans up the file system as when it is unmounted on an interrupt, termination,
+or hangup. Returns a nil file system and the exit code of the program if any of it fails.
+*/
+func startServing(name string, args []string) (*FS, net.Listener, int) {
+	if len(args) != 3 {
+		commandUsage(name)
+		return nil, nil, 2
+	}
+	cacheSize, err := strconv.Atoi(args[1])
+	if err != nil || cacheSize <= 0 {
+		fmt.Println("Invalid argument supplied for the cache size.")
+		return nil, nil, 2
+	}
+	config := loadConfig(args[0])
+	// nothing is mounted, so shutdown must not unmount the configured mountpoint
+	mountpoint = ""
+	initializeBackend(config, cacheSize)
+	auditLog, err = initializeAuditLog(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	listener, err := listenAddress(args[2])
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil, nil, 1
+	}
+	filesys, err := openMountedFs()
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil, nil, 1
+	}
+	shutdownOnSignal()
+	if ADMIN_SOCKET_PATH != "" {
+		err = startAdminSocket(ADMIN_SOCKET_PATH)
+		if err != nil {
+			fmt.Println(err.Error())
+			return nil, nil, 1
+		}
+	}
+	return filesys, listener, 0
+}
+
+/*
+Listens on address, which is "unix:PATH" for a unix socket or HOST:PORT for TCP.
+*/
+func listenAddress(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(address, "unix:"))
+	}
+	return net.Listen("tcp", address)
+}
+
+/*
+Connects to the admin socket of the mounted file system described by the config at configPath,
+sends req, and returns the connection and a decoder of the replies once the first says it succeeded.
+*/
+func adminClientRequest(configPath string, req *adminRequest) (net.Conn, *json.Decoder, error) {
+	config := readConfig(configPath)
+	if config.AdminSocket == "" {
+		return nil, nil, errors.New("The config does not set AdminSocket, so the file system has no admin socket.")
+	}
+	conn, err := net.Dial("unix", config.AdminSocket)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	dec := json.NewDecoder(conn)
+	var reply json.RawMessage
+	err = dec.Decode(&reply)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	resp := new(adminResponse)
+	json.Unmarshal(reply, resp)
+	if !resp.OK {
+		conn.Close()
+		return nil, nil, errors.New(resp.Error)
+	}
+	// the first reply is decoded again by the caller, for the commands that reply with more than OK
+	return conn, json.NewDecoder(io.MultiReader(bytes.NewReader(reply), dec.Buffered(), conn)), nil
+}
+
+/*
+Copies the file or directory at SRC to DST within the file system described by the config, which
+must not be mounted, then writes back the superblock and everything cached as an unmount does.
+*/
+func copyCommand(args []string) int {
+	flags := flag.NewFlagSet("cp", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "copy directories and everything under them")
+	if flags.Parse(args) != nil || flags.NArg() != 3 {
+		commandUsage("cp")
+		flags.PrintDefaults()
+		return 2
+	}
+	config := loadConfig(flags.Arg(0))
+	err := initializeToolBackend(config)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	auditLog, err = initializeAuditLog(config)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	filesys, err := openFs()
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	stats, err := cloneTree(filesys, flags.Arg(1), flags.Arg(2), *recursive)
+	// what was copied before a failure is kept, so the superblock has to record its inodes and blocks
+	filesys.Destroy()
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("Copied %d files and %d directories (%d bytes): %d blocks copied in the store, %d read and written.\n",
+		stats.Files, stats.Dirs, stats.Bytes, stats.CopiedBlocks, stats.ReadBlocks)
+	return 0
+}
+
+/*
+Makes the file system described by the second config match the one described by the first, neither
+of which may be mounted, printing what it changes. See syncFileSystems.
+*/
+func syncCommand(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+	dryRun := flags.Bool("n", false, "print what would be changed without changing anything")
+	remove := flags.Bool("delete", false, "remove what the source does not have from the destination")
+	if flags.Parse(args) != nil || flags.NArg() != 2 {
+		commandUsage("sync")
+		flags.PrintDefaults()
+		return 2
+	}
+	stats, err := syncFileSystems(flags.Arg(0), flags.Arg(1), *remove, *dryRun)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Printf("%d unchanged, %d files, %d directories, and %d links written, %d removed, %d special files skipped: %d blocks (%d bytes) copied.\n",
+		stats.Unchanged, stats.Files, stats.Dirs, stats.Links, stats.Removed, stats.Skipped, stats.Chunks, stats.Bytes)
+	return 0
+}
+
+/*
+Connects to the admin socket of the mounted file system described by the config, and prints the
+changes made under the path given after the config (or anywhere) until it is unmounted.
+*/
+func watchClientCommand(args []string) int {
+	if len(args) != 1 && len(args) != 2 {
+		commandUsage("watch")
+		return 2
+	}
+	req := &adminRequest{Command: "watch", Path: "/"}
+	if len(args) == 2 {
+		req.Path = args[1]
+	}
+	conn, dec, err := adminClientRequest(args[0], req)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer conn.Close()
+	// skip the reply saying the watch started
+	dec.Decode(new(adminResponse))
+	for {
+		var event json.RawMessage
+		err = dec.Decode(&event)
+		if err != nil {
+			return 0
+		}
+		fmt.Println(string(event))
+	}
+}
+
+/*
+Asks the mounted file system described by the config to pull the blocks of the file at the path
+given after the config, or with -f of the files listed in a manifest (one path to a line), into the
+cache, and prints how many it is pulling in. The blocks are read in the background after this
+returns.
+*/
+func prefetchClientCommand(args []string) int {
+	flags := flag.NewFlagSet("prefetch", flag.ContinueOnError)
+	manifestPath := flags.String("f", "", "read the paths of the files to prefetch from this manifest, or - for stdin")
+	if flags.Parse(args) != nil || (*manifestPath == "" && flags.NArg() != 2) || (*manifestPath != "" && flags.NArg() != 1) {
+		commandUsage("prefetch")
+		flags.PrintDefaults()
+		return 2
+	}
+	req := &adminRequest{Command: "prefetch"}
+	if *manifestPath == "" {
+		req.Path = flags.Arg(1)
+	} else {
+		manifest := os.Stdin
+		if *manifestPath != "-" {
+			file, err := os.Open(*manifestPath)
+			if err != nil {
+				fmt.Println(err.Error())
+				return 1
+			}
+			defer file.Close()
+			manifest = file
+		}
+		paths, err := readManifest(manifest)
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		if len(paths) == 0 {
+			fmt.Println("The manifest lists no files.")
+			return 1
+		}
+		req.Paths = paths
+	}
+	conn, dec, err := adminClientRequest(flags.Arg(0), req)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer conn.Close()
+	resp := new(prefetchResponse)
+	dec.Decode(resp)
+	for _, skipped := range resp.Skipped {
+		fmt.Println("Skipped " + skipped)
+	}
+	if *manifestPath == "" {
+		fmt.Printf("Prefetching %d blocks of %s.\n", resp.Blocks, req.Path)
+	} else {
+		fmt.Printf("Prefetching %d blocks of %d files.\n", resp.Blocks, resp.Files)
+	}
+	return 0
+}
+
+/*
+Prints the metrics of the cache of the mounted file system described by the config, as JSON.
+*/
+func metricsClientCommand(args []string) int {
+	if len(args) != 1 {
+		commandUsage("metrics")
+		return 2
+	}
+	conn, dec, err := adminClientRequest(args[0], &adminRequest{Command: "metrics"})
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer conn.Close()
+	var metrics json.RawMessage
+	dec.Decode(&metrics)
+	fmt.Println(string(metrics))
+	return 0
+}
+
+/*
+Prints the files with open handles in the mounted file system described by the config, as JSON.
+*/
+func openFilesClientCommand(args []string) int {
+	if len(args) != 1 {
+		commandUsage("open-files")
+		return 2
+	}
+	conn, dec, err := adminClientRequest(args[0], &adminRequest{Command: "open-files"})
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer conn.Close()
+	var files json.RawMessage
+	dec.Decode(&files)
+	fmt.Println(string(files))
+	return 0
+}
+
+/*
+Prints the health of the mounted file system described by the config, as JSON, exiting with status
+1 if it was made read-only by write failures, for use in health checks.
+*/
+func healthClientCommand(args []string) int {
+	if len(args) != 1 {
+		commandUsage("health")
+		return 2
+	}
+	conn, dec, err := adminClientRequest(args[0], &adminRequest{Command: "health"})
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer conn.Close()
+	var resp healthResponse
+	var raw json.RawMessage
+	dec.Decode(&raw)
+	fmt.Println(string(raw))
+	if json.Unmarshal(raw, &resp) != nil || resp.ReadOnly {
+		return 1
+	}
+	return 0
+}
+
+/*
+Prints the path of an inode of the mounted file system described by the config, found through its
+path index.
+*/
+func pathClientCommand(args []string) int {
+	if len(args) != 2 {
+		commandUsage("path")
+		return 2
+	}
+	inodeNum, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		commandUsage("path")
+		return 2
+	}
+	conn, dec, err := adminClientRequest(args[0], &adminRequest{Command: "path", Inode: inodeNum})
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	defer conn.Close()
+	var resp pathResponse
+	err = dec.Decode(&resp)
+	if err != nil || !resp.OK {
+		fmt.Println("Failed to find the path: " + resp.Error)
+		return 1
+	}
+	fmt.Println(resp.Path)
+	return 0
+}
+
+/*
+Asks the mounted file system described by the config to compact each file at the paths given after
+the config, one after another, and prints the blocks and fragments each had before and after.
+*/
+func compactClientCommand(args []string) int {
+	if len(args) < 2 {
+		commandUsage("compact")
+		return 2
+	}
+	status := 0
+	for _, p := range args[1:] {
+		conn, dec, err := adminClientRequest(args[0], &adminRequest{Command: "compact", Path: p})
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+		var resp compactResponse
+		err = dec.Decode(&resp)
+		conn.Close()
+		if err != nil || !resp.OK {
+			fmt.Println("Failed to compact " + p + ": " + resp.Error)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: %d blocks in %d fragments, now %d blocks in %d fragments\n",
+			p, resp.Blocks, resp.Fragments, resp.BlocksAfter, resp.FragmentsAfter)
+	}
+	return status
+}
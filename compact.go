@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+)
+
+// the data blocks compaction copies holding fsLock, before letting other requests in
+const COMPACT_BATCH_BLOCKS uint64 = 64
+
+/*
+Struct representing the reply to the "compact" admin command.
+*/
+type compactResponse struct {
+	adminResponse
+	Blocks         uint64 `json:"blocks"`         // the data and indirect blocks the file used before
+	BlocksAfter    uint64 `json:"blocksAfter"`    // and after, without the blocks of zeros left as holes
+	Fragments      uint64 `json:"fragments"`      // the runs of consecutive block numbers its data was in before
+	FragmentsAfter uint64 `json:"fragmentsAfter"` // and after
+}
+
+/*
+Returns the number of runs of consecutively numbered blocks the data blocks of the inode are in,
+in file order, passing over holes.
+*/
+func (i *Inode) fragments() (uint64, error) {
+	var runs, last uint64
+	err := i.forEachBlock(func(blockNum uint64, indirect bool) error {
+		if indirect {
+			return nil
+		}
+		if runs == 0 || blockNum != last+1 {
+			runs++
+		}
+		last = blockNum
+		return nil
+	})
+	return runs, err
+}
+
+/*
+Returns whether the stored inode still has the data snapshot had, which was read before its blocks
+were copied.
+*/
+func unchangedSince(stored, snapshot *Inode) bool {
+	return stored.Data == snapshot.Data && stored.Size == snapshot.Size && stored.UnixTime == snapshot.UnixTime &&
+		stored.Generation == snapshot.Generation && stored.LinkCount > 0
+}
+
+/*
+Returns the stored inode of the file with inodeNum, or an error if it cannot be compacted now: if it
+is open, since its handles would go on using the blocks freed, or if its data was changed or it was
+removed since snapshot was read.
+*/
+func checkCompactable(inodeNum uint64, snapshot *Inode) (*Inode, error) {
+	if openFiles.isOpen(inodeNum) {
+		return nil, errors.New("the file is open")
+	}
+	stored, err := getInode(inodeNum)
+	if err != nil {
+		return nil, err
+	}
+	if !unchangedSince(stored, snapshot) {
+		return nil, errors.New("the file was changed while it was compacted")
+	}
+	return stored, nil
+}
+
+/*
+Copies the data blocks of snapshot from start up to COMPACT_BATCH_BLOCKS blocks into compacted,
+which is given new blocks, numbered one after another as they are allocated. Blocks of zeros are
+left as holes. Each block is read back, so that a block that
+could not be stored fails the compaction rather than replacing the data. Returns the offset the
+next batch starts from. Must be called holding fsLock.
+*/
+func copyBatch(snapshot, compacted *Inode, start uint64) (uint64, error) {
+	offset := start
+	for n := uint64(0); n < COMPACT_BATCH_BLOCKS && offset < snapshot.Size; n++ {
+		data, err := snapshot.readFromData(offset, BLOCK_SIZE)
+		if err != nil {
+			return offset, err
+		}
+		if !isZero(data) {
+			compacted.writeToData(data, offset)
+			written, err := compacted.readFromData(offset, uint64(len(data)))
+			if err != nil {
+				return offset, err
+			}
+			if !bytes.Equal(written, data) {
+				return offset, fmt.Errorf("the block at offset %d could not be written", offset)
+			}
+		}
+		offset += BLOCK_SIZE
+	}
+	return offset, nil
+}
+
+/*
+Rewrites the data of the file with inodeNum into new blocks numbered one after another, in file
+order, leaving blocks of zeros as holes, and frees the blocks it used, so that a file left scattered
+and full of blocks of zeros by random writes and truncations is read with fewer, larger runs of
+keys. Blocks are copied in batches of COMPACT_BATCH_BLOCKS, letting other requests in between, and
+the inode is only pointed at the new blocks, in a single write, if the file was not opened or
+changed in the meantime; otherwise the new blocks are freed and the file is left as it was. The
+block size is that of the file system, which has a single one. Files under append-only and immutable
+directories, whose blocks may be locked in S3, are not compacted. dirNum is the directory the file
+was looked up in. Must not be called holding fsLock.
+*/
+func compactFile(inodeNum, dirNum uint64) (*compactResponse, error) {
+	fsLock.Lock()
+	err := checkStoreWritable()
+	var flags int8
+	if err == nil {
+		flags, err = inheritedDirFlags(dirNum)
+	}
+	if err == nil && flags != 0 {
+		err = errors.New("the file is under an append-only or immutable directory")
+	}
+	var snapshot *Inode
+	if err == nil {
+		snapshot, err = getInode(inodeNum)
+	}
+	if err == nil && (snapshot.isDir() || snapshot.isSymlink()) {
+		err = errors.New("not a regular file")
+	}
+	if err == nil {
+		_, err = checkCompactable(inodeNum, snapshot)
+	}
+	resp := &compactResponse{adminResponse: adminResponse{OK: true}}
+	if err == nil {
+		resp.Blocks, err = snapshot.countUsedBlocks()
+	}
+	if err == nil {
+		resp.Fragments, err = snapshot.fragments()
+	}
+	fsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	compacted := *snapshot
+	compacted.Data = [NUM_DATA_BLOCKS + 3]uint64{}
+	compacted.usedBlocks, compacted.usedBlocksKnown = 0, true
+	offset := INODE_BUFFER_SIZE
+	for offset < snapshot.Size {
+		fsLock.Lock()
+		_, err = checkCompactable(inodeNum, snapshot)
+		if err == nil {
+			offset, err = copyBatch(snapshot, &compacted, offset)
+		}
+		fsLock.Unlock()
+		if err != nil {
+			break
+		}
+	}
+
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	var stored *Inode
+	if err == nil {
+		stored, err = checkCompactable(inodeNum, snapshot)
+	}
+	if err == nil {
+		// the times of the file are kept, along with the links, owner, and cache hints changed since
+		// the snapshot, which storeFileInode keeps
+		compacted.UnixTime, compacted.Atime, compacted.Ctime = stored.UnixTime, stored.Atime, stored.Ctime
+		resp.BlocksAfter = compacted.usedBlocks
+		err = storeFileInode(&compacted, inodeNum)
+	}
+	if err != nil {
+		if freeErr := compacted.deleteAllData(); freeErr != nil {
+			fmt.Printf("Failed to free the blocks of inode %d copied before compaction failed: %v\n", inodeNum, freeErr)
+		}
+		return nil, err
+	}
+	liveNodes.stored(inodeNum, &compacted)
+	if err := snapshot.deleteAllData(); err != nil {
+		// the file is whole in its new blocks, so this only leaves some old ones behind
+		fmt.Printf("Failed to free the old blocks of inode %d after compacting it: %v\n", inodeNum, err)
+	}
+	resp.FragmentsAfter, err = compacted.fragments()
+	return resp, err
+}
+
+/*
+Admin command that compacts the file at the path of the request, replying once it is done with the
+blocks and fragments it had before and after.
+*/
+func compactCommand(req *adminRequest, conn net.Conn, enc *json.Encoder) error {
+	if mountedFs == nil {
+		return enc.Encode(&adminResponse{Error: "the file system is not mounted"})
+	}
+	p := path.Clean("/" + req.Path)
+	node, err := lookupNode(mountedFs, p)
+	if err != nil {
+		return enc.Encode(&adminResponse{Error: p + ": " + err.Error()})
+	}
+	file, ok := node.(*File)
+	if !ok {
+		return enc.Encode(&adminResponse{Error: p + " is not a file"})
+	}
+	resp, err := compactFile(file.inodeNum, file.dirNum)
+	if err != nil {
+		return enc.Encode(&adminResponse{Error: p + ": " + err.Error()})
+	}
+	return enc.Encode(resp)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that compacting a file whose blocks are interleaved with those of another puts them in one
+run of consecutive numbers, leaves its block of zeros as a hole, keeps its data and times, frees the
+old blocks, and that an open file is not compacted.
+*/
+func TestCompactFile(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	size := int(INODE_BUFFER_SIZE + 6*BLOCK_SIZE)
+	data := testData(size, 1)
+	zeros := int(INODE_BUFFER_SIZE + 3*BLOCK_SIZE)
+	copy(data[zeros:zeros+int(BLOCK_SIZE)], make([]byte, BLOCK_SIZE))
+	other := testData(size, 2)
+	handles := make(map[string]*FileHandle)
+	for _, name := range []string{"file", "other"} {
+		_, handle, err := root.Create(ctx, &fuse.CreateRequest{Name: name}, new(fuse.CreateResponse))
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		handles[name] = handle.(*FileHandle)
+	}
+	// the blocks of the two files are allocated in turn
+	for offset := 0; offset < size; {
+		end := offset + int(BLOCK_SIZE)
+		if offset == 0 {
+			end += int(INODE_BUFFER_SIZE)
+		}
+		handles["file"].Write(ctx, &fuse.WriteRequest{Offset: int64(offset), Data: data[offset:end]}, new(fuse.WriteResponse))
+		handles["other"].Write(ctx, &fuse.WriteRequest{Offset: int64(offset), Data: other[offset:end]}, new(fuse.WriteResponse))
+		offset = end
+	}
+	if _, err := compactFile(handles["file"].inodeNum, root.inodeNum); err == nil {
+		t.Fatalf("an open file was compacted")
+	}
+	for _, fh := range handles {
+		fh.Release(ctx, new(fuse.ReleaseRequest))
+	}
+
+	inodeNum := handles["file"].inodeNum
+	before, _ := getInode(inodeNum)
+	oldBlocks := inodeBlocks(t, before)
+	resp, err := compactFile(inodeNum, root.inodeNum)
+	if err != nil {
+		t.Fatalf("compactFile: %v", err)
+	}
+	if resp.Blocks != 6 || resp.Fragments != 6 || resp.BlocksAfter != 5 || resp.FragmentsAfter != 1 {
+		t.Fatalf("compacted %+v, want 6 blocks in 6 fragments to 5 blocks in 1", resp)
+	}
+	after, _ := getInode(inodeNum)
+	if after.Data[3] != 0 || after.UnixTime != before.UnixTime {
+		t.Fatalf("the block of zeros was stored as %d, or the modified time changed", after.Data[3])
+	}
+	checkFileData(t, root, "file", data)
+	checkFileData(t, root, "other", other)
+	for _, blockNum := range oldBlocks {
+		if _, err := getData(blockNum); err == nil {
+			t.Fatalf("old block %d was not freed", blockNum)
+		}
+	}
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck: %+v", report.problems)
+	}
+}
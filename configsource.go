@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// prefixes of config locations that refer to an SSM parameter or a Secrets Manager secret
+// holding the config, instead of a file
+const SSM_CONFIG_PREFIX string = "ssm://"
+const SECRET_CONFIG_PREFIX string = "secretsmanager://"
+
+/*
+Struct representing a config kept in SSM Parameter Store or Secrets Manager.
+*/
+type configReference struct {
+	service string // "ssm" or "secretsmanager"
+	name    string // the parameter name or secret ID
+	region  string
+}
+
+/*
+Parses a config location of the form ssm://NAME or secretsmanager://NAME, optionally followed by
+?region=REGION, returning nil if location is a file path. SSM parameter names are absolute, so
+ssm://cloudfusion/prod refers to the parameter /cloudfusion/prod. The region defaults to the
+AWS_REGION environment variable, then to AWS_CLIENT_REGION.
+*/
+func parseConfigReference(location string) (*configReference, error) {
+	var ref *configReference
+	if strings.HasPrefix(location, SSM_CONFIG_PREFIX) {
+		ref = &configReference{service: "ssm", name: "/" + strings.TrimPrefix(location, SSM_CONFIG_PREFIX)}
+	} else if strings.HasPrefix(location, SECRET_CONFIG_PREFIX) {
+		ref = &configReference{service: "secretsmanager", name: strings.TrimPrefix(location, SECRET_CONFIG_PREFIX)}
+	} else {
+		return nil, nil
+	}
+	ref.region = os.Getenv("AWS_REGION")
+	if ref.region == "" {
+		ref.region = AWS_CLIENT_REGION
+	}
+	if i := strings.Index(ref.name, "?"); i >= 0 {
+		query := ref.name[i+1:]
+		ref.name = ref.name[:i]
+		if !strings.HasPrefix(query, "region=") || len(query) == len("region=") {
+			return nil, errors.New("config location " + location + " has an unknown query, only ?region=REGION is supported")
+		}
+		ref.region = strings.TrimPrefix(query, "region=")
+	}
+	if parts := strings.Split(ref.name, ":"); strings.HasPrefix(ref.name, "arn:") && len(parts) > 3 {
+		// secrets can be referred to by ARN, which includes the region
+		ref.region = parts[3]
+	}
+	if strings.Trim(ref.name, "/") == "" {
+		return nil, errors.New("config location " + location + " does not name a parameter or secret")
+	}
+	return ref, nil
+}
+
+/*
+Returns the contents of the config at location, which is either a file path or a reference to an
+SSM parameter or Secrets Manager secret (see parseConfigReference). SSM parameters can be
+SecureStrings, which are decrypted.
+*/
+func readConfigData(location string) ([]byte, error) {
+	ref, err := parseConfigReference(location)
+	if err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		return ioutil.ReadFile(location)
+	}
+	if ref.service == "ssm" {
+		client := ssm.New(session.New(newAWSConfig("ssm", ref.region)))
+		resp, err := client.GetParameter(&ssm.GetParameterInput{
+			Name:           aws.String(ref.name),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, errors.New("Could not read the config from SSM parameter " + ref.name + ": " + err.Error())
+		}
+		return []byte(aws.StringValue(resp.Parameter.Value)), nil
+	}
+	client := secretsmanager.New(session.New(newAWSConfig("secretsmanager", ref.region)))
+	resp, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(ref.name),
+	})
+	if err != nil {
+		return nil, errors.New("Could not read the config from secret " + ref.name + ": " + err.Error())
+	}
+	if resp.SecretString != nil {
+		return []byte(*resp.SecretString), nil
+	}
+	return resp.SecretBinary, nil
+}
+
+/*
+Returns the IAM policy statement allowing the config at location to be read, or nil if it is a file.
+*/
+func configSourceStatement(location string) (*iamStatement, error) {
+	ref, err := parseConfigReference(location)
+	if err != nil || ref == nil {
+		return nil, err
+	}
+	if ref.service == "ssm" {
+		return &iamStatement{
+			Sid:      "CloudFusionConfig",
+			Effect:   "Allow",
+			Action:   []string{"ssm:GetParameter"},
+			Resource: []string{"arn:aws:ssm:" + ref.region + ":*:parameter" + ref.name},
+		}, nil
+	}
+	resource := ref.name
+	if !strings.HasPrefix(resource, "arn:") {
+		// secret ARNs end with a random suffix
+		resource = "arn:aws:secretsmanager:" + ref.region + ":*:secret:" + ref.name + "-*"
+	}
+	return &iamStatement{
+		Sid:      "CloudFusionConfig",
+		Effect:   "Allow",
+		Action:   []string{"secretsmanager:GetSecretValue"},
+		Resource: []string{resource},
+	}, nil
+}
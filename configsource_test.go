@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*
+Checks that SSM and Secrets Manager config references are parsed, with their regions, and that file
+paths are not treated as references.
+*/
+func TestParseConfigReference(t *testing.T) {
+	os.Setenv("AWS_REGION", "eu-west-1")
+	defer os.Unsetenv("AWS_REGION")
+	cases := map[string]configReference{
+		"ssm://cloudfusion/prod":                                           {"ssm", "/cloudfusion/prod", "eu-west-1"},
+		"ssm://cloudfusion/prod?region=us-west-2":                          {"ssm", "/cloudfusion/prod", "us-west-2"},
+		"secretsmanager://cloudfusion":                                     {"secretsmanager", "cloudfusion", "eu-west-1"},
+		"secretsmanager://arn:aws:secretsmanager:ap-south-1:1:secret:cf-x": {"secretsmanager", "arn:aws:secretsmanager:ap-south-1:1:secret:cf-x", "ap-south-1"},
+	}
+	for location, want := range cases {
+		ref, err := parseConfigReference(location)
+		if err != nil || ref == nil || *ref != want {
+			t.Errorf("parseConfigReference(%s) = %+v, %v, want %+v", location, ref, err, want)
+		}
+	}
+	for _, location := range []string{"ssm://", "ssm://a?foo=bar", "ssm://a?region="} {
+		if _, err := parseConfigReference(location); err == nil {
+			t.Errorf("parseConfigReference(%s) accepted", location)
+		}
+	}
+	if ref, err := parseConfigReference("/etc/CFconfig.json"); ref != nil || err != nil {
+		t.Errorf("file path parsed as %+v, %v", ref, err)
+	}
+}
+
+/*
+Checks that a config is still read from a file.
+*/
+func TestReadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CONFIG_FILE_NAME)
+	ioutil.WriteFile(path, []byte(`{"Bucket": "bucket", "Backend": "local"}`), 0600)
+	config := readConfig(path)
+	if config.Bucket != "bucket" || config.Backend != LOCAL_BACKEND {
+		t.Errorf("readConfig = %+v", config)
+	}
+}
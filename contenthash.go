@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"golang.org/x/net/context"
+	"strconv"
+)
+
+// the extended attribute holding the content hash of a file, e.g. read with
+// getfattr -n user.cloudfusion.sha256 FILE
+const CONTENT_HASH_XATTR string = "user.cloudfusion.sha256"
+
+const HASHES_PER_BLOCK uint64 = BLOCK_SIZE / sha256.Size
+
+/*
+Returns the key of the hash block holding the hash of the data block with dataNum. Like key blocks,
+hash blocks have no hash prefix.
+*/
+func genHashBlockKey(dataNum uint64) string {
+	return "hashes-" + strconv.FormatUint(dataNum/HASHES_PER_BLOCK, 10)
+}
+
+/*
+Returns the hash block holding the hash of the data block with dataNum, or a new block if it does
+not exist. A missing or unreadable hash block only means the hashes in it are computed again.
+*/
+func getHashBlock(dataNum uint64) *DataBlock {
+	block, err := getDataByKey(genHashBlockKey(dataNum))
+	if err != nil {
+		return new(DataBlock)
+	}
+	return block
+}
+
+/*
+Stores sum as the hash of the data block with dataNum. A hash block whose hashes are all cleared is
+deleted, so that no hash blocks are left behind by deleted files.
+*/
+func storeBlockHash(dataNum uint64, sum []byte) error {
+	block := getHashBlock(dataNum)
+	start := (dataNum % HASHES_PER_BLOCK) * sha256.Size
+	if string(block.Data[start:start+sha256.Size]) == string(sum) {
+		return nil
+	}
+	copy(block.Data[start:start+sha256.Size], sum)
+	key := genHashBlockKey(dataNum)
+	if block.Data != [BLOCK_SIZE]byte{} {
+		return putDataByKey(key, block)
+	}
+	cacheErr := cache.deleteBlock(key)
+	err := store.DeleteObject(key)
+	if cacheErr == nil {
+		// the block was only in the cache, so the store may never have had it
+		return nil
+	}
+	return err
+}
+
+/*
+Updates the hash of the data block with dataNum after it is written to a file, so that the content
+hash of the file is maintained as it is written, without reading it back.
+*/
+func setBlockHash(dataNum uint64, data *DataBlock) error {
+	sum := sha256.Sum256(data.Data[:])
+	return storeBlockHash(dataNum, sum[:])
+}
+
+/*
+Clears the hash of the data block with dataNum after it is deleted. Indirect blocks have no hash,
+so there is nothing to clear for them.
+*/
+func clearBlockHash(dataNum uint64) error {
+	return storeBlockHash(dataNum, make([]byte, sha256.Size))
+}
+
+/*
+Returns the hash of the data block with dataNum. Blocks written before hashes were kept have no
+hash, so they are read and hashed, and the hash is stored for next time.
+*/
+func getBlockHash(dataNum uint64) ([]byte, error) {
+	block := getHashBlock(dataNum)
+	start := (dataNum % HASHES_PER_BLOCK) * sha256.Size
+	sum := block.Data[start : start+sha256.Size]
+	if string(sum) != string(make([]byte, sha256.Size)) {
+		return sum, nil
+	}
+	data, err := getData(dataNum)
+	if err != nil {
+		return nil, err
+	}
+	computed := sha256.Sum256(data.Data[:])
+	return computed[:], storeBlockHash(dataNum, computed[:])
+}
+
+// the hash of a block of zeros, which the holes of sparse files count as
+var zeroBlockHash = sha256.Sum256(make([]byte, BLOCK_SIZE))
+
+/*
+Returns the content hash of the inode's data: the SHA-256 of its size (as 8 little-endian bytes),
+the SHA-256 of the part of the data in the inode buffer, and the SHA-256 of each data block in
+order, holes counting as blocks of zeros. It is computed from the hashes of the data blocks, which
+are updated as they are written, so only the inode is read. The same data always has the same hash, so tools can compare it with
+the hash they saw before to skip files that have not changed.
+*/
+func (i *Inode) contentHash() ([]byte, error) {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, i.Size)
+	bufLen := i.Size
+	if bufLen > INODE_BUFFER_SIZE {
+		bufLen = INODE_BUFFER_SIZE
+	}
+	bufSum := sha256.Sum256(i.DataBuf[:bufLen])
+	h.Write(bufSum[:])
+	err := i.walkBlocks(true, func(blockNum uint64, indirect bool) error {
+		if indirect {
+			return nil
+		}
+		if blockNum == 0 {
+			h.Write(zeroBlockHash[:])
+			return nil
+		}
+		sum, err := getBlockHash(blockNum)
+		h.Write(sum)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+var _ = fs.NodeGetxattrer(&File{})
+
+/*
+FUSE method that returns the content hash of the file, as hex, for CONTENT_HASH_XATTR, or the value
+of a cache hint set on it.
+*/
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	defer trackOp("Getxattr")()
+	defer recoverPanic("Getxattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Getxattr")()
+	debugOp(f.path, "Getxattr", "inode=%d name=%s", f.inodeNum, req.Name)
+	if value := cacheHintXattr(f.inode, req.Name); value != nil {
+		resp.Xattr = value
+		return nil
+	}
+	if req.Name != CONTENT_HASH_XATTR {
+		return fuse.ErrNoXattr
+	}
+	sum, err := f.inode.contentHash()
+	if err != nil {
+		return err
+	}
+	resp.Xattr = []byte(hex.EncodeToString(sum))
+	return nil
+}
+
+var _ = fs.NodeListxattrer(&File{})
+
+/*
+FUSE method that lists CONTENT_HASH_XATTR, which every file has, and the cache hints set on it.
+*/
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	defer trackOp("Listxattr")()
+	defer recoverPanic("Listxattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Listxattr")()
+	debugOp(f.path, "Listxattr", "inode=%d", f.inodeNum)
+	resp.Append(CONTENT_HASH_XATTR)
+	for _, name := range []string{CACHE_XATTR, READAHEAD_XATTR} {
+		if cacheHintXattr(f.inode, name) != nil {
+			resp.Append(name)
+		}
+	}
+	return nil
+}
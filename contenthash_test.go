@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+)
+
+/*
+Creates a file in the root directory holding data, written in chunks of chunkSize, and returns it.
+*/
+func writeTestFile(t *testing.T, root *Dir, name string, data []byte, chunkSize int) *File {
+	t.Helper()
+	ctx := context.Background()
+	node, handle, err := root.Create(ctx, &fuse.CreateRequest{Name: name}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	fh := handle.(*FileHandle)
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		fh.Write(ctx, &fuse.WriteRequest{Offset: int64(offset), Data: data[offset:end]}, &fuse.WriteResponse{})
+	}
+	fh.Release(ctx, &fuse.ReleaseRequest{})
+	return node.(*File)
+}
+
+/*
+Returns the content hash xattr of a file.
+*/
+func testContentHash(t *testing.T, file *File) string {
+	t.Helper()
+	resp := new(fuse.GetxattrResponse)
+	err := file.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: CONTENT_HASH_XATTR}, resp)
+	if err != nil {
+		t.Fatalf("Getxattr: %v", err)
+	}
+	return string(resp.Xattr)
+}
+
+/*
+Checks that the content hash of a file follows its definition, is the same for the same data
+however it was written, changes when the data does, and is left behind by no block once the file
+is removed.
+*/
+func TestContentHash(t *testing.T) {
+	filesys, objects := newTestFs(t, 4)
+	root := testRoot(t, filesys)
+	data := testData(int(INODE_BUFFER_SIZE+3*BLOCK_SIZE+100), 1)
+
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, uint64(len(data)))
+	bufSum := sha256.Sum256(data[:INODE_BUFFER_SIZE])
+	h.Write(bufSum[:])
+	rest := data[INODE_BUFFER_SIZE:]
+	for i := uint64(0); i < uint64(len(rest)); i += BLOCK_SIZE {
+		block := make([]byte, BLOCK_SIZE)
+		copy(block, rest[i:])
+		sum := sha256.Sum256(block)
+		h.Write(sum[:])
+	}
+	want := hex.EncodeToString(h.Sum(nil))
+
+	first := writeTestFile(t, root, "first", data, 4096)
+	second := writeTestFile(t, root, "second", data, 10000)
+	if got := testContentHash(t, first); got != want {
+		t.Fatalf("hash %s, want %s", got, want)
+	}
+	if got := testContentHash(t, second); got != want {
+		t.Fatalf("hash of the same data written in other chunks %s, want %s", got, want)
+	}
+
+	// blocks written before hashes were kept are hashed when the hash is asked for
+	var firstBlock uint64
+	fsLock.Lock()
+	first.inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		if firstBlock == 0 {
+			firstBlock = blockNum
+		}
+		return nil
+	})
+	clearBlockHash(firstBlock)
+	fsLock.Unlock()
+	if got := testContentHash(t, first); got != want {
+		t.Fatalf("hash after clearing a block hash %s, want %s", got, want)
+	}
+
+	data[len(data)-1]++
+	changed := writeTestFile(t, root, "changed", data, 4096)
+	if got := testContentHash(t, changed); got == want {
+		t.Fatalf("hash did not change with the data")
+	}
+
+	list := new(fuse.ListxattrResponse)
+	first.Listxattr(context.Background(), &fuse.ListxattrRequest{}, list)
+	if string(list.Xattr) != CONTENT_HASH_XATTR+"\x00" {
+		t.Fatalf("Listxattr returned %q", list.Xattr)
+	}
+	err := first.Getxattr(context.Background(), &fuse.GetxattrRequest{Name: "user.other"}, new(fuse.GetxattrResponse))
+	if err != fuse.ErrNoXattr {
+		t.Fatalf("Getxattr of another attribute returned %v, want ErrNoXattr", err)
+	}
+
+	for _, name := range []string{"first", "second", "changed"} {
+		err = root.Remove(context.Background(), &fuse.RemoveRequest{Name: name})
+		if err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+	}
+	cache.empty()
+	for key := range objects.items {
+		if strings.HasPrefix(key, "hashes-") {
+			t.Errorf("hash block %s still stored after removing every file", key)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bufio"
+	"bytes"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// environment variables used to pass the store directory and seed to the workload process
+const CRASH_DIR_ENV string = "CLOUDFUSION_CRASH_DIR"
+const CRASH_SEED_ENV string = "CLOUDFUSION_CRASH_SEED"
+
+// printed by the workload process once the file system is mounted
+const CRASH_READY_LINE string = "crash workload running"
+
+// the directory the workload works in. Everything outside of it is left alone by the workload,
+// so must be identical to how it was at the last clean unmount.
+const CRASH_WORK_DIR string = "work"
+
+var crashBaselineSizes = []int{0, 100, 20 * 1000, 200 * 1000}
+
+/*
+Mounts the file system kept in dir by the local backend, creating it if it does not exist yet. As
+in openMountedFs, the blocks a mount that crashed left in the cache table (kept in dir too) are
+recovered first, and the cache is marked, so that a mount that crashes in turn leaves them to the
+next.
+*/
+func openLocalTestFs(t *testing.T, dir string, cacheSize int) *FS {
+	t.Helper()
+	initializeBackend(&Config{Backend: LOCAL_BACKEND, LocalPath: dir}, cacheSize)
+	recovery, err := recoverCacheTable()
+	if err != nil {
+		t.Fatalf("recoverCacheTable: %v", err)
+	}
+	if recovery != nil {
+		t.Logf("recovered the cache table: %d blocks written, %d stored, %d discarded",
+			recovery.Written, recovery.Stored, recovery.Discarded)
+	}
+	super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+	isNew := err != nil
+	if isNew {
+		super = makeNewSuperblock()
+	}
+	filesys, err := makeFs(super)
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	err = markCache(filesys, filesys.info.Writer)
+	if err != nil {
+		t.Fatalf("markCache: %v", err)
+	}
+	if isNew {
+		makeNewRootInode()
+	}
+	return filesys
+}
+
+/*
+Returns the name of the nth file of the baseline that the workload must not lose.
+*/
+func crashBaselineName(n int) string {
+	return "keep" + strconv.Itoa(n)
+}
+
+/*
+Copies every file in the directory tree at src to dst.
+*/
+func copyTree(t *testing.T, src, dst string) {
+	t.Helper()
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(dst, rel), data, 0644)
+	})
+	if err != nil {
+		t.Fatalf("copying %s: %v", src, err)
+	}
+}
+
+/*
+Writes data to a new file with the given name in dir.
+*/
+func crashWriteFile(ctx context.Context, dir *Dir, name string, data []byte) error {
+	_, handle, err := dir.Create(ctx, &fuse.CreateRequest{Name: name}, &fuse.CreateResponse{})
+	if err != nil {
+		return err
+	}
+	fh := handle.(*FileHandle)
+	err = fh.Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{})
+	fh.Release(ctx, &fuse.ReleaseRequest{})
+	return err
+}
+
+/*
+Kills a process running a write/rename/delete workload against a file system on the local backend
+at random points, and checks that after each crash the file system can be mounted again, fsck finds
+no problems outside the directory the workload was using, and every file that was not changed
+since the last clean unmount is intact. Changes made since the last clean unmount may be lost.
+*/
+func TestCrashConsistency(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping crash tests in short mode")
+	}
+	ctx := context.Background()
+	base := filepath.Join(t.TempDir(), "base")
+	filesys := openLocalTestFs(t, base, 8)
+	root := testRoot(t, filesys)
+	for n, size := range crashBaselineSizes {
+		err := crashWriteFile(ctx, root, crashBaselineName(n), testData(size, int64(n)))
+		if err != nil {
+			t.Fatalf("writing baseline file: %v", err)
+		}
+	}
+	_, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: CRASH_WORK_DIR})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	filesys.Destroy()
+
+	iterations := 8
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < iterations; i++ {
+		dir := filepath.Join(t.TempDir(), "crash"+strconv.Itoa(i))
+		copyTree(t, base, dir)
+		delay := time.Duration(r.Intn(200)) * time.Millisecond
+		runCrashWorkload(t, dir, int64(i), delay)
+		checkAfterCrash(t, dir)
+	}
+}
+
+/*
+Runs TestCrashWorkload in a new process on the file system in dir, and kills it delay after the
+file system is mounted.
+*/
+func runCrashWorkload(t *testing.T, dir string, seed int64, delay time.Duration) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashWorkload$")
+	cmd.Env = append(os.Environ(), CRASH_DIR_ENV+"="+dir, CRASH_SEED_ENV+"="+strconv.FormatInt(seed, 10))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("starting workload: %v", err)
+	}
+	ready := make(chan bool)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		sent := false
+		for scanner.Scan() {
+			if !sent && scanner.Text() == CRASH_READY_LINE {
+				ready <- true
+				sent = true
+			}
+		}
+		if !sent {
+			close(ready)
+		}
+	}()
+	if !<-ready {
+		cmd.Wait()
+		t.Fatalf("workload process exited before mounting the file system")
+	}
+	time.Sleep(delay)
+	cmd.Process.Kill()
+	cmd.Wait()
+}
+
+/*
+Mounts the file system in dir after a crash, through the cache table the workload used, runs fsck on
+it, and checks the baseline files.
+*/
+func checkAfterCrash(t *testing.T, dir string) {
+	t.Helper()
+	ctx := context.Background()
+	filesys := openLocalTestFs(t, dir, 8)
+	report := fsck(filesys)
+	for _, problem := range report.problems {
+		if strings.HasPrefix(problem, "/"+CRASH_WORK_DIR+"/") || strings.HasPrefix(problem, "/"+CRASH_WORK_DIR+":") {
+			t.Logf("fsck (inside the crash window): %s", problem)
+		} else {
+			t.Errorf("fsck: %s", problem)
+		}
+	}
+
+	root := testRoot(t, filesys)
+	for n, size := range crashBaselineSizes {
+		name := crashBaselineName(n)
+		node, err := root.lookup(ctx, name)
+		if err != nil {
+			t.Errorf("%s lost after crash: %v", name, err)
+			continue
+		}
+		file := node.(*File)
+		var data []byte
+		if file.inode.Size > 0 {
+			data, err = file.inode.readFromData(0, file.inode.Size)
+		}
+		if err != nil {
+			t.Errorf("reading %s after crash: %v", name, err)
+		} else if !bytes.Equal(data, testData(size, int64(n))) {
+			t.Errorf("%s changed after crash", name)
+		}
+	}
+}
+
+/*
+The workload run in a separate process by TestCrashConsistency. It creates, overwrites, renames, and
+removes files in the work directory until it is killed.
+*/
+func TestCrashWorkload(t *testing.T) {
+	dir := os.Getenv(CRASH_DIR_ENV)
+	if dir == "" {
+		t.Skip("only run by TestCrashConsistency")
+	}
+	seed, _ := strconv.ParseInt(os.Getenv(CRASH_SEED_ENV), 10, 64)
+	r := rand.New(rand.NewSource(seed))
+	ctx := context.Background()
+	filesys := openLocalTestFs(t, dir, 8)
+	node, err := testRoot(t, filesys).lookup(ctx, CRASH_WORK_DIR)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	work := node.(*Dir)
+	name := func() string {
+		return "file" + strconv.Itoa(r.Intn(16))
+	}
+	os.Stdout.WriteString(CRASH_READY_LINE + "\n")
+	for {
+		switch r.Intn(4) {
+		case 0, 1:
+			crashWriteFile(ctx, work, name(), testData(r.Intn(4*int(BLOCK_SIZE)), r.Int63()))
+		case 2:
+			work.Rename(ctx, &fuse.RenameRequest{OldName: name(), NewName: name()}, work)
+		case 3:
+			work.Remove(ctx, &fuse.RemoveRequest{Name: name()})
+		}
+	}
+}
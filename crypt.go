@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"strings"
+)
+
+// the ARN of the KMS key that wraps the data encryption key of new file systems, or "" to not encrypt
+var KMS_KEY_ARN string
+
+// the key manager used to generate and unwrap data encryption keys, set by initializeBackend
+var keyManager KeyManager
+
+/*
+Interface for the service that generates the data encryption key of a file system and wraps it,
+so that only the wrapped key needs to be stored. In production this is AWS KMS. The context is
+bound to the wrapped key, and must be the same when it is unwrapped.
+*/
+type KeyManager interface {
+	GenerateDataKey(keyARN string, context map[string]string) (key []byte, wrappedKey []byte, err error)
+	UnwrapKey(wrappedKey []byte, context map[string]string) ([]byte, error)
+}
+
+/*
+KeyManager backed by AWS KMS.
+*/
+type kmsKeyManager struct{}
+
+/*
+Returns a KMS client for the region of the key with the given ARN.
+*/
+func getKMSClient(keyARN string) *kms.KMS {
+	region := S3_REGION
+	// ARNs are of the form arn:aws:kms:REGION:ACCOUNT:key/ID
+	parts := strings.Split(keyARN, ":")
+	if len(parts) > 3 && parts[3] != "" {
+		region = parts[3]
+	}
+	return kms.New(session.New(newAWSConfig("kms", region)))
+}
+
+/*
+Converts a context to the form used by the KMS API.
+*/
+func kmsContext(context map[string]string) map[string]*string {
+	kmsContext := make(map[string]*string)
+	for k, v := range context {
+		kmsContext[k] = aws.String(v)
+	}
+	return kmsContext
+}
+
+/*
+Has KMS generate a new 256 bit key, returning it along with the copy wrapped by the key with the given ARN.
+*/
+func (k *kmsKeyManager) GenerateDataKey(keyARN string, context map[string]string) ([]byte, []byte, error) {
+	resp, err := getKMSClient(keyARN).GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:             aws.String(keyARN),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: kmsContext(context),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Plaintext, resp.CiphertextBlob, nil
+}
+
+/*
+Has KMS unwrap a key returned by GenerateDataKey. The KMS key that wrapped it is recorded in
+the wrapped key, so its ARN does not need to be configured.
+*/
+func (k *kmsKeyManager) UnwrapKey(wrappedKey []byte, context map[string]string) ([]byte, error) {
+	resp, err := getKMSClient(KMS_KEY_ARN).Decrypt(&kms.DecryptInput{
+		CiphertextBlob:    wrappedKey,
+		EncryptionContext: kmsContext(context),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+/*
+Returns the context bound to the wrapped key of the file system described by info, which ties the
+wrapped key to that file system.
+*/
+func keyContext(info *SuperblockInfo) map[string]string {
+	return map[string]string{"CloudFusionUUID": info.UUID}
+}
+
+/*
+Sets up encryption for the file system described by info, wrapping the global store and cache table so
+that every block except the superblocks is encrypted. If the file system is new and a KMS key is
+configured, a data encryption key is generated for it and its wrapped copy is recorded in info, to
+be written with the superblock. Does nothing for unencrypted file systems.
+*/
+func initializeEncryption(info *SuperblockInfo, isNew bool) error {
+	fileKeys = nil
+	if info.WrappedKey == nil {
+		if KMS_KEY_ARN == "" {
+			return nil
+		}
+		if !isNew {
+			return errors.New("a KMS key is configured, but the file system was created without encryption")
+		}
+		key, wrappedKey, err := keyManager.GenerateDataKey(KMS_KEY_ARN, keyContext(info))
+		if err != nil {
+			return errors.New("Could not generate a data encryption key: " + err.Error())
+		}
+		info.KMSKeyARN = KMS_KEY_ARN
+		info.WrappedKey = wrappedKey
+		info.FileKeys = true
+		return enableEncryption(key, info.FileKeys)
+	}
+	key, err := keyManager.UnwrapKey(info.WrappedKey, keyContext(info))
+	if err != nil {
+		return errors.New("Could not unwrap the data encryption key with KMS key " + info.KMSKeyARN + ": " + err.Error())
+	}
+	return enableEncryption(key, info.FileKeys)
+}
+
+/*
+Wraps the global store and cache table so that blocks are encrypted with key. If withFileKeys is
+set, data blocks and inodes are additionally encrypted with their own keys (see keyTable).
+*/
+func enableEncryption(key []byte, withFileKeys bool) error {
+	c, err := newBlockCipher(key)
+	if err != nil {
+		return err
+	}
+	store = &encryptedStore{inner: store, cipher: c}
+	cache.table = &encryptedTable{inner: cache.table, cipher: c}
+	if withFileKeys {
+		fileKeys = newKeyTable(key)
+	}
+	return nil
+}
+
+/*
+Struct that encrypts and authenticates blocks with AES-256-GCM. Each encrypted block is a random
+nonce followed by the sealed data, with the key of the block as additional data so that blocks
+cannot be swapped.
+*/
+type blockCipher struct {
+	aead cipher.AEAD
+}
+
+/*
+Returns a pointer to a blockCipher using the given 256 bit key.
+*/
+func newBlockCipher(key []byte) (*blockCipher, error) {
+	if len(key) != 32 {
+		return nil, errors.New("data encryption key is not 256 bits")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &blockCipher{
+		aead: aead,
+	}, nil
+}
+
+/*
+Returns whether the block with key is stored encrypted. Superblocks are not, because they hold
+the wrapped key.
+*/
+func isEncryptedKey(key string) bool {
+	return !strings.HasPrefix(key, S3_SUPERBLOCK_NAME)
+}
+
+/*
+Returns data encrypted for storage under key.
+*/
+func (c *blockCipher) seal(key string, data []byte) ([]byte, error) {
+	if !isEncryptedKey(key) {
+		return data, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, data, []byte(key)), nil
+}
+
+/*
+Returns the decrypted data stored under key, or an error if it was not encrypted by seal with
+the same key.
+*/
+func (c *blockCipher) open(key string, data []byte) ([]byte, error) {
+	if !isEncryptedKey(key) {
+		return data, nil
+	}
+	if len(data) < c.aead.NonceSize() {
+		return nil, errors.New("Encrypted block " + key + " is too short.")
+	}
+	nonceSize := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(key))
+	if err != nil {
+		return nil, errors.New("Could not decrypt block " + key + ": " + err.Error())
+	}
+	return plain, nil
+}
+
+/*
+ObjectStore that encrypts the blocks stored in another ObjectStore.
+*/
+type encryptedStore struct {
+	inner  ObjectStore
+	cipher *blockCipher
+}
+
+var _ VerifyingStore = (*encryptedStore)(nil)
+
+/*
+Gets an object from the inner store and decrypts it.
+*/
+func (s *encryptedStore) GetObject(key string) ([]byte, error) {
+	data, err := s.inner.GetObject(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.cipher.open(key, data)
+}
+
+/*
+Encrypts data and puts it to the inner store.
+*/
+func (s *encryptedStore) PutObject(key string, data []byte) error {
+	sealed, err := s.cipher.seal(key, data)
+	if err != nil {
+		return err
+	}
+	return s.inner.PutObject(key, sealed)
+}
+
+/*
+Gets an object from the inner store, checking it against the inner store's checksum if it keeps
+one, and decrypts it. Decryption also fails if the object was changed.
+*/
+func (s *encryptedStore) VerifyObject(key string) ([]byte, error) {
+	data, err := verifyObject(s.inner, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.cipher.open(key, data)
+}
+
+/*
+Deletes an object from the inner store.
+*/
+func (s *encryptedStore) DeleteObject(key string) error {
+	return s.inner.DeleteObject(key)
+}
+
+var _ BatchDeletingStore = (*encryptedStore)(nil)
+
+/*
+Deletes objects from the inner store, with one request if it can.
+*/
+func (s *encryptedStore) DeleteObjects(keys []string) []error {
+	return deleteObjects(s.inner, keys)
+}
+
+/*
+CacheTable that encrypts the blocks stored in another CacheTable.
+*/
+type encryptedTable struct {
+	inner  CacheTable
+	cipher *blockCipher
+}
+
+/*
+Gets an item from the inner table and decrypts it.
+*/
+func (t *encryptedTable) GetItem(key string) ([]byte, error) {
+	data, err := t.inner.GetItem(key)
+	if err != nil {
+		return nil, err
+	}
+	return t.cipher.open(key, data)
+}
+
+/*
+Encrypts data and puts it to the inner table.
+*/
+func (t *encryptedTable) PutItem(key string, data []byte) error {
+	sealed, err := t.cipher.seal(key, data)
+	if err != nil {
+		return err
+	}
+	return t.inner.PutItem(key, sealed)
+}
+
+/*
+Deletes an item from the inner table, returning its decrypted data.
+*/
+func (t *encryptedTable) DeleteItem(key string) ([]byte, error) {
+	data, err := t.inner.DeleteItem(key)
+	if err != nil {
+		return nil, err
+	}
+	return t.cipher.open(key, data)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+KeyManager that wraps keys by XORing them with a fixed byte, in place of KMS.
+*/
+type fakeKeyManager struct {
+	contexts []map[string]string
+}
+
+/*
+Returns a fixed key and its wrapped copy.
+*/
+func (k *fakeKeyManager) GenerateDataKey(keyARN string, context map[string]string) ([]byte, []byte, error) {
+	k.contexts = append(k.contexts, context)
+	key := bytes.Repeat([]byte{7}, 32)
+	return key, k.xor(key), nil
+}
+
+/*
+Unwraps a key returned by GenerateDataKey, failing if the context differs.
+*/
+func (k *fakeKeyManager) UnwrapKey(wrappedKey []byte, context map[string]string) ([]byte, error) {
+	if len(k.contexts) == 0 || k.contexts[0]["CloudFusionUUID"] != context["CloudFusionUUID"] {
+		return nil, errors.New("context mismatch")
+	}
+	return k.xor(wrappedKey), nil
+}
+
+/*
+Returns data XORed with 0xff.
+*/
+func (k *fakeKeyManager) xor(data []byte) []byte {
+	res := make([]byte, len(data))
+	for i := range data {
+		res[i] = data[i] ^ 0xff
+	}
+	return res
+}
+
+/*
+Turns encryption back off for the tests that follow.
+*/
+func resetEncryption() {
+	KMS_KEY_ARN = ""
+	fileKeys = nil
+}
+
+/*
+Sets up a new, empty encrypted file system backed by memory, with a cache that holds cacheSize
+blocks. Returns the file system and the store that evicted blocks go to.
+*/
+func newEncryptedTestFs(t *testing.T, cacheSize int) (*FS, *MemStore) {
+	t.Helper()
+	KMS_KEY_ARN = "arn:aws:kms:us-west-2:111122223333:key/test"
+	keyManager = new(fakeKeyManager)
+	objects := newMemStore()
+	store = objects
+	cache = newCache(newMemStore(), cacheSize)
+	filesys, err := makeFs(makeNewSuperblock())
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	err = initializeEncryption(filesys.info, true)
+	if err != nil {
+		t.Fatalf("initializeEncryption: %v", err)
+	}
+	makeNewRootInode()
+	return filesys, objects
+}
+
+/*
+Checks that an encrypted file system stores no plaintext outside the superblock, that only the
+wrapped key is stored, and that it can be mounted again and read.
+*/
+func TestEncryptedFs(t *testing.T) {
+	defer resetEncryption()
+	ctx := context.Background()
+	filesys, objects := newEncryptedTestFs(t, 4)
+	data := testData(100*1000, 1)
+	plainLine := bytes.Repeat([]byte("plaintext "), 10)
+	root := testRoot(t, filesys)
+	err := crashWriteFile(ctx, root, "file", append(data, plainLine...))
+	if err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	filesys.Destroy()
+
+	for key, stored := range objects.items {
+		if !isEncryptedKey(key) {
+			if bytes.Contains(stored, bytes.Repeat([]byte{7}, 32)) {
+				t.Errorf("superblock %s contains the unwrapped key", key)
+			}
+			continue
+		}
+		if uint64(len(stored)) == BLOCK_SIZE {
+			t.Errorf("block %s was stored unencrypted", key)
+		}
+		if bytes.Contains(stored, plainLine) {
+			t.Errorf("block %s contains plaintext", key)
+		}
+	}
+
+	store = objects
+	cache = newCache(newMemStore(), 4)
+	remounted, err := openFs()
+	if err != nil {
+		t.Fatalf("openFs: %v", err)
+	}
+	if remounted.info.KMSKeyARN != KMS_KEY_ARN {
+		t.Errorf("KMSKeyARN = %q, want %q", remounted.info.KMSKeyARN, KMS_KEY_ARN)
+	}
+	node, err := testRoot(t, remounted).lookup(ctx, "file")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	file := node.(*File)
+	readData, err := file.inode.readFromData(0, file.inode.Size)
+	if err != nil || !bytes.Equal(readData, append(data, plainLine...)) {
+		t.Fatalf("data read back differs from data written (err %v)", err)
+	}
+}
+
+/*
+Checks that a block cannot be decrypted under a different key than it was stored with.
+*/
+func TestBlockCipherBindsKey(t *testing.T) {
+	c, err := newBlockCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := c.seal("a", []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := c.open("a", sealed); err != nil || string(plain) != "data" {
+		t.Fatalf("open = %q, %v", plain, err)
+	}
+	if _, err := c.open("b", sealed); err == nil {
+		t.Fatalf("block stored under one key was decrypted under another")
+	}
+}
+
+/*
+Checks that configuring a KMS key for an existing unencrypted file system is an error.
+*/
+func TestEncryptionNotInPlace(t *testing.T) {
+	defer resetEncryption()
+	KMS_KEY_ARN = "arn:aws:kms:us-west-2:111122223333:key/test"
+	keyManager = new(fakeKeyManager)
+	filesys, _ := newTestFs(t, 4)
+	if err := initializeEncryption(filesys.info, false); err == nil {
+		t.Fatalf("initializeEncryption encrypted an existing file system")
+	}
+}
@@ -1,15 +1,8 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"io"
-	"strconv"
 )
 
 const BLOCK_SIZE uint64 = 32768 // this can be modified as long as it is a multiple of 8 and the inode size
@@ -25,11 +18,12 @@ type DataBlock struct {
 Gets a DataBlock from S3/DynamoDB by the dataNum.
 */
 func getData(dataNum uint64) (*DataBlock, error) {
-	// fmt.Printf("doing get data for data id %d\n", dataNum)
-	client := getClient()
 	key := genDataKey(dataNum)
-	// fmt.Println("key for getData is: " + key)
-	data, err := getDataByKey(client, key)
+	debugBlock("getData block=%d key=%s", dataNum, key)
+	data, err := getDataByKey(key)
+	if err == nil && fileKeys != nil {
+		err = fileKeys.open(DATA_KEY_KIND, dataNum, data.Data[:])
+	}
 	return data, err
 }
 
@@ -38,11 +32,9 @@ Returns a DataBlock from S3/DynamoDB containing the inode with given inodeNum. M
 are packed into a single block.
 */
 func getInodeBlock(inodeNum uint64) (*DataBlock, error) {
-	// fmt.Printf("doing get inodeBlock for inode num %d\n", inodeNum)
-	client := getClient()
 	key := genInodeBlockKey(inodeNum)
-	// fmt.Println("doing getInodeBlock for key: " + key)
-	data, err := getDataByKey(client, key)
+	debugBlock("getInodeBlock inode=%d key=%s", inodeNum, key)
+	data, err := getDataByKey(key)
 	return data, err
 }
 
@@ -51,16 +43,36 @@ Deletes a block with the specified dataNum from both S3 and DynamoDB,
 returning an error only if it cannot be found in either one.
 */
 func deleteBlock(dataNum uint64) error {
-	// fmt.Printf("doing deleteBlock for blockNum: %d\n", dataNum)
-	client := getClient()
 	key := genDataKey(dataNum)
+	debugBlock("deleteBlock block=%d key=%s", dataNum, key)
 	cacheErr := cache.deleteBlock(key)
-	_, err := client.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(S3_BUCKET_NAME),
-		Key:    aws.String(key),
-	})
+	err := store.DeleteObject(key)
+	return blockDeleted(dataNum, key, cacheErr, err)
+}
+
+/*
+Finishes deleting the block with dataNum and key once it was deleted from the cache and the store,
+with cacheErr and err the errors of each: returns an error if it could be deleted from neither,
+and otherwise forgets its hash and key. Shared by deleteBlock and deleteBlocks.
+*/
+func blockDeleted(dataNum uint64, key string, cacheErr, err error) error {
 	if err != nil && cacheErr != nil {
-		return errors.New("Failed to delete from both DynamoDB and S3.")
+		if objectLockEnabled() {
+			// the block may be locked, in which case S3 keeps it until its retention ends, but it
+			// is no longer used by the file system either way
+			fmt.Println("Could not delete block " + key + ", which may be locked: " + err.Error())
+			countStat(&mountStats.BlocksRetained, 1)
+		} else {
+			return errors.New("Failed to delete from both DynamoDB and S3.")
+		}
+	}
+	countStat(&mountStats.BlocksDeleted, 1)
+	err = clearBlockHash(dataNum)
+	if err != nil {
+		return err
+	}
+	if fileKeys != nil {
+		return fileKeys.destroy(DATA_KEY_KIND, dataNum)
 	}
 	return nil
 }
@@ -69,10 +81,20 @@ func deleteBlock(dataNum uint64) error {
 Uploads a dataBlock with the specified number.
 */
 func putData(dataNum uint64, data *DataBlock) error {
-	// fmt.Printf("doing putData for dataBlock with data num %d\n", dataNum)
-	client := getClient()
 	key := genDataKey(dataNum)
-	err := putDataByKey(client, key, data)
+	debugBlock("putData block=%d key=%s", dataNum, key)
+	if fileKeys != nil {
+		sealed := *data
+		err := fileKeys.seal(DATA_KEY_KIND, dataNum, sealed.Data[:])
+		if err != nil {
+			return err
+		}
+		data = &sealed
+	}
+	err := putDataByKey(key, data)
+	if err == nil && lockingWrites {
+		err = lockBlock(key)
+	}
 	return err
 }
 
@@ -80,19 +102,16 @@ func putData(dataNum uint64, data *DataBlock) error {
 Uploads a data block consisting of inodes including the specified inode number.
 */
 func putInodeBlock(inodeNum uint64, inodeBlock *DataBlock) error {
-	// fmt.Printf("doing putInodeBlock for inodeBlock with inode num %d\n", inodeNum)
-	client := getClient()
 	key := genInodeBlockKey(inodeNum)
-	err := putDataByKey(client, key, inodeBlock)
+	debugBlock("putInodeBlock inode=%d key=%s", inodeNum, key)
+	err := putDataByKey(key, inodeBlock)
 	return err
 }
 
 /*
 Uploads a data block to the cache using key as the name of the file to be uploaded.
 */
-func putDataByKey(client *s3.S3, key string, data *DataBlock) error {
-	// fmt.Println("doing putDataByKey for key: " + key)
-	// fmt.Println("doing cache upload in putDataByKey")
+func putDataByKey(key string, data *DataBlock) error {
 	err := cache.addBlock(data, key)
 	if err != nil {
 		fmt.Println("Error in putDataByKey from cache.addBlock: " + err.Error())
@@ -106,40 +125,25 @@ Retrieves a data block with the specified key from either DynamoDB or S3. Dynamo
 is tried first (because it is the cache). Returns a new empty data block and an error if such
 a file is not found in the standard execution path.
 */
-func getDataByKey(client *s3.S3, key string) (*DataBlock, error) {
+func getDataByKey(key string) (*DataBlock, error) {
 	var data *DataBlock = new(DataBlock)
 	dataSlice, err := cache.getBlock(key)
 	if err != nil {
 		// cache miss
-		// fmt.Println("cache miss trying for key:" + key)
-		output, err := client.GetObject(&s3.GetObjectInput{
-			Bucket: aws.String(S3_BUCKET_NAME),
-			Key:    aws.String(key),
-		})
-		// fmt.Println("about to try read into data from getDataByKey")
+		debugBlock("cache miss key=%s", key)
+		data, err := getStoredDataByKey(key)
 		if err == nil {
-			// item existed in s3
-			err2 := binary.Read(output.Body, binary.LittleEndian, data)
-			if err2 != nil {
-				// s3 request succeeded but binary.Read failed (malformed write?)
-				fmt.Println("Error doing binary.Read from getObject output in getDataByKey: " + err2.Error())
-				return data, err2
-			} else {
-				// s3 request succeeded
-				// add to cache since this was a cache miss
-				cache.addBlock(data, key)
-				return data, nil
-			}
-		} else {
-			// item not in s3, return a blank data block for writing
-			// don't bother adding to cache, because it will
-			// be added anyways when written to (this branch should occur only
-			// immediately before a write)
-			return data, err
+			// s3 request succeeded
+			// add to cache since this was a cache miss
+			cache.fillBlock(data, key)
 		}
+		// if the item was not in s3, a blank data block is returned for writing.
+		// don't bother adding it to cache, because it will be added anyways when
+		// written to (this should occur only immediately before a write)
+		return data, err
 	} else {
 		// cache hit
-		// fmt.Println("cache hit trying for key:" + key)
+		debugBlock("cache hit key=%s", key)
 		copy(data.Data[:], dataSlice)
 		return data, nil
 	}
@@ -147,32 +151,37 @@ func getDataByKey(client *s3.S3, key string) (*DataBlock, error) {
 }
 
 /*
-Inode block keys are of the format "HASH-inodeBlockNUMBER", where HASH is the first 2
-bytes of the md5 hash of "inodeNUMBER". Theoretically this allows
-for higher throughput on S3 (see
-http://docs.aws.amazon.com/AmazonS3/latest/dev/request-rate-perf-considerations.html)
+Retrieves a data block with the specified key directly from S3, bypassing the cache. Returns a
+new empty data block and an error if it cannot be read.
+*/
+func getStoredDataByKey(key string) (*DataBlock, error) {
+	var data *DataBlock = new(DataBlock)
+	dataSlice, err := store.GetObject(key)
+	if err != nil {
+		return data, err
+	}
+	if uint64(len(dataSlice)) != BLOCK_SIZE {
+		// s3 request succeeded but the object is not a block (malformed write?)
+		fmt.Printf("Error in getStoredDataByKey: object %s has size %d\n", key, len(dataSlice))
+		return data, errors.New("Object " + key + " is not the size of a block.")
+	}
+	copy(data.Data[:], dataSlice)
+	return data, nil
+}
+
+/*
+Returns the key of the inode block holding the inode with inodeNum, as keyScheme names the
+"inodeBlock" with its number, e.g. "HASH-inodeBlockNUMBER" with the default md5KeyScheme.
 */
 func genInodeBlockKey(inodeNum uint64) string {
 	var blockNum uint64 = inodeNum / (BLOCK_SIZE / INODE_SIZE)
-	ident := "inodeBlock" + strconv.FormatUint(blockNum, 10)
-	h := md5.New()
-	io.WriteString(h, ident)
-	hash := hex.EncodeToString(h.Sum(nil)[:2])
-	// fmt.Println("did genInodeBlockKey, new key is " + hash + "-" + ident)
-	return hash + "-" + ident
+	return keyScheme.BlockKey("inodeBlock", blockNum)
 }
 
 /*
-Data keys are of the format "HASH-dataNUMBER", where HASH is the first 2
-bytes of the md5 hash of "dataNUMBER". Theoretically this allows
-for higher throughput on S3 (see
-http://docs.aws.amazon.com/AmazonS3/latest/dev/request-rate-perf-considerations.html)
+Returns the key of the data block with dataNum, as keyScheme names the "data" block with its
+number, e.g. "HASH-dataNUMBER" with the default md5KeyScheme.
 */
 func genDataKey(dataNum uint64) string {
-	ident := "data" + strconv.FormatUint(dataNum, 10)
-	h := md5.New()
-	io.WriteString(h, ident)
-	hash := hex.EncodeToString(h.Sum(nil)[:2])
-	// fmt.Println("did genDataKey, new key is " + hash + "-" + ident)
-	return hash + "-" + ident
+	return keyScheme.BlockKey("data", dataNum)
 }
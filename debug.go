@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// set by the --debug-ops and --debug-ops-prefix flags
+var debugOps bool
+var debugOpsPrefix string
+
+/*
+Logs a FUSE operation on the file at path if --debug-ops is set and the path is
+under the --debug-ops-prefix filter.
+*/
+func debugOp(path, op string, format string, args ...interface{}) {
+	if !debugOps || !underDebugPrefix(path) {
+		return
+	}
+	log.Printf("%s %s "+format, append([]interface{}{op, path}, args...)...)
+}
+
+/*
+Returns whether path is the --debug-ops-prefix path or under it, by whole path components, so that
+a prefix of /data matches /data/x but not /database.
+*/
+func underDebugPrefix(path string) bool {
+	prefix := strings.TrimSuffix(debugOpsPrefix, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+/*
+Logs an operation on the block layer (including the key chosen for the block) if --debug-ops is set.
+The block layer does not know which file a block belongs to, so these are only logged when there is
+no path filter.
+*/
+func debugBlock(format string, args ...interface{}) {
+	if !debugOps || debugOpsPrefix != "" {
+		return
+	}
+	log.Printf("    "+format, args...)
+}
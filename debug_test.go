@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+/*
+Checks that --debug-ops-prefix matches the path it names and the paths under it, by whole path
+components, with or without a trailing slash.
+*/
+func TestDebugPrefix(t *testing.T) {
+	defer func() { debugOpsPrefix = "" }()
+	cases := []struct {
+		prefix string
+		path   string
+		want   bool
+	}{
+		{"", "/anything", true},
+		{"/", "/anything", true},
+		{"/data", "/data", true},
+		{"/data", "/data/file", true},
+		{"/data/", "/data/file", true},
+		{"/data", "/database", false},
+		{"/data", "/dat", false},
+		{"/data/sub", "/data", false},
+	}
+	for _, c := range cases {
+		debugOpsPrefix = c.prefix
+		if got := underDebugPrefix(c.path); got != c.want {
+			t.Errorf("prefix %q, path %q: got %v, want %v", c.prefix, c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the number of writes to S3 in a row (evictions and flushes of the cache) that may fail before the
+// mount stops taking changes, or 0 to never stop
+const DEFAULT_WRITE_FAILURE_LIMIT int = 10
+
+var WRITE_FAILURE_LIMIT int = DEFAULT_WRITE_FAILURE_LIMIT
+
+/*
+Struct tracking the writes to S3 that failed in a row, and whether the mount was made read-only
+because of them. It has its own lock, so that health checks answer while fsLock is held.
+*/
+type writeHealth struct {
+	lock          sync.Mutex
+	failures      int
+	lastError     string
+	readOnly      bool
+	reason        string
+	readOnlySince time.Time
+}
+
+var health = new(writeHealth)
+
+/*
+Struct representing the reply to the "health" admin command.
+*/
+type healthResponse struct {
+	adminResponse
+	ReadOnly      bool       `json:"readOnly"`
+	Reason        string     `json:"reason,omitempty"`
+	ReadOnlySince *time.Time `json:"readOnlySince,omitempty"`
+	WriteFailures int        `json:"writeFailures"` // the writes to S3 that failed in a row
+	LastError     string     `json:"lastError,omitempty"`
+}
+
+/*
+Records the result of a write to S3 of what (e.g. "evicting block KEY"). Once WRITE_FAILURE_LIMIT
+writes in a row have failed, the mount becomes read-only until it is remounted, so that changes that
+cannot be written do not pile up and the metadata in the cache does not drift further from S3.
+*/
+func (h *writeHealth) noteWrite(what string, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err == nil {
+		h.failures = 0
+		return
+	}
+	h.failures++
+	h.lastError = what + ": " + err.Error()
+	if h.readOnly || WRITE_FAILURE_LIMIT <= 0 || h.failures < WRITE_FAILURE_LIMIT {
+		return
+	}
+	h.setReadOnly(strconv.Itoa(h.failures) + " writes to S3 failed in a row, the last " + h.lastError)
+}
+
+/*
+Makes the mount read-only until it is remounted, for reason, unless it already is.
+*/
+func (h *writeHealth) makeReadOnly(reason string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !h.readOnly {
+		h.setReadOnly(reason)
+	}
+}
+
+/*
+Makes the mount read-only for reason. The caller must hold the lock.
+*/
+func (h *writeHealth) setReadOnly(reason string) {
+	h.readOnly = true
+	h.readOnlySince = time.Now()
+	h.reason = reason
+	fmt.Println("VERY BAD: the file system is now read-only, since " + h.reason)
+}
+
+/*
+Returns fuse.Errno(syscall.EROFS) if the mount was made read-only.
+*/
+func (h *writeHealth) check() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.readOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
+
+/*
+Returns the current health of the mount, as replied to the "health" admin command.
+*/
+func (h *writeHealth) snapshot() *healthResponse {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	resp := &healthResponse{
+		adminResponse: adminResponse{OK: !h.readOnly},
+		ReadOnly:      h.readOnly,
+		Reason:        h.reason,
+		WriteFailures: h.failures,
+		LastError:     h.lastError,
+	}
+	if h.readOnly {
+		since := h.readOnlySince
+		resp.ReadOnlySince = &since
+	}
+	return resp
+}
+
+/*
+Admin command that replies with whether the mount is taking changes, and if not, why not.
+*/
+func healthCommand(req *adminRequest, conn net.Conn, enc *json.Encoder) error {
+	return enc.Encode(health.snapshot())
+}
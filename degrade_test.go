@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"sync/atomic"
+	"syscall"
+	"testing"
+)
+
+/*
+Checks that the mount becomes read-only once WRITE_FAILURE_LIMIT evictions in a row have failed,
+that it stays so once S3 is back, and that its files can still be read.
+*/
+func TestReadOnlyAfterWriteFailures(t *testing.T) {
+	root, down := newOutageTestFs(t, OUTAGE_QUEUE)
+	WRITE_FAILURE_LIMIT = 3
+	defer func() { WRITE_FAILURE_LIMIT = DEFAULT_WRITE_FAILURE_LIMIT }()
+	ctx := context.Background()
+	data := testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1)
+	if err := writeOutageFile(root, "before", data); err != nil {
+		t.Fatalf("writing before the outage: %v", err)
+	}
+	if !health.snapshot().OK {
+		t.Fatalf("the mount is unhealthy before the outage")
+	}
+
+	atomic.StoreInt32(&down.down, 1)
+	var err error
+	for i := 0; i < 20 && err == nil; i++ {
+		// each write finds S3 down again once OUTAGE_RETRY_INTERVAL has passed
+		cache.storeRetryTime = cache.storeRetryTime.Add(-OUTAGE_RETRY_INTERVAL)
+		err = writeOutageFile(root, "during", testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), int64(i)))
+	}
+	if err != fuse.Errno(syscall.EROFS) {
+		t.Fatalf("writing during the outage returned %v", err)
+	}
+	atomic.StoreInt32(&down.down, 0)
+	for name, err := range map[string]error{
+		"Create": writeOutageFile(root, "after", data),
+		"Mkdir":  func() error { _, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"}); return err }(),
+		"Remove": root.Remove(ctx, &fuse.RemoveRequest{Name: "before"}),
+	} {
+		if err != fuse.Errno(syscall.EROFS) {
+			t.Fatalf("%s after the mount became read-only returned %v", name, err)
+		}
+	}
+	resp := health.snapshot()
+	if resp.OK || !resp.ReadOnly || resp.Reason == "" || resp.ReadOnlySince == nil {
+		t.Fatalf("health is %+v", resp)
+	}
+	checkFileData(t, root, "before", data)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"sort"
+	"sync"
+)
+
+// files with at least this many data blocks are deleted by a background job when their last link
+// and handle are gone, so that the removal returns at once, see deleteJob. The blocks of smaller
+// files are deleted before the removal returns.
+var DELETE_JOB_MIN_BLOCKS uint64 = 4096
+
+// the most delete requests a job has in flight at once
+const DELETE_JOB_WORKERS int = 8
+
+// the most objects deleted with one request, which is the most S3 takes in a DeleteObjects request
+const DELETE_REQUEST_KEYS int = 1000
+
+// the data blocks a job deletes between checkpoints
+var DELETE_BATCH_BLOCKS uint64 = uint64(DELETE_JOB_WORKERS * DELETE_REQUEST_KEYS)
+
+// the key of the object recording the delete jobs that have not finished, so that a job cut short by
+// a crash or an unmount is finished by the next mount, rather than leaking the blocks it had left
+const DELETE_JOBS_NAME string = "deletejobs"
+
+/*
+Struct representing the deletion of the blocks of a removed file in the background, one batch at a
+time, and what is recorded of it to resume it. Before each batch is deleted, Next is moved past it
+and the blocks of the batch are recorded, so that a job cut short deletes the batch again and goes
+on from Next. Its inode number is freed once all of its blocks are deleted.
+*/
+type deleteJob struct {
+	Inode uint64                      `json:"inode"`
+	Size  uint64                      `json:"size"`
+	Data  [NUM_DATA_BLOCKS + 3]uint64 `json:"data"` // the block numbers of the inode
+	Next  uint64                      `json:"next"` // the data blocks before it, and the indirect blocks over only them, are deleted
+	Batch []uint64                    `json:"batch,omitempty"`
+
+	path        string // the path the file was removed from, only used for messages
+	inodeStream *IntStream
+	running     bool
+}
+
+/*
+Struct tracking the delete jobs of the mounted file system.
+*/
+type deleteJobTable struct {
+	lock     sync.Mutex
+	jobs     map[uint64]*deleteJob
+	loaded   bool // whether the jobs recorded by earlier mounts were read, which saving keeps
+	stopping bool
+	running  sync.WaitGroup
+}
+
+// the delete jobs of the mounted file system. Set by makeFs.
+var deleteJobs = newDeleteJobTable()
+
+/*
+Returns a pointer to a new table with no delete jobs.
+*/
+func newDeleteJobTable() *deleteJobTable {
+	return &deleteJobTable{jobs: make(map[uint64]*deleteJob)}
+}
+
+/*
+Returns the number of data blocks of the file of the job.
+*/
+func (job *deleteJob) numDataBlocks() uint64 {
+	inode := Inode{storedInode: storedInode{Size: job.Size}}
+	return inode.numDataBlocks()
+}
+
+/*
+Starts deleting the blocks of inode, whose inode number is inodeNum and which was removed from p, in
+the background, and frees the inode number to inodeStream once they are deleted. Called holding
+fsLock. Returns an error if the job could not be recorded, in which case it is not started.
+*/
+func (t *deleteJobTable) start(inode *Inode, inodeNum uint64, p string, inodeStream *IntStream) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	job := &deleteJob{Inode: inodeNum, Size: inode.Size, Data: inode.Data, path: p, inodeStream: inodeStream}
+	t.jobs[inodeNum] = job
+	err := t.save()
+	if err != nil {
+		delete(t.jobs, inodeNum)
+		return err
+	}
+	debugOp(p, "Remove", "deleting the %d blocks of inode=%d in the background", job.numDataBlocks(), inodeNum)
+	t.run(job)
+	return nil
+}
+
+/*
+Reads the jobs recorded by earlier mounts into the table, if they were not read yet. They are not
+started. Called holding t.lock.
+*/
+func (t *deleteJobTable) load() error {
+	if t.loaded {
+		return nil
+	}
+	data, err := store.GetObject(DELETE_JOBS_NAME)
+	if err != nil && isMissingObject(err) {
+		// there are none
+		t.loaded = true
+		return nil
+	}
+	if err != nil {
+		// saving over a record that could not be read would leak the blocks of its jobs
+		return fmt.Errorf("Could not read the delete jobs: %v", err)
+	}
+	var recorded []*deleteJob
+	err = json.Unmarshal(data, &recorded)
+	if err != nil {
+		return fmt.Errorf("Could not decode the delete jobs: %v", err)
+	}
+	for _, job := range recorded {
+		if t.jobs[job.Inode] == nil {
+			t.jobs[job.Inode] = job
+		}
+	}
+	t.loaded = true
+	return nil
+}
+
+/*
+Records the jobs of the table, keeping those recorded by earlier mounts, or deletes the record if
+there are none. Called holding t.lock.
+*/
+func (t *deleteJobTable) save() error {
+	err := t.load()
+	if err != nil {
+		return err
+	}
+	if len(t.jobs) == 0 {
+		return store.DeleteObject(DELETE_JOBS_NAME)
+	}
+	jobs := make([]*deleteJob, 0, len(t.jobs))
+	for _, job := range t.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Inode < jobs[j].Inode })
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		return err
+	}
+	return store.PutObject(DELETE_JOBS_NAME, data)
+}
+
+/*
+Runs job in the background until its blocks are deleted, the table is stopped, or it fails, in
+which case it is left recorded for the next mount to try again. Its calls are made with a context of
+their own, so that they are not aborted along with the request holding fsLock. Called holding
+t.lock.
+*/
+func (t *deleteJobTable) run(job *deleteJob) {
+	job.running = true
+	t.running.Add(1)
+	go func() {
+		defer t.running.Done()
+		defer useAWSContext(context.Background())()
+		err := t.work(job)
+		t.lock.Lock()
+		job.running = false
+		t.lock.Unlock()
+		if err != nil {
+			fmt.Printf("Failed to delete the blocks of inode %d, which the next mount tries again: %v\n", job.Inode, err)
+		}
+	}()
+}
+
+/*
+Does the work of run: deletes the recorded batch of job, if a job cut short left one, and then each
+next batch, recording each before it is deleted, and finally frees the inode number.
+*/
+func (t *deleteJobTable) work(job *deleteJob) error {
+	redo := len(job.Batch) > 0
+	total := job.numDataBlocks()
+	for {
+		if len(job.Batch) > 0 {
+			err := deleteBlocks(job.Batch, redo)
+			if err != nil {
+				return err
+			}
+			redo = false
+		}
+		if job.Next >= total {
+			return t.finish(job)
+		}
+		if t.isStopping() {
+			return nil
+		}
+		err := t.advance(job)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Collects the next batch of job, and records it with Next moved past it.
+*/
+func (t *deleteJobTable) advance(job *deleteJob) error {
+	fsLock.Lock()
+	batch, next, err := job.collect()
+	fsLock.Unlock()
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	job.Batch, job.Next = batch, next
+	return t.save()
+}
+
+/*
+Frees the inode number of job, whose blocks are all deleted, and drops its record.
+*/
+func (t *deleteJobTable) finish(job *deleteJob) error {
+	fsLock.Lock()
+	job.inodeStream.put(job.Inode)
+	var err error
+	if fileKeys != nil {
+		err = fileKeys.destroy(INODE_KEY_KIND, job.Inode)
+	}
+	fsLock.Unlock()
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.jobs, job.Inode)
+	debugOp(job.path, "Remove", "deleted the blocks of inode=%d", job.Inode)
+	return t.save()
+}
+
+/*
+Returns whether the table is stopping, so that jobs must not start another batch.
+*/
+func (t *deleteJobTable) isStopping() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.stopping
+}
+
+/*
+Stops the jobs once they have deleted the batch they are on, and waits for them, leaving the ones
+not finished recorded for the next mount. Called when the file system is unmounted, not holding
+fsLock, which the jobs take to finish their batch.
+*/
+func (t *deleteJobTable) stop() {
+	t.lock.Lock()
+	t.stopping = true
+	t.lock.Unlock()
+	t.running.Wait()
+}
+
+/*
+Returns the number of delete jobs, and the data blocks they have left to delete.
+*/
+func (t *deleteJobTable) counts() (int, uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var pending uint64
+	for _, job := range t.jobs {
+		pending += job.numDataBlocks() - job.Next
+	}
+	return len(t.jobs), pending
+}
+
+/*
+Resumes the delete jobs that earlier mounts of filesys left recorded, freeing their inode numbers to
+filesys once they are done. A job whose inode was linked again, or no longer has the blocks the job
+recorded, is dropped without deleting anything, since its removal was lost, as when the blocks
+written after a crash were discarded (see recoverCacheTable). Called once the file system is
+mounted, before it serves requests.
+*/
+func resumeDeleteJobs(filesys *FS) {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	t := deleteJobs
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	err := t.load()
+	if err != nil {
+		fmt.Println(err.Error())
+		return
+	}
+	dropped := 0
+	for inodeNum, job := range t.jobs {
+		if job.running {
+			continue
+		}
+		inode, err := getInode(inodeNum)
+		if err != nil || inode.LinkCount != 0 || inode.Data != job.Data {
+			fmt.Printf("Not resuming the deletion of the blocks of inode %d, which is not removed as it was when the deletion started.\n", inodeNum)
+			delete(t.jobs, inodeNum)
+			dropped++
+			continue
+		}
+		job.inodeStream = filesys.inodeStream
+		t.run(job)
+	}
+	if len(t.jobs) > 0 {
+		fmt.Printf("Resuming the deletion of the blocks of %d removed files.\n", len(t.jobs))
+	}
+	if dropped > 0 {
+		err = t.save()
+		if err != nil {
+			fmt.Println("Could not record the delete jobs: " + err.Error())
+		}
+	}
+}
+
+/*
+Returns the blocks of the next batch of the job, which are the data blocks from Next to up to
+DELETE_BATCH_BLOCKS past it, and the indirect blocks that point only to data blocks before the end
+of the batch, each after the blocks it points to. Returns the index of the data block after the
+batch too. Holes are passed over, along with the indirect blocks of earlier batches, which are
+deleted. Called holding fsLock, since indirect blocks are read through the cache.
+*/
+func (job *deleteJob) collect() ([]uint64, uint64, error) {
+	total := job.numDataBlocks()
+	end := minUint64(job.Next+DELETE_BATCH_BLOCKS, total)
+	var blocks []uint64
+	var j uint64
+	for j = job.Next; j < NUM_DATA_BLOCKS && j < end; j++ {
+		if job.Data[j] != 0 {
+			blocks = append(blocks, job.Data[j])
+		}
+	}
+	start := NUM_DATA_BLOCKS
+	for depth, indBlockNum := range []uint64{job.Data[IND_BLOCK], job.Data[DOUB_IND_BLOCK], job.Data[TRIP_IND_BLOCK]} {
+		var err error
+		blocks, err = collectIndirect(blocks, indBlockNum, depth+1, start, job.Next, end, total)
+		if err != nil {
+			return nil, 0, err
+		}
+		start += indirectSpan(depth + 1)
+	}
+	return blocks, end, nil
+}
+
+/*
+Helper for collect that appends to blocks those of the batch from data block from to data block to
+under the indirect block with the given depth (1 for singly indirect), which points to the data
+blocks from start on, of the total of the file.
+*/
+func collectIndirect(blocks []uint64, indBlockNum uint64, depth int, start, from, to, total uint64) ([]uint64, error) {
+	spanEnd := minUint64(start+indirectSpan(depth), total)
+	if indBlockNum == 0 || spanEnd <= from || start >= to {
+		return blocks, nil
+	}
+	indBlock, err := getData(indBlockNum)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read indirect block %d: %v", indBlockNum, err)
+	}
+	childSpan := indirectSpan(depth - 1)
+	var j uint64
+	for j = 0; j < BLOCK_POINTERS; j++ {
+		childStart := start + j*childSpan
+		if childStart >= to {
+			break
+		}
+		blockNum := binary.LittleEndian.Uint64(indBlock.Data[j*8 : j*8+8])
+		if depth == 1 {
+			if childStart >= from && blockNum != 0 {
+				blocks = append(blocks, blockNum)
+			}
+			continue
+		}
+		blocks, err = collectIndirect(blocks, blockNum, depth-1, childStart, from, to, total)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if spanEnd <= to {
+		blocks = append(blocks, indBlockNum)
+	}
+	return blocks, nil
+}
+
+/*
+Deletes blocks as deleteBlock does, but with the objects deleted DELETE_REQUEST_KEYS at a time by up
+to DELETE_JOB_WORKERS requests at once, without holding fsLock, so that the file system is not held
+up while they are. The blocks belong to a removed file that nothing reads, and block numbers are not
+reused, so they cannot change meanwhile. If redo is set, some of the blocks may have been deleted
+already by a job cut short, so those in neither the cache nor the store are taken as deleted.
+*/
+func deleteBlocks(blocks []uint64, redo bool) error {
+	keys := make([]string, len(blocks))
+	cacheErrs := make([]error, len(blocks))
+	fsLock.Lock()
+	for n, blockNum := range blocks {
+		keys[n] = genDataKey(blockNum)
+		cacheErrs[n] = cache.deleteBlock(keys[n])
+	}
+	fsLock.Unlock()
+
+	errs := make([]error, len(keys))
+	requests := make(chan int)
+	var workers sync.WaitGroup
+	for w := 0; w < DELETE_JOB_WORKERS; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			defer useAWSContext(context.Background())()
+			for start := range requests {
+				end := start + DELETE_REQUEST_KEYS
+				if end > len(keys) {
+					end = len(keys)
+				}
+				copy(errs[start:end], deleteObjects(store, keys[start:end]))
+			}
+		}()
+	}
+	for start := 0; start < len(keys); start += DELETE_REQUEST_KEYS {
+		requests <- start
+	}
+	close(requests)
+	workers.Wait()
+
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	for n, blockNum := range blocks {
+		err := errs[n]
+		if redo && cacheErrs[n] != nil {
+			err = nil
+		}
+		err = blockDeleted(blockNum, keys[n], cacheErrs[n], err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
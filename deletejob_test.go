@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that removing a large file leaves its blocks to a job, which records its progress, and that a
+job cut short after recording a batch is finished by the next mount, deleting every data and indirect
+block of the file and freeing its inode number.
+*/
+func TestDeleteJob(t *testing.T) {
+	defer func(minBlocks, batchBlocks uint64) {
+		DELETE_JOB_MIN_BLOCKS, DELETE_BATCH_BLOCKS = minBlocks, batchBlocks
+	}(DELETE_JOB_MIN_BLOCKS, DELETE_BATCH_BLOCKS)
+	DELETE_JOB_MIN_BLOCKS = 8
+	DELETE_BATCH_BLOCKS = 16
+	filesys, objects := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	file := writeTestFile(t, root, "big", testData(int(INODE_BUFFER_SIZE+60*BLOCK_SIZE), 1), 1<<16)
+	var keys []string
+	fsLock.Lock()
+	file.inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		keys = append(keys, genDataKey(blockNum))
+		return nil
+	})
+	fsLock.Unlock()
+
+	// the job stops before its first batch, as when the file system is unmounted
+	deleteJobs.stop()
+	err := root.Remove(context.Background(), &fuse.RemoveRequest{Name: "big"})
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	deleteJobs.running.Wait()
+	if jobs, pending := deleteJobs.counts(); jobs != 1 || pending != 60 {
+		t.Fatalf("%d delete jobs with %d blocks left, want 1 with 60", jobs, pending)
+	}
+	if _, err := objects.GetObject(DELETE_JOBS_NAME); err != nil {
+		t.Fatalf("the delete job is not recorded: %v", err)
+	}
+	// the first batch is recorded, and the mount ends before it is deleted
+	err = deleteJobs.advance(deleteJobs.jobs[file.inodeNum])
+	if err != nil {
+		t.Fatalf("advance: %v", err)
+	}
+
+	deleteJobs = newDeleteJobTable()
+	resumeDeleteJobs(filesys)
+	deleteJobs.running.Wait()
+	if jobs, _ := deleteJobs.counts(); jobs != 0 {
+		t.Fatalf("%d delete jobs left after resuming", jobs)
+	}
+	if _, err := objects.GetObject(DELETE_JOBS_NAME); err == nil {
+		t.Fatalf("the finished delete job is still recorded")
+	}
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	for _, key := range keys {
+		if _, err := objects.GetObject(key); err == nil {
+			t.Errorf("block %s is left in the store", key)
+		}
+		if _, err := cache.getBlock(key); err == nil {
+			t.Errorf("block %s is left in the cache", key)
+		}
+	}
+	if freed := filesys.inodeStream.stack.Front(); freed == nil || freed.Value.(uint64) != file.inodeNum {
+		t.Fatalf("the inode number %d was not freed", file.inodeNum)
+	}
+}
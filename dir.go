@@ -5,11 +5,15 @@ package main
 import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"errors"
+	"bufio"
+	"encoding/binary"
 	"fmt"
 	"golang.org/x/net/context"
+	"io"
 	"os"
-	"time"
+	"path"
+	"sort"
+	"syscall"
 )
 
 /*
@@ -19,25 +23,38 @@ type Dir struct {
 	inode       *Inode
 	inodeNum    uint64
 	inodeStream *IntStream
+	path        string // path at lookup time, only used for debug and audit logging
 }
 
 var _ fs.Node = (*Dir)(nil)
 
 /*
-FUSE method that returns meta data about the directory.
+FUSE method that returns meta data about the directory. Its link count is given as 1, as btrfs does,
+rather than 2 plus its subdirectories, which are not counted: tools like find take 1 to mean the
+count is unknown and look in every entry, where a wrong count would make them skip subdirectories.
+The kernel keeps the meta data for ATTR_TTL.
 */
 func (d *Dir) Attr(ctx context.Context, attr *fuse.Attr) error {
-	// fmt.Printf("getting attr of dir with inode %d\n", d.inodeNum)
+	defer trackOp("Attr")()
+	defer recoverPanic("Attr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Attr")()
+	debugOp(d.path, "Attr", "inode=%d size=%d", d.inodeNum, d.inode.Size)
+	attr.Inode = d.inodeNum
 	attr.Size = d.inode.Size
+	attr.Nlink = 1
+	attr.Blocks = d.inode.attrBlocks()
+	attr.BlockSize = uint32(BLOCK_SIZE)
+	attr.Uid = d.inode.Uid
+	attr.Gid = d.inode.Gid
 	var fileMode os.FileMode = 0
-	if d.inode.IsDir == 1 {
+	if d.inode.isDir() {
 		fileMode = 1 << 31
 	}
-	attr.Mode = fileMode
-	fileTime := time.Unix(d.inode.UnixTime, 0)
-	attr.Mtime = fileTime
-	attr.Ctime = fileTime
-	attr.Crtime = fileTime
+	attr.Mode = fileMode | d.inode.perm()
+	d.inode.attrTimes(attr)
+	attr.Valid = ATTR_TTL
 	return nil
 }
 
@@ -50,23 +67,44 @@ type DirHandle struct {
 	inode      *Inode
 	inodeTable *InodeTable
 	inodeNum   uint64
+	path       string
+	names      []string // the names in inodeTable, sorted, which the entries are listed in
+	reaped     bool     // whether the table and names were dropped while idle, see reap
 }
 
 var _ = fs.NodeOpener(&Dir{})
 
 /*
-FUSE method that returns a file handle for the relevant directory.
+FUSE method that returns a file handle for the relevant directory, and starts reading the inodes
+of its entries into the cache.
 */
 func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	// fmt.Printf("opening file with inodeNum: %d\n", d.inodeNum)
-	var offset uint64 = 0
-	tableData, err := d.inode.readFromData(offset, d.inode.Size)
-	table := new(InodeTable)
-	table.UnmarshalBinary(tableData)
+	defer trackOp("Open")()
+	defer recoverPanic("Open")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Open")()
+	debugOp(d.path, "Open", "inode=%d flags=%v", d.inodeNum, req.Flags)
+	if err := checkGeneration(d.inode.Generation, d.inodeNum); err != nil {
+		return nil, err
+	}
+	if err := openHandles.check(d.path); err != nil {
+		return nil, err
+	}
+	table, err := getTable(d.inodeNum, d.inode)
 	handle := &DirHandle{
 		inode:      d.inode,
 		inodeTable: table,
 		inodeNum:   d.inodeNum,
+		path:       d.path,
+	}
+	for name := range table.Table {
+		handle.names = append(handle.names, name)
+	}
+	sort.Strings(handle.names)
+	if err == nil {
+		prefetchEntryInodes(table)
+		openHandles.add(handle, d.path)
 	}
 	return handle, err
 }
@@ -77,11 +115,42 @@ var _ fs.HandleReleaser = (*DirHandle)(nil)
 FUSE method that closes a file handle for a directory.
 */
 func (dh *DirHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	// hopefully this can't have an error
-	tableData, _ := dh.inodeTable.MarshalBinary()
-	var offset uint64 = 0
-	dh.inode.writeToData(tableData, offset)
-	err := putInode(dh.inode, dh.inodeNum)
+	defer trackOp("Release")()
+	defer recoverPanic("Release")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Release")()
+	debugOp(dh.path, "Release", "inode=%d", dh.inodeNum)
+	openHandles.remove(dh)
+	if metadataStore != nil || dh.reaped {
+		// the table of the handle holds the entry items, which are not written to the inode
+		return nil
+	}
+	err := writeTable(dh.inodeTable, dh.inode)
+	if err != nil {
+		return err
+	}
+	return putInode(dh.inode, dh.inodeNum)
+}
+
+var _ = fs.NodeFsyncer(&Dir{})
+
+/*
+FUSE method that writes the directory to S3 before returning, as fsync(2) on a directory does. The
+kernel sends it to the node rather than to the handle. Every change to the directory already writes
+its table and inode to the cache, without waiting for the handle to be released, so this writes the
+blocks of the table and the block holding the inode from the cache to S3. If the file system keeps
+its metadata as items, the entries and the inode are already in DynamoDB, which is not a cache.
+*/
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	defer trackOp("Fsync")()
+	defer recoverPanic("Fsync")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Fsync")()
+	debugOp(d.path, "Fsync", "inode=%d", d.inodeNum)
+	err := flushInode(d.inodeNum)
+	health.noteWrite("syncing a directory", err)
 	return err
 }
 
@@ -91,18 +160,50 @@ var _ = fs.NodeMkdirer(&Dir{})
 FUSE method that makes a new directory in the file system and uploads it.
 */
 func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-	// fmt.Println("doing Mkdir for dir " + req.Name)
+	defer trackOp("Mkdir")()
+	defer recoverPanic("Mkdir")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Mkdir")()
+	debugOp(path.Join(d.path, req.Name), "Mkdir", "parent=%d mode=%v", d.inodeNum, req.Mode)
+	err := checkDirWritable(d.inodeNum, true)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStoreWritable()
+	if err != nil {
+		return nil, err
+	}
+	err = d.checkRoomFor(req.Name)
+	if err != nil {
+		return nil, err
+	}
 	// req contains an os.FileMode but I think it isn't really relevant in this implementation
 	var isDir int8 = 1
 	inode := createInode(isDir)
-	newInodeNum := d.inodeStream.next()
+	newInodeNum := nextInodeNum(d.inodeStream)
 	inode.init(d.inodeNum, newInodeNum)
-	err := putInode(inode, newInodeNum)
-	d.addFile(req.Name, newInodeNum)
+	err = setNewGeneration(inode, newInodeNum)
+	if err == nil {
+		err = setNewOwner(inode, newInodeNum, req.Header)
+	}
+	if err == nil {
+		err = putInode(inode, newInodeNum)
+	}
+	if err == nil {
+		err = d.addFile(req.Name, newInodeNum)
+	}
 	newDir := &Dir{
 		inodeNum:    newInodeNum,
 		inode:       inode,
 		inodeStream: d.inodeStream,
+		path:        path.Join(d.path, req.Name),
+	}
+	if err == nil {
+		liveNodes.add(newInodeNum, newDir)
+		countStat(&mountStats.DirsCreated, 1)
+		audit("mkdir", req.Header, newDir.path, "", newInodeNum)
+		notifyChange("create", newDir.path, "", true)
 	}
 	// should newDir be returned if err != nil?
 	return newDir, err
@@ -110,9 +211,32 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 
 /*
 Helper method that adds a fileName/inodeNum pair to the hash table stored in the directory,
-and uploads the directory inode to reflect the change.
+and uploads the directory inode to reflect the change. Returns fuse.EEXIST if the file system keeps
+its metadata as items and another mount added the name first.
+*/
+func (d *Dir) addFile(name string, inodeNum uint64) error {
+	return d.setEntry(name, inodeNum, INVALID_INODE)
+}
+
+/*
+Points the entry name of the directory at inodeNum. If the file system keeps its metadata as items,
+only the item of the entry is written, and only if the entry still points to prev (INVALID_INODE if
+it should not exist), so that entries changed by another mount are not overwritten. The packed table
+has a single writer, the mount holding fsLock, so prev is not checked there, and records the type of
+the file along with the entry, for listings. The directory is recorded as the parent of the inode in
+the path index. A packed table past its limits is not added to, with the error of checkRoom.
 */
-func (d *Dir) addFile(name string, inodeNum uint64) {
+func (d *Dir) setEntry(name string, inodeNum, prev uint64) error {
+	if metadataStore != nil {
+		err := putEntryItem(d.inodeNum, name, inodeNum, prev)
+		if err == errEntryChanged {
+			return fuse.EEXIST
+		}
+		if err == nil {
+			indexParent(inodeNum, d.inodeNum)
+		}
+		return err
+	}
 	var offset uint64 = 0
 	data, _ := d.inode.readFromData(offset, d.inode.Size)
 	table := new(InodeTable)
@@ -120,13 +244,20 @@ func (d *Dir) addFile(name string, inodeNum uint64) {
 	if err != nil {
 		fmt.Println("VERY BAD error doing unmarshal binary on table: " + err.Error())
 	}
-	table.add(name, inodeNum)
-	data, err = table.MarshalBinary()
+	err = d.checkRoom(table, name)
+	if err != nil {
+		return err
+	}
+	table.addTyped(name, inodeNum, entryType(inodeNum))
+	err = writeTable(table, d.inode)
 	if err != nil {
-		fmt.Println("VERY BAD error doing marshal binary on table: " + err.Error())
+		fmt.Println("VERY BAD error writing table: " + err.Error())
 	}
-	d.inode.writeToData(data, offset)
-	putInode(d.inode, d.inodeNum)
+	err = putInode(d.inode, d.inodeNum)
+	if err == nil {
+		indexParent(inodeNum, d.inodeNum)
+	}
+	return err
 }
 
 /*
@@ -134,6 +265,20 @@ Removes a file with the given name from the directory's inode table. Not to be c
 with Remove, which actually deletes a file from the file system.
 */
 func (d *Dir) removeFile(name string) (uint64, error) {
+	if metadataStore != nil {
+		inodeNum, err := metadataStore.GetEntry(d.inodeNum, name)
+		if err == nil && inodeNum == INVALID_INODE {
+			return 0, fuse.ENOENT
+		}
+		if err == nil {
+			err = deleteEntryItem(d.inodeNum, name, inodeNum)
+		}
+		if err == errEntryChanged {
+			// another mount removed or replaced the entry since it was read
+			return 0, fuse.ENOENT
+		}
+		return inodeNum, err
+	}
 	var offset uint64 = 0
 	data, _ := d.inode.readFromData(offset, d.inode.Size)
 	table := new(InodeTable)
@@ -142,38 +287,53 @@ func (d *Dir) removeFile(name string) (uint64, error) {
 		fmt.Println("VERY BAD error doing unmarshal binary on table: " + err.Error())
 	}
 	inodeNum := table.Table[name]
-	if inodeNum == 0 {
+	if inodeNum == INVALID_INODE {
 		// file does not exist in directory
 		return 0, fuse.ENOENT
 	} else {
 		table.delete(name)
 	}
-	data, err = table.MarshalBinary()
+	err = writeTable(table, d.inode)
 	if err != nil {
-		fmt.Println("VERY BAD error doing marshal binary on table: " + err.Error())
+		fmt.Println("VERY BAD error writing table: " + err.Error())
 	}
-	d.inode.writeToData(data, offset)
 	putInode(d.inode, d.inodeNum)
 	return inodeNum, nil
 }
 
-var _ = fs.NodeStringLookuper(&Dir{})
+var _ = fs.NodeRequestLookuper(&Dir{})
 
 /*
-FUSE method that returns a node corresponding to a directory entry in the current directory,
-if one exists.
+FUSE method that returns a node corresponding to a directory entry in the current directory, if one
+exists, and tells the kernel to keep the entry for ENTRY_TTL.
 */
-func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	// fmt.Printf("doing lookup of dir at inode %d\n", d.inodeNum)
-	var offset uint64 = 0
-	tableData, err := d.inode.readFromData(offset, d.inode.Size)
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = entryValid()
+	return d.lookup(ctx, req.Name)
+}
+
+/*
+Returns a node corresponding to a directory entry in the current directory, if one exists. Called
+by Lookup, and by the other front ends and commands that walk the tree.
+*/
+func (d *Dir) lookup(ctx context.Context, name string) (fs.Node, error) {
+	defer trackOp("Lookup")()
+	defer recoverPanic("Lookup")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Lookup")()
+	debugOp(path.Join(d.path, name), "Lookup", "parent=%d", d.inodeNum)
+	if err := checkGeneration(d.inode.Generation, d.inodeNum); err != nil {
+		return nil, err
+	}
+	if isVirtualDir(d.inodeNum, name) {
+		return &VirtualDir{}, nil
+	}
+	inodeNum, err := lookupEntry(d.inodeNum, d.inode, name)
 	if err != nil {
-		fmt.Println("VERY BAD error doing readFromData from offset 0 in Lookup " + err.Error())
+		fmt.Println("VERY BAD error doing lookupEntry in Lookup " + err.Error())
 	}
-	table := new(InodeTable)
-	table.UnmarshalBinary(tableData)
-	inodeNum := table.Table[name]
-	if inodeNum == 0 {
+	if inodeNum == INVALID_INODE {
 		return nil, fuse.ENOENT
 	} else {
 		inode, err := getInode(inodeNum)
@@ -181,82 +341,555 @@ func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
 			fmt.Println("VERY BAD error doing getInode on existing entry in Lookup: " + err.Error())
 		}
 		var child fs.Node
-		if inode.IsDir == 1 {
+		if inode.isDir() {
 			child = &Dir{
 				inode:       inode,
 				inodeNum:    inodeNum,
 				inodeStream: d.inodeStream,
+				path:        path.Join(d.path, name),
 			}
 		} else {
 			child = &File{
 				inode:       inode,
 				inodeNum:    inodeNum,
+				dirNum:      d.inodeNum,
 				inodeStream: d.inodeStream,
+				path:        path.Join(d.path, name),
 			}
 		}
-		return child, nil
+		return liveNodes.lookedUp(inodeNum, child), nil
 	}
 }
 
 var _ = fs.NodeRenamer(&Dir{})
 
 /*
-FUSE method that renames a file in the directory, and potentially moves it to a new directory.
+FUSE method that renames a file in the directory, and potentially moves it to a new directory. A
+file or empty directory at the new name is replaced in the same metadata transaction, and loses the
+link of that name, see moveEntry.
 */
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDirNode fs.Node) error {
-	// fmt.Printf("doing rename on dir with inodeNum: %d, oldName: "+req.OldName+" newName: "+req.NewName+"\n", d.inodeNum)
-	newDir := newDirNode.(*Dir)
-	// fmt.Printf("newDir has inodeNum: %d\n", newDir.inodeNum)
-	inodeNum, err := d.removeFile(req.OldName)
+	defer trackOp("Rename")()
+	defer recoverPanic("Rename")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Rename")()
+	newDir, ok := newDirNode.(*Dir)
+	if !ok {
+		// the virtual directory, which nothing can be moved into
+		return fuse.EPERM
+	}
+	debugOp(path.Join(d.path, req.OldName), "Rename", "to=%s parent=%d newParent=%d",
+		path.Join(newDir.path, req.NewName), d.inodeNum, newDir.inodeNum)
+	if isVirtualDir(d.inodeNum, req.OldName) || isVirtualDir(newDir.inodeNum, req.NewName) {
+		return fuse.EPERM
+	}
+	err := checkDirWritable(d.inodeNum, false)
+	if err != nil {
+		return err
+	}
+	err = checkStoreWritable()
+	if err != nil {
+		return err
+	}
+	newTable, err := getTable(newDir.inodeNum, newDir.inode)
+	if err != nil {
+		return err
+	}
+	err = checkDirWritable(newDir.inodeNum, newTable.Table[req.NewName] == INVALID_INODE)
+	if err != nil {
+		return err
+	}
+	table, err := getTable(d.inodeNum, d.inode)
+	if err != nil {
+		return err
+	}
+	if table.Table[req.OldName] == INVALID_INODE {
+		return fuse.ENOENT
+	}
+	if d.inodeNum == newDir.inodeNum && req.OldName == req.NewName {
+		return nil
+	}
+	replaced := newTable.Table[req.NewName]
+	if replaced == table.Table[req.OldName] {
+		// both names are links to the same file, which rename(2) leaves as they are
+		return nil
+	}
+	if replaced != INVALID_INODE {
+		err = checkReplace(table.Table[req.OldName], replaced)
+		if err != nil {
+			return err
+		}
+	}
+	if newDir.inodeNum != d.inodeNum {
+		under, err := isUnder(newDir.inodeNum, table.Table[req.OldName])
+		if err != nil {
+			return err
+		}
+		if under {
+			// a directory moved under itself would be cut off from the root along with its tree
+			return fuse.Errno(syscall.EINVAL)
+		}
+	}
+	// a barrier for publishing a file by renaming it over another: its data and inode are in S3
+	// before the new name can be seen, so that the name never points to data only in the cache
+	err = flushInode(table.Table[req.OldName])
 	if err != nil {
 		return err
 	}
-	newDir.addFile(req.NewName, inodeNum)
+	// the entries and inodes are changed together, so that a rename cut short neither loses the
+	// file nor leaves it under both names
+	beginMetadataTransaction()
+	inodeNum, err := d.moveEntry(req.OldName, newDir, req.NewName, replaced)
+	err = commitMetadataTransaction(err)
+	if err == errEntryChanged {
+		// another mount changed one of the names since they were read
+		return fuse.ENOENT
+	}
+	if err != nil {
+		return err
+	}
+	if objectLockEnabled() {
+		flags, err := inheritedDirFlags(newDir.inodeNum)
+		if err == nil && flags != 0 {
+			err = lockTree(inodeNum)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	audit("rename", req.Header, path.Join(d.path, req.OldName), path.Join(newDir.path, req.NewName), inodeNum)
+	notifyChange("rename", path.Join(d.path, req.OldName), path.Join(newDir.path, req.NewName), false)
 	return nil
 }
 
-var _ = fs.HandleReadDirAller(&DirHandle{})
+/*
+Returns an error if the inode with inodeNum cannot be renamed over the inode with replaced, as
+rename(2) has it: a directory can only replace an empty directory, and a file only a file. Marked
+directories cannot be replaced, as they cannot be removed.
+*/
+func checkReplace(inodeNum, replaced uint64) error {
+	inode, err := getInode(inodeNum)
+	if err != nil {
+		return err
+	}
+	replacedInode, err := getInode(replaced)
+	if err != nil {
+		return err
+	}
+	if !replacedInode.isDir() {
+		if inode.isDir() {
+			return fuse.Errno(syscall.ENOTDIR)
+		}
+		return nil
+	}
+	if !inode.isDir() {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	if replacedInode.dirFlags() != 0 {
+		return fuse.EPERM
+	}
+	replacedTable, err := getTable(replaced, replacedInode)
+	if err != nil {
+		return err
+	}
+	if len(replacedTable.Table) != 2 {
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
+	return nil
+}
 
 /*
-FUSE method that returns a list of all directory entries in a directory.
+Moves the entry oldName of the directory to newName in newDir, which pointed to replaced, and
+returns the inode number moved. The inode replaced loses the link of its name, and a directory moved
+to another parent has its ".." entry pointed at it.
 */
-func (dh *DirHandle) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	// fmt.Printf("doing readDirAll of dir with inode %d\n", dh.inodeNum)
-	var res []fuse.Dirent
+func (d *Dir) moveEntry(oldName string, newDir *Dir, newName string, replaced uint64) (uint64, error) {
+	if newDir.inodeNum != d.inodeNum && replaced == INVALID_INODE {
+		err := newDir.checkRoomFor(newName)
+		if err != nil {
+			return 0, err
+		}
+	}
+	inodeNum, err := d.removeFile(oldName)
+	if err != nil {
+		return 0, err
+	}
+	err = newDir.setEntry(newName, inodeNum, replaced)
+	if err != nil {
+		return 0, err
+	}
+	if replaced != INVALID_INODE {
+		// the file (or empty directory) renamed over loses the link of its name, and is deleted if
+		// that was its last
+		replacedInode, err := getInode(replaced)
+		if err == nil {
+			err = unlinkInode(replacedInode, replaced, path.Join(newDir.path, newName), d.inodeStream)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if newDir.inodeNum != d.inodeNum {
+		err = setParentDir(inodeNum, newDir.inodeNum)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if metadataStore != nil {
+		// the tables of the directories are items, so their inodes are not written with them
+		err = touchDir(d.inode, d.inodeNum)
+		if err == nil && newDir.inodeNum != d.inodeNum {
+			err = touchDir(newDir.inode, newDir.inodeNum)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return inodeNum, nil
+}
+
+/*
+Sets the modification and change times of the directory inode to now, as changing its entries does,
+and writes it.
+*/
+func touchDir(inode *Inode, inodeNum uint64) error {
+	inode.modified()
+	return putInode(inode, inodeNum)
+}
 
-	for name, inodeNum := range dh.inodeTable.Table {
-		var dirent fuse.Dirent
-		dirent.Name = name
-		entInode, err := getInode(inodeNum)
+/*
+Returns whether the directory with dirNum is inodeNum or under it, following ".." entries up to the
+root.
+*/
+func isUnder(dirNum, inodeNum uint64) (bool, error) {
+	for {
+		if dirNum == inodeNum {
+			return true, nil
+		}
+		inode, err := getInode(dirNum)
 		if err != nil {
-			fmt.Println("error doing getInode in ReadDirAll: " + err.Error())
+			return false, err
 		}
-		if entInode.IsDir == 1 {
-			dirent.Type = fuse.DT_Dir
-		} else {
-			dirent.Type = fuse.DT_File
+		table, err := decodeTable(inode)
+		if err != nil {
+			return false, err
+		}
+		parent := table.Table[".."]
+		if parent == dirNum || parent == INVALID_INODE {
+			return false, nil
+		}
+		dirNum = parent
+	}
+}
+
+/*
+Points the ".." entry of the inode with inodeNum at parentNum if it is a directory, after it is
+moved to a new parent. Directories under append-only and immutable directories
+find their flags through "..".
+*/
+func setParentDir(inodeNum, parentNum uint64) error {
+	inode, err := getInode(inodeNum)
+	if err != nil || !inode.isDir() {
+		return err
+	}
+	table, err := decodeTable(inode)
+	if err != nil {
+		return err
+	}
+	table.add("..", parentNum)
+	err = writeTable(table, inode)
+	if err != nil {
+		return err
+	}
+	return putInode(inode, inodeNum)
+}
+
+var _ = fs.HandleReader(&DirHandle{})
+
+/*
+FUSE method that returns the directory entries that fit in the request, starting with the entry
+at req.Offset in name order. Only those entries are loaded, rather than every entry of the
+directory at once. The offset of each entry sent is the position of the entry after it, which the
+kernel passes back to continue the listing.
+*/
+func (dh *DirHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	defer trackOp("ReadDir")()
+	defer recoverPanic("ReadDir")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "ReadDir")()
+	openHandles.use(dh)
+	if err := dh.reload(); err != nil {
+		return err
+	}
+	debugOp(dh.path, "ReadDir", "inode=%d offset=%d size=%d entries=%d", dh.inodeNum, req.Offset, req.Size, len(dh.names))
+	for i := req.Offset; i >= 0 && i < int64(len(dh.names)); i++ {
+		entry := fuse.AppendDirent(nil, dh.dirent(dh.names[i]))
+		if len(resp.Data)+len(entry) > req.Size {
+			break
 		}
-		res = append(res, dirent)
+		setDirentOffset(entry, uint64(i+1))
+		resp.Data = append(resp.Data, entry...)
 	}
-	return res, nil
+	return nil
 }
 
 /*
-Returns the inodeTable struct from unmarshaling the data of the directory's inode
+Drops the table and names of a handle left idle, which can be large, as its entries are what is
+held in memory for it. Called with fsLock held.
 */
-func getTable(inode *Inode) (*InodeTable, error) {
+func (dh *DirHandle) reap() {
+	dh.inodeTable = nil
+	dh.names = nil
+	dh.reaped = true
+}
+
+/*
+Reads the table and names of a reaped handle again. The offsets of the entries listed before it was
+reaped are kept, so a listing that goes on may repeat or skip entries added or removed meanwhile.
+Called with fsLock held.
+*/
+func (dh *DirHandle) reload() error {
+	if dh.inodeTable != nil {
+		return nil
+	}
+	table, err := getTable(dh.inodeNum, dh.inode)
+	if err != nil {
+		return err
+	}
+	dh.inodeTable = table
+	dh.names = nil
+	for name := range table.Table {
+		dh.names = append(dh.names, name)
+	}
+	sort.Strings(dh.names)
+	return nil
+}
+
+/*
+Stops tracking a handle that a front end is done with but does not release, since Release writes
+back the entries read at Open, which would undo changes made through other handles since.
+*/
+func (dh *DirHandle) close() {
+	openHandles.remove(dh)
+}
+
+/*
+Returns every entry in the directory, in name order, for the front ends that list whole
+directories.
+*/
+func (dh *DirHandle) readDirAll() []fuse.Dirent {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	debugOp(dh.path, "ReadDirAll", "inode=%d entries=%d", dh.inodeNum, len(dh.names))
+	res := make([]fuse.Dirent, 0, len(dh.names))
+	for _, name := range dh.names {
+		res = append(res, dh.dirent(name))
+	}
+	return res
+}
+
+/*
+Returns the directory entry with name. Its type is taken from the table, and only if the table does
+not hold it (as tables written before format version 14 and entry items do not) is the inode of the
+entry read to tell what type of file it is.
+*/
+func (dh *DirHandle) dirent(name string) fuse.Dirent {
+	inodeNum := dh.inodeTable.Table[name]
+	dirent := fuse.Dirent{Inode: inodeNum, Name: name, Type: dh.inodeTable.entryType(name)}
+	if dirent.Type == fuse.DT_Unknown {
+		dirent.Type = entryType(inodeNum)
+	}
+	if dirent.Type == fuse.DT_Unknown {
+		dirent.Type = fuse.DT_File
+	}
+	return dirent
+}
+
+/*
+Returns the type of the file with inodeNum, read from its inode, or fuse.DT_Unknown if the inode
+cannot be read.
+*/
+func entryType(inodeNum uint64) fuse.DirentType {
+	entInode, err := getInode(inodeNum)
+	if err != nil {
+		fmt.Println("error reading the inode of a directory entry: " + err.Error())
+		return fuse.DT_Unknown
+	}
+	return entInode.direntType()
+}
+
+// the byte order of the offset in encoded directory entries, which is that of the machine
+var direntByteOrder binary.ByteOrder = binary.LittleEndian
+
+// entries are encoded in the byte order of the machine, which is found from the offset of an
+// entry encoded by fuse.AppendDirent, which is its size
+func init() {
+	probe := fuse.AppendDirent(nil, fuse.Dirent{Name: "probe"})
+	if binary.BigEndian.Uint64(probe[8:16]) == uint64(len(probe)) {
+		direntByteOrder = binary.BigEndian
+	}
+}
+
+/*
+Sets the offset of a directory entry encoded by fuse.AppendDirent, which sets it to the entry's
+size.
+*/
+func setDirentOffset(entry []byte, offset uint64) {
+	direntByteOrder.PutUint64(entry[8:16], offset)
+}
+
+/*
+Returns the inodeTable struct from unmarshaling the data of the directory's inode, with the entry
+items of the directory added if the file system keeps its metadata as items.
+*/
+func getTable(inodeNum uint64, inode *Inode) (*InodeTable, error) {
 	var offset uint64 = 0
 	tableData, err := inode.readFromData(offset, inode.Size)
 	table := new(InodeTable)
 	table.UnmarshalBinary(tableData)
+	if err == nil {
+		err = addEntryItems(table, inodeNum)
+	}
+	return table, err
+}
+
+/*
+Returns the table stored in the data of the directory inode, or an error if it cannot be read or
+decoded, which getTable does not report. If the file system keeps its metadata as items, this only
+holds "." and "..".
+*/
+func decodeTable(inode *Inode) (*InodeTable, error) {
+	tableData, err := inode.readFromData(0, inode.Size)
+	if err != nil {
+		return nil, err
+	}
+	table := new(InodeTable)
+	err = table.UnmarshalBinary(tableData)
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+/*
+Returns the whole table of the directory with inodeNum, or an error if it cannot be read or decoded.
+*/
+func readTable(inodeNum uint64, inode *Inode) (*InodeTable, error) {
+	table, err := decodeTable(inode)
+	if err == nil {
+		err = addEntryItems(table, inodeNum)
+	}
 	return table, err
 }
 
 /*
-Writes the table struct to the inode's data
+Adds the entries of the directory with inodeNum that are items in the metadata store to table, if
+the file system keeps its metadata as items.
+*/
+func addEntryItems(table *InodeTable, inodeNum uint64) error {
+	if metadataStore == nil {
+		return nil
+	}
+	entries, err := metadataStore.ListEntries(inodeNum)
+	if err != nil {
+		return err
+	}
+	if table.Table == nil {
+		table.Table = make(map[string]uint64)
+	}
+	for name, entryNum := range entries {
+		table.add(name, entryNum)
+	}
+	return nil
+}
+
+/*
+Returns the inode number of the entry name in the directory with inodeNum, or INVALID_INODE if
+there is none. If the file system keeps its metadata as items, only the item of the entry is read.
+*/
+func lookupEntry(inodeNum uint64, inode *Inode, name string) (uint64, error) {
+	if metadataStore != nil && name != "." && name != ".." {
+		return metadataStore.GetEntry(inodeNum, name)
+	}
+	table, err := decodeTable(inode)
+	if err != nil {
+		return INVALID_INODE, err
+	}
+	return table.Table[name], nil
+}
+
+/*
+Calls fn with the name and inode number of each entry of the directory with inodeNum other than "."
+and "..", in name order, stopping at the first error fn returns and returning it. Tools that walk
+the tree, like fsck, verify, and cp, read directories through this rather than decoding their
+tables, so that a large directory is never held in memory whole: its table is read a block at a time
+as it is decoded, or, if the file system keeps its metadata as items, a page of items at a time.
+Tables in the gob encoding, as earlier versions wrote those that outgrew the inode buffer, cannot be
+decoded a piece at a time, so they are read whole until the directory next changes.
+*/
+func forEachEntry(inodeNum uint64, inode *Inode, fn func(name string, inodeNum uint64) error) error {
+	if metadataStore != nil {
+		// the table in the inode only holds "." and ".."
+		return metadataStore.ForEachEntry(inodeNum, fn)
+	}
+	reader := bufio.NewReaderSize(&inodeDataReader{inode: inode}, int(BLOCK_SIZE))
+	magic, err := reader.ReadByte()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if err == io.EOF || (magic != INLINE_TABLE_MAGIC && magic != INLINE_TYPED_TABLE_MAGIC) {
+		table, err := decodeTable(inode)
+		if err != nil {
+			return err
+		}
+		return table.forEachEntry(fn)
+	}
+	return forEachInlineEntry(reader, inode.Size, magic == INLINE_TYPED_TABLE_MAGIC, func(name string, entryNum uint64, typ fuse.DirentType) error {
+		if name == "." || name == ".." {
+			return nil
+		}
+		return fn(name, entryNum)
+	})
+}
+
+/*
+Struct that reads the data of an inode from the start, as much of it at a time as is asked for.
+*/
+type inodeDataReader struct {
+	inode  *Inode
+	offset uint64
+}
+
+/*
+Reads from the data of the inode at the current offset.
+*/
+func (r *inodeDataReader) Read(p []byte) (int, error) {
+	if r.offset >= r.inode.Size {
+		return 0, io.EOF
+	}
+	data, err := r.inode.readFromData(r.offset, uint64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, data)
+	r.offset += uint64(n)
+	return n, nil
+}
+
+/*
+Writes the table struct to the inode's data. A table that shrinks back into the inode buffer frees
+the data blocks it had grown into, so that a directory that was once large does not keep them.
 */
 func writeTable(table *InodeTable, inode *Inode) error {
 	tableData, err := table.MarshalBinary()
+	if uint64(len(tableData)) <= INODE_BUFFER_SIZE && inode.Size > INODE_BUFFER_SIZE {
+		freeErr := inode.truncateBlocks(0)
+		if freeErr != nil {
+			return freeErr
+		}
+	}
 	var offset uint64 = 0
 	inode.writeToData(tableData, offset)
 	return err
@@ -269,42 +902,106 @@ FUSE method that removes a file from the given directory, deleting it from the f
 it's LinkCount becomes 0.
 */
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	// fmt.Printf("doing remove from dir at inode %d\n", d.inodeNum)
-
-	table, _ := getTable(d.inode)
+	defer trackOp("Remove")()
+	defer recoverPanic("Remove")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Remove")()
+	debugOp(path.Join(d.path, req.Name), "Remove", "parent=%d dir=%v", d.inodeNum, req.Dir)
+	if isVirtualDir(d.inodeNum, req.Name) {
+		return fuse.EPERM
+	}
+	err := checkDirWritable(d.inodeNum, false)
+	if err != nil {
+		return err
+	}
+	err = checkStoreWritable()
+	if err != nil {
+		return err
+	}
+	table, _ := getTable(d.inodeNum, d.inode)
 	inodeNum := table.Table[req.Name]
-	if inodeNum == 0 {
+	if inodeNum == INVALID_INODE {
 		return fuse.ENOENT
 	}
 	inode, err := getInode(inodeNum)
 	if err != nil {
 		return err
 	}
-	if req.Dir == true && inode.IsDir == 1 {
-		removeTable, err := getTable(inode)
+	if inode.dirFlags() != 0 {
+		return fuse.EPERM
+	}
+	if req.Dir == true && inode.isDir() {
+		removeTable, err := getTable(inodeNum, inode)
 		if err != nil {
 			return err
 		}
 		if len(removeTable.Table) != 2 {
 			// dir is not empty
-			return errors.New("Cannot remove non-empty directory " + req.Name + ".")
+			return fuse.Errno(syscall.ENOTEMPTY)
 		}
 	}
-	// fmt.Printf("inode linkCount before decrement is: %d\n", inode.LinkCount)
+	// the link count and the entry are changed together
+	beginMetadataTransaction()
+	err = unlinkInode(inode, inodeNum, path.Join(d.path, req.Name), d.inodeStream)
+	if err == nil {
+		_, err = d.removeFile(req.Name)
+	}
+	err = commitMetadataTransaction(err)
+	if err == errEntryChanged {
+		// another mount removed or replaced the entry since it was read
+		err = fuse.ENOENT
+	}
+	if err == nil {
+		audit("remove", req.Header, path.Join(d.path, req.Name), "", inodeNum)
+		notifyChange("delete", path.Join(d.path, req.Name), "", inode.isDir())
+	}
+	return err
+}
+
+/*
+Drops one link to the inode with inodeNum, whose entry at p is being removed, deleting its data and
+freeing it once no entry links to it. The data is deleted after the inode is written, and after the
+rest of the metadata transaction if there is one, so that a removal cut short leaves blocks no inode
+points to rather than an entry pointing to a file without its data.
+*/
+func unlinkInode(inode *Inode, inodeNum uint64, p string, inodeStream *IntStream) error {
 	inode.LinkCount--
-	if inode.LinkCount == 0 {
-		// fmt.Println("doing deleteAllData in Remove")
-		err = inode.deleteAllData()
-		if err != nil {
-			fmt.Println("err from deleteAllData is: " + err.Error())
-			return err
+	inode.changed()
+	err := putInode(inode, inodeNum)
+	if err != nil || inode.LinkCount != 0 {
+		return err
+	}
+	return afterMetadataCommit(func() error {
+		return freeInode(inode, inodeNum, p, inodeStream)
+	})
+}
+
+/*
+Deletes the data of the inode with inodeNum, which no entry or handle refers to any more, and frees
+its inode number to inodeStream. The data of a file of DELETE_JOB_MIN_BLOCKS or more is deleted by
+a background job instead, which frees the inode number once it is done.
+*/
+func deleteInode(inode *Inode, inodeNum uint64, p string, inodeStream *IntStream) error {
+	if inode.numDataBlocks() >= DELETE_JOB_MIN_BLOCKS {
+		err := deleteJobs.start(inode, inodeNum, p, inodeStream)
+		if err == nil {
+			return nil
 		}
-		// fmt.Printf("doing inodeStream.put for inodeNum: %d\n", inodeNum)
-		d.inodeStream.put(inodeNum)
+		fmt.Println("Could not record the delete job, so deleting the blocks now: " + err.Error())
 	}
-	putInode(inode, inodeNum)
-	_, err = d.removeFile(req.Name)
-	return err
+	err := inode.deleteAllData()
+	if err != nil {
+		fmt.Println("err from deleteAllData is: " + err.Error())
+		return err
+	}
+	debugOp(p, "Remove", "freeing inode=%d", inodeNum)
+	inodeStream.put(inodeNum)
+	if fileKeys != nil {
+		// crypto-erase the inode, which may hold the start of the file's data
+		return fileKeys.destroy(INODE_KEY_KIND, inodeNum)
+	}
+	return nil
 }
 
 var _ = fs.NodeCreater(&Dir{})
@@ -312,43 +1009,100 @@ var _ = fs.NodeCreater(&Dir{})
 /*
 FUSE method that creates a new inode for a file being created in the current directory.
 If called on an existing file, the file is simply opened and a handle is returned, it is not
-overwritten.
+overwritten, though it is emptied if O_TRUNC is set.
 */
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
-	// fmt.Printf("creating file in dir with inode %d\n", d.inodeNum)
-	// fmt.Println("name of file to be created is: " + req.Name)
-	dirTable, err := getTable(d.inode)
+	defer trackOp("Create")()
+	defer recoverPanic("Create")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Create")()
+	debugOp(path.Join(d.path, req.Name), "Create", "parent=%d flags=%v mode=%v", d.inodeNum, req.Flags, req.Mode)
+	if err := openHandles.check(path.Join(d.path, req.Name)); err != nil {
+		return nil, nil, err
+	}
+	flags, err := inheritedDirFlags(d.inodeNum)
+	if err != nil {
+		return nil, nil, err
+	}
+	if flags&DIR_FLAG_IMMUTABLE != 0 {
+		return nil, nil, fuse.EPERM
+	}
+	err = checkStoreWritable()
+	if err != nil {
+		return nil, nil, err
+	}
+	dirTable, err := getTable(d.inodeNum, d.inode)
 	if err != nil {
 		return nil, nil, err
 	}
-	fileExists := dirTable.Table[req.Name] != 0
+	fileExists := dirTable.Table[req.Name] != INVALID_INODE
+	if !fileExists {
+		err = d.checkRoom(dirTable, req.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	var inode *Inode
 	var inodeNum uint64
+	op := "open-write"
 	if !fileExists {
-		// fmt.Println("file does not yet exist in Create")
+		op = "create"
 		var isDir int8 = 0
 		inode = createInode(isDir)
-		inodeNum = d.inodeStream.next()
+		inodeNum = nextInodeNum(d.inodeStream)
 		inode.init(d.inodeNum, inodeNum)
-		d.addFile(req.Name, inodeNum)
+		// the inode is stored before any handle is released, which keeps the link count stored
+		err = setNewGeneration(inode, inodeNum)
+		if err == nil {
+			err = setNewOwner(inode, inodeNum, req.Header)
+		}
+		if err == nil {
+			err = putInode(inode, inodeNum)
+		}
+		if err == nil {
+			err = d.addFile(req.Name, inodeNum)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
 	} else {
-		// fmt.Println("file already exists in Create")
 		inodeNum = dirTable.Table[req.Name]
 		inode, err = getInode(inodeNum)
 		if err != nil {
 			return nil, nil, err
 		}
+		err = truncateOnOpen(req.Flags, inode, inodeNum, path.Join(d.path, req.Name), flags&DIR_FLAG_APPEND_ONLY != 0)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
 	child := &File{
 		inode:       inode,
 		inodeNum:    inodeNum,
+		dirNum:      d.inodeNum,
 		inodeStream: d.inodeStream,
+		path:        path.Join(d.path, req.Name),
 	}
 	handle := &FileHandle{
-		inode:    inode,
-		inodeNum: inodeNum,
+		inode:      inode,
+		inodeNum:   inodeNum,
+		path:       child.path,
+		appendOnly: flags&DIR_FLAG_APPEND_ONLY != 0,
+		appending:  req.Flags&fuse.OpenAppend != 0,
+		writable:   !req.Flags.IsReadOnly(),
+	}
+	openFiles.open(handle)
+	openHandles.add(handle, child.path)
+	audit(op, req.Header, child.path, "", inodeNum)
+	if fileExists {
+		// the node the kernel may already have for the file, given the inode the handle shares
+		return liveNodes.lookedUp(inodeNum, child), handle, nil
 	}
+	liveNodes.add(inodeNum, child)
+	countStat(&mountStats.FilesCreated, 1)
+	notifyChange("create", child.path, "", false)
 	// can any errors happen here?
 	return child, handle, nil
 }
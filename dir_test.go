@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"fmt"
+	"golang.org/x/net/context"
+	"net/http"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+/*
+Returns the root directory of a file system.
+*/
+func testRoot(t testing.TB, filesys *FS) *Dir {
+	t.Helper()
+	root, err := filesys.Root()
+	if err != nil {
+		t.Fatalf("Root: %v", err)
+	}
+	return root.(*Dir)
+}
+
+/*
+Creates and deletes a directory from the root of the file system.
+*/
+func TestMkdirRemove(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+
+	_, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "testDir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	node, err := root.lookup(ctx, "testDir")
+	if err != nil {
+		t.Fatalf("Lookup after Mkdir: %v", err)
+	}
+	if _, ok := node.(*Dir); !ok {
+		t.Fatalf("Lookup returned %T, want *Dir", node)
+	}
+	err = root.Remove(ctx, &fuse.RemoveRequest{Name: "testDir", Dir: true})
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := root.lookup(ctx, "testDir"); err != fuse.ENOENT {
+		t.Fatalf("Lookup after Remove returned %v, want ENOENT", err)
+	}
+}
+
+/*
+Checks that renaming a directory over an empty directory replaces it and frees its inode, and that
+renaming over a directory with entries, a directory over a file, or a file over a directory is
+refused, leaving both names as they were.
+*/
+func TestRenameReplaceDir(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	for _, name := range []string{"src", "empty", "full"} {
+		if _, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: name}); err != nil {
+			t.Fatalf("Mkdir %s: %v", name, err)
+		}
+	}
+	full, _ := root.lookup(ctx, "full")
+	writeTestFile(t, full.(*Dir), "entry", testData(10, 1), 10)
+	writeTestFile(t, root, "file", testData(10, 2), 10)
+
+	refused := []struct {
+		oldName, newName string
+		want             error
+	}{
+		{"src", "full", fuse.Errno(syscall.ENOTEMPTY)},
+		{"src", "file", fuse.Errno(syscall.ENOTDIR)},
+		{"file", "empty", fuse.Errno(syscall.EISDIR)},
+	}
+	for _, r := range refused {
+		err := root.Rename(ctx, &fuse.RenameRequest{OldName: r.oldName, NewName: r.newName}, root)
+		if err != r.want {
+			t.Fatalf("renaming %s over %s returned %v, want %v", r.oldName, r.newName, err, r.want)
+		}
+		if _, err := root.lookup(ctx, r.oldName); err != nil {
+			t.Fatalf("%s is gone after a refused rename: %v", r.oldName, err)
+		}
+	}
+
+	empty, _ := root.lookup(ctx, "empty")
+	src, _ := root.lookup(ctx, "src")
+	err := root.Rename(ctx, &fuse.RenameRequest{OldName: "src", NewName: "empty"}, root)
+	if err != nil {
+		t.Fatalf("Rename over an empty directory: %v", err)
+	}
+	node, err := root.lookup(ctx, "empty")
+	if err != nil || node.(*Dir).inodeNum != src.(*Dir).inodeNum {
+		t.Fatalf("the name does not point to the directory renamed over it, err %v", err)
+	}
+	if _, err := root.lookup(ctx, "src"); err != fuse.ENOENT {
+		t.Fatalf("Lookup of the old name returned %v", err)
+	}
+	if next := filesys.inodeStream.next(); next != empty.(*Dir).inodeNum {
+		t.Fatalf("the replaced directory's inode was not freed, next inode is %d", next)
+	}
+	filesys.inodeStream.put(empty.(*Dir).inodeNum)
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck: %+v", report.problems)
+	}
+}
+
+/*
+Checks that moving a directory to another parent points its ".." entry at the new parent, and that
+moving a directory under itself is refused.
+*/
+func TestRenameDirParent(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	aNode, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "a"})
+	bNode, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "b"})
+	a, b := aNode.(*Dir), bNode.(*Dir)
+	subNode, err := a.Mkdir(ctx, &fuse.MkdirRequest{Name: "sub"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	sub := subNode.(*Dir)
+
+	err = a.Rename(ctx, &fuse.RenameRequest{OldName: "sub", NewName: "sub"}, b)
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	inode, _ := getInode(sub.inodeNum)
+	table, err := decodeTable(inode)
+	if err != nil || table.Table[".."] != b.inodeNum {
+		t.Fatalf("\"..\" of the moved directory is %d, want %d, err %v", table.Table[".."], b.inodeNum, err)
+	}
+
+	for _, dst := range []*Dir{b, sub} {
+		err = root.Rename(ctx, &fuse.RenameRequest{OldName: "b", NewName: "b"}, dst)
+		if err != fuse.Errno(syscall.EINVAL) {
+			t.Fatalf("moving a directory under itself returned %v", err)
+		}
+	}
+	if report := fsck(filesys); len(report.problems) != 0 || report.dirs != 4 {
+		t.Fatalf("fsck: %+v", report)
+	}
+}
+
+/*
+Writes a file through the FUSE handlers in kernel-sized chunks, reads it back, and deletes it,
+checking that its data blocks are freed.
+*/
+func TestCreateWriteReadRemove(t *testing.T) {
+	filesys, objects := newTestFs(t, 4)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	data := testData(120*1000, 1)
+	const chunkSize = 4096
+
+	_, handle, err := root.Create(ctx, &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	fh := handle.(*FileHandle)
+	for offset := 0; offset < len(data); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		resp := new(fuse.WriteResponse)
+		err = fh.Write(ctx, &fuse.WriteRequest{Offset: int64(offset), Data: data[offset:end]}, resp)
+		if err != nil || resp.Size != end-offset {
+			t.Fatalf("Write at %d: size %d, err %v", offset, resp.Size, err)
+		}
+	}
+	err = fh.Release(ctx, &fuse.ReleaseRequest{})
+	if err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	node, err := root.lookup(ctx, "file")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	handle, err = node.(*File).Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh = handle.(*FileHandle)
+	var readData []byte
+	for offset := 0; offset < len(data); offset += chunkSize {
+		size := chunkSize
+		if offset+size > len(data) {
+			size = len(data) - offset
+		}
+		resp := new(fuse.ReadResponse)
+		err = fh.Read(ctx, &fuse.ReadRequest{Offset: int64(offset), Size: size}, resp)
+		if err != nil {
+			t.Fatalf("Read at %d: %v", offset, err)
+		}
+		readData = append(readData, resp.Data...)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Fatalf("data read back differs from data written")
+	}
+	fh.Release(ctx, &fuse.ReleaseRequest{})
+
+	err = root.Remove(ctx, &fuse.RemoveRequest{Name: "file"})
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	for key := range objects.items {
+		if key != genInodeBlockKey(ROOT_INODE) && key != genInodeBlockKey(2) &&
+			key != genOwnerBlockKey(ROOT_INODE) && key != genTimesBlockKey(ROOT_INODE) &&
+			key != genGenerationBlockKey(ROOT_INODE) {
+			t.Errorf("block %s still stored after Remove", key)
+		}
+	}
+}
+
+/*
+Checks that reads past the end of a file, which the kernel makes to fill pages, are cut short
+instead of failing, including on an empty file.
+*/
+func TestReadPastEnd(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+
+	_, handle, err := root.Create(ctx, &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	fh := handle.(*FileHandle)
+	resp := new(fuse.ReadResponse)
+	err = fh.Read(ctx, &fuse.ReadRequest{Offset: 0, Size: 4096}, resp)
+	if err != nil || len(resp.Data) != 0 {
+		t.Fatalf("Read of an empty file returned %d bytes, err %v", len(resp.Data), err)
+	}
+	data := testData(100, 1)
+	fh.Write(ctx, &fuse.WriteRequest{Offset: 0, Data: data}, &fuse.WriteResponse{})
+	resp = new(fuse.ReadResponse)
+	err = fh.Read(ctx, &fuse.ReadRequest{Offset: 50, Size: 4096}, resp)
+	if err != nil || !bytes.Equal(resp.Data, data[50:]) {
+		t.Fatalf("Read past the end returned %d bytes, err %v, want the last 50", len(resp.Data), err)
+	}
+}
+
+/*
+Lists a directory through reads too small for all of its entries, continuing from the offset of
+the last entry each time as the kernel does, and checks every entry is listed once, in order.
+*/
+func TestReadDirInPages(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		_, handle, err := root.Create(ctx, &fuse.CreateRequest{Name: name}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		handle.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+		want = append(want, name)
+	}
+	root.Mkdir(ctx, &fuse.MkdirRequest{Name: "subdir"})
+	want = append([]string{".", ".."}, append(want, "subdir")...)
+
+	handle, err := root.Open(ctx, &fuse.OpenRequest{Dir: true}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	dh := handle.(*DirHandle)
+	var got []string
+	var offset int64
+	for reads := 0; ; reads++ {
+		resp := new(fuse.ReadResponse)
+		err = dh.Read(ctx, &fuse.ReadRequest{Dir: true, Offset: offset, Size: 100}, resp)
+		if err != nil {
+			t.Fatalf("Read at %d: %v", offset, err)
+		}
+		if len(resp.Data) == 0 {
+			break
+		}
+		if reads > len(want) {
+			t.Fatalf("listing does not end")
+		}
+		for data := resp.Data; len(data) > 0; {
+			// the layout of struct fuse_dirent: inode, offset, name length, type, and name
+			offset = int64(direntByteOrder.Uint64(data[8:16]))
+			nameLen := int(direntByteOrder.Uint32(data[16:20]))
+			name := string(data[24 : 24+nameLen])
+			if direntByteOrder.Uint64(data[0:8]) == 0 {
+				t.Errorf("entry %s has inode 0", name)
+			}
+			if isDir := direntByteOrder.Uint32(data[20:24]) == uint32(fuse.DT_Dir); isDir != (name == "subdir" || name == "." || name == "..") {
+				t.Errorf("entry %s has the wrong type", name)
+			}
+			got = append(got, name)
+			data = data[(24+nameLen+7)&^7:]
+		}
+	}
+	if !equalStrings(got, want) {
+		t.Fatalf("listed %v, want %v", got, want)
+	}
+}
+
+/*
+Lists a directory holding a file, a directory, and a link, and checks that the entries have the
+types kept in the table, without reading the inode of any entry.
+*/
+func TestReadDirTypes(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	writeTestFile(t, root, "file", nil, 1)
+	root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	_, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "link", Target: "file"})
+	if err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	table, err := getTable(root.inodeNum, root.inode)
+	if err != nil {
+		t.Fatalf("getTable: %v", err)
+	}
+	dh := &DirHandle{inode: root.inode, inodeTable: table, inodeNum: root.inodeNum}
+	for name := range table.Table {
+		dh.names = append(dh.names, name)
+	}
+	sort.Strings(dh.names)
+
+	cache.empty()
+	cache = newCache(newMemStore(), 16)
+	inodes = newInodeCache(0, 0)
+	want := map[string]fuse.DirentType{".": fuse.DT_Dir, "..": fuse.DT_Dir, "dir": fuse.DT_Dir, "file": fuse.DT_File, "link": fuse.DT_Link}
+	for _, dirent := range dh.readDirAll() {
+		if dirent.Type != want[dirent.Name] {
+			t.Errorf("%s is listed with type %v, want %v", dirent.Name, dirent.Type, want[dirent.Name])
+		}
+	}
+	if len(cache.keyHash) != 0 {
+		t.Fatalf("listing the directory read %d blocks", len(cache.keyHash))
+	}
+}
+
+/*
+Checks that stat reports the link count and the blocks of a file, the block size of the file system,
+and a link count of 1 for directories, so that find does not skip their subdirectories.
+*/
+func TestAttrLinksAndBlocks(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "file", testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1), 1<<16)
+	node, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	node.(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "sub"})
+
+	var attr fuse.Attr
+	file.Attr(ctx, &attr)
+	if attr.Nlink != 1 || attr.Blocks != 2*(BLOCK_SIZE/512) || attr.BlockSize != uint32(BLOCK_SIZE) {
+		t.Fatalf("the file has %d links, %d blocks, and block size %d", attr.Nlink, attr.Blocks, attr.BlockSize)
+	}
+	attr = fuse.Attr{}
+	node.Attr(ctx, &attr)
+	if attr.Nlink != 1 || attr.BlockSize != uint32(BLOCK_SIZE) {
+		t.Fatalf("the directory has %d links and block size %d", attr.Nlink, attr.BlockSize)
+	}
+}
+
+/*
+Checks that a read asking for far more than the file holds only allocates what the file holds, and
+that no read returns more than MAX_READ_SIZE.
+*/
+func TestReadSizeBounded(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	data := testData(int(MAX_READ_SIZE+BLOCK_SIZE), 1)
+	file := writeTestFile(t, root, "file", data, 1<<16)
+
+	data, err := file.inode.readFromData(10, 1<<40)
+	if err != nil || len(data) != int(file.inode.Size)-10 {
+		t.Fatalf("readFromData of 1 TiB returned %d bytes, err %v", len(data), err)
+	}
+	handle, _ := file.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	resp := new(fuse.ReadResponse)
+	err = handle.(*FileHandle).Read(ctx, &fuse.ReadRequest{Size: 1 << 30}, resp)
+	if err != nil || uint64(len(resp.Data)) != MAX_READ_SIZE {
+		t.Fatalf("Read of 1 GiB returned %d bytes, err %v, want MAX_READ_SIZE", len(resp.Data), err)
+	}
+}
+
+/*
+Checks that an empty file can be looked up, stat'd, read, and downloaded, and that reads of nothing
+return no data and no error.
+*/
+func TestZeroLengthFile(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	writeTestFile(t, root, "empty", nil, 1)
+	node, err := root.lookup(ctx, "empty")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	file := node.(*File)
+	var attr fuse.Attr
+	if err := file.Attr(ctx, &attr); err != nil || attr.Size != 0 {
+		t.Fatalf("Attr: size %d, err %v", attr.Size, err)
+	}
+	handle, err := file.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	for _, req := range []*fuse.ReadRequest{{Size: 0}, {Size: 4096}, {Offset: 4096, Size: 4096}} {
+		resp := new(fuse.ReadResponse)
+		err = handle.(*FileHandle).Read(ctx, req, resp)
+		if err != nil || len(resp.Data) != 0 {
+			t.Fatalf("Read at %d of %d: %d bytes, err %v", req.Offset, req.Size, len(resp.Data), err)
+		}
+	}
+	data, err := file.inode.readFromData(0, 0)
+	if err != nil || data == nil || len(data) != 0 {
+		t.Fatalf("readFromData of nothing returned %v, err %v", data, err)
+	}
+	handle.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+
+	// a read of size 0 inside a file that has data returns nothing too
+	full := writeTestFile(t, root, "full", testData(100, 1), 100)
+	if data, err := full.inode.readFromData(50, 0); err != nil || len(data) != 0 {
+		t.Fatalf("readFromData of 0 bytes returned %d bytes, err %v", len(data), err)
+	}
+	if data, err := full.inode.readFromData(100, 10); err != nil || len(data) != 0 {
+		t.Fatalf("readFromData at the end returned %d bytes, err %v", len(data), err)
+	}
+
+	rec := httpDo(newHTTPGateway(filesys, ""), "GET", "/files/empty", nil)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Fatalf("GET of an empty file: status %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+}
+
+/*
+Checks that reads running past the end of a file return exactly the bytes before the end, for ends
+in the inode buffer, in a direct block, and in a block under the indirect block.
+*/
+func TestTailReads(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	sizes := []uint64{
+		INODE_BUFFER_SIZE / 2,
+		INODE_BUFFER_SIZE,
+		INODE_BUFFER_SIZE + 1,
+		INODE_BUFFER_SIZE + BLOCK_SIZE + 10,
+		INODE_BUFFER_SIZE + (NUM_DATA_BLOCKS+2)*BLOCK_SIZE - 3,
+	}
+	for n, size := range sizes {
+		data := testData(int(size), int64(n))
+		file := writeTestFile(t, root, fmt.Sprintf("file%d", n), data, 1<<16)
+		handle, err := file.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		fh := handle.(*FileHandle)
+		for _, back := range []uint64{1, 7, INODE_BUFFER_SIZE / 2, BLOCK_SIZE + 5} {
+			if back > size {
+				continue
+			}
+			offset := size - back
+			resp := new(fuse.ReadResponse)
+			err = fh.Read(ctx, &fuse.ReadRequest{Offset: int64(offset), Size: 2 * int(BLOCK_SIZE)}, resp)
+			if err != nil || !bytes.Equal(resp.Data, data[offset:]) {
+				t.Fatalf("file of %d bytes: read at %d returned %d bytes, err %v, want the last %d", size, offset, len(resp.Data), err, back)
+			}
+		}
+		fh.Release(ctx, &fuse.ReleaseRequest{})
+	}
+}
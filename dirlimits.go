@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"errors"
+	"fmt"
+	"sort"
+	"syscall"
+)
+
+// the most entries a directory may hold, from MaxDirEntries, or 0 for no limit. Every change to a
+// directory decodes and rewrites its whole table, so past some size that takes longer than the
+// change itself; adding more entries fails with EMLINK.
+const DEFAULT_MAX_DIR_ENTRIES uint64 = 250000
+
+var MAX_DIR_ENTRIES uint64 = DEFAULT_MAX_DIR_ENTRIES
+
+// the most bytes the table of a directory may take, from MaxDirTableMB, or 0 for no limit. Adding
+// entries that would grow it past this fails with ENOSPC, which catches directories of long names
+// before MAX_DIR_ENTRIES does.
+const DEFAULT_MAX_DIR_TABLE_BYTES uint64 = 16 << 20
+
+var MAX_DIR_TABLE_BYTES uint64 = DEFAULT_MAX_DIR_TABLE_BYTES
+
+// the most bytes an entry adds to a table besides its name: its inode number and type, and the
+// lengths that come before them
+const DIR_ENTRY_OVERHEAD uint64 = 20
+
+// the percentage of either limit past which a directory is reported by the metrics and a warning is
+// printed, so that it can be split up before changes to it start failing
+const DIR_LIMIT_WARNING_PERCENT uint64 = 90
+
+/*
+Struct describing a directory near its limits, as reported by the metrics.
+*/
+type dirUsage struct {
+	Inode   uint64 `json:"inode"`
+	Path    string `json:"path"`
+	Entries uint64 `json:"entries"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// the directories past DIR_LIMIT_WARNING_PERCENT of a limit when an entry was last added to them,
+// by inode number. Reset by makeFs.
+var dirsNearLimit = make(map[uint64]*dirUsage)
+
+/*
+Sets the directory limits from the config, where 0 leaves the default and -1 removes the limit.
+*/
+func setDirLimits(config *Config) error {
+	if config.MaxDirEntries < -1 || config.MaxDirTableMB < -1 {
+		return errors.New("MaxDirEntries and MaxDirTableMB must be positive, or -1 for no limit.")
+	}
+	MAX_DIR_ENTRIES = DEFAULT_MAX_DIR_ENTRIES
+	if config.MaxDirEntries == -1 {
+		MAX_DIR_ENTRIES = 0
+	} else if config.MaxDirEntries > 0 {
+		MAX_DIR_ENTRIES = uint64(config.MaxDirEntries)
+	}
+	MAX_DIR_TABLE_BYTES = DEFAULT_MAX_DIR_TABLE_BYTES
+	if config.MaxDirTableMB == -1 {
+		MAX_DIR_TABLE_BYTES = 0
+	} else if config.MaxDirTableMB > 0 {
+		MAX_DIR_TABLE_BYTES = uint64(config.MaxDirTableMB) << 20
+	}
+	return nil
+}
+
+/*
+Returns whether used is past DIR_LIMIT_WARNING_PERCENT of limit, if there is a limit.
+*/
+func nearLimit(used, limit uint64) bool {
+	return limit > 0 && used*100 >= limit*DIR_LIMIT_WARNING_PERCENT
+}
+
+/*
+Returns fuse.Errno(syscall.EMLINK) if adding the entry name to the directory, with table, would take
+it past MAX_DIR_ENTRIES, fuse.Errno(syscall.ENOSPC) if it would take its table past
+MAX_DIR_TABLE_BYTES, or nil if it has room. Replacing an entry always has room. Directories whose
+entries are DynamoDB items have no table to rewrite, and no limits. A directory found near a limit
+is recorded for the metrics, with a warning printed the first time. The name of the virtual
+directory cannot be added where it is shown, which fails with fuse.EEXIST.
+*/
+func (d *Dir) checkRoom(table *InodeTable, name string) error {
+	if isVirtualDir(d.inodeNum, name) {
+		return fuse.EEXIST
+	}
+	if metadataStore != nil || table.Table[name] != INVALID_INODE {
+		return nil
+	}
+	// the entries with name added, not counting "." and ".."
+	entries := uint64(len(table.Table)) - 1
+	size := d.inode.Size + uint64(len(name)) + DIR_ENTRY_OVERHEAD
+	if MAX_DIR_ENTRIES > 0 && entries > MAX_DIR_ENTRIES {
+		countStat(&mountStats.DirLimitDenials, 1)
+		return fuse.Errno(syscall.EMLINK)
+	}
+	if MAX_DIR_TABLE_BYTES > 0 && size > MAX_DIR_TABLE_BYTES {
+		countStat(&mountStats.DirLimitDenials, 1)
+		return fuse.Errno(syscall.ENOSPC)
+	}
+	if !nearLimit(entries, MAX_DIR_ENTRIES) && !nearLimit(size, MAX_DIR_TABLE_BYTES) {
+		delete(dirsNearLimit, d.inodeNum)
+		return nil
+	}
+	if dirsNearLimit[d.inodeNum] == nil {
+		fmt.Printf("Directory %s holds %d entries in %d bytes, near its limits of %d entries and %d bytes.\n",
+			d.path, entries, size, MAX_DIR_ENTRIES, MAX_DIR_TABLE_BYTES)
+	}
+	dirsNearLimit[d.inodeNum] = &dirUsage{Inode: d.inodeNum, Path: d.path, Entries: entries, Bytes: size}
+	return nil
+}
+
+/*
+Returns the error checkRoom would for adding the entry name to the directory, reading its table.
+Called before a new inode is stored for the entry, and before an entry is moved from another
+directory, so that reaching a limit neither leaves an inode with no entry nor loses the one moved.
+*/
+func (d *Dir) checkRoomFor(name string) error {
+	if isVirtualDir(d.inodeNum, name) {
+		return fuse.EEXIST
+	}
+	if metadataStore != nil || (MAX_DIR_ENTRIES == 0 && MAX_DIR_TABLE_BYTES == 0) {
+		return nil
+	}
+	table, err := decodeTable(d.inode)
+	if err != nil {
+		return err
+	}
+	return d.checkRoom(table, name)
+}
+
+/*
+Returns the directories near their limits, largest first. Must be called holding fsLock.
+*/
+func nearLimitDirs() []dirUsage {
+	dirs := make([]dirUsage, 0, len(dirsNearLimit))
+	for _, usage := range dirsNearLimit {
+		dirs = append(dirs, *usage)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Entries > dirs[j].Entries })
+	return dirs
+}
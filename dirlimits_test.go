@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+/*
+Checks that a directory at its entry limit refuses new entries with EMLINK, but not replacing one,
+that a rename into it fails without losing the file, that one whose table would pass its size limit
+refuses them with ENOSPC, and that full directories are reported by the metrics.
+*/
+func TestDirLimits(t *testing.T) {
+	defer func() {
+		MAX_DIR_ENTRIES = DEFAULT_MAX_DIR_ENTRIES
+		MAX_DIR_TABLE_BYTES = DEFAULT_MAX_DIR_TABLE_BYTES
+	}()
+	MAX_DIR_ENTRIES = 2
+	MAX_DIR_TABLE_BYTES = 0
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	mountStats = LifetimeStats{}
+	node, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	dir := node.(*Dir)
+	writeTestFile(t, dir, "a", testData(10, 1), 10)
+	writeTestFile(t, dir, "b", testData(10, 2), 10)
+	_, _, err := dir.Create(ctx, &fuse.CreateRequest{Name: "c", Flags: fuse.OpenReadWrite}, new(fuse.CreateResponse))
+	if err != fuse.Errno(syscall.EMLINK) {
+		t.Fatalf("creating a file in a full directory returned %v, want EMLINK", err)
+	}
+	if _, err := dir.Mkdir(ctx, &fuse.MkdirRequest{Name: "sub"}); err != fuse.Errno(syscall.EMLINK) {
+		t.Fatalf("making a directory in a full directory returned %v, want EMLINK", err)
+	}
+	writeTestFile(t, dir, "a", testData(10, 3), 10)
+
+	moved := writeTestFile(t, root, "moved", testData(10, 4), 10)
+	err = root.Rename(ctx, &fuse.RenameRequest{OldName: "moved", NewName: "c"}, dir)
+	if err != fuse.Errno(syscall.EMLINK) {
+		t.Fatalf("renaming into a full directory returned %v, want EMLINK", err)
+	}
+	table, _ := getTable(root.inodeNum, root.inode)
+	if table.Table["moved"] != moved.inodeNum {
+		t.Fatalf("the file renamed into a full directory is no longer in its own")
+	}
+	// the root holds "dir" and "moved", so it is full too
+	metrics := currentMetrics()
+	full := map[string]bool{}
+	for _, near := range metrics.DirsNearLimit {
+		if near.Entries == 2 {
+			full[near.Path] = true
+		}
+	}
+	if len(metrics.DirsNearLimit) != 2 || !full[dir.path] || !full["/"] {
+		t.Fatalf("the metrics report %+v near their limits, want %s and the root, which are full", metrics.DirsNearLimit, dir.path)
+	}
+	if metrics.DirLimitDenials != 3 {
+		t.Fatalf("%d entries refused, want 3", metrics.DirLimitDenials)
+	}
+
+	MAX_DIR_ENTRIES = 0
+	MAX_DIR_TABLE_BYTES = dir.inode.Size + 100
+	_, _, err = dir.Create(ctx, &fuse.CreateRequest{Name: strings.Repeat("n", 100), Flags: fuse.OpenReadWrite}, new(fuse.CreateResponse))
+	if err != fuse.Errno(syscall.ENOSPC) {
+		t.Fatalf("creating a file past the table size limit returned %v, want ENOSPC", err)
+	}
+	writeTestFile(t, dir, "c", testData(10, 5), 10)
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck: %+v", report.problems)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// errors returned by injected faults, modeled on the errors returned by S3 and DynamoDB
+var errInjectedThrottle = errors.New("injected fault: ProvisionedThroughputExceededException: rate exceeded")
+var errInjectedServer = errors.New("injected fault: InternalError: status code 500")
+
+/*
+Struct describing which faults a FaultInjector injects. Rates are the fraction of calls (0 to 1)
+affected by each fault, chosen with a random source seeded from Seed so that runs are repeatable.
+*/
+type FaultConfig struct {
+	Seed            int64
+	ThrottleRate    float64       // calls fail with a throttling error
+	ServerErrorRate float64       // calls fail with a 500 error
+	PartialReadRate float64       // reads succeed but return truncated data
+	LatencyRate     float64       // calls are delayed by Latency before running
+	Latency         time.Duration // the length of a latency spike
+}
+
+/*
+Struct that decides which calls to the wrapped backends fail. Wrap an ObjectStore or CacheTable
+with wrapStore or wrapTable; all wrapped backends share the same random source and counts.
+*/
+type FaultInjector struct {
+	mutex    sync.Mutex
+	config   FaultConfig
+	rand     *rand.Rand
+	failNext []error // errors to return from the next calls, before any random faults
+	calls    int
+	injected int
+}
+
+/*
+Returns a pointer to a new FaultInjector for the given config.
+*/
+func newFaultInjector(config FaultConfig) *FaultInjector {
+	return &FaultInjector{
+		config: config,
+		rand:   rand.New(rand.NewSource(config.Seed)),
+	}
+}
+
+/*
+Makes the next len(errs) calls through the injector fail with errs, in order.
+*/
+func (f *FaultInjector) failNextCalls(errs ...error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failNext = append(f.failNext, errs...)
+}
+
+/*
+Returns the number of calls made through the injector, and how many of them had a fault injected.
+*/
+func (f *FaultInjector) counts() (int, int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls, f.injected
+}
+
+/*
+Decides the fault for a call. Returns whether a read should return partial data, and an error if
+the call should fail. Sleeps first if the call is chosen for a latency spike.
+*/
+func (f *FaultInjector) before(isRead bool) (bool, error) {
+	f.mutex.Lock()
+	f.calls++
+	if len(f.failNext) > 0 {
+		err := f.failNext[0]
+		f.failNext = f.failNext[1:]
+		f.injected++
+		f.mutex.Unlock()
+		return false, err
+	}
+	var err error
+	partial := false
+	delay := f.rand.Float64() < f.config.LatencyRate
+	if f.rand.Float64() < f.config.ThrottleRate {
+		err = errInjectedThrottle
+	} else if f.rand.Float64() < f.config.ServerErrorRate {
+		err = errInjectedServer
+	} else if isRead && f.rand.Float64() < f.config.PartialReadRate {
+		partial = true
+	}
+	if err != nil || partial || delay {
+		f.injected++
+	}
+	f.mutex.Unlock()
+	if delay {
+		time.Sleep(f.config.Latency)
+	}
+	return partial, err
+}
+
+/*
+Returns a prefix of data of random length shorter than data, for a partial read.
+*/
+func (f *FaultInjector) truncate(data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return data[:f.rand.Intn(len(data))]
+}
+
+/*
+Returns an ObjectStore that passes calls through to inner, injecting faults.
+*/
+func (f *FaultInjector) wrapStore(inner ObjectStore) ObjectStore {
+	return &faultyStore{inner: inner, faults: f}
+}
+
+/*
+Returns a CacheTable that passes calls through to inner, injecting faults.
+*/
+func (f *FaultInjector) wrapTable(inner CacheTable) CacheTable {
+	return &faultyTable{inner: inner, faults: f}
+}
+
+/*
+ObjectStore that injects faults into calls to another ObjectStore.
+*/
+type faultyStore struct {
+	inner  ObjectStore
+	faults *FaultInjector
+}
+
+/*
+Gets an object from the inner store, unless a fault is injected.
+*/
+func (s *faultyStore) GetObject(key string) ([]byte, error) {
+	partial, err := s.faults.before(true)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.inner.GetObject(key)
+	if err == nil && partial {
+		data = s.faults.truncate(data)
+	}
+	return data, err
+}
+
+/*
+Puts an object to the inner store, unless a fault is injected.
+*/
+func (s *faultyStore) PutObject(key string, data []byte) error {
+	if _, err := s.faults.before(false); err != nil {
+		return err
+	}
+	return s.inner.PutObject(key, data)
+}
+
+/*
+Deletes an object from the inner store, unless a fault is injected.
+*/
+func (s *faultyStore) DeleteObject(key string) error {
+	if _, err := s.faults.before(false); err != nil {
+		return err
+	}
+	return s.inner.DeleteObject(key)
+}
+
+/*
+CacheTable that injects faults into calls to another CacheTable.
+*/
+type faultyTable struct {
+	inner  CacheTable
+	faults *FaultInjector
+}
+
+/*
+Gets an item from the inner table, unless a fault is injected.
+*/
+func (t *faultyTable) GetItem(key string) ([]byte, error) {
+	partial, err := t.faults.before(true)
+	if err != nil {
+		return nil, err
+	}
+	data, err := t.inner.GetItem(key)
+	if err == nil && partial {
+		data = t.faults.truncate(data)
+	}
+	return data, err
+}
+
+/*
+Puts an item to the inner table, unless a fault is injected.
+*/
+func (t *faultyTable) PutItem(key string, data []byte) error {
+	if _, err := t.faults.before(false); err != nil {
+		return err
+	}
+	return t.inner.PutItem(key, data)
+}
+
+/*
+Deletes an item from the inner table, unless a fault is injected. A fault leaves the item in place.
+*/
+func (t *faultyTable) DeleteItem(key string) ([]byte, error) {
+	if _, err := t.faults.before(false); err != nil {
+		return nil, err
+	}
+	return t.inner.DeleteItem(key)
+}
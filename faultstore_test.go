@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+)
+
+/*
+Sets up a test file system whose store and cache table are wrapped by a FaultInjector with config.
+*/
+func newFaultyTestFs(t *testing.T, cacheSize int, config FaultConfig) (*FS, *FaultInjector) {
+	t.Helper()
+	filesys, objects := newTestFs(t, cacheSize)
+	faults := newFaultInjector(config)
+	store = faults.wrapStore(objects)
+	cache.table = faults.wrapTable(cache.table)
+	return filesys, faults
+}
+
+/*
+Checks that two injectors with the same seed inject the same faults.
+*/
+func TestFaultInjectorDeterministic(t *testing.T) {
+	config := FaultConfig{Seed: 42, ThrottleRate: 0.2, ServerErrorRate: 0.2}
+	run := func() []error {
+		objects := newFaultInjector(config).wrapStore(newMemStore())
+		var errs []error
+		for i := 0; i < 50; i++ {
+			errs = append(errs, objects.PutObject("key", []byte{1}))
+		}
+		return errs
+	}
+	first, second := run(), run()
+	failures := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("call %d: %v != %v", i, first[i], second[i])
+		}
+		if first[i] != nil {
+			failures++
+		}
+	}
+	if failures == 0 || failures == len(first) {
+		t.Fatalf("%d of %d calls failed, want some but not all", failures, len(first))
+	}
+}
+
+/*
+Checks that a truncated object read from the store is reported as an error rather than being
+returned as a zero-padded block.
+*/
+func TestPartialReadRejected(t *testing.T) {
+	newFaultyTestFs(t, 4, FaultConfig{PartialReadRate: 1})
+	block := new(DataBlock)
+	block.Data[0] = 1
+	err := putDataByKey("partial", block)
+	if err != nil {
+		t.Fatalf("putDataByKey: %v", err)
+	}
+	err = cache.empty()
+	if err != nil {
+		t.Fatalf("cache.empty: %v", err)
+	}
+	_, err = getStoredDataByKey("partial")
+	if err == nil {
+		t.Fatalf("getStoredDataByKey returned a truncated block without an error")
+	}
+}
+
+/*
+Checks that failures writing a block to the cache table are returned to the caller.
+*/
+func TestCacheWriteFailure(t *testing.T) {
+	_, faults := newFaultyTestFs(t, 4, FaultConfig{})
+	// the blocks the file system was made with are evicted first, so that the fault hits the table
+	// write of putData rather than an eviction making room for it
+	err := cache.empty()
+	if err != nil {
+		t.Fatalf("cache.empty: %v", err)
+	}
+	before, _ := faults.counts()
+	faults.failNextCalls(errInjectedThrottle)
+	err = putData(5, new(DataBlock))
+	if err != errInjectedThrottle {
+		t.Fatalf("putData returned %v, want %v", err, errInjectedThrottle)
+	}
+	err = putData(5, new(DataBlock))
+	if err != nil {
+		t.Fatalf("putData after the fault returned %v", err)
+	}
+	if calls, injected := faults.counts(); calls-before != 2 || injected != 1 {
+		t.Fatalf("counts() = %d, %d, want %d, 1", calls, injected, before+2)
+	}
+}
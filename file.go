@@ -5,9 +5,9 @@ package main
 import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"bytes"
 	"golang.org/x/net/context"
 	"os"
-	"time"
 )
 
 /*
@@ -16,63 +16,92 @@ Struct representing a file in the FUSE file system.
 type File struct {
 	inode       *Inode
 	inodeNum    uint64
+	dirNum      uint64 // inode of the directory the file was looked up in
 	inodeStream *IntStream
+	path        string // path at lookup time, only used for debug and audit logging
 }
 
 var _ fs.Node = (*File)(nil)
 
 /*
-FUSE method that returns metadata about a particular file.
+FUSE method that returns metadata about a particular file, which the kernel keeps for ATTR_TTL.
 */
 func (f *File) Attr(ctx context.Context, attr *fuse.Attr) error {
-	// fmt.Printf("getting attr of file with inode %d\n", f.inodeNum)
+	defer trackOp("Attr")()
+	defer recoverPanic("Attr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Attr")()
+	debugOp(f.path, "Attr", "inode=%d size=%d", f.inodeNum, f.inode.Size)
+	attr.Inode = f.inodeNum
 	attr.Size = f.inode.Size
+	attr.Nlink = uint32(f.inode.LinkCount)
+	attr.Blocks = f.inode.attrBlocks()
+	attr.BlockSize = uint32(BLOCK_SIZE)
+	attr.Uid = f.inode.Uid
+	attr.Gid = f.inode.Gid
 	var fileMode os.FileMode = 0
-	if f.inode.IsDir == 1 {
+	if f.inode.isDir() {
 		fileMode = 1 << 31
+	} else if f.inode.isSymlink() {
+		fileMode = os.ModeSymlink
+	} else if f.inode.isSpecial() {
+		fileMode = f.inode.specialMode()
+		attr.Rdev = f.inode.rdev()
 	}
-	attr.Mode = fileMode
-	fileTime := time.Unix(f.inode.UnixTime, 0)
-	attr.Mtime = fileTime
-	attr.Ctime = fileTime
-	attr.Crtime = fileTime
+	attr.Mode = fileMode | f.inode.perm()
+	f.inode.attrTimes(attr)
+	attr.Valid = ATTR_TTL
 	return nil
 }
 
-// var _ = fs.NodeSetattrer(&File{})
-
-// /*
-// FUSE method that updates the metadata of a particular file. Importantly, this updates the size,
-// which is necessary for reading/writing correctly.
-
-// This never seems to actually be called, so file size is set manually elsewhere.
-// */
-// func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
-// 	// fmt.Printf("doing setattr of file with inode %d\n", f.inodeNum)
-// 	// should other things be set as well?
-// 	if req.Valid.Size() {
-// 		// fmt.Printf("set size of file in setAttr")
-// 		f.inode.Size = req.Size
-// 	}
-// 	// this is sort of inaccurate but probably good enough
-// 	if req.Valid.Mtime() || req.Valid.Atime() {
-// 		f.inode.UnixTime = req.Mtime.Unix()
-// 	}
-// 	err := putInode(f.inode, f.inodeNum)
-// 	return err
-// }
-
 var _ = fs.NodeOpener(&File{})
 
 /*
-FUSE method that returns a file handle for a file in the file system.
+FUSE method that returns a file handle for a file in the file system, emptying the file if it is
+opened for writing with O_TRUNC.
 */
 func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
-	// fmt.Printf("opening file with inodeNum: %d\n", f.inodeNum)
+	defer trackOp("Open")()
+	defer recoverPanic("Open")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Open")()
+	debugOp(f.path, "Open", "inode=%d flags=%v", f.inodeNum, req.Flags)
+	if err := checkGeneration(f.inode.Generation, f.inodeNum); err != nil {
+		return nil, err
+	}
+	if err := openHandles.check(f.path); err != nil {
+		return nil, err
+	}
 	handle := &FileHandle{
-		inode:    f.inode,
-		inodeNum: f.inodeNum,
+		inode:     f.inode,
+		inodeNum:  f.inodeNum,
+		path:      f.path,
+		appending: req.Flags&fuse.OpenAppend != 0,
+		writable:  !req.Flags.IsReadOnly(),
 	}
+	if !req.Flags.IsReadOnly() {
+		flags, err := inheritedDirFlags(f.dirNum)
+		if err != nil {
+			return nil, err
+		}
+		if flags&DIR_FLAG_IMMUTABLE != 0 {
+			return nil, fuse.EPERM
+		}
+		err = health.check()
+		if err != nil {
+			return nil, err
+		}
+		handle.appendOnly = flags&DIR_FLAG_APPEND_ONLY != 0
+		err = truncateOnOpen(req.Flags, f.inode, f.inodeNum, f.path, handle.appendOnly)
+		if err != nil {
+			return nil, err
+		}
+		audit("open-write", req.Header, f.path, "", f.inodeNum)
+	}
+	openFiles.open(handle)
+	openHandles.add(handle, f.path)
 	return handle, nil
 }
 
@@ -80,8 +109,16 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenR
 Struct that represents a file handle for a File struct.
 */
 type FileHandle struct {
-	inode    *Inode
-	inodeNum uint64
+	inode      *Inode
+	inodeNum   uint64
+	path       string
+	appendOnly bool   // whether the file is under an append-only directory, so writes may only extend it
+	appending  bool   // whether the handle was opened with O_APPEND, so writes go to the end of the file
+	writable   bool   // whether the handle was opened for writing
+	written    bool   // whether the file was written through the handle since it was last released
+	dirty      bool   // whether the file was written through the handle since it was last flushed
+	readEnd    uint64 // where the last read through the handle ended
+	sequential int    // the number of reads in a row that started where the one before ended
 }
 
 var _ fs.Handle = (*FileHandle)(nil)
@@ -89,13 +126,108 @@ var _ fs.Handle = (*FileHandle)(nil)
 var _ fs.HandleReleaser = (*FileHandle)(nil)
 
 /*
-FUSE method that closes a file handle associated with a file, causing the file to be uploaded.
+FUSE method called once the last descriptor of the handle is closed and its mappings are gone, which
+releases the flock locks taken through it. What was written through the handle was made durable when
+it was flushed, so the inode is only stored here if it was written since, as through a mapping. If it
+was the last handle open on a file whose last entry was removed, the file is deleted.
 */
 func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	err := putInode(fh.inode, fh.inodeNum)
+	defer trackOp("Release")()
+	defer recoverPanic("Release")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Release")()
+	debugOp(fh.path, "Release", "inode=%d size=%d", fh.inodeNum, fh.inode.Size)
+	openHandles.remove(fh)
+	var err error
+	if fh.dirty {
+		if err = fh.storeInode(); err == nil {
+			fh.dirty = false
+		}
+	}
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		lockErr := fileLocks.release(fh.inodeNum, req.LockOwner, true)
+		if err == nil {
+			err = lockErr
+		}
+	}
+	if inodeStream := openFiles.release(fh); inodeStream != nil {
+		freeErr := deleteInode(fh.inode, fh.inodeNum, fh.path, inodeStream)
+		if err == nil {
+			err = freeErr
+		}
+		return err
+	}
+	if err == nil && fh.written {
+		fh.written = false
+		notifyChange("modify", fh.path, "", false)
+	}
 	return err
 }
 
+/*
+Writes the inode of the handle. See storeFileInode.
+*/
+func (fh *FileHandle) storeInode() error {
+	return storeFileInode(fh.inode, fh.inodeNum)
+}
+
+/*
+Writes the inode of a file held by a node or handle, keeping the cache hints set, the links made or
+removed, and the owner changed through another node for the file since it was read.
+*/
+func storeFileInode(inode *Inode, inodeNum uint64) error {
+	if stored, err := getInode(inodeNum); err == nil {
+		inode.IsDir = stored.IsDir
+		inode.LinkCount = stored.LinkCount
+		inode.Uid, inode.Gid = stored.Uid, stored.Gid
+	}
+	return putInode(inode, inodeNum)
+}
+
+var _ = fs.HandleFlusher(&FileHandle{})
+
+/*
+FUSE method called each time a file descriptor of the handle is closed, which close(2) waits for,
+unlike the release that follows once every descriptor and mapping of the handle is gone. If the file
+was written through the handle since it was last flushed, its inode and blocks are written to S3 as
+by fsync (see syncFile), so that a file is durable, and a rename made after it is closed sees its
+size, as soon as close returns. An error is returned by close. As POSIX has it, closing any
+descriptor of a file releases the POSIX locks its process holds on the file.
+*/
+func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	defer trackOp("Flush")()
+	defer recoverPanic("Flush")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Flush")()
+	debugOp(fh.path, "Flush", "inode=%d size=%d", fh.inodeNum, fh.inode.Size)
+	err := fileLocks.release(fh.inodeNum, req.LockOwner, false)
+	if err != nil || !fh.dirty {
+		return err
+	}
+	if err = syncFile(fh.inode, fh.inodeNum); err == nil {
+		fh.dirty = false
+	}
+	return err
+}
+
+var _ = fs.NodeFsyncer(&File{})
+
+/*
+FUSE method that writes the file to S3 before returning, so that what was written before an fsync
+survives the loss of the DynamoDB table as well as of the mount. See syncFile.
+*/
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	defer trackOp("Fsync")()
+	defer recoverPanic("Fsync")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Fsync")()
+	debugOp(f.path, "Fsync", "inode=%d size=%d", f.inodeNum, f.inode.Size)
+	return syncFile(f.inode, f.inodeNum)
+}
+
 var _ = fs.HandleReader(&FileHandle{})
 
 /*
@@ -103,27 +235,96 @@ FUSE method that reads from a file handle with a particular offset and size, and
 into the response.
 */
 func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	// fmt.Printf("reading from file with inodeNum: %d\n", fh.inodeNum)
-	// fmt.Printf("in file read inode size is: %d, req size is: %d\n", fh.inode.Size, req.Size)
+	defer trackOp("Read")()
+	defer recoverPanic("Read")
 	size := uint64(req.Size)
-	// if size > fh.inode.Size {
-	// 	return fuse.ESTALE
-	// }
+	if size > MAX_READ_SIZE {
+		size = MAX_READ_SIZE
+	}
+	// the budget is taken before the lock, so that waiting for it does not hold up other requests
+	ioMemory.acquire(int64(size))
+	defer ioMemory.release(int64(size))
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Read")()
+	debugOp(fh.path, "Read", "inode=%d offset=%d size=%d fileSize=%d", fh.inodeNum, req.Offset, req.Size, fh.inode.Size)
+	openHandles.use(fh)
+	// the kernel reads past the end of the file, e.g. to fill pages with the writeback cache, which
+	// readFromData cuts short
 	data, err := fh.inode.readFromData(uint64(req.Offset), size)
 	resp.Data = data
+	countStat(&mountStats.BytesRead, uint64(len(data)))
+	if uint64(req.Offset) == fh.readEnd && fh.sequential > 0 {
+		fh.sequential++
+	} else {
+		fh.sequential = 1
+	}
+	fh.readEnd = uint64(req.Offset) + uint64(len(data))
+	if err == nil && fh.sequential >= READAHEAD_TRIGGER {
+		fh.inode.readAhead(uint64(req.Offset), uint64(len(data)))
+	}
+	if err == nil {
+		err = fh.inode.accessed(fh.inodeNum)
+	}
 	return err
 }
 
 var _ = fs.HandleWriter(&FileHandle{})
 
 /*
-FUSE method that writes to a file handle at a particular offset.
+FUSE method that writes to a file handle at a particular offset, or at the end of the file if the
+handle was opened with O_APPEND. The kernel passes the end of the file as it last saw it, which a
+write through another handle may have moved since, so the end is found again while fsLock is held.
+With the writeback cache, the kernel appends itself and writes back whole pages at their offsets.
 */
 func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
-	// fmt.Printf("writing to file with inodeNum: %d\n", fh.inodeNum)
+	defer trackOp("Write")()
+	defer recoverPanic("Write")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Write")()
+	offset := uint64(req.Offset)
+	if fh.appending && !WRITEBACK_CACHE {
+		offset = openFiles.end(fh.inodeNum, fh.inode)
+	}
+	debugOp(fh.path, "Write", "inode=%d offset=%d size=%d", fh.inodeNum, offset, len(req.Data))
+	openHandles.use(fh)
+	if err := checkStoreWritable(); err != nil {
+		return err
+	}
 
+	if fh.appendOnly && !fh.onlyAppends(offset, req.Data) {
+		return fuse.EPERM
+	}
+	if err := checkQuota(fh.path, fh.inode, offset, uint64(len(req.Data))); err != nil {
+		return err
+	}
+	if fh.appendOnly && objectLockEnabled() {
+		// lock the blocks of files under append-only directories as they are written
+		lockingWrites = true
+		defer func() { lockingWrites = false }()
+	}
 	// this is not very fault tolerant...
-	fh.inode.writeToData(req.Data, uint64(req.Offset))
+	fh.inode.writeToData(req.Data, offset)
+	fh.written, fh.dirty = true, true
+	countStat(&mountStats.BytesWritten, uint64(len(req.Data)))
 	resp.Size = len(req.Data)
 	return nil
 }
+
+/*
+Returns whether writing data at offset only extends the file, leaving its existing bytes as they
+are. With the writeback cache, the kernel writes back whole pages, so an append can rewrite the
+end of the file with the bytes already there.
+*/
+func (fh *FileHandle) onlyAppends(offset uint64, data []byte) bool {
+	if offset >= fh.inode.Size {
+		return true
+	}
+	overlap := uint64(len(data))
+	if offset+overlap > fh.inode.Size {
+		overlap = fh.inode.Size - offset
+	}
+	existing, err := fh.inode.readFromData(offset, overlap)
+	return err == nil && bytes.Equal(existing, data[:overlap])
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+const KEY_SALT_SIZE uint64 = 32
+const SALTS_PER_BLOCK uint64 = BLOCK_SIZE / KEY_SALT_SIZE
+
+// the kinds of things that have their own keys
+const DATA_KEY_KIND string = "data"
+const INODE_KEY_KIND string = "inode"
+
+// the key table of an encrypted file system created with file keys, or nil if there is none
+var fileKeys *keyTable
+
+/*
+Struct that gives every data block and inode of an encrypted file system its own key, derived from
+the file system's data encryption key and a random salt that is replaced every time the block or inode
+is written. The salts are kept in key blocks, which are stored like any other block. Deleting a block
+or freeing an inode zeroes its salt, so copies of it that linger in S3 (in old object versions or
+backups) cannot be decrypted even with the data encryption key, as long as the old versions of the
+key blocks are gone too. Key blocks are named "keys-KIND-NUMBER", without a hash prefix, so that
+a lifecycle rule on the "keys-" prefix can expire their old versions quickly.
+*/
+type keyTable struct {
+	master []byte
+}
+
+/*
+Returns a pointer to a keyTable deriving keys from master.
+*/
+func newKeyTable(master []byte) *keyTable {
+	return &keyTable{
+		master: master,
+	}
+}
+
+/*
+Returns the key of the key block holding the salt of the given kind and number.
+*/
+func genKeyBlockKey(kind string, num uint64) string {
+	return "keys-" + kind + "-" + strconv.FormatUint(num/SALTS_PER_BLOCK, 10)
+}
+
+/*
+Returns the key block holding the salt of the given kind and number, or a new block if it does not
+exist yet. As with inode blocks, a key block is only created by the first number it holds (or the
+first numbers that are allocated), and only if the store says it is missing, so that an error
+reading an existing key block does not cause the salts in it to be overwritten.
+*/
+func getKeyBlock(kind string, num uint64) (*DataBlock, error) {
+	block, err := getDataByKey(genKeyBlockKey(kind, num))
+	if err != nil {
+		if !isMissingObject(err) || (num%SALTS_PER_BLOCK != 0 && num > 2) {
+			return nil, err
+		}
+		block = new(DataBlock)
+	}
+	return block, nil
+}
+
+/*
+Stores salt as the salt of the given kind and number.
+*/
+func (k *keyTable) setSalt(kind string, num uint64, salt []byte) error {
+	block, err := getKeyBlock(kind, num)
+	if err != nil {
+		return err
+	}
+	start := (num % SALTS_PER_BLOCK) * KEY_SALT_SIZE
+	copy(block.Data[start:start+KEY_SALT_SIZE], salt)
+	return putDataByKey(genKeyBlockKey(kind, num), block)
+}
+
+/*
+Returns the salt of the given kind and number, or an error if it was never written or was destroyed.
+*/
+func (k *keyTable) getSalt(kind string, num uint64) ([]byte, error) {
+	block, err := getDataByKey(genKeyBlockKey(kind, num))
+	if err != nil {
+		return nil, err
+	}
+	start := (num % SALTS_PER_BLOCK) * KEY_SALT_SIZE
+	salt := block.Data[start : start+KEY_SALT_SIZE]
+	if bytes.Equal(salt, make([]byte, KEY_SALT_SIZE)) {
+		return nil, fmt.Errorf("the key of %s %d does not exist or has been destroyed", kind, num)
+	}
+	return salt, nil
+}
+
+/*
+Encrypts or decrypts data in place with the key for the given kind, number, and salt. The key is
+only ever used for one version of the data, because the salt is replaced on every write, so CTR mode
+with a fixed IV is safe. It does not change the size of the data, and the data is authenticated by
+the outer encryption of the block it is stored in.
+*/
+func (k *keyTable) crypt(kind string, num uint64, salt []byte, data []byte) error {
+	mac := hmac.New(sha256.New, k.master)
+	mac.Write([]byte("CloudFusion file key\x00" + kind + "\x00"))
+	numBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(numBuf, num)
+	mac.Write(numBuf)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, aes.BlockSize)
+	cipher.NewCTR(block, iv).XORKeyStream(data, data)
+	return nil
+}
+
+/*
+Encrypts data in place for storage as the given kind and number, under a new key.
+*/
+func (k *keyTable) seal(kind string, num uint64, data []byte) error {
+	salt := make([]byte, KEY_SALT_SIZE)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	err = k.setSalt(kind, num, salt)
+	if err != nil {
+		return err
+	}
+	return k.crypt(kind, num, salt, data)
+}
+
+/*
+Decrypts data of the given kind and number in place.
+*/
+func (k *keyTable) open(kind string, num uint64, data []byte) error {
+	salt, err := k.getSalt(kind, num)
+	if err != nil {
+		return err
+	}
+	return k.crypt(kind, num, salt, data)
+}
+
+/*
+Destroys the key of the given kind and number, making every stored copy of it unreadable.
+*/
+func (k *keyTable) destroy(kind string, num uint64) error {
+	return k.setSalt(kind, num, make([]byte, KEY_SALT_SIZE))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that once a file is removed from an encrypted file system, copies of its inode and data
+blocks that linger in the store cannot be decrypted, while other files stay readable.
+*/
+func TestCryptoErase(t *testing.T) {
+	defer resetEncryption()
+	ctx := context.Background()
+	filesys, objects := newEncryptedTestFs(t, 4)
+	root := testRoot(t, filesys)
+	for _, name := range []string{"erased", "kept"} {
+		err := crashWriteFile(ctx, root, name, testData(100*1000, 1))
+		if err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	node, err := root.lookup(ctx, "erased")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	erased := node.(*File)
+	var blocks []uint64
+	erased.inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		blocks = append(blocks, blockNum)
+		return nil
+	})
+	// copy the file's objects as they would linger in old versions or backups
+	cache.empty()
+	cache = newCache(newMemStore(), 4)
+	lingering := make(map[string][]byte)
+	for _, blockNum := range blocks {
+		lingering[genDataKey(blockNum)] = objects.items[genDataKey(blockNum)]
+	}
+	lingering[genInodeBlockKey(erased.inodeNum)] = objects.items[genInodeBlockKey(erased.inodeNum)]
+
+	err = root.Remove(ctx, &fuse.RemoveRequest{Name: "erased"})
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Errorf("fsck after removing a file: %v", report.problems)
+	}
+	cache.empty()
+	cache = newCache(newMemStore(), 4)
+	for key, data := range lingering {
+		objects.put(key, data)
+	}
+	for _, blockNum := range blocks {
+		if _, err := getData(blockNum); err == nil {
+			t.Errorf("block %d of a removed file can still be decrypted", blockNum)
+		}
+	}
+	if _, err := getInode(erased.inodeNum); err == nil {
+		t.Errorf("inode of a removed file can still be decrypted")
+	}
+	node, err = root.lookup(ctx, "kept")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	kept := node.(*File)
+	if _, err := kept.inode.readFromData(0, kept.inode.Size); err != nil {
+		t.Errorf("reading a file that was not removed: %v", err)
+	}
+}
+
+/*
+Checks that a key block that cannot be read is not taken for a missing one, which would replace the
+salts of every file in it with new ones and so make the files unreadable.
+*/
+func TestUnreadableKeyBlock(t *testing.T) {
+	defer resetEncryption()
+	filesys, objects := newEncryptedTestFs(t, 4)
+	writeTestFile(t, testRoot(t, filesys), "file", testData(1000, 1), 1000)
+	cache.empty()
+
+	faults := newFaultInjector(FaultConfig{})
+	store = faults.wrapStore(objects)
+	cache = newCache(newMemStore(), 4)
+	faults.failNextCalls(errInjectedThrottle)
+	if _, err := getKeyBlock(INODE_KEY_KIND, 0); err == nil {
+		t.Fatalf("a key block that could not be read was taken for a missing one")
+	}
+	if _, err := getKeyBlock(INODE_KEY_KIND, SALTS_PER_BLOCK*7); err != nil {
+		t.Fatalf("a key block that does not exist yet: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// the longest a change may exist only in the DynamoDB cache before it is written to S3, or 0 to
+// only write blocks to S3 when they are evicted and on unmount
+var FLUSH_INTERVAL time.Duration
+
+// when the flusher last finished flushing the cache, and the error it got if it failed
+var lastFlush time.Time
+var lastFlushError error
+
+/*
+Struct representing the reply to the "metrics" admin command.
+*/
+type metricsResponse struct {
+	adminResponse
+	FlushInterval  float64    `json:"flushIntervalSeconds"`
+	DirtyBlocks    int        `json:"dirtyBlocks"`     // blocks whose changes are only in the cache
+	ExposureWindow float64    `json:"exposureSeconds"` // how long ago the oldest of them changed
+	LastFlush      *time.Time `json:"lastFlush,omitempty"`
+	LastFlushError string     `json:"lastFlushError,omitempty"`
+	CacheBusy      bool       `json:"cacheBusy,omitempty"`    // the cache fields are missing, see METRICS_LOCK_WAIT
+	QueuedBlocks   int        `json:"queuedBlocks,omitempty"` // blocks past the capacity of the cache that S3 did not take
+
+	// the requests being handled, including those waiting for fsLock, and the latency of those done
+	InFlight       int                   `json:"inFlightRequests"`
+	OldestInFlight float64               `json:"oldestInFlightSeconds"`
+	OldestOp       string                `json:"oldestInFlightOp,omitempty"`
+	LatencyBuckets []float64             `json:"latencyBucketsSeconds"`
+	Ops            map[string]*opMetrics `json:"ops"`
+
+	// the lookups of inodes found decoded in memory, and those that read their block or item
+	InodeCacheHits   uint64 `json:"inodeCacheHits"`
+	InodeCacheMisses uint64 `json:"inodeCacheMisses"`
+
+	Nodes int `json:"nodes"` // the nodes looked up that the kernel has not forgotten, see nodeRegistry
+
+	// the file and directory handles open, and the opens refused past MAX_OPEN_HANDLES
+	OpenHandles    int    `json:"openHandles"`
+	HandlesRefused uint64 `json:"handlesRefused"`
+
+	// the removed files whose blocks are being deleted in the background, and the data blocks they
+	// have left, see deleteJob
+	DeleteJobs     int    `json:"deleteJobs"`
+	PendingDeletes uint64 `json:"pendingDeletes"`
+
+	// whether the free inode list is still being read from the overflow superblocks, see
+	// restoreFreeInodes
+	FreeInodesLoading bool `json:"freeInodesLoading,omitempty"`
+
+	Space *spaceReport `json:"space,omitempty"` // where the space of the file system goes, see currentSpace
+
+	// the directories past DIR_LIMIT_WARNING_PERCENT of MAX_DIR_ENTRIES or MAX_DIR_TABLE_BYTES, and the
+	// entries refused in those at a limit
+	DirsNearLimit   []dirUsage `json:"dirsNearLimit,omitempty"`
+	DirLimitDenials uint64     `json:"dirLimitDenials"`
+}
+
+/*
+Starts flushing the cache every half FLUSH_INTERVAL, writing blocks that changed at least half
+FLUSH_INTERVAL ago to S3, so that no change stays only in the cache for much longer than
+FLUSH_INTERVAL. Does nothing if FLUSH_INTERVAL is 0.
+*/
+func startFlusher() {
+	if FLUSH_INTERVAL <= 0 {
+		return
+	}
+	period := FLUSH_INTERVAL / 2
+	go func() {
+		for range time.Tick(period) {
+			err := flushDueBlocks(period)
+			if err != nil {
+				fmt.Println("Failed to flush the cache to S3: " + err.Error())
+			}
+		}
+	}()
+}
+
+/*
+Writes the blocks that changed at least maxAge ago to S3, taking fsLock for one block at a time, so
+that requests are served between the blocks of a large flush, which can take a while when
+S3_UPLOAD_BANDWIDTH is limited.
+*/
+func flushDueBlocks(maxAge time.Duration) error {
+	fsLock.Lock()
+	keys := cache.dueBlocks(maxAge)
+	fsLock.Unlock()
+	var err error
+	for _, key := range keys {
+		fsLock.Lock()
+		err = cache.flushBlock(key)
+		fsLock.Unlock()
+		if err != nil {
+			break
+		}
+	}
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	if len(keys) > 0 {
+		health.noteWrite("flushing the cache", err)
+	}
+	lastFlush = time.Now()
+	lastFlushError = err
+	return err
+}
+
+/*
+Writes the blocks of the inode with inodeNum that are only in the cache to S3, along with the blocks
+holding the inode, its owner, and its times and, with per-file keys, the key blocks of the inode and
+its data, so that the inode and its data survive the loss of the DynamoDB table. Indirect blocks are
+written like data blocks.
+*/
+func flushInode(inodeNum uint64) error {
+	inode, err := getInode(inodeNum)
+	if err != nil {
+		return err
+	}
+	err = inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		err := cache.flushBlock(genDataKey(blockNum))
+		if err == nil && fileKeys != nil {
+			err = cache.flushBlock(genKeyBlockKey(DATA_KEY_KIND, blockNum))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if fileKeys != nil {
+		err = cache.flushBlock(genKeyBlockKey(INODE_KEY_KIND, inodeNum))
+		if err != nil {
+			return err
+		}
+	}
+	if inodeOwners {
+		err = cache.flushBlock(genOwnerBlockKey(inodeNum))
+		if err != nil {
+			return err
+		}
+	}
+	if inodeTimes {
+		err = cache.flushBlock(genTimesBlockKey(inodeNum))
+		if err != nil {
+			return err
+		}
+	}
+	if inodeGenerations {
+		err = cache.flushBlock(genGenerationBlockKey(inodeNum))
+		if err != nil {
+			return err
+		}
+	}
+	if metadataStore != nil {
+		// the inode is an item in DynamoDB, which is not a cache
+		return nil
+	}
+	return cache.flushBlock(genInodeBlockKey(inodeNum))
+}
+
+/*
+Makes the file with inodeNum durable, as fsync(2) does: writes its inode, held by an open node or
+handle, and then its blocks and the block holding the inode to S3, returning once they are there
+rather than when they are next evicted or flushed.
+*/
+func syncFile(inode *Inode, inodeNum uint64) error {
+	err := storeFileInode(inode, inodeNum)
+	if err != nil {
+		return err
+	}
+	err = flushInode(inodeNum)
+	health.noteWrite("syncing a file", err)
+	return err
+}
+
+/*
+Returns the current metrics of the cache and of the requests being handled. The exposure window is
+the age of the oldest change that is only in the cache, so losing the DynamoDB table now would lose
+the changes made in that window. While flushes succeed, it stays under FLUSH_INTERVAL. Requests that
+pile up in flight, with the oldest of them growing older, are waiting behind a slow one, usually
+on S3 or DynamoDB, and the applications making them hang.
+*/
+func currentMetrics() *metricsResponse {
+	inFlight, oldestOp, oldest, ops := requests.snapshot()
+	resp := &metricsResponse{
+		adminResponse:  adminResponse{OK: true},
+		FlushInterval:  FLUSH_INTERVAL.Seconds(),
+		InFlight:       inFlight,
+		OldestInFlight: oldest.Seconds(),
+		OldestOp:       oldestOp,
+		LatencyBuckets: LATENCY_BUCKETS,
+		Ops:            ops,
+	}
+	resp.InodeCacheHits, resp.InodeCacheMisses = inodes.counts()
+	resp.DirLimitDenials = atomic.LoadUint64(&mountStats.DirLimitDenials)
+	resp.DeleteJobs, resp.PendingDeletes = deleteJobs.counts()
+	if !lockWithin(METRICS_LOCK_WAIT) {
+		resp.CacheBusy = true
+		return resp
+	}
+	defer fsLock.Unlock()
+	dirty, exposure := cache.dirtyBlocks()
+	resp.DirtyBlocks = dirty
+	resp.ExposureWindow = exposure.Seconds()
+	if queued := cache.recentlyUsedQueue.Len() - cache.cacheCapacity; queued > 0 {
+		resp.QueuedBlocks = queued
+	}
+	if mountedFs != nil {
+		resp.Space = currentSpace(mountedFs.info)
+		resp.FreeInodesLoading = mountedFs.freeInodes.loading()
+	}
+	resp.DirsNearLimit = nearLimitDirs()
+	resp.Nodes = liveNodes.count()
+	resp.OpenHandles, resp.HandlesRefused = openHandles.counts()
+	if !lastFlush.IsZero() {
+		flushed := lastFlush
+		resp.LastFlush = &flushed
+	}
+	if lastFlushError != nil {
+		resp.LastFlushError = lastFlushError.Error()
+	}
+	return resp
+}
+
+/*
+Admin command that replies with the current metrics of the cache.
+*/
+func metricsCommand(req *adminRequest, conn net.Conn, enc *json.Encoder) error {
+	return enc.Encode(currentMetrics())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+Checks that flushing writes changed blocks old enough to S3 while keeping them in the cache, and
+that blocks read from S3 or already flushed are not counted as exposed.
+*/
+func TestCacheFlush(t *testing.T) {
+	newTestFs(t, 16)
+	// the blocks of the new file system are not part of the test
+	cache.flush(0)
+	objects := newMemStore()
+	store = objects
+	block := new(DataBlock)
+	block.Data[0] = 1
+	cache.fillBlock(block, "read")
+	putDataByKey("written", block)
+
+	if dirty, _ := cache.dirtyBlocks(); dirty != 1 {
+		t.Fatalf("%d dirty blocks, want only the written one", dirty)
+	}
+	err := cache.flush(time.Hour)
+	if err != nil || len(objects.items) != 0 {
+		t.Fatalf("flush of blocks older than an hour wrote %d blocks, err %v", len(objects.items), err)
+	}
+	err = cache.flush(0)
+	if err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if _, ok := objects.items["written"]; !ok || len(objects.items) != 1 {
+		t.Fatalf("flush wrote %d blocks, want the written one", len(objects.items))
+	}
+	if dirty, exposure := cache.dirtyBlocks(); dirty != 0 || exposure != 0 {
+		t.Fatalf("%d dirty blocks exposed for %v after flushing", dirty, exposure)
+	}
+	if _, err := cache.getBlock("written"); err != nil {
+		t.Fatalf("flushed block left the cache: %v", err)
+	}
+
+	block.Data[0] = 2
+	putDataByKey("written", block)
+	if dirty, _ := cache.dirtyBlocks(); dirty != 1 {
+		t.Fatalf("%d dirty blocks after changing a flushed block, want 1", dirty)
+	}
+}
+
+/*
+Checks that closing a file stores its inode, and that renaming it writes its data and inode to S3
+first, while other changes stay only in the cache.
+*/
+func TestRenameBarrier(t *testing.T) {
+	filesys, objects := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	cache.flush(0)
+	node, handle, _ := root.Create(ctx, &fuse.CreateRequest{Name: "tmp"}, new(fuse.CreateResponse))
+	fh := handle.(*FileHandle)
+	data := testData(int(INODE_BUFFER_SIZE+3*BLOCK_SIZE), 1)
+	fh.Write(ctx, &fuse.WriteRequest{Data: data}, new(fuse.WriteResponse))
+	if err := fh.Flush(ctx, new(fuse.FlushRequest)); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	inodeNum := node.(*File).inodeNum
+	if inode, _ := getInode(inodeNum); inode.Size != uint64(len(data)) {
+		t.Fatalf("stored inode has size %d after closing, want %d", inode.Size, len(data))
+	}
+	writeTestFile(t, root, "other", testData(100, 2), 100)
+
+	err := root.Rename(ctx, &fuse.RenameRequest{OldName: "tmp", NewName: "target"}, root)
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	var keys []string
+	fh.inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		keys = append(keys, genDataKey(blockNum))
+		return nil
+	})
+	for _, key := range keys {
+		if _, ok := objects.items[key]; !ok || !cache.dirtySince[key].IsZero() {
+			t.Fatalf("block %s was not written to S3 before the rename", key)
+		}
+	}
+	// the inode block is shared with the root directory, which the rename changes again
+	start := (inodeNum % (BLOCK_SIZE / INODE_SIZE)) * INODE_SIZE
+	stored := new(Inode)
+	binary.Read(bytes.NewReader(objects.items[genInodeBlockKey(inodeNum)][start:]), binary.LittleEndian, &stored.storedInode)
+	if stored.Size != uint64(len(data)) {
+		t.Fatalf("the inode in S3 has size %d after the rename, want %d", stored.Size, len(data))
+	}
+	if dirty, _ := cache.dirtyBlocks(); dirty == 0 {
+		t.Fatalf("rename flushed the whole cache")
+	}
+	fh.Release(ctx, new(fuse.ReleaseRequest))
+}
+
+/*
+Checks that fsync writes a file still being written, and its inode, to S3 before returning, and
+leaves the other changes in the cache.
+*/
+func TestFsync(t *testing.T) {
+	filesys, objects := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	writeTestFile(t, root, "other", testData(100, 2), 100)
+	node, handle, _ := root.Create(ctx, &fuse.CreateRequest{Name: "file"}, new(fuse.CreateResponse))
+	file := node.(*File)
+	fh := handle.(*FileHandle)
+	data := testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1)
+	fh.Write(ctx, &fuse.WriteRequest{Data: data}, new(fuse.WriteResponse))
+	if err := file.Fsync(ctx, new(fuse.FsyncRequest)); err != nil {
+		t.Fatalf("Fsync: %v", err)
+	}
+	for _, key := range []string{genDataKey(file.inode.Data[0]), genDataKey(file.inode.Data[1]),
+		genInodeBlockKey(file.inodeNum), genOwnerBlockKey(file.inodeNum)} {
+		if _, ok := objects.items[key]; !ok || !cache.dirtySince[key].IsZero() {
+			t.Fatalf("block %s was not written to S3 by fsync", key)
+		}
+	}
+	start := (file.inodeNum % (BLOCK_SIZE / INODE_SIZE)) * INODE_SIZE
+	stored := new(Inode)
+	binary.Read(bytes.NewReader(objects.items[genInodeBlockKey(file.inodeNum)][start:]), binary.LittleEndian, &stored.storedInode)
+	if stored.Size != uint64(len(data)) {
+		t.Fatalf("the inode in S3 has size %d after fsync, want %d", stored.Size, len(data))
+	}
+	if dirty, _ := cache.dirtyBlocks(); dirty == 0 {
+		t.Fatalf("fsync flushed the whole cache")
+	}
+	fh.Release(ctx, new(fuse.ReleaseRequest))
+}
+
+/*
+Checks that closing a file written through a handle writes its blocks and inode to S3 before
+returning, that closing it again without writing writes nothing, and that the release stores what
+was written after the last close.
+*/
+func TestCloseFlushes(t *testing.T) {
+	filesys, objects := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, handle, _ := root.Create(ctx, &fuse.CreateRequest{Name: "file"}, new(fuse.CreateResponse))
+	file := node.(*File)
+	fh := handle.(*FileHandle)
+	data := testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1)
+	fh.Write(ctx, &fuse.WriteRequest{Data: data}, new(fuse.WriteResponse))
+	if err := fh.Flush(ctx, new(fuse.FlushRequest)); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for _, key := range []string{genDataKey(file.inode.Data[0]), genDataKey(file.inode.Data[1]),
+		genInodeBlockKey(file.inodeNum)} {
+		if _, ok := objects.items[key]; !ok || !cache.dirtySince[key].IsZero() {
+			t.Fatalf("block %s was not written to S3 when the file was closed", key)
+		}
+	}
+
+	writeTestFile(t, root, "other", testData(100, 2), 100)
+	dirtyBefore, _ := cache.dirtyBlocks()
+	if err := fh.Flush(ctx, new(fuse.FlushRequest)); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if dirty, _ := cache.dirtyBlocks(); dirty != dirtyBefore {
+		t.Fatalf("closing a file not written since it was last closed wrote %d blocks", dirtyBefore-dirty)
+	}
+
+	fh.Write(ctx, &fuse.WriteRequest{Offset: int64(len(data)), Data: testData(10, 3)}, new(fuse.WriteResponse))
+	fh.Release(ctx, new(fuse.ReleaseRequest))
+	if inode, _ := getInode(file.inodeNum); inode.Size != uint64(len(data)+10) {
+		t.Fatalf("stored inode has size %d after the release, want %d", inode.Size, len(data)+10)
+	}
+}
+
+/*
+Checks that fsync on a directory writes its table, with the entries added since it was opened, to
+S3 before returning.
+*/
+func TestDirFsync(t *testing.T) {
+	filesys, objects := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	dir := node.(*Dir)
+	handle, _ := dir.Open(ctx, new(fuse.OpenRequest), new(fuse.OpenResponse))
+	cache.flush(0)
+	writeTestFile(t, dir, "file", testData(100, 1), 100)
+	key := genInodeBlockKey(dir.inodeNum)
+	if cache.dirtySince[key].IsZero() {
+		t.Fatalf("the inode block of the directory was written to S3 before fsync")
+	}
+	if err := dir.Fsync(ctx, new(fuse.FsyncRequest)); err != nil {
+		t.Fatalf("Fsync: %v", err)
+	}
+	if !cache.dirtySince[key].IsZero() {
+		t.Fatalf("the inode block of the directory is still only in the cache after fsync")
+	}
+	start := (dir.inodeNum % (BLOCK_SIZE / INODE_SIZE)) * INODE_SIZE
+	stored := new(Inode)
+	binary.Read(bytes.NewReader(objects.items[key][start:]), binary.LittleEndian, &stored.storedInode)
+	table, err := decodeTable(stored)
+	if err != nil || table.Table["file"] == INVALID_INODE {
+		t.Fatalf("the table in S3 has entries %v after fsync, err %v", table, err)
+	}
+	handle.(*DirHandle).Release(ctx, new(fuse.ReleaseRequest))
+}
+
+/*
+Reads the metrics from the admin socket.
+*/
+func TestMetricsCommand(t *testing.T) {
+	newTestFs(t, 16)
+	FLUSH_INTERVAL = time.Minute
+	defer func() { FLUSH_INTERVAL = 0 }()
+	cache.flush(0)
+	putDataByKey("written", new(DataBlock))
+	lastFlush = time.Time{}
+
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	err := startAdminSocket(socketPath)
+	if err != nil {
+		t.Fatalf("startAdminSocket: %v", err)
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("connecting to the admin socket: %v", err)
+	}
+	defer conn.Close()
+	json.NewEncoder(conn).Encode(&adminRequest{Command: "metrics"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("reading the metrics: %v", err)
+	}
+	var metrics metricsResponse
+	json.Unmarshal(line, &metrics)
+	if !metrics.OK || metrics.FlushInterval != 60 || metrics.DirtyBlocks != 1 || metrics.ExposureWindow <= 0 || metrics.LastFlush != nil {
+		t.Fatalf("metrics %s", line)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"time"
+)
+
+// the longest to wait before retrying to read the overflow superblocks of the free inode list
+const MAX_FREE_INODES_RETRY time.Duration = 30 * time.Second
+
+// the longest unmounting waits for the free inode list to be restored. Past it the superblock is
+// written without the free inode numbers not yet restored, which are then never reused, but are
+// never given to two files either.
+const FREE_INODES_UNMOUNT_WAIT time.Duration = time.Minute
+
+/*
+Struct tracking the free inode list of a mounted file system whose overflow superblocks are being
+read in the background, so that the mount serves requests without waiting for them. Until the list
+is restored, new files get inode numbers past the last allocated, which are not on it.
+*/
+type freeInodeLoad struct {
+	done   chan struct{} // closed once the list is restored
+	blocks uint64        // the overflow superblocks holding the list
+}
+
+/*
+Starts reading the part of the free inode list of contents held by its overflow superblocks, and
+adding the inode numbers on it to the stack of inodeStream, behind any freed since the mount, as
+they were when the list was written. Each overflow superblock is read holding fsLock, since it goes
+through the cache. Reading is retried until it succeeds.
+*/
+func startFreeInodeLoad(contents *superblockContents, inodeStream *IntStream) *freeInodeLoad {
+	load := &freeInodeLoad{
+		done:   make(chan struct{}),
+		blocks: (contents.overflowBytes + BLOCK_SIZE - 1) / BLOCK_SIZE,
+	}
+	fetch := func(key string) (*DataBlock, error) {
+		fsLock.Lock()
+		defer fsLock.Unlock()
+		return getDataByKey(key)
+	}
+	go func() {
+		defer close(load.done)
+		start := time.Now()
+		wait := time.Second
+		for {
+			err := contents.readOverflow(fetch)
+			if err == nil {
+				break
+			}
+			fmt.Printf("Failed to read the free inode list, retrying in %v: %v\n", wait, err)
+			time.Sleep(wait)
+			if wait *= 2; wait > MAX_FREE_INODES_RETRY {
+				wait = MAX_FREE_INODES_RETRY
+			}
+		}
+		restored := new(IntStream)
+		restored.UnmarshalBinary(contents.inodeListData)
+		fsLock.Lock()
+		defer fsLock.Unlock()
+		count := restored.stack.Len()
+		for e := restored.stack.Front(); e != nil; e = e.Next() {
+			inodeStream.stack.PushBack(e.Value)
+		}
+		fmt.Printf("Restored %d free inode numbers from %d overflow superblocks in %v.\n",
+			count, load.blocks, time.Since(start).Round(time.Millisecond))
+	}()
+	return load
+}
+
+/*
+Returns whether the free inode list has been restored, waiting up to timeout for it. A nil load,
+of a list read with the superblock, is always restored. Must not be called holding fsLock.
+*/
+func (load *freeInodeLoad) wait(timeout time.Duration) bool {
+	if load == nil {
+		return true
+	}
+	select {
+	case <-load.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+/*
+Returns whether the free inode list is still being restored.
+*/
+func (load *freeInodeLoad) loading() bool {
+	if load == nil {
+		return false
+	}
+	select {
+	case <-load.done:
+		return false
+	default:
+		return true
+	}
+}
+
+/*
+Sets the stack of inodeStream from the part of the free inode list of contents held by the first
+superblock, which is all of it unless contents.overflowBytes is set, and starts restoring the rest
+in the background. Returns the load restoring it, or nil if there is nothing to restore.
+*/
+func restoreFreeInodes(contents *superblockContents, inodeStream *IntStream) *freeInodeLoad {
+	if contents.overflowBytes > 0 {
+		inodeStream.stack = new(list.List)
+		return startFreeInodeLoad(contents, inodeStream)
+	}
+	if len(contents.inodeListData) > 0 {
+		inodeStream.UnmarshalBinary(contents.inodeListData)
+	} else {
+		inodeStream.stack = new(list.List)
+	}
+	return nil
+}
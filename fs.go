@@ -7,7 +7,9 @@ import (
 	"container/list"
 	"encoding/binary"
 	"fmt"
+	"golang.org/x/net/context"
 	"strconv"
+	"sync"
 )
 
 /*
@@ -16,20 +18,37 @@ struct representing the FUSE file system.
 type FS struct {
 	inodeStream *IntStream
 	rootInode   uint64
+	info        *SuperblockInfo
+	destroyOnce sync.Once
+	freeInodes  *freeInodeLoad // the free inode list being restored, or nil, see restoreFreeInodes
+	id          string         // the ID the superblock is written as, see SuperblockInfo.Writer
+	cacheMarked bool           // whether the cache marker was put, see markCache
 }
 
 var _ fs.FS = (*FS)(nil)
 
+// FUSE requests are served concurrently, but the in-memory state they share (the streams, the
+// cache, and inodes shared between nodes and handles) is not safe for concurrent use, so every
+// handler holds this lock while it runs.
+var fsLock sync.Mutex
+
 /*
 FUSE method that returns a directory corresponding to the root of the file system.
 */
 func (f *FS) Root() (fs.Node, error) {
+	defer trackOp("Root")()
+	defer recoverPanic("Root")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(context.Background(), "Root")()
 	inode, err := getInode(f.rootInode)
 	root := &Dir{
 		inode:       inode,
 		inodeNum:    f.rootInode,
 		inodeStream: f.inodeStream,
+		path:        "/",
 	}
+	liveNodes.add(f.rootInode, root)
 	return root, err
 }
 
@@ -38,10 +57,25 @@ var _ = fs.FSDestroyer(&FS{})
 /*
 FUSE method that performs clean up on the file system when it is unmounted. Also called if there
 is an interrupt. The method empties the cache and uploads the superblock to S3. If this fails
-to execute before program termination, it is likely the table/bucket will become unusable
-unless they are manually emptied.
+to execute before program termination, the blocks left in the table are reconciled with the
+bucket on the next mount (see recoverCacheTable).
 */
 func (f *FS) Destroy() {
+	// Destroy can be reached from an unmount, an interrupt, and a panic, but must only run once
+	f.destroyOnce.Do(f.destroy)
+}
+
+/*
+Does the work of Destroy.
+*/
+func (f *FS) destroy() {
+	if !f.freeInodes.wait(FREE_INODES_UNMOUNT_WAIT) {
+		fmt.Println("The free inode list is still being read, so the inode numbers not yet restored will not be reused.")
+	}
+	// the jobs not finished go on from where they stopped on the next mount
+	deleteJobs.stop()
+	fsLock.Lock()
+	defer fsLock.Unlock()
 	fmt.Println()
 	fmt.Println("Beginning file system cleanup.")
 	lastInode := f.inodeStream.compressStream()
@@ -50,87 +84,118 @@ func (f *FS) Destroy() {
 	if err != nil {
 		fmt.Println("VERY BAD ERROR IN inodeStream.MarshalBinary")
 	}
-	superBlocks := makeSuperblocks(lastInode, lastData, f.rootInode, inodeLinkedList)
-	client := getClient()
+	// file systems mounted from a legacy superblock are upgraded when it is rewritten
+	if f.info.FormatVersion != FORMAT_VERSION {
+		f.info.FormatVersion = FORMAT_VERSION
+		if f.info.UUID == "" {
+			f.info.UUID = newUUID()
+		}
+	}
+	f.info.Stats.addMount()
+	f.info.Orphans = append(f.info.Orphans, openFiles.orphans()...)
+	f.info.Writer = f.id
+	payload, err := encodeSuperPayload(f.info, inodeLinkedList)
+	if err != nil {
+		fmt.Println("VERY BAD ERROR encoding superblock payload: " + err.Error())
+	}
+	superBlocks := makeSuperblocks(lastInode, lastData, f.rootInode, payload)
 	for index, block := range superBlocks {
 		blockName := S3_SUPERBLOCK_NAME + strconv.Itoa(index)
-		err = putDataByKey(client, blockName, block)
+		err = putDataByKey(blockName, block)
 		if err != nil {
 			fmt.Println("error writing superblock on FS.Destroy: " + err.Error())
 		}
 	}
+	err = fileLocks.releaseAll()
+	if err != nil {
+		fmt.Println("Error releasing file locks: " + err.Error())
+	}
 	err = cache.empty()
 	if err != nil {
 		fmt.Println("Error doing cache.empty(): " + err.Error())
+	} else if f.cacheMarked {
+		err = store.DeleteObject(CACHE_MARKER_NAME)
+		if err != nil {
+			fmt.Println("Error deleting the cache marker, so the next mount checks the cache table: " + err.Error())
+		}
+	}
+	if auditLog != nil {
+		auditLog.close()
+	}
+	err = releaseMountLease()
+	if err != nil {
+		fmt.Println("Error releasing the mount lease: " + err.Error())
 	}
 	// would call unmount here, but for some reason it hangs for ~20 seconds
 	fmt.Println("File system cleanup successful.")
 }
 
 /*
-Return a pointer to a new FS initialized with values from the super data block
+Return a pointer to a new FS initialized with values from the super data block. Returns an error
+if the superblock cannot be read or is in a format this binary does not support.
 */
-func makeFs(super *DataBlock) *FS {
+func makeFs(super *DataBlock) (*FS, error) {
 	// fmt.Println("doing makeFS")
-	rootInode := binary.LittleEndian.Uint64(super.Data[16:24])
-	listSize := binary.LittleEndian.Uint64(super.Data[24:32])
+	// the overflow superblocks holding the rest of the free inode list are read once the mount
+	// serves requests, see restoreFreeInodes
+	contents, err := readSuperblockHead(super, getDataByKey)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFormatSupported(contents.info)
+	if err != nil {
+		return nil, err
+	}
+	// each mount starts out healthy, even after one made read-only by write failures, and with none
+	// of the inodes read, files opened, or directories found near their limits by the last
+	health = new(writeHealth)
+	inodes = newInodeCache(INODE_CACHE_SIZE, INODE_CACHE_TTL)
+	openFiles = newOpenFileTable()
+	openHandles = newHandleTable()
+	deleteJobs = newDeleteJobTable()
+	liveNodes = newNodeRegistry()
+	dirsNearLimit = make(map[uint64]*dirUsage)
+	fileLocks = newLockTable(openLockStore(), newUUID())
+	// metadataStore is declared globally for use by getInode and the directory methods
+	metadataStore, err = openMetadataStore(contents.info)
+	inodeOwners = contents.info.InodeOwners
+	inodeTimes = contents.info.InodeTimes
+	inodeGenerations = contents.info.InodeGenerations
+	pathIndex = contents.info.PathIndex
+	if err != nil {
+		return nil, err
+	}
+	// keyScheme is declared globally for use by the functions making the keys of blocks
+	keyScheme, err = openKeyScheme(contents.info)
+	if err != nil {
+		return nil, err
+	}
 
 	inodeStream := new(IntStream)
-	var inodeBytes [8]byte
-	copy(inodeBytes[:], super.Data[0:8])
-	inodeStream.decompressStream(inodeBytes)
-	var dataBytes [8]byte
-	copy(dataBytes[:], super.Data[8:16])
+	inodeStream.decompressStream(contents.lastInode)
 
 	// dataStream is declared globally for use by inode methods
 	dataStream = new(IntStream)
-	dataStream.decompressStream(dataBytes)
+	dataStream.decompressStream(contents.lastData)
 	dataStream.stack = new(list.List)
 
-	var readEnd uint64
-	if listSize < BLOCK_SIZE-32 {
-		readEnd = listSize + 32
-	} else {
-		readEnd = BLOCK_SIZE
-	}
-	listData := make([]byte, listSize)
-	copy(listData[0:readEnd-32], super.Data[32:readEnd])
-	listSize = listSize - (readEnd - 32)
-	amountRead := readEnd
-
-	numBlocksNeeded := 1 + (listSize / BLOCK_SIZE)
-	client := getClient()
-	var i uint64
-	for i = 1; i < numBlocksNeeded; i++ {
-		key := S3_SUPERBLOCK_NAME + strconv.FormatUint(i, 10)
-		block, err := getDataByKey(client, key)
-		if err != nil {
-			fmt.Printf("VERY BAD ERROR getting superblock number %d\n", i)
-		}
-		if listSize < BLOCK_SIZE {
-			readEnd = listSize
-		} else {
-			readEnd = BLOCK_SIZE
-		}
-		copy(listData[amountRead:amountRead+readEnd], block.Data[0:readEnd])
-		listSize = listSize - readEnd
-		amountRead = amountRead + readEnd
-	}
-
-	if listSize > 0 {
-		inodeStream.UnmarshalBinary(listData)
-	} else {
-		inodeStream.stack = new(list.List)
-	}
+	freeInodes := restoreFreeInodes(contents, inodeStream)
+	// quotaInfo is declared globally for checking writes against the quotas
+	quotaInfo = contents.info
 	return &FS{
 		inodeStream: inodeStream,
-		rootInode:   rootInode,
-	}
+		rootInode:   contents.rootInode,
+		info:        contents.info,
+		freeInodes:  freeInodes,
+		id:          newUUID(),
+	}, nil
 }
 
 /*
 Write data into the super data block. First 8 bytes are the index of the last "allocated" inode,
-next 8 are the last "allocated" dataBlock, and the next 8 is the inode number of the root
+next 8 are the last "allocated" dataBlock, the next 8 is the inode number of the root, and the next
+8 are the size of the payload (see encodeSuperPayload) that fills the rest of the block and any
+overflow blocks.
 */
 func makeSuperblocks(inode, data [8]byte, root uint64, inodeListData []byte) []*DataBlock {
 	// fmt.Println("doing writeSuperblock")
@@ -154,7 +219,7 @@ func makeSuperblocks(inode, data [8]byte, root uint64, inodeListData []byte) []*
 	}
 	copy(super.Data[32:writeEnd], inodeListData[0:writeEnd-32])
 	inodeListData = inodeListData[writeEnd-32:]
-	numBlocksNeeded := 1 + (uint64(len(inodeListData)) / BLOCK_SIZE)
+	numBlocksNeeded := 1 + (uint64(len(inodeListData))+BLOCK_SIZE-1)/BLOCK_SIZE
 	superBlocks := make([]*DataBlock, numBlocksNeeded)
 	superBlocks[0] = super
 	var j uint64
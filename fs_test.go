@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+/*
+Sets up a new, empty file system backed by memory instead of S3 and DynamoDB, with a cache
+that holds cacheSize blocks. Returns the file system and the store that evicted blocks go to.
+*/
+func newTestFs(t testing.TB, cacheSize int) (*FS, *MemStore) {
+	t.Helper()
+	// the delete jobs of the file system of an earlier test must not run on this one
+	deleteJobs.stop()
+	objects := newMemStore()
+	store = objects
+	cache = newCache(newMemStore(), cacheSize)
+	filesys, err := makeFs(makeNewSuperblock())
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	makeNewRootInode()
+	return filesys, objects
+}
+
+/*
+Returns size bytes of deterministic pseudo-random data, for use as file contents.
+*/
+func testData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+/*
+Checks that the state of a file system survives Destroy and being mounted again from the superblock.
+*/
+func TestDestroyAndRemount(t *testing.T) {
+	filesys, objects := newTestFs(t, 4)
+	for i := 0; i < 3; i++ {
+		filesys.inodeStream.next()
+	}
+	filesys.inodeStream.put(FIRST_USER_INODE + 1)
+	dataStream.next()
+	filesys.Destroy()
+	if cache.recentlyUsedQueue.Len() > 0 && objects.Len() == 0 {
+		t.Fatalf("Destroy did not write the cache back to the store")
+	}
+
+	cache = newCache(newMemStore(), 4)
+	super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err != nil {
+		t.Fatalf("getDataByKey for superblock: %v", err)
+	}
+	remounted, err := makeFs(super)
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	if remounted.info.UUID != filesys.info.UUID {
+		t.Fatalf("UUID changed across remount: %s != %s", remounted.info.UUID, filesys.info.UUID)
+	}
+	if remounted.inodeStream.lastInt != LAST_RESERVED_INODE+3 || dataStream.lastInt != 2 {
+		t.Fatalf("streams not restored: inode lastInt %d, data lastInt %d", remounted.inodeStream.lastInt, dataStream.lastInt)
+	}
+	if next := remounted.inodeStream.next(); next != FIRST_USER_INODE+1 {
+		t.Fatalf("free inode list not restored: next() = %d, want %d", next, FIRST_USER_INODE+1)
+	}
+	if _, err := getInode(remounted.rootInode); err != nil {
+		t.Fatalf("root inode not readable after remount: %v", err)
+	}
+}
+
+/*
+Checks that a mount fails if the superblock cannot be read, rather than taking it for missing and
+replacing the file system with a new, empty one.
+*/
+func TestMountUnreadableSuperblock(t *testing.T) {
+	filesys, objects := newTestFs(t, 4)
+	writeTestFile(t, testRoot(t, filesys), "file", testData(1000, 1), 1000)
+	filesys.Destroy()
+	before, err := objects.GetObject(S3_SUPERBLOCK_NAME + "0")
+	if err != nil {
+		t.Fatalf("GetObject for superblock: %v", err)
+	}
+
+	faults := newFaultInjector(FaultConfig{})
+	store = faults.wrapStore(objects)
+	cache = newCache(newMemStore(), 4)
+	// the first call reads the cache marker, the second the superblock
+	faults.failNextCalls(nil, errInjectedThrottle)
+	if _, err := openMountedFs(); err == nil {
+		t.Fatalf("mounting with a superblock that could not be read succeeded")
+	}
+	after, err := objects.GetObject(S3_SUPERBLOCK_NAME + "0")
+	if err != nil || !bytes.Equal(after, before) {
+		t.Fatalf("the superblock was replaced by a mount that could not read it")
+	}
+}
+
+/*
+Checks that a free inode list spilling into overflow superblocks is restored in the background after
+a remount, that inode numbers are allocated past the last one while it is, and that numbers freed
+in the meantime are reused before those restored.
+*/
+func TestLazyFreeInodeList(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	const freed = 20000
+	for i := 0; i < freed; i++ {
+		filesys.inodeStream.next()
+	}
+	for i := uint64(1); i <= freed; i++ {
+		filesys.inodeStream.put(LAST_RESERVED_INODE + i)
+	}
+	filesys.Destroy()
+	cache = newCache(newMemStore(), 64)
+	if _, err := getDataByKey(S3_SUPERBLOCK_NAME + "1"); err != nil {
+		t.Fatalf("the free inode list did not spill into an overflow superblock: %v", err)
+	}
+	super, _ := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+
+	// the overflow superblocks are read holding fsLock, so none are until it is released
+	fsLock.Lock()
+	remounted, err := makeFs(super)
+	if err != nil {
+		fsLock.Unlock()
+		t.Fatalf("makeFs: %v", err)
+	}
+	inodeNum := nextInodeNum(remounted.inodeStream)
+	remounted.inodeStream.put(inodeNum)
+	loading := remounted.freeInodes.loading()
+	fsLock.Unlock()
+	if inodeNum != LAST_RESERVED_INODE+freed+1 || !loading {
+		t.Fatalf("inode %d allocated while the list is restored, want %d", inodeNum, LAST_RESERVED_INODE+freed+1)
+	}
+	if !remounted.freeInodes.wait(time.Minute) {
+		t.Fatalf("the free inode list was not restored")
+	}
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	if next := nextInodeNum(remounted.inodeStream); next != inodeNum {
+		t.Fatalf("next() = %d after the list was restored, want the number freed since the mount, %d", next, inodeNum)
+	}
+	if next := nextInodeNum(remounted.inodeStream); next != LAST_RESERVED_INODE+freed {
+		t.Fatalf("next() = %d, want the last number freed before the remount, %d", next, LAST_RESERVED_INODE+freed)
+	}
+	if remounted.inodeStream.stack.Len() != freed-1 {
+		t.Fatalf("%d free inode numbers restored, want %d", remounted.inodeStream.stack.Len()+1, freed)
+	}
+}
+
+/*
+Checks that data written through an inode can be read back, for sizes that fit in the inode buffer,
+in several data blocks, and in the singly indirect block. The cache is kept small so blocks are
+evicted to the store and read back from it.
+*/
+func TestInodeWriteRead(t *testing.T) {
+	sizes := map[string]int{
+		"small":  239,
+		"medium": 120 * 1000,
+		"large":  420 * 1000,
+	}
+	for name, size := range sizes {
+		t.Run(name, func(t *testing.T) {
+			newTestFs(t, 3)
+			inode := createInode(0)
+			inode.init(ROOT_INODE, 2)
+			data := testData(size, int64(size))
+			inode.writeToData(data, 0)
+			if inode.Size != uint64(size) {
+				t.Fatalf("Size = %d, want %d", inode.Size, size)
+			}
+			readData, err := inode.readFromData(0, inode.Size)
+			if err != nil {
+				t.Fatalf("readFromData: %v", err)
+			}
+			if !bytes.Equal(readData, data) {
+				t.Fatalf("data read back differs from data written")
+			}
+			err = inode.deleteAllData()
+			if err != nil {
+				t.Fatalf("deleteAllData: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+/*
+Struct holding the results of checking a file system with fsck.
+*/
+type fsckReport struct {
+	dirs     int
+	files    int
+	bytes    uint64
+	problems []string
+}
+
+/*
+Struct holding the state of a running fsck.
+*/
+type fscker struct {
+	report     *fsckReport
+	lastInode  uint64
+	firstUser  uint64 // the first inode number files may have, see SuperblockInfo.FirstUserInode
+	freeInodes map[uint64]bool
+	freeBlocks map[uint64]bool
+	inodes     map[uint64]string // maps each reachable inode to the first path it was found at
+	links      map[uint64]uint16 // maps each reachable file to the number of entries linking to it
+	linkCounts map[uint64]uint16 // maps each reachable file to its LinkCount
+	blocks     map[uint64]string // maps each used block to the path of the inode using it
+	parents    map[uint64]uint64 // maps each reachable inode to the directory it was first found in
+}
+
+/*
+Walks the file system from its root, checking that every directory has correct "." and ".."
+entries, that every reachable inode and block was allocated, is not free or reserved, is used only
+once (files may be linked more than once, as their LinkCount says), and can be read, and that the
+path index, if the file system keeps one, has the right parent for each. The file system should not
+be mounted, since fsck reads through the global cache.
+*/
+func fsck(filesys *FS) *fsckReport {
+	if !filesys.freeInodes.wait(FREE_INODES_UNMOUNT_WAIT) {
+		report := new(fsckReport)
+		report.problems = append(report.problems, "/: the free inode list could not be read from the overflow superblocks")
+		return report
+	}
+	f := &fscker{
+		report:     new(fsckReport),
+		lastInode:  filesys.inodeStream.lastInt,
+		firstUser:  filesys.info.FirstUserInode,
+		freeInodes: streamFreeSet(filesys.inodeStream),
+		freeBlocks: streamFreeSet(dataStream),
+		inodes:     make(map[uint64]string),
+		links:      make(map[uint64]uint16),
+		linkCounts: make(map[uint64]uint16),
+		blocks:     make(map[uint64]string),
+		parents:    make(map[uint64]uint64),
+	}
+	f.checkInode(filesys.rootInode, filesys.rootInode, "/")
+	for inodeNum, links := range f.links {
+		if links != f.linkCounts[inodeNum] {
+			f.problem(f.inodes[inodeNum], "inode %d has LinkCount %d, but %d entries link to it",
+				inodeNum, f.linkCounts[inodeNum], links)
+		}
+	}
+	if pathIndex {
+		f.checkPathIndex(filesys.rootInode)
+	}
+	return f.report
+}
+
+/*
+Returns the set of ints that have been put back on the stream to be reused.
+*/
+func streamFreeSet(s *IntStream) map[uint64]bool {
+	free := make(map[uint64]bool)
+	for e := s.stack.Front(); e != nil; e = e.Next() {
+		free[e.Value.(uint64)] = true
+	}
+	return free
+}
+
+/*
+Records a problem found at the given path.
+*/
+func (f *fscker) problem(p string, format string, args ...interface{}) {
+	f.report.problems = append(f.report.problems, p+": "+fmt.Sprintf(format, args...))
+}
+
+/*
+Checks the inode with number inodeNum found at path p, whose directory has inode number parentNum,
+and everything below it.
+*/
+func (f *fscker) checkInode(inodeNum, parentNum uint64, p string) {
+	if inodeNum == INVALID_INODE || inodeNum > f.lastInode {
+		f.problem(p, "inode %d was never allocated", inodeNum)
+		return
+	}
+	if inodeNum != ROOT_INODE && inodeNum < f.firstUser {
+		f.problem(p, "inode %d is reserved for metadata files", inodeNum)
+		return
+	}
+	if f.freeInodes[inodeNum] {
+		f.problem(p, "inode %d is on the free list", inodeNum)
+	}
+	if other, ok := f.inodes[inodeNum]; ok {
+		if _, isFile := f.links[inodeNum]; isFile {
+			// another hard link to a file already checked
+			f.links[inodeNum]++
+			return
+		}
+		f.problem(p, "inode %d is also reachable as %s", inodeNum, other)
+		return
+	}
+	f.inodes[inodeNum] = p
+	f.parents[inodeNum] = parentNum
+	inode, err := getInode(inodeNum)
+	if err != nil {
+		f.problem(p, "cannot read inode %d: %v", inodeNum, err)
+		return
+	}
+	err = inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		f.checkBlock(blockNum, p)
+		if indirect {
+			return nil
+		}
+		_, err := getData(blockNum)
+		if err != nil {
+			f.problem(p, "cannot read block %d: %v", blockNum, err)
+		}
+		return nil
+	})
+	if err != nil {
+		f.problem(p, "cannot read indirect block: %v", err)
+		return
+	}
+	if !inode.isDir() {
+		f.links[inodeNum] = 1
+		f.linkCounts[inodeNum] = inode.LinkCount
+		f.report.files++
+		f.report.bytes += inode.Size
+		return
+	}
+	f.report.dirs++
+	f.checkDir(inode, inodeNum, parentNum, p)
+}
+
+/*
+Checks that the path index has the directory each reachable inode other than the root was found in
+as its parent. Files linked more than once are passed over, since the index holds only one of their
+directories.
+*/
+func (f *fscker) checkPathIndex(rootNum uint64) {
+	for inodeNum, parentNum := range f.parents {
+		if inodeNum == rootNum || f.links[inodeNum] > 1 || f.linkCounts[inodeNum] > 1 {
+			continue
+		}
+		indexed, err := getParent(inodeNum)
+		if err != nil {
+			f.problem(f.inodes[inodeNum], "cannot read the parent of inode %d from the path index: %v", inodeNum, err)
+		} else if indexed != parentNum {
+			f.problem(f.inodes[inodeNum], "the path index has inode %d under inode %d, want %d", inodeNum, indexed, parentNum)
+		}
+	}
+}
+
+/*
+Checks that blockNum was allocated, is not free, and is not used by any other inode.
+*/
+func (f *fscker) checkBlock(blockNum uint64, p string) {
+	if blockNum == 0 || blockNum > dataStream.lastInt {
+		f.problem(p, "block %d was never allocated", blockNum)
+	}
+	if f.freeBlocks[blockNum] {
+		f.problem(p, "block %d is on the free list", blockNum)
+	}
+	if other, ok := f.blocks[blockNum]; ok {
+		f.problem(p, "block %d is also used by %s", blockNum, other)
+	}
+	f.blocks[blockNum] = p
+}
+
+/*
+Checks the entries of the directory with the given inode, then each of its children in name order.
+*/
+func (f *fscker) checkDir(inode *Inode, inodeNum, parentNum uint64, p string) {
+	table, err := readTable(inodeNum, inode)
+	if err != nil {
+		f.problem(p, "cannot read directory: %v", err)
+		return
+	}
+	if table.Table["."] != inodeNum {
+		f.problem(p, "\".\" is inode %d, want %d", table.Table["."], inodeNum)
+	}
+	if table.Table[".."] != parentNum {
+		f.problem(p, "\"..\" is inode %d, want %d", table.Table[".."], parentNum)
+	}
+	table.forEachEntry(func(name string, childNum uint64) error {
+		f.checkInode(childNum, inodeNum, path.Join(p, name))
+		return nil
+	})
+}
+
+/*
+Prints the results of an fsck, returning true if no problems were found.
+*/
+func printFsckReport(report *fsckReport) bool {
+	for _, problem := range report.problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d directories, %d files, %d bytes\n", report.dirs, report.files, report.bytes)
+	if len(report.problems) > 0 {
+		fmt.Printf("%d problems found\n", len(report.problems))
+		return false
+	}
+	fmt.Println("no problems found")
+	return true
+}
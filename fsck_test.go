@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that fsck finds no problems in a healthy file system, and reports a directory entry that
+points to an inode that is also reachable elsewhere and one that was never allocated.
+*/
+func TestFsck(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	err := crashWriteFile(ctx, root, "file", testData(100*1000, 1))
+	if err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	_, err = root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	report := fsck(filesys)
+	if len(report.problems) != 0 || report.dirs != 2 || report.files != 1 || report.bytes != 100*1000 {
+		t.Fatalf("fsck of a healthy file system: %+v", report)
+	}
+
+	node, err := root.lookup(ctx, "file")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	root.addFile("link", node.(*File).inodeNum)
+	root.addFile("dangling", filesys.inodeStream.lastInt+1)
+	report = fsck(filesys)
+	if len(report.problems) != 2 {
+		t.Fatalf("fsck found %d problems, want 2: %v", len(report.problems), report.problems)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// whether the kernel buffers writes and sends them in page-sized pieces, instead of passing each
+// write through as it is made
+var WRITEBACK_CACHE bool
+
+// the most the kernel reads ahead of a sequential read, which saves round trips to S3
+const FUSE_MAX_READAHEAD uint32 = 1 << 20
+
+// how long the kernel keeps the attributes of a file, and the entries of directories, before asking
+// the file system again, from AttrTTL and EntryTTL. Longer times save round trips on metadata heavy
+// work like ls -lR, but changes made by other mounts, commands, or the gateways show later.
+const DEFAULT_KERNEL_TTL time.Duration = time.Minute
+
+var ATTR_TTL time.Duration = DEFAULT_KERNEL_TTL
+var ENTRY_TTL time.Duration = DEFAULT_KERNEL_TTL
+
+// the mount options from MountOptions, passed after those the file system sets itself, so that
+// they take precedence
+var FUSE_MOUNT_OPTIONS []fuse.MountOption
+
+// the mount options that MountOptions may hold, by name, each taking the value after "=" if it has
+// one, which the option must have exactly when it is listed as taking one
+var fuseMountOptions = map[string]struct {
+	hasValue bool
+	option   func(value string) (fuse.MountOption, error)
+}{
+	"allow_other":         {false, func(string) (fuse.MountOption, error) { return fuse.AllowOther(), nil }},
+	"allow_dev":           {false, func(string) (fuse.MountOption, error) { return fuse.AllowDev(), nil }},
+	"allow_suid":          {false, func(string) (fuse.MountOption, error) { return fuse.AllowSUID(), nil }},
+	"default_permissions": {false, func(string) (fuse.MountOption, error) { return fuse.DefaultPermissions(), nil }},
+	"async_read":          {false, func(string) (fuse.MountOption, error) { return fuse.AsyncRead(), nil }},
+	"ro":                  {false, func(string) (fuse.MountOption, error) { return fuse.ReadOnly(), nil }},
+	"fsname":              {true, func(value string) (fuse.MountOption, error) { return fuse.FSName(value), nil }},
+	"subtype":             {true, func(value string) (fuse.MountOption, error) { return fuse.Subtype(value), nil }},
+	"max_readahead": {true, func(value string) (fuse.MountOption, error) {
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, errors.New("max_readahead must be a number of bytes, not \"" + value + "\"")
+		}
+		return fuse.MaxReadahead(uint32(n)), nil
+	}},
+}
+
+/*
+Returns the mount options named by options, each a name, or a name and value as "name=value", as
+given to mount -o. Returns an error naming the first option that is not one of fuseMountOptions, or
+that is missing its value or has one it does not take. The writeback cache is refused, since the
+file system has to know whether the kernel buffers writes, so it is set with WritebackCache.
+*/
+func parseMountOptions(options []string) ([]fuse.MountOption, error) {
+	var parsed []fuse.MountOption
+	for _, option := range options {
+		name, value := option, ""
+		hasValue := strings.Contains(option, "=")
+		if hasValue {
+			parts := strings.SplitN(option, "=", 2)
+			name, value = parts[0], parts[1]
+		}
+		known, ok := fuseMountOptions[name]
+		if name == "writeback_cache" {
+			// the file system finds the end of appends itself only without it, see FileHandle.Write
+			return nil, errors.New("Set WritebackCache instead of the mount option writeback_cache in MountOptions.")
+		}
+		if !ok {
+			return nil, errors.New("Unknown mount option \"" + option + "\" in MountOptions.")
+		}
+		if hasValue != known.hasValue {
+			if known.hasValue {
+				return nil, errors.New("The mount option " + name + " in MountOptions needs a value, as in \"" + name + "=VALUE\".")
+			}
+			return nil, errors.New("The mount option " + name + " in MountOptions does not take a value.")
+		}
+		mountOption, err := known.option(value)
+		if err != nil {
+			return nil, errors.New("Bad mount option in MountOptions: " + err.Error() + ".")
+		}
+		parsed = append(parsed, mountOption)
+	}
+	return parsed, nil
+}
+
+/*
+Sets ATTR_TTL and ENTRY_TTL from the config, each a duration such as "5s", "" for the default, or "0"
+for the kernel to ask every time.
+*/
+func setKernelTTLs(config *Config) error {
+	ttls := []struct {
+		key   string
+		value string
+		ttl   *time.Duration
+	}{{"AttrTTL", config.AttrTTL, &ATTR_TTL}, {"EntryTTL", config.EntryTTL, &ENTRY_TTL}}
+	for _, t := range ttls {
+		*t.ttl = DEFAULT_KERNEL_TTL
+		if t.value == "" {
+			continue
+		}
+		ttl, err := time.ParseDuration(t.value)
+		if err != nil || ttl < 0 {
+			return errors.New(t.key + " must be a duration such as \"5s\", or \"0\" to not cache, not \"" + t.value + "\".")
+		}
+		*t.ttl = ttl
+	}
+	return nil
+}
+
+/*
+Returns how long the kernel should keep a looked up entry. The library takes 0 to mean its default
+of a minute, so an ENTRY_TTL of 0 is given as a nanosecond, which has expired by the next lookup.
+*/
+func entryValid() time.Duration {
+	if ENTRY_TTL == 0 {
+		return time.Nanosecond
+	}
+	return ENTRY_TTL
+}
+
+/*
+Interface of the FUSE library the file system is mounted with. Only mounting, serving, and
+unmounting go through it, so that main and shutdown do not depend on the library; the Dir, File,
+and handle methods implement the node interfaces of bazil.org/fuse, which other front ends (like
+the 9P server) call directly.
+*/
+type fuseBinding interface {
+	mount(mountpoint, label string) (fuseConn, error)
+	unmount(mountpoint string) error
+}
+
+/*
+Interface of a mounted file system that has not been served yet.
+*/
+type fuseConn interface {
+	serve(filesys *FS) error
+	close() error
+}
+
+// the binding the file system is mounted with
+var binding fuseBinding = bazilBinding{}
+
+/*
+Struct representing the bazil.org/fuse library, as of late April 2020, the first version with file
+locking (and the first without macOS). Later versions wait for the mount in fuse.Mount, drop
+Conn.Ready and Conn.MountError, and do not build on FreeBSD, so the file system stays on this one.
+*/
+type bazilBinding struct{}
+
+/*
+Struct representing a file system mounted with bazil.org/fuse.
+*/
+type bazilConn struct {
+	conn *fuse.Conn
+}
+
+/*
+Returns the name the file system is mounted under, which shows in mount and df: cloudfusion,
+followed by the label of the file system if it has one.
+*/
+func mountName(label string) string {
+	if label == "" {
+		return FS_NAME
+	}
+	return FS_NAME + ":" + label
+}
+
+/*
+Mounts the file system with label at mountpoint, with the options of the platform, the
+writeback cache and allow_other if they are enabled, and then those from MountOptions. Reads of a file handle are served concurrently, since the
+handlers lock what they share. File locks are passed to the file system rather than kept by the
+kernel, so that they can be shared between mounts (see lockTable).
+*/
+func (bazilBinding) mount(mountpoint, label string) (fuseConn, error) {
+	options := append(mountOptions(label), fuse.AsyncRead(), fuse.MaxReadahead(FUSE_MAX_READAHEAD),
+		fuse.LockingFlock(), fuse.LockingPOSIX())
+	if WRITEBACK_CACHE {
+		options = append(options, fuse.WritebackCache())
+	}
+	if ALLOW_OTHER {
+		options = append(options, fuse.AllowOther())
+	}
+	options = append(options, FUSE_MOUNT_OPTIONS...)
+	c, err := fuse.Mount(mountpoint, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &bazilConn{conn: c}, nil
+}
+
+/*
+Unmounts the file system at mountpoint.
+*/
+func (bazilBinding) unmount(mountpoint string) error {
+	return fuse.Unmount(mountpoint)
+}
+
+/*
+Serves the file system until it is unmounted, returning any error from the mount itself.
+*/
+func (c *bazilConn) serve(filesys *FS) error {
+	err := fs.Serve(c.conn, filesys)
+	if err != nil {
+		return err
+	}
+	// check if the mount process has an error to report
+	<-c.conn.Ready
+	return c.conn.MountError
+}
+
+/*
+Closes the connection to the kernel.
+*/
+func (c *bazilConn) close() error {
+	return c.conn.Close()
+}
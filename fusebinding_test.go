@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+/*
+Checks that MountOptions are parsed into mount options, and that unknown options, missing or extra
+values, and the writeback cache are refused.
+*/
+func TestParseMountOptions(t *testing.T) {
+	options, err := parseMountOptions([]string{"default_permissions", "fsname=data", "max_readahead=4194304"})
+	if err != nil || len(options) != 3 {
+		t.Fatalf("parsing valid options returned %d options and %v", len(options), err)
+	}
+	if options, err := parseMountOptions(nil); err != nil || len(options) != 0 {
+		t.Fatalf("parsing no options returned %d options and %v", len(options), err)
+	}
+	for _, bad := range []string{"nosuch", "fsname", "ro=1", "max_readahead=lots", "writeback_cache"} {
+		if _, err := parseMountOptions([]string{"default_permissions", bad}); err == nil {
+			t.Errorf("the mount option %q was accepted", bad)
+		}
+	}
+}
+
+/*
+Checks that AttrTTL and EntryTTL set how long the kernel keeps attributes and looked up entries, and
+that an EntryTTL of 0 is not taken as the default of the library.
+*/
+func TestKernelTTLs(t *testing.T) {
+	defer setKernelTTLs(&Config{})
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	writeTestFile(t, root, "file", testData(100, 1), 100)
+
+	for _, ttls := range []struct {
+		attr, entry         string
+		attrTTL, entryValid time.Duration
+	}{{"", "", time.Minute, time.Minute}, {"5s", "0", 5 * time.Second, time.Nanosecond}} {
+		err := setKernelTTLs(&Config{AttrTTL: ttls.attr, EntryTTL: ttls.entry})
+		if err != nil {
+			t.Fatalf("setKernelTTLs: %v", err)
+		}
+		resp := new(fuse.LookupResponse)
+		node, err := root.Lookup(ctx, &fuse.LookupRequest{Name: "file"}, resp)
+		if err != nil {
+			t.Fatalf("Lookup: %v", err)
+		}
+		if resp.EntryValid != ttls.entryValid {
+			t.Errorf("with EntryTTL %q the entry is kept for %v", ttls.entry, resp.EntryValid)
+		}
+		var attr fuse.Attr
+		node.Attr(ctx, &attr)
+		if attr.Valid != ttls.attrTTL {
+			t.Errorf("with AttrTTL %q the attributes of a file are kept for %v", ttls.attr, attr.Valid)
+		}
+		root.Attr(ctx, &attr)
+		if attr.Valid != ttls.attrTTL {
+			t.Errorf("with AttrTTL %q the attributes of a directory are kept for %v", ttls.attr, attr.Valid)
+		}
+	}
+	if err := setKernelTTLs(&Config{EntryTTL: "-1s"}); err == nil {
+		t.Errorf("a negative EntryTTL was accepted")
+	}
+}
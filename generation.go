@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"encoding/binary"
+)
+
+// the bytes kept in a generation block for each inode: the generation of the file holding its number
+const GENERATION_RECORD_SIZE uint64 = 8
+const GENERATIONS_PER_BLOCK uint64 = BLOCK_SIZE / GENERATION_RECORD_SIZE
+
+// whether the mounted file system keeps the generation of each inode, which those created before
+// format version 15 do not, so that their stale handles cannot be told from current ones. Set by
+// makeFs.
+var inodeGenerations bool
+
+/*
+Generation block keys are of the format "HASH-generationBlockNUMBER", like those of owner blocks.
+Each generation block holds the generations of GENERATIONS_PER_BLOCK inodes.
+*/
+func genGenerationBlockKey(inodeNum uint64) string {
+	return genRecordBlockKey("generationBlock", inodeNum, GENERATIONS_PER_BLOCK)
+}
+
+/*
+Returns the generation of the file holding the inode with inodeNum.
+*/
+func getGeneration(inodeNum uint64) (uint64, error) {
+	block, err := getDataByKey(genGenerationBlockKey(inodeNum))
+	if err != nil {
+		return 0, err
+	}
+	start := (inodeNum % GENERATIONS_PER_BLOCK) * GENERATION_RECORD_SIZE
+	return binary.LittleEndian.Uint64(block.Data[start : start+GENERATION_RECORD_SIZE]), nil
+}
+
+/*
+Gives the new inode with inodeNum the generation after that of the last file to hold the number, if
+the file system keeps generations, so that handles still naming that file are told apart from those
+of the new one. Inode numbers are reused from the free stack of the inode stream, which is all that
+makes a handle stale. Called before the inode is first stored.
+*/
+func setNewGeneration(inode *Inode, inodeNum uint64) error {
+	if !inodeGenerations {
+		return nil
+	}
+	key := genGenerationBlockKey(inodeNum)
+	block, err := getRecordBlock(key, inodeNum, GENERATIONS_PER_BLOCK)
+	if err != nil {
+		return err
+	}
+	start := (inodeNum % GENERATIONS_PER_BLOCK) * GENERATION_RECORD_SIZE
+	generation := binary.LittleEndian.Uint64(block.Data[start:start+GENERATION_RECORD_SIZE]) + 1
+	binary.LittleEndian.PutUint64(block.Data[start:start+GENERATION_RECORD_SIZE], generation)
+	err = putDataByKey(key, block)
+	if err != nil {
+		return err
+	}
+	inode.Generation = generation
+	return nil
+}
+
+/*
+Returns fuse.ESTALE if generation, of the file a node or 9P fid was looked up as, is that of an
+earlier file than the one now holding inodeNum, which was freed and given to a new file since, or if
+the file was removed and freed and its number is not given to another yet, or nil if it is current.
+It is checked when files and directories are opened, files are changed with Setattr, and names are
+looked up in directories, which the kernel does before creating or removing them, so that a stale
+node never reads or changes the file that took over its number, nor the freed inode before then,
+whose later release would write it back over the new file. A removed file that is still open is not
+freed yet, so it is not stale. Must be called holding fsLock.
+*/
+func checkGeneration(generation, inodeNum uint64) error {
+	if inodeGenerations {
+		current, err := getGeneration(inodeNum)
+		if err != nil {
+			return err
+		}
+		if generation != current {
+			countStat(&mountStats.StaleHandles, 1)
+			return fuse.ESTALE
+		}
+	}
+	inode, err := getInode(inodeNum)
+	if err != nil {
+		return err
+	}
+	if inode.LinkCount == 0 && !openFiles.isOpen(inodeNum) {
+		countStat(&mountStats.StaleHandles, 1)
+		return fuse.ESTALE
+	}
+	return nil
+}
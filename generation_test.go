@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that a file given the inode number of a removed one gets the next generation, that the nodes
+of the removed file are refused with ESTALE, both before and after its number is reused, while those
+of the new one are not, and that a directory removed and replaced the same way refuses lookups
+through its stale node.
+*/
+func TestStaleHandle(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	mountStats = LifetimeStats{}
+	old := writeTestFile(t, root, "old", testData(100, 1), 100)
+	if old.inode.Generation != 1 {
+		t.Fatalf("a new inode number has generation %d, want 1", old.inode.Generation)
+	}
+	root.Remove(ctx, &fuse.RemoveRequest{Name: "old"})
+	// the inode is freed, but not given to another file yet
+	if _, err := old.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, new(fuse.OpenResponse)); err != fuse.ESTALE {
+		t.Fatalf("opening the removed file before its inode was reused returned %v, want ESTALE", err)
+	}
+	current := writeTestFile(t, root, "new", testData(100, 2), 100)
+	if current.inodeNum != old.inodeNum || current.inode.Generation != 2 {
+		t.Fatalf("the new file has inode %d with generation %d, want %d with generation 2", current.inodeNum, current.inode.Generation, old.inodeNum)
+	}
+	if _, err := old.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, new(fuse.OpenResponse)); err != fuse.ESTALE {
+		t.Fatalf("opening the removed file returned %v, want ESTALE", err)
+	}
+	err := old.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize}, new(fuse.SetattrResponse))
+	if err != fuse.ESTALE || current.inode.Size != 100 {
+		t.Fatalf("truncating the removed file returned %v, and left the new one with size %d", err, current.inode.Size)
+	}
+	handle, err := current.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, new(fuse.OpenResponse))
+	if err != nil {
+		t.Fatalf("opening the new file: %v", err)
+	}
+	handle.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+
+	node, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	root.Remove(ctx, &fuse.RemoveRequest{Name: "dir", Dir: true})
+	root.Mkdir(ctx, &fuse.MkdirRequest{Name: "other"})
+	if _, err := node.(*Dir).lookup(ctx, "."); err != fuse.ESTALE {
+		t.Fatalf("looking up in the removed directory returned %v, want ESTALE", err)
+	}
+	if mountStats.StaleHandles != 4 {
+		t.Fatalf("%d stale handles counted, want 4", mountStats.StaleHandles)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"compress/gzip"
+	"flag"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden file system for the current format version")
+
+const goldenDir = "testdata/golden"
+
+/*
+The files in the golden file system. Their contents are generated by goldenData from size and seed.
+*/
+var goldenFiles = []struct {
+	dir  string
+	name string
+	size int
+	seed int64
+}{
+	{"", "big.bin", int(INODE_BUFFER_SIZE + 2*BLOCK_SIZE + 100), 1},
+	{"dir", "small.txt", 200, 2},
+	{"dir", "empty.txt", 0, 3},
+}
+
+/*
+Returns size bytes of numbered text lines, which (unlike testData) compress well, to keep the
+checked in golden files small.
+*/
+func goldenData(size int, seed int64) []byte {
+	var buf bytes.Buffer
+	for line := 0; buf.Len() < size; line++ {
+		buf.WriteString("file " + strconv.FormatInt(seed, 10) + " line " + strconv.Itoa(line) + "\n")
+	}
+	return buf.Bytes()[:size]
+}
+
+/*
+Returns the directory holding the golden file system for a format version.
+*/
+func goldenPath(formatVersion uint32) string {
+	return filepath.Join(goldenDir, "format"+strconv.FormatUint(uint64(formatVersion), 10))
+}
+
+/*
+Builds the golden file system with the current code and writes every object it stores to
+the golden directory for the current format version, gzipped.
+*/
+func writeGoldenFs(t *testing.T) {
+	filesys, objects := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	dirs := map[string]*Dir{"": root}
+	for _, file := range goldenFiles {
+		dir, ok := dirs[file.dir]
+		if !ok {
+			node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: file.dir})
+			if err != nil {
+				t.Fatalf("Mkdir: %v", err)
+			}
+			dir = node.(*Dir)
+			dirs[file.dir] = dir
+		}
+		_, handle, err := dir.Create(ctx, &fuse.CreateRequest{Name: file.name}, &fuse.CreateResponse{})
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		fh := handle.(*FileHandle)
+		fh.Write(ctx, &fuse.WriteRequest{Data: goldenData(file.size, file.seed)}, &fuse.WriteResponse{})
+		fh.Release(ctx, &fuse.ReleaseRequest{})
+	}
+	// fixed values so that regenerating the golden files only changes them when the format does
+	filesys.info.UUID = "00000000-0000-4000-8000-000000000000"
+	filesys.info.CreatedTime = 0
+	filesys.Destroy()
+
+	path := goldenPath(FORMAT_VERSION)
+	os.RemoveAll(path)
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, data := range objects.items {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		err = ioutil.WriteFile(filepath.Join(path, key+".gz"), buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+/*
+Loads a golden file system into a new in-memory store and cache.
+*/
+func loadGoldenFs(t *testing.T, path string) {
+	t.Helper()
+	objects := newMemStore()
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		file, err := os.Open(filepath.Join(path, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects.put(strings.TrimSuffix(entry.Name(), ".gz"), data)
+	}
+	store = objects
+	cache = newCache(newMemStore(), 64)
+}
+
+/*
+Checks that the current code can mount and read the golden file system written by every format
+version it claims to support, so that format-breaking changes are caught before they reach user
+buckets. Run with -update-golden after an intentional format change (which must also bump
+FORMAT_VERSION) to add the golden file system for the new version.
+*/
+func TestGoldenFormat(t *testing.T) {
+	if *updateGolden {
+		writeGoldenFs(t)
+	}
+	for _, formatVersion := range SUPPORTED_FORMAT_VERSIONS {
+		path := goldenPath(formatVersion)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			if formatVersion == FORMAT_VERSION {
+				t.Errorf("no golden file system for the current format version %d; run go test -update-golden", formatVersion)
+			}
+			continue
+		}
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			loadGoldenFs(t, path)
+			super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+			if err != nil {
+				t.Fatalf("reading superblock: %v", err)
+			}
+			filesys, err := makeFs(super)
+			if err != nil {
+				t.Fatalf("makeFs: %v", err)
+			}
+			if filesys.info.FormatVersion != formatVersion {
+				t.Errorf("FormatVersion = %d, want %d", filesys.info.FormatVersion, formatVersion)
+			}
+			root := testRoot(t, filesys)
+			ctx := context.Background()
+			for _, file := range goldenFiles {
+				dir := root
+				if file.dir != "" {
+					node, err := root.lookup(ctx, file.dir)
+					if err != nil {
+						t.Fatalf("Lookup %s: %v", file.dir, err)
+					}
+					dir = node.(*Dir)
+				}
+				node, err := dir.lookup(ctx, file.name)
+				if err != nil {
+					t.Fatalf("Lookup %s: %v", file.name, err)
+				}
+				inode := node.(*File).inode
+				if inode.Size != uint64(file.size) {
+					t.Fatalf("%s has size %d, want %d", file.name, inode.Size, file.size)
+				}
+				if file.size == 0 {
+					continue
+				}
+				data, err := inode.readFromData(0, inode.Size)
+				if err != nil {
+					t.Fatalf("reading %s: %v", file.name, err)
+				}
+				if !bytes.Equal(data, goldenData(file.size, file.seed)) {
+					t.Errorf("%s has different contents than were written", file.name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the most file and directory handles that may be open at once, from MaxOpenHandles, or 0 for no
+// limit. Each handle is kept in memory until the kernel releases it, so an application that leaks
+// descriptors would otherwise grow the mount process without bound; opening more fails with EMFILE.
+const DEFAULT_MAX_OPEN_HANDLES int = 100000
+
+var MAX_OPEN_HANDLES int = DEFAULT_MAX_OPEN_HANDLES
+
+// how long a handle may go unused before it is reported as a likely leak and, if it is a directory
+// handle, the entries it holds are dropped, from HandleIdleTime, or 0 to never
+const DEFAULT_HANDLE_IDLE_TIMEOUT time.Duration = time.Hour
+
+var HANDLE_IDLE_TIMEOUT time.Duration = DEFAULT_HANDLE_IDLE_TIMEOUT
+
+// how often the handles are checked for ones idle past HANDLE_IDLE_TIMEOUT
+const HANDLE_REAP_INTERVAL time.Duration = time.Minute
+
+/*
+Struct tracking the file and directory handles open on the mounted file system, from FUSE, 9P, and
+the HTTP gateway alike, and when each was last used.
+*/
+type handleTable struct {
+	lock    sync.Mutex
+	handles map[fs.Handle]*handleUse
+	refused uint64 // the opens refused with EMFILE
+	full    bool   // whether the last open was refused, so that only the first of a run is printed
+}
+
+/*
+Struct recording the use of an open handle.
+*/
+type handleUse struct {
+	path     string
+	opened   time.Time
+	used     time.Time
+	reported bool // whether it was reported as idle, which is only done once
+}
+
+/*
+Struct describing an open handle idle past HANDLE_IDLE_TIMEOUT.
+*/
+type idleHandle struct {
+	handle fs.Handle
+	path   string
+	opened time.Time
+	used   time.Time
+}
+
+// the handles open on the mounted file system. Set by makeFs.
+var openHandles = newHandleTable()
+
+/*
+Returns a pointer to a new table with no open handles.
+*/
+func newHandleTable() *handleTable {
+	return &handleTable{handles: make(map[fs.Handle]*handleUse)}
+}
+
+/*
+Sets the handle limits from the config, where 0 leaves the default and -1 removes the limit.
+HandleIdleTime is a duration such as "30m", or "0" to never reap idle handles.
+*/
+func setHandleLimits(config *Config) error {
+	if config.MaxOpenHandles < -1 {
+		return errors.New("MaxOpenHandles must be positive, or -1 for no limit.")
+	}
+	MAX_OPEN_HANDLES = DEFAULT_MAX_OPEN_HANDLES
+	if config.MaxOpenHandles == -1 {
+		MAX_OPEN_HANDLES = 0
+	} else if config.MaxOpenHandles > 0 {
+		MAX_OPEN_HANDLES = config.MaxOpenHandles
+	}
+	HANDLE_IDLE_TIMEOUT = DEFAULT_HANDLE_IDLE_TIMEOUT
+	if config.HandleIdleTime != "" {
+		timeout, err := time.ParseDuration(config.HandleIdleTime)
+		if err != nil || timeout < 0 {
+			return errors.New("HandleIdleTime must be a duration such as \"30m\", or \"0\" to never reap idle handles, not \"" + config.HandleIdleTime + "\".")
+		}
+		HANDLE_IDLE_TIMEOUT = timeout
+	}
+	return nil
+}
+
+/*
+Returns EMFILE if MAX_OPEN_HANDLES handles are open, so that no more may be opened, and nil
+otherwise. Called before an open changes anything, under fsLock, which is held until the handle is
+added.
+*/
+func (t *handleTable) check(p string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if MAX_OPEN_HANDLES == 0 || len(t.handles) < MAX_OPEN_HANDLES {
+		t.full = false
+		return nil
+	}
+	t.refused++
+	if !t.full {
+		t.full = true
+		fmt.Printf("Refusing to open %s: %d handles are open, which is the most allowed by MaxOpenHandles.\n",
+			p, len(t.handles))
+	}
+	return fuse.Errno(syscall.EMFILE)
+}
+
+/*
+Records that h was opened on the file or directory at p.
+*/
+func (t *handleTable) add(h fs.Handle, p string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	t.handles[h] = &handleUse{path: p, opened: now, used: now}
+}
+
+/*
+Records that h was used.
+*/
+func (t *handleTable) use(h fs.Handle) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if use := t.handles[h]; use != nil {
+		use.used = time.Now()
+		use.reported = false
+	}
+}
+
+/*
+Records that h was released.
+*/
+func (t *handleTable) remove(h fs.Handle) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.handles, h)
+}
+
+/*
+Returns the number of open handles, and the opens refused with EMFILE.
+*/
+func (t *handleTable) counts() (int, uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.handles), t.refused
+}
+
+/*
+Returns the handles unused for at least timeout as of now that were not reported since they were
+last used, oldest first, and marks them reported.
+*/
+func (t *handleTable) idle(now time.Time, timeout time.Duration) []idleHandle {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var idle []idleHandle
+	for h, use := range t.handles {
+		if use.reported || now.Sub(use.used) < timeout {
+			continue
+		}
+		use.reported = true
+		idle = append(idle, idleHandle{handle: h, path: use.path, opened: use.opened, used: use.used})
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].used.Before(idle[j].used) })
+	return idle
+}
+
+/*
+Reports each handle idle past HANDLE_IDLE_TIMEOUT as a likely leak, and drops the entries that idle
+directory handles hold, which are read again if they are used. File handles are kept whole, since
+the kernel may still write through them. Returns the number of handles reported.
+*/
+func reapIdleHandles(now time.Time) int {
+	idle := openHandles.idle(now, HANDLE_IDLE_TIMEOUT)
+	for _, h := range idle {
+		fmt.Printf("The handle of %s opened %s ago has not been used for %s, so the process that opened it may have leaked it.\n",
+			h.path, now.Sub(h.opened).Round(time.Second), now.Sub(h.used).Round(time.Second))
+		if dh, ok := h.handle.(*DirHandle); ok {
+			fsLock.Lock()
+			dh.reap()
+			fsLock.Unlock()
+		}
+	}
+	return len(idle)
+}
+
+/*
+Starts reaping idle handles every HANDLE_REAP_INTERVAL. Does nothing if HANDLE_IDLE_TIMEOUT is 0.
+*/
+func startHandleReaper() {
+	if HANDLE_IDLE_TIMEOUT <= 0 {
+		return
+	}
+	go func() {
+		for now := range time.Tick(HANDLE_REAP_INTERVAL) {
+			reapIdleHandles(now)
+		}
+	}()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+Checks that opens past the handle limit fail with EMFILE until a handle is released, and that an idle
+directory handle is reported and dropped, and still lists its entries once it is used again.
+*/
+func TestHandleLimits(t *testing.T) {
+	defer func() {
+		MAX_OPEN_HANDLES = DEFAULT_MAX_OPEN_HANDLES
+		HANDLE_IDLE_TIMEOUT = DEFAULT_HANDLE_IDLE_TIMEOUT
+	}()
+	MAX_OPEN_HANDLES = 2
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "file", testData(100, 1), 100)
+	writeTestFile(t, root, "other", testData(100, 2), 100)
+
+	read := &fuse.OpenRequest{Flags: fuse.OpenReadOnly}
+	first, err := file.Open(ctx, read, new(fuse.OpenResponse))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	dh, err := root.Open(ctx, &fuse.OpenRequest{Dir: true}, new(fuse.OpenResponse))
+	if err != nil {
+		t.Fatalf("Open of the root: %v", err)
+	}
+	if _, err := file.Open(ctx, read, new(fuse.OpenResponse)); err != fuse.Errno(syscall.EMFILE) {
+		t.Fatalf("opening past the limit returned %v, want EMFILE", err)
+	}
+	if _, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "new"}, new(fuse.CreateResponse)); err != fuse.Errno(syscall.EMFILE) {
+		t.Fatalf("creating past the limit returned %v, want EMFILE", err)
+	}
+	if _, err := root.lookup(ctx, "new"); err != fuse.ENOENT {
+		t.Fatalf("the file refused with EMFILE was created: %v", err)
+	}
+	first.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	second, err := file.Open(ctx, read, new(fuse.OpenResponse))
+	if err != nil {
+		t.Fatalf("Open after a release: %v", err)
+	}
+	if open, refused := openHandles.counts(); open != 2 || refused != 2 {
+		t.Fatalf("%d handles open and %d refused, want 2 and 2", open, refused)
+	}
+
+	HANDLE_IDLE_TIMEOUT = time.Minute
+	second.(*FileHandle).Read(ctx, &fuse.ReadRequest{Size: 10}, new(fuse.ReadResponse))
+	if n := reapIdleHandles(time.Now().Add(30 * time.Second)); n != 0 {
+		t.Fatalf("%d handles were reaped before they were idle", n)
+	}
+	if n := reapIdleHandles(time.Now().Add(2 * time.Minute)); n != 2 {
+		t.Fatalf("%d idle handles were reaped, want 2", n)
+	}
+	if n := reapIdleHandles(time.Now().Add(3 * time.Minute)); n != 0 {
+		t.Fatalf("%d handles were reported again", n)
+	}
+	dirHandle := dh.(*DirHandle)
+	if !dirHandle.reaped || dirHandle.names != nil {
+		t.Fatalf("the idle directory handle still holds %d names", len(dirHandle.names))
+	}
+	resp := new(fuse.ReadResponse)
+	err = dirHandle.Read(ctx, &fuse.ReadRequest{Size: 4096}, resp)
+	if err != nil || len(dirHandle.names) != 4 || len(resp.Data) == 0 {
+		t.Fatalf("reading the reaped directory handle: %v, %d names", err, len(dirHandle.names))
+	}
+	dirHandle.Release(ctx, new(fuse.ReleaseRequest))
+	second.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	if open, _ := openHandles.counts(); open != 0 {
+		t.Fatalf("%d handles open after every one was released", open)
+	}
+}
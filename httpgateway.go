@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"crypto/subtle"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the prefix of the URLs of files and directories served by the HTTP gateway
+const HTTP_FILES_PREFIX string = "/files/"
+
+// the environment variable holding the bearer token that requests to the HTTP gateway must carry,
+// if it is set
+const HTTP_TOKEN_ENV string = "CLOUDFUSION_HTTP_TOKEN"
+
+// the size of the pieces uploaded files are written in
+const HTTP_CHUNK_SIZE int = 1 << 20
+
+/*
+Struct representing an HTTP gateway to a file system, which serves files and directories by path:
+GET returns a file, or a JSON listing of a directory; PUT uploads a file, replacing any file at the
+path, or makes a directory if the path ends in "/"; and DELETE removes a file or an empty directory.
+Requests are translated to calls of the same Dir, File, and handle methods that serve FUSE requests.
+
+When a token is set, share tokens issued with it (see issueShareToken) grant reading a subtree
+until they expire.
+
+When the file browser is enabled, the gateway is read-only, and also serves HTML pages under
+HTTP_BROWSE_PREFIX for browsing the directory tree and downloading files.
+
+Requests are served one at a time, since the blocks of a file being downloaded could otherwise be
+freed and reused by an upload replacing it.
+*/
+type httpGateway struct {
+	filesys *FS
+	token   string
+	browser bool
+	lock    sync.Mutex
+}
+
+/*
+Struct representing an entry in the listing of a directory.
+*/
+type httpDirEntry struct {
+	Name  string    `json:"name"`
+	Dir   bool      `json:"dir"`
+	Size  uint64    `json:"size"`
+	Mtime time.Time `json:"mtime"`
+}
+
+/*
+Returns a new HTTP gateway to the file system, which requires requests to carry token as a bearer
+token, unless it is "".
+*/
+func newHTTPGateway(filesys *FS, token string) *httpGateway {
+	return &httpGateway{filesys: filesys, token: token}
+}
+
+/*
+Serves a request for a file or directory.
+*/
+func (g *httpGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	scope, shared := "/", false
+	if g.token != "" && !g.authorized(r) {
+		scope, shared = g.shareScope(r)
+		if !shared {
+			if g.browser {
+				w.Header().Set("WWW-Authenticate", "Basic realm=\"CloudFusion\"")
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, "missing or wrong token", http.StatusUnauthorized)
+			return
+		}
+	}
+	if g.browser && r.URL.Path == "/" {
+		target := browserURL(HTTP_BROWSE_PREFIX, scope)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+	prefix := HTTP_FILES_PREFIX
+	if g.browser && strings.HasPrefix(r.URL.Path, HTTP_BROWSE_PREFIX) {
+		prefix = HTTP_BROWSE_PREFIX
+	}
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	p := path.Clean("/" + strings.TrimPrefix(r.URL.Path, prefix))
+	if g.browser && r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "the file browser is read-only", http.StatusMethodNotAllowed)
+		return
+	}
+	if shared && r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "share tokens only grant reading", http.StatusForbidden)
+		return
+	}
+	if !inShareScope(scope, p) {
+		http.Error(w, "the share token does not grant access to "+p, http.StatusForbidden)
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	switch r.Method {
+	case "GET", "HEAD":
+		if prefix == HTTP_BROWSE_PREFIX {
+			g.browse(w, r, p)
+		} else {
+			g.get(w, r, p)
+		}
+	case "PUT":
+		if strings.HasSuffix(r.URL.Path, "/") {
+			g.mkdir(w, r, p)
+		} else {
+			g.put(w, r, p)
+		}
+	case "DELETE":
+		g.delete(w, r, p)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+Returns whether the request carries the token, as a bearer token or, for browsers, as the password
+of basic authentication.
+*/
+func (g *httpGateway) authorized(r *http.Request) bool {
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+g.token)) == 1 {
+		return true
+	}
+	_, password, ok := r.BasicAuth()
+	return g.browser && ok && subtle.ConstantTimeCompare([]byte(password), []byte(g.token)) == 1
+}
+
+/*
+Writes the HTTP status and message for an error from the FUSE methods.
+*/
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errno, ok := err.(fuse.ErrorNumber); ok {
+		switch syscall.Errno(errno.Errno()) {
+		case syscall.ENOENT:
+			status = http.StatusNotFound
+		case syscall.EPERM, syscall.EACCES, syscall.ELOOP, syscall.ENXIO:
+			status = http.StatusForbidden
+		case syscall.ENOTDIR, syscall.EISDIR, syscall.ENOTEMPTY, syscall.EEXIST:
+			status = http.StatusConflict
+		}
+	}
+	http.Error(w, err.Error(), status)
+}
+
+/*
+Returns the header of the FUSE requests that HTTP requests are translated to. HTTP requests do
+not come from a user of the machine, so they are made as nobody.
+*/
+func httpHeader() fuse.Header {
+	return fuse.Header{Uid: NOBODY_UID, Gid: NOBODY_UID}
+}
+
+/*
+Returns the node at path p.
+*/
+func (g *httpGateway) lookup(p string) (fs.Node, error) {
+	return lookupNode(g.filesys, p)
+}
+
+/*
+Returns the node at path p, which is absolute and clean, by looking up each of its names from the
+root.
+*/
+func lookupNode(filesys *FS, p string) (fs.Node, error) {
+	node, err := filesys.Root()
+	if err != nil || p == "/" {
+		return node, err
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		dir, ok := node.(*Dir)
+		if !ok {
+			return nil, fuse.Errno(syscall.ENOTDIR)
+		}
+		node, err = dir.lookup(context.Background(), name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+/*
+Returns the directory that holds the entry at path p, which must not be the root.
+*/
+func (g *httpGateway) lookupParent(p string) (*Dir, error) {
+	if p == "/" {
+		return nil, fuse.EPERM
+	}
+	node, err := g.lookup(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := node.(*Dir)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	return dir, nil
+}
+
+/*
+Serves the file at path p, with support for ranges and conditional requests, or the listing of the
+directory at p as JSON. Symbolic links and special files are refused (see checkOpenable).
+*/
+func (g *httpGateway) get(w http.ResponseWriter, r *http.Request, p string) {
+	node, err := g.lookup(p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	ctx := context.Background()
+	if dir, ok := node.(*Dir); ok {
+		entries, err := listDir(dir)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+	file, ok := node.(*File)
+	if !ok {
+		// the virtual directory of a FUSE mount, whose files are only served through the mount
+		httpError(w, fuse.ENOENT)
+		return
+	}
+	err = file.inode.checkOpenable()
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	var attr fuse.Attr
+	err = file.Attr(ctx, &attr)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	// the content hash as the ETag lets clients skip downloading files they already have
+	hash := new(fuse.GetxattrResponse)
+	err = file.Getxattr(ctx, &fuse.GetxattrRequest{Name: CONTENT_HASH_XATTR}, hash)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("ETag", "\""+string(hash.Xattr)+"\"")
+	handle, err := file.Open(ctx, &fuse.OpenRequest{Header: httpHeader(), Flags: fuse.OpenReadOnly}, new(fuse.OpenResponse))
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	reader := &httpFileReader{handle: handle.(*FileHandle), size: int64(attr.Size)}
+	http.ServeContent(w, r, path.Base(p), attr.Mtime, reader)
+	reader.handle.Release(ctx, &fuse.ReleaseRequest{Header: httpHeader()})
+}
+
+/*
+Returns the entries of a directory other than "." and "..", sorted by name.
+*/
+func listDir(dir *Dir) ([]httpDirEntry, error) {
+	ctx := context.Background()
+	handle, err := dir.Open(ctx, &fuse.OpenRequest{Header: httpHeader(), Dir: true}, new(fuse.OpenResponse))
+	if err != nil {
+		return nil, err
+	}
+	dirents := handle.(*DirHandle).readDirAll()
+	handle.(*DirHandle).close()
+	entries := []httpDirEntry{}
+	for _, dirent := range dirents {
+		if dirent.Name == "." || dirent.Name == ".." {
+			continue
+		}
+		node, err := dir.lookup(ctx, dirent.Name)
+		if err != nil {
+			return nil, err
+		}
+		var attr fuse.Attr
+		err = node.Attr(ctx, &attr)
+		if err != nil {
+			return nil, err
+		}
+		_, isDir := node.(*Dir)
+		entries = append(entries, httpDirEntry{Name: dirent.Name, Dir: isDir, Size: attr.Size, Mtime: attr.Mtime})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+/*
+Struct that reads a file through its handle, for http.ServeContent.
+*/
+type httpFileReader struct {
+	handle *FileHandle
+	size   int64
+	offset int64
+}
+
+/*
+Reads from the file at the current offset.
+*/
+func (r *httpFileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	resp := new(fuse.ReadResponse)
+	err := r.handle.Read(context.Background(), &fuse.ReadRequest{Header: httpHeader(), Offset: r.offset, Size: len(p)}, resp)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, resp.Data)
+	r.offset += int64(n)
+	return n, nil
+}
+
+/*
+Moves the offset that the file is read from.
+*/
+func (r *httpFileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fuse.Errno(syscall.EINVAL)
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+/*
+Uploads the body of the request to a file at path p, replacing any file already there. The body is
+written to a new file under a temporary name in the same directory, which is renamed over p once it
+is complete, so a failed upload leaves the file that was there as it was.
+*/
+func (g *httpGateway) put(w http.ResponseWriter, r *http.Request, p string) {
+	dir, err := g.lookupParent(p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	ctx := context.Background()
+	name := path.Base(p)
+	status := http.StatusCreated
+	existing, err := dir.lookup(ctx, name)
+	if err == nil {
+		if _, isDir := existing.(*Dir); isDir {
+			httpError(w, fuse.Errno(syscall.EISDIR))
+			return
+		}
+		status = http.StatusNoContent
+	} else if err != fuse.ENOENT {
+		httpError(w, err)
+		return
+	}
+	upload := uploadName(name)
+	req := &fuse.CreateRequest{Header: httpHeader(), Name: upload, Flags: fuse.OpenWriteOnly, Mode: 0644}
+	_, handle, err := dir.Create(ctx, req, new(fuse.CreateResponse))
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	fh := handle.(*FileHandle)
+	err = writeBody(fh, r.Body)
+	releaseErr := fh.Release(ctx, &fuse.ReleaseRequest{Header: httpHeader()})
+	if err == nil {
+		err = releaseErr
+	}
+	if err == nil {
+		err = dir.Rename(ctx, &fuse.RenameRequest{Header: httpHeader(), OldName: upload, NewName: name}, dir)
+	}
+	if err != nil {
+		dir.Remove(ctx, &fuse.RemoveRequest{Header: httpHeader(), Name: upload})
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+/*
+Returns the temporary name a PUT of a file called name writes it under until it is complete: a
+hidden name made unique by the time, so that concurrent uploads of the same file do not collide.
+*/
+func uploadName(name string) string {
+	return "." + name + ".upload-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+/*
+Writes everything read from body to the file of a handle, a chunk at a time.
+*/
+func writeBody(fh *FileHandle, body io.Reader) error {
+	ioMemory.acquire(int64(HTTP_CHUNK_SIZE))
+	defer ioMemory.release(int64(HTTP_CHUNK_SIZE))
+	buf := make([]byte, HTTP_CHUNK_SIZE)
+	var offset int64
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			req := &fuse.WriteRequest{Header: httpHeader(), Offset: offset, Data: buf[:n]}
+			writeErr := fh.Write(context.Background(), req, new(fuse.WriteResponse))
+			if writeErr != nil {
+				return writeErr
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Makes a directory at path p, unless there is one already.
+*/
+func (g *httpGateway) mkdir(w http.ResponseWriter, r *http.Request, p string) {
+	dir, err := g.lookupParent(p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	ctx := context.Background()
+	name := path.Base(p)
+	existing, err := dir.lookup(ctx, name)
+	if err == nil {
+		if _, isDir := existing.(*Dir); !isDir {
+			httpError(w, fuse.Errno(syscall.EEXIST))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != fuse.ENOENT {
+		httpError(w, err)
+		return
+	}
+	_, err = dir.Mkdir(ctx, &fuse.MkdirRequest{Header: httpHeader(), Name: name, Mode: os.ModeDir | 0755})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+/*
+Removes the file or empty directory at path p.
+*/
+func (g *httpGateway) delete(w http.ResponseWriter, r *http.Request, p string) {
+	dir, err := g.lookupParent(p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	ctx := context.Background()
+	name := path.Base(p)
+	node, err := dir.lookup(ctx, name)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	_, isDir := node.(*Dir)
+	err = dir.Remove(ctx, &fuse.RemoveRequest{Header: httpHeader(), Name: name, Dir: isDir})
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
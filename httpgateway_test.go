@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+/*
+Makes a request to the gateway and returns the response.
+*/
+func httpDo(g *httpGateway, method, url string, body []byte, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, req)
+	return rec
+}
+
+/*
+Uploads, downloads, lists, replaces, and deletes files and directories through the HTTP gateway.
+*/
+func TestHTTPGateway(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	g := newHTTPGateway(filesys, "")
+	data := testData(3*HTTP_CHUNK_SIZE/2, 1)
+
+	if rec := httpDo(g, "PUT", "/files/dir/", nil); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT of a directory: status %d", rec.Code)
+	}
+	if rec := httpDo(g, "PUT", "/files/dir/file", data); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT of a file: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := httpDo(g, "GET", "/files/dir/file", nil)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatalf("GET returned status %d and %d bytes, want the %d put", rec.Code, rec.Body.Len(), len(data))
+	}
+	rec = httpDo(g, "GET", "/files/dir/file", nil, "Range", "bytes=10-19")
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), data[10:20]) {
+		t.Fatalf("GET of a range returned status %d and %q", rec.Code, rec.Body.Bytes())
+	}
+
+	// a shorter file replaces the longer one entirely
+	if rec := httpDo(g, "PUT", "/files/dir/file", []byte("short")); rec.Code != http.StatusNoContent {
+		t.Fatalf("PUT replacing a file: status %d", rec.Code)
+	}
+	if rec := httpDo(g, "GET", "/files/dir/file", nil); rec.Body.String() != "short" {
+		t.Fatalf("GET after replacing returned %d bytes", rec.Body.Len())
+	}
+	etag := httpDo(g, "GET", "/files/dir/file", nil).Header().Get("ETag")
+	if rec := httpDo(g, "GET", "/files/dir/file", nil, "If-None-Match", etag); etag == "" || rec.Code != http.StatusNotModified {
+		t.Fatalf("GET with the ETag %q: status %d, want %d", etag, rec.Code, http.StatusNotModified)
+	}
+
+	rec = httpDo(g, "GET", "/files/dir", nil)
+	var entries []httpDirEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("directory listing %q: %v", rec.Body, err)
+	}
+	if len(entries) != 1 || entries[0].Name != "file" || entries[0].Dir || entries[0].Size != 5 {
+		t.Fatalf("directory listing %+v, want the file of 5 bytes", entries)
+	}
+
+	if rec := httpDo(g, "GET", "/files/missing", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET of a missing file: status %d, want 404", rec.Code)
+	}
+	if rec := httpDo(g, "DELETE", "/files/dir", nil); rec.Code != http.StatusConflict {
+		t.Errorf("DELETE of a non-empty directory: status %d, want 409", rec.Code)
+	}
+	if rec := httpDo(g, "DELETE", "/files/dir/file", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE of a file: status %d", rec.Code)
+	}
+	if rec := httpDo(g, "DELETE", "/files/dir", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE of an empty directory: status %d", rec.Code)
+	}
+	if rec := httpDo(g, "GET", "/files/", nil); rec.Body.String() != "[]\n" {
+		t.Errorf("root listing after deleting everything: %q", rec.Body)
+	}
+}
+
+/*
+Checks that an upload cut short leaves the file it was replacing as it was, and no temporary file.
+*/
+func TestHTTPGatewayFailedPut(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	g := newHTTPGateway(filesys, "")
+	if rec := httpDo(g, "PUT", "/files/file", []byte("old")); rec.Code != http.StatusCreated {
+		t.Fatalf("PUT of a file: status %d", rec.Code)
+	}
+	body := io.MultiReader(bytes.NewReader(testData(HTTP_CHUNK_SIZE, 1)), iotest.ErrReader(errors.New("connection reset")))
+	rec := httptest.NewRecorder()
+	g.ServeHTTP(rec, httptest.NewRequest("PUT", "/files/file", body))
+	if rec.Code < 400 {
+		t.Fatalf("PUT cut short: status %d", rec.Code)
+	}
+	if rec := httpDo(g, "GET", "/files/file", nil); rec.Body.String() != "old" {
+		t.Fatalf("GET after a failed PUT returned %d bytes, want the old file", rec.Body.Len())
+	}
+	var entries []httpDirEntry
+	if err := json.Unmarshal(httpDo(g, "GET", "/files/", nil).Body.Bytes(), &entries); err != nil || len(entries) != 1 {
+		t.Fatalf("root listing after a failed PUT: %+v, %v", entries, err)
+	}
+}
+
+/*
+Checks that symbolic links and special files are refused rather than served as files.
+*/
+func TestHTTPGatewaySpecialFiles(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	if _, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "link", Target: "/etc/passwd"}); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if _, err := root.Mknod(ctx, &fuse.MknodRequest{Name: "fifo", Mode: os.ModeNamedPipe | 0644}); err != nil {
+		t.Fatalf("Mknod: %v", err)
+	}
+	g := newHTTPGateway(filesys, "")
+	for _, name := range []string{"link", "fifo"} {
+		if rec := httpDo(g, "GET", "/files/"+name, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("GET of %s: status %d, want %d", name, rec.Code, http.StatusForbidden)
+		}
+	}
+}
+
+/*
+Checks that the gateway rejects requests without the bearer token when one is set.
+*/
+func TestHTTPGatewayToken(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	g := newHTTPGateway(filesys, "secret")
+	if rec := httpDo(g, "GET", "/files/", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET without a token: status %d, want 401", rec.Code)
+	}
+	if rec := httpDo(g, "GET", "/files/", nil, "Authorization", "Bearer wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET with the wrong token: status %d, want 401", rec.Code)
+	}
+	if rec := httpDo(g, "GET", "/files/", nil, "Authorization", "Bearer secret"); rec.Code != http.StatusOK {
+		t.Errorf("GET with the token: status %d, want 200", rec.Code)
+	}
+}
+
+/*
+Checks that a share token grants reading its subtree and nothing else, only until it expires, and
+only with the gateway token it was issued with.
+*/
+func TestHTTPGatewayShareToken(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	g := newHTTPGateway(filesys, "secret")
+	auth := []string{"Authorization", "Bearer secret"}
+	httpDo(g, "PUT", "/files/shared/", nil, auth...)
+	httpDo(g, "PUT", "/files/shared/file", []byte("shared"), auth...)
+	httpDo(g, "PUT", "/files/sharedother", []byte("private"), auth...)
+
+	token := issueShareToken("secret", "shared", time.Now().Add(time.Hour))
+	share := []string{"Authorization", "Bearer " + token}
+	if rec := httpDo(g, "GET", "/files/shared/file", nil, share...); rec.Code != http.StatusOK || rec.Body.String() != "shared" {
+		t.Errorf("GET in the shared directory: status %d, body %q", rec.Code, rec.Body)
+	}
+	if rec := httpDo(g, "GET", "/files/shared/file?token="+token, nil); rec.Code != http.StatusOK {
+		t.Errorf("GET with the share token as a parameter: status %d", rec.Code)
+	}
+	if rec := httpDo(g, "GET", "/files/shared", nil, share...); rec.Code != http.StatusOK {
+		t.Errorf("GET of the shared directory: status %d", rec.Code)
+	}
+	for _, p := range []string{"/files/sharedother", "/files/", "/files/shared/../sharedother"} {
+		if rec := httpDo(g, "GET", p, nil, share...); rec.Code != http.StatusForbidden {
+			t.Errorf("GET of %s outside the shared directory: status %d, want 403", p, rec.Code)
+		}
+	}
+	if rec := httpDo(g, "PUT", "/files/shared/new", []byte("x"), share...); rec.Code != http.StatusForbidden {
+		t.Errorf("PUT with a share token: status %d, want 403", rec.Code)
+	}
+
+	expired := issueShareToken("secret", "shared", time.Now().Add(-time.Second))
+	if rec := httpDo(g, "GET", "/files/shared/file", nil, "Authorization", "Bearer "+expired); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET with an expired share token: status %d, want 401", rec.Code)
+	}
+	forged := issueShareToken("other", "shared", time.Now().Add(time.Hour))
+	if rec := httpDo(g, "GET", "/files/shared/file", nil, "Authorization", "Bearer "+forged); rec.Code != http.StatusUnauthorized {
+		t.Errorf("GET with a share token issued with another secret: status %d, want 401", rec.Code)
+	}
+}
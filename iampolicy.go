@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// the region the S3 and DynamoDB clients are created in
+const AWS_CLIENT_REGION string = "us-east-1"
+
+/*
+Struct representing an IAM policy document.
+*/
+type iamPolicy struct {
+	Version   string
+	Statement []iamStatement
+}
+
+/*
+Struct representing a single statement of an IAM policy document.
+*/
+type iamStatement struct {
+	Sid      string
+	Effect   string
+	Action   []string
+	Resource []string
+}
+
+/*
+Returns the least-privilege IAM policy for mounting the file system described by config. If
+allowCreate is set, the policy also allows creating the bucket and table, which is only needed the
+first time the file system is mounted.
+*/
+func makeIAMPolicy(config *Config, allowCreate bool) *iamPolicy {
+	bucketARN := "arn:aws:s3:::" + config.Bucket
+	tableARN := "arn:aws:dynamodb:" + AWS_CLIENT_REGION + ":*:table/" + config.Table
+	bucketActions := []string{"s3:GetBucketLocation", "s3:ListBucket"}
+	objectActions := []string{"s3:GetObject", "s3:PutObject", "s3:DeleteObject"}
+	// Scan lists the items a crashed mount left in the cache table, see recoverCacheTable
+	tableActions := []string{"dynamodb:DescribeTable", "dynamodb:GetItem", "dynamodb:PutItem", "dynamodb:DeleteItem", "dynamodb:Scan"}
+	var createTableActions []string
+	if allowCreate {
+		provisionBucketActions, provisionTableActions := provisionActions(config)
+		createTableActions = append([]string{"dynamodb:CreateTable"}, provisionTableActions...)
+		bucketActions = append(append(bucketActions, "s3:CreateBucket"), provisionBucketActions...)
+		tableActions = append(tableActions, createTableActions...)
+	}
+	if config.ObjectLockMode != "" {
+		objectActions = append(objectActions, "s3:PutObjectRetention")
+	}
+	if config.ObjectLockLegalHold {
+		objectActions = append(objectActions, "s3:PutObjectLegalHold")
+	}
+	if allowCreate && (config.ObjectLockMode != "" || config.ObjectLockLegalHold) {
+		// creating a bucket with Object Lock enabled also enables versioning and Object Lock on it
+		bucketActions = append(bucketActions, "s3:PutBucketObjectLockConfiguration", "s3:PutBucketVersioning")
+	}
+	policy := &iamPolicy{
+		Version: "2012-10-17",
+		Statement: []iamStatement{
+			{
+				Sid:      "CloudFusionBucket",
+				Effect:   "Allow",
+				Action:   bucketActions,
+				Resource: []string{bucketARN},
+			},
+			{
+				Sid:      "CloudFusionBlocks",
+				Effect:   "Allow",
+				Action:   objectActions,
+				Resource: []string{bucketARN + "/*"},
+			},
+			{
+				Sid:      "CloudFusionCache",
+				Effect:   "Allow",
+				Action:   tableActions,
+				Resource: []string{tableARN},
+			},
+		},
+	}
+	if config.MetadataStore == METADATA_ITEMS_STORE {
+		metadataActions := []string{"dynamodb:DescribeTable", "dynamodb:GetItem", "dynamodb:PutItem",
+			"dynamodb:DeleteItem", "dynamodb:Query"}
+		metadataActions = append(metadataActions, createTableActions...)
+		policy.Statement = append(policy.Statement, iamStatement{
+			Sid:      "CloudFusionMetadata",
+			Effect:   "Allow",
+			Action:   metadataActions,
+			Resource: []string{tableARN + METADATA_TABLE_SUFFIX},
+		})
+	}
+	if config.Locks == LOCKS_DYNAMODB {
+		lockActions := []string{"dynamodb:DescribeTable", "dynamodb:GetItem", "dynamodb:PutItem", "dynamodb:DeleteItem"}
+		lockActions = append(lockActions, createTableActions...)
+		policy.Statement = append(policy.Statement, iamStatement{
+			Sid:      "CloudFusionLocks",
+			Effect:   "Allow",
+			Action:   lockActions,
+			Resource: []string{tableARN + LOCK_TABLE_SUFFIX},
+		})
+	}
+	if config.KMSKeyARN != "" {
+		policy.Statement = append(policy.Statement, iamStatement{
+			Sid:      "CloudFusionEncryption",
+			Effect:   "Allow",
+			Action:   []string{"kms:GenerateDataKey", "kms:Decrypt"},
+			Resource: []string{config.KMSKeyARN},
+		})
+	}
+	if config.StorageClass == STORAGE_CLASS_INTELLIGENT_TIERING {
+		// CloudWatch metrics have no ARNs to limit the statement to
+		policy.Statement = append(policy.Statement, iamStatement{
+			Sid:      "CloudFusionTieringUsage",
+			Effect:   "Allow",
+			Action:   []string{"cloudwatch:GetMetricStatistics"},
+			Resource: []string{"*"},
+		})
+	}
+	if strings.HasPrefix(config.AuditLog, AUDIT_CLOUDWATCH_PREFIX) {
+		group := strings.Split(strings.TrimPrefix(config.AuditLog, AUDIT_CLOUDWATCH_PREFIX), ":")[0]
+		policy.Statement = append(policy.Statement, iamStatement{
+			Sid:      "CloudFusionAuditLog",
+			Effect:   "Allow",
+			Action:   []string{"logs:CreateLogStream", "logs:DescribeLogStreams", "logs:PutLogEvents"},
+			Resource: []string{"arn:aws:logs:" + config.Region + ":*:log-group:" + group + ":*"},
+		})
+	}
+	return policy
+}
+
+/*
+Prints the least-privilege IAM policy for mounting the file system described by the config.
+*/
+func iamPolicyCommand(args []string) int {
+	flags := flag.NewFlagSet("iam-policy", flag.ContinueOnError)
+	noCreate := flags.Bool("no-create", false, "leave out the permissions to create the bucket and table")
+	if flags.Parse(args) != nil || flags.NArg() != 1 {
+		commandUsage("iam-policy")
+		flags.PrintDefaults()
+		return 2
+	}
+	config := readConfig(flags.Arg(0))
+	if config.Backend == LOCAL_BACKEND {
+		fmt.Println("The local backend does not use AWS, so needs no IAM policy.")
+		return 1
+	}
+	policy := makeIAMPolicy(config, !*noCreate)
+	statement, err := configSourceStatement(flags.Arg(0))
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	if statement != nil {
+		policy.Statement = append(policy.Statement, *statement)
+	}
+	data, err := json.MarshalIndent(policy, "", "  ")
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	os.Stdout.Write(append(data, '\n'))
+	return 0
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+Returns whether a statement of policy allows action.
+*/
+func policyAllows(policy *iamPolicy, action string) bool {
+	for _, statement := range policy.Statement {
+		for _, allowed := range statement.Action {
+			if allowed == action {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+Checks that the IAM policy is scoped to the configured bucket, table, and KMS key, and only allows
+creating the bucket and table when asked to.
+*/
+func TestIAMPolicy(t *testing.T) {
+	config := &Config{Bucket: "bucket", Table: "table", KMSKeyARN: "arn:aws:kms:us-east-1:1:key/k",
+		Region: "us-west-2", AuditLog: "cloudwatch:group:stream"}
+	resources := map[string]string{}
+	actions := map[string]bool{}
+	for _, statement := range makeIAMPolicy(config, false).Statement {
+		for _, action := range statement.Action {
+			actions[action] = true
+			resources[action] = strings.Join(statement.Resource, ",")
+		}
+	}
+	want := map[string]string{
+		"s3:GetObject":         "arn:aws:s3:::bucket/*",
+		"s3:GetBucketLocation": "arn:aws:s3:::bucket",
+		"s3:ListBucket":        "arn:aws:s3:::bucket",
+		"dynamodb:PutItem":     "arn:aws:dynamodb:" + AWS_CLIENT_REGION + ":*:table/table",
+		"dynamodb:Scan":        "arn:aws:dynamodb:" + AWS_CLIENT_REGION + ":*:table/table",
+		"kms:Decrypt":          config.KMSKeyARN,
+		"logs:PutLogEvents":    "arn:aws:logs:us-west-2:*:log-group:group:*",
+	}
+	for action, resource := range want {
+		if resources[action] != resource {
+			t.Errorf("%s allowed on %q, want %q", action, resources[action], resource)
+		}
+	}
+	if actions["s3:CreateBucket"] || actions["dynamodb:CreateTable"] {
+		t.Errorf("policy without create permissions allows creating the bucket or table")
+	}
+	if actions["dynamodb:Query"] {
+		t.Errorf("policy for a file system keeping its metadata in blocks allows dynamodb:Query")
+	}
+	for _, statement := range makeIAMPolicy(&Config{Bucket: "b", Table: "t"}, true).Statement {
+		for _, action := range statement.Action {
+			if strings.HasPrefix(action, "kms:") {
+				t.Errorf("policy for an unencrypted file system allows %s", action)
+			}
+		}
+	}
+	config = &Config{Bucket: "b", Table: "t", StorageClass: STORAGE_CLASS_INTELLIGENT_TIERING}
+	if !policyAllows(makeIAMPolicy(config, false), "cloudwatch:GetMetricStatistics") {
+		t.Errorf("policy for a file system in Intelligent-Tiering cannot read its usage from CloudWatch")
+	}
+	if policyAllows(makeIAMPolicy(&Config{Bucket: "b", Table: "t"}, false), "cloudwatch:GetMetricStatistics") {
+		t.Errorf("policy for a file system in S3 Standard allows reading CloudWatch metrics")
+	}
+	config = &Config{Bucket: "b", Table: "t", Locks: LOCKS_DYNAMODB}
+	if !hasStatement(makeIAMPolicy(config, false), "CloudFusionLocks", "arn:aws:dynamodb:"+AWS_CLIENT_REGION+":*:table/t"+LOCK_TABLE_SUFFIX) {
+		t.Errorf("policy for a file system sharing its locks has no statement for the lock table")
+	}
+	config = &Config{Bucket: "b", Table: "t", MetadataStore: METADATA_ITEMS_STORE}
+	for _, statement := range makeIAMPolicy(config, false).Statement {
+		if statement.Sid == "CloudFusionMetadata" {
+			want := "arn:aws:dynamodb:" + AWS_CLIENT_REGION + ":*:table/t" + METADATA_TABLE_SUFFIX
+			if len(statement.Resource) != 1 || statement.Resource[0] != want {
+				t.Errorf("metadata statement allowed on %v, want %s", statement.Resource, want)
+			}
+			return
+		}
+	}
+	t.Errorf("policy for a file system keeping its metadata as items has no statement for its table")
+}
+
+/*
+Returns whether policy has the statement sid, allowed on resource alone.
+*/
+func hasStatement(policy *iamPolicy, sid, resource string) bool {
+	for _, statement := range policy.Statement {
+		if statement.Sid == sid {
+			return len(statement.Resource) == 1 && statement.Resource[0] == resource
+		}
+	}
+	return false
+}
@@ -16,25 +16,56 @@ const NUM_DATA_BLOCKS uint64 = 12 // could be adjusted
 const INODE_WITHOUT_BUFFER_SIZE = 139 // this is hard-coded based on the fields in the struct and should not be changed
 const INODE_BUFFER_SIZE uint64 = INODE_SIZE - INODE_WITHOUT_BUFFER_SIZE
 const FIRST_DATA_BLOCK_BYTE uint64 = INODE_BUFFER_SIZE // index of first byte that needs to be written to a datablock
-const FIRST_SINGLY_INDIRECT_BYTE uint64 = FIRST_DATA_BLOCK_BYTE + NUM_DATA_BLOCKS*BLOCK_SIZE
-const FIRST_DOUBLY_INDIRECT_BYTE uint64 = FIRST_SINGLY_INDIRECT_BYTE + BLOCK_SIZE*BLOCK_SIZE
-const FIRST_TRIPLY_INDIRECT_BYTE uint64 = FIRST_DOUBLY_INDIRECT_BYTE + BLOCK_SIZE*BLOCK_SIZE*BLOCK_SIZE
+const BLOCK_POINTERS uint64 = BLOCK_SIZE / 8           // the number of block numbers an indirect block holds
 const IND_BLOCK uint8 = uint8(NUM_DATA_BLOCKS)
-const IND_BLOCK_SIZE uint64 = BLOCK_SIZE * BLOCK_SIZE
+const IND_BLOCK_SIZE uint64 = BLOCK_POINTERS * BLOCK_SIZE // the bytes of data under a singly indirect block
 const DOUB_IND_BLOCK uint8 = uint8(NUM_DATA_BLOCKS) + 1
-const DOUB_IND_BLOCK_SIZE uint64 = BLOCK_SIZE * BLOCK_SIZE * BLOCK_SIZE
+const DOUB_IND_BLOCK_SIZE uint64 = BLOCK_POINTERS * IND_BLOCK_SIZE // the bytes of data under a doubly indirect block
 const TRIP_IND_BLOCK uint8 = uint8(NUM_DATA_BLOCKS) + 2
+const FIRST_SINGLY_INDIRECT_BYTE uint64 = FIRST_DATA_BLOCK_BYTE + NUM_DATA_BLOCKS*BLOCK_SIZE
+const FIRST_DOUBLY_INDIRECT_BYTE uint64 = FIRST_SINGLY_INDIRECT_BYTE + IND_BLOCK_SIZE
+const FIRST_TRIPLY_INDIRECT_BYTE uint64 = FIRST_DOUBLY_INDIRECT_BYTE + DOUB_IND_BLOCK_SIZE
 
 /*
-Struct representing an inode in the file system. The size of the buffer can be varied by
-adjusting the INODE_SIZE constant, and it will expand to fill the difference.
+Struct representing an inode in the file system.
 */
 type Inode struct {
+	storedInode
+
+	// the owner of the inode, which is kept in its owner block rather than in the inode, since
+	// the inode has no room left, see owner.go
+	Uid uint32
+	Gid uint32
+
+	// the access and change times of the inode, kept in its times block for the same reason, see
+	// times.go. The modification time is UnixTime.
+	Atime       int64
+	Ctime       int64
+	storedTimes [2]int64 // the times as last read from or written to the times block
+
+	// the generation of the file holding the inode number, kept in its generation block, which
+	// tells it from the earlier files given the same number, see generation.go
+	Generation uint64
+
+	// the number of data and indirect blocks the inode uses, counted the first time it is needed
+	// and kept up to date as blocks are allocated, see sparse.go
+	usedBlocks      uint64
+	usedBlocksKnown bool
+}
+
+/*
+Struct holding the fields of an inode that are stored in its INODE_SIZE bytes. The size of the
+buffer can be varied by adjusting the INODE_SIZE constant, and it will expand to fill the difference.
+*/
+type storedInode struct {
 	Size      uint64
 	LinkCount uint16
 	UnixTime  int64
 
-	IsDir int8 // this must be an int and not bool to work with encoding/binary
+	// this must be an int and not bool to work with encoding/binary. The lowest bit is set for
+	// directories, and the other bits hold the DIR_FLAG_* flags of directories, or the cache hints
+	// of files and INODE_SYMLINK.
+	IsDir int8
 
 	DataBuf [INODE_BUFFER_SIZE]byte
 
@@ -42,30 +73,99 @@ type Inode struct {
 	Data [NUM_DATA_BLOCKS + 3]uint64
 }
 
+const DIR_FLAG_APPEND_ONLY int8 = 1 << 1 // entries can be added under the directory, but not changed or removed
+const DIR_FLAG_IMMUTABLE int8 = 1 << 2   // nothing under the directory can be added, changed, or removed
+const DIR_FLAGS int8 = DIR_FLAG_APPEND_ONLY | DIR_FLAG_IMMUTABLE
+
+// files keep their cache hints in the same bits of IsDir as the DIR_FLAG_* flags of directories,
+// with the readahead in blocks in the bits above them
+const FILE_CACHE_NONE int8 = 1 << 1 // blocks of the file are read from S3 without being cached
+const FILE_CACHE_PIN int8 = 1 << 2  // blocks of the file stay in the cache over those of other files
+const FILE_CACHE_HINTS int8 = FILE_CACHE_NONE | FILE_CACHE_PIN
+const FILE_READAHEAD_SHIFT = 3
+const MAX_FILE_READAHEAD uint64 = 15
+const FILE_READAHEAD_MASK int8 = int8(MAX_FILE_READAHEAD) << FILE_READAHEAD_SHIFT
+
+// the highest bit of IsDir is set for symbolic links, which are files holding their target in DataBuf,
+// and for special files, which have no target (see special.go)
+const INODE_SYMLINK int8 = -1 << 7
+
+/*
+Returns whether the inode is a directory.
+*/
+func (i *Inode) isDir() bool {
+	return i.IsDir&1 == 1
+}
+
+/*
+Returns whether the inode is a symbolic link. Targets cannot be empty, so links always have a size.
+*/
+func (i *Inode) isSymlink() bool {
+	return !i.isDir() && i.IsDir&INODE_SYMLINK != 0 && i.Size != 0
+}
+
+/*
+Returns the DIR_FLAG_* flags set on the inode.
+*/
+func (i *Inode) dirFlags() int8 {
+	if !i.isDir() {
+		return 0
+	}
+	return i.IsDir & DIR_FLAGS
+}
+
+/*
+Returns the FILE_CACHE_* hint set on the inode, or 0 if it is a directory or has none.
+*/
+func (i *Inode) cacheHint() int8 {
+	if i.isDir() {
+		return 0
+	}
+	return i.IsDir & FILE_CACHE_HINTS
+}
+
+/*
+Returns the number of blocks to read ahead of each read of the inode, or 0 if it is a directory.
+*/
+func (i *Inode) readahead() uint64 {
+	if i.isDir() {
+		return 0
+	}
+	return uint64(i.IsDir&FILE_READAHEAD_MASK) >> FILE_READAHEAD_SHIFT
+}
+
 /*
 Helper function that updates size and modified time of an inode.
 */
 func (i *Inode) updateSize(size uint64) {
 	i.Size = size
+	i.modified()
+}
+
+/*
+Sets the modification time of the inode to now, along with its change time.
+*/
+func (i *Inode) modified() {
 	i.UnixTime = time.Now().Unix()
+	i.Ctime = i.UnixTime
 }
 
 /*
-Returns a pointer to a new inode with time initialized to the system time.
+Returns a pointer to a new inode with its times initialized to the system time.
 */
 func createInode(isDir int8) *Inode {
 	sysTime := time.Now().Unix()
 	var data [15]uint64
 	var dataBuf [INODE_BUFFER_SIZE]byte
 
-	return &Inode{
+	return &Inode{storedInode: storedInode{
 		Size:      0,
 		LinkCount: 0,
 		UnixTime:  sysTime,
 		IsDir:     isDir,
 		Data:      data,
 		DataBuf:   dataBuf,
-	}
+	}, Atime: sysTime, Ctime: sysTime}
 }
 
 /*
@@ -73,39 +173,87 @@ Initializes a new inode by writing the inode numbers for . and .. to its table i
 and setting LinkCount to 1.
 */
 func (i *Inode) init(parentNum, thisNum uint64) {
-	if i.IsDir == 1 {
+	if i.isDir() {
 		inodeTable := new(InodeTable)
 		inodeTable.init(parentNum, thisNum)
-		// this shouldn't have an error
-		tableData, _ := inodeTable.MarshalBinary()
-		var offset uint64
-		offset = 0
-		i.writeToData(tableData, offset)
-		i.updateSize(uint64(len(tableData)))
+		// this shouldn't have an error, as the table is inline
+		writeTable(inodeTable, i)
 	}
 	i.LinkCount = 1
 }
 
 /*
-Gets an inode from S3/DynamoDB by the inodeNum.
+Returns the stored bytes of the inode with inodeNum, which are sealed if the file system has file
+keys. They are its item if the file system keeps its metadata as items, and otherwise its part of
+the inode block holding it.
 */
-func getInode(inodeNum uint64) (*Inode, error) {
-	// fmt.Printf("doing get inode for inode id %d\n", inodeNum)
+func getInodeData(inodeNum uint64) ([]byte, error) {
+	if metadataStore != nil {
+		if metadataTxn != nil {
+			if inodeData, ok := metadataTxn.inodeData(inodeNum); ok {
+				// written earlier in the operation, and not yet stored
+				return append([]byte(nil), inodeData...), nil
+			}
+		}
+		inodeData, err := metadataStore.GetInode(inodeNum)
+		if err == nil && uint64(len(inodeData)) != INODE_SIZE {
+			err = fmt.Errorf("inode %d has size %d, not %d", inodeNum, len(inodeData), INODE_SIZE)
+		}
+		return inodeData, err
+	}
 	inodeBlock, err := getInodeBlock(inodeNum)
 	start := (inodeNum % (BLOCK_SIZE / INODE_SIZE)) * INODE_SIZE
 	end := start + INODE_SIZE
-	inodeData := inodeBlock.Data[start:end]
-	reader := bytes.NewReader(inodeData)
+	return inodeBlock.Data[start:end], err
+}
+
+/*
+Gets an inode from S3/DynamoDB by the inodeNum.
+*/
+func getInode(inodeNum uint64) (*Inode, error) {
+	// fmt.Printf("doing get inode for inode id %d\n", inodeNum)
+	if err := checkInodeNum(inodeNum); err != nil {
+		return new(Inode), err
+	}
+	if cached, ok := inodes.get(inodeNum); ok {
+		return cached, nil
+	}
+	inodeData, err := getInodeData(inodeNum)
 	var inode *Inode = new(Inode)
+	if err == nil && fileKeys != nil {
+		err = fileKeys.open(INODE_KEY_KIND, inodeNum, inodeData)
+	}
+	reader := bytes.NewReader(inodeData)
 	if err == nil {
 		// fmt.Println("about to try read into inode from getInode")
-		err2 := binary.Read(reader, binary.LittleEndian, inode)
+		err2 := binary.Read(reader, binary.LittleEndian, &inode.storedInode)
 		if err2 != nil {
 			// if this happens then the s3 data is malformed
 			fmt.Println("err2 during getInode is: " + err2.Error())
 			os.Exit(1)
 		}
-		return inode, err2
+		if inodeOwners {
+			inode.Uid, inode.Gid, err = getOwner(inodeNum)
+			if err != nil {
+				return inode, err
+			}
+		}
+		if inodeTimes {
+			err = inode.readTimes(inodeNum)
+			if err != nil {
+				return inode, err
+			}
+		}
+		if inodeGenerations {
+			inode.Generation, err = getGeneration(inodeNum)
+			if err != nil {
+				return inode, err
+			}
+		}
+		if metadataTxn == nil {
+			inodes.put(inodeNum, inode)
+		}
+		return inode, nil
 	} else {
 		// fmt.Println("error doing getObject in getInode")
 		return inode, err
@@ -113,12 +261,51 @@ func getInode(inodeNum uint64) (*Inode, error) {
 }
 
 /*
-Puts the inode into S3/DynamoDB.
+Puts the inode into S3/DynamoDB. If the file system keeps its metadata as items, the inode is its
+own item, and the other inodes are left alone; otherwise its inode block is read and rewritten.
 */
 func putInode(inode *Inode, inodeNum uint64) error {
+	if err := checkInodeNum(inodeNum); err != nil {
+		return err
+	}
+	buf := new(bytes.Buffer)
+	err := binary.Write(buf, binary.LittleEndian, inode.storedInode)
+	if err != nil {
+		// if this happens then something really bad happened
+		fmt.Println("error doing binary.Write in putInode: " + err.Error())
+		os.Exit(1)
+	}
+	inodeData := buf.Bytes()
+	if fileKeys != nil {
+		err = fileKeys.seal(INODE_KEY_KIND, inodeNum, inodeData)
+		if err != nil {
+			return err
+		}
+	}
+	// the cached copy is dropped first, so that it is read again if the write fails. Inodes written
+	// in a transaction are not cached, as the transaction may yet be refused.
+	inodes.invalidate(inodeNum)
+	if metadataStore != nil {
+		err = putInodeItem(inodeNum, inodeData)
+	} else {
+		err = putInodeInBlock(inodeNum, inodeData)
+	}
+	if err == nil {
+		err = inode.writeTimes(inodeNum)
+	}
+	if err == nil && inode.LinkCount != 0 && metadataTxn == nil {
+		inodes.put(inodeNum, inode)
+	}
+	return err
+}
+
+/*
+Writes the (sealed) bytes of the inode with inodeNum into the inode block holding it.
+*/
+func putInodeInBlock(inodeNum uint64, inodeData []byte) error {
 	inodeBlock, err := getInodeBlock(inodeNum)
 	if err != nil {
-		if inodeNum%(BLOCK_SIZE/INODE_SIZE) != 0 && inodeNum != 1 {
+		if !startsInodeBlock(inodeNum) {
 			fmt.Printf("error getting inode with inodeNum %d\n", inodeNum)
 			return err
 		} else {
@@ -128,14 +315,6 @@ func putInode(inode *Inode, inodeNum uint64) error {
 	}
 	start := (inodeNum % (BLOCK_SIZE / INODE_SIZE)) * INODE_SIZE
 	end := start + INODE_SIZE
-	buf := new(bytes.Buffer)
-	err = binary.Write(buf, binary.LittleEndian, *inode)
-	if err != nil {
-		// if this happens then something really bad happened
-		fmt.Println("error doing binary.Write in putInode: " + err.Error())
-		os.Exit(1)
-	}
-	inodeData := buf.Bytes()
 
 	// yuck
 	newData := append(append(inodeBlock.Data[:start], inodeData...), inodeBlock.Data[end:]...)
@@ -150,22 +329,22 @@ Writes data at offset to the buffer/data blocks associated with the inode.
 */
 func (i *Inode) writeToData(data []byte, offset uint64) {
 	sizeInt := len(data)
-	// fmt.Printf("doing writeToData for data of size: %d\n", len(data))
-	// fmt.Printf("offset of writeToData is: %d\n", offset)
 	size := uint64(sizeInt)
 
-	// if i.IsDir == 1 {
-	// 	i.updateSize(size + offset)
-	// }
-
-	// a directory's size needs to be updated manually, because it is stored
-	// in a weird format. However, the size of a file should be updated automatically
-	// by setAttr syscalls. This never happens, so we must update the size here manually. :(
-	i.updateSize(size + offset)
+	// a directory's size needs to be updated manually, because its table is always rewritten
+	// whole and may shrink. The size of a file should be updated automatically by setAttr
+	// syscalls, but this never happens, so a write that extends a file updates it here. :(
+	if i.isDir() {
+		i.updateSize(size + offset)
+	} else if size > 0 && size+offset > i.Size {
+		i.updateSize(size + offset)
+	} else {
+		i.modified()
+	}
 	if offset < INODE_BUFFER_SIZE {
 		var writeEnd uint64
-		if size-offset < INODE_BUFFER_SIZE {
-			writeEnd = size - offset
+		if offset+size < INODE_BUFFER_SIZE {
+			writeEnd = offset + size
 		} else {
 			writeEnd = INODE_BUFFER_SIZE
 		}
@@ -186,14 +365,18 @@ func (i *Inode) writeToData(data []byte, offset uint64) {
 
 /*
 Reads data from offset of the buffer/data blocks associated with the inode and returns it as
-a single byte slice.
+a single byte slice. Reads of nothing, of an empty file, and at or past the end of the data return
+no data and no error, as read(2) does.
 */
 func (i *Inode) readFromData(offset, size uint64) ([]byte, error) {
 	// fmt.Printf("size of read is: %d in readFromData\n", size)
 	// fmt.Printf("size of inode is: %d in readFromData\n", i.Size)
-	if offset >= i.Size {
-		fmt.Println("VERY BAD offset in readFromData larger than size")
-		return nil, errors.New("Offset specified to read is past the end of the file.")
+	if size == 0 || offset >= i.Size {
+		return []byte{}, nil
+	}
+	// only allocate what there is to read, however much was asked for
+	if size > i.Size-offset {
+		size = i.Size - offset
 	}
 	// fmt.Printf("doing readFromData for data of size: %d\n", size)
 	data := make([]byte, size)
@@ -210,32 +393,126 @@ func (i *Inode) readFromData(offset, size uint64) ([]byte, error) {
 		copy(data[0:readLen], i.DataBuf[offset:readEnd])
 		leftToRead = leftToRead - readLen
 		offset = 0
+	} else {
+		// make offset relative to the data blocks, as in writeToData
+		offset = offset - INODE_BUFFER_SIZE
 	}
 	if leftToRead > 0 {
 		data = i.readDataBlocks(data, offset, leftToRead)
 	}
+	// the block reads stop once the request is interrupted, leaving the rest of data unread
+	if err := requestErr(); err != nil {
+		return nil, err
+	}
 	return data, nil
 }
 
 /*
-Sends delete requests to S3/DynamoDB for all data blocks the inode uses.
+Returns the number of data blocks (not counting indirect blocks) needed to hold the inode's data
+past the inode buffer.
 */
-func (i *Inode) deleteAllData() error {
-	var numBlocksToDelete uint64
-	// fmt.Println("doing deleteAllData")
+func (i *Inode) numDataBlocks() uint64 {
 	if i.Size <= INODE_BUFFER_SIZE {
-		numBlocksToDelete = 0
-	} else {
-		numBlocksToDelete = ((i.Size - INODE_BUFFER_SIZE) / BLOCK_SIZE) + 1
+		return 0
 	}
-	// fmt.Printf("numBlocksToDelete is: %d\n", numBlocksToDelete)
-	var err error
+	return (i.Size - INODE_BUFFER_SIZE + BLOCK_SIZE - 1) / BLOCK_SIZE
+}
+
+/*
+Calls fn with the number of every data block and indirect block the inode uses, in file order,
+with each indirect block before the blocks it points to. Holes, where no block was ever written,
+are passed over. Stops and returns the error if fn returns one, or if an indirect block cannot be
+read.
+*/
+func (i *Inode) forEachBlock(fn func(blockNum uint64, indirect bool) error) error {
+	return i.walkBlocks(false, fn)
+}
+
+/*
+Like forEachBlock, but if holes is set, fn is also called with 0 for each data block in a hole, so
+that it sees every data block of the file in order.
+*/
+func (i *Inode) walkBlocks(holes bool, fn func(blockNum uint64, indirect bool) error) error {
+	numBlocks := i.numDataBlocks()
 	var j uint64
-	for j = 0; j < NUM_DATA_BLOCKS && numBlocksToDelete > 0; j++ {
-		err = deleteBlock(i.Data[j])
+	for j = 0; j < NUM_DATA_BLOCKS && numBlocks > 0; j++ {
+		if i.Data[j] != 0 || holes {
+			err := fn(i.Data[j], false)
+			if err != nil {
+				return err
+			}
+		}
+		numBlocks--
+	}
+	for depth, indBlockNum := range []uint64{i.Data[IND_BLOCK], i.Data[DOUB_IND_BLOCK], i.Data[TRIP_IND_BLOCK]} {
+		if numBlocks == 0 {
+			break
+		}
+		err := forEachIndirect(indBlockNum, depth+1, &numBlocks, holes, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Helper for walkBlocks that visits an indirect block with the given depth (1 for singly indirect)
+and the blocks below it, until numBlocks data blocks have been visited.
+*/
+func forEachIndirect(indBlockNum uint64, depth int, numBlocks *uint64, holes bool, fn func(uint64, bool) error) error {
+	if indBlockNum == 0 {
+		n := minUint64(indirectSpan(depth), *numBlocks)
+		*numBlocks -= n
+		for ; holes && n > 0; n-- {
+			err := fn(0, false)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := fn(indBlockNum, true)
+	if err != nil {
+		return err
+	}
+	indBlock, err := getData(indBlockNum)
+	if err != nil {
+		return err
+	}
+	var j uint64
+	for j = 0; j < BLOCK_SIZE && *numBlocks > 0; j = j + 8 {
+		blockNum := binary.LittleEndian.Uint64(indBlock.Data[j : j+8])
+		if depth == 1 {
+			if blockNum != 0 || holes {
+				err = fn(blockNum, false)
+			}
+			*numBlocks--
+		} else {
+			err = forEachIndirect(blockNum, depth-1, numBlocks, holes, fn)
+		}
 		if err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+/*
+Sends delete requests to S3/DynamoDB for all data blocks the inode uses.
+*/
+func (i *Inode) deleteAllData() error {
+	numBlocksToDelete := i.numDataBlocks()
+	var err error
+	var j uint64
+	i.usedBlocksKnown = false
+	for j = 0; j < NUM_DATA_BLOCKS && numBlocksToDelete > 0; j++ {
+		if i.Data[j] != 0 {
+			err = deleteBlock(i.Data[j])
+			if err != nil {
+				return err
+			}
+		}
 		numBlocksToDelete--
 	}
 	if numBlocksToDelete > 0 {
@@ -269,6 +546,9 @@ on blocks other than the one immediately allocated in the inode, such as those
 used in the doubly/triply indirect blocks.
 */
 func (i *Inode) deleteIndirect(numBlocks, indBlockNum uint64) (uint64, error) {
+	if indBlockNum == 0 {
+		return numBlocks - minUint64(indirectSpan(1), numBlocks), nil
+	}
 	indBlock, err := getData(indBlockNum)
 	if err != nil {
 		fmt.Println("VERY BAD ERROR: from getData in deleteIndirect: " + err.Error())
@@ -278,9 +558,11 @@ func (i *Inode) deleteIndirect(numBlocks, indBlockNum uint64) (uint64, error) {
 		blockAddress := make([]byte, 8)
 		copy(blockAddress[0:8], indBlock.Data[j:j+8])
 		blockNum := binary.LittleEndian.Uint64(blockAddress)
-		err = deleteBlock(blockNum)
-		if err != nil {
-			return 0, err
+		if blockNum != 0 {
+			err = deleteBlock(blockNum)
+			if err != nil {
+				return 0, err
+			}
 		}
 		numBlocks--
 	}
@@ -295,6 +577,9 @@ func (i *Inode) deleteIndirect(numBlocks, indBlockNum uint64) (uint64, error) {
 Deletes all blocks associated with the specified doubly indirect block.
 */
 func (i *Inode) deleteDoubIndirect(numBlocks, indBlockNum uint64) (uint64, error) {
+	if indBlockNum == 0 {
+		return numBlocks - minUint64(indirectSpan(2), numBlocks), nil
+	}
 	indBlock, err := getData(indBlockNum)
 	if err != nil {
 		fmt.Println("VERY BAD ERROR: from getData in deleteDoubIndirect: " + err.Error())
@@ -320,6 +605,9 @@ func (i *Inode) deleteDoubIndirect(numBlocks, indBlockNum uint64) (uint64, error
 Deletes all blocks associated with the specified triply indirect block.
 */
 func (i *Inode) deleteTripIndirect(numBlocks, indBlockNum uint64) (uint64, error) {
+	if indBlockNum == 0 {
+		return numBlocks - minUint64(indirectSpan(3), numBlocks), nil
+	}
 	indBlock, err := getData(indBlockNum)
 	if err != nil {
 		fmt.Println("VERY BAD ERROR: from getData in deleteTripIndirect: " + err.Error())
@@ -343,7 +631,8 @@ func (i *Inode) deleteTripIndirect(numBlocks, indBlockNum uint64) (uint64, error
 
 /*
 Read from the data blocks of the inode, appending to the end of data. Offset is relative to
-the previous read, and does not invlude the inode buffer at all.
+the previous read, and does not invlude the inode buffer at all. If the request is interrupted,
+the blocks not yet read are left unread, as though nothing were left to read (see requestDone).
 */
 func (i *Inode) readDataBlocks(data []byte, offset, leftToRead uint64) []byte {
 	var j uint64
@@ -356,23 +645,23 @@ func (i *Inode) readDataBlocks(data []byte, offset, leftToRead uint64) []byte {
 			offset = offset - BLOCK_SIZE
 		}
 	}
-	if leftToRead > 0 && offset < FIRST_DOUBLY_INDIRECT_BYTE {
+	if leftToRead > 0 && offset < IND_BLOCK_SIZE {
 		data, leftToRead = i.readIndirect(data, offset, leftToRead, i.Data[IND_BLOCK])
 		offset = 0
 	} else {
-		offset = offset - (BLOCK_SIZE * BLOCK_SIZE)
+		offset = offset - IND_BLOCK_SIZE
 	}
-	if leftToRead > 0 && offset < FIRST_TRIPLY_INDIRECT_BYTE {
+	if leftToRead > 0 && offset < DOUB_IND_BLOCK_SIZE {
 		data, leftToRead = i.readDoubIndirect(data, offset, leftToRead, i.Data[DOUB_IND_BLOCK])
 		offset = 0
 	} else {
-		offset = offset - (BLOCK_SIZE * BLOCK_SIZE * BLOCK_SIZE)
+		offset = offset - DOUB_IND_BLOCK_SIZE
 	}
 	if leftToRead > 0 {
 		data, leftToRead = i.readTripIndirect(data, offset, leftToRead, i.Data[TRIP_IND_BLOCK])
 	}
-	if leftToRead > 0 {
-		// this should never happen (bytes have to be written past ~4500 TB)
+	if leftToRead > 0 && !requestDone() {
+		// this should never happen (bytes have to be written past ~2 PiB)
 		fmt.Println("READ TOO BIG")
 	}
 	return data
@@ -380,17 +669,17 @@ func (i *Inode) readDataBlocks(data []byte, offset, leftToRead uint64) []byte {
 
 /*
 Read a single data block with number blockNum from relative offset. Returns the data appended with the new
-data, and the number of bytes remanining to read. Relative offset is adjusted by the caller.
+data, and the number of bytes remanining to read. Relative offset is adjusted by the caller. A hole
+(blockNum 0) reads as the zeros data already holds, without reading anything.
 */
 func (i *Inode) readBlock(data []byte, offset, leftToRead, blockNum uint64) ([]byte, uint64) {
 	// fmt.Printf("inode size is: %d in readBlock\n", i.Size)
-	block, err := getData(blockNum)
-	if err != nil {
-		// so... this is bad and shouldn't ever happen. but actually it happens a lot.
-		// it seems like it doesn't break anything, so just don't print the error message.
-		// ¯\_(ツ)_/¯
-
-		// fmt.Println("VERY BAD ERROR: from getData in readBlock: " + err.Error())
+	if blockNum == 0 {
+		return data, skipHole(offset, leftToRead, BLOCK_SIZE)
+	}
+	if requestDone() {
+		// the request was interrupted, so the read stops here, see readDataBlocks
+		return data, 0
 	}
 	var readEnd uint64
 	if leftToRead+offset > BLOCK_SIZE {
@@ -400,6 +689,18 @@ func (i *Inode) readBlock(data []byte, offset, leftToRead, blockNum uint64) ([]b
 	}
 	readLen := readEnd - offset
 	dataStart := uint64(len(data)) - leftToRead
+	if part, ok := i.getBlockRange(blockNum, offset, readLen); ok {
+		copy(data[dataStart:dataStart+readLen], part)
+		return data, leftToRead - readLen
+	}
+	block, err := i.getBlockData(blockNum)
+	if err != nil {
+		// so... this is bad and shouldn't ever happen. but actually it happens a lot.
+		// it seems like it doesn't break anything, so just don't print the error message.
+		// ¯\_(ツ)_/¯
+
+		// fmt.Println("VERY BAD ERROR: from getData in readBlock: " + err.Error())
+	}
 	// fmt.Printf("about to read from block, readLen is %d, offset is %d, readEnd is %d\n", readLen, offset, readEnd)
 	copy(data[dataStart:dataStart+readLen], block.Data[offset:readEnd])
 	leftToRead = leftToRead - readLen
@@ -411,6 +712,12 @@ Reads data associated with a singly indirect block from a relative offset, appen
 it to data.
 */
 func (i *Inode) readIndirect(data []byte, offset, leftToRead, indBlockNum uint64) ([]byte, uint64) {
+	if indBlockNum == 0 {
+		return data, skipHole(offset, leftToRead, IND_BLOCK_SIZE)
+	}
+	if requestDone() {
+		return data, 0
+	}
 	indBlock, err := getData(indBlockNum)
 	if err != nil {
 		fmt.Println("VERY BAD ERROR: from getData in readIndirect: " + err.Error())
@@ -438,6 +745,12 @@ it to data.
 */
 func (i *Inode) readDoubIndirect(data []byte, offset, leftToRead, indBlockNum uint64) ([]byte, uint64) {
 	// fmt.Println("\nDOING READ DOUBLE INDIRECT\n")
+	if indBlockNum == 0 {
+		return data, skipHole(offset, leftToRead, DOUB_IND_BLOCK_SIZE)
+	}
+	if requestDone() {
+		return data, 0
+	}
 	indBlock, err := getData(indBlockNum)
 	if err != nil {
 		fmt.Println("VERY BAD ERROR: from getData in readDoubIndirect: " + err.Error())
@@ -464,6 +777,12 @@ Reads data associated with a triply indirect block from a relative offset, appen
 it to data.
 */
 func (i *Inode) readTripIndirect(data []byte, offset, leftToRead, indBlockNum uint64) ([]byte, uint64) {
+	if indBlockNum == 0 {
+		return data, skipHole(offset, leftToRead, BLOCK_POINTERS*DOUB_IND_BLOCK_SIZE)
+	}
+	if requestDone() {
+		return data, 0
+	}
 	indBlock, err := getData(indBlockNum)
 	if err != nil {
 		fmt.Println("VERY BAD ERROR: from getData in readTripIndirect: " + err.Error())
@@ -502,17 +821,17 @@ func (i *Inode) writeDataBlocks(data []byte, offset uint64) {
 			offset = offset - BLOCK_SIZE
 		}
 	}
-	if len(data) > 0 && offset < FIRST_DOUBLY_INDIRECT_BYTE {
+	if len(data) > 0 && offset < IND_BLOCK_SIZE {
 		i.Data[IND_BLOCK], data = i.writeIndirect(data, offset, i.Data[IND_BLOCK])
 		offset = 0
 	} else {
-		offset = offset - (BLOCK_SIZE * BLOCK_SIZE)
+		offset = offset - IND_BLOCK_SIZE
 	}
-	if len(data) > 0 && offset < FIRST_TRIPLY_INDIRECT_BYTE {
+	if len(data) > 0 && offset < DOUB_IND_BLOCK_SIZE {
 		i.Data[DOUB_IND_BLOCK], data = i.writeDoubIndirect(data, offset, i.Data[DOUB_IND_BLOCK])
 		offset = 0
 	} else {
-		offset = offset - (BLOCK_SIZE * BLOCK_SIZE * BLOCK_SIZE)
+		offset = offset - DOUB_IND_BLOCK_SIZE
 	}
 	if len(data) > 0 {
 		i.Data[TRIP_IND_BLOCK], data = i.writeTripIndirect(data, offset, i.Data[TRIP_IND_BLOCK])
@@ -527,16 +846,21 @@ func (i *Inode) writeDataBlocks(data []byte, offset uint64) {
 Writes as much of data as possible to the block at blockNum, with relative offset (within this block).
 Creates a new data block in S3/DynamoDB if one does not yet exist. Returns the number of the relevant block,
 which will be the same unless the block was previously uninitialized, and the original data
-with the written portion removed.
+with the written portion removed. With SKIP_ZERO_BLOCKS, a block left all zeros is not stored, or is
+freed if it was, and 0 (a hole) is returned.
 */
 func (i *Inode) writeBlock(data []byte, offset, blockNum uint64) (uint64, []byte) {
-	oldData, err := getData(blockNum)
+	var oldData *DataBlock
+	var err error
+	if blockNum != 0 {
+		oldData, err = i.getBlockData(blockNum)
+	}
 	if err != nil {
+		// the block cannot be read, so a new one takes its place
+		blockNum = 0
+	}
+	if blockNum == 0 {
 		oldData = new(DataBlock)
-		blockNum = dataStream.next()
-		// fmt.Printf("made new block with num: %d\n", blockNum)
-	} else {
-		// fmt.Printf("writing to existing block with blockNum: %d\n", blockNum)
 	}
 	sizeInt := len(data)
 	size := uint64(sizeInt)
@@ -548,8 +872,19 @@ func (i *Inode) writeBlock(data []byte, offset, blockNum uint64) (uint64, []byte
 	}
 	writeLen := writeEnd - offset
 	copy(oldData.Data[offset:writeEnd], data[0:writeLen])
+	if SKIP_ZERO_BLOCKS && isZero(data[0:writeLen]) && isZero(oldData.Data[:]) {
+		return i.skipZeroBlock(blockNum), data[writeLen:]
+	}
+	if blockNum == 0 {
+		blockNum = dataStream.next()
+		i.allocated()
+		debugBlock("allocated data block=%d", blockNum)
+	}
 	// hopefully this will never error
-	err = putData(blockNum, oldData)
+	err = i.putBlockData(blockNum, oldData)
+	if err == nil {
+		err = setBlockHash(blockNum, oldData)
+	}
 	if err != nil {
 		fmt.Printf("error in writeBlock with blockNum %d: "+err.Error()+"\n", blockNum)
 	}
@@ -561,13 +896,14 @@ Writes to a singly indirect block, initializing the block if necessary and retur
 Offset is relative, and data is removed from the beginning as it is written.
 */
 func (i *Inode) writeIndirect(data []byte, offset, indBlockNum uint64) (uint64, []byte) {
-	indBlock, err := getData(indBlockNum)
-	if err != nil {
+	var indBlock *DataBlock
+	var err error
+	if indBlockNum != 0 {
+		indBlock, err = getData(indBlockNum)
+	}
+	if indBlockNum == 0 || err != nil {
 		indBlock = new(DataBlock)
-		indBlockNum = dataStream.next()
-		// fmt.Printf("made new indBlock with num: %d\n", indBlockNum)
-	} else {
-		// fmt.Printf("writing to existing indBlock with num: %d\n", indBlockNum)
+		indBlockNum = 0
 	}
 	var j uint64
 	for j = 0; j < BLOCK_SIZE; j = j + 8 {
@@ -584,11 +920,7 @@ func (i *Inode) writeIndirect(data []byte, offset, indBlockNum uint64) (uint64,
 			offset = offset - BLOCK_SIZE
 		}
 	}
-	err = putData(indBlockNum, indBlock)
-	if err != nil {
-		fmt.Println("error doing putData for indirect block: " + err.Error())
-	}
-	return indBlockNum, data
+	return i.putIndirect(indBlock, indBlockNum, "indirect"), data
 }
 
 /*
@@ -597,11 +929,14 @@ Offset is relative, and data is removed from the beginning as it is written.
 */
 func (i *Inode) writeDoubIndirect(data []byte, offset, doubBlockNum uint64) (uint64, []byte) {
 	// fmt.Println("\nDOING WRITE DOUBLE INDIRECT\n")
-	doubBlock, err := getData(doubBlockNum)
-	if err != nil {
+	var doubBlock *DataBlock
+	var err error
+	if doubBlockNum != 0 {
+		doubBlock, err = getData(doubBlockNum)
+	}
+	if doubBlockNum == 0 || err != nil {
 		doubBlock = new(DataBlock)
-		doubBlockNum = dataStream.next()
-		// fmt.Printf("made new doubBlock with num: %d\n", doubBlockNum)
+		doubBlockNum = 0
 	}
 	var j uint64
 	for j = 0; j < BLOCK_SIZE; j = j + 8 {
@@ -618,11 +953,7 @@ func (i *Inode) writeDoubIndirect(data []byte, offset, doubBlockNum uint64) (uin
 			offset = offset - IND_BLOCK_SIZE
 		}
 	}
-	err = putData(doubBlockNum, doubBlock)
-	if err != nil {
-		fmt.Println("error doing putData for indirect block: " + err.Error())
-	}
-	return doubBlockNum, data
+	return i.putIndirect(doubBlock, doubBlockNum, "doubly indirect"), data
 }
 
 /*
@@ -630,13 +961,17 @@ Writes to a triply indirect block, initializing the block if necessary and retur
 Offset is relative, and data is removed from the beginning as it is written.
 */
 func (i *Inode) writeTripIndirect(data []byte, offset, tripBlockNum uint64) (uint64, []byte) {
-	tripBlock, err := getData(tripBlockNum)
-	if err != nil {
+	var tripBlock *DataBlock
+	var err error
+	if tripBlockNum != 0 {
+		tripBlock, err = getData(tripBlockNum)
+	}
+	if tripBlockNum == 0 || err != nil {
 		tripBlock = new(DataBlock)
-		tripBlockNum = dataStream.next()
+		tripBlockNum = 0
 	}
 	var j uint64
-	for j = 0; j < DOUB_IND_BLOCK_SIZE; j = j + 8 {
+	for j = 0; j < BLOCK_SIZE; j = j + 8 {
 		if offset < DOUB_IND_BLOCK_SIZE && len(data) > 0 {
 			doubBlockAddress := make([]byte, 8)
 			copy(doubBlockAddress[0:8], tripBlock.Data[j:j+8])
@@ -650,9 +985,5 @@ func (i *Inode) writeTripIndirect(data []byte, offset, tripBlockNum uint64) (uin
 			offset = offset - DOUB_IND_BLOCK_SIZE
 		}
 	}
-	err = putData(tripBlockNum, tripBlock)
-	if err != nil {
-		fmt.Println("error doing putData for indirect block: " + err.Error())
-	}
-	return tripBlockNum, data
+	return i.putIndirect(tripBlock, tripBlockNum, "triply indirect"), data
 }
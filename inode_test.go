@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// bounds for the fuzzed writes, chosen to cross the inode buffer, the direct blocks,
+// and the start of the singly indirect block while staying fast
+const fuzzMaxOffset = FIRST_SINGLY_INDIRECT_BYTE + 2*BLOCK_SIZE
+const fuzzMaxLength = 3 * BLOCK_SIZE
+
+/*
+Decodes fuzz input into a sequence of (offset, length) pairs, 6 bytes per pair.
+*/
+func fuzzOps(ops []byte) [][2]uint64 {
+	var res [][2]uint64
+	for len(ops) >= 6 {
+		var buf [8]byte
+		copy(buf[:], ops[0:3])
+		offset := binary.LittleEndian.Uint64(buf[:]) % fuzzMaxOffset
+		copy(buf[:], ops[3:6])
+		length := binary.LittleEndian.Uint64(buf[:]) % fuzzMaxLength
+		res = append(res, [2]uint64{offset, length})
+		ops = ops[6:]
+	}
+	return res
+}
+
+/*
+Encodes (offset, length) pairs in the format read by fuzzOps, for the seed corpus.
+*/
+func fuzzSeed(pairs ...uint64) []byte {
+	var res []byte
+	for _, value := range pairs {
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], value)
+		res = append(res, buf[0:3]...)
+	}
+	return res
+}
+
+/*
+Applies a sequence of writes at random offsets and lengths to an inode and to an in-memory model
+of the file, checking after each write that the size and contents of the two agree, including
+for reads starting at every write boundary.
+*/
+func FuzzInodeReadWrite(f *testing.F) {
+	f.Add(fuzzSeed(0, 239))
+	f.Add(fuzzSeed(100, 50))
+	f.Add(fuzzSeed(0, 1000, 10, 20))
+	f.Add(fuzzSeed(INODE_BUFFER_SIZE-1, 2, 0, 1))
+	f.Add(fuzzSeed(BLOCK_SIZE+INODE_BUFFER_SIZE-10, 20))
+	f.Add(fuzzSeed(5000, 10, 0, BLOCK_SIZE*2))
+	f.Add(fuzzSeed(FIRST_SINGLY_INDIRECT_BYTE-100, 200, 0, 10))
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		newTestFs(t, 8)
+		inode := createInode(0)
+		inode.init(ROOT_INODE, 2)
+		var model []byte
+		for n, op := range fuzzOps(ops) {
+			offset, length := op[0], op[1]
+			data := testData(int(length), int64(n))
+			inode.writeToData(data, offset)
+			if length > 0 {
+				if end := offset + length; end > uint64(len(model)) {
+					model = append(model, make([]byte, end-uint64(len(model)))...)
+				}
+				copy(model[offset:], data)
+			}
+
+			if inode.Size != uint64(len(model)) {
+				t.Fatalf("after write %d (offset %d, length %d): Size = %d, want %d", n, offset, length, inode.Size, len(model))
+			}
+			if inode.Size == 0 {
+				continue
+			}
+			for _, start := range []uint64{0, offset, offset + length} {
+				if start >= inode.Size {
+					continue
+				}
+				readData, err := inode.readFromData(start, inode.Size-start)
+				if err != nil {
+					t.Fatalf("after write %d: readFromData(%d): %v", n, start, err)
+				}
+				if !bytes.Equal(readData, model[start:]) {
+					t.Fatalf("after write %d (offset %d, length %d): data read from %d differs from model", n, offset, length, start)
+				}
+			}
+		}
+	})
+}
+
+/*
+Writes a few blocks across each boundary between the ranges of the block pointers of an inode, up to
+the triply indirect block, in pieces smaller than a block, as FUSE writes them. Checks that the data
+reads back, that the holes before it read as zeros, and that dataBlockNum finds the blocks the data
+was written to. The files are sparse, so the test stays fast however far into the file the data is.
+*/
+func TestIndirectBoundaries(t *testing.T) {
+	boundaries := map[string]uint64{
+		"singly indirect":          FIRST_SINGLY_INDIRECT_BYTE,
+		"doubly indirect":          FIRST_DOUBLY_INDIRECT_BYTE,
+		"second singly of doubly":  FIRST_DOUBLY_INDIRECT_BYTE + IND_BLOCK_SIZE,
+		"triply indirect":          FIRST_TRIPLY_INDIRECT_BYTE,
+		"second singly of triply":  FIRST_TRIPLY_INDIRECT_BYTE + IND_BLOCK_SIZE,
+		"second doubly of triply":  FIRST_TRIPLY_INDIRECT_BYTE + DOUB_IND_BLOCK_SIZE,
+		"last block of the triply": FIRST_TRIPLY_INDIRECT_BYTE + BLOCK_POINTERS*DOUB_IND_BLOCK_SIZE - BLOCK_SIZE,
+	}
+	for name, boundary := range boundaries {
+		newTestFs(t, 16)
+		inode := createInode(0)
+		inode.init(ROOT_INODE, 2)
+		start := boundary - BLOCK_SIZE - 100
+		data := testData(int(3*BLOCK_SIZE), int64(boundary))
+		if name == "last block of the triply" {
+			data = data[:BLOCK_SIZE+100+BLOCK_SIZE]
+		}
+		for n := 0; n < len(data); n += 5000 {
+			end := n + 5000
+			if end > len(data) {
+				end = len(data)
+			}
+			inode.writeToData(data[n:end], start+uint64(n))
+		}
+		if inode.Size != start+uint64(len(data)) {
+			t.Fatalf("%s: Size = %d, want %d", name, inode.Size, start+uint64(len(data)))
+		}
+		got, err := inode.readFromData(start, uint64(len(data)))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: the data read back differs, err %v", name, err)
+		}
+		got, err = inode.readFromData(start-2*BLOCK_SIZE, 2*BLOCK_SIZE)
+		if err != nil || !bytes.Equal(got, make([]byte, 2*BLOCK_SIZE)) {
+			t.Fatalf("%s: the hole before the data is not zeros, err %v", name, err)
+		}
+		// the block holding the byte at the boundary, counting from the first block past the buffer
+		index := (boundary - FIRST_DATA_BLOCK_BYTE) / BLOCK_SIZE
+		blockNum, err := inode.dataBlockNum(index)
+		if err != nil {
+			t.Fatalf("%s: dataBlockNum: %v", name, err)
+		}
+		block, err := getData(blockNum)
+		if err != nil || !bytes.Equal(block.Data[:100], data[BLOCK_SIZE+100:BLOCK_SIZE+200]) {
+			t.Fatalf("%s: block %d found by dataBlockNum does not hold the data at the boundary, err %v", name, blockNum, err)
+		}
+	}
+}
+
+/*
+Checks that the hand-computed layout constants match the encoded size of the stored part of the
+Inode struct.
+*/
+func TestInodeLayout(t *testing.T) {
+	if size := binary.Size(storedInode{}); size != int(INODE_SIZE) {
+		t.Errorf("binary.Size(storedInode{}) = %d, want INODE_SIZE = %d", size, INODE_SIZE)
+	}
+	if size := binary.Size(storedInode{}) - int(INODE_BUFFER_SIZE); size != INODE_WITHOUT_BUFFER_SIZE {
+		t.Errorf("encoded size of storedInode without its buffer = %d, want INODE_WITHOUT_BUFFER_SIZE = %d", size, INODE_WITHOUT_BUFFER_SIZE)
+	}
+	if BLOCK_SIZE%INODE_SIZE != 0 {
+		t.Errorf("BLOCK_SIZE %d is not a multiple of INODE_SIZE %d", BLOCK_SIZE, INODE_SIZE)
+	}
+}
+
+/*
+Checks that arbitrary inodes survive being packed into inode blocks, and that storing an inode
+does not disturb the other inodes in its block.
+*/
+func TestInodeRoundTrip(t *testing.T) {
+	newTestFs(t, 8)
+	// the owners and times are kept apart from the inodes, and only written when they are created or
+	// changed
+	inodeOwners = false
+	inodeTimes = false
+	inodesPerBlock := BLOCK_SIZE / INODE_SIZE
+	roundTrip := func(stored storedInode, neighborStored storedInode, blockNum uint8, slot uint8) bool {
+		inode, neighbor := Inode{storedInode: stored}, Inode{storedInode: neighborStored}
+		// inode numbers that are not the first in their block can only be put once the block exists
+		first := uint64(blockNum) * inodesPerBlock
+		inodeNum := first + uint64(slot)%inodesPerBlock
+		neighborNum := first + (uint64(slot)+1)%inodesPerBlock
+		if first == 0 {
+			first = ROOT_INODE
+		}
+		if inodeNum == 0 || neighborNum == 0 {
+			return true
+		}
+		if putInode(createInode(0), first) != nil {
+			return false
+		}
+		if putInode(&neighbor, neighborNum) != nil || putInode(&inode, inodeNum) != nil {
+			return false
+		}
+		got, err := getInode(inodeNum)
+		if err != nil || !reflect.DeepEqual(*got, inode) {
+			return false
+		}
+		gotNeighbor, err := getInode(neighborNum)
+		return err == nil && reflect.DeepEqual(*gotNeighbor, neighbor)
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 50}); err != nil {
+		t.Error(err)
+	}
+}
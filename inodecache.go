@@ -0,0 +1,126 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// the most inodes kept decoded in memory, so that stat-heavy workloads (git status, IDE indexing)
+// do not read the block or item of each inode again, or 0 to not keep any
+const DEFAULT_INODE_CACHE_SIZE int = 4096
+
+var INODE_CACHE_SIZE int = DEFAULT_INODE_CACHE_SIZE
+
+// the longest an inode is kept in memory before it is read again. Inodes written by this mount are
+// updated in memory as they are written, so this only bounds how stale changes made by other mounts
+// of a file system keeping its metadata as items can be.
+const DEFAULT_INODE_CACHE_TTL time.Duration = 5 * time.Second
+
+var INODE_CACHE_TTL time.Duration = DEFAULT_INODE_CACHE_TTL
+
+/*
+Struct holding the most recently used inodes, decoded, up to a capacity, each for at most a ttl.
+*/
+type inodeCache struct {
+	lock     sync.Mutex
+	capacity int
+	ttl      time.Duration
+	lru      *list.List               // of *inodeCacheEntry, with the least recently used at the front
+	entries  map[uint64]*list.Element // maps inode numbers to their elements of lru
+	hits     uint64
+	misses   uint64
+}
+
+/*
+Struct representing an inode in an inodeCache.
+*/
+type inodeCacheEntry struct {
+	inodeNum uint64
+	inode    Inode
+	loaded   time.Time
+}
+
+// the inodes of the mounted file system, replaced by makeFs
+var inodes = newInodeCache(0, 0)
+
+/*
+Returns a pointer to a new, empty inodeCache holding up to capacity inodes for up to ttl.
+*/
+func newInodeCache(capacity int, ttl time.Duration) *inodeCache {
+	return &inodeCache{
+		capacity: capacity,
+		ttl:      ttl,
+		lru:      new(list.List),
+		entries:  make(map[uint64]*list.Element),
+	}
+}
+
+/*
+Returns a copy of the inode with inodeNum, and whether it was in the cache and fresh.
+*/
+func (c *inodeCache) get(inodeNum uint64) (*Inode, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elt := c.entries[inodeNum]
+	if elt == nil {
+		c.misses++
+		return nil, false
+	}
+	entry := elt.Value.(*inodeCacheEntry)
+	if time.Since(entry.loaded) > c.ttl {
+		c.lru.Remove(elt)
+		delete(c.entries, inodeNum)
+		c.misses++
+		return nil, false
+	}
+	c.lru.MoveToBack(elt)
+	c.hits++
+	inode := entry.inode
+	return &inode, true
+}
+
+/*
+Keeps a copy of inode as the inode with inodeNum, evicting the least recently used inode if the cache
+is full.
+*/
+func (c *inodeCache) put(inodeNum uint64, inode *Inode) {
+	if c.capacity <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elt := c.entries[inodeNum]; elt != nil {
+		entry := elt.Value.(*inodeCacheEntry)
+		entry.inode = *inode
+		entry.loaded = time.Now()
+		c.lru.MoveToBack(elt)
+		return
+	}
+	if c.lru.Len() >= c.capacity {
+		oldest := c.lru.Remove(c.lru.Front()).(*inodeCacheEntry)
+		delete(c.entries, oldest.inodeNum)
+	}
+	c.entries[inodeNum] = c.lru.PushBack(&inodeCacheEntry{inodeNum: inodeNum, inode: *inode, loaded: time.Now()})
+}
+
+/*
+Drops the inode with inodeNum from the cache, so that it is read again.
+*/
+func (c *inodeCache) invalidate(inodeNum uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elt := c.entries[inodeNum]; elt != nil {
+		c.lru.Remove(elt)
+		delete(c.entries, inodeNum)
+	}
+}
+
+/*
+Returns the number of lookups of the cache that found a fresh inode, and that did not.
+*/
+func (c *inodeCache) counts() (uint64, uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hits, c.misses
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+/*
+Checks that repeated lookups of a file find its inode in memory, that writes to it are seen at once,
+and that a cached inode is read again once it is older than INODE_CACHE_TTL.
+*/
+func TestInodeCache(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	file := writeTestFile(t, root, "file", testData(100, 1), 100)
+
+	hits, misses := inodes.counts()
+	for i := 0; i < 3; i++ {
+		if _, err := lookupNode(filesys, "/file"); err != nil {
+			t.Fatalf("lookupNode: %v", err)
+		}
+	}
+	if newHits, newMisses := inodes.counts(); newHits < hits+3 || newMisses != misses {
+		t.Fatalf("three lookups had %d hits and %d misses", newHits-hits, newMisses-misses)
+	}
+
+	file.inode.Size = 50
+	if err := putInode(file.inode, file.inodeNum); err != nil {
+		t.Fatalf("putInode: %v", err)
+	}
+	if inode, _ := getInode(file.inodeNum); inode.Size != 50 {
+		t.Fatalf("the cached inode has size %d after writing size 50", inode.Size)
+	}
+	inode, _ := getInode(file.inodeNum)
+	inode.Size = 10
+	if inode, _ := getInode(file.inodeNum); inode.Size != 50 {
+		t.Fatalf("changing a returned inode changed the cached one")
+	}
+
+	// the inode changed behind the cache, as by another mount
+	ttlCache := newInodeCache(16, 10*time.Millisecond)
+	inodes = ttlCache
+	getInode(file.inodeNum)
+	inodes = newInodeCache(0, 0)
+	file.inode.Size = 20
+	putInode(file.inode, file.inodeNum)
+	inodes = ttlCache
+	if inode, _ := getInode(file.inodeNum); inode.Size != 50 {
+		t.Fatalf("the inode was read again before its ttl")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if inode, _ := getInode(file.inodeNum); inode.Size != 20 {
+		t.Fatalf("the inode was not read again after its ttl")
+	}
+}
+
+/*
+Checks that the least recently used inode is dropped from a full cache, and that a cache with no
+capacity keeps nothing.
+*/
+func TestInodeCacheEviction(t *testing.T) {
+	c := newInodeCache(2, time.Minute)
+	for inodeNum := uint64(1); inodeNum <= 2; inodeNum++ {
+		inode := new(Inode)
+		inode.Size = inodeNum
+		c.put(inodeNum, inode)
+	}
+	c.get(1)
+	inode := new(Inode)
+	inode.Size = 3
+	c.put(3, inode)
+	if _, ok := c.get(2); ok {
+		t.Fatalf("the least recently used inode was kept")
+	}
+	for _, inodeNum := range []uint64{1, 3} {
+		if inode, ok := c.get(inodeNum); !ok || inode.Size != inodeNum {
+			t.Fatalf("inode %d was not kept", inodeNum)
+		}
+	}
+	c.invalidate(1)
+	if _, ok := c.get(1); ok {
+		t.Fatalf("an invalidated inode was kept")
+	}
+	disabled := newInodeCache(-1, time.Minute)
+	disabled.put(1, &Inode{})
+	if _, ok := disabled.get(1); ok {
+		t.Fatalf("a cache with no capacity kept an inode")
+	}
+}
+
+/*
+Checks that a file removed by this mount is not found in the inode cache.
+*/
+func TestInodeCacheRemove(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	file := writeTestFile(t, root, "file", testData(100, 1), 100)
+	if err := root.Remove(context.Background(), &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, ok := inodes.get(file.inodeNum); ok {
+		t.Fatalf("the removed inode is still cached")
+	}
+}
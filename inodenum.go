@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+)
+
+// inode numbers with a meaning of their own. INVALID_INODE marks a missing entry in an InodeTable,
+// so it is never the number of an inode, and ROOT_INODE is the root directory.
+const INVALID_INODE uint64 = 0
+const ROOT_INODE uint64 = 1
+
+// inode numbers from ROOT_INODE+1 to LAST_RESERVED_INODE are reserved for metadata files (like a
+// journal or quotas), and never given to files or directories. File systems created before they
+// were reserved may already use them, see SuperblockInfo.FirstUserInode.
+const LAST_RESERVED_INODE uint64 = 15
+const FIRST_USER_INODE uint64 = LAST_RESERVED_INODE + 1
+
+/*
+Returns an error if inodeNum can never be the number of an inode.
+*/
+func checkInodeNum(inodeNum uint64) error {
+	if inodeNum == INVALID_INODE {
+		return fmt.Errorf("inode number %d is not valid", inodeNum)
+	}
+	return nil
+}
+
+/*
+Returns whether inodeNum is reserved for a metadata file.
+*/
+func isReservedInode(inodeNum uint64) bool {
+	return inodeNum > ROOT_INODE && inodeNum <= LAST_RESERVED_INODE
+}
+
+/*
+Returns whether inodeNum is the first inode to be written to its inode block, which must then be
+created. Numbers are given out in order, and INVALID_INODE is never written, so this is the first
+number in the block, or the root for the first block.
+*/
+func startsInodeBlock(inodeNum uint64) bool {
+	return inodeNum%(BLOCK_SIZE/INODE_SIZE) == 0 || inodeNum == ROOT_INODE
+}
+
+/*
+Returns the number for a new file or directory from stream, skipping INVALID_INODE, the root, and
+the reserved numbers, which file systems created before they were reserved may have freed.
+*/
+func nextInodeNum(stream *IntStream) uint64 {
+	if stream.lastInt < LAST_RESERVED_INODE {
+		stream.lastInt = LAST_RESERVED_INODE
+	}
+	inodeNum := stream.next()
+	for inodeNum <= LAST_RESERVED_INODE {
+		inodeNum = stream.next()
+	}
+	return inodeNum
+}
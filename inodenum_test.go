@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that new files get numbers past the reserved inodes, even when reserved numbers were freed
+by an older version, that the invalid inode number can be neither read nor written, and that fsck
+reports entries pointing at reserved inodes, but only in file systems created with them reserved.
+*/
+func TestReservedInodes(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	if filesys.info.FirstUserInode != FIRST_USER_INODE {
+		t.Fatalf("new file system has FirstUserInode %d", filesys.info.FirstUserInode)
+	}
+	node, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "first"}, new(fuse.CreateResponse))
+	if err != nil || node.(*File).inodeNum != FIRST_USER_INODE {
+		t.Fatalf("first file has inode %d, err %v, want %d", node.(*File).inodeNum, err, FIRST_USER_INODE)
+	}
+	filesys.inodeStream.put(5)
+	node, err = root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	if err != nil || isReservedInode(node.(*Dir).inodeNum) {
+		t.Fatalf("directory created with a reserved inode on the free list has inode %d, err %v", node.(*Dir).inodeNum, err)
+	}
+	if _, err := getInode(INVALID_INODE); err == nil {
+		t.Fatalf("read inode %d", INVALID_INODE)
+	}
+	if err := putInode(createInode(0), INVALID_INODE); err == nil {
+		t.Fatalf("wrote inode %d", INVALID_INODE)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck found problems: %v", report.problems)
+	}
+
+	reserved := createInode(0)
+	reserved.init(ROOT_INODE, 2)
+	putInode(reserved, 2)
+	root.addFile("metadata", 2)
+	if report := fsck(filesys); len(report.problems) != 1 {
+		t.Fatalf("fsck found %v, want the reserved inode", report.problems)
+	}
+	filesys.info.FirstUserInode = 0
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck of a file system from before inodes were reserved found %v", report.problems)
+	}
+}
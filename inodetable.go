@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bazil.org/fuse"
+	"bufio"
 	"bytes"
 	"encoding"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"io"
+	"sort"
 )
 
 /*
@@ -12,6 +18,7 @@ operations.
 */
 type InodeTable struct {
 	Table map[string]uint64
+	Types map[string]fuse.DirentType // the types of the entries whose type is known, for listings
 }
 
 /*
@@ -29,6 +36,22 @@ Adds a fileName/inode pair to the hash table.
 */
 func (i *InodeTable) add(fileName string, inode uint64) {
 	i.Table[fileName] = inode
+	delete(i.Types, fileName)
+}
+
+/*
+Adds a fileName/inode pair to the hash table along with the type of the file, so that listing the
+directory does not need to read its inode.
+*/
+func (i *InodeTable) addTyped(fileName string, inode uint64, typ fuse.DirentType) {
+	i.add(fileName, inode)
+	if typ == fuse.DT_Unknown {
+		return
+	}
+	if i.Types == nil {
+		i.Types = make(map[string]fuse.DirentType)
+	}
+	i.Types[fileName] = typ
 }
 
 /*
@@ -36,27 +59,156 @@ Deletes a filename/inode pair from the hash table.
 */
 func (i *InodeTable) delete(fileName string) {
 	delete(i.Table, fileName)
+	delete(i.Types, fileName)
+}
+
+/*
+Returns the type of the entry with fileName, or fuse.DT_Unknown if the table does not hold it, as
+tables written before format version 14 do not.
+*/
+func (i *InodeTable) entryType(fileName string) fuse.DirentType {
+	if fileName == "." || fileName == ".." {
+		return fuse.DT_Dir
+	}
+	return i.Types[fileName]
+}
+
+/*
+Calls fn with the name and inode number of each entry in the table other than "." and "..", in name
+order, stopping at the first error fn returns and returning it.
+*/
+func (i *InodeTable) forEachEntry(fn func(name string, inodeNum uint64) error) error {
+	names := make([]string, 0, len(i.Table))
+	for name := range i.Table {
+		if name != "." && name != ".." {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := fn(name, i.Table[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 var _ = encoding.BinaryMarshaler(&IntStream{})
 
+// the first byte of a table in the inline encoding, which a gob stream never starts with
+const INLINE_TABLE_MAGIC byte = 0
+
+// the first byte of a table in the inline encoding with the type of each entry, which a gob stream
+// never starts with either, since its first message is longer than a byte
+const INLINE_TYPED_TABLE_MAGIC byte = 1
+
 /*
-Returns a binary representation of the inodeTable, to be stored in a directory's data.
+Returns a binary representation of the inodeTable, to be stored in a directory's data, in the inline
+encoding (see marshalInline), so that small directories never need a data block, and large ones can
+be read a block at a time (see forEachEntry). Tables were gob encoded before format version 13, and
+those that outgrew the inode buffer were until the inline encoding was used for all of them, with the
+map of entry types encoded after the map of entries since format version 14.
 */
 func (i *InodeTable) MarshalBinary() ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(i.Table)
-	return buf.Bytes(), err
+	return i.marshalInline(), nil
 }
 
 /*
-Unmarshals the supplied binary into this inodeTable.
+Returns the inline encoding of the inodeTable: INLINE_TYPED_TABLE_MAGIC, followed by the length of
+the name, the name, and the inode number of each entry, in name order, as uvarints, and a byte
+holding the type of the entry (0 if it is not known). It has none of the type information gob writes
+at the start of every table, so a directory holding a dozen short names fits in the inode buffer.
+*/
+func (i *InodeTable) marshalInline() []byte {
+	names := make([]string, 0, len(i.Table))
+	for name := range i.Table {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data := []byte{INLINE_TYPED_TABLE_MAGIC}
+	var num [binary.MaxVarintLen64]byte
+	for _, name := range names {
+		n := binary.PutUvarint(num[:], uint64(len(name)))
+		data = append(append(data, num[:n]...), name...)
+		n = binary.PutUvarint(num[:], i.Table[name])
+		data = append(append(data, num[:n]...), byte(i.Types[name]))
+	}
+	return data
+}
+
+/*
+Unmarshals the supplied binary, in any encoding, into this inodeTable. Tables written before format
+version 14 have no entry types.
 */
 func (i *InodeTable) UnmarshalBinary(data []byte) error {
+	i.Types = nil
+	if len(data) > 0 && (data[0] == INLINE_TABLE_MAGIC || data[0] == INLINE_TYPED_TABLE_MAGIC) {
+		return i.unmarshalInline(data[1:], data[0] == INLINE_TYPED_TABLE_MAGIC)
+	}
 	var buf bytes.Buffer
 	buf.Write(data)
 	dec := gob.NewDecoder(&buf)
 	err := dec.Decode(&i.Table)
-	return err
+	if err != nil {
+		return err
+	}
+	var types map[string]fuse.DirentType
+	if dec.Decode(&types) == nil && len(types) > 0 {
+		i.Types = types
+	}
+	return nil
+}
+
+/*
+Unmarshals the entries of a table in the inline encoding, after its magic byte, with a type byte
+after each entry if typed is set.
+*/
+func (i *InodeTable) unmarshalInline(data []byte, typed bool) error {
+	i.Table = make(map[string]uint64)
+	reader := bufio.NewReader(bytes.NewReader(data))
+	return forEachInlineEntry(reader, uint64(len(data)), typed, func(name string, inodeNum uint64, typ fuse.DirentType) error {
+		i.addTyped(name, inodeNum, typ)
+		return nil
+	})
+}
+
+/*
+Calls fn with each entry of a table in the inline encoding read from reader, after its magic byte,
+in the order they are stored, which is name order, with a type byte after each entry if typed is
+set. Stops at the first error fn returns and returns it. size is the length of the table, so that a
+corrupt name length is reported rather than allocated.
+*/
+func forEachInlineEntry(reader *bufio.Reader, size uint64, typed bool, fn func(name string, inodeNum uint64, typ fuse.DirentType) error) error {
+	truncated := errors.New("inline directory table is truncated")
+	for {
+		nameLen, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil || nameLen > size {
+			return truncated
+		}
+		name := make([]byte, nameLen)
+		_, err = io.ReadFull(reader, name)
+		if err != nil {
+			return truncated
+		}
+		inodeNum, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return truncated
+		}
+		typ := fuse.DT_Unknown
+		if typed {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return truncated
+			}
+			typ = fuse.DirentType(b)
+		}
+		err = fn(string(name), inodeNum, typ)
+		if err != nil {
+			return err
+		}
+	}
 }
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+/*
+Checks that an InodeTable survives marshaling and that entries can be deleted.
+*/
+func TestInodeTable(t *testing.T) {
+	table := new(InodeTable)
+	table.init(1, 27)
+	table.add("testFile", 5)
+	tableData, err := table.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	newTable := new(InodeTable)
+	err = newTable.UnmarshalBinary(tableData)
+	if err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if newTable.Table["."] != 27 || newTable.Table[".."] != 1 || newTable.Table["testFile"] != 5 {
+		t.Fatalf("incorrect table after round trip: %v", newTable.Table)
+	}
+	newTable.delete("testFile")
+	if newTable.Table["testFile"] != 0 {
+		t.Fatalf("delete did not remove testFile: %v", newTable.Table)
+	}
+}
+
+/*
+Checks that arbitrary tables survive marshaling exactly.
+*/
+func TestInodeTableRoundTrip(t *testing.T) {
+	roundTrip := func(entries map[string]uint64) bool {
+		table := &InodeTable{Table: entries}
+		tableData, err := table.MarshalBinary()
+		if err != nil {
+			return false
+		}
+		newTable := new(InodeTable)
+		err = newTable.UnmarshalBinary(tableData)
+		if err != nil {
+			return false
+		}
+		if len(entries) == 0 {
+			return len(newTable.Table) == 0
+		}
+		return reflect.DeepEqual(entries, newTable.Table)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+/*
+Checks that forEachEntry visits the entries of a directory other than "." and ".." in name order,
+whether its table is in the inode buffer, spans data blocks, or is in the gob encoding, stops at the
+first error, and reports a directory that cannot be decoded.
+*/
+func TestForEachEntry(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	for _, name := range []string{"c", "a", "b"} {
+		writeTestFile(t, root, name, nil, 1)
+	}
+	var names []string
+	err := forEachEntry(root.inodeNum, root.inode, func(name string, inodeNum uint64) error {
+		if inodeNum == INVALID_INODE {
+			t.Errorf("%s has no inode number", name)
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil || !equalStrings(names, []string{"a", "b", "c"}) {
+		t.Fatalf("forEachEntry visited %v, err %v", names, err)
+	}
+	stop := errors.New("stop")
+	visited := 0
+	err = forEachEntry(root.inodeNum, root.inode, func(name string, inodeNum uint64) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Fatalf("forEachEntry returned %v after %d entries, want it to stop at the first", err, visited)
+	}
+
+	// a table spanning data blocks is read a block at a time, and one in the gob encoding whole
+	large := new(InodeTable)
+	large.init(1, 2)
+	var want []string
+	for i := 0; i < int(2*BLOCK_SIZE/16); i++ {
+		name := fmt.Sprintf("entry%08d", i)
+		large.add(name, uint64(i+3))
+		want = append(want, name)
+	}
+	largeInode := createInode(1)
+	writeTable(large, largeInode)
+	if largeInode.Size <= 2*BLOCK_SIZE {
+		t.Fatalf("the large table takes %d bytes, want more than two blocks", largeInode.Size)
+	}
+	gobInode := createInode(1)
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(large.Table)
+	gobInode.writeToData(buf.Bytes(), 0)
+	for _, inode := range []*Inode{largeInode, gobInode} {
+		names = nil
+		err = forEachEntry(2, inode, func(name string, inodeNum uint64) error {
+			if large.Table[name] != inodeNum {
+				t.Errorf("%s has inode %d, want %d", name, inodeNum, large.Table[name])
+			}
+			names = append(names, name)
+			return nil
+		})
+		if err != nil || !equalStrings(names, want) {
+			t.Fatalf("forEachEntry of a table of %d bytes visited %d entries, err %v", inode.Size, len(names), err)
+		}
+	}
+
+	corrupt := createInode(1)
+	corrupt.writeToData([]byte("not a table"), 0)
+	corrupt.updateSize(11)
+	if err := forEachEntry(2, corrupt, func(string, uint64) error { return nil }); err == nil {
+		t.Fatalf("forEachEntry of a corrupt directory returned no error")
+	}
+}
+
+/*
+Checks that a small directory keeps its table inline in the inode buffer, that it moves into a data
+block once it outgrows the buffer, and that it moves back, freeing the block, once it shrinks.
+*/
+func TestInlineTable(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	for i := 0; i < 8; i++ {
+		writeTestFile(t, root, fmt.Sprintf("file%d", i), nil, 1)
+	}
+	if root.inode.Size > INODE_BUFFER_SIZE || root.inode.DataBuf[0] != INLINE_TYPED_TABLE_MAGIC || root.inode.Data[0] != 0 {
+		t.Fatalf("small directory has size %d and data block %d", root.inode.Size, root.inode.Data[0])
+	}
+	for i := 8; i < 64; i++ {
+		writeTestFile(t, root, fmt.Sprintf("file%d", i), nil, 1)
+	}
+	if root.inode.Size <= INODE_BUFFER_SIZE || root.inode.Data[0] == 0 {
+		t.Fatalf("large directory has size %d and data block %d", root.inode.Size, root.inode.Data[0])
+	}
+	for i := 8; i < 64; i++ {
+		err := root.Remove(context.Background(), &fuse.RemoveRequest{Name: fmt.Sprintf("file%d", i)})
+		if err != nil {
+			t.Fatalf("Remove: %v", err)
+		}
+	}
+	if root.inode.Size > INODE_BUFFER_SIZE || root.inode.Data[0] != 0 {
+		t.Fatalf("shrunk directory has size %d and data block %d", root.inode.Size, root.inode.Data[0])
+	}
+	table, err := decodeTable(root.inode)
+	if err != nil || len(table.Table) != 10 {
+		t.Fatalf("shrunk directory has table %v, err %v", table, err)
+	}
+}
+
+/*
+Checks that the types of entries survive marshaling in the inline encoding whatever the size of the
+table, that those in the gob encoding earlier versions wrote for large tables are read, and that
+tables written without them, as before format version 14, decode with the types unknown.
+*/
+func TestTableEntryTypes(t *testing.T) {
+	for _, entries := range []int{2, 64} {
+		table := new(InodeTable)
+		table.init(1, 2)
+		for i := 0; i < entries; i++ {
+			table.addTyped(fmt.Sprintf("file%d", i), uint64(i+3), fuse.DT_File)
+		}
+		table.addTyped("dir", 100, fuse.DT_Dir)
+		table.add("untyped", 101)
+		tableData, err := table.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary: %v", err)
+		}
+		newTable := new(InodeTable)
+		err = newTable.UnmarshalBinary(tableData)
+		if err != nil {
+			t.Fatalf("UnmarshalBinary: %v", err)
+		}
+		if tableData[0] != INLINE_TYPED_TABLE_MAGIC {
+			t.Fatalf("table of %d entries is not in the inline encoding", len(table.Table))
+		}
+		if newTable.entryType("file1") != fuse.DT_File || newTable.entryType("dir") != fuse.DT_Dir || newTable.entryType("untyped") != fuse.DT_Unknown || newTable.entryType("..") != fuse.DT_Dir {
+			t.Fatalf("table of %d entries has types %v after round trip", len(table.Table), newTable.Types)
+		}
+
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		enc.Encode(table.Table)
+		enc.Encode(table.Types)
+		gobTable := new(InodeTable)
+		err = gobTable.UnmarshalBinary(buf.Bytes())
+		if err != nil || gobTable.entryType("file1") != fuse.DT_File || gobTable.entryType("untyped") != fuse.DT_Unknown || len(gobTable.Table) != len(table.Table) {
+			t.Fatalf("gob table of %d entries decoded with types %v, err %v", len(table.Table), gobTable.Types, err)
+		}
+	}
+
+	// the inline encoding of format version 13: "..", then "a" with inode 5
+	old := new(InodeTable)
+	err := old.UnmarshalBinary([]byte{INLINE_TABLE_MAGIC, 2, '.', '.', 1, 1, 'a', 5})
+	if err != nil || old.Table["a"] != 5 || old.entryType("a") != fuse.DT_Unknown {
+		t.Fatalf("untyped table decoded as %v with types %v, err %v", old.Table, old.Types, err)
+	}
+}
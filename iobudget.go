@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+)
+
+// the most a single read returns. The kernel never asks for more than FUSE_MAX_READAHEAD, and
+// 9P and HTTP clients read again after a short read.
+const MAX_READ_SIZE uint64 = 1 << 20
+
+// the default of IO_MEMORY_BUDGET
+const DEFAULT_IO_MEMORY_BUDGET int64 = 64 << 20
+
+// the most memory the buffers of reads and writes in flight may take up at once, across FUSE,
+// 9P, and HTTP requests. Requests wait for memory to be freed before allocating their buffers.
+var IO_MEMORY_BUDGET int64 = DEFAULT_IO_MEMORY_BUDGET
+
+/*
+Struct representing the memory taken by the buffers of requests in flight.
+*/
+type ioBudget struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	used int64
+}
+
+var ioMemory = newIOBudget()
+
+/*
+Returns a pointer to a new budget with nothing in use.
+*/
+func newIOBudget() *ioBudget {
+	b := new(ioBudget)
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+/*
+Waits until n bytes fit in IO_MEMORY_BUDGET and takes them. A request bigger than the whole budget
+waits until nothing else is in use, rather than forever.
+*/
+func (b *ioBudget) acquire(n int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.used > 0 && b.used+n > IO_MEMORY_BUDGET {
+		b.cond.Wait()
+	}
+	b.used += n
+}
+
+/*
+Gives back n bytes taken by acquire.
+*/
+func (b *ioBudget) release(n int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.used -= n
+	b.cond.Broadcast()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Checks that requests wait for the memory they need to be freed, and that a request bigger than the
+whole budget still goes through once nothing else is in use.
+*/
+func TestIOBudget(t *testing.T) {
+	b := newIOBudget()
+	b.acquire(IO_MEMORY_BUDGET - 10)
+	acquired := make(chan bool)
+	go func() {
+		b.acquire(20)
+		acquired <- true
+		b.acquire(2 * IO_MEMORY_BUDGET)
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("acquired memory past the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(IO_MEMORY_BUDGET - 10)
+	<-acquired
+	b.release(20)
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a request bigger than the budget never went through")
+	}
+}
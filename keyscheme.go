@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// the values of KeyScheme in the config, naming how the keys of the numbered blocks of a new file
+// system are made (see KeyScheme). Like Label, it only applies to a new file system, and is
+// recorded in its superblock, since the blocks could not be found under any other scheme.
+const KEY_SCHEME_MD5 string = "md5"
+const KEY_SCHEME_NUMERIC string = "numeric"
+const KEY_SCHEME_ULID string = "ulid"
+const KEY_SCHEME_DIRECTORIES string = "directories"
+
+// the scheme given to file systems when they are created, from the config, or "" for
+// KEY_SCHEME_MD5
+var KEY_SCHEME string
+
+// the scheme the keys of the blocks of the mounted file system are made with. Set by makeFs.
+var keyScheme KeyScheme = md5KeyScheme{}
+
+// the digits of the Crockford base32 encoding that ULIDs are written in
+const CROCKFORD_BASE32 string = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+/*
+Interface for the ways of naming the blocks of a file system that are numbered: data blocks
+("data"), inode blocks ("inodeBlock"), and the owner, times, and generation blocks beside them
+("ownerBlock", "timesBlock", and "generationBlock"). BlockKey returns the key of the block of the
+given kind with num, which must differ from the key of every other block. The superblocks and the
+hash and key blocks have fixed names.
+*/
+type KeyScheme interface {
+	BlockKey(kind string, num uint64) string
+}
+
+/*
+Returns an error if scheme is not a value of KeyScheme in the config.
+*/
+func checkKeyScheme(scheme string) error {
+	switch scheme {
+	case "", KEY_SCHEME_MD5, KEY_SCHEME_NUMERIC, KEY_SCHEME_ULID, KEY_SCHEME_DIRECTORIES:
+		return nil
+	}
+	return fmt.Errorf("KeyScheme must be %q, %q, %q, or %q, not %q.", KEY_SCHEME_MD5, KEY_SCHEME_NUMERIC,
+		KEY_SCHEME_ULID, KEY_SCHEME_DIRECTORIES, scheme)
+}
+
+/*
+Returns the scheme that the keys of the blocks of the file system described by info are made with.
+File systems created before schemes were recorded use KEY_SCHEME_MD5.
+*/
+func openKeyScheme(info *SuperblockInfo) (KeyScheme, error) {
+	switch info.KeyScheme {
+	case "", KEY_SCHEME_MD5:
+		return md5KeyScheme{}, nil
+	case KEY_SCHEME_NUMERIC:
+		return numericKeyScheme{}, nil
+	case KEY_SCHEME_ULID:
+		return ulidKeyScheme{createdMillis: uint64(info.CreatedTime) * 1000}, nil
+	case KEY_SCHEME_DIRECTORIES:
+		return directoryKeyScheme{}, nil
+	}
+	return nil, fmt.Errorf("file system names its blocks with key scheme %q, which this binary does not know", info.KeyScheme)
+}
+
+/*
+KeyScheme naming blocks "HASH-KINDNUMBER", where HASH is the first 2 bytes of the md5 hash of
+"KINDNUMBER", as every file system did before schemes could be chosen. Theoretically this allows for
+higher throughput on S3 (see
+http://docs.aws.amazon.com/AmazonS3/latest/dev/request-rate-perf-considerations.html)
+*/
+type md5KeyScheme struct{}
+
+var _ KeyScheme = md5KeyScheme{}
+
+/*
+Returns the key of the block of the given kind with num.
+*/
+func (md5KeyScheme) BlockKey(kind string, num uint64) string {
+	ident := kind + strconv.FormatUint(num, 10)
+	h := md5.New()
+	io.WriteString(h, ident)
+	hash := hex.EncodeToString(h.Sum(nil)[:2])
+	return hash + "-" + ident
+}
+
+/*
+KeyScheme naming blocks "KINDNUMBER", e.g. "data12", so that keys can be read at a glance.
+*/
+type numericKeyScheme struct{}
+
+var _ KeyScheme = numericKeyScheme{}
+
+/*
+Returns the key of the block of the given kind with num.
+*/
+func (numericKeyScheme) BlockKey(kind string, num uint64) string {
+	return kind + strconv.FormatUint(num, 10)
+}
+
+/*
+KeyScheme naming blocks "KIND/NUMBER", e.g. "data/12", so that each kind of block is under its own
+prefix (a directory in the S3 console), and lifecycle rules, replication, and inventories can be
+limited to the data blocks or to the metadata. The key of a block cannot depend on the directory
+of the file it belongs to, since files move between directories when renamed without their blocks
+being copied.
+*/
+type directoryKeyScheme struct{}
+
+var _ KeyScheme = directoryKeyScheme{}
+
+/*
+Returns the key of the block of the given kind with num.
+*/
+func (directoryKeyScheme) BlockKey(kind string, num uint64) string {
+	return kind + "/" + strconv.FormatUint(num, 10)
+}
+
+/*
+KeyScheme naming blocks with ULIDs: 26 characters of Crockford base32 holding a 48-bit time in
+milliseconds and 80 more bits. Since keys must be found again from the number of a block, the time
+is when the file system was created, and the other bits are the first 2 bytes of the md5 hash of the
+kind followed by the number, so that the keys of each kind sort by number.
+*/
+type ulidKeyScheme struct {
+	createdMillis uint64
+}
+
+var _ KeyScheme = ulidKeyScheme{}
+
+/*
+Returns the key of the block of the given kind with num.
+*/
+func (s ulidKeyScheme) BlockKey(kind string, num uint64) string {
+	var id [16]byte
+	var millis [8]byte
+	binary.BigEndian.PutUint64(millis[:], s.createdMillis)
+	copy(id[0:6], millis[2:8])
+	kindHash := md5.Sum([]byte(kind))
+	copy(id[6:8], kindHash[:2])
+	binary.BigEndian.PutUint64(id[8:16], num)
+	return encodeULID(id)
+}
+
+/*
+Returns the 128 bits of id in Crockford base32, five bits to a character, starting with the two
+highest bits of the first byte.
+*/
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = CROCKFORD_BASE32[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+Checks that a file system created under each key scheme names its blocks with it, records it in its
+superblock, and reads its files back when mounted again.
+*/
+func TestKeySchemes(t *testing.T) {
+	defer func() { KEY_SCHEME = "" }()
+	wantInodeBlock := map[string]string{
+		"":                     "21f2-inodeBlock0",
+		KEY_SCHEME_MD5:         "21f2-inodeBlock0",
+		KEY_SCHEME_NUMERIC:     "inodeBlock0",
+		KEY_SCHEME_DIRECTORIES: "inodeBlock/0",
+	}
+	for _, scheme := range []string{"", KEY_SCHEME_MD5, KEY_SCHEME_NUMERIC, KEY_SCHEME_ULID, KEY_SCHEME_DIRECTORIES} {
+		KEY_SCHEME = scheme
+		filesys, objects := newTestFs(t, 4)
+		data := testData(int(INODE_BUFFER_SIZE+3*BLOCK_SIZE), 1)
+		writeTestFile(t, testRoot(t, filesys), "file", data, 1<<16)
+		filesys.Destroy()
+
+		key := genInodeBlockKey(ROOT_INODE)
+		if want, ok := wantInodeBlock[scheme]; ok && key != want {
+			t.Fatalf("scheme %q names the first inode block %q, want %q", scheme, key, want)
+		}
+		if _, err := objects.GetObject(key); err != nil {
+			t.Fatalf("scheme %q: no inode block at %q", scheme, key)
+		}
+		keyScheme = md5KeyScheme{}
+		cache = newCache(newMemStore(), 4)
+		super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+		if err != nil {
+			t.Fatalf("getDataByKey for superblock: %v", err)
+		}
+		filesys, err = makeFs(super)
+		if err != nil {
+			t.Fatalf("makeFs: %v", err)
+		}
+		if filesys.info.KeyScheme != scheme || genInodeBlockKey(ROOT_INODE) != key {
+			t.Fatalf("remounted file system has key scheme %q, want %q", filesys.info.KeyScheme, scheme)
+		}
+		checkFileData(t, testRoot(t, filesys), "file", data)
+	}
+}
+
+/*
+Checks that ULID keys are 26 characters of Crockford base32 starting with the creation time of the
+file system, differ between kinds of blocks, and sort by block number within a kind.
+*/
+func TestULIDKeys(t *testing.T) {
+	scheme := ulidKeyScheme{createdMillis: 1700000000 * 1000}
+	// the ULID of 1700000000000 milliseconds starts with these 10 characters
+	const timePrefix = "01HF7YAT00"
+	last := ""
+	for _, num := range []uint64{0, 1, 2, 31, 32, 1000, 1 << 40} {
+		key := scheme.BlockKey("data", num)
+		if len(key) != 26 || !strings.HasPrefix(key, timePrefix) || strings.Trim(key, CROCKFORD_BASE32) != "" {
+			t.Fatalf("data block %d has key %q, not a ULID of the creation time", num, key)
+		}
+		if key <= last {
+			t.Fatalf("data block %d has key %q, which sorts before %q", num, key, last)
+		}
+		last = key
+	}
+	if scheme.BlockKey("data", 7) == scheme.BlockKey("inodeBlock", 7) {
+		t.Fatalf("data and inode blocks with the same number have the same key")
+	}
+	if _, err := openKeyScheme(&SuperblockInfo{KeyScheme: "sha3"}); err == nil {
+		t.Fatalf("a file system with an unknown key scheme was opened")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"math"
+	"path"
+	"syscall"
+)
+
+var _ = fs.NodeLinker(&Dir{})
+
+/*
+FUSE method that makes a hard link in the directory to an existing file, adding an entry for its
+inode and counting the link in its LinkCount, so that the file is only deleted once every entry
+linking to it is removed. Directories cannot be linked.
+*/
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+	defer trackOp("Link")()
+	defer recoverPanic("Link")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Link")()
+	target, ok := old.(*File)
+	if !ok {
+		return nil, fuse.EPERM
+	}
+	debugOp(path.Join(d.path, req.NewName), "Link", "parent=%d inode=%d", d.inodeNum, target.inodeNum)
+	err := checkDirWritable(d.inodeNum, true)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStoreWritable()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := lookupEntry(d.inodeNum, d.inode, req.NewName)
+	if err != nil {
+		return nil, err
+	}
+	if exists != INVALID_INODE {
+		return nil, fuse.EEXIST
+	}
+	// the stored inode, since the node may be older than links made or removed since
+	inode, err := getInode(target.inodeNum)
+	if err != nil {
+		return nil, err
+	}
+	if inode.LinkCount == 0 {
+		return nil, fuse.ENOENT
+	}
+	if inode.LinkCount == math.MaxUint16 {
+		return nil, fuse.Errno(syscall.EMLINK)
+	}
+	// the link count and the new entry are changed together
+	beginMetadataTransaction()
+	inode.LinkCount++
+	inode.changed()
+	err = putInode(inode, target.inodeNum)
+	if err == nil {
+		err = d.addFile(req.NewName, target.inodeNum)
+		if err != nil && metadataTxn == nil {
+			inode.LinkCount--
+			putInode(inode, target.inodeNum)
+		}
+	}
+	err = commitMetadataTransaction(err)
+	if err == errEntryChanged {
+		// another mount added the name first
+		err = fuse.EEXIST
+	}
+	if err != nil {
+		return nil, err
+	}
+	target.inode.LinkCount = inode.LinkCount
+	target.inode.Ctime = inode.Ctime
+	link := &File{
+		inode:       inode,
+		inodeNum:    target.inodeNum,
+		dirNum:      d.inodeNum,
+		inodeStream: d.inodeStream,
+		path:        path.Join(d.path, req.NewName),
+	}
+	audit("link", req.Header, target.path, link.path, target.inodeNum)
+	notifyChange("create", link.path, "", false)
+	return liveNodes.lookedUp(target.inodeNum, link), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that a hard link keeps a file, and its data, until the last entry linking to it is removed,
+and that fsck counts the links.
+*/
+func TestHardLink(t *testing.T) {
+	filesys, _ := newTestFs(t, 8)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	data := testData(int(INODE_BUFFER_SIZE+3*BLOCK_SIZE), 1)
+	file := writeTestFile(t, root, "file", data, 1<<16)
+	dirNode, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	dir := dirNode.(*Dir)
+	if _, err := dir.Link(ctx, &fuse.LinkRequest{NewName: "link"}, file); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if _, err := root.Link(ctx, &fuse.LinkRequest{NewName: "file"}, file); err != fuse.EEXIST {
+		t.Fatalf("Link over an existing name returned %v", err)
+	}
+	if _, err := root.Link(ctx, &fuse.LinkRequest{NewName: "dirlink"}, dir); err != fuse.EPERM {
+		t.Fatalf("Link of a directory returned %v", err)
+	}
+	attr := new(fuse.Attr)
+	file.Attr(ctx, attr)
+	if attr.Nlink != 2 {
+		t.Fatalf("file has %d links", attr.Nlink)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 || report.files != 1 {
+		t.Fatalf("fsck: %+v", report)
+	}
+
+	// renaming one link over the other leaves both
+	if err := root.Rename(ctx, &fuse.RenameRequest{OldName: "file", NewName: "link"}, dir); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	checkFileData(t, dir, "link", data)
+	inode, _ := getInode(file.inodeNum)
+	if inode.LinkCount != 1 || filesys.inodeStream.stack.Len() != 0 {
+		t.Fatalf("after removing a link the inode has LinkCount %d", inode.LinkCount)
+	}
+
+	// renaming another file over the last link deletes the file
+	writeTestFile(t, root, "other", testData(100, 2), 100)
+	if err := root.Rename(ctx, &fuse.RenameRequest{OldName: "other", NewName: "link"}, dir); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	inode, _ = getInode(file.inodeNum)
+	if inode.LinkCount != 0 || filesys.inodeStream.stack.Len() != 1 {
+		t.Fatalf("after replacing the last link the inode has LinkCount %d", inode.LinkCount)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 || report.files != 1 {
+		t.Fatalf("fsck: %+v", report)
+	}
+}
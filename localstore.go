@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Struct that keeps blocks as files in a local directory, one file per key. It implements both
+ObjectStore and CacheTable (separate directories should be used for the two roles), so that the
+file system can be run and crash tested on a single machine without AWS.
+*/
+type LocalStore struct {
+	dir string
+}
+
+var _ ObjectStore = (*LocalStore)(nil)
+var _ CacheTable = (*LocalStore)(nil)
+
+/*
+Returns a pointer to a LocalStore that keeps its files in dir, creating dir if it does not exist.
+*/
+func newLocalStore(dir string) (*LocalStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{
+		dir: dir,
+	}, nil
+}
+
+/*
+Returns the path of the file holding the item with key.
+*/
+func (l *LocalStore) path(key string) string {
+	return filepath.Join(l.dir, key)
+}
+
+/*
+Returns the data stored with key.
+*/
+func (l *LocalStore) get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, errors.New("No local item with key " + key + ".")
+	}
+	return data, err
+}
+
+/*
+Stores data with key. The data is written to a temporary file that is renamed into place, so
+a crash never leaves a partially written item.
+*/
+func (l *LocalStore) put(key string, data []byte) error {
+	tmp, err := ioutil.TempFile(l.dir, ".tmp-"+key)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+/*
+ObjectStore method that returns the data stored with key.
+*/
+func (l *LocalStore) GetObject(key string) ([]byte, error) {
+	return l.get(key)
+}
+
+/*
+ObjectStore method that stores data with key.
+*/
+func (l *LocalStore) PutObject(key string, data []byte) error {
+	return l.put(key, data)
+}
+
+/*
+ObjectStore method that removes the item stored with key.
+*/
+func (l *LocalStore) DeleteObject(key string) error {
+	return os.Remove(l.path(key))
+}
+
+/*
+CacheTable method that returns the data stored with key.
+*/
+func (l *LocalStore) GetItem(key string) ([]byte, error) {
+	return l.get(key)
+}
+
+/*
+CacheTable method that stores data with key.
+*/
+func (l *LocalStore) PutItem(key string, data []byte) error {
+	return l.put(key, data)
+}
+
+/*
+CacheTable method that removes the item stored with key, returning its data.
+*/
+func (l *LocalStore) DeleteItem(key string) ([]byte, error) {
+	data, err := l.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return data, os.Remove(l.path(key))
+}
+
+var _ ListingTable = (*LocalStore)(nil)
+
+/*
+ListingTable method that returns the keys of the items stored, in order, passing over the temporary
+files of puts that did not finish.
+*/
+func (l *LocalStore) ListItems() ([]string, error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), ".tmp-") {
+			keys = append(keys, file.Name())
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"golang.org/x/net/context"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the value of Locks in the config that shares the file locks of mounts of the same file system
+// through a DynamoDB table, rather than keeping them within each mount
+const LOCKS_DYNAMODB string = "dynamodb"
+
+// the suffix added to the name of the cache table to get the name of the lock table
+const LOCK_TABLE_SUFFIX string = "-locks"
+
+// how long a lock in the lock table outlives the last renewal by its mount, so that the locks of a
+// mount that crashed or lost its network are released. Mounts renew their locks every
+// LOCK_RENEW_INTERVAL, so the clocks of the hosts must agree to well within the difference.
+const LOCK_LEASE time.Duration = 30 * time.Second
+const LOCK_RENEW_INTERVAL time.Duration = 10 * time.Second
+
+// the first and the longest wait between tries of a lock that waits for another to be released
+const LOCK_WAIT_MIN_INTERVAL time.Duration = 10 * time.Millisecond
+const LOCK_WAIT_MAX_INTERVAL time.Duration = time.Second
+
+// how many times a change of the locks of a file is tried when another mount keeps changing them
+const LOCK_RETRIES int = 10
+
+// whether file locks are shared between mounts, from the config
+var SHARED_LOCKS bool
+
+// the store that shared locks are kept in with the configured backend, or nil if the backend has
+// none
+var backendLockStore LockStore
+
+// the locks of the mounted file system. Set by makeFs.
+var fileLocks = newLockTable(newMemLockStore(), newUUID())
+
+// returned by LockStore.PutLocks when the locks of the file were changed since they were read
+var errLocksChanged = errors.New("the locks of the file were changed by another mount")
+
+/*
+Struct describing an advisory lock on a range of a file, held by a lock owner of a mount: a process
+for POSIX (fcntl) locks, and an open file for flock locks, which cover the whole file. Locks of the
+two kinds never conflict, as on Linux.
+*/
+type fileLock struct {
+	Mount   string // the mount holding the lock
+	Owner   uint64 // the lock owner the kernel gave, which is only unique within the mount
+	Flock   bool   // whether it is a flock lock rather than a POSIX lock
+	Write   bool   // whether it is a write (exclusive) lock rather than a read (shared) lock
+	Start   uint64
+	End     uint64 // the last byte locked, math.MaxUint64 up to the end of the file
+	Pid     int32  // the process that took the lock, as reported by F_GETLK
+	Expires int64  // when the lease of the lock runs out, in nanoseconds since the epoch
+}
+
+/*
+Returns whether l and other are held by the same owner of the same mount, and are of the same kind.
+*/
+func (l *fileLock) sameOwner(other *fileLock) bool {
+	return l.Mount == other.Mount && l.Owner == other.Owner && l.Flock == other.Flock
+}
+
+/*
+Returns whether l keeps other from being taken.
+*/
+func (l *fileLock) conflicts(other *fileLock) bool {
+	return !l.sameOwner(other) && l.Flock == other.Flock && (l.Write || other.Write) &&
+		l.Start <= other.End && other.Start <= l.End
+}
+
+/*
+Interface for the store holding the locks of the files of a file system. GetLocks returns the locks
+on the file with inodeNum and a version, which is 0 if the file has none. PutLocks replaces them if
+they are still at version, and returns errLocksChanged otherwise. In production, this is either
+kept in memory by the mount, or a DynamoDB table shared by the mounts of the file system.
+*/
+type LockStore interface {
+	GetLocks(inodeNum uint64) ([]fileLock, uint64, error)
+	PutLocks(inodeNum uint64, locks []fileLock, version uint64) error
+}
+
+/*
+Struct keeping the locks taken through a mount in a LockStore, which may hold the locks of other
+mounts too. Changes are read, checked, and written back conditionally on the version read, so that
+mounts sharing a store never both take conflicting locks.
+*/
+type lockTable struct {
+	mutex sync.Mutex
+	store LockStore
+	mount string          // the name of the mount in the locks it takes
+	lease time.Duration   // how long the locks it takes last without being renewed
+	held  map[uint64]bool // the files the mount holds locks on
+}
+
+/*
+Returns a pointer to a new lockTable taking locks as mount in store.
+*/
+func newLockTable(store LockStore, mount string) *lockTable {
+	return &lockTable{
+		store: store,
+		mount: mount,
+		lease: LOCK_LEASE,
+		held:  make(map[uint64]bool),
+	}
+}
+
+/*
+Returns the store that the locks of a new mount are kept in: the store of the backend if locks are
+shared, and a new one in memory otherwise.
+*/
+func openLockStore() LockStore {
+	if SHARED_LOCKS && backendLockStore != nil {
+		return backendLockStore
+	}
+	return newMemLockStore()
+}
+
+/*
+Takes lock on the file with inodeNum for its owner, in place of what the owner held over its range,
+or releases what the owner held over the range if unlock is set. Returns a lock keeping it from
+being taken, if there is one, in which case nothing is changed.
+*/
+func (t *lockTable) set(inodeNum uint64, lock fileLock, unlock bool) (*fileLock, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lock.Mount = t.mount
+	if unlock && !t.held[inodeNum] {
+		return nil, nil
+	}
+	for try := 0; try < LOCK_RETRIES; try++ {
+		locks, version, err := t.store.GetLocks(inodeNum)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now().UnixNano()
+		locks = t.live(locks, now)
+		if !unlock {
+			for i := range locks {
+				if locks[i].conflicts(&lock) {
+					return &locks[i], nil
+				}
+			}
+		}
+		changed := make([]fileLock, 0, len(locks)+2)
+		for _, l := range locks {
+			if !l.sameOwner(&lock) || l.End < lock.Start || lock.End < l.Start {
+				changed = append(changed, l)
+				continue
+			}
+			// keep the parts of the range of the owner's lock outside the new one
+			if l.Start < lock.Start {
+				before := l
+				before.End = lock.Start - 1
+				changed = append(changed, before)
+			}
+			if lock.End < l.End {
+				after := l
+				after.Start = lock.End + 1
+				changed = append(changed, after)
+			}
+		}
+		if !unlock {
+			lock.Expires = now + int64(t.lease)
+			changed = append(changed, lock)
+		}
+		err = t.store.PutLocks(inodeNum, changed, version)
+		if err == errLocksChanged {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.held[inodeNum] = t.holds(changed)
+		if !t.held[inodeNum] {
+			delete(t.held, inodeNum)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("the locks of inode %d kept changing", inodeNum)
+}
+
+/*
+Returns locks without those of other mounts whose lease ran out before now.
+*/
+func (t *lockTable) live(locks []fileLock, now int64) []fileLock {
+	kept := locks[:0]
+	for _, l := range locks {
+		if l.Mount == t.mount || l.Expires > now {
+			kept = append(kept, l)
+		}
+	}
+	return kept
+}
+
+/*
+Returns whether the mount holds any of locks.
+*/
+func (t *lockTable) holds(locks []fileLock) bool {
+	for _, l := range locks {
+		if l.Mount == t.mount {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Takes lock on the file with inodeNum, waiting until no other lock keeps it from being taken, or
+returning fuse.EINTR if ctx is canceled first.
+*/
+func (t *lockTable) wait(ctx context.Context, inodeNum uint64, lock fileLock) error {
+	interval := LOCK_WAIT_MIN_INTERVAL
+	for {
+		conflict, err := t.set(inodeNum, lock, false)
+		if err != nil || conflict == nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fuse.EINTR
+		case <-time.After(interval):
+		}
+		interval *= 2
+		if interval > LOCK_WAIT_MAX_INTERVAL {
+			interval = LOCK_WAIT_MAX_INTERVAL
+		}
+	}
+}
+
+/*
+Returns a lock that keeps lock from being taken on the file with inodeNum, or nil if there is none.
+*/
+func (t *lockTable) query(inodeNum uint64, lock fileLock) (*fileLock, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	lock.Mount = t.mount
+	locks, _, err := t.store.GetLocks(inodeNum)
+	if err != nil {
+		return nil, err
+	}
+	locks = t.live(locks, time.Now().UnixNano())
+	for i := range locks {
+		if locks[i].conflicts(&lock) {
+			return &locks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+Releases the locks of the given kind that owner holds on the file with inodeNum.
+*/
+func (t *lockTable) release(inodeNum uint64, owner fuse.LockOwner, flock bool) error {
+	_, err := t.set(inodeNum, fileLock{Owner: uint64(owner), Flock: flock, End: math.MaxUint64}, true)
+	return err
+}
+
+/*
+Extends the leases of the locks the mount holds, so that other mounts do not take them as left by a
+mount that is gone.
+*/
+func (t *lockTable) renew() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for inodeNum := range t.held {
+		err := t.rewriteOwn(inodeNum, func(l *fileLock) bool {
+			l.Expires = time.Now().Add(t.lease).UnixNano()
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Releases all the locks the mount holds, when the file system is unmounted.
+*/
+func (t *lockTable) releaseAll() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for inodeNum := range t.held {
+		err := t.rewriteOwn(inodeNum, func(l *fileLock) bool { return false })
+		if err != nil {
+			return err
+		}
+		delete(t.held, inodeNum)
+	}
+	return nil
+}
+
+/*
+Rewrites the locks of the mount on the file with inodeNum with change, which returns whether to keep
+each. The caller must hold the mutex.
+*/
+func (t *lockTable) rewriteOwn(inodeNum uint64, change func(l *fileLock) bool) error {
+	for try := 0; try < LOCK_RETRIES; try++ {
+		locks, version, err := t.store.GetLocks(inodeNum)
+		if err != nil {
+			return err
+		}
+		changed := make([]fileLock, 0, len(locks))
+		for _, l := range locks {
+			if l.Mount != t.mount || change(&l) {
+				changed = append(changed, l)
+			}
+		}
+		err = t.store.PutLocks(inodeNum, changed, version)
+		if err != errLocksChanged {
+			return err
+		}
+	}
+	return fmt.Errorf("the locks of inode %d kept changing", inodeNum)
+}
+
+/*
+Starts renewing the leases of the locks of the mount every LOCK_RENEW_INTERVAL while the file system
+is mounted. Does nothing if locks are not shared with other mounts.
+*/
+func startLockRenewal(t *lockTable) {
+	if !SHARED_LOCKS {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(LOCK_RENEW_INTERVAL)
+			err := t.renew()
+			if err != nil {
+				fmt.Println("Error renewing file locks: " + err.Error())
+			}
+		}
+	}()
+}
+
+/*
+Returns the lock requested by req.
+*/
+func requestedLock(req *fuse.LockRequest) fileLock {
+	return fileLock{
+		Owner: uint64(req.LockOwner),
+		Flock: req.LockFlags&fuse.LockFlock != 0,
+		Write: req.Lock.Type == fuse.LockWrite,
+		Start: req.Lock.Start,
+		End:   req.Lock.End,
+		Pid:   req.Lock.PID,
+	}
+}
+
+var _ = fs.HandleFlockLocker(&FileHandle{})
+
+var _ = fs.HandlePOSIXLocker(&FileHandle{})
+
+/*
+FUSE method that takes a lock on a range of the file, or returns EAGAIN if another lock keeps it
+from being taken. Locks are advisory: reads and writes do not check them.
+*/
+func (fh *FileHandle) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	defer trackOp("Lock")()
+	defer recoverPanic("Lock")
+	debugOp(fh.path, "Lock", "inode=%d owner=%d range=%d..%d type=%v", fh.inodeNum, req.LockOwner, req.Lock.Start, req.Lock.End, req.Lock.Type)
+	conflict, err := fileLocks.set(fh.inodeNum, requestedLock(req), false)
+	if err != nil {
+		return err
+	}
+	if conflict != nil {
+		return fuse.Errno(syscall.EAGAIN)
+	}
+	return nil
+}
+
+/*
+FUSE method that takes a lock on a range of the file, waiting until no other lock keeps it from
+being taken.
+*/
+func (fh *FileHandle) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	defer trackOp("LockWait")()
+	defer recoverPanic("LockWait")
+	debugOp(fh.path, "LockWait", "inode=%d owner=%d range=%d..%d type=%v", fh.inodeNum, req.LockOwner, req.Lock.Start, req.Lock.End, req.Lock.Type)
+	lockReq := fuse.LockRequest(*req)
+	return fileLocks.wait(ctx, fh.inodeNum, requestedLock(&lockReq))
+}
+
+/*
+FUSE method that releases the locks of the owner on a range of the file.
+*/
+func (fh *FileHandle) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	defer trackOp("Unlock")()
+	defer recoverPanic("Unlock")
+	debugOp(fh.path, "Unlock", "inode=%d owner=%d range=%d..%d", fh.inodeNum, req.LockOwner, req.Lock.Start, req.Lock.End)
+	lockReq := fuse.LockRequest(*req)
+	_, err := fileLocks.set(fh.inodeNum, requestedLock(&lockReq), true)
+	return err
+}
+
+/*
+FUSE method that reports a lock keeping the requested one from being taken, as F_GETLK does. Locks
+of other mounts are reported with the process -1, since their processes mean nothing here.
+*/
+func (fh *FileHandle) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	defer trackOp("QueryLock")()
+	defer recoverPanic("QueryLock")
+	debugOp(fh.path, "QueryLock", "inode=%d owner=%d range=%d..%d type=%v", fh.inodeNum, req.LockOwner, req.Lock.Start, req.Lock.End, req.Lock.Type)
+	lockReq := fuse.LockRequest{LockOwner: req.LockOwner, Lock: req.Lock, LockFlags: req.LockFlags}
+	conflict, err := fileLocks.query(fh.inodeNum, requestedLock(&lockReq))
+	if err != nil || conflict == nil {
+		return err
+	}
+	resp.Lock = fuse.FileLock{Start: conflict.Start, End: conflict.End, Type: fuse.LockRead, PID: conflict.Pid}
+	if conflict.Write {
+		resp.Lock.Type = fuse.LockWrite
+	}
+	if conflict.Mount != fileLocks.mount {
+		resp.Lock.PID = -1
+	}
+	return nil
+}
+
+/*
+LockStore that keeps locks in memory, used for the locks of a single mount, and in tests for those
+of several.
+*/
+type memLockStore struct {
+	mutex    sync.Mutex
+	locks    map[uint64][]fileLock
+	versions map[uint64]uint64
+}
+
+var _ LockStore = (*memLockStore)(nil)
+
+/*
+Returns a pointer to a new memLockStore with no locks.
+*/
+func newMemLockStore() *memLockStore {
+	return &memLockStore{
+		locks:    make(map[uint64][]fileLock),
+		versions: make(map[uint64]uint64),
+	}
+}
+
+/*
+Returns a copy of the locks on the file with inodeNum, and their version.
+*/
+func (m *memLockStore) GetLocks(inodeNum uint64) ([]fileLock, uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]fileLock(nil), m.locks[inodeNum]...), m.versions[inodeNum], nil
+}
+
+/*
+Replaces the locks on the file with inodeNum with a copy of locks, if they are at version.
+*/
+func (m *memLockStore) PutLocks(inodeNum uint64, locks []fileLock, version uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.versions[inodeNum] != version {
+		return errLocksChanged
+	}
+	if len(locks) == 0 {
+		delete(m.locks, inodeNum)
+		delete(m.versions, inodeNum)
+		return nil
+	}
+	m.locks[inodeNum] = append([]fileLock(nil), locks...)
+	m.versions[inodeNum] = version + 1
+	return nil
+}
+
+/*
+LockStore backed by a DynamoDB table with the number "Inode" as its hash key. The locks on a file
+are kept as JSON in the binary "Locks" of its item, which is written conditionally on the number
+"Version", and deleted when the last lock is released.
+*/
+type dynamoLockStore struct {
+	client *dynamodb.DynamoDB
+	name   string
+}
+
+var _ LockStore = (*dynamoLockStore)(nil)
+
+/*
+Returns a LockStore that uses the DynamoDB table with the given name.
+*/
+func newDynamoLockStore(client *dynamodb.DynamoDB, name string) *dynamoLockStore {
+	return &dynamoLockStore{
+		client: client,
+		name:   name,
+	}
+}
+
+/*
+Creates the lock table if it does not exist, and waits for it to be ready. Exits the program on
+failure, as initializeCache does.
+*/
+func (t *dynamoLockStore) initialize() {
+	isReady, err := checkTableReady(t.name, t.client)
+	if err != nil {
+		_, err := t.client.CreateTable(provisionTable(&dynamodb.CreateTableInput{
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("Inode"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("Inode"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			},
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(READ_WRITE_CAPACITY),
+				WriteCapacityUnits: aws.Int64(READ_WRITE_CAPACITY),
+			},
+			TableName: aws.String(t.name),
+		}))
+		if err != nil {
+			fmt.Println("Error trying to create DynamoDB table with name: " + t.name + ", but failed")
+			fmt.Println("Error was: " + err.Error())
+			os.Exit(2)
+		}
+	}
+	for !isReady {
+		time.Sleep(time.Second)
+		isReady, _ = checkTableReady(t.name, t.client)
+	}
+}
+
+/*
+Returns the key of the item holding the locks on the file with inodeNum.
+*/
+func lockKey(inodeNum uint64) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"Inode": {N: aws.String(strconv.FormatUint(inodeNum, 10))},
+	}
+}
+
+/*
+Does a consistent read of the locks on the file with inodeNum.
+*/
+func (t *dynamoLockStore) GetLocks(inodeNum uint64) ([]fileLock, uint64, error) {
+	resp, err := t.client.GetItem(&dynamodb.GetItemInput{
+		Key:            lockKey(inodeNum),
+		TableName:      aws.String(t.name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || resp.Item["Version"] == nil {
+		return nil, 0, err
+	}
+	version, err := strconv.ParseUint(aws.StringValue(resp.Item["Version"].N), 10, 64)
+	if err != nil {
+		return nil, 0, err
+	}
+	var locks []fileLock
+	if resp.Item["Locks"] != nil {
+		err = json.Unmarshal(resp.Item["Locks"].B, &locks)
+	}
+	return locks, version, err
+}
+
+/*
+Replaces the locks on the file with inodeNum, if they are at version, deleting its item if there
+are none left.
+*/
+func (t *dynamoLockStore) PutLocks(inodeNum uint64, locks []fileLock, version uint64) error {
+	condition := aws.String("attribute_not_exists(Inode)")
+	var values map[string]*dynamodb.AttributeValue
+	if version != 0 {
+		condition = aws.String("Version = :version")
+		values = map[string]*dynamodb.AttributeValue{
+			":version": {N: aws.String(strconv.FormatUint(version, 10))},
+		}
+	}
+	var err error
+	if len(locks) == 0 {
+		_, err = t.client.DeleteItem(&dynamodb.DeleteItemInput{
+			Key:                       lockKey(inodeNum),
+			TableName:                 aws.String(t.name),
+			ConditionExpression:       condition,
+			ExpressionAttributeValues: values,
+		})
+	} else {
+		data, jsonErr := json.Marshal(locks)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		item := lockKey(inodeNum)
+		item["Version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatUint(version+1, 10))}
+		item["Locks"] = &dynamodb.AttributeValue{B: data}
+		_, err = t.client.PutItem(&dynamodb.PutItemInput{
+			Item:                      item,
+			TableName:                 aws.String(t.name),
+			ConditionExpression:       condition,
+			ExpressionAttributeValues: values,
+		})
+	}
+	if err != nil && strings.Contains(err.Error(), dynamodb.ErrCodeConditionalCheckFailedException) {
+		return errLocksChanged
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"math"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+Checks that POSIX locks on ranges of a file conflict only with overlapping locks of other owners
+where one is a write lock, that unlocking part of a range keeps the rest, that F_GETLK reports a
+conflicting lock, that closing a descriptor releases the POSIX locks of its owner, and that flock
+locks are released with the handle and never conflict with POSIX locks.
+*/
+func TestFileLocks(t *testing.T) {
+	filesys, _ := newTestFs(t, 8)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	writeTestFile(t, root, "file", testData(100, 1), 1<<16)
+	node, _ := root.lookup(ctx, "file")
+	handle, _ := node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, new(fuse.OpenResponse))
+	fh := handle.(*FileHandle)
+	lock := func(owner fuse.LockOwner, typ fuse.LockType, start, end uint64) error {
+		return fh.Lock(ctx, &fuse.LockRequest{LockOwner: owner, Lock: fuse.FileLock{Start: start, End: end, Type: typ, PID: int32(owner)}})
+	}
+	eagain := fuse.Errno(syscall.EAGAIN)
+
+	if err := lock(1, fuse.LockWrite, 0, 99); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if err := lock(2, fuse.LockRead, 50, 60); err != eagain {
+		t.Fatalf("a read lock over a write lock of another owner returned %v", err)
+	}
+	if err := lock(1, fuse.LockRead, 50, 60); err != nil {
+		t.Fatalf("an owner could not change part of its own lock: %v", err)
+	}
+	if err := lock(2, fuse.LockRead, 55, 200); err != eagain {
+		t.Fatalf("a lock over the rest of the write lock returned %v", err)
+	}
+	unlock := &fuse.UnlockRequest{LockOwner: 1, Lock: fuse.FileLock{Start: 61, End: 99, Type: fuse.LockUnlock}}
+	if err := fh.Unlock(ctx, unlock); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if err := lock(2, fuse.LockRead, 55, 200); err != nil {
+		t.Fatalf("a read lock over a read lock and an unlocked range returned %v", err)
+	}
+	resp := new(fuse.QueryLockResponse)
+	query := &fuse.QueryLockRequest{LockOwner: 3, Lock: fuse.FileLock{Start: 0, End: math.MaxUint64, Type: fuse.LockWrite}}
+	if err := fh.QueryLock(ctx, query, resp); err != nil {
+		t.Fatalf("QueryLock: %v", err)
+	}
+	if resp.Lock.Type != fuse.LockWrite || resp.Lock.Start != 0 || resp.Lock.End != 49 || resp.Lock.PID != 1 {
+		t.Fatalf("QueryLock reported %+v, want the write lock of owner 1 on 0..49", resp.Lock)
+	}
+
+	if err := fh.Flush(ctx, &fuse.FlushRequest{LockOwner: 1}); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := lock(3, fuse.LockWrite, 0, 54); err != nil {
+		t.Fatalf("the locks of an owner were kept after it closed the file: %v", err)
+	}
+
+	flock := &fuse.LockRequest{LockOwner: 4, LockFlags: fuse.LockFlock, Lock: fuse.FileLock{End: math.MaxUint64, Type: fuse.LockWrite}}
+	if err := fh.Lock(ctx, flock); err != nil {
+		t.Fatalf("a flock lock conflicted with POSIX locks: %v", err)
+	}
+	other := &fuse.LockRequest{LockOwner: 5, LockFlags: fuse.LockFlock, Lock: fuse.FileLock{End: math.MaxUint64, Type: fuse.LockRead}}
+	if err := fh.Lock(ctx, other); err != eagain {
+		t.Fatalf("a flock lock over another returned %v", err)
+	}
+	if err := fh.Release(ctx, &fuse.ReleaseRequest{LockOwner: 4, ReleaseFlags: fuse.ReleaseFlockUnlock}); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if err := fh.Lock(ctx, other); err != nil {
+		t.Fatalf("a flock lock was kept after its handle was released: %v", err)
+	}
+}
+
+/*
+Checks that mounts sharing a lock store see each other's locks, that a waiting lock is taken once
+the lock in its way is released or its context is canceled, that the locks of a mount that stops
+renewing them are ignored once their lease runs out, and that unmounting releases them.
+*/
+func TestSharedLocks(t *testing.T) {
+	store := newMemLockStore()
+	first := newLockTable(store, "first")
+	second := newLockTable(store, "second")
+	write := fileLock{Owner: 1, Write: true, End: math.MaxUint64}
+
+	if conflict, err := first.set(7, write, false); conflict != nil || err != nil {
+		t.Fatalf("set: %+v, %v", conflict, err)
+	}
+	if conflict, _ := second.set(7, write, false); conflict == nil || conflict.Mount != "first" {
+		t.Fatalf("a lock held by another mount was taken")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := second.wait(ctx, 7, write); err != fuse.EINTR {
+		t.Fatalf("wait returned %v when its context was canceled", err)
+	}
+	done := make(chan error)
+	go func() { done <- second.wait(context.Background(), 7, write) }()
+	time.Sleep(20 * time.Millisecond)
+	if err := first.release(7, 1, false); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	// the second mount goes away without renewing its lock
+	locks, version, _ := store.GetLocks(7)
+	locks[0].Expires = time.Now().Add(-time.Second).UnixNano()
+	store.PutLocks(7, locks, version)
+	if conflict, err := first.set(7, write, false); conflict != nil || err != nil {
+		t.Fatalf("a lock whose lease ran out kept another from being taken: %+v, %v", conflict, err)
+	}
+	if err := first.renew(); err != nil {
+		t.Fatalf("renew: %v", err)
+	}
+	if locks, _, _ := store.GetLocks(7); len(locks) != 1 || locks[0].Mount != "first" || locks[0].Expires < time.Now().UnixNano() {
+		t.Fatalf("locks %+v after renewing", locks)
+	}
+	if err := first.releaseAll(); err != nil {
+		t.Fatalf("releaseAll: %v", err)
+	}
+	if locks, version, _ := store.GetLocks(7); len(locks) != 0 || version != 0 {
+		t.Fatalf("locks %+v left after unmounting", locks)
+	}
+}
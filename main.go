@@ -4,13 +4,12 @@ package main
 
 import (
 	"bazil.org/fuse"
-	"bazil.org/fuse/fs"
 	"container/list"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -20,12 +19,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 const S3_SUPERBLOCK_NAME string = "super"
-const ROOT_INODE uint64 = 1 // cannot be set to 0 or things will break
 const CONFIG_FILE_NAME string = "CFconfig.json"
 const TEST_FLAG = "test"
+const FS_NAME string = "cloudfusion"
 
 var S3_BUCKET_NAME string
 var S3_REGION string
@@ -36,14 +36,18 @@ var cache *Cache
 var credentialsProfile string
 var mountpoint string
 var runTests bool
+var runStress bool
 
 /*
 Prints information on how to format the command line args.
 */
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", progName)
-	fmt.Fprintf(os.Stderr, " %s CONFIG_PATH CACHESIZE (test)\n", progName)
+	fmt.Fprintf(os.Stderr, " %s CONFIG_PATH CACHESIZE (test|stress)\n", progName)
+	fmt.Fprintf(os.Stderr, " %s COMMAND ARGS...\n", progName)
 	fmt.Fprintf(os.Stderr, "ex: $GOPATH/bin/CFconfig.json 50 test\n")
+	fmt.Fprintf(os.Stderr, "commands:\n")
+	printCommands()
 	flag.PrintDefaults()
 }
 
@@ -55,8 +59,15 @@ func main() {
 	log.SetPrefix(progName + ": ")
 
 	flag.Usage = usage
+	flag.BoolVar(&debugOps, "debug-ops", false, "log every FUSE operation with its arguments and block keys")
+	flag.StringVar(&debugOpsPrefix, "debug-ops-prefix", "", "only log operations on this path and the paths under it")
+	flag.StringVar(&SANDBOX_PREFIX, "sandbox-prefix", "", "put the keys of every block under this prefix, to test without touching the real file system")
 	flag.Parse()
 
+	if flag.NArg() > 0 && isCommand(flag.Arg(0)) {
+		os.Exit(runCommand(flag.Arg(0), flag.Args()[1:]))
+	}
+
 	if flag.NArg() != 2 && flag.NArg() != 3 {
 		usage()
 		os.Exit(2)
@@ -70,6 +81,8 @@ func main() {
 	if flag.NArg() > 2 {
 		if flag.Arg(2) == TEST_FLAG {
 			runTests = true
+		} else if flag.Arg(2) == STRESS_FLAG {
+			runStress = true
 		} else {
 			usage()
 			os.Exit(2)
@@ -77,14 +90,15 @@ func main() {
 	} else {
 		runTests = false
 	}
-	config := readConfig(configLocation)
-	S3_REGION = config.Region
-	S3_BUCKET_NAME = config.Bucket
-	initializeBucket()
-	DYNAMO_TABLE_NAME = config.Table
-	cache = initializeCache(cacheSize)
-	credentialsProfile = config.Credentials
-	mountpoint = config.Mountpoint
+	if err := checkTestSandbox(); err != nil {
+		log.Fatal(err)
+	}
+	config := loadConfig(configLocation)
+	initializeBackend(config, cacheSize)
+	auditLog, err = initializeAuditLog(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if err := mount(mountpoint); err != nil {
 		log.Fatal(err)
 	}
@@ -92,58 +106,121 @@ func main() {
 
 /*
 Does 3 things: initializes persistent things if they do not exist (S3 bucket, DynamoDB table, superblock),
-sets up a channel to call FS.Destroy on an interrupt, and serves the file system.
+sets up a channel to call FS.Destroy and unmount on an interrupt, termination, or hangup, and serves
+the file system. The superblock is read before mounting, so that the mount is named after the label.
 */
 func mount(mountpoint string) error {
-	c, err := fuse.Mount(mountpoint)
+	filesys, err := openMountedFs()
 	if err != nil {
 		return err
 	}
-	defer c.Close()
-
-	client := getClient()
+	configured := FS_LABEL != "" || FS_DESCRIPTION != ""
+	if configured && (FS_LABEL != filesys.info.Label || FS_DESCRIPTION != filesys.info.Description) {
+		fmt.Println("The Label and Description in the config only apply to new file systems, so the stored ones are kept.")
+	}
 
-	// fmt.Println("doing getData for superblock")
-	superKey := S3_SUPERBLOCK_NAME + "0"
-	super, err := getDataByKey(client, superKey)
+	c, err := binding.mount(mountpoint, filesys.info.Label)
 	if err != nil {
-		super = makeNewSuperblock()
+		return err
 	}
-	filesys := makeFs(super)
-	// fmt.Println("finished makeFs")
+	defer c.close()
+	virtualDirParent = filesys.rootInode
 
-	// from http://stackoverflow.com/questions/11268943/golang-is-it-possible-to-capture-a-ctrlc-signal-and-run-a-cleanup-function-in
-	c2 := make(chan os.Signal, 1)
-	signal.Notify(c2, os.Interrupt)
-	signal.Notify(c2, syscall.SIGTERM)
-	go func() {
-		<-c2
-		filesys.Destroy()
-		os.Exit(1)
-	}()
-
-	_, err = getInode(filesys.rootInode)
-	if err != nil {
-		makeNewRootInode()
+	shutdownOnSignal()
+	if ADMIN_SOCKET_PATH != "" {
+		err = startAdminSocket(ADMIN_SOCKET_PATH)
+		if err != nil {
+			return err
+		}
 	}
 
 	if runTests {
 		fmt.Println("Test flag was set, so running all tests.")
 		go runAllTests()
 	}
+	if runStress {
+		fmt.Println("Stress flag was set, so running the concurrent stress test.")
+		go runStressTest()
+	}
 
-	fmt.Println("File system mounted.")
-	if err := fs.Serve(c, filesys); err != nil {
-		return err
+	fmt.Println("File system " + mountName(filesys.info.Label) + " mounted.")
+	if len(warmPaths) != 0 {
+		go warmCache(filesys, warmPaths)
 	}
+	return c.serve(filesys)
+}
 
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		return err
+/*
+Sets up a channel to call shutdown on an interrupt, termination, or hangup.
+*/
+func shutdownOnSignal() {
+	// from http://stackoverflow.com/questions/11268943/golang-is-it-possible-to-capture-a-ctrlc-signal-and-run-a-cleanup-function-in
+	c2 := make(chan os.Signal, 1)
+	signal.Notify(c2, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-c2
+		fmt.Println("Received " + sig.String() + ", shutting down the file system.")
+		shutdown()
+	}()
+}
+
+/*
+Takes the mount lease if the config asks for one, reads the superblock, or creates a new file system
+if there is none, and sets up encryption and the root directory, returning the file system ready to
+be served.
+*/
+func openMountedFs() (*FS, error) {
+	err := acquireMountLease()
+	if err != nil {
+		return nil, err
+	}
+	recovery, err := recoverCacheTable()
+	if err != nil {
+		return nil, errors.New("Could not recover the blocks left in the cache table: " + err.Error())
+	}
+	if recovery != nil {
+		recovery.report()
+	}
+	superKey := S3_SUPERBLOCK_NAME + "0"
+	super, err := getDataByKey(superKey)
+	// only a superblock the store says is missing makes a new file system: one that could not be
+	// read (as when S3 throttles) would be replaced, with a new data key, by an empty file system
+	isNew := err != nil && isMissingObject(err)
+	if err != nil && !isNew {
+		return nil, errors.New("Could not read the superblock: " + err.Error())
+	}
+	if isNew {
+		super = makeNewSuperblock()
 	}
+	filesys, err := makeFs(super)
+	if err != nil {
+		return nil, err
+	}
+	err = markCache(filesys, filesys.info.Writer)
+	if err != nil {
+		return nil, errors.New("Could not put the cache marker: " + err.Error())
+	}
+	err = initializeEncryption(filesys.info, isNew)
+	if err != nil {
+		return nil, err
+	}
+	mountedFs = filesys
+	// fmt.Println("finished makeFs")
 
-	return nil
+	_, err = getInode(filesys.rootInode)
+	if err != nil && !isMissingObject(err) {
+		return nil, errors.New("Could not read the root directory: " + err.Error())
+	}
+	if err != nil {
+		makeNewRootInode()
+	}
+	deleteOrphans(filesys)
+	resumeDeleteJobs(filesys)
+	startFlusher()
+	startHandleReaper()
+	startTieringReports(filesys)
+	startLockRenewal(fileLocks)
+	return filesys, nil
 }
 
 /*
@@ -155,10 +232,13 @@ func makeNewSuperblock() *DataBlock {
 	super := &DataBlock{
 		Data: superData,
 	}
-	// this is the easiest way to make streams start at 1, which is needed so that the zero
-	// value of a map differs from any inode number... :(
-	tempFs := makeFs(super)
-	tempFs.inodeStream.lastInt = 1
+	// this is the easiest way to make streams start past INVALID_INODE, which is needed so that
+	// the zero value of a map differs from any inode number, and past the reserved inodes
+	tempFs, err := makeFs(super)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tempFs.inodeStream.lastInt = LAST_RESERVED_INODE
 	tempFs.inodeStream.stack = new(list.List)
 	dataStream.lastInt = 1
 	lastInode := tempFs.inodeStream.compressStream()
@@ -168,7 +248,11 @@ func makeNewSuperblock() *DataBlock {
 	if err != nil {
 		fmt.Println("VERY BAD ERROR marshaling binary from inodeStream in makeNewSuperblock")
 	}
-	super = makeSuperblocks(lastInode, lastData, ROOT_INODE, inodeListData)[0]
+	payload, err := encodeSuperPayload(newSuperblockInfo(), inodeListData)
+	if err != nil {
+		log.Fatal(err)
+	}
+	super = makeSuperblocks(lastInode, lastData, ROOT_INODE, payload)[0]
 	// fmt.Println("doing makeFs with new blank superblock")
 	return super
 }
@@ -183,10 +267,19 @@ func makeNewRootInode() {
 	newRootInode := createInode(isDir)
 	newRootInode.init(ROOT_INODE, ROOT_INODE)
 	// fmt.Println("created new root inode")
-	err2 := putInode(newRootInode, ROOT_INODE)
+	// the root belongs to the user who created the file system
+	err2 := setNewGeneration(newRootInode, ROOT_INODE)
+	if err2 == nil {
+		err2 = setNewOwner(newRootInode, ROOT_INODE, fuse.Header{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())})
+	}
+	if err2 == nil {
+		err2 = putInode(newRootInode, ROOT_INODE)
+	}
 	if err2 != nil {
 		log.Fatal(err2)
 	}
+	// the root is its own parent, which creates the first parent block
+	indexParent(ROOT_INODE, ROOT_INODE)
 	// fmt.Println("uploaded new root inode")
 }
 
@@ -194,33 +287,282 @@ func makeNewRootInode() {
 Struct used to represent information in CFconfig.json.
 */
 type Config struct {
-	Region      string
-	Bucket      string
-	Credentials string
-	Mountpoint  string
-	Table       string
+	Region          string
+	Bucket          string
+	Credentials     string
+	Mountpoint      string
+	Table           string
+	Backend         string // "s3" (the default) or "local"
+	LocalPath       string // directory holding the file system when Backend is "local"
+	KMSKeyARN       string // KMS key used to encrypt new file systems, or "" to not encrypt them
+	CABundle        string // PEM file of the CAs to trust for AWS endpoints
+	MinTLSVersion   string // lowest TLS version to use with AWS endpoints, e.g. "1.2"
+	FIPSEndpoints   bool   // use the FIPS endpoints of S3, DynamoDB, and KMS
+	AuditLog        string // "s3" or "cloudwatch:GROUP:STREAM" to audit file operations, or "" to not
+	WritebackCache  bool   // let the kernel buffer writes, see WRITEBACK_CACHE
+	AllowOther      bool   // let other users use the mount, see ALLOW_OTHER
+	SkipZeroBlocks  bool   // leave blocks of zeros as holes, see SKIP_ZERO_BLOCKS
+	AdminSocket     string // unix socket to serve the admin API on, or "" to not
+	FlushInterval   string // longest a change may be only in the cache, e.g. "5m", or "" for no limit
+	IOMemoryMB      int    // see IO_MEMORY_BUDGET, or 0 for the default
+	UploadKBps      int    // see S3_UPLOAD_BANDWIDTH, in KiB per second, or 0 for no limit
+	DownloadKBps    int    // see S3_DOWNLOAD_BANDWIDTH, in KiB per second, or 0 for no limit
+	Label           string // human-readable name given to a new file system, see FS_LABEL
+	Description     string // human-readable description given to a new file system
+	ReadaheadBlocks int    // see READAHEAD_WINDOW
+	ReadaheadReads  int    // see READAHEAD_TRIGGER, or 0 for the default
+	MaxPrefetches   int    // see MAX_PREFETCHES, or 0 for the default
+	VirtualSizeGB   int    // the size df shows, in GiB, see STATFS_BLOCKS, or 0 for the default
+	VirtualFiles    int    // the number of files df shows room for, see STATFS_FILES, or 0 for the default
+	QuotaGB         int    // the most space the file system may take, see QUOTA_BLOCKS, or 0 for no limit
+	SoftQuotaGB     int    // see SOFT_QUOTA_BLOCKS, or 0 for no soft limit
+	QuotaGrace      string // how long SoftQuotaGB may be exceeded, e.g. "72h", or "" for the default
+	MetadataStore   string // "items" to keep the metadata of a new file system as DynamoDB items, see METADATA_ITEMS
+	InodeCacheSize  int    // see INODE_CACHE_SIZE, 0 for the default, or -1 to not keep inodes in memory
+	InodeCacheTTL   string // see INODE_CACHE_TTL, e.g. "1s", or "" for the default
+	AttrTTL         string // see ATTR_TTL, e.g. "5s", "" for the default, or "0" to not cache attributes in the kernel
+	EntryTTL        string // see ENTRY_TTL, e.g. "5s", "" for the default, or "0" to not cache entries in the kernel
+	MaxDirEntries   int    // see MAX_DIR_ENTRIES, 0 for the default, or -1 for no limit
+	MaxDirTableMB   int    // see MAX_DIR_TABLE_BYTES, in MiB, 0 for the default, or -1 for no limit
+	MaxOpenHandles  int    // see MAX_OPEN_HANDLES, 0 for the default, or -1 for no limit
+	HandleIdleTime  string // see HANDLE_IDLE_TIMEOUT, e.g. "30m", "" for the default, or "0" to never
+	Atime           string // see ATIME_MODE, "noatime", "relatime", or "strictatime", or "" for relatime
+	StorageClass    string // see S3_STORAGE_CLASS, "STANDARD" or "INTELLIGENT_TIERING", or "" for STANDARD
+	KeyScheme       string // how the blocks of a new file system are named, see KEY_SCHEME
+	Locks           string // "dynamodb" to share file locks between mounts, see SHARED_LOCKS, or "" to keep them in the mount
+	MountLease      bool   // hold a lease while mounted, so that a standby can take over, see MOUNT_LEASE_ENABLED
+	PathIndex       bool   // keep the parent of each inode of a new file system, see PATH_INDEX
+
+	// how the first mount sets up the bucket and tables it creates, see provision.go
+	Tags                 map[string]string // put on the bucket and the tables
+	ServerSideEncryption string            // default encryption of the bucket, see SSE_ALGORITHM
+	ServerSideKMSKeyARN  string            // KMS key of "aws:kms", or "" for the AWS managed key
+	BlockPublicAccess    bool              // see BLOCK_PUBLIC_ACCESS
+	Versioning           bool              // see BUCKET_VERSIONING
+
+	// S3 Object Lock settings for the blocks of files under append-only and immutable directories
+	ObjectLockMode      string // "GOVERNANCE" or "COMPLIANCE", or "" to not set retention
+	ObjectLockDays      int
+	ObjectLockLegalHold bool
+
+	// what to do when S3 does not take the blocks evicted from the cache
+	S3OutagePolicy    string // see S3_OUTAGE_POLICY, or "" for OUTAGE_BLOCK
+	OutageQueueBlocks int    // see OUTAGE_QUEUE_BLOCKS, or 0 for the default
+	WriteFailureLimit int    // see WRITE_FAILURE_LIMIT, 0 for the default, or -1 to never become read-only
+
+	// the longest each kind of request may take, see OP_TIMEOUTS, e.g. {"Attr": "2s", "Read": "30s", "*": "1m"}
+	OpTimeouts map[string]string
+
+	// the space under QuotaGB kept for the writers under each path, in GiB, see QUOTA_RESERVATIONS, e.g. {"/logs": 5}
+	QuotaReservedGB map[string]int
+
+	// more FUSE mount options, as given to mount -o, see FUSE_MOUNT_OPTIONS, e.g. ["default_permissions", "max_readahead=4194304"]
+	MountOptions []string
 }
 
 /*
-Reads from the config file at the specified path and returns a Config with the AWS region, the S3 bucket name,
-the name of the AWS credentials profile, and the desired mountpoint of the file system.
+Reads from the config file at the specified path (or the SSM parameter or secret it refers to, see
+readConfigData) and returns a Config with the AWS region, the S3 bucket name, the name of the AWS
+credentials profile, and the desired mountpoint of the file system.
 */
 func readConfig(configFilePath string) *Config {
-	// fmt.Println("doing readConfig")
-	file, err := os.Open(configFilePath)
-	defer file.Close()
-	decoder := json.NewDecoder(file)
+	data, err := readConfigData(configFilePath)
+	if err != nil {
+		log.Fatal(err)
+	}
 	config := new(Config)
-	err = decoder.Decode(config)
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return config
+}
+
+/*
+Reads the config file at the specified path and uses it to set the globals describing
+where the file system is stored.
+*/
+func loadConfig(configFilePath string) *Config {
+	config := readConfig(configFilePath)
+	mountConfig = config
+	S3_REGION = config.Region
+	S3_BUCKET_NAME = config.Bucket
+	DYNAMO_TABLE_NAME = config.Table
+	credentialsProfile = config.Credentials
+	mountpoint = config.Mountpoint
+	KMS_KEY_ARN = config.KMSKeyARN
+	CA_BUNDLE_PATH = config.CABundle
+	MIN_TLS_VERSION = config.MinTLSVersion
+	USE_FIPS_ENDPOINTS = config.FIPSEndpoints
+	OBJECT_LOCK_MODE = config.ObjectLockMode
+	OBJECT_LOCK_DAYS = config.ObjectLockDays
+	OBJECT_LOCK_LEGAL_HOLD = config.ObjectLockLegalHold
+	WRITEBACK_CACHE = config.WritebackCache
+	ALLOW_OTHER = config.AllowOther
+	SKIP_ZERO_BLOCKS = config.SkipZeroBlocks
+	ADMIN_SOCKET_PATH = config.AdminSocket
+	FLUSH_INTERVAL = 0
+	if config.FlushInterval != "" {
+		interval, err := time.ParseDuration(config.FlushInterval)
+		if err != nil || interval <= 0 {
+			log.Fatal("FlushInterval must be a positive duration such as \"30s\" or \"5m\", not \"" + config.FlushInterval + "\".")
+		}
+		FLUSH_INTERVAL = interval
+	}
+	IO_MEMORY_BUDGET = DEFAULT_IO_MEMORY_BUDGET
+	if config.IOMemoryMB > 0 {
+		IO_MEMORY_BUDGET = int64(config.IOMemoryMB) << 20
+	}
+	if config.UploadKBps < 0 || config.DownloadKBps < 0 {
+		log.Fatal("UploadKBps and DownloadKBps cannot be negative.")
+	}
+	S3_UPLOAD_BANDWIDTH = int64(config.UploadKBps) << 10
+	S3_DOWNLOAD_BANDWIDTH = int64(config.DownloadKBps) << 10
+	if config.VirtualSizeGB < 0 || config.VirtualFiles < 0 {
+		log.Fatal("VirtualSizeGB and VirtualFiles cannot be negative.")
+	}
+	STATFS_BLOCKS = DEFAULT_STATFS_BLOCKS
+	if config.VirtualSizeGB > 0 {
+		STATFS_BLOCKS = uint64(config.VirtualSizeGB) << 30 / BLOCK_SIZE
+	}
+	STATFS_FILES = DEFAULT_STATFS_FILES
+	if config.VirtualFiles > 0 {
+		STATFS_FILES = uint64(config.VirtualFiles)
+	}
+	err := setQuotas(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	FUSE_MOUNT_OPTIONS, err = parseMountOptions(config.MountOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.ReadaheadBlocks < 0 || config.ReadaheadReads < 0 || config.MaxPrefetches < 0 {
+		log.Fatal("ReadaheadBlocks, ReadaheadReads, and MaxPrefetches cannot be negative.")
+	}
+	READAHEAD_WINDOW = uint64(config.ReadaheadBlocks)
+	READAHEAD_TRIGGER = DEFAULT_READAHEAD_TRIGGER
+	if config.ReadaheadReads > 0 {
+		READAHEAD_TRIGGER = config.ReadaheadReads
+	}
+	MAX_PREFETCHES = DEFAULT_MAX_PREFETCHES
+	if config.MaxPrefetches > 0 {
+		MAX_PREFETCHES = int32(config.MaxPrefetches)
+	}
+	S3_OUTAGE_POLICY = OUTAGE_BLOCK
+	if config.S3OutagePolicy != "" {
+		S3_OUTAGE_POLICY = config.S3OutagePolicy
+	}
+	err = checkOutagePolicy(S3_OUTAGE_POLICY)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.OutageQueueBlocks < 0 {
+		log.Fatal("OutageQueueBlocks cannot be negative.")
+	}
+	OUTAGE_QUEUE_BLOCKS = DEFAULT_OUTAGE_QUEUE_BLOCKS
+	if config.OutageQueueBlocks > 0 {
+		OUTAGE_QUEUE_BLOCKS = config.OutageQueueBlocks
+	}
+	INODE_CACHE_SIZE = DEFAULT_INODE_CACHE_SIZE
+	if config.InodeCacheSize != 0 {
+		INODE_CACHE_SIZE = config.InodeCacheSize
+	}
+	err = setDirLimits(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setHandleLimits(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setKernelTTLs(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	INODE_CACHE_TTL = DEFAULT_INODE_CACHE_TTL
+	if config.InodeCacheTTL != "" {
+		ttl, err := time.ParseDuration(config.InodeCacheTTL)
+		if err != nil || ttl < 0 {
+			log.Fatal("InodeCacheTTL must be a duration such as \"1s\", not \"" + config.InodeCacheTTL + "\".")
+		}
+		INODE_CACHE_TTL = ttl
+	}
+	ATIME_MODE = ATIME_RELATIVE
+	if config.Atime != "" {
+		ATIME_MODE = config.Atime
+	}
+	err = checkAtimeMode(ATIME_MODE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	S3_STORAGE_CLASS = config.StorageClass
+	err = checkStorageClass(S3_STORAGE_CLASS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	WRITE_FAILURE_LIMIT = DEFAULT_WRITE_FAILURE_LIMIT
+	if config.WriteFailureLimit != 0 {
+		WRITE_FAILURE_LIMIT = config.WriteFailureLimit
+	}
+	FS_LABEL = config.Label
+	FS_DESCRIPTION = config.Description
+	OP_TIMEOUTS, err = parseOpTimeouts(config.OpTimeouts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	KEY_SCHEME = config.KeyScheme
+	err = checkKeyScheme(KEY_SCHEME)
+	if err != nil {
+		log.Fatal(err)
+	}
+	METADATA_ITEMS = config.MetadataStore == METADATA_ITEMS_STORE
+	if config.MetadataStore != "" && !METADATA_ITEMS {
+		log.Fatal("MetadataStore must be \"" + METADATA_ITEMS_STORE + "\" or left out, not \"" + config.MetadataStore + "\".")
+	}
+	if METADATA_ITEMS && config.Backend == LOCAL_BACKEND {
+		log.Fatal("MetadataStore \"" + METADATA_ITEMS_STORE + "\" needs DynamoDB, so cannot be used with the local backend.")
+	}
+	PATH_INDEX = config.PathIndex
+	SHARED_LOCKS = config.Locks == LOCKS_DYNAMODB
+	if config.Locks != "" && !SHARED_LOCKS {
+		log.Fatal("Locks must be \"" + LOCKS_DYNAMODB + "\" or left out, not \"" + config.Locks + "\".")
+	}
+	if SHARED_LOCKS && config.Backend == LOCAL_BACKEND {
+		log.Fatal("Locks \"" + LOCKS_DYNAMODB + "\" needs DynamoDB, so cannot be used with the local backend.")
+	}
+	MOUNT_LEASE_ENABLED = config.MountLease
+	if MOUNT_LEASE_ENABLED && !SHARED_LOCKS {
+		log.Fatal("MountLease is kept in the lock table, so needs Locks \"" + LOCKS_DYNAMODB + "\".")
+	}
+	err = checkSandbox(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = checkLabel(FS_LABEL, FS_DESCRIPTION)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = checkObjectLockConfig(OBJECT_LOCK_MODE, OBJECT_LOCK_DAYS)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = setProvisioning(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := newHTTPClient(CA_BUNDLE_PATH, MIN_TLS_VERSION)
+	if err != nil {
+		log.Fatal(err)
+	}
+	awsHTTPClient = client
 	return config
 }
 
 /*
-Checks if the specified S3 bucket already exists, and if it does not, attempts to create a new one.
-Exits the program on failure, as this is unrecoverable.
+Checks if the specified S3 bucket already exists, and if it does not, attempts to create a new one,
+set up as the config asks (see provisionBucket). Exits the program on failure, as this is
+unrecoverable.
 */
 func initializeBucket() {
 	client := getClient()
@@ -233,12 +575,21 @@ func initializeBucket() {
 		params := &s3.CreateBucketInput{
 			Bucket: aws.String(S3_BUCKET_NAME), // Required
 		}
+		if objectLockEnabled() {
+			// Object Lock can only be enabled when a bucket is created
+			params.ObjectLockEnabledForBucket = aws.Bool(true)
+		}
 		_, err := client.CreateBucket(params)
 		if err != nil {
 			fmt.Println("Attempted to create bucket with name " + S3_BUCKET_NAME + ", but failed.")
 			fmt.Println("Error was: " + err.Error())
 			os.Exit(2)
 		}
+		err = provisionBucket(client)
+		if err != nil {
+			fmt.Println("Created bucket with name " + S3_BUCKET_NAME + ", but failed setting it up: " + err.Error())
+			os.Exit(2)
+		}
 		// fmt.Println("created new bucket with name: " + S3_BUCKET_NAME)
 	}
 }
@@ -248,10 +599,7 @@ Helper function that initializes a client for S3.
 */
 func getClient() *s3.S3 {
 	var client *s3.S3
-	client = s3.New(session.New(&aws.Config{
-		Region:      aws.String("us-east-1"),
-		Credentials: credentials.NewSharedCredentials("", credentialsProfile),
-	}))
+	client = s3.New(session.New(newAWSConfig("s3", AWS_CLIENT_REGION)))
 	return client
 }
 
@@ -259,9 +607,6 @@ func getClient() *s3.S3 {
 Helper function that initializes a client for DynamoDB.
 */
 func getDynamoClient() *dynamodb.DynamoDB {
-	client := dynamodb.New(session.New(&aws.Config{
-		Region:      aws.String("us-east-1"),
-		Credentials: credentials.NewSharedCredentials("", credentialsProfile),
-	}))
+	client := dynamodb.New(session.New(newAWSConfig("dynamodb", AWS_CLIENT_REGION)))
 	return client
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+/*
+Struct that keeps blocks in memory. It implements both ObjectStore and CacheTable, so
+the file system can run without AWS (separate instances should be used for the two roles).
+*/
+type MemStore struct {
+	mutex sync.Mutex
+	items map[string][]byte
+}
+
+var _ ObjectStore = (*MemStore)(nil)
+var _ CacheTable = (*MemStore)(nil)
+
+/*
+Returns a pointer to a new, empty MemStore.
+*/
+func newMemStore() *MemStore {
+	return &MemStore{
+		items: make(map[string][]byte),
+	}
+}
+
+/*
+Returns a copy of the item stored with key, or an error if there is none.
+*/
+func (m *MemStore) get(key string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.items[key]
+	if !ok {
+		return nil, errors.New("No item in memory with key " + key + ".")
+	}
+	return append([]byte(nil), data...), nil
+}
+
+/*
+Stores a copy of data with key.
+*/
+func (m *MemStore) put(key string, data []byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.items[key] = append([]byte(nil), data...)
+}
+
+/*
+Removes the item stored with key, returning its data, or an error if there is none.
+*/
+func (m *MemStore) remove(key string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.items[key]
+	if !ok {
+		return nil, errors.New("No item in memory with key " + key + ".")
+	}
+	delete(m.items, key)
+	return data, nil
+}
+
+/*
+Returns the number of items stored.
+*/
+func (m *MemStore) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.items)
+}
+
+/*
+ObjectStore method that returns a copy of the item stored with key.
+*/
+func (m *MemStore) GetObject(key string) ([]byte, error) {
+	return m.get(key)
+}
+
+var _ RangeStore = (*MemStore)(nil)
+
+/*
+RangeStore method that returns a copy of length bytes at offset of the item stored with key.
+*/
+func (m *MemStore) GetObjectRange(key string, offset, length uint64) ([]byte, error) {
+	data, err := m.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)) < offset+length {
+		return nil, errors.New("Item " + key + " is shorter than the range asked for.")
+	}
+	return data[offset : offset+length], nil
+}
+
+/*
+ObjectStore method that stores a copy of data with key.
+*/
+func (m *MemStore) PutObject(key string, data []byte) error {
+	m.put(key, data)
+	return nil
+}
+
+var _ CopyingStore = (*MemStore)(nil)
+
+/*
+CopyingStore method that stores a copy of the item stored with srcKey with dstKey.
+*/
+func (m *MemStore) CopyObject(srcKey, dstKey string) error {
+	data, err := m.get(srcKey)
+	if err != nil {
+		return err
+	}
+	m.put(dstKey, data)
+	return nil
+}
+
+/*
+ObjectStore method that removes the item stored with key.
+*/
+func (m *MemStore) DeleteObject(key string) error {
+	_, err := m.remove(key)
+	return err
+}
+
+/*
+CacheTable method that returns a copy of the item stored with key.
+*/
+func (m *MemStore) GetItem(key string) ([]byte, error) {
+	return m.get(key)
+}
+
+/*
+CacheTable method that stores a copy of data with key.
+*/
+func (m *MemStore) PutItem(key string, data []byte) error {
+	m.put(key, data)
+	return nil
+}
+
+/*
+CacheTable method that removes the item stored with key, returning its data.
+*/
+func (m *MemStore) DeleteItem(key string) ([]byte, error) {
+	return m.remove(key)
+}
+
+var _ ListingTable = (*MemStore)(nil)
+
+/*
+ListingTable method that returns the keys of the items stored, in order.
+*/
+func (m *MemStore) ListItems() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	keys := make([]string, 0, len(m.items))
+	for key := range m.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
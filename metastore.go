@@ -0,0 +1,517 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the value of MetadataStore in the config that keeps the inodes and directory entries of new file
+// systems as items in a DynamoDB table, rather than packed into blocks
+const METADATA_ITEMS_STORE string = "items"
+
+// the suffix added to the name of the cache table to get the name of the metadata table
+const METADATA_TABLE_SUFFIX string = "-metadata"
+
+// the name of the item holding the inode of a directory or file in the metadata table. Names of
+// directory entries cannot contain "/", so it never clashes with one.
+const INODE_ITEM_NAME string = "/inode"
+
+// whether new file systems keep their metadata as items, from the config
+var METADATA_ITEMS bool
+
+// the store holding the inodes and directory entries of the mounted file system, or nil if they are
+// packed into blocks. It is set from the superblock by makeFs.
+var metadataStore MetadataStore
+
+// the store that file systems keeping their metadata as items use with the configured backend, or
+// nil if the backend has none
+var backendMetadataStore MetadataStore
+
+// the code DynamoDB gives as the reason a transaction was canceled when one of its conditions failed
+const TRANSACTION_CONDITION_FAILED string = "ConditionalCheckFailed"
+
+// returned by the conditional updates of a MetadataStore when the entry is not what was expected,
+// because another mount changed it
+var errEntryChanged = errors.New("the directory entry was changed by another writer")
+
+/*
+Interface for the store holding inodes and directory entries as individual items, rather than
+packed into blocks, so that changing one never reads and rewrites the others. In production this is
+a DynamoDB table keyed by directory inode number and name.
+
+The entries "." and ".." are not kept as items, but in the table in the directory's inode, which
+never holds any other entries. PutEntry and DeleteEntry are conditional: they only change the entry
+if it points to prev, where INVALID_INODE means that the entry must not exist, and return
+errEntryChanged otherwise. GetEntry returns INVALID_INODE for an entry that does not exist.
+ForEachEntry calls fn with the entries of a directory in name order, stopping at the first error fn
+returns and returning it, without holding all of them at once.
+Transact makes a list of such writes together: either all of them or, if any condition fails, none.
+*/
+type MetadataStore interface {
+	GetInode(inodeNum uint64) ([]byte, error)
+	PutInode(inodeNum uint64, data []byte) error
+	GetEntry(dirNum uint64, name string) (uint64, error)
+	PutEntry(dirNum uint64, name string, inodeNum, prev uint64) error
+	DeleteEntry(dirNum uint64, name string, prev uint64) error
+	ListEntries(dirNum uint64) (map[string]uint64, error)
+	ForEachEntry(dirNum uint64, fn func(name string, inodeNum uint64) error) error
+	Transact(writes []metadataWrite) error
+}
+
+/*
+Struct describing one write of a transaction on a MetadataStore: either of an inode, whose item has
+the inode number and INODE_ITEM_NAME, or of a directory entry, conditional on prev like PutEntry and
+DeleteEntry. A transaction writes each item at most once.
+*/
+type metadataWrite struct {
+	dirNum   uint64 // the directory of the entry, or the number of the inode
+	name     string // the name of the entry, or INODE_ITEM_NAME
+	inodeNum uint64 // what the entry is to point to, or INVALID_INODE to delete it
+	prev     uint64 // what the entry must point to first
+	data     []byte // the inode
+}
+
+/*
+Returns whether the write is of an inode rather than of a directory entry.
+*/
+func (w *metadataWrite) isInode() bool {
+	return w.name == INODE_ITEM_NAME
+}
+
+/*
+Returns the store to keep the metadata of the file system described by info in, or an error if it
+keeps its metadata as items and the backend has no store for them.
+*/
+func openMetadataStore(info *SuperblockInfo) (MetadataStore, error) {
+	if !info.MetadataItems {
+		return nil, nil
+	}
+	if backendMetadataStore == nil {
+		return nil, errors.New("The file system keeps its metadata as DynamoDB items, which this backend does not support.")
+	}
+	return backendMetadataStore, nil
+}
+
+/*
+MetadataStore that keeps its items in memory, for tests.
+*/
+type memMetadataStore struct {
+	mutex   sync.Mutex
+	inodes  map[uint64][]byte
+	entries map[uint64]map[string]uint64
+}
+
+var _ MetadataStore = (*memMetadataStore)(nil)
+
+/*
+Returns a pointer to a new, empty memMetadataStore.
+*/
+func newMemMetadataStore() *memMetadataStore {
+	return &memMetadataStore{
+		inodes:  make(map[uint64][]byte),
+		entries: make(map[uint64]map[string]uint64),
+	}
+}
+
+/*
+Returns a copy of the inode with inodeNum.
+*/
+func (m *memMetadataStore) GetInode(inodeNum uint64) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	data, ok := m.inodes[inodeNum]
+	if !ok {
+		return nil, fmt.Errorf("No inode %d in the metadata store.", inodeNum)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+/*
+Stores a copy of data as the inode with inodeNum.
+*/
+func (m *memMetadataStore) PutInode(inodeNum uint64, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.inodes[inodeNum] = append([]byte(nil), data...)
+	return nil
+}
+
+/*
+Returns the inode number of the entry name in the directory with dirNum.
+*/
+func (m *memMetadataStore) GetEntry(dirNum uint64, name string) (uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.entries[dirNum][name], nil
+}
+
+/*
+Points the entry name in the directory with dirNum at inodeNum, if it points to prev.
+*/
+func (m *memMetadataStore) PutEntry(dirNum uint64, name string, inodeNum, prev uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.entries[dirNum][name] != prev {
+		return errEntryChanged
+	}
+	if m.entries[dirNum] == nil {
+		m.entries[dirNum] = make(map[string]uint64)
+	}
+	m.entries[dirNum][name] = inodeNum
+	return nil
+}
+
+/*
+Deletes the entry name in the directory with dirNum, if it points to prev.
+*/
+func (m *memMetadataStore) DeleteEntry(dirNum uint64, name string, prev uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.entries[dirNum][name] != prev {
+		return errEntryChanged
+	}
+	delete(m.entries[dirNum], name)
+	return nil
+}
+
+/*
+Returns a copy of the entries of the directory with dirNum.
+*/
+func (m *memMetadataStore) ListEntries(dirNum uint64) (map[string]uint64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entries := make(map[string]uint64, len(m.entries[dirNum]))
+	for name, inodeNum := range m.entries[dirNum] {
+		entries[name] = inodeNum
+	}
+	return entries, nil
+}
+
+/*
+Calls fn with the entries of the directory with dirNum in name order, from a copy of them, so that fn
+may change the directory.
+*/
+func (m *memMetadataStore) ForEachEntry(dirNum uint64, fn func(name string, inodeNum uint64) error) error {
+	entries, _ := m.ListEntries(dirNum)
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := fn(name, entries[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Checks the conditions of all the writes, then makes them if they all hold, returning errEntryChanged
+without making any otherwise.
+*/
+func (m *memMetadataStore) Transact(writes []metadataWrite) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, w := range writes {
+		if !w.isInode() && m.entries[w.dirNum][w.name] != w.prev {
+			return errEntryChanged
+		}
+	}
+	for _, w := range writes {
+		switch {
+		case w.isInode():
+			m.inodes[w.dirNum] = append([]byte(nil), w.data...)
+		case w.inodeNum == INVALID_INODE:
+			delete(m.entries[w.dirNum], w.name)
+		default:
+			if m.entries[w.dirNum] == nil {
+				m.entries[w.dirNum] = make(map[string]uint64)
+			}
+			m.entries[w.dirNum][w.name] = w.inodeNum
+		}
+	}
+	return nil
+}
+
+/*
+MetadataStore backed by a DynamoDB table with the number "Dir" as its hash key and the string
+"Name" as its range key. Directory entries are items with the number of the directory and the name
+of the entry, and the inode number they point to in "Inode". Inodes are items with their own number
+and INODE_ITEM_NAME, and the inode in the binary "Value".
+*/
+type dynamoMetadataStore struct {
+	client *dynamodb.DynamoDB
+	name   string
+}
+
+var _ MetadataStore = (*dynamoMetadataStore)(nil)
+
+/*
+Returns a MetadataStore that uses the DynamoDB table with the given name.
+*/
+func newDynamoMetadataStore(client *dynamodb.DynamoDB, name string) *dynamoMetadataStore {
+	return &dynamoMetadataStore{
+		client: client,
+		name:   name,
+	}
+}
+
+/*
+Creates the metadata table if it does not exist, and waits for it to be ready. Exits the program on
+failure, as initializeCache does.
+*/
+func (t *dynamoMetadataStore) initialize() {
+	isReady, err := checkTableReady(t.name, t.client)
+	if err != nil {
+		_, err := t.client.CreateTable(provisionTable(&dynamodb.CreateTableInput{
+			AttributeDefinitions: []*dynamodb.AttributeDefinition{
+				{AttributeName: aws.String("Dir"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+				{AttributeName: aws.String("Name"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			},
+			KeySchema: []*dynamodb.KeySchemaElement{
+				{AttributeName: aws.String("Dir"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+				{AttributeName: aws.String("Name"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+			},
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+				ReadCapacityUnits:  aws.Int64(READ_WRITE_CAPACITY),
+				WriteCapacityUnits: aws.Int64(READ_WRITE_CAPACITY),
+			},
+			TableName: aws.String(t.name),
+		}))
+		if err != nil {
+			fmt.Println("Error trying to create DynamoDB table with name: " + t.name + ", but failed")
+			fmt.Println("Error was: " + err.Error())
+			os.Exit(2)
+		}
+	}
+	for !isReady {
+		time.Sleep(time.Second)
+		isReady, _ = checkTableReady(t.name, t.client)
+	}
+}
+
+/*
+Returns the key of the item with the given directory (or inode) number and name.
+*/
+func metadataKey(dirNum uint64, name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"Dir":  {N: aws.String(strconv.FormatUint(dirNum, 10))},
+		"Name": {S: aws.String(name)},
+	}
+}
+
+/*
+Returns the condition, and the values and names it uses, that an entry points to prev, or does not
+exist if prev is INVALID_INODE.
+*/
+func entryCondition(prev uint64) (*string, map[string]*dynamodb.AttributeValue, map[string]*string) {
+	names := map[string]*string{"#n": aws.String("Name")}
+	if prev == INVALID_INODE {
+		return aws.String("attribute_not_exists(#n)"), nil, names
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":prev": {N: aws.String(strconv.FormatUint(prev, 10))},
+	}
+	return aws.String("attribute_exists(#n) AND Inode = :prev"), values, names
+}
+
+/*
+Returns errEntryChanged if err is DynamoDB refusing a conditional update, or canceling a transaction
+because a condition in it failed, and err otherwise.
+*/
+func conditionError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if strings.Contains(msg, dynamodb.ErrCodeConditionalCheckFailedException) ||
+		strings.Contains(msg, dynamodb.ErrCodeTransactionCanceledException) && strings.Contains(msg, TRANSACTION_CONDITION_FAILED) {
+		return errEntryChanged
+	}
+	return err
+}
+
+/*
+Does a consistent read of the inode with inodeNum.
+*/
+func (t *dynamoMetadataStore) GetInode(inodeNum uint64) ([]byte, error) {
+	resp, err := t.client.GetItemWithContext(awsContext(), &dynamodb.GetItemInput{
+		Key:            metadataKey(inodeNum, INODE_ITEM_NAME),
+		TableName:      aws.String(t.name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Item["Value"] == nil {
+		return nil, fmt.Errorf("No inode %d in the metadata table.", inodeNum)
+	}
+	return resp.Item["Value"].B, nil
+}
+
+/*
+Puts the inode with inodeNum.
+*/
+func (t *dynamoMetadataStore) PutInode(inodeNum uint64, data []byte) error {
+	item := metadataKey(inodeNum, INODE_ITEM_NAME)
+	item["Value"] = &dynamodb.AttributeValue{B: data}
+	_, err := t.client.PutItemWithContext(awsContext(), &dynamodb.PutItemInput{
+		Item:      item,
+		TableName: aws.String(t.name),
+	})
+	return err
+}
+
+/*
+Does a consistent read of the entry name in the directory with dirNum.
+*/
+func (t *dynamoMetadataStore) GetEntry(dirNum uint64, name string) (uint64, error) {
+	resp, err := t.client.GetItemWithContext(awsContext(), &dynamodb.GetItemInput{
+		Key:            metadataKey(dirNum, name),
+		TableName:      aws.String(t.name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || resp.Item["Inode"] == nil {
+		return INVALID_INODE, err
+	}
+	return strconv.ParseUint(aws.StringValue(resp.Item["Inode"].N), 10, 64)
+}
+
+/*
+Points the entry name in the directory with dirNum at inodeNum, if it points to prev.
+*/
+func (t *dynamoMetadataStore) PutEntry(dirNum uint64, name string, inodeNum, prev uint64) error {
+	item := metadataKey(dirNum, name)
+	item["Inode"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatUint(inodeNum, 10))}
+	condition, values, names := entryCondition(prev)
+	_, err := t.client.PutItemWithContext(awsContext(), &dynamodb.PutItemInput{
+		Item:                      item,
+		TableName:                 aws.String(t.name),
+		ConditionExpression:       condition,
+		ExpressionAttributeValues: values,
+		ExpressionAttributeNames:  names,
+	})
+	return conditionError(err)
+}
+
+/*
+Deletes the entry name in the directory with dirNum, if it points to prev.
+*/
+func (t *dynamoMetadataStore) DeleteEntry(dirNum uint64, name string, prev uint64) error {
+	condition, values, names := entryCondition(prev)
+	_, err := t.client.DeleteItemWithContext(awsContext(), &dynamodb.DeleteItemInput{
+		Key:                       metadataKey(dirNum, name),
+		TableName:                 aws.String(t.name),
+		ConditionExpression:       condition,
+		ExpressionAttributeValues: values,
+		ExpressionAttributeNames:  names,
+	})
+	return conditionError(err)
+}
+
+/*
+Returns the entries of the directory with dirNum, querying a page of them at a time.
+*/
+func (t *dynamoMetadataStore) ListEntries(dirNum uint64) (map[string]uint64, error) {
+	entries := make(map[string]uint64)
+	err := t.ForEachEntry(dirNum, func(name string, inodeNum uint64) error {
+		entries[name] = inodeNum
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+/*
+Calls fn with the entries of the directory with dirNum, querying a page of them at a time, which
+DynamoDB returns in the order of their names, the sort key.
+*/
+func (t *dynamoMetadataStore) ForEachEntry(dirNum uint64, fn func(name string, inodeNum uint64) error) error {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(t.name),
+		KeyConditionExpression: aws.String("#d = :dir"),
+		ExpressionAttributeNames: map[string]*string{
+			"#d": aws.String("Dir"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dir": {N: aws.String(strconv.FormatUint(dirNum, 10))},
+		},
+		ConsistentRead: aws.Bool(true),
+	}
+	for {
+		resp, err := t.client.QueryWithContext(awsContext(), input)
+		if err != nil {
+			return err
+		}
+		for _, item := range resp.Items {
+			if item["Name"] == nil || item["Inode"] == nil {
+				// the item holding the inode of the directory
+				continue
+			}
+			inodeNum, err := strconv.ParseUint(aws.StringValue(item["Inode"].N), 10, 64)
+			if err != nil {
+				return err
+			}
+			err = fn(aws.StringValue(item["Name"].S), inodeNum)
+			if err != nil {
+				return err
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+/*
+Makes the writes with a single TransactWriteItems call, so that DynamoDB makes all of them or none.
+*/
+func (t *dynamoMetadataStore) Transact(writes []metadataWrite) error {
+	items := make([]*dynamodb.TransactWriteItem, 0, len(writes))
+	for _, w := range writes {
+		if w.isInode() {
+			item := metadataKey(w.dirNum, INODE_ITEM_NAME)
+			item["Value"] = &dynamodb.AttributeValue{B: w.data}
+			items = append(items, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+				Item:      item,
+				TableName: aws.String(t.name),
+			}})
+			continue
+		}
+		condition, values, names := entryCondition(w.prev)
+		if w.inodeNum == INVALID_INODE {
+			items = append(items, &dynamodb.TransactWriteItem{Delete: &dynamodb.Delete{
+				Key:                       metadataKey(w.dirNum, w.name),
+				TableName:                 aws.String(t.name),
+				ConditionExpression:       condition,
+				ExpressionAttributeValues: values,
+				ExpressionAttributeNames:  names,
+			}})
+			continue
+		}
+		item := metadataKey(w.dirNum, w.name)
+		item["Inode"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatUint(w.inodeNum, 10))}
+		items = append(items, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			Item:                      item,
+			TableName:                 aws.String(t.name),
+			ConditionExpression:       condition,
+			ExpressionAttributeValues: values,
+			ExpressionAttributeNames:  names,
+		}})
+	}
+	_, err := t.client.TransactWriteItemsWithContext(awsContext(), &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	return conditionError(err)
+}
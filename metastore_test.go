@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Returns a new file system keeping its metadata as items in memory, like newTestFs.
+*/
+func newItemsTestFs(t *testing.T, cacheSize int) (*FS, *memMetadataStore) {
+	t.Helper()
+	items := newMemMetadataStore()
+	METADATA_ITEMS = true
+	backendMetadataStore = items
+	t.Cleanup(func() {
+		METADATA_ITEMS = false
+		backendMetadataStore = nil
+		metadataStore = nil
+	})
+	filesys, _ := newTestFs(t, cacheSize)
+	return filesys, items
+}
+
+/*
+Runs the directory operations on a file system keeping its metadata as items, and checks that the
+inodes and entries are items rather than blocks, that fsck finds no problem, and that entries changed
+by another mount are not overwritten.
+*/
+func TestMetadataItems(t *testing.T) {
+	filesys, items := newItemsTestFs(t, 16)
+	if !filesys.info.MetadataItems || metadataStore == nil {
+		t.Fatalf("new file system does not keep its metadata as items")
+	}
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	dir := node.(*Dir)
+	data := testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1)
+	file := writeTestFile(t, dir, "file", data, 1<<16)
+	writeTestFile(t, root, "other", testData(100, 2), 100)
+	if err := dir.Rename(ctx, &fuse.RenameRequest{OldName: "file", NewName: "moved"}, root); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "other"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	if cache.keyHash[genInodeBlockKey(ROOT_INODE)] != nil {
+		t.Fatalf("the inodes are in a block")
+	}
+	if entries, _ := items.ListEntries(ROOT_INODE); len(entries) != 2 || entries["moved"] != file.inodeNum {
+		t.Fatalf("the root has entry items %v", entries)
+	}
+	var entryNames []string
+	forEachEntry(ROOT_INODE, root.inode, func(name string, inodeNum uint64) error {
+		entryNames = append(entryNames, name)
+		return nil
+	})
+	if !equalStrings(entryNames, []string{"dir", "moved"}) {
+		t.Fatalf("forEachEntry of the root visited %v", entryNames)
+	}
+	handle, _ := root.Open(ctx, new(fuse.OpenRequest), new(fuse.OpenResponse))
+	var names []string
+	for _, dirent := range handle.(*DirHandle).readDirAll() {
+		names = append(names, dirent.Name)
+	}
+	handle.(*DirHandle).Release(ctx, new(fuse.ReleaseRequest))
+	if !equalStrings(names, []string{".", "..", "dir", "moved"}) {
+		t.Fatalf("the root lists %v", names)
+	}
+	node, err = lookupNode(filesys, "/moved")
+	if err != nil {
+		t.Fatalf("lookupNode: %v", err)
+	}
+	inode := node.(*File).inode
+	got, err := inode.readFromData(0, inode.Size)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes of the moved file, err %v", len(got), err)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 || report.files != 1 || report.dirs != 2 {
+		t.Fatalf("fsck: %+v", report)
+	}
+
+	// another mount adding an entry, or replacing one, first
+	items.PutEntry(ROOT_INODE, "raced", file.inodeNum, INVALID_INODE)
+	if err := root.addFile("raced", file.inodeNum); err != fuse.EEXIST {
+		t.Fatalf("adding an entry added by another mount returned %v", err)
+	}
+	if err := root.setEntry("moved", dir.inodeNum, INVALID_INODE); err != fuse.EEXIST {
+		t.Fatalf("replacing an entry changed by another mount returned %v", err)
+	}
+	if inodeNum, _ := items.GetEntry(ROOT_INODE, "moved"); inodeNum != file.inodeNum {
+		t.Fatalf("the entry changed by another mount was overwritten")
+	}
+}
+
+/*
+MetadataStore that counts its transactions, and refuses them while refuse is set, as DynamoDB does
+when another mount changed an entry in one.
+*/
+type refusingMetadataStore struct {
+	*memMetadataStore
+	transactions int
+	refuse       bool
+}
+
+/*
+Counts the transaction, and makes its writes unless they are to be refused.
+*/
+func (s *refusingMetadataStore) Transact(writes []metadataWrite) error {
+	s.transactions++
+	if s.refuse {
+		return errEntryChanged
+	}
+	return s.memMetadataStore.Transact(writes)
+}
+
+/*
+Checks that a transaction makes none of its writes if one of its conditions fails, and all of them
+otherwise.
+*/
+func TestMetadataTransact(t *testing.T) {
+	items := newMemMetadataStore()
+	items.PutEntry(1, "a", 5, INVALID_INODE)
+	writes := []metadataWrite{
+		{dirNum: 1, name: "a", inodeNum: INVALID_INODE, prev: 5},
+		{dirNum: 2, name: "b", inodeNum: 5, prev: 6},
+		{dirNum: 5, name: INODE_ITEM_NAME, data: []byte{1}},
+	}
+	if err := items.Transact(writes); err != errEntryChanged {
+		t.Fatalf("a transaction with a failed condition returned %v", err)
+	}
+	if inodeNum, _ := items.GetEntry(1, "a"); inodeNum != 5 {
+		t.Fatalf("a refused transaction deleted an entry")
+	}
+	if _, err := items.GetInode(5); err == nil {
+		t.Fatalf("a refused transaction wrote an inode")
+	}
+	writes[1].prev = INVALID_INODE
+	if err := items.Transact(writes); err != nil {
+		t.Fatalf("Transact: %v", err)
+	}
+	a, _ := items.GetEntry(1, "a")
+	b, _ := items.GetEntry(2, "b")
+	if data, err := items.GetInode(5); a != INVALID_INODE || b != 5 || err != nil || !bytes.Equal(data, []byte{1}) {
+		t.Fatalf("after the transaction a=%d b=%d inode=%v err=%v", a, b, data, err)
+	}
+}
+
+/*
+Checks that renaming a file over another in a different directory, linking, and removing each write
+their items in one transaction, and that a refused transaction leaves the entries, the link counts,
+and the data of the replaced file as they were.
+*/
+func TestMetadataTransactions(t *testing.T) {
+	filesys, items := newItemsTestFs(t, 16)
+	store := &refusingMetadataStore{memMetadataStore: items}
+	metadataStore = store
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	dir := node.(*Dir)
+	file := writeTestFile(t, root, "file", testData(100, 1), 100)
+	data := testData(int(INODE_BUFFER_SIZE+BLOCK_SIZE), 2)
+	replaced := writeTestFile(t, dir, "replaced", data, 1<<16)
+
+	store.refuse = true
+	rename := &fuse.RenameRequest{OldName: "file", NewName: "replaced"}
+	if err := root.Rename(ctx, rename, dir); err != fuse.ENOENT {
+		t.Fatalf("a rename whose transaction was refused returned %v", err)
+	}
+	if _, err := root.Link(ctx, &fuse.LinkRequest{NewName: "link"}, file); err != fuse.EEXIST {
+		t.Fatalf("a link whose transaction was refused returned %v", err)
+	}
+	if err := dir.Remove(ctx, &fuse.RemoveRequest{Name: "replaced"}); err != fuse.ENOENT {
+		t.Fatalf("a removal whose transaction was refused returned %v", err)
+	}
+	if inodeNum, _ := items.GetEntry(ROOT_INODE, "file"); inodeNum != file.inodeNum {
+		t.Fatalf("a refused rename removed the old name")
+	}
+	if inodeNum, _ := items.GetEntry(dir.inodeNum, "replaced"); inodeNum != replaced.inodeNum {
+		t.Fatalf("a refused rename replaced the new name")
+	}
+	if inodeNum, _ := items.GetEntry(ROOT_INODE, "link"); inodeNum != INVALID_INODE {
+		t.Fatalf("a refused link added its entry")
+	}
+	for _, f := range []*File{file, replaced} {
+		if inode, err := getInode(f.inodeNum); err != nil || inode.LinkCount != 1 {
+			t.Fatalf("inode %d has LinkCount %d after refused transactions, err %v", f.inodeNum, inode.LinkCount, err)
+		}
+	}
+	inode, _ := getInode(replaced.inodeNum)
+	if got, err := inode.readFromData(0, inode.Size); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("the data of the file not replaced was lost, err %v", err)
+	}
+
+	store.refuse = false
+	store.transactions = 0
+	if err := root.Rename(ctx, rename, dir); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := dir.Link(ctx, &fuse.LinkRequest{NewName: "link"}, file); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if err := dir.Remove(ctx, &fuse.RemoveRequest{Name: "link"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if store.transactions != 3 {
+		t.Fatalf("rename, link, and remove made %d transactions", store.transactions)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 || report.files != 1 {
+		t.Fatalf("fsck: %+v", report)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+/*
+Struct collecting the writes to metadata items that one operation makes, so that they are made
+together by a single transaction of the MetadataStore when the operation is done. Without it, a crash
+or an error between the writes of a rename or an unlink leaves an entry pointing to a freed inode,
+or a link count that does not match the entries.
+*/
+type metadataTransaction struct {
+	writes    []metadataWrite
+	committed []func() error // what to do once the writes are made, such as deleting the data of freed inodes
+}
+
+// the transaction of the operation being handled, or nil if writes go to the metadata store at once.
+// It is only set while fsLock is held, by the operations that write several items.
+var metadataTxn *metadataTransaction
+
+/*
+Starts collecting the metadata writes of the operation into a transaction, if the file system keeps
+its metadata as items. Each call is followed by one to commitMetadataTransaction.
+*/
+func beginMetadataTransaction() {
+	if metadataStore != nil {
+		metadataTxn = new(metadataTransaction)
+	}
+}
+
+/*
+Ends the transaction of the operation. If err is nil, its writes are made together and then what was
+to be done after them; otherwise they are dropped, and none of them is made. Returns err, or the
+error of making the writes, which is errEntryChanged if another mount changed one of the entries.
+*/
+func commitMetadataTransaction(err error) error {
+	txn := metadataTxn
+	metadataTxn = nil
+	if txn == nil || err != nil {
+		return err
+	}
+	if len(txn.writes) != 0 {
+		err = metadataStore.Transact(txn.writes)
+		if err != nil {
+			return err
+		}
+	}
+	for _, fn := range txn.committed {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Adds w to the transaction. A later write of an item already written replaces the earlier one, but
+keeps its condition, which is what the item must be before the transaction.
+*/
+func (t *metadataTransaction) add(w metadataWrite) {
+	for i := range t.writes {
+		if t.writes[i].dirNum == w.dirNum && t.writes[i].name == w.name {
+			w.prev = t.writes[i].prev
+			t.writes[i] = w
+			return
+		}
+	}
+	t.writes = append(t.writes, w)
+}
+
+/*
+Returns the bytes of the inode with inodeNum written in the transaction, if it was.
+*/
+func (t *metadataTransaction) inodeData(inodeNum uint64) ([]byte, bool) {
+	for _, w := range t.writes {
+		if w.isInode() && w.dirNum == inodeNum {
+			return w.data, true
+		}
+	}
+	return nil, false
+}
+
+/*
+Runs fn once the writes of the current transaction are made, or now if there is none. Things that
+cannot be undone, like deleting data, wait for the transaction, so that they are not done for writes
+that are then refused.
+*/
+func afterMetadataCommit(fn func() error) error {
+	if metadataTxn == nil {
+		return fn()
+	}
+	metadataTxn.committed = append(metadataTxn.committed, fn)
+	return nil
+}
+
+/*
+Stores the (sealed) bytes of the inode with inodeNum as its item, or adds them to the transaction.
+*/
+func putInodeItem(inodeNum uint64, data []byte) error {
+	if metadataTxn != nil {
+		metadataTxn.add(metadataWrite{dirNum: inodeNum, name: INODE_ITEM_NAME, data: append([]byte(nil), data...)})
+		return nil
+	}
+	return metadataStore.PutInode(inodeNum, data)
+}
+
+/*
+Points the entry name of the directory with dirNum at inodeNum if it points to prev, as PutEntry
+does, or adds the write to the transaction.
+*/
+func putEntryItem(dirNum uint64, name string, inodeNum, prev uint64) error {
+	if metadataTxn != nil {
+		metadataTxn.add(metadataWrite{dirNum: dirNum, name: name, inodeNum: inodeNum, prev: prev})
+		return nil
+	}
+	return metadataStore.PutEntry(dirNum, name, inodeNum, prev)
+}
+
+/*
+Deletes the entry name of the directory with dirNum if it points to prev, as DeleteEntry does, or
+adds the deletion to the transaction.
+*/
+func deleteEntryItem(dirNum uint64, name string, prev uint64) error {
+	if metadataTxn != nil {
+		metadataTxn.add(metadataWrite{dirNum: dirNum, name: name, inodeNum: INVALID_INODE, prev: prev})
+		return nil
+	}
+	return metadataStore.DeleteEntry(dirNum, name, prev)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"bazil.org/fuse"
+)
+
+// the command to unmount the file system by hand if it is left mounted. Unless the sysctl
+// vfs.usermount is set, only root can unmount it.
+const UNMOUNT_COMMAND string = "umount"
+
+/*
+Returns the options the file system is mounted with. mount_fusefs has no subtype option, and the
+FUSE library passes options to it without escaping, so they cannot contain commas.
+*/
+func mountOptions(label string) []fuse.MountOption {
+	return []fuse.MountOption{fuse.FSName(mountName(label))}
+}
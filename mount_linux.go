@@ -0,0 +1,16 @@
+package main
+
+import (
+	"bazil.org/fuse"
+)
+
+// the command to unmount the file system by hand if it is left mounted
+const UNMOUNT_COMMAND string = "fusermount -u"
+
+/*
+Returns the options the file system with label is mounted with, which show it as cloudfusion (see
+mountName) in mount and df.
+*/
+func mountOptions(label string) []fuse.MountOption {
+	return []fuse.MountOption{fuse.FSName(mountName(label)), fuse.Subtype(FS_NAME)}
+}
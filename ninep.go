@@ -0,0 +1,1151 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the only 9P dialect served, which is the one the Linux kernel uses for Linux guests
+const NINEP_VERSION string = "9P2000.L"
+
+// the largest message accepted, which bounds the size of reads and writes
+const NINEP_MAX_MSIZE uint32 = 1 << 20
+
+// the room to leave in a message for the header of a read or write reply
+const NINEP_IOHDRSZ uint32 = 24
+
+// the fid sent when there is none, and the uid sent when the user is not known
+const NINEP_NOFID uint32 = ^uint32(0)
+const NINEP_NONUNAME uint32 = ^uint32(0)
+
+// the f_type reported by statfs for 9P file systems
+const NINEP_MAGIC uint32 = 0x01021997
+
+// the 9P2000.L messages that are served. Each reply has the type of its request plus one.
+const (
+	NINEP_TLERROR   uint8 = 6
+	NINEP_TSTATFS   uint8 = 8
+	NINEP_TLOPEN    uint8 = 12
+	NINEP_TLCREATE  uint8 = 14
+	NINEP_TSYMLINK  uint8 = 16
+	NINEP_TRENAME   uint8 = 20
+	NINEP_TREADLINK uint8 = 22
+	NINEP_TGETATTR  uint8 = 24
+	NINEP_TSETATTR  uint8 = 26
+	NINEP_TREADDIR  uint8 = 40
+	NINEP_TFSYNC    uint8 = 50
+	NINEP_TMKDIR    uint8 = 72
+	NINEP_TRENAMEAT uint8 = 74
+	NINEP_TUNLINKAT uint8 = 76
+	NINEP_TVERSION  uint8 = 100
+	NINEP_TATTACH   uint8 = 104
+	NINEP_TFLUSH    uint8 = 108
+	NINEP_TWALK     uint8 = 110
+	NINEP_TREAD     uint8 = 116
+	NINEP_TWRITE    uint8 = 118
+	NINEP_TCLUNK    uint8 = 120
+	NINEP_TREMOVE   uint8 = 122
+)
+
+// the qid types of directories, symbolic links, and files
+const NINEP_QTDIR uint8 = 0x80
+const NINEP_QTSYMLINK uint8 = 0x02
+const NINEP_QTFILE uint8 = 0
+
+// the flag of Tunlinkat that removes a directory
+const NINEP_AT_REMOVEDIR uint32 = 0x200
+
+// the fields of Rgetattr that are filled in, and the generation, which is when the file system
+// keeps generations
+const NINEP_GETATTR_BASIC uint64 = 0x7ff
+const NINEP_GETATTR_GEN uint64 = 0x800
+
+var errNinePShortMessage = fuse.Errno(syscall.EINVAL)
+
+/*
+Struct that decodes the fields of a 9P message. Reading past the end of the message sets err
+instead of failing each read, so handlers check it once after reading every field.
+*/
+type ninePReader struct {
+	data []byte
+	err  error
+}
+
+/*
+Returns the next n bytes of the message.
+*/
+func (r *ninePReader) next(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = errNinePShortMessage
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *ninePReader) u8() uint8   { return r.next(1)[0] }
+func (r *ninePReader) u16() uint16 { return binary.LittleEndian.Uint16(r.next(2)) }
+func (r *ninePReader) u32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *ninePReader) u64() uint64 { return binary.LittleEndian.Uint64(r.next(8)) }
+
+/*
+Returns the next string of the message, which is prefixed with its length.
+*/
+func (r *ninePReader) str() string {
+	return string(r.next(int(r.u16())))
+}
+
+/*
+Struct that encodes the fields of a 9P message.
+*/
+type ninePWriter struct {
+	buf []byte
+}
+
+func (w *ninePWriter) u8(v uint8) *ninePWriter {
+	w.buf = append(w.buf, v)
+	return w
+}
+
+func (w *ninePWriter) u16(v uint16) *ninePWriter {
+	w.buf = append(w.buf, byte(v), byte(v>>8))
+	return w
+}
+
+func (w *ninePWriter) u32(v uint32) *ninePWriter {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+	return w
+}
+
+func (w *ninePWriter) u64(v uint64) *ninePWriter {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+	return w
+}
+
+func (w *ninePWriter) str(s string) *ninePWriter {
+	w.u16(uint16(len(s)))
+	w.buf = append(w.buf, s...)
+	return w
+}
+
+/*
+Appends a qid, which identifies a file to the client by its inode number.
+*/
+func (w *ninePWriter) qid(isDir bool, inodeNum uint64) *ninePWriter {
+	if isDir {
+		w.u8(NINEP_QTDIR)
+	} else {
+		w.u8(NINEP_QTFILE)
+	}
+	return w.u32(0).u64(inodeNum)
+}
+
+/*
+Appends the qid of a symbolic link.
+*/
+func (w *ninePWriter) linkQid(inodeNum uint64) *ninePWriter {
+	return w.u8(NINEP_QTSYMLINK).u32(0).u64(inodeNum)
+}
+
+/*
+Struct representing a 9P server of a file system. Requests are translated to calls of the same
+Dir, File, and handle methods that serve FUSE requests.
+
+Nodes are built from a fresh copy of their inode for each request, since the client can hold any
+number of fids for the same file, and a stale inode would overwrite changes made through the others.
+Requests from all connections are served one at a time, so no inode changes between being read and
+being used. Only open files keep their inode between requests, shared by every fid open on the file
+so that the data written through each is seen by the others.
+*/
+type ninePServer struct {
+	filesys *FS
+	lock    sync.Mutex
+	open    map[uint64]*ninePOpenFile
+}
+
+/*
+Struct representing a file open through one or more fids.
+*/
+type ninePOpenFile struct {
+	inode *Inode
+	refs  int
+}
+
+/*
+Struct representing a 9P connection, and the fids the client has set up on it.
+*/
+type ninePConn struct {
+	server *ninePServer
+	conn   io.ReadWriter
+	msize  uint32
+	fids   map[uint32]*ninePFid
+}
+
+/*
+Struct representing a fid, which refers to a file or directory the client has walked to.
+*/
+type ninePFid struct {
+	inodeNum   uint64
+	generation uint64 // the generation of the file of inodeNum when the fid was walked to it
+	parentNum  uint64 // inode of the directory the fid was walked to from, used to remove and rename it
+	parentGen  uint64 // the generation of the directory of parentNum
+	name       string
+	path       string
+	isDir      bool
+	isLink     bool
+	uid        uint32
+	opened     bool
+	handle     *FileHandle       // set when an open file
+	dirents    []fuse.Dirent     // sorted entries of an open directory
+	dirTable   map[string]uint64 // inode numbers of the entries of an open directory
+}
+
+/*
+Returns a new 9P server of the file system.
+*/
+func newNinePServer(filesys *FS) *ninePServer {
+	return &ninePServer{
+		filesys: filesys,
+		open:    make(map[uint64]*ninePOpenFile),
+	}
+}
+
+/*
+Accepts connections on listener and serves each of them, until the listener fails.
+*/
+func (s *ninePServer) serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			err := s.serveConn(conn)
+			if err != nil && err != io.EOF {
+				fmt.Println("9P connection from " + conn.RemoteAddr().String() + " failed: " + err.Error())
+			}
+		}()
+	}
+}
+
+/*
+Serves the requests of a single connection until it is closed, then clunks its remaining fids.
+*/
+func (s *ninePServer) serveConn(conn io.ReadWriter) error {
+	c := &ninePConn{
+		server: s,
+		conn:   conn,
+		msize:  NINEP_MAX_MSIZE,
+		fids:   make(map[uint32]*ninePFid),
+	}
+	defer func() {
+		s.lock.Lock()
+		c.clunkAll()
+		s.lock.Unlock()
+	}()
+	for {
+		msgType, tag, body, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+		s.lock.Lock()
+		reply, err := c.handle(msgType, &ninePReader{data: body})
+		s.lock.Unlock()
+		if err != nil {
+			msgType = NINEP_TLERROR
+			reply = new(ninePWriter).u32(ninePErrno(err))
+		}
+		err = c.writeMessage(msgType+1, tag, reply.buf)
+		ioMemory.release(int64(len(body)))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+Reads a message from the connection, returning its type, tag, and body. The body is taken from
+ioMemory, and has to be released once the message is replied to.
+*/
+func (c *ninePConn) readMessage() (uint8, uint16, []byte, error) {
+	var header [7]byte
+	_, err := io.ReadFull(c.conn, header[:])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	if size < 7 || size > c.msize {
+		return 0, 0, nil, errors.New("message of " + strconv.Itoa(int(size)) + " bytes does not fit msize")
+	}
+	ioMemory.acquire(int64(size - 7))
+	body := make([]byte, size-7)
+	_, err = io.ReadFull(c.conn, body)
+	if err != nil {
+		ioMemory.release(int64(len(body)))
+	}
+	return header[4], binary.LittleEndian.Uint16(header[5:7]), body, err
+}
+
+/*
+Writes a message to the connection.
+*/
+func (c *ninePConn) writeMessage(msgType uint8, tag uint16, body []byte) error {
+	msg := new(ninePWriter).u32(uint32(7 + len(body))).u8(msgType).u16(tag)
+	_, err := c.conn.Write(append(msg.buf, body...))
+	return err
+}
+
+/*
+Returns the Linux error number sent to the client for err.
+*/
+func ninePErrno(err error) uint32 {
+	if errno, ok := err.(fuse.ErrorNumber); ok {
+		return uint32(errno.Errno())
+	}
+	return uint32(syscall.EIO)
+}
+
+/*
+Serves a request, returning the body of the reply.
+*/
+func (c *ninePConn) handle(msgType uint8, r *ninePReader) (*ninePWriter, error) {
+	defer recoverPanic("9P request " + strconv.Itoa(int(msgType)))
+	switch msgType {
+	case NINEP_TVERSION:
+		return c.version(r)
+	case NINEP_TATTACH:
+		return c.attach(r)
+	case NINEP_TFLUSH:
+		// requests are replied to in order, so the flushed one has already been
+		r.u16()
+		return new(ninePWriter), r.err
+	case NINEP_TWALK:
+		return c.walk(r)
+	case NINEP_TLOPEN:
+		return c.lopen(r)
+	case NINEP_TLCREATE:
+		return c.lcreate(r)
+	case NINEP_TSYMLINK:
+		return c.symlink(r)
+	case NINEP_TREADLINK:
+		return c.readlink(r)
+	case NINEP_TREAD:
+		return c.read(r)
+	case NINEP_TWRITE:
+		return c.write(r)
+	case NINEP_TCLUNK:
+		fid, err := c.fid(r.u32(), r)
+		if err != nil {
+			return nil, err
+		}
+		return new(ninePWriter), c.clunk(fid)
+	case NINEP_TREMOVE:
+		return c.remove(r)
+	case NINEP_TGETATTR:
+		return c.getattr(r)
+	case NINEP_TSETATTR:
+		// like the FUSE handlers, which do not implement Setattr, changes to the mode,
+		// owner, size, and times are accepted but ignored
+		_, err := c.fid(r.u32(), r)
+		return new(ninePWriter), err
+	case NINEP_TREADDIR:
+		return c.readdir(r)
+	case NINEP_TFSYNC:
+		return c.fsync(r)
+	case NINEP_TMKDIR:
+		return c.mkdir(r)
+	case NINEP_TRENAME:
+		return c.rename(r)
+	case NINEP_TRENAMEAT:
+		return c.renameat(r)
+	case NINEP_TUNLINKAT:
+		return c.unlinkat(r)
+	case NINEP_TSTATFS:
+		return c.statfs(r)
+	}
+	return nil, fuse.Errno(syscall.EOPNOTSUPP)
+}
+
+/*
+Returns the fid with the given number, or an error if it does not exist or the message was short.
+*/
+func (c *ninePConn) fid(num uint32, r *ninePReader) (*ninePFid, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	fid := c.fids[num]
+	if fid == nil {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	return fid, nil
+}
+
+/*
+Returns the header of the FUSE request a 9P request on fid is translated to.
+*/
+func (fid *ninePFid) header() fuse.Header {
+	return fuse.Header{Uid: fid.uid}
+}
+
+/*
+Returns a Dir or File for the inode of fid, built from a fresh copy of its inode unless it is open,
+or fuse.ESTALE if the file the fid was walked to was removed and its inode number given to another.
+*/
+func (c *ninePConn) node(fid *ninePFid) (fs.Node, error) {
+	fsLock.Lock()
+	var inode *Inode
+	err := checkGeneration(fid.generation, fid.inodeNum)
+	if open := c.server.open[fid.inodeNum]; open != nil {
+		inode = open.inode
+	} else if err == nil {
+		inode, err = getInode(fid.inodeNum)
+	}
+	fsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if inode.isDir() {
+		return &Dir{
+			inode:       inode,
+			inodeNum:    fid.inodeNum,
+			inodeStream: c.server.filesys.inodeStream,
+			path:        fid.path,
+		}, nil
+	}
+	return &File{
+		inode:       inode,
+		inodeNum:    fid.inodeNum,
+		dirNum:      fid.parentNum,
+		inodeStream: c.server.filesys.inodeStream,
+		path:        fid.path,
+	}, nil
+}
+
+/*
+Returns the directory of fid, or ENOTDIR if it is a file.
+*/
+func (c *ninePConn) dir(fid *ninePFid) (*Dir, error) {
+	node, err := c.node(fid)
+	if err != nil {
+		return nil, err
+	}
+	dir, ok := node.(*Dir)
+	if !ok {
+		return nil, fuse.Errno(syscall.ENOTDIR)
+	}
+	return dir, nil
+}
+
+/*
+Makes the inode of a newly opened file handle the one shared by the other fids open on the file.
+*/
+func (s *ninePServer) retain(handle *FileHandle) {
+	open := s.open[handle.inodeNum]
+	if open == nil {
+		open = &ninePOpenFile{inode: handle.inode}
+		s.open[handle.inodeNum] = open
+	}
+	handle.inode = open.inode
+	open.refs++
+}
+
+/*
+Releases a file handle, dropping the shared inode once no fid has the file open.
+*/
+func (s *ninePServer) release(handle *FileHandle) error {
+	err := handle.Release(context.Background(), &fuse.ReleaseRequest{})
+	open := s.open[handle.inodeNum]
+	open.refs--
+	if open.refs == 0 {
+		delete(s.open, handle.inodeNum)
+	}
+	return err
+}
+
+/*
+Negotiates the message size and protocol version, which also resets the connection.
+*/
+func (c *ninePConn) version(r *ninePReader) (*ninePWriter, error) {
+	msize := r.u32()
+	version := r.str()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if msize > NINEP_MAX_MSIZE {
+		msize = NINEP_MAX_MSIZE
+	}
+	if msize < 2*NINEP_IOHDRSZ {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	c.clunkAll()
+	c.msize = msize
+	if version != NINEP_VERSION {
+		version = "unknown"
+	}
+	return new(ninePWriter).u32(msize).str(version), nil
+}
+
+/*
+Sets up a fid for the root directory. There is no authentication: the client is trusted to send the
+uid of the user it acts for, which is the uid checked and recorded by the FUSE handlers.
+*/
+func (c *ninePConn) attach(r *ninePReader) (*ninePWriter, error) {
+	fidNum := r.u32()
+	afid := r.u32()
+	r.str() // uname
+	r.str() // aname
+	uid := r.u32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if afid != NINEP_NOFID {
+		return nil, fuse.Errno(syscall.EOPNOTSUPP)
+	}
+	if c.fids[fidNum] != nil {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	if uid == NINEP_NONUNAME {
+		uid = NOBODY_UID
+	}
+	root := c.server.filesys.rootInode
+	fsLock.Lock()
+	rootInode, err := getInode(root)
+	fsLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	c.fids[fidNum] = &ninePFid{inodeNum: root, generation: rootInode.Generation, parentNum: root, parentGen: rootInode.Generation, path: "/", isDir: true, uid: uid}
+	return new(ninePWriter).qid(true, root), nil
+}
+
+/*
+Walks from a fid through a list of names to a new fid. If only some of the names can be walked,
+their qids are returned and the new fid is not set up.
+*/
+func (c *ninePConn) walk(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	newFidNum := r.u32()
+	names := make([]string, r.u16())
+	for i := range names {
+		names[i] = r.str()
+	}
+	if err != nil || r.err != nil {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	if c.fids[newFidNum] != nil && c.fids[newFidNum] != fid {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	walked := &ninePFid{
+		inodeNum:   fid.inodeNum,
+		generation: fid.generation,
+		parentNum:  fid.parentNum,
+		parentGen:  fid.parentGen,
+		name:       fid.name,
+		path:       fid.path,
+		isDir:      fid.isDir,
+		isLink:     fid.isLink,
+		uid:        fid.uid,
+	}
+	reply := new(ninePWriter).u16(0)
+	for i, name := range names {
+		child, err := c.lookup(walked, name)
+		if err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			binary.LittleEndian.PutUint16(reply.buf, uint16(i))
+			return reply, nil
+		}
+		walked = child
+		if walked.isLink {
+			reply.linkQid(walked.inodeNum)
+		} else {
+			reply.qid(walked.isDir, walked.inodeNum)
+		}
+	}
+	binary.LittleEndian.PutUint16(reply.buf, uint16(len(names)))
+	if c.fids[newFidNum] == fid {
+		if len(names) == 0 {
+			return reply, nil
+		}
+		c.clunk(fid)
+	}
+	c.fids[newFidNum] = walked
+	return reply, nil
+}
+
+/*
+Returns a fid for the entry with name in the directory of fid.
+*/
+func (c *ninePConn) lookup(fid *ninePFid, name string) (*ninePFid, error) {
+	dir, err := c.dir(fid)
+	if err != nil {
+		return nil, err
+	}
+	node, err := dir.lookup(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	child := &ninePFid{parentNum: fid.inodeNum, parentGen: fid.generation, name: name, path: path.Join(fid.path, name), uid: fid.uid}
+	switch node := node.(type) {
+	case *Dir:
+		child.inodeNum, child.generation = node.inodeNum, node.inode.Generation
+		child.isDir = true
+	case *File:
+		child.inodeNum, child.generation = node.inodeNum, node.inode.Generation
+		child.isLink = node.inode.isSymlink()
+	}
+	return child, nil
+}
+
+/*
+Opens the file or directory of a fid. The entries of a directory are read when it is opened, and
+returned by readdir. Symbolic links and special files cannot be opened (see checkOpenable).
+*/
+func (c *ninePConn) lopen(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	flags := r.u32()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fid.opened {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	node, err := c.node(fid)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	req := &fuse.OpenRequest{Header: fid.header(), Dir: fid.isDir, Flags: fuse.OpenFlags(flags)}
+	switch node := node.(type) {
+	case *Dir:
+		handle, err := node.Open(ctx, req, new(fuse.OpenResponse))
+		if err != nil {
+			return nil, err
+		}
+		dh := handle.(*DirHandle)
+		fid.dirents = dh.readDirAll()
+		fid.dirTable = dh.inodeTable.Table
+		dh.close()
+	case *File:
+		err := node.inode.checkOpenable()
+		if err != nil {
+			return nil, err
+		}
+		handle, err := node.Open(ctx, req, new(fuse.OpenResponse))
+		if err != nil {
+			return nil, err
+		}
+		fid.handle = handle.(*FileHandle)
+		c.server.retain(fid.handle)
+	}
+	fid.opened = true
+	return new(ninePWriter).qid(fid.isDir, fid.inodeNum).u32(c.msize - NINEP_IOHDRSZ), nil
+}
+
+/*
+Creates a file in the directory of a fid, which becomes a fid for the new file, opened.
+*/
+func (c *ninePConn) lcreate(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	name := r.str()
+	flags := r.u32()
+	mode := r.u32()
+	gid := r.u32()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fid.opened {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	dir, err := c.dir(fid)
+	if err != nil {
+		return nil, err
+	}
+	header := fid.header()
+	header.Gid = gid
+	req := &fuse.CreateRequest{Header: header, Name: name, Flags: fuse.OpenFlags(flags), Mode: os.FileMode(mode & 0777)}
+	_, handle, err := dir.Create(context.Background(), req, new(fuse.CreateResponse))
+	if err != nil {
+		return nil, err
+	}
+	fh := handle.(*FileHandle)
+	c.server.retain(fh)
+	fid.parentNum, fid.parentGen = fid.inodeNum, fid.generation
+	fid.inodeNum = fh.inodeNum
+	fid.generation = fh.inode.Generation
+	fid.name = name
+	fid.path = path.Join(fid.path, name)
+	fid.isDir = false
+	fid.opened = true
+	fid.handle = fh
+	return new(ninePWriter).qid(false, fid.inodeNum).u32(c.msize - NINEP_IOHDRSZ), nil
+}
+
+/*
+Reads from the file of an open fid. Reads are cut short at the end of the file.
+*/
+func (c *ninePConn) read(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	offset := r.u64()
+	count := r.u32()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fid.handle == nil {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	if count > c.msize-NINEP_IOHDRSZ {
+		count = c.msize - NINEP_IOHDRSZ
+	}
+	fsLock.Lock()
+	size := fid.handle.inode.Size
+	fsLock.Unlock()
+	if offset >= size {
+		return new(ninePWriter).u32(0), nil
+	}
+	if offset+uint64(count) > size {
+		count = uint32(size - offset)
+	}
+	resp := new(fuse.ReadResponse)
+	err = fid.handle.Read(context.Background(), &fuse.ReadRequest{Header: fid.header(), Offset: int64(offset), Size: int(count)}, resp)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(ninePWriter).u32(uint32(len(resp.Data)))
+	reply.buf = append(reply.buf, resp.Data...)
+	return reply, nil
+}
+
+/*
+Writes to the file of an open fid.
+*/
+func (c *ninePConn) write(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	offset := r.u64()
+	data := r.next(int(r.u32()))
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fid.handle == nil {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	resp := new(fuse.WriteResponse)
+	err = fid.handle.Write(context.Background(), &fuse.WriteRequest{Header: fid.header(), Offset: int64(offset), Data: data}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return new(ninePWriter).u32(uint32(resp.Size)), nil
+}
+
+/*
+Forgets a fid, releasing its file handle if it is an open file.
+*/
+func (c *ninePConn) clunk(fid *ninePFid) error {
+	for num, other := range c.fids {
+		if other == fid {
+			delete(c.fids, num)
+		}
+	}
+	if fid.handle == nil {
+		return nil
+	}
+	return c.server.release(fid.handle)
+}
+
+/*
+Clunks every fid of the connection, when it is closed or reset.
+*/
+func (c *ninePConn) clunkAll() {
+	for _, fid := range c.fids {
+		err := c.clunk(fid)
+		if err != nil {
+			fmt.Println("Error releasing " + fid.path + ": " + err.Error())
+		}
+	}
+}
+
+/*
+Removes the file or directory of a fid, which is clunked whether or not it is removed.
+*/
+func (c *ninePConn) remove(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	if err != nil {
+		return nil, err
+	}
+	if fid.inodeNum == fid.parentNum {
+		c.clunk(fid)
+		return nil, fuse.EPERM
+	}
+	parent := &ninePFid{inodeNum: fid.parentNum, generation: fid.parentGen, path: path.Dir(fid.path), uid: fid.uid}
+	// the fid's own handle does not keep the file from being removed
+	err = c.clunk(fid)
+	if err == nil {
+		err = c.unlink(parent, fid.name, fid.isDir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return new(ninePWriter), nil
+}
+
+/*
+Removes the entry with name from the directory of fid. A file that is open is only deleted once the
+last fid open on it is clunked, as with the FUSE handlers.
+*/
+func (c *ninePConn) unlink(fid *ninePFid, name string, isDir bool) error {
+	dir, err := c.dir(fid)
+	if err != nil {
+		return err
+	}
+	return dir.Remove(context.Background(), &fuse.RemoveRequest{Header: fid.header(), Name: name, Dir: isDir})
+}
+
+/*
+Removes an entry of the directory of a fid.
+*/
+func (c *ninePConn) unlinkat(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	name := r.str()
+	flags := r.u32()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = c.unlink(fid, name, flags&NINEP_AT_REMOVEDIR != 0)
+	if err != nil {
+		return nil, err
+	}
+	return new(ninePWriter), nil
+}
+
+/*
+Returns the attributes of the file or directory of a fid, with the type and permissions the FUSE
+handlers give it. Files are owned by their owner, or by the user the client attached as if the file
+system does not keep owners.
+*/
+func (c *ninePConn) getattr(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	r.u64() // request_mask
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	node, err := c.node(fid)
+	if err != nil {
+		return nil, err
+	}
+	var attr fuse.Attr
+	err = node.Attr(context.Background(), &attr)
+	if err != nil {
+		return nil, err
+	}
+	uid, gid := fid.uid, uint32(0)
+	if inodeOwners {
+		uid, gid = attr.Uid, attr.Gid
+	}
+	valid := NINEP_GETATTR_BASIC
+	if inodeGenerations {
+		valid |= NINEP_GETATTR_GEN
+	}
+	reply := new(ninePWriter).u64(valid)
+	if attr.Mode&os.ModeSymlink != 0 {
+		reply.linkQid(fid.inodeNum)
+	} else {
+		reply.qid(fid.isDir, fid.inodeNum)
+	}
+	reply.u32(ninePMode(attr.Mode)).u32(uid).u32(gid).u64(uint64(attr.Nlink)).u64(uint64(attr.Rdev))
+	reply.u64(attr.Size).u64(uint64(attr.BlockSize)).u64(attr.Blocks)
+	for _, t := range []time.Time{attr.Atime, attr.Mtime, attr.Ctime, attr.Crtime} {
+		// in seconds and nanoseconds
+		reply.u64(uint64(t.Unix())).u64(0)
+	}
+	// the generation and the data version
+	return reply.u64(fid.generation).u64(0), nil
+}
+
+/*
+Returns the Linux st_mode of a file with mode, as 9P2000.L sends it.
+*/
+func ninePMode(mode os.FileMode) uint32 {
+	perm := uint32(mode.Perm())
+	switch {
+	case mode.IsDir():
+		return syscall.S_IFDIR | perm
+	case mode&os.ModeSymlink != 0:
+		return syscall.S_IFLNK | perm
+	case mode&os.ModeNamedPipe != 0:
+		return syscall.S_IFIFO | perm
+	case mode&os.ModeSocket != 0:
+		return syscall.S_IFSOCK | perm
+	case mode&os.ModeCharDevice != 0:
+		return syscall.S_IFCHR | perm
+	case mode&os.ModeDevice != 0:
+		return syscall.S_IFBLK | perm
+	}
+	return syscall.S_IFREG | perm
+}
+
+/*
+Returns the entries of an open directory, from the one at offset, that fit in count bytes.
+The offset of each entry is the offset of the one after it.
+*/
+func (c *ninePConn) readdir(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	offset := r.u64()
+	count := r.u32()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !fid.opened || !fid.isDir {
+		return nil, fuse.Errno(syscall.EBADF)
+	}
+	if count > c.msize-NINEP_IOHDRSZ {
+		count = c.msize - NINEP_IOHDRSZ
+	}
+	entries := new(ninePWriter)
+	for i := offset; i < uint64(len(fid.dirents)); i++ {
+		dirent := fid.dirents[i]
+		size := 13 + 8 + 1 + 2 + len(dirent.Name)
+		if len(entries.buf)+size > int(count) {
+			break
+		}
+		if dirent.Type == fuse.DT_Link {
+			entries.linkQid(fid.dirTable[dirent.Name])
+		} else {
+			entries.qid(dirent.Type == fuse.DT_Dir, fid.dirTable[dirent.Name])
+		}
+		entries.u64(i + 1).u8(uint8(dirent.Type)).str(dirent.Name)
+	}
+	reply := new(ninePWriter).u32(uint32(len(entries.buf)))
+	reply.buf = append(reply.buf, entries.buf...)
+	return reply, nil
+}
+
+/*
+Writes an open file, and its inode, to S3. See syncFile.
+*/
+func (c *ninePConn) fsync(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	if err != nil {
+		return nil, err
+	}
+	if fid.handle != nil {
+		fsLock.Lock()
+		err = syncFile(fid.handle.inode, fid.handle.inodeNum)
+		fsLock.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return new(ninePWriter), nil
+}
+
+/*
+Makes a directory in the directory of a fid.
+*/
+func (c *ninePConn) mkdir(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	name := r.str()
+	mode := r.u32()
+	gid := r.u32()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	dir, err := c.dir(fid)
+	if err != nil {
+		return nil, err
+	}
+	header := fid.header()
+	header.Gid = gid
+	node, err := dir.Mkdir(context.Background(), &fuse.MkdirRequest{Header: header, Name: name, Mode: os.ModeDir | os.FileMode(mode&0777)})
+	if err != nil {
+		return nil, err
+	}
+	return new(ninePWriter).qid(true, node.(*Dir).inodeNum), nil
+}
+
+/*
+Makes a symbolic link in the directory of a fid.
+*/
+func (c *ninePConn) symlink(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	name := r.str()
+	target := r.str()
+	gid := r.u32()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	dir, err := c.dir(fid)
+	if err != nil {
+		return nil, err
+	}
+	header := fid.header()
+	header.Gid = gid
+	node, err := dir.Symlink(context.Background(), &fuse.SymlinkRequest{Header: header, NewName: name, Target: target})
+	if err != nil {
+		return nil, err
+	}
+	return new(ninePWriter).linkQid(node.(*File).inodeNum), nil
+}
+
+/*
+Returns the target of the symbolic link of a fid, or EINVAL if it is not a link.
+*/
+func (c *ninePConn) readlink(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	if err != nil {
+		return nil, err
+	}
+	node, err := c.node(fid)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := node.(*File)
+	if !ok {
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	target, err := file.Readlink(context.Background(), &fuse.ReadlinkRequest{Header: fid.header()})
+	if err != nil {
+		return nil, err
+	}
+	return new(ninePWriter).str(target), nil
+}
+
+/*
+Renames the file or directory of a fid, moving it to the directory of another fid.
+*/
+func (c *ninePConn) rename(r *ninePReader) (*ninePWriter, error) {
+	fid, err := c.fid(r.u32(), r)
+	if err != nil {
+		return nil, err
+	}
+	newDirFid, err := c.fid(r.u32(), r)
+	newName := r.str()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fid.inodeNum == fid.parentNum {
+		return nil, fuse.EPERM
+	}
+	oldDirFid := &ninePFid{inodeNum: fid.parentNum, generation: fid.parentGen, path: path.Dir(fid.path), uid: fid.uid}
+	return c.renameEntry(oldDirFid, fid.name, newDirFid, newName)
+}
+
+/*
+Renames an entry of the directory of a fid, moving it to the directory of another fid.
+*/
+func (c *ninePConn) renameat(r *ninePReader) (*ninePWriter, error) {
+	oldDirFid, err := c.fid(r.u32(), r)
+	if err != nil {
+		return nil, err
+	}
+	oldName := r.str()
+	newDirFid, err := c.fid(r.u32(), r)
+	newName := r.str()
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.renameEntry(oldDirFid, oldName, newDirFid, newName)
+}
+
+/*
+Does the work of rename and renameat, then points the fids of the connection that were walked to
+the entry at its new name.
+*/
+func (c *ninePConn) renameEntry(oldDirFid *ninePFid, oldName string, newDirFid *ninePFid, newName string) (*ninePWriter, error) {
+	oldDir, err := c.dir(oldDirFid)
+	if err != nil {
+		return nil, err
+	}
+	// renames within a directory must go through a single node, as they do from FUSE, or the
+	// entry removed through one copy of the inode would be written back through the other
+	newDir := oldDir
+	if newDirFid.inodeNum != oldDirFid.inodeNum {
+		newDir, err = c.dir(newDirFid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	req := &fuse.RenameRequest{Header: oldDirFid.header(), OldName: oldName, NewName: newName}
+	err = oldDir.Rename(context.Background(), req, newDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fid := range c.fids {
+		if fid.parentNum == oldDirFid.inodeNum && fid.name == oldName && fid.inodeNum != fid.parentNum {
+			fid.parentNum, fid.parentGen = newDirFid.inodeNum, newDirFid.generation
+			fid.name = newName
+			fid.path = path.Join(newDirFid.path, newName)
+		}
+	}
+	return new(ninePWriter), nil
+}
+
+/*
+Returns the statistics of the file system, as FS.Statfs does.
+*/
+func (c *ninePConn) statfs(r *ninePReader) (*ninePWriter, error) {
+	_, err := c.fid(r.u32(), r)
+	if err != nil {
+		return nil, err
+	}
+	var stat fuse.StatfsResponse
+	err = c.server.filesys.Statfs(context.Background(), new(fuse.StatfsRequest), &stat)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(ninePWriter).u32(NINEP_MAGIC).u32(stat.Bsize)
+	reply.u64(stat.Blocks).u64(stat.Bfree).u64(stat.Bavail)
+	reply.u64(stat.Files).u64(stat.Ffree)
+	return reply.u64(0).u32(stat.Namelen), nil
+}
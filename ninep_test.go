@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"encoding/binary"
+	"golang.org/x/net/context"
+	"net"
+	"os"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+/*
+Struct representing the client end of a 9P connection to a test server.
+*/
+type ninePTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	tag  uint16
+}
+
+/*
+Starts a 9P server of filesys on one end of a pipe, and returns a client connected to the other
+end that has negotiated the version and attached fid 0 to the root as uid 1000. The connection is
+closed, and the server waited for, when the test ends.
+*/
+func newNinePTestClient(t *testing.T, filesys *FS) *ninePTestClient {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	served := make(chan bool)
+	go func() {
+		newNinePServer(filesys).serveConn(serverConn)
+		close(served)
+	}()
+	// the server clunks the fids left open once the connection closes, which has to finish
+	// before the next test makes its file system
+	t.Cleanup(func() {
+		clientConn.Close()
+		<-served
+	})
+	c := &ninePTestClient{t: t, conn: clientConn}
+	r := c.call(NINEP_TVERSION, new(ninePWriter).u32(8192).str(NINEP_VERSION))
+	if msize, version := r.u32(), r.str(); msize != 8192 || version != NINEP_VERSION {
+		t.Fatalf("Rversion: msize %d version %s", msize, version)
+	}
+	c.call(NINEP_TATTACH, new(ninePWriter).u32(0).u32(NINEP_NOFID).str("user").str("").u32(1000))
+	return c
+}
+
+/*
+Sends a request and returns the body of its reply, or the error number of an Rlerror.
+*/
+func (c *ninePTestClient) send(msgType uint8, body *ninePWriter) (*ninePReader, uint32) {
+	c.t.Helper()
+	c.tag++
+	msg := new(ninePWriter).u32(uint32(7 + len(body.buf))).u8(msgType).u16(c.tag)
+	_, err := c.conn.Write(append(msg.buf, body.buf...))
+	if err != nil {
+		c.t.Fatalf("writing request %d: %v", msgType, err)
+	}
+	var header [7]byte
+	_, err = c.conn.Read(header[:4])
+	if err != nil {
+		c.t.Fatalf("reading reply to %d: %v", msgType, err)
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(header[:4])-4)
+	for n := 0; n < len(reply); {
+		m, err := c.conn.Read(reply[n:])
+		if err != nil {
+			c.t.Fatalf("reading reply to %d: %v", msgType, err)
+		}
+		n += m
+	}
+	r := &ninePReader{data: reply[3:]}
+	if binary.LittleEndian.Uint16(reply[1:3]) != c.tag {
+		c.t.Fatalf("reply to %d has the wrong tag", msgType)
+	}
+	if reply[0] == NINEP_TLERROR+1 {
+		return r, r.u32()
+	}
+	if reply[0] != msgType+1 {
+		c.t.Fatalf("reply to %d has type %d", msgType, reply[0])
+	}
+	return r, 0
+}
+
+/*
+Sends a request that must succeed, and returns the body of its reply.
+*/
+func (c *ninePTestClient) call(msgType uint8, body *ninePWriter) *ninePReader {
+	c.t.Helper()
+	r, errno := c.send(msgType, body)
+	if errno != 0 {
+		c.t.Fatalf("request %d failed: %v", msgType, syscall.Errno(errno))
+	}
+	return r
+}
+
+/*
+Walks fid 0 (the root) to newFid through names.
+*/
+func (c *ninePTestClient) walk(newFid uint32, names ...string) uint32 {
+	c.t.Helper()
+	w := new(ninePWriter).u32(0).u32(newFid).u16(uint16(len(names)))
+	for _, name := range names {
+		w.str(name)
+	}
+	_, errno := c.send(NINEP_TWALK, w)
+	return errno
+}
+
+/*
+Opens newFid on the file at name in the root, and reads all of it.
+*/
+func (c *ninePTestClient) readFile(newFid uint32, name string) []byte {
+	c.t.Helper()
+	if errno := c.walk(newFid, name); errno != 0 {
+		c.t.Fatalf("walk to %s: %v", name, syscall.Errno(errno))
+	}
+	c.call(NINEP_TLOPEN, new(ninePWriter).u32(newFid).u32(0))
+	var data []byte
+	for {
+		r := c.call(NINEP_TREAD, new(ninePWriter).u32(newFid).u64(uint64(len(data))).u32(4096))
+		chunk := r.next(int(r.u32()))
+		if len(chunk) == 0 {
+			break
+		}
+		data = append(data, chunk...)
+	}
+	c.call(NINEP_TCLUNK, new(ninePWriter).u32(newFid))
+	return data
+}
+
+/*
+Returns the names of the entries of the root directory, read through fid newFid.
+*/
+func (c *ninePTestClient) readRoot(newFid uint32) []string {
+	c.t.Helper()
+	c.walk(newFid)
+	c.call(NINEP_TLOPEN, new(ninePWriter).u32(newFid).u32(0))
+	var names []string
+	var offset uint64
+	for {
+		r := c.call(NINEP_TREADDIR, new(ninePWriter).u32(newFid).u64(offset).u32(64))
+		entries := &ninePReader{data: r.next(int(r.u32()))}
+		if len(entries.data) == 0 {
+			break
+		}
+		for len(entries.data) > 0 {
+			entries.next(13)
+			offset = entries.u64()
+			entries.u8()
+			names = append(names, entries.str())
+		}
+	}
+	c.call(NINEP_TCLUNK, new(ninePWriter).u32(newFid))
+	sort.Strings(names)
+	return names
+}
+
+/*
+Creates, writes, reads, renames, and removes files and directories over 9P.
+*/
+func TestNineP(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	c := newNinePTestClient(t, filesys)
+	data := testData(100*1000, 1)
+
+	if errno := c.walk(1, "missing"); errno != uint32(syscall.ENOENT) {
+		t.Fatalf("walk to a missing file returned %v, want ENOENT", syscall.Errno(errno))
+	}
+	c.walk(1)
+	c.call(NINEP_TLCREATE, new(ninePWriter).u32(1).str("file").u32(syscall.O_WRONLY).u32(0644).u32(1000))
+	for offset := 0; offset < len(data); offset += 4096 {
+		end := offset + 4096
+		if end > len(data) {
+			end = len(data)
+		}
+		w := new(ninePWriter).u32(1).u64(uint64(offset)).u32(uint32(end - offset))
+		w.buf = append(w.buf, data[offset:end]...)
+		r := c.call(NINEP_TWRITE, w)
+		if n := r.u32(); n != uint32(end-offset) {
+			t.Fatalf("wrote %d bytes at %d, want %d", n, offset, end-offset)
+		}
+	}
+
+	// a second fid open on the file sees the data written through the first before it is clunked
+	if got := c.readFile(2, "file"); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes back while open, want the %d written", len(got), len(data))
+	}
+	c.call(NINEP_TCLUNK, new(ninePWriter).u32(1))
+	if got := c.readFile(2, "file"); !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes back, want the %d written", len(got), len(data))
+	}
+
+	c.walk(3)
+	r := c.call(NINEP_TMKDIR, new(ninePWriter).u32(3).str("dir").u32(0755).u32(1000))
+	if qidType := r.u8(); qidType != NINEP_QTDIR {
+		t.Fatalf("Rmkdir qid type %#x, want a directory", qidType)
+	}
+	c.call(NINEP_TRENAMEAT, new(ninePWriter).u32(0).str("file").u32(0).str("renamed"))
+	if got, want := c.readRoot(4), []string{".", "..", "dir", "renamed"}; !equalStrings(got, want) {
+		t.Fatalf("root has entries %v, want %v", got, want)
+	}
+	r = c.call(NINEP_TGETATTR, new(ninePWriter).u32(0).u64(NINEP_GETATTR_BASIC))
+	r.u64()
+	r.next(13)
+	// the root belongs to the user who created the file system, and the directory to the client
+	if mode, uid := r.u32(), r.u32(); mode != syscall.S_IFDIR|0755 || uid != uint32(os.Getuid()) {
+		t.Fatalf("root has mode %o uid %d", mode, uid)
+	}
+	c.walk(6, "dir")
+	r = c.call(NINEP_TGETATTR, new(ninePWriter).u32(6).u64(NINEP_GETATTR_BASIC))
+	r.u64()
+	r.next(13)
+	if mode, uid, gid := r.u32(), r.u32(), r.u32(); mode != syscall.S_IFDIR|0755 || uid != 1000 || gid != 1000 {
+		t.Fatalf("dir has mode %o uid %d gid %d", mode, uid, gid)
+	}
+	c.call(NINEP_TCLUNK, new(ninePWriter).u32(6))
+
+	// a file removed while open can still be read until it is clunked
+	c.walk(5, "renamed")
+	c.call(NINEP_TLOPEN, new(ninePWriter).u32(5).u32(0))
+	c.call(NINEP_TUNLINKAT, new(ninePWriter).u32(0).str("renamed").u32(0))
+	r = c.call(NINEP_TREAD, new(ninePWriter).u32(5).u64(0).u32(4096))
+	if chunk := r.next(int(r.u32())); !bytes.Equal(chunk, data[:4096]) {
+		t.Fatalf("read %d bytes of the removed file while open, want the first 4096 written", len(chunk))
+	}
+	c.call(NINEP_TCLUNK, new(ninePWriter).u32(5))
+	c.walk(6, "dir")
+	c.call(NINEP_TREMOVE, new(ninePWriter).u32(6))
+	if got, want := c.readRoot(7), []string{".", ".."}; !equalStrings(got, want) {
+		t.Fatalf("root has entries %v after removing them, want %v", got, want)
+	}
+}
+
+/*
+Makes and reads a symbolic link over 9P, and checks that links, special files, and regular files
+have their type in their mode, and that links and special files cannot be opened.
+*/
+func TestNinePLinks(t *testing.T) {
+	filesys, _ := newTestFs(t, 4)
+	root := testRoot(t, filesys)
+	_, err := root.Mknod(context.Background(), &fuse.MknodRequest{Name: "fifo", Mode: os.ModeNamedPipe | 0644})
+	if err != nil {
+		t.Fatalf("Mknod: %v", err)
+	}
+	writeTestFile(t, root, "file", testData(10, 1), 10)
+	c := newNinePTestClient(t, filesys)
+	r := c.call(NINEP_TSYMLINK, new(ninePWriter).u32(0).str("link").str("file").u32(1000))
+	if qidType := r.u8(); qidType != NINEP_QTSYMLINK {
+		t.Fatalf("Rsymlink qid type %#x, want a symbolic link", qidType)
+	}
+	c.walk(1, "link")
+	if target := c.call(NINEP_TREADLINK, new(ninePWriter).u32(1)).str(); target != "file" {
+		t.Fatalf("Rreadlink target %q, want \"file\"", target)
+	}
+	c.walk(2, "file")
+	if _, errno := c.send(NINEP_TREADLINK, new(ninePWriter).u32(2)); errno != uint32(syscall.EINVAL) {
+		t.Fatalf("Treadlink of a file returned %v, want EINVAL", syscall.Errno(errno))
+	}
+	c.walk(3, "fifo")
+
+	for _, check := range []struct {
+		fid   uint32
+		mode  uint32
+		errno syscall.Errno
+	}{
+		{1, syscall.S_IFLNK | 0777, syscall.ELOOP},
+		{2, syscall.S_IFREG | 0644, 0},
+		{3, syscall.S_IFIFO | 0644, syscall.ENXIO},
+	} {
+		r = c.call(NINEP_TGETATTR, new(ninePWriter).u32(check.fid).u64(NINEP_GETATTR_BASIC))
+		r.u64()
+		r.next(13)
+		if mode := r.u32(); mode != check.mode {
+			t.Errorf("fid %d has mode %o, want %o", check.fid, mode, check.mode)
+		}
+		if _, errno := c.send(NINEP_TLOPEN, new(ninePWriter).u32(check.fid).u32(0)); syscall.Errno(errno) != check.errno {
+			t.Errorf("Tlopen of fid %d returned %v, want %v", check.fid, syscall.Errno(errno), check.errno)
+		}
+	}
+}
+
+/*
+Returns whether a and b hold the same strings in the same order.
+*/
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
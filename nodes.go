@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bazil.org/fuse/fs"
+	"fmt"
+)
+
+/*
+Struct holding the node the kernel was last given for each inode, so that looking a file up again
+returns the node it already has, with a single copy of the inode in memory, rather than a new one
+each time, and so that the node and its copy are dropped once the kernel forgets it. Only used
+holding fsLock.
+*/
+type nodeRegistry struct {
+	nodes map[uint64]fs.Node
+}
+
+// the nodes of the mounted file system. Set by makeFs.
+var liveNodes = newNodeRegistry()
+
+/*
+Returns a pointer to a new registry with no nodes.
+*/
+func newNodeRegistry() *nodeRegistry {
+	return &nodeRegistry{nodes: make(map[uint64]fs.Node)}
+}
+
+/*
+Records node as the node of the inode with inodeNum, in place of any node it had, as when the inode
+is created.
+*/
+func (r *nodeRegistry) add(inodeNum uint64, node fs.Node) {
+	r.nodes[inodeNum] = node
+}
+
+/*
+Returns the node of the inode with inodeNum found by a lookup, which is node itself unless the
+registry holds a node of the same kind and generation for the inode. That node is then given the
+fields of node, with the inode just read and the path and directory it was looked up at, and is
+returned instead. A node of an earlier file that held the number is replaced, so that its stale
+handles still fail.
+*/
+func (r *nodeRegistry) lookedUp(inodeNum uint64, node fs.Node) fs.Node {
+	switch known := r.nodes[inodeNum].(type) {
+	case *Dir:
+		if d, ok := node.(*Dir); ok && known.inode.Generation == d.inode.Generation {
+			*known = *d
+			return known
+		}
+	case *File:
+		if f, ok := node.(*File); ok && known.inode.Generation == f.inode.Generation {
+			*known = *f
+			return known
+		}
+	}
+	r.nodes[inodeNum] = node
+	return node
+}
+
+/*
+Gives the file node of the inode with inodeNum, if the registry holds one, a copy of inode, just
+stored in place of the one the node was looked up with, as when its blocks are moved.
+*/
+func (r *nodeRegistry) stored(inodeNum uint64, inode *Inode) {
+	if f, ok := r.nodes[inodeNum].(*File); ok {
+		copied := *inode
+		f.inode = &copied
+	}
+}
+
+/*
+Removes node from the registry if it is still the node of the inode with inodeNum.
+*/
+func (r *nodeRegistry) forget(inodeNum uint64, node fs.Node) {
+	if r.nodes[inodeNum] == node {
+		delete(r.nodes, inodeNum)
+	}
+}
+
+/*
+Returns the number of nodes held.
+*/
+func (r *nodeRegistry) count() int {
+	return len(r.nodes)
+}
+
+var _ = fs.NodeForgetter(&Dir{})
+
+/*
+FUSE method called once the kernel drops the last reference to the directory, after which the node
+gets no more requests. Every change to a directory is written as it is made, so there is nothing to
+write, and the node is only dropped from the registry.
+*/
+func (d *Dir) Forget() {
+	defer trackOp("Forget")()
+	defer recoverPanic("Forget")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	debugOp(d.path, "Forget", "inode=%d", d.inodeNum)
+	liveNodes.forget(d.inodeNum, d)
+}
+
+var _ = fs.NodeForgetter(&File{})
+
+/*
+FUSE method called once the kernel drops the last reference to the file, after which the node gets
+no more requests. A handle still open on the file, through 9P or a descriptor the kernel has not
+yet released, may share the copy of the inode of the node and have written to it since the inode
+was last stored, so the inode is stored first, and the node is dropped from the registry.
+*/
+func (f *File) Forget() {
+	defer trackOp("Forget")()
+	defer recoverPanic("Forget")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	debugOp(f.path, "Forget", "inode=%d", f.inodeNum)
+	if openFiles.unstored(f.inodeNum, f.inode) {
+		if err := storeFileInode(f.inode, f.inodeNum); err != nil {
+			fmt.Printf("Failed to store inode %d as its node was forgotten: %v\n", f.inodeNum, err)
+		}
+	}
+	liveNodes.forget(f.inodeNum, f)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that looking a file up again returns the node the kernel already has, that a forgotten node is
+dropped and stores what was written through a handle sharing its inode, and that a file given the
+inode number of a removed one gets a new node.
+*/
+func TestForgetNodes(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	writeTestFile(t, root, "file", testData(100, 1), 100)
+	first, err := root.lookup(ctx, "file")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	again, _ := root.lookup(ctx, "file")
+	if again != first {
+		t.Fatalf("looking the file up again returned a new node")
+	}
+	file := first.(*File)
+	nodesBefore := liveNodes.count()
+
+	handle, _ := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, new(fuse.OpenResponse))
+	fh := handle.(*FileHandle)
+	fh.Write(ctx, &fuse.WriteRequest{Offset: 100, Data: testData(50, 2)}, new(fuse.WriteResponse))
+	file.Forget()
+	if liveNodes.count() != nodesBefore-1 {
+		t.Fatalf("%d nodes held after the file was forgotten, want %d", liveNodes.count(), nodesBefore-1)
+	}
+	if inode, _ := getInode(file.inodeNum); inode.Size != 150 {
+		t.Fatalf("the forgotten file has size %d stored, want 150", inode.Size)
+	}
+	fh.Release(ctx, new(fuse.ReleaseRequest))
+	node, _ := root.lookup(ctx, "file")
+	if node == first || node.(*File).inode.Size != 150 {
+		t.Fatalf("looking up a forgotten file returned its old node, or one of size %d", node.(*File).inode.Size)
+	}
+
+	root.Remove(ctx, &fuse.RemoveRequest{Name: "file"})
+	writeTestFile(t, root, "other", testData(10, 3), 10)
+	other, _ := root.lookup(ctx, "other")
+	if other == node || other.(*File).inodeNum != file.inodeNum {
+		t.Fatalf("the file given a reused inode number got the node of the removed file, or another number")
+	}
+	if _, err := node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, new(fuse.OpenResponse)); err != fuse.ESTALE {
+		t.Fatalf("opening the node of the removed file returned %v, want ESTALE", err)
+	}
+}
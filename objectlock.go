@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"time"
+)
+
+// the S3 Object Lock retention mode ("GOVERNANCE" or "COMPLIANCE") and period set on the blocks of
+// files under append-only and immutable directories, or "" to not set retention
+var OBJECT_LOCK_MODE string
+var OBJECT_LOCK_DAYS int
+
+// whether a legal hold is also placed on the blocks of files under append-only and immutable directories
+var OBJECT_LOCK_LEGAL_HOLD bool
+
+// set while a file under an append-only directory is being written, so that putData marks the
+// blocks it writes to be locked
+var lockingWrites bool
+
+/*
+Interface implemented by ObjectStores that can lock objects against deletion, with S3 Object Lock.
+PutLockedObject puts an object and locks it, and LockObject locks an object that was already put.
+Locking only stops versions of an object from being deleted, so locked objects can still be
+overwritten (creating a new version) and deleted (adding a delete marker).
+*/
+type LockingStore interface {
+	PutLockedObject(key string, data []byte) error
+	LockObject(key string) error
+}
+
+var _ LockingStore = (*s3Store)(nil)
+var _ LockingStore = (*encryptedStore)(nil)
+
+/*
+Returns whether blocks under append-only and immutable directories are locked.
+*/
+func objectLockEnabled() bool {
+	return OBJECT_LOCK_MODE != "" || OBJECT_LOCK_LEGAL_HOLD
+}
+
+/*
+Returns an error if the Object Lock settings from the config are invalid.
+*/
+func checkObjectLockConfig(mode string, days int) error {
+	switch mode {
+	case "":
+		return nil
+	case "GOVERNANCE", "COMPLIANCE":
+		if days <= 0 {
+			return errors.New("ObjectLockDays must be positive when ObjectLockMode is set")
+		}
+		return nil
+	}
+	return errors.New("ObjectLockMode must be \"GOVERNANCE\" or \"COMPLIANCE\", not " + mode)
+}
+
+/*
+Returns the date until which an object locked now is retained.
+*/
+func objectLockRetainUntil() time.Time {
+	return time.Now().AddDate(0, 0, OBJECT_LOCK_DAYS)
+}
+
+/*
+Puts an object with the given key to S3 with the configured retention and legal hold.
+*/
+func (s *s3Store) PutLockedObject(key string, data []byte) error {
+	input := s.putObjectInput(key, data)
+	if OBJECT_LOCK_MODE != "" {
+		input.ObjectLockMode = aws.String(OBJECT_LOCK_MODE)
+		input.ObjectLockRetainUntilDate = aws.Time(objectLockRetainUntil())
+	}
+	if OBJECT_LOCK_LEGAL_HOLD {
+		input.ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	}
+	s.uploads.wait(len(data))
+	_, err := s.client.PutObject(input)
+	return err
+}
+
+/*
+Sets the configured retention and legal hold on the current version of the object with the given key.
+*/
+func (s *s3Store) LockObject(key string) error {
+	if OBJECT_LOCK_MODE != "" {
+		_, err := s.client.PutObjectRetention(&s3.PutObjectRetentionInput{
+			Bucket: aws.String(S3_BUCKET_NAME),
+			Key:    aws.String(key),
+			Retention: &s3.ObjectLockRetention{
+				Mode:            aws.String(OBJECT_LOCK_MODE),
+				RetainUntilDate: aws.Time(objectLockRetainUntil()),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if OBJECT_LOCK_LEGAL_HOLD {
+		_, err := s.client.PutObjectLegalHold(&s3.PutObjectLegalHoldInput{
+			Bucket:    aws.String(S3_BUCKET_NAME),
+			Key:       aws.String(key),
+			LegalHold: &s3.ObjectLockLegalHold{Status: aws.String(s3.ObjectLockLegalHoldStatusOn)},
+		})
+		return err
+	}
+	return nil
+}
+
+/*
+Encrypts data and puts it to the inner store locked, if the inner store can lock objects.
+*/
+func (s *encryptedStore) PutLockedObject(key string, data []byte) error {
+	locking, ok := s.inner.(LockingStore)
+	if !ok {
+		return s.PutObject(key, data)
+	}
+	sealed, err := s.cipher.seal(key, data)
+	if err != nil {
+		return err
+	}
+	return locking.PutLockedObject(key, sealed)
+}
+
+/*
+Locks an object in the inner store, if it can lock objects.
+*/
+func (s *encryptedStore) LockObject(key string) error {
+	if locking, ok := s.inner.(LockingStore); ok {
+		return locking.LockObject(key)
+	}
+	return nil
+}
+
+/*
+Puts data to the global store, locked if the store can lock objects.
+*/
+func putLockedObject(key string, data []byte) error {
+	if locking, ok := store.(LockingStore); ok {
+		return locking.PutLockedObject(key, data)
+	}
+	return store.PutObject(key, data)
+}
+
+/*
+Locks the block with key: if it is in the cache it is locked when it is evicted, and otherwise it is
+locked in the store now.
+*/
+func lockBlock(key string) error {
+	if cache.keyHash[key] != nil {
+		cache.lockOnEvict[key] = true
+		return nil
+	}
+	if locking, ok := store.(LockingStore); ok {
+		return locking.LockObject(key)
+	}
+	return nil
+}
+
+/*
+Locks the data and indirect blocks of every file under the directory with inodeNum, when it is marked
+append-only or immutable. Inode blocks are shared by unrelated files, so are not locked.
+*/
+func lockTree(inodeNum uint64) error {
+	inode, err := getInode(inodeNum)
+	if err != nil {
+		return err
+	}
+	err = inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		return lockBlock(genDataKey(blockNum))
+	})
+	if err != nil || !inode.isDir() {
+		return err
+	}
+	return forEachEntry(inodeNum, inode, func(name string, child uint64) error {
+		err := lockTree(child)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+ObjectStore backed by memory that records the objects that were locked.
+*/
+type lockingMemStore struct {
+	*MemStore
+	locked map[string]bool
+}
+
+/*
+Puts an object and records it as locked.
+*/
+func (s *lockingMemStore) PutLockedObject(key string, data []byte) error {
+	s.locked[key] = true
+	return s.PutObject(key, data)
+}
+
+/*
+Records an object that was already put as locked.
+*/
+func (s *lockingMemStore) LockObject(key string) error {
+	s.locked[key] = true
+	return nil
+}
+
+/*
+Returns the keys of the data blocks of the file with the given name in dir.
+*/
+func fileBlockKeys(t *testing.T, dir *Dir, name string) []string {
+	t.Helper()
+	node, err := dir.lookup(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Lookup(%s): %v", name, err)
+	}
+	var keys []string
+	node.(*File).inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		keys = append(keys, genDataKey(blockNum))
+		return nil
+	})
+	return keys
+}
+
+/*
+Checks that with Object Lock configured, the blocks of files written under an append-only directory
+are locked when they are evicted, the blocks already written to files in a directory are locked when
+it is marked, and the blocks of other files are not.
+*/
+func TestObjectLock(t *testing.T) {
+	OBJECT_LOCK_MODE = "GOVERNANCE"
+	OBJECT_LOCK_DAYS = 1
+	defer func() { OBJECT_LOCK_MODE = "" }()
+	filesys, objects := newTestFs(t, 4)
+	locking := &lockingMemStore{MemStore: objects, locked: make(map[string]bool)}
+	store = locking
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "archive"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	archive := node.(*Dir)
+	size := int(INODE_BUFFER_SIZE + 3*BLOCK_SIZE)
+	for _, name := range []string{"before", "other"} {
+		dir := archive
+		if name == "other" {
+			dir = root
+		}
+		err = crashWriteFile(ctx, dir, name, testData(size, 1))
+		if err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	err = setWorm(t, archive, "append-only", 1000)
+	if err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	err = crashWriteFile(ctx, archive, "after", testData(size, 2))
+	if err != nil {
+		t.Fatalf("writing under append-only directory: %v", err)
+	}
+	filesys.Destroy()
+
+	for _, name := range []string{"before", "after"} {
+		for _, key := range fileBlockKeys(t, archive, name) {
+			if !locking.locked[key] {
+				t.Errorf("block %s of %s was not locked", key, name)
+			}
+		}
+	}
+	for _, key := range fileBlockKeys(t, root, "other") {
+		if locking.locked[key] {
+			t.Errorf("block %s of a file outside the append-only directory was locked", key)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+/*
+Struct tracking the file handles open on each inode of the mounted file system, from FUSE and 9P
+alike. A file whose last entry is removed while it is open is only deleted once its last handle is
+released, as POSIX has it, so that it can still be read and written through them; and a file is not
+shrunk while handles holding another copy of its inode have it open for writing, since they would
+write back pointers to the blocks freed.
+*/
+type openFileTable struct {
+	lock  sync.Mutex
+	files map[uint64]*openFile
+}
+
+/*
+Struct holding the handles open on one inode.
+*/
+type openFile struct {
+	handles     map[*FileHandle]bool
+	path        string     // the path the file was first opened at
+	unlinked    bool       // whether its last entry was removed, so that it is freed on the last release
+	inodeStream *IntStream // the stream to free its inode number to, once unlinked
+}
+
+/*
+Struct describing a file with open handles, as replied to the "open-files" admin command.
+*/
+type openFileInfo struct {
+	Inode    uint64 `json:"inode"`
+	Path     string `json:"path"`
+	Readers  int    `json:"readers"` // the handles open only for reading
+	Writers  int    `json:"writers"` // the handles open for writing
+	Unlinked bool   `json:"unlinked,omitempty"`
+}
+
+/*
+Struct representing the reply to the "open-files" admin command.
+*/
+type openFilesResponse struct {
+	adminResponse
+	Files []openFileInfo `json:"files"`
+}
+
+// the handles open on the mounted file system. Set by makeFs.
+var openFiles = newOpenFileTable()
+
+/*
+Returns a pointer to a new table with no open files.
+*/
+func newOpenFileTable() *openFileTable {
+	return &openFileTable{files: make(map[uint64]*openFile)}
+}
+
+/*
+Records that fh was opened.
+*/
+func (t *openFileTable) open(fh *FileHandle) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	file := t.files[fh.inodeNum]
+	if file == nil {
+		file = &openFile{handles: make(map[*FileHandle]bool), path: fh.path}
+		t.files[fh.inodeNum] = file
+	}
+	file.handles[fh] = true
+}
+
+/*
+Records that fh was released. Returns the stream to free the inode number of the file to if it was
+the last handle open on a file whose last entry was removed, and nil otherwise.
+*/
+func (t *openFileTable) release(fh *FileHandle) *IntStream {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	file := t.files[fh.inodeNum]
+	if file == nil || !file.handles[fh] {
+		return nil
+	}
+	delete(file.handles, fh)
+	if len(file.handles) != 0 {
+		return nil
+	}
+	delete(t.files, fh.inodeNum)
+	if file.unlinked {
+		return file.inodeStream
+	}
+	return nil
+}
+
+/*
+Marks the file with inodeNum as unlinked if it is open, so that its last release frees it to
+inodeStream, and returns whether it was.
+*/
+func (t *openFileTable) unlink(inodeNum uint64, inodeStream *IntStream) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	file := t.files[inodeNum]
+	if file == nil {
+		return false
+	}
+	file.unlinked = true
+	file.inodeStream = inodeStream
+	return true
+}
+
+/*
+Returns the inode numbers of the files whose last entry was removed while they were open, and which
+are still open, in order.
+*/
+func (t *openFileTable) orphans() []uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var orphans []uint64
+	for inodeNum, file := range t.files {
+		if file.unlinked {
+			orphans = append(orphans, inodeNum)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i] < orphans[j] })
+	return orphans
+}
+
+/*
+Returns whether any handle is open on the inode with inodeNum.
+*/
+func (t *openFileTable) isOpen(inodeNum uint64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.files[inodeNum] != nil
+}
+
+/*
+Returns whether a handle open for writing on the inode with inodeNum holds a copy of the inode other
+than inode.
+*/
+func (t *openFileTable) otherWriters(inodeNum uint64, inode *Inode) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	file := t.files[inodeNum]
+	if file == nil {
+		return false
+	}
+	for fh := range file.handles {
+		if fh.writable && fh.inode != inode {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns whether a handle open on the inode with inodeNum shares inode as its copy and was written
+through since it was last flushed, so that the copy may hold changes not yet stored.
+*/
+func (t *openFileTable) unstored(inodeNum uint64, inode *Inode) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	file := t.files[inodeNum]
+	if file == nil {
+		return false
+	}
+	for fh := range file.handles {
+		if fh.dirty && fh.inode == inode {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Returns the end of the file with inodeNum, as the largest size of inode and the copies of it held
+by the handles open on the file, so that appends through a handle whose copy is behind land after
+what was written through the others.
+*/
+func (t *openFileTable) end(inodeNum uint64, inode *Inode) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	size := inode.Size
+	if file := t.files[inodeNum]; file != nil {
+		for fh := range file.handles {
+			if fh.inode.Size > size {
+				size = fh.inode.Size
+			}
+		}
+	}
+	return size
+}
+
+/*
+Returns the files with open handles, in inode number order.
+*/
+func (t *openFileTable) list() []openFileInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	infos := make([]openFileInfo, 0, len(t.files))
+	for inodeNum, file := range t.files {
+		info := openFileInfo{Inode: inodeNum, Path: file.path, Unlinked: file.unlinked}
+		for fh := range file.handles {
+			if fh.writable {
+				info.Writers++
+			} else {
+				info.Readers++
+			}
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Inode < infos[j].Inode })
+	return infos
+}
+
+/*
+Deletes the data of the inode with inodeNum, whose last entry, at p, was removed, and frees the inode
+to inodeStream. If it is still open, this waits until its last handle is released, or if the file
+system is unmounted first, until the next mount (see SuperblockInfo.Orphans).
+*/
+func freeInode(inode *Inode, inodeNum uint64, p string, inodeStream *IntStream) error {
+	if openFiles.unlink(inodeNum, inodeStream) {
+		debugOp(p, "Remove", "inode=%d is open, freeing it on release", inodeNum)
+		return nil
+	}
+	return deleteInode(inode, inodeNum, p, inodeStream)
+}
+
+/*
+Deletes the files on the orphan list of the superblock of filesys, which were still open when it was
+written, as when the kernel did not release their handles before the file system was unmounted, and
+frees their inode numbers. A file that cannot be deleted stays on the list, to be deleted on the next
+mount. Called once the file system is mounted, before it serves requests.
+*/
+func deleteOrphans(filesys *FS) {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	var kept []uint64
+	for _, inodeNum := range filesys.info.Orphans {
+		inode, err := getInode(inodeNum)
+		if err == nil {
+			err = deleteInode(inode, inodeNum, "", filesys.inodeStream)
+		}
+		if err != nil {
+			fmt.Printf("Failed to delete orphaned inode %d, which is kept for the next mount: %v\n", inodeNum, err)
+			kept = append(kept, inodeNum)
+		}
+	}
+	if deleted := len(filesys.info.Orphans) - len(kept); deleted > 0 {
+		fmt.Printf("Deleted %d files removed while they were open when the file system was last unmounted.\n", deleted)
+	}
+	filesys.info.Orphans = kept
+}
+
+/*
+Admin command that replies with the files that have open handles, and how many of them are open
+for reading and for writing. Their current paths are given if the file system keeps a path index.
+*/
+func openFilesCommand(req *adminRequest, conn net.Conn, enc *json.Encoder) error {
+	files := openFiles.list()
+	if pathIndex {
+		// the path each was opened at may have been renamed since
+		fsLock.Lock()
+		for i := range files {
+			if files[i].Unlinked {
+				continue
+			}
+			if p, err := inodePath(files[i].Inode); err == nil {
+				files[i].Path = p
+			}
+		}
+		fsLock.Unlock()
+	}
+	return enc.Encode(&openFilesResponse{adminResponse: adminResponse{OK: true}, Files: files})
+}
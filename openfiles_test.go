@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"golang.org/x/net/context"
+	"syscall"
+	"testing"
+)
+
+/*
+Checks that a file removed while open can still be read and written through its handle, and is only
+deleted, freeing its blocks and inode, once the handle is released, and that the open files are
+listed with their readers and writers.
+*/
+func TestUnlinkWhileOpen(t *testing.T) {
+	mountStats = LifetimeStats{}
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	data := testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1)
+	writeTestFile(t, root, "file", data, 1<<16)
+	node, _ := root.lookup(ctx, "file")
+	file := node.(*File)
+	handle, _ := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadWrite}, new(fuse.OpenResponse))
+	fh := handle.(*FileHandle)
+	reader, _ := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, new(fuse.OpenResponse))
+	files := openFiles.list()
+	if len(files) != 1 || files[0].Inode != file.inodeNum || files[0].Readers != 1 || files[0].Writers != 1 {
+		t.Fatalf("open files %+v", files)
+	}
+
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if files := openFiles.list(); len(files) != 1 || !files[0].Unlinked {
+		t.Fatalf("open files %+v after removing the file", files)
+	}
+	if mountStats.BlocksDeleted != 0 {
+		t.Fatalf("%d blocks of the open file were deleted when it was removed", mountStats.BlocksDeleted)
+	}
+	fh.Write(ctx, &fuse.WriteRequest{Offset: int64(len(data)), Data: testData(int(BLOCK_SIZE), 2)}, new(fuse.WriteResponse))
+	resp := new(fuse.ReadResponse)
+	if err := fh.Read(ctx, &fuse.ReadRequest{Size: len(data)}, resp); err != nil || !bytes.Equal(resp.Data, data) {
+		t.Fatalf("read %d bytes of the removed file, err %v", len(resp.Data), err)
+	}
+
+	reader.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	if mountStats.BlocksDeleted != 0 {
+		t.Fatalf("the file was deleted while a handle was still open")
+	}
+	if err := fh.Release(ctx, new(fuse.ReleaseRequest)); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if mountStats.BlocksDeleted != 3 {
+		t.Fatalf("%d blocks deleted on the last release, want the 3 of the file", mountStats.BlocksDeleted)
+	}
+	if files := openFiles.list(); len(files) != 0 {
+		t.Fatalf("open files %+v after releasing every handle", files)
+	}
+	if inodeNum := nextInodeNum(filesys.inodeStream); inodeNum != file.inodeNum {
+		t.Fatalf("the next inode is %d, want %d freed by the last release", inodeNum, file.inodeNum)
+	}
+}
+
+/*
+Checks that a file removed while open and still open when the file system is unmounted is kept on
+the orphan list of the superblock, and deleted, freeing its blocks and inode, on the next mount.
+*/
+func TestOrphanDeletedOnMount(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "file", testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1), 1<<16)
+	if _, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, new(fuse.OpenResponse)); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	mountStats = LifetimeStats{}
+	filesys.Destroy()
+
+	cache = newCache(newMemStore(), 64)
+	super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err != nil {
+		t.Fatalf("getDataByKey for superblock: %v", err)
+	}
+	remounted, err := makeFs(super)
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	if len(remounted.info.Orphans) != 1 || remounted.info.Orphans[0] != file.inodeNum {
+		t.Fatalf("the superblock has orphans %v, want [%d]", remounted.info.Orphans, file.inodeNum)
+	}
+	deleteOrphans(remounted)
+	if mountStats.BlocksDeleted != 2 || len(remounted.info.Orphans) != 0 {
+		t.Fatalf("%d blocks deleted on mount, orphans %v left", mountStats.BlocksDeleted, remounted.info.Orphans)
+	}
+	if inodeNum := nextInodeNum(remounted.inodeStream); inodeNum != file.inodeNum {
+		t.Fatalf("the next inode is %d, want %d freed on mount", inodeNum, file.inodeNum)
+	}
+}
+
+/*
+Checks that a file cannot be shrunk while a handle holding another copy of its inode has it open for
+writing, but can be extended. With one node per inode, that copy is the one the node had before the
+file was looked up again, which reads the inode afresh. A handle opened through the node since
+shares its copy, so it does not keep the file from being shrunk.
+*/
+func TestTruncateOpenElsewhere(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	writeTestFile(t, root, "file", testData(1000, 1), 1000)
+	node, _ := root.lookup(ctx, "file")
+	file := node.(*File)
+	old, _ := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, new(fuse.OpenResponse))
+	if again, _ := root.lookup(ctx, "file"); again != node {
+		t.Fatalf("looking the file up again returned a new node")
+	}
+
+	shrink := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 10}
+	if err := file.Setattr(ctx, shrink, new(fuse.SetattrResponse)); err != fuse.Errno(syscall.EBUSY) {
+		t.Fatalf("shrinking a file open for writing with another copy of its inode returned %v, want EBUSY", err)
+	}
+	extend := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 2000}
+	if err := file.Setattr(ctx, extend, new(fuse.SetattrResponse)); err != nil {
+		t.Fatalf("extending a file open for writing with another copy of its inode: %v", err)
+	}
+	current, _ := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, new(fuse.OpenResponse))
+	old.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	if err := file.Setattr(ctx, shrink, new(fuse.SetattrResponse)); err != nil {
+		t.Fatalf("shrinking a file open for writing only through a handle sharing the inode of its node: %v", err)
+	}
+	current.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	if openFiles.otherWriters(file.inodeNum, file.inode) {
+		t.Fatalf("a released handle still counts as a writer")
+	}
+}
+
+/*
+Checks that writes through a handle opened with O_APPEND land at the end of the file, even when it
+was extended through another handle after the kernel last saw its size.
+*/
+func TestAppendWrites(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "log", []byte("first\n"), 6)
+	appender, _ := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly | fuse.OpenAppend}, new(fuse.OpenResponse))
+	writer, _ := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, new(fuse.OpenResponse))
+	writer.(*FileHandle).Write(ctx, &fuse.WriteRequest{Offset: 6, Data: []byte("second\n")}, new(fuse.WriteResponse))
+	// the offset the kernel passes is the size it saw when the file was opened
+	appender.(*FileHandle).Write(ctx, &fuse.WriteRequest{Offset: 6, Data: []byte("third\n")}, new(fuse.WriteResponse))
+	writer.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	appender.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	data, err := file.inode.readFromData(0, file.inode.Size)
+	if err != nil || string(data) != "first\nsecond\nthird\n" {
+		t.Fatalf("file holds %q, err %v", data, err)
+	}
+}
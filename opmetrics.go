@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// the upper bounds, in seconds, of the buckets of the latency histograms of file system requests.
+// Requests slower than the last bound are counted in one more bucket.
+var LATENCY_BUCKETS = []float64{0.001, 0.005, 0.025, 0.1, 0.25, 1, 5, 30}
+
+// how long the metrics command waits for fsLock to read the metrics of the cache, before replying
+// without them, so that it still answers while a request is stuck holding the file system
+var METRICS_LOCK_WAIT = time.Second
+
+/*
+Struct holding the latency histogram of one kind of request, as reported by the metrics command.
+Buckets[i] counts the requests that took at most LATENCY_BUCKETS[i] seconds and more than the bound
+before it, and the last bucket those that took longer than every bound.
+*/
+type opMetrics struct {
+	Count        uint64   `json:"count"`
+	TotalSeconds float64  `json:"totalSeconds"`
+	MaxSeconds   float64  `json:"maxSeconds"`
+	Buckets      []uint64 `json:"buckets"`
+	TimedOut     uint64   `json:"timedOut,omitempty"` // the requests that ran out of their budget, see OP_TIMEOUTS
+}
+
+/*
+Struct tracking the requests being handled, and how long each kind of request has taken. Requests
+are tracked separately from fsLock, so that requests waiting for it are counted.
+*/
+type opTracker struct {
+	lock     sync.Mutex
+	nextID   uint64
+	inFlight map[uint64]inFlightOp
+	ops      map[string]*opMetrics
+}
+
+/*
+Struct representing a request that is being handled.
+*/
+type inFlightOp struct {
+	op    string
+	start time.Time
+}
+
+// the requests of the file system, from FUSE, 9P, and HTTP alike
+var requests = newOpTracker()
+
+/*
+Returns a pointer to a new opTracker with no requests.
+*/
+func newOpTracker() *opTracker {
+	return &opTracker{
+		inFlight: make(map[uint64]inFlightOp),
+		ops:      make(map[string]*opMetrics),
+	}
+}
+
+/*
+Starts tracking a request of kind op, returning the function that stops tracking it and records its
+latency. Handlers defer the function before taking fsLock, as in defer trackOp("Read")().
+*/
+func trackOp(op string) func() {
+	countStat(&mountStats.Requests, 1)
+	return requests.start(op)
+}
+
+/*
+Counts a request of kind op as in flight until the returned function is called.
+*/
+func (t *opTracker) start(op string) func() {
+	t.lock.Lock()
+	id := t.nextID
+	t.nextID++
+	start := time.Now()
+	t.inFlight[id] = inFlightOp{op: op, start: start}
+	t.lock.Unlock()
+	return func() {
+		t.finish(id, op, time.Since(start))
+	}
+}
+
+/*
+Stops counting the request with id as in flight, and adds its latency to the histogram of op.
+*/
+func (t *opTracker) finish(id uint64, op string, latency time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.inFlight, id)
+	metrics := t.metrics(op)
+	seconds := latency.Seconds()
+	bucket := 0
+	for bucket < len(LATENCY_BUCKETS) && seconds > LATENCY_BUCKETS[bucket] {
+		bucket++
+	}
+	metrics.Buckets[bucket]++
+	metrics.Count++
+	metrics.TotalSeconds += seconds
+	if seconds > metrics.MaxSeconds {
+		metrics.MaxSeconds = seconds
+	}
+}
+
+/*
+Counts a request of kind op that ran out of its budget.
+*/
+func (t *opTracker) timedOut(op string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.metrics(op).TimedOut++
+}
+
+/*
+Returns the histogram of op, adding an empty one if there is none yet. The caller must hold the
+lock.
+*/
+func (t *opTracker) metrics(op string) *opMetrics {
+	metrics := t.ops[op]
+	if metrics == nil {
+		metrics = &opMetrics{Buckets: make([]uint64, len(LATENCY_BUCKETS)+1)}
+		t.ops[op] = metrics
+	}
+	return metrics
+}
+
+/*
+Returns the number of requests in flight, the kind and age of the oldest of them (or "" and 0 if
+there are none), and a copy of the latency histograms.
+*/
+func (t *opTracker) snapshot() (int, string, time.Duration, map[string]*opMetrics) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var oldestOp string
+	var oldest time.Duration
+	now := time.Now()
+	for _, req := range t.inFlight {
+		if age := now.Sub(req.start); age > oldest {
+			oldest = age
+			oldestOp = req.op
+		}
+	}
+	ops := make(map[string]*opMetrics, len(t.ops))
+	for op, metrics := range t.ops {
+		copied := *metrics
+		copied.Buckets = append([]uint64(nil), metrics.Buckets...)
+		ops[op] = &copied
+	}
+	return len(t.inFlight), oldestOp, oldest, ops
+}
+
+/*
+Takes fsLock if it can be taken within wait, returning whether it was.
+*/
+func lockWithin(wait time.Duration) bool {
+	deadline := time.Now().Add(wait)
+	for !fsLock.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+/*
+Checks that requests are counted in flight until they finish, that their latencies land in the right
+buckets, and that handlers are tracked.
+*/
+func TestOpTracker(t *testing.T) {
+	tracker := newOpTracker()
+	done := tracker.start("Read")
+	tracker.start("Write")
+	time.Sleep(10 * time.Millisecond)
+	done()
+	tracker.finish(100, "Read", 30*time.Millisecond)
+	tracker.finish(101, "Read", time.Minute)
+	inFlight, oldestOp, oldest, ops := tracker.snapshot()
+	if inFlight != 1 || oldestOp != "Write" || oldest < 10*time.Millisecond {
+		t.Fatalf("%d requests in flight, the oldest %s for %v, want only the Write", inFlight, oldestOp, oldest)
+	}
+	read := ops["Read"]
+	// 10ms, 30ms, and a minute fall in the buckets up to 25ms, up to 100ms, and past the last bound
+	want := []uint64{0, 0, 1, 1, 0, 0, 0, 0, 1}
+	if read == nil || read.Count != 3 || read.MaxSeconds != 60 || !equalCounts(read.Buckets, want) {
+		t.Fatalf("Read metrics %+v, want buckets %v", read, want)
+	}
+
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	_, _, _, ops = requests.snapshot()
+	before := uint64(0)
+	if ops["Lookup"] != nil {
+		before = ops["Lookup"].Count
+	}
+	root.lookup(context.Background(), "missing")
+	if _, _, _, ops = requests.snapshot(); ops["Lookup"] == nil || ops["Lookup"].Count != before+1 {
+		t.Fatalf("Lookup was not tracked")
+	}
+}
+
+/*
+Checks that the metrics are still returned, without those of the cache, while a request holds the
+file system.
+*/
+func TestMetricsWhileBusy(t *testing.T) {
+	newTestFs(t, 16)
+	METRICS_LOCK_WAIT = 50 * time.Millisecond
+	defer func() { METRICS_LOCK_WAIT = time.Second }()
+	fsLock.Lock()
+	done := trackOp("Write")
+	metrics := currentMetrics()
+	done()
+	fsLock.Unlock()
+	if !metrics.CacheBusy || metrics.InFlight == 0 || metrics.OldestOp == "" {
+		t.Fatalf("metrics while busy: %+v", metrics)
+	}
+	if metrics = currentMetrics(); metrics.CacheBusy {
+		t.Fatalf("metrics with the file system idle report it busy")
+	}
+}
+
+/*
+Returns whether the two bucket counts are equal.
+*/
+func equalCounts(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// what the cache does when S3 does not take the blocks it evicts. Either way the blocks stay in the
+// DynamoDB table, so no change is lost.
+const OUTAGE_BLOCK string = "block" // requests wait until S3 takes the block, holding up the file system
+const OUTAGE_QUEUE string = "queue" // the cache grows past its capacity, by up to OUTAGE_QUEUE_BLOCKS
+const OUTAGE_FAIL string = "fail"   // requests that write fail with EIO until S3 takes the blocks again
+
+var S3_OUTAGE_POLICY string = OUTAGE_BLOCK
+
+// the most blocks the cache may hold past its capacity under OUTAGE_QUEUE, beyond which requests
+// wait as under OUTAGE_BLOCK
+const DEFAULT_OUTAGE_QUEUE_BLOCKS int = 1024
+
+var OUTAGE_QUEUE_BLOCKS int = DEFAULT_OUTAGE_QUEUE_BLOCKS
+
+// how long the cache waits after S3 fails to take a block before it tries to evict one again
+var OUTAGE_RETRY_INTERVAL time.Duration = 5 * time.Second
+
+var errStoreUnavailable = errors.New("S3 is unavailable, retrying evictions later")
+
+/*
+Returns an error if policy is not one of the OUTAGE_* policies.
+*/
+func checkOutagePolicy(policy string) error {
+	switch policy {
+	case OUTAGE_BLOCK, OUTAGE_QUEUE, OUTAGE_FAIL:
+		return nil
+	}
+	return fmt.Errorf("S3OutagePolicy must be %q, %q, or %q, not %q.", OUTAGE_BLOCK, OUTAGE_QUEUE, OUTAGE_FAIL, policy)
+}
+
+/*
+Evicts the least recently used block that is not pinned (or the least recently used block, if they
+all are) to S3. If S3 does not take it, the block is left in the cache, no block is tried again for
+OUTAGE_RETRY_INTERVAL, and errStoreUnavailable is returned. Other errors, of the DynamoDB table, are
+returned as they are, since waiting for S3 does not fix them.
+*/
+func (c *Cache) evictNext() error {
+	if time.Now().Before(c.storeRetryTime) {
+		return errStoreUnavailable
+	}
+	evictElt := c.recentlyUsedQueue.Front()
+	for e := evictElt; e != nil; e = e.Next() {
+		if !c.pinned[e.Value.(string)] {
+			evictElt = e
+			break
+		}
+	}
+	evictKey := evictElt.Value.(string)
+	storeFailed, err := c.evictBlock(evictKey)
+	if err != nil && !storeFailed {
+		return err
+	}
+	health.noteWrite("evicting block "+evictKey, err)
+	if err != nil {
+		fmt.Println("Failed to evict block " + evictKey + ", keeping it in the cache: " + err.Error())
+		c.storeRetryTime = time.Now().Add(OUTAGE_RETRY_INTERVAL)
+		return errStoreUnavailable
+	}
+	c.recentlyUsedQueue.Remove(evictElt)
+	c.keyHash[evictKey] = nil
+	return nil
+}
+
+/*
+Evicts blocks until there is room in the cache for one more, following S3_OUTAGE_POLICY when S3
+does not take them. Returns an error under OUTAGE_FAIL, or if the DynamoDB table fails, in which
+case the cache is left full.
+*/
+func (c *Cache) makeRoom() error {
+	for c.recentlyUsedQueue.Len() >= c.cacheCapacity {
+		err := c.evictNext()
+		if err == nil {
+			continue
+		}
+		switch {
+		case err != errStoreUnavailable:
+			return err
+		case S3_OUTAGE_POLICY == OUTAGE_FAIL:
+			return err
+		case S3_OUTAGE_POLICY == OUTAGE_QUEUE && c.recentlyUsedQueue.Len() < c.cacheCapacity+OUTAGE_QUEUE_BLOCKS:
+			return nil
+		}
+		time.Sleep(time.Until(c.storeRetryTime))
+	}
+	return nil
+}
+
+/*
+Evicts the blocks the cache holds past its capacity, which S3 did not take, before a request writes.
+Returns fuse.EIO under OUTAGE_FAIL if S3 still does not take them, so that requests that write fail
+rather than grow the cache further, and EROFS if the mount was made read-only.
+*/
+func checkStoreWritable() error {
+	err := health.check()
+	if err != nil {
+		return err
+	}
+	for cache.recentlyUsedQueue.Len() > cache.cacheCapacity {
+		if cache.evictNext() != nil {
+			if S3_OUTAGE_POLICY == OUTAGE_FAIL {
+				return fuse.EIO
+			}
+			return nil
+		}
+	}
+	return nil
+}
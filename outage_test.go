@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+Struct wrapping an ObjectStore that refuses every write while it is down, like S3 in an outage.
+*/
+type outageStore struct {
+	ObjectStore
+	down int32
+}
+
+/*
+Fails while the store is down, and otherwise writes to the wrapped store.
+*/
+func (s *outageStore) PutObject(key string, data []byte) error {
+	if atomic.LoadInt32(&s.down) != 0 {
+		return errors.New("InternalError: status code 503")
+	}
+	return s.ObjectStore.PutObject(key, data)
+}
+
+/*
+Returns a new file system with a cache of 4 blocks whose store goes down when the returned store is
+set down, with S3_OUTAGE_POLICY set to policy.
+*/
+func newOutageTestFs(t *testing.T, policy string) (*Dir, *outageStore) {
+	t.Helper()
+	filesys, objects := newTestFs(t, 4)
+	down := &outageStore{ObjectStore: objects}
+	store = down
+	S3_OUTAGE_POLICY = policy
+	OUTAGE_RETRY_INTERVAL = 10 * time.Millisecond
+	t.Cleanup(func() {
+		S3_OUTAGE_POLICY = OUTAGE_BLOCK
+		OUTAGE_QUEUE_BLOCKS = DEFAULT_OUTAGE_QUEUE_BLOCKS
+		OUTAGE_RETRY_INTERVAL = 5 * time.Second
+	})
+	return testRoot(t, filesys), down
+}
+
+/*
+Writes data to a new file under root in block-sized writes, returning the error of the first write
+that fails.
+*/
+func writeOutageFile(root *Dir, name string, data []byte) error {
+	ctx := context.Background()
+	_, handle, err := root.Create(ctx, &fuse.CreateRequest{Name: name}, new(fuse.CreateResponse))
+	if err != nil {
+		return err
+	}
+	fh := handle.(*FileHandle)
+	defer fh.Release(ctx, new(fuse.ReleaseRequest))
+	for offset := 0; offset < len(data); offset += int(BLOCK_SIZE) {
+		end := offset + int(BLOCK_SIZE)
+		if end > len(data) {
+			end = len(data)
+		}
+		err := fh.Write(ctx, &fuse.WriteRequest{Offset: int64(offset), Data: data[offset:end]}, new(fuse.WriteResponse))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Checks that the file at name under root holds data.
+*/
+func checkFileData(t *testing.T, root *Dir, name string, data []byte) {
+	t.Helper()
+	node, err := root.lookup(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Lookup %s: %v", name, err)
+	}
+	inode := node.(*File).inode
+	got, err := inode.readFromData(0, inode.Size)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d of the %d bytes of %s back, err %v", len(got), len(data), name, err)
+	}
+}
+
+/*
+Checks that under OUTAGE_QUEUE the cache grows past its capacity while S3 is down, by at most
+OUTAGE_QUEUE_BLOCKS, and that the queued blocks are written to S3 once it is back.
+*/
+func TestOutageQueue(t *testing.T) {
+	root, down := newOutageTestFs(t, OUTAGE_QUEUE)
+	OUTAGE_QUEUE_BLOCKS = 16
+	atomic.StoreInt32(&down.down, 1)
+	data := testData(int(INODE_BUFFER_SIZE+10*BLOCK_SIZE), 1)
+	if err := writeOutageFile(root, "queued", data); err != nil {
+		t.Fatalf("writing during the outage: %v", err)
+	}
+	if n := cache.recentlyUsedQueue.Len(); n <= cache.cacheCapacity || n > cache.cacheCapacity+OUTAGE_QUEUE_BLOCKS {
+		t.Fatalf("the cache holds %d blocks during the outage", n)
+	}
+	atomic.StoreInt32(&down.down, 0)
+	time.Sleep(2 * OUTAGE_RETRY_INTERVAL)
+	if err := writeOutageFile(root, "after", testData(100, 2)); err != nil {
+		t.Fatalf("writing after the outage: %v", err)
+	}
+	if n := cache.recentlyUsedQueue.Len(); n > cache.cacheCapacity {
+		t.Fatalf("the cache still holds %d blocks after the outage", n)
+	}
+	checkFileData(t, root, "queued", data)
+}
+
+/*
+Checks that under OUTAGE_FAIL writes fail with EIO once S3 has refused a block, without losing the
+block, and succeed again once S3 is back.
+*/
+func TestOutageFail(t *testing.T) {
+	root, down := newOutageTestFs(t, OUTAGE_FAIL)
+	data := testData(int(INODE_BUFFER_SIZE+3*BLOCK_SIZE), 1)
+	if err := writeOutageFile(root, "before", data); err != nil {
+		t.Fatalf("writing before the outage: %v", err)
+	}
+	atomic.StoreInt32(&down.down, 1)
+	err := writeOutageFile(root, "during", testData(int(INODE_BUFFER_SIZE+8*BLOCK_SIZE), 2))
+	if err != fuse.EIO {
+		t.Fatalf("writing during the outage returned %v", err)
+	}
+	atomic.StoreInt32(&down.down, 0)
+	time.Sleep(2 * OUTAGE_RETRY_INTERVAL)
+	if err := writeOutageFile(root, "after", data); err != nil {
+		t.Fatalf("writing after the outage: %v", err)
+	}
+	checkFileData(t, root, "before", data)
+	checkFileData(t, root, "after", data)
+}
+
+/*
+Checks that under OUTAGE_BLOCK a write waits while S3 is down, and finishes once it is back.
+*/
+func TestOutageBlock(t *testing.T) {
+	root, down := newOutageTestFs(t, OUTAGE_BLOCK)
+	WRITE_FAILURE_LIMIT = 0
+	defer func() { WRITE_FAILURE_LIMIT = DEFAULT_WRITE_FAILURE_LIMIT }()
+	atomic.StoreInt32(&down.down, 1)
+	data := testData(int(INODE_BUFFER_SIZE+8*BLOCK_SIZE), 1)
+	done := make(chan error)
+	go func() {
+		done <- writeOutageFile(root, "blocked", data)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("the write finished during the outage, err %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	atomic.StoreInt32(&down.down, 0)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the write did not finish after the outage")
+	}
+	checkFileData(t, root, "blocked", data)
+}
+
+/*
+Struct wrapping a CacheTable whose items can no longer be deleted, as when the table lost them.
+*/
+type undeletableTable struct {
+	CacheTable
+}
+
+/*
+Fails, as DeleteItem does for an item the table does not have.
+*/
+func (t *undeletableTable) DeleteItem(key string) ([]byte, error) {
+	return nil, errors.New("No item in memory with key " + key)
+}
+
+/*
+Checks that under OUTAGE_BLOCK a failure of the cache table to give up a block is returned when
+making room, rather than waited out as if S3 were down.
+*/
+func TestOutageTableFailure(t *testing.T) {
+	newOutageTestFs(t, OUTAGE_BLOCK)
+	for cache.recentlyUsedQueue.Len() < cache.cacheCapacity {
+		putDataByKey("filler"+strconv.Itoa(cache.recentlyUsedQueue.Len()), new(DataBlock))
+	}
+	cache.table = &undeletableTable{cache.table}
+	done := make(chan error)
+	go func() {
+		fsLock.Lock()
+		defer fsLock.Unlock()
+		done <- cache.makeRoom()
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err == errStoreUnavailable {
+			t.Fatalf("making room with a failing table returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("making room with a failing table is still retrying")
+	}
+}
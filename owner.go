@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"encoding/binary"
+	"golang.org/x/net/context"
+)
+
+// the bytes kept in an owner block for each inode: its uid and then its gid
+const OWNER_RECORD_SIZE uint64 = 8
+const OWNERS_PER_BLOCK uint64 = BLOCK_SIZE / OWNER_RECORD_SIZE
+
+// whether the mounted file system keeps the owner of each inode, which those created before format
+// version 9 do not, so that their files are all owned by root. Set by makeFs.
+var inodeOwners bool
+
+/*
+Owner block keys are of the format "HASH-ownerBlockNUMBER", where HASH is the first 2 bytes of the
+md5 hash of "ownerBlockNUMBER", like the keys of inode blocks. Each owner block holds the owners of
+OWNERS_PER_BLOCK inodes.
+*/
+func genOwnerBlockKey(inodeNum uint64) string {
+	return genRecordBlockKey("ownerBlock", inodeNum, OWNERS_PER_BLOCK)
+}
+
+/*
+Returns the key of the block of the given kind (e.g. "ownerBlock") holding the record of the inode
+with inodeNum, as keyScheme names it, where each block holds perBlock records.
+*/
+func genRecordBlockKey(kind string, inodeNum, perBlock uint64) string {
+	return keyScheme.BlockKey(kind, inodeNum/perBlock)
+}
+
+/*
+Returns the owner block holding the owner of the inode with inodeNum, or a new block if it does not
+exist yet. See getRecordBlock.
+*/
+func getOwnerBlock(inodeNum uint64) (*DataBlock, error) {
+	return getRecordBlock(genOwnerBlockKey(inodeNum), inodeNum, OWNERS_PER_BLOCK)
+}
+
+/*
+Returns the block with key, holding the records of perBlock inodes including the one with inodeNum,
+or a new block if it does not exist yet. As with key blocks, such a block is only created by the
+first inode it holds (or the root), so that an error reading an existing block does not cause the
+records in it to be overwritten.
+*/
+func getRecordBlock(key string, inodeNum, perBlock uint64) (*DataBlock, error) {
+	block, err := getDataByKey(key)
+	if err != nil {
+		if inodeNum%perBlock != 0 && inodeNum != ROOT_INODE {
+			return nil, err
+		}
+		block = new(DataBlock)
+	}
+	return block, nil
+}
+
+/*
+Returns the uid and gid of the owner of the inode with inodeNum.
+*/
+func getOwner(inodeNum uint64) (uint32, uint32, error) {
+	block, err := getDataByKey(genOwnerBlockKey(inodeNum))
+	if err != nil {
+		return 0, 0, err
+	}
+	start := (inodeNum % OWNERS_PER_BLOCK) * OWNER_RECORD_SIZE
+	uid := binary.LittleEndian.Uint32(block.Data[start : start+4])
+	gid := binary.LittleEndian.Uint32(block.Data[start+4 : start+8])
+	return uid, gid, nil
+}
+
+/*
+Stores uid and gid as the owner of the inode with inodeNum.
+*/
+func putOwner(inodeNum uint64, uid, gid uint32) error {
+	block, err := getOwnerBlock(inodeNum)
+	if err != nil {
+		return err
+	}
+	start := (inodeNum % OWNERS_PER_BLOCK) * OWNER_RECORD_SIZE
+	binary.LittleEndian.PutUint32(block.Data[start:start+4], uid)
+	binary.LittleEndian.PutUint32(block.Data[start+4:start+8], gid)
+	return putDataByKey(genOwnerBlockKey(inodeNum), block)
+}
+
+/*
+Makes the user and group of the request in header the owner of the new inode with inodeNum, if the
+file system keeps owners. Called before the inode is first stored.
+*/
+func setNewOwner(inode *Inode, inodeNum uint64, header fuse.Header) error {
+	if !inodeOwners {
+		return nil
+	}
+	inode.Uid = header.Uid
+	inode.Gid = header.Gid
+	return putOwner(inodeNum, inode.Uid, inode.Gid)
+}
+
+/*
+Changes the owner of the inode with inodeNum, at path p, to the uid and gid set in req, as chown(2)
+does. Only root can give an inode to another user, and only root and the owner can change its group;
+the groups of the owner are not known, so the owner can change it to any group. Does nothing if req
+changes neither.
+*/
+func chown(inode *Inode, inodeNum uint64, p string, req *fuse.SetattrRequest) error {
+	if !req.Valid.Uid() && !req.Valid.Gid() {
+		return nil
+	}
+	if !inodeOwners {
+		return fuse.ENOTSUP
+	}
+	uid, gid := inode.Uid, inode.Gid
+	if req.Valid.Uid() {
+		uid = req.Uid
+	}
+	if req.Valid.Gid() {
+		gid = req.Gid
+	}
+	if uid == inode.Uid && gid == inode.Gid {
+		return nil
+	}
+	if req.Header.Uid != 0 && (uid != inode.Uid || req.Header.Uid != inode.Uid) {
+		return fuse.EPERM
+	}
+	err := checkStoreWritable()
+	if err != nil {
+		return err
+	}
+	err = putOwner(inodeNum, uid, gid)
+	if err != nil {
+		return err
+	}
+	inode.Uid, inode.Gid = uid, gid
+	inode.changed()
+	err = inode.writeTimes(inodeNum)
+	if err != nil {
+		return err
+	}
+	// the copy in the inode cache, and those of other nodes for the inode, are read again
+	inodes.invalidate(inodeNum)
+	audit("chown", req.Header, p, "", inodeNum)
+	return nil
+}
+
+var _ = fs.NodeSetattrer(&Dir{})
+
+/*
+FUSE method that changes the owner of the directory. Other changes to its attributes are accepted
+but ignored, as they were before directories had owners.
+*/
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	defer trackOp("Setattr")()
+	defer recoverPanic("Setattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Setattr")()
+	debugOp(d.path, "Setattr", "inode=%d valid=%v uid=%d gid=%d", d.inodeNum, req.Valid, req.Uid, req.Gid)
+	return chown(d.inode, d.inodeNum, d.path, req)
+}
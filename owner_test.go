@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Returns a request changing the owner to uid and gid, made by the user caller.
+*/
+func chownRequest(caller, uid, gid uint32) *fuse.SetattrRequest {
+	return &fuse.SetattrRequest{
+		Header: fuse.Header{Uid: caller},
+		Valid:  fuse.SetattrUid | fuse.SetattrGid,
+		Uid:    uid,
+		Gid:    gid,
+	}
+}
+
+/*
+Checks that new files and directories belong to the user creating them, that only root can give
+them away, that the owner can change their group, and that the owner is kept.
+*/
+func TestOwners(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	user := fuse.Header{Uid: 1000, Gid: 100}
+	node, handle, err := root.Create(ctx, &fuse.CreateRequest{Header: user, Name: "file"}, new(fuse.CreateResponse))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	handle.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	file := node.(*File)
+	dirNode, err := root.Mkdir(ctx, &fuse.MkdirRequest{Header: user, Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	dir := dirNode.(*Dir)
+	var attr fuse.Attr
+	file.Attr(ctx, &attr)
+	if attr.Uid != 1000 || attr.Gid != 100 {
+		t.Fatalf("new file owned by %d:%d", attr.Uid, attr.Gid)
+	}
+	dir.Attr(ctx, &attr)
+	if attr.Uid != 1000 || attr.Gid != 100 {
+		t.Fatalf("new directory owned by %d:%d", attr.Uid, attr.Gid)
+	}
+
+	resp := new(fuse.SetattrResponse)
+	if err := file.Setattr(ctx, chownRequest(1000, 1001, 100), resp); err != fuse.EPERM {
+		t.Fatalf("giving a file away as its owner returned %v", err)
+	}
+	if err := file.Setattr(ctx, chownRequest(1001, 1000, 200), resp); err != fuse.EPERM {
+		t.Fatalf("changing the group of another user's file returned %v", err)
+	}
+	if err := file.Setattr(ctx, chownRequest(1000, 1000, 200), resp); err != nil {
+		t.Fatalf("changing the group as the owner: %v", err)
+	}
+	if err := dir.Setattr(ctx, chownRequest(0, 0, 0), resp); err != nil {
+		t.Fatalf("chown of a directory as root: %v", err)
+	}
+
+	// a write through the handle, which stores the inode, keeps the new owner
+	_, handle, _ = root.Create(ctx, &fuse.CreateRequest{Header: user, Name: "file"}, new(fuse.CreateResponse))
+	fh := handle.(*FileHandle)
+	fh.Write(ctx, &fuse.WriteRequest{Data: []byte("data")}, new(fuse.WriteResponse))
+	fh.Release(ctx, new(fuse.ReleaseRequest))
+	inodes = newInodeCache(INODE_CACHE_SIZE, INODE_CACHE_TTL)
+	for _, p := range []string{"/file", "/dir"} {
+		node, err := lookupNode(filesys, p)
+		if err != nil {
+			t.Fatalf("lookupNode: %v", err)
+		}
+		node.Attr(ctx, &attr)
+		if p == "/file" && (attr.Uid != 1000 || attr.Gid != 200 || attr.Size != 4) {
+			t.Fatalf("file owned by %d:%d with size %d", attr.Uid, attr.Gid, attr.Size)
+		}
+		if p == "/dir" && (attr.Uid != 0 || attr.Gid != 0) {
+			t.Fatalf("directory owned by %d:%d after chown to root", attr.Uid, attr.Gid)
+		}
+	}
+}
+
+/*
+Checks that file systems created before owners were kept refuse chown, and report every file as
+owned by root, as they did.
+*/
+func TestOwnersNotKept(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	inodeOwners = false
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, handle, err := root.Create(ctx, &fuse.CreateRequest{Header: fuse.Header{Uid: 1000}, Name: "file"}, new(fuse.CreateResponse))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	handle.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	var attr fuse.Attr
+	node.Attr(ctx, &attr)
+	if attr.Uid != 0 {
+		t.Fatalf("file owned by %d", attr.Uid)
+	}
+	if err := node.(*File).Setattr(ctx, chownRequest(0, 1000, 0), new(fuse.SetattrResponse)); err != fuse.ENOTSUP {
+		t.Fatalf("chown returned %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// the bytes kept in a parent block for each inode: the inode number of the directory it was last
+// linked into
+const PARENT_RECORD_SIZE uint64 = 8
+const PARENTS_PER_BLOCK uint64 = BLOCK_SIZE / PARENT_RECORD_SIZE
+
+// whether new file systems keep a path index, from PathIndex in the config
+var PATH_INDEX bool
+
+// whether the mounted file system keeps the parent of each inode in parent blocks, so that the path
+// of an inode can be found from its number. Set by makeFs.
+var pathIndex bool
+
+// the most directories inodePath goes up through, so that a cycle left by a bad index ends
+const MAX_PATH_DEPTH int = 4096
+
+var errPathFound = errors.New("path found")
+
+/*
+Parent block keys are of the format "HASH-parentBlockNUMBER", like those of owner blocks. Each parent
+block holds the parents of PARENTS_PER_BLOCK inodes.
+*/
+func genParentBlockKey(inodeNum uint64) string {
+	return genRecordBlockKey("parentBlock", inodeNum, PARENTS_PER_BLOCK)
+}
+
+/*
+Returns the inode number of the directory the inode with inodeNum was last linked into, or
+INVALID_INODE if it has none recorded.
+*/
+func getParent(inodeNum uint64) (uint64, error) {
+	block, err := getDataByKey(genParentBlockKey(inodeNum))
+	if err != nil {
+		return INVALID_INODE, err
+	}
+	start := (inodeNum % PARENTS_PER_BLOCK) * PARENT_RECORD_SIZE
+	return binary.LittleEndian.Uint64(block.Data[start : start+PARENT_RECORD_SIZE]), nil
+}
+
+/*
+Records the directory with parentNum as the parent of the inode with inodeNum, if the file system
+keeps a path index. Called whenever an entry is pointed at an inode, by creating, linking, or
+renaming it. The index is only a hint, checked against the directory entries whenever it is used, so
+a failure to update it is printed rather than failing the change. A file linked into several
+directories has the last of them recorded, and one whose recorded entry is removed has no path
+until it is linked or renamed again.
+*/
+func indexParent(inodeNum, parentNum uint64) {
+	if !pathIndex {
+		return
+	}
+	key := genParentBlockKey(inodeNum)
+	block, err := getRecordBlock(key, inodeNum, PARENTS_PER_BLOCK)
+	if err == nil {
+		start := (inodeNum % PARENTS_PER_BLOCK) * PARENT_RECORD_SIZE
+		binary.LittleEndian.PutUint64(block.Data[start:start+PARENT_RECORD_SIZE], parentNum)
+		err = putDataByKey(key, block)
+	}
+	if err != nil {
+		fmt.Printf("Failed to index the parent of inode %d: %v\n", inodeNum, err)
+	}
+}
+
+/*
+Returns the name of an entry of the directory with parentNum that links to the inode with inodeNum.
+*/
+func entryName(parentNum, inodeNum uint64) (string, error) {
+	parent, err := getInode(parentNum)
+	if err != nil {
+		return "", err
+	}
+	if !parent.isDir() {
+		return "", fmt.Errorf("the parent of inode %d, inode %d, is not a directory", inodeNum, parentNum)
+	}
+	table, err := readTable(parentNum, parent)
+	if err != nil {
+		return "", err
+	}
+	var found string
+	err = table.forEachEntry(func(name string, childNum uint64) error {
+		if childNum == inodeNum {
+			found = name
+			return errPathFound
+		}
+		return nil
+	})
+	if err != errPathFound {
+		return "", fmt.Errorf("inode %d is not in its parent, inode %d", inodeNum, parentNum)
+	}
+	return found, nil
+}
+
+/*
+Returns the path of the inode with inodeNum, found by going up through the parents in the path
+index to the root, and checking that each directory still has an entry for the one below it. Must
+be called holding fsLock.
+*/
+func inodePath(inodeNum uint64) (string, error) {
+	if !pathIndex {
+		return "", errors.New("the file system keeps no path index")
+	}
+	p := ""
+	for depth := 0; inodeNum != ROOT_INODE; depth++ {
+		if depth == MAX_PATH_DEPTH {
+			return "", fmt.Errorf("inode %d is more than %d directories deep", inodeNum, MAX_PATH_DEPTH)
+		}
+		parentNum, err := getParent(inodeNum)
+		if err != nil {
+			return "", err
+		}
+		if parentNum == INVALID_INODE {
+			return "", fmt.Errorf("inode %d has no parent in the path index", inodeNum)
+		}
+		name, err := entryName(parentNum, inodeNum)
+		if err != nil {
+			return "", err
+		}
+		p = "/" + name + p
+		inodeNum = parentNum
+	}
+	if p == "" {
+		return "/", nil
+	}
+	return p, nil
+}
+
+/*
+Struct representing the reply to the "path" admin command.
+*/
+type pathResponse struct {
+	adminResponse
+	Path string `json:"path,omitempty"`
+}
+
+/*
+Replies with the path of the inode of the request, so that the inode numbers in audit records and
+handles can be resolved.
+*/
+func pathCommand(req *adminRequest, conn net.Conn, enc *json.Encoder) error {
+	fsLock.Lock()
+	p, err := inodePath(req.Inode)
+	fsLock.Unlock()
+	if err != nil {
+		return enc.Encode(&adminResponse{Error: err.Error()})
+	}
+	return enc.Encode(&pathResponse{adminResponse: adminResponse{OK: true}, Path: p})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Checks that the path of an inode is found through the path index after it is created and after a
+directory above it is renamed, that a removed file has no path, and that fsck checks the index.
+*/
+func TestPathIndex(t *testing.T) {
+	PATH_INDEX = true
+	defer func() { PATH_INDEX = false }()
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	dir := node.(*Dir)
+	node, _ = dir.Mkdir(ctx, &fuse.MkdirRequest{Name: "sub"})
+	file := writeTestFile(t, node.(*Dir), "file", testData(100, 1), 100)
+	if p, err := inodePath(file.inodeNum); err != nil || p != "/dir/sub/file" {
+		t.Fatalf("the file has path %q, err %v", p, err)
+	}
+	if p, err := inodePath(ROOT_INODE); err != nil || p != "/" {
+		t.Fatalf("the root has path %q, err %v", p, err)
+	}
+
+	err := dir.Rename(ctx, &fuse.RenameRequest{OldName: "sub", NewName: "moved"}, root)
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if p, err := inodePath(file.inodeNum); err != nil || p != "/moved/file" {
+		t.Fatalf("the file has path %q after the rename, err %v", p, err)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck: %+v", report.problems)
+	}
+	indexParent(file.inodeNum, dir.inodeNum)
+	if report := fsck(filesys); len(report.problems) != 1 {
+		t.Fatalf("fsck found %v in the index with a wrong parent, want 1 problem", report.problems)
+	}
+
+	err = root.Remove(ctx, &fuse.RemoveRequest{Name: "dir", Dir: true})
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if p, err := inodePath(dir.inodeNum); err == nil {
+		t.Fatalf("the removed directory has path %q", p)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"sync"
+)
+
+// the most blocks the prefetch admin command reads from S3 at once
+const PREFETCH_PARALLELISM int = 16
+
+/*
+Struct representing the reply to the "prefetch" admin command.
+*/
+type prefetchResponse struct {
+	adminResponse
+	Blocks  int      `json:"blocks,omitempty"`  // the number of blocks being pulled into the cache
+	Files   int      `json:"files,omitempty"`   // the number of files of a manifest they belong to
+	Skipped []string `json:"skipped,omitempty"` // the paths of a manifest that are not files, with why
+}
+
+/*
+Admin command that starts pulling the blocks of the file at req.Path, or of the files at req.Paths
+(a manifest), into the cache, so that a job reading them later does not wait for S3. It replies once
+the blocks to prefetch are known, without waiting for them to be read.
+*/
+func prefetchCommand(req *adminRequest, conn net.Conn, enc *json.Encoder) error {
+	if len(req.Paths) > 0 {
+		return prefetchManifestCommand(req.Paths, enc)
+	}
+	keys, err := prefetchKeys(mountedFs, req.Path)
+	if err != nil {
+		return enc.Encode(&adminResponse{Error: err.Error()})
+	}
+	go prefetchBlocksParallel(keys)
+	return enc.Encode(&prefetchResponse{adminResponse: adminResponse{OK: true}, Blocks: len(keys)})
+}
+
+/*
+Starts pulling the blocks of the files at paths into the cache. Paths that are missing or are not
+files are skipped and reported, since a manifest written for one version of a data set should not
+stop the rest of it from being prefetched. Blocks shared by files (as hard links are) are read once.
+*/
+func prefetchManifestCommand(paths []string, enc *json.Encoder) error {
+	resp := &prefetchResponse{adminResponse: adminResponse{OK: true}}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, p := range paths {
+		blockKeys, err := prefetchKeys(mountedFs, p)
+		if err != nil {
+			if mountedFs == nil {
+				return enc.Encode(&adminResponse{Error: err.Error()})
+			}
+			resp.Skipped = append(resp.Skipped, err.Error())
+			continue
+		}
+		for _, key := range blockKeys {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		resp.Files++
+	}
+	if len(keys) > cache.cacheCapacity {
+		return enc.Encode(&adminResponse{Error: fmt.Sprintf("the manifest has %d blocks to prefetch, but the cache only holds %d", len(keys), cache.cacheCapacity)})
+	}
+	resp.Blocks = len(keys)
+	go prefetchBlocksParallel(keys)
+	return enc.Encode(resp)
+}
+
+/*
+Returns the paths listed in a manifest, one to a line. Blank lines and lines starting with "#" are
+skipped, and paths are taken relative to the root of the file system.
+*/
+func readManifest(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, scanner.Err()
+}
+
+/*
+Returns the keys of the data blocks of the file at p, in file order, that are not in the cache.
+The indirect blocks of the file are read into the cache along the way. Fails if the blocks would
+not all fit in the cache, since the first would then be evicted by the last.
+*/
+func prefetchKeys(filesys *FS, p string) ([]string, error) {
+	if filesys == nil {
+		return nil, errors.New("the file system is not mounted")
+	}
+	node, err := lookupNode(filesys, path.Clean("/"+p))
+	if err != nil {
+		return nil, errors.New(p + ": " + err.Error())
+	}
+	file, ok := node.(*File)
+	if !ok {
+		return nil, errors.New(p + " is not a file")
+	}
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	var keys []string
+	err = file.inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		key := genDataKey(blockNum)
+		if !indirect && cache.keyHash[key] == nil {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.New(p + ": " + err.Error())
+	}
+	if len(keys) > cache.cacheCapacity {
+		return nil, fmt.Errorf("%s has %d blocks to prefetch, but the cache only holds %d", p, len(keys), cache.cacheCapacity)
+	}
+	return keys, nil
+}
+
+/*
+Reads the blocks with keys into the cache, one at a time, so that requests are only held up by one
+block read at a time. Blocks that were read into the cache since their keys were found are skipped.
+*/
+func prefetchBlocks(keys []string) {
+	for _, key := range keys {
+		fsLock.Lock()
+		if cache.keyHash[key] == nil {
+			debugBlock("prefetch key=%s", key)
+			_, err := getDataByKey(key)
+			if err != nil {
+				fmt.Println("Failed to prefetch block " + key + ": " + err.Error())
+			}
+		}
+		fsLock.Unlock()
+	}
+}
+
+/*
+Reads the blocks with keys into the cache, PREFETCH_PARALLELISM at a time. The blocks are read from
+S3 without holding fsLock, so that requests are not held up while they are, and added to the cache
+holding it, unless they were written or deleted in the meantime (see startFetch). They are read with
+a context of their own, so that they are not aborted along with the request holding fsLock.
+*/
+func prefetchBlocksParallel(keys []string) {
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < PREFETCH_PARALLELISM; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer useAWSContext(context.Background())()
+			for key := range work {
+				prefetchBlock(key)
+			}
+		}()
+	}
+	for _, key := range keys {
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+}
+
+/*
+Reads the block with key from S3 into the cache, if it is not there yet.
+*/
+func prefetchBlock(key string) {
+	fsLock.Lock()
+	fetch := cache.startFetch(key)
+	fsLock.Unlock()
+	if !fetch {
+		return
+	}
+	debugBlock("prefetch key=%s", key)
+	data, err := getStoredDataByKey(key)
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	if err == nil {
+		err = cache.endFetch(key, data)
+	} else {
+		delete(cache.fetching, key)
+	}
+	if err != nil {
+		fmt.Println("Failed to prefetch block " + key + ": " + err.Error())
+	}
+}
+
+/*
+Marks the block with key as being read from S3 outside fsLock, and returns whether it should be,
+which it should not if it is in the cache or already being read. Must be called holding fsLock.
+*/
+func (c *Cache) startFetch(key string) bool {
+	if c.keyHash[key] != nil || c.fetching[key] {
+		return false
+	}
+	c.fetching[key] = true
+	return true
+}
+
+/*
+Adds the block with key, read from S3 after startFetch, to the cache. A block written or deleted
+while it was being read is left out, since what was read may be older than what was written; the
+write or deletion clears the mark startFetch made. Must be called holding fsLock.
+*/
+func (c *Cache) endFetch(key string, data *DataBlock) error {
+	if !c.fetching[key] {
+		return nil
+	}
+	delete(c.fetching, key)
+	if c.keyHash[key] != nil {
+		return nil
+	}
+	return c.fillBlock(data, key)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Prefetches a file over the admin socket, and checks that its blocks end up in the cache, and that
+directories and files too big for the cache are refused.
+*/
+func TestPrefetch(t *testing.T) {
+	filesys, _ := newTestFs(t, 32)
+	root := testRoot(t, filesys)
+	writeTestFile(t, root, "file", testData(int(INODE_BUFFER_SIZE+20*BLOCK_SIZE), 1), 1<<16)
+	writeTestFile(t, root, "huge", testData(int(INODE_BUFFER_SIZE+40*BLOCK_SIZE), 1), 1<<16)
+	root.Mkdir(context.Background(), &fuse.MkdirRequest{Name: "dir"})
+	cache.empty()
+	cache = newCache(newMemStore(), 32)
+	mountedFs = filesys
+	defer func() { mountedFs = nil }()
+
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	err := startAdminSocket(socketPath)
+	if err != nil {
+		t.Fatalf("startAdminSocket: %v", err)
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("connecting to the admin socket: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	enc := json.NewEncoder(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, p := range []string{"/dir", "/huge", "/missing"} {
+		enc.Encode(&adminRequest{Command: "prefetch", Path: p})
+		line, _ := reader.ReadBytes('\n')
+		var resp prefetchResponse
+		json.Unmarshal(line, &resp)
+		if resp.OK || resp.Error == "" {
+			t.Fatalf("prefetch of %s replied %s, want an error", p, line)
+		}
+	}
+	enc.Encode(&adminRequest{Command: "prefetch", Path: "/file"})
+	line, _ := reader.ReadBytes('\n')
+	var resp prefetchResponse
+	json.Unmarshal(line, &resp)
+	if !resp.OK || resp.Blocks != 20 {
+		t.Fatalf("prefetch replied %s, want 20 blocks", line)
+	}
+
+	keys, err := prefetchKeys(filesys, "/file")
+	for deadline := time.Now().Add(5 * time.Second); len(keys) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		keys, err = prefetchKeys(filesys, "/file")
+	}
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("%d blocks still not in the cache after prefetching, err %v", len(keys), err)
+	}
+}
+
+/*
+Prefetches the files of a manifest, and checks that comments and blank lines are passed over, that
+paths that are not files are skipped, and that the blocks of the files end up in the cache.
+*/
+func TestPrefetchManifest(t *testing.T) {
+	filesys, _ := newTestFs(t, 32)
+	root := testRoot(t, filesys)
+	writeTestFile(t, root, "a", testData(int(INODE_BUFFER_SIZE+5*BLOCK_SIZE), 1), 1<<16)
+	writeTestFile(t, root, "b", testData(int(INODE_BUFFER_SIZE+7*BLOCK_SIZE), 2), 1<<16)
+	cache.empty()
+	cache = newCache(newMemStore(), 32)
+	mountedFs = filesys
+	defer func() { mountedFs = nil }()
+
+	paths, err := readManifest(strings.NewReader("# training set\n/a\n\n  b  \nmissing\n/a\n"))
+	if err != nil || len(paths) != 4 || paths[1] != "b" {
+		t.Fatalf("readManifest returned %q, %v", paths, err)
+	}
+	var out bytes.Buffer
+	err = prefetchCommand(&adminRequest{Command: "prefetch", Paths: paths}, nil, json.NewEncoder(&out))
+	if err != nil {
+		t.Fatalf("prefetchCommand: %v", err)
+	}
+	var resp prefetchResponse
+	json.Unmarshal(out.Bytes(), &resp)
+	if !resp.OK || resp.Files != 3 || resp.Blocks != 12 || len(resp.Skipped) != 1 {
+		t.Fatalf("prefetch of the manifest replied %s, want 3 files of 12 blocks and 1 skipped", out.Bytes())
+	}
+
+	for _, p := range []string{"/a", "/b"} {
+		keys, err := prefetchKeys(filesys, p)
+		for deadline := time.Now().Add(5 * time.Second); len(keys) > 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			keys, err = prefetchKeys(filesys, p)
+		}
+		if err != nil || len(keys) != 0 {
+			t.Fatalf("%d blocks of %s still not in the cache after prefetching, err %v", len(keys), p, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"sort"
+)
+
+// the tags put on the bucket and the tables when the first mount creates them, from Tags
+var PROVISION_TAGS map[string]string
+
+// the default encryption put on the bucket when it is created, from ServerSideEncryption: "AES256"
+// (SSE-S3) or "aws:kms" (SSE-KMS, with SSE_KMS_KEY_ARN, or the AWS managed key if it is ""), or ""
+// to leave the bucket with the S3 default. Tables are encrypted with the KMS key under "aws:kms",
+// and with a key owned by DynamoDB otherwise.
+var SSE_ALGORITHM string
+var SSE_KMS_KEY_ARN string
+
+// whether the bucket gets all four of its public access blocks turned on when it is created
+var BLOCK_PUBLIC_ACCESS bool
+
+// whether the bucket gets versioning turned on when it is created
+var BUCKET_VERSIONING bool
+
+// the most tags S3 puts on a bucket
+const MAX_BUCKET_TAGS int = 50
+
+/*
+Sets the provisioning globals from the config, returning an error if they are not valid.
+*/
+func setProvisioning(config *Config) error {
+	if len(config.Tags) > MAX_BUCKET_TAGS {
+		return fmt.Errorf("Tags can hold at most %d tags, not %d.", MAX_BUCKET_TAGS, len(config.Tags))
+	}
+	for key := range config.Tags {
+		if key == "" {
+			return errors.New("Tags cannot have an empty key.")
+		}
+	}
+	switch config.ServerSideEncryption {
+	case "", s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms:
+	default:
+		return errors.New("ServerSideEncryption must be \"" + s3.ServerSideEncryptionAes256 + "\" or \"" + s3.ServerSideEncryptionAwsKms + "\" or left out, not \"" + config.ServerSideEncryption + "\".")
+	}
+	if config.ServerSideKMSKeyARN != "" && config.ServerSideEncryption != s3.ServerSideEncryptionAwsKms {
+		return errors.New("ServerSideKMSKeyARN needs ServerSideEncryption \"" + s3.ServerSideEncryptionAwsKms + "\".")
+	}
+	PROVISION_TAGS = config.Tags
+	SSE_ALGORITHM = config.ServerSideEncryption
+	SSE_KMS_KEY_ARN = config.ServerSideKMSKeyARN
+	BLOCK_PUBLIC_ACCESS = config.BlockPublicAccess
+	BUCKET_VERSIONING = config.Versioning
+	return nil
+}
+
+/*
+Returns the keys of PROVISION_TAGS in order, so that the tags are always sent in the same order.
+*/
+func sortedTagKeys() []string {
+	keys := make([]string, 0, len(PROVISION_TAGS))
+	for key := range PROVISION_TAGS {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+Returns PROVISION_TAGS as S3 tags.
+*/
+func bucketTags() []*s3.Tag {
+	var tags []*s3.Tag
+	for _, key := range sortedTagKeys() {
+		tags = append(tags, &s3.Tag{Key: aws.String(key), Value: aws.String(PROVISION_TAGS[key])})
+	}
+	return tags
+}
+
+/*
+Applies the tags, default encryption, public access blocks, and versioning of the config to the
+bucket just created, returning the first error. Only a bucket the file system creates is set up, so
+that the settings of a bucket provisioned some other way are never changed.
+*/
+func provisionBucket(client *s3.S3) error {
+	bucket := aws.String(S3_BUCKET_NAME)
+	if len(PROVISION_TAGS) > 0 {
+		_, err := client.PutBucketTagging(&s3.PutBucketTaggingInput{
+			Bucket:  bucket,
+			Tagging: &s3.Tagging{TagSet: bucketTags()},
+		})
+		if err != nil {
+			return fmt.Errorf("tagging the bucket: %v", err)
+		}
+	}
+	if SSE_ALGORITHM != "" {
+		rule := &s3.ServerSideEncryptionByDefault{SSEAlgorithm: aws.String(SSE_ALGORITHM)}
+		if SSE_KMS_KEY_ARN != "" {
+			rule.KMSMasterKeyID = aws.String(SSE_KMS_KEY_ARN)
+		}
+		_, err := client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+			Bucket: bucket,
+			ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+				Rules: []*s3.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: rule}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("setting the default encryption of the bucket: %v", err)
+		}
+	}
+	if BLOCK_PUBLIC_ACCESS {
+		_, err := client.PutPublicAccessBlock(&s3.PutPublicAccessBlockInput{
+			Bucket: bucket,
+			PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+				BlockPublicAcls:       aws.Bool(true),
+				BlockPublicPolicy:     aws.Bool(true),
+				IgnorePublicAcls:      aws.Bool(true),
+				RestrictPublicBuckets: aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("blocking public access to the bucket: %v", err)
+		}
+	}
+	if BUCKET_VERSIONING {
+		_, err := client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+			Bucket:                  bucket,
+			VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+		})
+		if err != nil {
+			return fmt.Errorf("turning on versioning of the bucket: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+Adds the tags and encryption of the config to the request creating one of the tables of the file
+system, and returns it.
+*/
+func provisionTable(input *dynamodb.CreateTableInput) *dynamodb.CreateTableInput {
+	for _, key := range sortedTagKeys() {
+		input.Tags = append(input.Tags, &dynamodb.Tag{Key: aws.String(key), Value: aws.String(PROVISION_TAGS[key])})
+	}
+	if SSE_ALGORITHM == s3.ServerSideEncryptionAwsKms {
+		input.SSESpecification = &dynamodb.SSESpecification{
+			Enabled: aws.Bool(true),
+			SSEType: aws.String(dynamodb.SSETypeKms),
+		}
+		if SSE_KMS_KEY_ARN != "" {
+			input.SSESpecification.KMSMasterKeyId = aws.String(SSE_KMS_KEY_ARN)
+		}
+	}
+	return input
+}
+
+/*
+Returns the IAM actions, on the bucket and on each table, that creating them needs beyond
+s3:CreateBucket and dynamodb:CreateTable to be set up as the config asks.
+*/
+func provisionActions(config *Config) (bucketActions, tableActions []string) {
+	if len(config.Tags) > 0 {
+		bucketActions = append(bucketActions, "s3:PutBucketTagging")
+		tableActions = append(tableActions, "dynamodb:TagResource")
+	}
+	if config.ServerSideEncryption != "" {
+		bucketActions = append(bucketActions, "s3:PutEncryptionConfiguration")
+	}
+	if config.BlockPublicAccess {
+		bucketActions = append(bucketActions, "s3:PutBucketPublicAccessBlock")
+	}
+	// a bucket created with Object Lock has versioning turned on with it, see makeIAMPolicy
+	if config.Versioning && config.ObjectLockMode == "" && !config.ObjectLockLegalHold {
+		bucketActions = append(bucketActions, "s3:PutBucketVersioning")
+	}
+	return bucketActions, tableActions
+}
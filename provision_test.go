@@ -0,0 +1,49 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"testing"
+)
+
+/*
+Checks that the provisioning settings are checked, that the tables are created with the tags, in
+key order, and with the KMS key of SSE-KMS, and that the policy for creating the file system allows
+setting up the bucket and tables as the config asks.
+*/
+func TestProvisioning(t *testing.T) {
+	defer setProvisioning(new(Config))
+	bad := []*Config{
+		{ServerSideEncryption: "DES"},
+		{ServerSideKMSKeyARN: "arn:aws:kms:us-east-1:1:key/k"},
+		{Tags: map[string]string{"": "empty"}},
+	}
+	for _, config := range bad {
+		if setProvisioning(config) == nil {
+			t.Errorf("setProvisioning accepted %+v", config)
+		}
+	}
+	config := &Config{Bucket: "b", Table: "t", Locks: LOCKS_DYNAMODB, Tags: map[string]string{"team": "data", "cost-center": "42"},
+		ServerSideEncryption: "aws:kms", ServerSideKMSKeyARN: "arn:aws:kms:us-east-1:1:key/k", BlockPublicAccess: true}
+	if err := setProvisioning(config); err != nil {
+		t.Fatalf("setProvisioning: %v", err)
+	}
+
+	input := provisionTable(&dynamodb.CreateTableInput{TableName: aws.String("t")})
+	if len(input.Tags) != 2 || aws.StringValue(input.Tags[0].Key) != "cost-center" || aws.StringValue(input.Tags[1].Value) != "data" {
+		t.Errorf("table created with tags %v", input.Tags)
+	}
+	if input.SSESpecification == nil || aws.StringValue(input.SSESpecification.KMSMasterKeyId) != config.ServerSideKMSKeyARN {
+		t.Errorf("table created with encryption %v", input.SSESpecification)
+	}
+
+	policy := makeIAMPolicy(config, true)
+	for _, action := range []string{"s3:PutBucketTagging", "s3:PutEncryptionConfiguration", "s3:PutBucketPublicAccessBlock", "dynamodb:TagResource"} {
+		if !policyAllows(policy, action) {
+			t.Errorf("policy for creating the file system does not allow %s", action)
+		}
+	}
+	if policyAllows(policy, "s3:PutBucketVersioning") || policyAllows(makeIAMPolicy(config, false), "dynamodb:TagResource") {
+		t.Errorf("policy allows setting up more than the config asks for")
+	}
+}
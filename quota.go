@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the most blocks the file system may take, from QuotaGB, or 0 for no limit. Writes that would grow
+// files past it fail with EDQUOT, and df shows it as the size of the file system.
+var QUOTA_BLOCKS uint64
+
+// the blocks past which writes growing files start the grace period, from SoftQuotaGB, or 0 for no
+// soft limit. Once the grace period has passed, they fail with EDQUOT until enough is removed.
+var SOFT_QUOTA_BLOCKS uint64
+
+// how long the blocks in use may stay over SOFT_QUOTA_BLOCKS, as with the grace period of disk quotas
+const DEFAULT_QUOTA_GRACE_PERIOD time.Duration = 7 * 24 * time.Hour
+
+var QUOTA_GRACE_PERIOD time.Duration = DEFAULT_QUOTA_GRACE_PERIOD
+
+// the blocks kept below QUOTA_BLOCKS for the writers under each path, from QuotaReservedGB, so that
+// writers elsewhere get EDQUOT first as the file system fills up
+var QUOTA_RESERVATIONS map[string]uint64
+
+// the superblock info of the mounted file system, whose blocks in use are checked against the
+// quotas, and which records when they went over the soft quota. Set by makeFs.
+var quotaInfo *SuperblockInfo
+
+/*
+Sets the quota globals from the config, returning an error if they do not make sense together.
+*/
+func setQuotas(config *Config) error {
+	if config.QuotaGB < 0 || config.SoftQuotaGB < 0 {
+		return errors.New("QuotaGB and SoftQuotaGB cannot be negative.")
+	}
+	QUOTA_BLOCKS = uint64(config.QuotaGB) << 30 / BLOCK_SIZE
+	SOFT_QUOTA_BLOCKS = uint64(config.SoftQuotaGB) << 30 / BLOCK_SIZE
+	if QUOTA_BLOCKS > 0 && SOFT_QUOTA_BLOCKS > QUOTA_BLOCKS {
+		return errors.New("SoftQuotaGB cannot be more than QuotaGB.")
+	}
+	QUOTA_GRACE_PERIOD = DEFAULT_QUOTA_GRACE_PERIOD
+	if config.QuotaGrace != "" {
+		grace, err := time.ParseDuration(config.QuotaGrace)
+		if err != nil || grace < 0 {
+			return errors.New("QuotaGrace must be a duration such as \"72h\", not \"" + config.QuotaGrace + "\".")
+		}
+		QUOTA_GRACE_PERIOD = grace
+	}
+	QUOTA_RESERVATIONS = make(map[string]uint64, len(config.QuotaReservedGB))
+	var reserved uint64
+	for p, gb := range config.QuotaReservedGB {
+		if !path.IsAbs(p) || gb <= 0 {
+			return fmt.Errorf("QuotaReservedGB must give absolute paths a positive size, not %d for %q.", gb, p)
+		}
+		blocks := uint64(gb) << 30 / BLOCK_SIZE
+		QUOTA_RESERVATIONS[path.Clean(p)] = blocks
+		reserved += blocks
+	}
+	if reserved > 0 && reserved >= QUOTA_BLOCKS {
+		return errors.New("QuotaReservedGB must reserve less than QuotaGB in all.")
+	}
+	return nil
+}
+
+/*
+Returns whether p is dir or a path under it.
+*/
+func pathUnder(p, dir string) bool {
+	return dir == "/" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+/*
+Returns the blocks reserved for paths that p is not under, which the writers of p may not use.
+Reservations are kept free below QUOTA_BLOCKS rather than counted against the blocks their paths
+hold, so a writer under a reserved path may use the space of its reservation and everything above.
+*/
+func reservedFrom(p string) uint64 {
+	var reserved uint64
+	for dir, blocks := range QUOTA_RESERVATIONS {
+		if !pathUnder(p, dir) {
+			reserved += blocks
+		}
+	}
+	return reserved
+}
+
+/*
+Returns the data blocks a file of size bytes takes, counting the part of a block at its end.
+*/
+func dataBlocksFor(size uint64) uint64 {
+	if size <= INODE_BUFFER_SIZE {
+		return 0
+	}
+	return (size - INODE_BUFFER_SIZE + BLOCK_SIZE - 1) / BLOCK_SIZE
+}
+
+/*
+Returns fuse.Errno(syscall.EDQUOT) if writing size bytes at offset to the file at p, with inode,
+would take the file system over its quota, or nil if it may be written. Only writes that grow the
+file are checked, by the blocks they add past its end, so that files can still be overwritten and
+truncated to make room. Must be called holding fsLock.
+*/
+func checkQuota(p string, inode *Inode, offset, size uint64) error {
+	if quotaInfo == nil || (QUOTA_BLOCKS == 0 && SOFT_QUOTA_BLOCKS == 0) || offset+size <= inode.Size {
+		return nil
+	}
+	start := inode.Size
+	if offset > start {
+		start = offset
+	}
+	added := dataBlocksFor(offset+size) - dataBlocksFor(start)
+	space := currentSpace(quotaInfo)
+	used := space.UsedBlocks + space.RetainedBlocks
+	if QUOTA_BLOCKS > 0 && used+added > QUOTA_BLOCKS-reservedFrom(p) {
+		countStat(&mountStats.QuotaDenials, 1)
+		return fuse.Errno(syscall.EDQUOT)
+	}
+	if SOFT_QUOTA_BLOCKS == 0 {
+		return nil
+	}
+	if used+added <= SOFT_QUOTA_BLOCKS {
+		quotaInfo.SoftQuotaExceeded = 0
+		return nil
+	}
+	now := time.Now()
+	if quotaInfo.SoftQuotaExceeded == 0 {
+		quotaInfo.SoftQuotaExceeded = now.Unix()
+		fmt.Printf("The file system is over its soft quota; writes growing files will fail after %v.\n", QUOTA_GRACE_PERIOD)
+	}
+	if now.Sub(time.Unix(quotaInfo.SoftQuotaExceeded, 0)) > QUOTA_GRACE_PERIOD {
+		countStat(&mountStats.QuotaDenials, 1)
+		return fuse.Errno(syscall.EDQUOT)
+	}
+	return nil
+}
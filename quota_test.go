@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+Creates a file at name under dir and returns a handle open on it for writing.
+*/
+func createForQuota(t *testing.T, dir *Dir, name string) *FileHandle {
+	t.Helper()
+	_, handle, err := dir.Create(context.Background(), &fuse.CreateRequest{Name: name}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	return handle.(*FileHandle)
+}
+
+/*
+Writes a block to fh at offset, returning the error of the write.
+*/
+func writeBlockForQuota(fh *FileHandle, offset uint64) error {
+	req := &fuse.WriteRequest{Offset: int64(offset), Data: testData(int(BLOCK_SIZE), int64(offset))}
+	return fh.Write(context.Background(), req, &fuse.WriteResponse{})
+}
+
+/*
+Checks that writes growing files fail with EDQUOT past QuotaGB, leaving the space reserved for a
+path to the writers under it, that files can still be overwritten, and that df reports the quota
+with the reserved space unavailable.
+*/
+func TestQuota(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	// the blocks in use are counted from the blocks deleted by this mount
+	mountStats = LifetimeStats{}
+	defer func() {
+		QUOTA_BLOCKS = 0
+		QUOTA_RESERVATIONS = nil
+	}()
+	used := currentSpace(filesys.info).UsedBlocks
+	QUOTA_BLOCKS = used + 4
+	QUOTA_RESERVATIONS = map[string]uint64{"/logs": 2}
+	node, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "logs"})
+	logs := node.(*Dir)
+
+	big := createForQuota(t, root, "big")
+	for offset := INODE_BUFFER_SIZE; offset < INODE_BUFFER_SIZE+2*BLOCK_SIZE; offset += BLOCK_SIZE {
+		if err := writeBlockForQuota(big, offset); err != nil {
+			t.Fatalf("writing under the quota: %v", err)
+		}
+	}
+	if err := writeBlockForQuota(big, INODE_BUFFER_SIZE+2*BLOCK_SIZE); err != fuse.Errno(syscall.EDQUOT) {
+		t.Fatalf("writing into the reserved space returned %v, want EDQUOT", err)
+	}
+	if err := writeBlockForQuota(big, INODE_BUFFER_SIZE); err != nil {
+		t.Fatalf("overwriting the file returned %v", err)
+	}
+
+	var stat fuse.StatfsResponse
+	filesys.Statfs(ctx, new(fuse.StatfsRequest), &stat)
+	if stat.Blocks != QUOTA_BLOCKS || stat.Bfree != 2 || stat.Bavail != 0 {
+		t.Fatalf("df reports %d blocks, %d free, and %d available, want %d, 2, and 0", stat.Blocks, stat.Bfree, stat.Bavail, QUOTA_BLOCKS)
+	}
+
+	app := createForQuota(t, logs, "app")
+	for offset := INODE_BUFFER_SIZE; offset < INODE_BUFFER_SIZE+2*BLOCK_SIZE; offset += BLOCK_SIZE {
+		if err := writeBlockForQuota(app, offset); err != nil {
+			t.Fatalf("writing under the reserved path: %v", err)
+		}
+	}
+	if err := writeBlockForQuota(app, INODE_BUFFER_SIZE+2*BLOCK_SIZE); err != fuse.Errno(syscall.EDQUOT) {
+		t.Fatalf("writing past the quota under the reserved path returned %v, want EDQUOT", err)
+	}
+	big.Release(ctx, new(fuse.ReleaseRequest))
+	app.Release(ctx, new(fuse.ReleaseRequest))
+}
+
+/*
+Checks that writes over the soft quota succeed during the grace period and fail with EDQUOT once it
+has passed, and that going back under it ends the grace period.
+*/
+func TestSoftQuota(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	// the blocks in use are counted from the blocks deleted by this mount
+	mountStats = LifetimeStats{}
+	defer func() {
+		SOFT_QUOTA_BLOCKS = 0
+		QUOTA_GRACE_PERIOD = DEFAULT_QUOTA_GRACE_PERIOD
+	}()
+	SOFT_QUOTA_BLOCKS = currentSpace(filesys.info).UsedBlocks + 1
+	QUOTA_GRACE_PERIOD = time.Hour
+
+	fh := createForQuota(t, root, "file")
+	for offset := INODE_BUFFER_SIZE; offset < INODE_BUFFER_SIZE+2*BLOCK_SIZE; offset += BLOCK_SIZE {
+		if err := writeBlockForQuota(fh, offset); err != nil {
+			t.Fatalf("writing during the grace period: %v", err)
+		}
+	}
+	if filesys.info.SoftQuotaExceeded == 0 {
+		t.Fatalf("going over the soft quota did not start the grace period")
+	}
+	filesys.info.SoftQuotaExceeded = time.Now().Add(-2 * time.Hour).Unix()
+	if err := writeBlockForQuota(fh, INODE_BUFFER_SIZE+2*BLOCK_SIZE); err != fuse.Errno(syscall.EDQUOT) {
+		t.Fatalf("writing after the grace period returned %v, want EDQUOT", err)
+	}
+
+	err := fh.inode.truncate(0)
+	if err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := writeBlockForQuota(fh, 0); err != nil || filesys.info.SoftQuotaExceeded != 0 {
+		t.Fatalf("writing back under the soft quota returned %v, grace period started at %d", err, filesys.info.SoftQuotaExceeded)
+	}
+	fh.Release(ctx, new(fuse.ReleaseRequest))
+}
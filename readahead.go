@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the number of blocks read ahead of sequential reads of files that do not set READAHEAD_XATTR,
+// or 0 to only read ahead files that do
+var READAHEAD_WINDOW uint64
+
+// the number of reads of a file handle in a row, each starting where the last one ended, before
+// the blocks after them are read ahead
+const DEFAULT_READAHEAD_TRIGGER int = 2
+
+var READAHEAD_TRIGGER int = DEFAULT_READAHEAD_TRIGGER
+
+// the most readaheads that may be in flight at once, beyond which reads are not read ahead
+const DEFAULT_MAX_PREFETCHES int32 = 4
+
+var MAX_PREFETCHES int32 = DEFAULT_MAX_PREFETCHES
+
+// how long DynamoDB must go without throttling before a readahead window cut by throttling is
+// doubled again, and the most times it is halved
+const READAHEAD_RECOVERY_INTERVAL time.Duration = time.Minute
+const MAX_READAHEAD_SHIFT uint = 6
+
+// the number of readaheads in flight
+var activePrefetches int32
+
+// the error codes with which AWS throttles requests
+var throttleCodes = []string{"ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded"}
+
+/*
+Returns whether err is an error from AWS throttling a request.
+*/
+func isThrottle(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, code := range throttleCodes {
+		if strings.Contains(err.Error(), code) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Halves the readahead window if err is DynamoDB throttling the cache, since reading ahead adds to
+the requests being throttled.
+*/
+func (c *Cache) noteError(err error) {
+	if !isThrottle(err) {
+		return
+	}
+	if c.readaheadShift < MAX_READAHEAD_SHIFT {
+		c.readaheadShift++
+		debugBlock("cache throttled, readahead window shift=%d", c.readaheadShift)
+	}
+	c.lastThrottle = time.Now()
+}
+
+/*
+Returns window cut down by throttling, first doubling it back if DynamoDB has not throttled for
+READAHEAD_RECOVERY_INTERVAL.
+*/
+func (c *Cache) readaheadWindow(window uint64) uint64 {
+	if c.readaheadShift > 0 && time.Since(c.lastThrottle) >= READAHEAD_RECOVERY_INTERVAL {
+		c.readaheadShift--
+		c.lastThrottle = time.Now()
+	}
+	return window >> c.readaheadShift
+}
+
+/*
+Starts reading the blocks that follow a read of size bytes at offset into the cache, as many as the
+readahead of the inode gives, or else READAHEAD_WINDOW, so that a sequential reader finds them
+there. Files that are not to be cached are not read ahead, and neither are reads made while
+MAX_PREFETCHES readaheads are in flight.
+*/
+func (i *Inode) readAhead(offset, size uint64) {
+	count := i.readahead()
+	if count == 0 {
+		count = READAHEAD_WINDOW
+	}
+	count = cache.readaheadWindow(count)
+	// reading ahead more than half the cache would evict the blocks being read
+	if max := uint64(cache.cacheCapacity / 2); count > max {
+		count = max
+	}
+	end := offset + size
+	if count == 0 || i.cacheHint() == FILE_CACHE_NONE || end <= INODE_BUFFER_SIZE {
+		return
+	}
+	numBlocks := i.numDataBlocks()
+	var keys []string
+	// the block holding the end of the read was just read, so the next one is the first to fetch
+	for index := (end - INODE_BUFFER_SIZE + BLOCK_SIZE - 1) / BLOCK_SIZE; count > 0 && index < numBlocks; index++ {
+		blockNum, err := i.dataBlockNum(index)
+		if err != nil {
+			fmt.Println("Failed to find the blocks to read ahead: " + err.Error())
+			break
+		}
+		key := genDataKey(blockNum)
+		if blockNum != 0 && cache.keyHash[key] == nil {
+			keys = append(keys, key)
+		}
+		count--
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if atomic.AddInt32(&activePrefetches, 1) > MAX_PREFETCHES {
+		atomic.AddInt32(&activePrefetches, -1)
+		return
+	}
+	go func() {
+		defer atomic.AddInt32(&activePrefetches, -1)
+		prefetchBlocks(keys)
+	}()
+}
+
+/*
+Starts reading the inode blocks of the entries of a directory being opened into the cache, so that
+a listing that goes on to look up every entry, as ls -l and find do, does not wait for each block in
+turn. Inodes are packed BLOCK_SIZE/INODE_SIZE to a block, so each block is read once however many
+entries it holds. File systems keeping their metadata as items have no inode blocks to read.
+*/
+func prefetchEntryInodes(table *InodeTable) {
+	if metadataStore != nil {
+		return
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, inodeNum := range table.Table {
+		key := genInodeBlockKey(inodeNum)
+		if inodeNum == INVALID_INODE || seen[key] || cache.keyHash[key] != nil {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	// reading more than half the cache would evict the blocks being read
+	if max := cache.cacheCapacity / 2; len(keys) > max {
+		keys = keys[:max]
+	}
+	if len(keys) == 0 {
+		return
+	}
+	if atomic.AddInt32(&activePrefetches, 1) > MAX_PREFETCHES {
+		atomic.AddInt32(&activePrefetches, -1)
+		return
+	}
+	go func() {
+		defer atomic.AddInt32(&activePrefetches, -1)
+		prefetchBlocks(keys)
+	}()
+}
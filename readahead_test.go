@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+Checks that READAHEAD_WINDOW reads ahead of files without a readahead of their own, but only once
+READAHEAD_TRIGGER reads in a row were sequential.
+*/
+func TestReadaheadWindow(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "file", testData(int(INODE_BUFFER_SIZE+12*BLOCK_SIZE), 1), 1<<16)
+	cache.empty()
+	cache = newCache(newMemStore(), 16)
+	READAHEAD_WINDOW = 3
+	defer func() { READAHEAD_WINDOW = 0 }()
+
+	handle, _ := file.Open(ctx, new(fuse.OpenRequest), new(fuse.OpenResponse))
+	fh := handle.(*FileHandle)
+	read := func(block uint64) {
+		req := &fuse.ReadRequest{Offset: int64(INODE_BUFFER_SIZE + block*BLOCK_SIZE), Size: int(BLOCK_SIZE)}
+		if err := fh.Read(ctx, req, new(fuse.ReadResponse)); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	// scattered reads are not read ahead
+	read(6)
+	read(0)
+	read(9)
+	time.Sleep(50 * time.Millisecond)
+	fsLock.Lock()
+	cached := cachedBlocks(t, file)
+	fsLock.Unlock()
+	if cached != 3 {
+		t.Fatalf("%d blocks cached after 3 scattered reads", cached)
+	}
+	// the second of two reads in a row reads the next 3 blocks ahead
+	read(1)
+	read(2)
+	for deadline := time.Now().Add(5 * time.Second); cached < 8 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		fsLock.Lock()
+		cached = cachedBlocks(t, file)
+		fsLock.Unlock()
+	}
+	if cached != 8 {
+		t.Fatalf("%d blocks cached after sequential reads, want 8", cached)
+	}
+}
+
+/*
+Checks that the readahead window is halved each time DynamoDB throttles the cache, and doubled back
+once it has not for READAHEAD_RECOVERY_INTERVAL.
+*/
+func TestReadaheadThrottling(t *testing.T) {
+	c := newCache(newMemStore(), 16)
+	c.noteError(errInjectedServer)
+	if window := c.readaheadWindow(8); window != 8 {
+		t.Fatalf("window %d after a server error, want 8", window)
+	}
+	c.noteError(errInjectedThrottle)
+	c.noteError(errInjectedThrottle)
+	if window := c.readaheadWindow(8); window != 2 {
+		t.Fatalf("window %d after throttling twice, want 2", window)
+	}
+	c.lastThrottle = time.Now().Add(-READAHEAD_RECOVERY_INTERVAL)
+	if window := c.readaheadWindow(8); window != 4 {
+		t.Fatalf("window %d after a quiet interval, want 4", window)
+	}
+	if window := c.readaheadWindow(8); window != 4 {
+		t.Fatalf("window %d right after growing, want 4", window)
+	}
+}
+
+/*
+Checks that opening a directory reads the inode blocks of its entries into the cache.
+*/
+func TestPrefetchEntryInodes(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	inodesPerBlock := BLOCK_SIZE / INODE_SIZE
+	var last *File
+	for i := uint64(0); i < 2*inodesPerBlock; i++ {
+		last = writeTestFile(t, root, "file"+strconv.FormatUint(i, 10), testData(10, int64(i)), 10)
+	}
+	cache.empty()
+	cache = newCache(newMemStore(), 16)
+
+	handle, err := root.Open(ctx, new(fuse.OpenRequest), new(fuse.OpenResponse))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer handle.(*DirHandle).Release(ctx, new(fuse.ReleaseRequest))
+	lastBlock := last.inodeNum / inodesPerBlock
+	cached := func() uint64 {
+		fsLock.Lock()
+		defer fsLock.Unlock()
+		var n uint64
+		for block := uint64(0); block <= lastBlock; block++ {
+			if cache.keyHash[genInodeBlockKey(block*inodesPerBlock)] != nil {
+				n++
+			}
+		}
+		return n
+	}
+	for deadline := time.Now().Add(5 * time.Second); cached() <= lastBlock && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := cached(); n != lastBlock+1 {
+		t.Fatalf("%d of the %d inode blocks of the entries were read", n, lastBlock+1)
+	}
+}
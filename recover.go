@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+// the mounted file system, used to checkpoint state if a handler panics
+var mountedFs *FS
+
+/*
+Recovers from a panic in a FUSE handler. Must be deferred directly by the handler. A panic
+leaves the in-memory state (the streams and the list of blocks held in DynamoDB) in an
+unknown condition, so rather than continuing to serve, the stack is logged, the superblock
+is checkpointed and the cache is flushed to S3 as far as possible, and the file system is
+unmounted.
+*/
+func recoverPanic(op string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "panic in %s: %v\n%s", op, r, debug.Stack())
+	emergencyShutdown()
+}
+
+/*
+Attempts to save the file system state and unmount, then exits the program.
+*/
+func emergencyShutdown() {
+	fmt.Println("Attempting emergency flush of the file system.")
+	shutdown()
+}
+
+/*
+Saves the file system state and unmounts it, then exits the program. If the unmount fails, the
+mountpoint is left behind and has to be unmounted by hand, or the next mount will fail.
+*/
+func shutdown() {
+	if mountedFs != nil {
+		mountedFs.Destroy()
+	}
+	if mountpoint == "" {
+		// served over 9P instead of mounted
+		os.Exit(1)
+	}
+	err := binding.unmount(mountpoint)
+	if err != nil {
+		fmt.Println("Error unmounting " + mountpoint + ": " + err.Error())
+		fmt.Println("Unmount it with: " + UNMOUNT_COMMAND + " " + mountpoint)
+	}
+	os.Exit(1)
+}
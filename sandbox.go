@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// the prefix put before the key of every object and cache item of the file system, from the
+// --sandbox-prefix flag, or "" to use the keys as they are. It keeps a file system used for testing
+// apart from the real one in the same bucket and table.
+var SANDBOX_PREFIX string
+
+/*
+Returns an error if the file system cannot be run in a sandbox with the config. The items of
+MetadataStore "items" and the locks of Locks "dynamodb" are keyed by inode numbers in tables of
+their own, which the prefix does not reach, so a sandbox would share them with the real file system.
+*/
+func checkSandbox(config *Config) error {
+	if SANDBOX_PREFIX == "" {
+		return nil
+	}
+	if config.MetadataStore != "" || config.Locks != "" {
+		return errors.New("--sandbox-prefix only namespaces blocks, so cannot be used with MetadataStore or Locks.")
+	}
+	return nil
+}
+
+/*
+Returns an error if the built-in tests of the test or stress flag would write to a file system that
+is not in a sandbox, so that passing them with a production config cannot pollute its data.
+*/
+func checkTestSandbox() error {
+	if (runTests || runStress) && SANDBOX_PREFIX == "" {
+		return errors.New("The " + TEST_FLAG + " and " + STRESS_FLAG + " flags write to the file system, so they need --sandbox-prefix.")
+	}
+	return nil
+}
+
+/*
+Wraps the global store and the table of the global cache so that their keys are put under
+SANDBOX_PREFIX, if it is set. Called once the backend is set up.
+*/
+func sandboxBackend() {
+	if SANDBOX_PREFIX == "" {
+		return
+	}
+	store = sandboxStore(store)
+	cache.table = &prefixedTable{inner: cache.table, prefix: SANDBOX_PREFIX}
+}
+
+/*
+Returns s with its keys put under SANDBOX_PREFIX, or s itself if it is not set.
+*/
+func sandboxStore(s ObjectStore) ObjectStore {
+	if SANDBOX_PREFIX == "" {
+		return s
+	}
+	return &prefixedStore{inner: s, prefix: SANDBOX_PREFIX}
+}
+
+/*
+ObjectStore that puts prefix before the keys of the objects of inner. It does not pass on the
+checksums of a VerifyingStore, the copies of a CopyingStore, or the retention of a LockingStore, so
+in a sandbox verify and cp fall back to reading the objects, and Object Lock is not applied. It does
+pass on the Range GETs of a RangeStore, the versions of a VersionedStore, and the batches of a
+BatchDeletingStore.
+*/
+type prefixedStore struct {
+	inner  ObjectStore
+	prefix string
+}
+
+var _ ObjectStore = (*prefixedStore)(nil)
+
+/*
+ObjectStore method that gets the object with key from under the prefix.
+*/
+func (s *prefixedStore) GetObject(key string) ([]byte, error) {
+	return s.inner.GetObject(s.prefix + key)
+}
+
+/*
+RangeStore method that gets part of the object with key from under the prefix, getting only that
+part if the inner store can.
+*/
+func (s *prefixedStore) GetObjectRange(key string, offset, length uint64) ([]byte, error) {
+	return getObjectRange(s.inner, s.prefix+key, offset, length)
+}
+
+/*
+VersionedStore method that gets the version of the object with key from under the prefix that was
+current at the given time, if the inner store keeps versions.
+*/
+func (s *prefixedStore) GetObjectAt(key string, at time.Time) ([]byte, *objectVersion, error) {
+	versions, ok := s.inner.(VersionedStore)
+	if !ok {
+		return nil, nil, errors.New("the store does not keep versions of its objects")
+	}
+	return versions.GetObjectAt(s.prefix+key, at)
+}
+
+/*
+ObjectStore method that puts data with key under the prefix.
+*/
+func (s *prefixedStore) PutObject(key string, data []byte) error {
+	return s.inner.PutObject(s.prefix+key, data)
+}
+
+/*
+ObjectStore method that deletes the object with key from under the prefix.
+*/
+func (s *prefixedStore) DeleteObject(key string) error {
+	return s.inner.DeleteObject(s.prefix + key)
+}
+
+/*
+BatchDeletingStore method that deletes the objects with keys from under the prefix, with one request
+if the inner store can.
+*/
+func (s *prefixedStore) DeleteObjects(keys []string) []error {
+	prefixed := make([]string, len(keys))
+	for n, key := range keys {
+		prefixed[n] = s.prefix + key
+	}
+	return deleteObjects(s.inner, prefixed)
+}
+
+/*
+CacheTable that puts prefix before the keys of the items of inner.
+*/
+type prefixedTable struct {
+	inner  CacheTable
+	prefix string
+}
+
+var _ CacheTable = (*prefixedTable)(nil)
+
+/*
+CacheTable method that gets the item with key from under the prefix.
+*/
+func (t *prefixedTable) GetItem(key string) ([]byte, error) {
+	return t.inner.GetItem(t.prefix + key)
+}
+
+/*
+CacheTable method that puts data with key under the prefix.
+*/
+func (t *prefixedTable) PutItem(key string, data []byte) error {
+	return t.inner.PutItem(t.prefix+key, data)
+}
+
+/*
+CacheTable method that deletes the item with key from under the prefix, returning its data.
+*/
+func (t *prefixedTable) DeleteItem(key string) ([]byte, error) {
+	return t.inner.DeleteItem(t.prefix + key)
+}
+
+/*
+ListingTable method that returns the keys of the items under the prefix, without it, if the inner
+table can list its items.
+*/
+func (t *prefixedTable) ListItems() ([]string, error) {
+	lister, ok := t.inner.(ListingTable)
+	if !ok {
+		return nil, errors.New("the cache table cannot list its items")
+	}
+	all, err := lister.ListItems()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, key := range all {
+		if strings.HasPrefix(key, t.prefix) {
+			keys = append(keys, strings.TrimPrefix(key, t.prefix))
+		}
+	}
+	return keys, nil
+}
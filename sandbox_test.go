@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+/*
+Checks that a file system in a sandbox keeps its blocks under the prefix, in the store and in the
+cache table, and that the test flags refuse to run outside of one.
+*/
+func TestSandboxPrefix(t *testing.T) {
+	objects, table := newMemStore(), newMemStore()
+	store = objects
+	cache = newCache(table, 16)
+	SANDBOX_PREFIX = "sandbox/"
+	defer func() { SANDBOX_PREFIX = "" }()
+	sandboxBackend()
+	filesys, err := makeFs(makeNewSuperblock())
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	makeNewRootInode()
+	writeTestFile(t, testRoot(t, filesys), "file", testData(int(INODE_BUFFER_SIZE+BLOCK_SIZE), 1), 1<<16)
+	if table.Len() == 0 {
+		t.Fatalf("nothing was written to the cache table")
+	}
+	checkKeysUnder(t, table, SANDBOX_PREFIX)
+	filesys.Destroy()
+	if objects.Len() == 0 {
+		t.Fatalf("nothing was written to the store")
+	}
+	checkKeysUnder(t, objects, SANDBOX_PREFIX)
+
+	runTests = true
+	defer func() { runTests = false }()
+	if err := checkTestSandbox(); err != nil {
+		t.Errorf("the test flag was refused in a sandbox: %v", err)
+	}
+	SANDBOX_PREFIX = ""
+	if err := checkTestSandbox(); err == nil {
+		t.Errorf("the test flag was allowed outside of a sandbox")
+	}
+}
+
+/*
+Fails the test if any key in items is not under prefix.
+*/
+func checkKeysUnder(t *testing.T, items *MemStore, prefix string) {
+	t.Helper()
+	for key := range items.items {
+		if !strings.HasPrefix(key, prefix) {
+			t.Errorf("%s is not under %s", key, prefix)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// the prefix of share tokens, which tells them apart from the gateway token and versions their format
+const SHARE_TOKEN_PREFIX string = "cfshare1."
+
+// the query parameter that a share token can be given in, so that links to shared files work
+// without setting headers
+const SHARE_TOKEN_PARAM string = "token"
+
+/*
+Struct holding what a share token grants: reading the file or directory at Path, and everything under
+it, until Expires.
+*/
+type shareGrant struct {
+	Path    string `json:"p"`
+	Expires int64  `json:"e"` // in seconds since the epoch
+}
+
+/*
+Returns a share token for reading the subtree at path p through a gateway whose token is secret,
+until expires. The token is the grant signed with an HMAC keyed with the gateway token, so the
+gateway checks it without keeping any state, and changing the gateway token revokes every share
+token issued with it.
+*/
+func issueShareToken(secret string, p string, expires time.Time) string {
+	grant, _ := json.Marshal(&shareGrant{Path: path.Clean("/" + p), Expires: expires.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(grant)
+	return SHARE_TOKEN_PREFIX + payload + "." + shareSignature(secret, payload)
+}
+
+/*
+Returns the signature of the payload of a share token.
+*/
+func shareSignature(secret string, payload string) string {
+	mac := hmac.New(sha256.New, []byte("cloudfusion share token\x00"+secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Returns the path that the share token grants reading, if it was issued with secret and has not
+expired by now.
+*/
+func parseShareToken(secret string, token string, now time.Time) (string, error) {
+	if !strings.HasPrefix(token, SHARE_TOKEN_PREFIX) {
+		return "", errors.New("not a share token")
+	}
+	parts := strings.Split(strings.TrimPrefix(token, SHARE_TOKEN_PREFIX), ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(shareSignature(secret, parts[0]))) {
+		return "", errors.New("bad share token signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	var grant shareGrant
+	err = json.Unmarshal(data, &grant)
+	if err != nil {
+		return "", err
+	}
+	if now.Unix() >= grant.Expires {
+		return "", errors.New("share token expired")
+	}
+	return grant.Path, nil
+}
+
+/*
+Returns whether path p is the path scope or under it. Both are absolute and clean.
+*/
+func inShareScope(scope string, p string) bool {
+	return scope == "/" || p == scope || strings.HasPrefix(p, scope+"/")
+}
+
+/*
+Returns the path that the share token carried by the request grants reading, as a bearer token, the
+password of basic authentication, or the token query parameter, and whether it carries a valid one.
+*/
+func (g *httpGateway) shareScope(r *http.Request) (string, bool) {
+	var tokens []string
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		tokens = append(tokens, strings.TrimPrefix(auth, "Bearer "))
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		tokens = append(tokens, password)
+	}
+	tokens = append(tokens, r.URL.Query().Get(SHARE_TOKEN_PARAM))
+	for _, token := range tokens {
+		if scope, err := parseShareToken(g.token, token, time.Now()); err == nil {
+			return scope, true
+		}
+	}
+	return "", false
+}
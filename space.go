@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"sync/atomic"
+)
+
+// the number of blocks and files reported as the size of the file system by statfs. S3 has no
+// capacity, so a large one is made up, and the space taken is subtracted from it. The config can
+// set a size of its own, for tools that plan around the size of the file system.
+const DEFAULT_STATFS_BLOCKS uint64 = 1 << 32
+const DEFAULT_STATFS_FILES uint64 = 1 << 32
+
+var STATFS_BLOCKS uint64 = DEFAULT_STATFS_BLOCKS
+var STATFS_FILES uint64 = DEFAULT_STATFS_FILES
+
+// the longest name statfs reports that entries can have
+const STATFS_NAME_LENGTH uint32 = 255
+
+/*
+Struct describing where the space of the file system goes, as reported by statfs and the metrics
+command. Data block numbers are never reused, so the blocks in use are those allocated and not
+deleted since; file systems mounted before deletions were counted report the blocks they deleted
+before then as in use.
+*/
+type spaceReport struct {
+	UsedBlocks     uint64 `json:"usedBlocks"`     // data and indirect blocks of files and directories
+	RetainedBlocks uint64 `json:"retainedBlocks"` // deleted blocks that S3 Object Lock keeps until their retention ends
+	DirtyBlocks    uint64 `json:"dirtyBlocks"`    // blocks whose changes are only in the DynamoDB cache
+	// the bytes taken beyond the live data in S3, which are freed without deleting anything: the
+	// retained blocks once their retention ends, and the dirty blocks once they are written to S3
+	ReclaimableBytes uint64 `json:"reclaimableBytes"`
+}
+
+/*
+Returns where the space of the mounted file system described by info goes. The caller holds fsLock.
+*/
+func currentSpace(info *SuperblockInfo) *spaceReport {
+	deleted := info.Stats.BlocksDeleted + atomic.LoadUint64(&mountStats.BlocksDeleted)
+	retained := info.Stats.BlocksRetained + atomic.LoadUint64(&mountStats.BlocksRetained)
+	// the data stream starts at 1
+	allocated := dataStream.lastInt - 1
+	report := &spaceReport{RetainedBlocks: retained}
+	if allocated > deleted {
+		report.UsedBlocks = allocated - deleted
+	}
+	dirty, _ := cache.dirtyBlocks()
+	report.DirtyBlocks = uint64(dirty)
+	report.ReclaimableBytes = (report.RetainedBlocks + report.DirtyBlocks) * BLOCK_SIZE
+	return report
+}
+
+/*
+Fills resp with the made-up size of the file system, or its quota if it has one, less the blocks in
+use and those retained by Object Lock, which are taken from the space available until they can be
+removed. Nothing is free once the file system holds more than its size. The space reserved for paths
+by QUOTA_RESERVATIONS is free but not available, as the space ext4 reserves for root is.
+*/
+func (r *spaceReport) statfs(inodesInUse uint64, resp *fuse.StatfsResponse) {
+	resp.Blocks = STATFS_BLOCKS
+	if QUOTA_BLOCKS > 0 {
+		resp.Blocks = QUOTA_BLOCKS
+	}
+	resp.Bfree = 0
+	taken := r.UsedBlocks + r.RetainedBlocks
+	if taken < resp.Blocks {
+		resp.Bfree = resp.Blocks - taken
+	}
+	resp.Bavail = 0
+	// no path is under "", so this is every reservation
+	if reserved := reservedFrom(""); resp.Bfree > reserved {
+		resp.Bavail = resp.Bfree - reserved
+	}
+	resp.Files = STATFS_FILES
+	resp.Ffree = 0
+	if inodesInUse < STATFS_FILES {
+		resp.Ffree = STATFS_FILES - inodesInUse
+	}
+	resp.Bsize = uint32(BLOCK_SIZE)
+	resp.Frsize = uint32(BLOCK_SIZE)
+	resp.Namelen = STATFS_NAME_LENGTH
+}
+
+var _ = fs.FSStatfser(&FS{})
+
+/*
+FUSE method that reports the size and free space of the file system, as df shows them.
+*/
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	defer trackOp("Statfs")()
+	defer recoverPanic("Statfs")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Statfs")()
+	currentSpace(f.info).statfs(f.inodeStream.lastInt-uint64(f.inodeStream.stack.Len()), resp)
+	return nil
+}
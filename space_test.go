@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"errors"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+ObjectStore backed by memory that refuses to delete objects, as S3 does for objects under Object Lock.
+*/
+type retainingStore struct {
+	*MemStore
+}
+
+/*
+Refuses to delete the object.
+*/
+func (s *retainingStore) DeleteObject(key string) error {
+	return errors.New("AccessDenied: object " + key + " is locked")
+}
+
+/*
+Checks that the blocks of files are counted as used until they are deleted, that blocks kept by
+Object Lock are counted as reclaimable and taken from the free space, and that statfs reports both.
+*/
+func TestSpaceReport(t *testing.T) {
+	mountStats = LifetimeStats{}
+	filesys, objects := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	before := currentSpace(filesys.info)
+	size := int(INODE_BUFFER_SIZE + 3*BLOCK_SIZE)
+	writeTestFile(t, root, "file", testData(size, 1), size)
+	space := currentSpace(filesys.info)
+	if space.UsedBlocks != before.UsedBlocks+3 || space.DirtyBlocks == 0 {
+		t.Fatalf("after writing 3 blocks: %+v, before %+v", space, before)
+	}
+	if space.ReclaimableBytes != space.DirtyBlocks*BLOCK_SIZE {
+		t.Fatalf("%d bytes reclaimable with %d dirty blocks", space.ReclaimableBytes, space.DirtyBlocks)
+	}
+	var stat fuse.StatfsResponse
+	filesys.Statfs(ctx, new(fuse.StatfsRequest), &stat)
+	if stat.Blocks != STATFS_BLOCKS || stat.Bfree != STATFS_BLOCKS-space.UsedBlocks || stat.Bsize != uint32(BLOCK_SIZE) {
+		t.Fatalf("statfs %+v with %d blocks used", stat, space.UsedBlocks)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if space = currentSpace(filesys.info); space.UsedBlocks != before.UsedBlocks || mountStats.BlocksDeleted != 3 {
+		t.Fatalf("after removing the file: %+v, %d blocks deleted", space, mountStats.BlocksDeleted)
+	}
+
+	// blocks written to S3 that it refuses to delete
+	writeTestFile(t, root, "locked", testData(size, 2), size)
+	if err := cache.empty(); err != nil {
+		t.Fatalf("cache.empty: %v", err)
+	}
+	OBJECT_LOCK_MODE = "GOVERNANCE"
+	defer func() { OBJECT_LOCK_MODE = "" }()
+	store = &retainingStore{objects}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "locked"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	space = currentSpace(filesys.info)
+	if space.UsedBlocks != before.UsedBlocks || space.RetainedBlocks != 3 || space.ReclaimableBytes < 3*BLOCK_SIZE {
+		t.Fatalf("after removing a locked file: %+v", space)
+	}
+	filesys.Statfs(ctx, new(fuse.StatfsRequest), &stat)
+	if stat.Bfree != STATFS_BLOCKS-space.UsedBlocks-3 || stat.Bavail != stat.Bfree {
+		t.Fatalf("statfs %+v with %d blocks used and 3 retained", stat, space.UsedBlocks)
+	}
+}
+
+/*
+Checks that statfs reports the size set by the config, and no free blocks or files once the file
+system holds more than it.
+*/
+func TestStatfsVirtualSize(t *testing.T) {
+	mountStats = LifetimeStats{}
+	filesys, _ := newTestFs(t, 8)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	defer func() { STATFS_BLOCKS, STATFS_FILES = DEFAULT_STATFS_BLOCKS, DEFAULT_STATFS_FILES }()
+	size := int(INODE_BUFFER_SIZE + 3*BLOCK_SIZE)
+	writeTestFile(t, root, "file", testData(size, 1), size)
+	used := currentSpace(filesys.info).UsedBlocks
+	STATFS_BLOCKS, STATFS_FILES = used+10, 100
+	var stat fuse.StatfsResponse
+	filesys.Statfs(ctx, new(fuse.StatfsRequest), &stat)
+	if stat.Blocks != used+10 || stat.Bfree != 10 || stat.Files != 100 || stat.Ffree == 0 || stat.Ffree >= 100 {
+		t.Fatalf("statfs %+v with %d blocks used", stat, used)
+	}
+	STATFS_BLOCKS, STATFS_FILES = used-1, 1
+	filesys.Statfs(ctx, new(fuse.StatfsRequest), &stat)
+	if stat.Blocks != used-1 || stat.Bfree != 0 || stat.Bavail != 0 || stat.Ffree != 0 {
+		t.Fatalf("statfs %+v of a file system holding more than its size", stat)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+)
+
+// whether blocks written as all zeros are left as holes rather than stored, so that the zeros
+// written by VM images and preallocating databases take no space or requests in S3
+var SKIP_ZERO_BLOCKS bool
+
+/*
+Returns the number of data blocks under an indirect block with the given depth (1 for singly
+indirect).
+*/
+func indirectSpan(depth int) uint64 {
+	span := uint64(1)
+	for ; depth > 0; depth-- {
+		span *= BLOCK_POINTERS
+	}
+	return span
+}
+
+/*
+Returns the bytes left to read once the part of a read from relative offset that falls in a hole of
+size bytes is passed over. The read buffer is already zeros, so nothing needs to be copied.
+*/
+func skipHole(offset, leftToRead, size uint64) uint64 {
+	return leftToRead - minUint64(leftToRead, size-offset)
+}
+
+/*
+Counts a block allocated to the inode, if its blocks have been counted.
+*/
+func (i *Inode) allocated() {
+	if i.usedBlocksKnown {
+		i.usedBlocks++
+	}
+}
+
+/*
+Returns the number of data and indirect blocks the inode uses, which for a sparse file is less than
+its size would take. They are counted by walking the indirect blocks the first time, and kept up to
+date as blocks are allocated after that; freeing blocks makes them be counted again.
+*/
+func (i *Inode) countUsedBlocks() (uint64, error) {
+	if i.usedBlocksKnown {
+		return i.usedBlocks, nil
+	}
+	var used uint64
+	err := i.forEachBlock(func(blockNum uint64, indirect bool) error {
+		used++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	i.usedBlocks = used
+	i.usedBlocksKnown = true
+	return used, nil
+}
+
+/*
+Returns the space the data of the inode takes, in the 512-byte units of st_blocks, so that du shows
+what a sparse file actually uses. The part of the data in the inode buffer takes no blocks. If an
+indirect block cannot be read, the blocks of a file without holes are reported.
+*/
+func (i *Inode) attrBlocks() uint64 {
+	used, err := i.countUsedBlocks()
+	if err != nil {
+		fmt.Println("Failed to count the blocks of an inode: " + err.Error())
+		used = i.numDataBlocks()
+	}
+	return used * (BLOCK_SIZE / 512)
+}
+
+/*
+Returns whether b is all zeros.
+*/
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Leaves the data block with blockNum of the inode, just written to hold only zeros, as a hole:
+frees it if it was stored (blockNum is not 0), and returns 0 for the pointer to it.
+*/
+func (i *Inode) skipZeroBlock(blockNum uint64) uint64 {
+	countStat(&mountStats.ZeroBlocksSkipped, 1)
+	if blockNum == 0 {
+		return 0
+	}
+	debugBlock("freeing zero block=%d", blockNum)
+	err := deleteBlock(blockNum)
+	if err != nil {
+		fmt.Printf("error freeing zero block %d: %v\n", blockNum, err)
+	}
+	i.usedBlocksKnown = false
+	return 0
+}
+
+/*
+Stores the indirect block written by writeIndirect and the like, allocating a number for it if it is
+new (indBlockNum is 0), and returns its number. An indirect block that only points to holes, as the
+blocks of zeros of SKIP_ZERO_BLOCKS are, is not stored, or is freed if it was, and 0 is returned.
+*/
+func (i *Inode) putIndirect(indBlock *DataBlock, indBlockNum uint64, kind string) uint64 {
+	if isZero(indBlock.Data[:]) {
+		if indBlockNum != 0 {
+			err := deleteBlock(indBlockNum)
+			if err != nil {
+				fmt.Printf("error freeing %s block %d: %v\n", kind, indBlockNum, err)
+			}
+			i.usedBlocksKnown = false
+		}
+		return 0
+	}
+	if indBlockNum == 0 {
+		indBlockNum = dataStream.next()
+		i.allocated()
+		debugBlock("allocated "+kind+" block=%d", indBlockNum)
+	}
+	err := putData(indBlockNum, indBlock)
+	if err != nil {
+		fmt.Println("error doing putData for indirect block: " + err.Error())
+	}
+	return indBlockNum
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Writes far past the end of a file and extends it further, and checks that only the blocks written
+to are stored, that the holes read as zeros without reading anything from S3, that stat reports
+the blocks used, and that the file can be hashed, checked, and removed.
+*/
+func TestSparseFile(t *testing.T) {
+	filesys, objects := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "sparse", testData(100, 1), 1<<16)
+	tail := testData(int(BLOCK_SIZE), 2)
+	offset := FIRST_DOUBLY_INDIRECT_BYTE + 10*BLOCK_SIZE + 100
+	file.inode.writeToData(tail, offset)
+
+	var attr fuse.Attr
+	file.Attr(ctx, &attr)
+	// the data crosses into a second block, under one singly indirect block of the doubly indirect one
+	if want := 4 * (BLOCK_SIZE / 512); attr.Blocks != want || attr.Size != offset+BLOCK_SIZE {
+		t.Fatalf("stat reports %d blocks and size %d, want %d blocks", attr.Blocks, attr.Size, want)
+	}
+	if len(inodeBlocks(t, file.inode)) != 4 {
+		t.Fatalf("the file uses blocks %v, want 4", inodeBlocks(t, file.inode))
+	}
+
+	cache.empty()
+	cache = newCache(newMemStore(), 16)
+	stored := len(objects.items)
+	got, err := file.inode.readFromData(FIRST_SINGLY_INDIRECT_BYTE-BLOCK_SIZE, 3*BLOCK_SIZE)
+	if err != nil || !bytes.Equal(got, make([]byte, 3*BLOCK_SIZE)) {
+		t.Fatalf("the hole does not read as zeros, err %v", err)
+	}
+	if len(cache.keyHash) != 0 {
+		t.Fatalf("reading the hole read %d blocks", len(cache.keyHash))
+	}
+	got, _ = file.inode.readFromData(offset-10, BLOCK_SIZE+10)
+	if !bytes.Equal(got[:10], make([]byte, 10)) || !bytes.Equal(got[10:], tail) {
+		t.Fatalf("the data after the hole differs")
+	}
+
+	err = file.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: FIRST_TRIPLY_INDIRECT_BYTE + 5*BLOCK_SIZE}, new(fuse.SetattrResponse))
+	if err != nil {
+		t.Fatalf("Setattr: %v", err)
+	}
+	file.Attr(ctx, &attr)
+	if attr.Blocks != 4*(BLOCK_SIZE/512) || len(objects.items) > stored+1 {
+		t.Fatalf("extending the file wrote blocks: %d blocks, %d objects", attr.Blocks, len(objects.items))
+	}
+	got, _ = file.inode.readFromData(FIRST_TRIPLY_INDIRECT_BYTE, BLOCK_SIZE)
+	if !bytes.Equal(got, make([]byte, BLOCK_SIZE)) {
+		t.Fatalf("the extension does not read as zeros")
+	}
+
+	_, err = file.inode.contentHash()
+	if err != nil {
+		t.Fatalf("contentHash: %v", err)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck: %+v", report.problems)
+	}
+	err = root.Remove(ctx, &fuse.RemoveRequest{Name: "sparse"})
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+}
+
+/*
+Checks that a hole hashes as a block of zeros, so that a sparse file and the same data written out
+in full have the same content hash, and that holes in different places give different hashes.
+*/
+func TestSparseContentHash(t *testing.T) {
+	newTestFs(t, 16)
+	block := testData(int(BLOCK_SIZE), 1)
+	sparse := createInode(0)
+	sparse.init(ROOT_INODE, 2)
+	sparse.writeToData(block, INODE_BUFFER_SIZE+BLOCK_SIZE)
+	full := createInode(0)
+	full.init(ROOT_INODE, 3)
+	full.writeToData(append(make([]byte, INODE_BUFFER_SIZE+BLOCK_SIZE), block...), 0)
+	moved := createInode(0)
+	moved.init(ROOT_INODE, 4)
+	moved.writeToData(block, INODE_BUFFER_SIZE)
+	moved.truncate(INODE_BUFFER_SIZE + 2*BLOCK_SIZE)
+
+	sparseHash, err := sparse.contentHash()
+	if err != nil {
+		t.Fatalf("contentHash: %v", err)
+	}
+	fullHash, _ := full.contentHash()
+	movedHash, _ := moved.contentHash()
+	if !bytes.Equal(sparseHash, fullHash) {
+		t.Fatalf("the sparse file hashes differently from the same data written out")
+	}
+	if bytes.Equal(sparseHash, movedHash) {
+		t.Fatalf("files with holes in different places have the same hash")
+	}
+}
+
+/*
+Writes blocks of zeros with SKIP_ZERO_BLOCKS set, and checks that they are left as holes, that a
+stored block overwritten with zeros is freed, and that the data reads back the same.
+*/
+func TestSkipZeroBlocks(t *testing.T) {
+	filesys, objects := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	SKIP_ZERO_BLOCKS = true
+	defer func() { SKIP_ZERO_BLOCKS = false }()
+	mountStats = LifetimeStats{}
+	data := make([]byte, INODE_BUFFER_SIZE+(NUM_DATA_BLOCKS+4)*BLOCK_SIZE)
+	copy(data[len(data)-100:], testData(100, 1))
+	file := writeTestFile(t, root, "zeros", data, len(data))
+	// the last block, under the singly indirect block
+	if blocks := inodeBlocks(t, file.inode); len(blocks) != 2 {
+		t.Fatalf("the file uses blocks %v, want an indirect block and a data block", blocks)
+	}
+	if mountStats.ZeroBlocksSkipped != NUM_DATA_BLOCKS+3 {
+		t.Fatalf("%d zero blocks counted, want %d", mountStats.ZeroBlocksSkipped, NUM_DATA_BLOCKS+3)
+	}
+	checkFileData(t, root, "zeros", data)
+
+	last := inodeBlocks(t, file.inode)[1]
+	file.inode.writeToData(make([]byte, 100), uint64(len(data)-100))
+	if blocks := inodeBlocks(t, file.inode); len(blocks) != 0 || file.inode.Data[IND_BLOCK] != 0 {
+		t.Fatalf("zeroing the last block left blocks %v", blocks)
+	}
+	key := genDataKey(last)
+	if cache.keyHash[key] != nil || objects.items[key] != nil {
+		t.Fatalf("the block overwritten with zeros is still stored")
+	}
+	got, _ := file.inode.readFromData(0, uint64(len(data)))
+	if !bytes.Equal(got, make([]byte, len(data))) {
+		t.Fatalf("the zeroed file does not read as zeros")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"encoding/binary"
+	"golang.org/x/net/context"
+	"os"
+	"path"
+	"syscall"
+)
+
+// the types of special files. Special files are inodes with INODE_SYMLINK set but no target, which
+// keep their type in the first byte of DataBuf, where links keep their target, and their device
+// number in the 4 bytes after it. They have no data, and the kernel handles reading and writing
+// them, so the file system only keeps them.
+const SPECIAL_FIFO byte = 1
+const SPECIAL_SOCKET byte = 2
+const SPECIAL_CHAR_DEVICE byte = 3
+const SPECIAL_BLOCK_DEVICE byte = 4
+
+/*
+Returns whether the inode is a special file.
+*/
+func (i *Inode) isSpecial() bool {
+	return !i.isDir() && i.IsDir&INODE_SYMLINK != 0 && i.Size == 0
+}
+
+/*
+Returns the SPECIAL_* type of the inode, or 0 if it is not a special file.
+*/
+func (i *Inode) specialType() byte {
+	if !i.isSpecial() {
+		return 0
+	}
+	return i.DataBuf[0]
+}
+
+/*
+Returns the device number of the inode, which is only set for device files.
+*/
+func (i *Inode) rdev() uint32 {
+	if !i.isSpecial() {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(i.DataBuf[1:5])
+}
+
+/*
+Returns an error if the inode is a symbolic link or a special file, which have no data of their own
+to read or write through a handle: ELOOP for a link, as open(2) with O_NOFOLLOW returns, and ENXIO
+for a special file, whose reads and writes the kernel handles. The kernel never opens them through
+the FUSE handlers, but 9P clients and HTTP requests can ask to.
+*/
+func (i *Inode) checkOpenable() error {
+	switch {
+	case i.isSymlink():
+		return fuse.Errno(syscall.ELOOP)
+	case i.isSpecial():
+		return fuse.Errno(syscall.ENXIO)
+	}
+	return nil
+}
+
+/*
+Returns the SPECIAL_* type of a file created with mode, 0 for a regular file, and false if the
+file system cannot keep files of its type.
+*/
+func specialTypeOf(mode os.FileMode) (byte, bool) {
+	switch {
+	case mode&os.ModeType == 0:
+		return 0, true
+	case mode&os.ModeNamedPipe != 0:
+		return SPECIAL_FIFO, true
+	case mode&os.ModeSocket != 0:
+		return SPECIAL_SOCKET, true
+	case mode&os.ModeCharDevice != 0:
+		return SPECIAL_CHAR_DEVICE, true
+	case mode&os.ModeDevice != 0:
+		return SPECIAL_BLOCK_DEVICE, true
+	}
+	return 0, false
+}
+
+/*
+Returns the bits of os.FileMode giving the type of the special file of the inode, or 0 if it is
+not one.
+*/
+func (i *Inode) specialMode() os.FileMode {
+	switch i.specialType() {
+	case SPECIAL_FIFO:
+		return os.ModeNamedPipe
+	case SPECIAL_SOCKET:
+		return os.ModeSocket
+	case SPECIAL_CHAR_DEVICE:
+		return os.ModeDevice | os.ModeCharDevice
+	case SPECIAL_BLOCK_DEVICE:
+		return os.ModeDevice
+	}
+	return 0
+}
+
+/*
+Returns the type of the directory entry of the inode.
+*/
+func (i *Inode) direntType() fuse.DirentType {
+	switch {
+	case i.isDir():
+		return fuse.DT_Dir
+	case i.isSymlink():
+		return fuse.DT_Link
+	}
+	switch i.specialType() {
+	case SPECIAL_FIFO:
+		return fuse.DT_FIFO
+	case SPECIAL_SOCKET:
+		return fuse.DT_Socket
+	case SPECIAL_CHAR_DEVICE:
+		return fuse.DT_Char
+	case SPECIAL_BLOCK_DEVICE:
+		return fuse.DT_Block
+	}
+	return fuse.DT_File
+}
+
+var _ = fs.NodeMknoder(&Dir{})
+
+/*
+FUSE method that makes a named pipe, socket, or device file in the directory, as mkfifo and mknod
+do, or an empty regular file. Permissions are not kept, as for other files.
+*/
+func (d *Dir) Mknod(ctx context.Context, req *fuse.MknodRequest) (fs.Node, error) {
+	defer trackOp("Mknod")()
+	defer recoverPanic("Mknod")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Mknod")()
+	debugOp(path.Join(d.path, req.Name), "Mknod", "parent=%d mode=%v rdev=%d", d.inodeNum, req.Mode, req.Rdev)
+	special, ok := specialTypeOf(req.Mode)
+	if !ok {
+		return nil, fuse.EPERM
+	}
+	err := checkDirWritable(d.inodeNum, true)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStoreWritable()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := lookupEntry(d.inodeNum, d.inode, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if exists != INVALID_INODE {
+		return nil, fuse.EEXIST
+	}
+	err = d.checkRoomFor(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	var inode *Inode
+	if special == 0 {
+		inode = createInode(0)
+	} else {
+		inode = createInode(INODE_SYMLINK)
+		inode.DataBuf[0] = special
+		binary.LittleEndian.PutUint32(inode.DataBuf[1:5], req.Rdev)
+	}
+	inodeNum := nextInodeNum(d.inodeStream)
+	inode.init(d.inodeNum, inodeNum)
+	err = setNewGeneration(inode, inodeNum)
+	if err == nil {
+		err = setNewOwner(inode, inodeNum, req.Header)
+	}
+	if err == nil {
+		err = putInode(inode, inodeNum)
+	}
+	if err == nil {
+		err = d.addFile(req.Name, inodeNum)
+	}
+	if err != nil {
+		return nil, err
+	}
+	file := &File{
+		inode:       inode,
+		inodeNum:    inodeNum,
+		dirNum:      d.inodeNum,
+		inodeStream: d.inodeStream,
+		path:        path.Join(d.path, req.Name),
+	}
+	liveNodes.add(inodeNum, file)
+	audit("mknod", req.Header, file.path, "", inodeNum)
+	countStat(&mountStats.FilesCreated, 1)
+	notifyChange("create", file.path, "", false)
+	return file, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"os"
+	"testing"
+)
+
+/*
+Checks that named pipes, sockets, and device files can be made, are reported with their type and
+device number in their attributes and directory entries, cannot be given a size, and are not taken
+for links, and that mknod of a regular file makes an empty file.
+*/
+func TestMknod(t *testing.T) {
+	filesys, _ := newTestFs(t, 8)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	nodes := []struct {
+		name  string
+		mode  os.FileMode
+		rdev  uint32
+		dtype fuse.DirentType
+	}{
+		{"fifo", os.ModeNamedPipe | 0644, 0, fuse.DT_FIFO},
+		{"socket", os.ModeSocket | 0755, 0, fuse.DT_Socket},
+		{"tty", os.ModeDevice | os.ModeCharDevice | 0600, 4<<8 | 1, fuse.DT_Char},
+		{"disk", os.ModeDevice | 0600, 8<<8 | 0, fuse.DT_Block},
+		{"plain", 0644, 0, fuse.DT_File},
+	}
+	for _, n := range nodes {
+		if _, err := root.Mknod(ctx, &fuse.MknodRequest{Name: n.name, Mode: n.mode, Rdev: n.rdev}); err != nil {
+			t.Fatalf("Mknod %s: %v", n.name, err)
+		}
+	}
+	if _, err := root.Mknod(ctx, &fuse.MknodRequest{Name: "fifo", Mode: os.ModeNamedPipe}); err != fuse.EEXIST {
+		t.Fatalf("Mknod over an existing file returned %v", err)
+	}
+
+	handle, _ := root.Open(ctx, new(fuse.OpenRequest), new(fuse.OpenResponse))
+	types := make(map[string]fuse.DirentType)
+	for _, dirent := range handle.(*DirHandle).readDirAll() {
+		types[dirent.Name] = dirent.Type
+	}
+	handle.(*DirHandle).Release(ctx, new(fuse.ReleaseRequest))
+	for _, n := range nodes {
+		if types[n.name] != n.dtype {
+			t.Fatalf("%s is listed with type %v, want %v", n.name, types[n.name], n.dtype)
+		}
+		node, err := root.lookup(ctx, n.name)
+		if err != nil {
+			t.Fatalf("Lookup %s: %v", n.name, err)
+		}
+		var attr fuse.Attr
+		node.(*File).Attr(ctx, &attr)
+		if attr.Mode&os.ModeType != n.mode&os.ModeType || attr.Rdev != n.rdev || attr.Size != 0 {
+			t.Fatalf("%s has mode %v, rdev %d, and size %d", n.name, attr.Mode, attr.Rdev, attr.Size)
+		}
+	}
+
+	node, _ := root.lookup(ctx, "fifo")
+	fifo := node.(*File)
+	if _, err := fifo.Readlink(ctx, new(fuse.ReadlinkRequest)); err == nil {
+		t.Fatalf("Readlink of a named pipe succeeded")
+	}
+	resize := &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 10}
+	if err := fifo.Setattr(ctx, resize, new(fuse.SetattrResponse)); err != fuse.EPERM {
+		t.Fatalf("giving a named pipe a size returned %v", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "fifo"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck: %+v", report)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the reserved inode number that the mount lease is kept under in the lock table. No file has it, so
+// no file lock is ever taken on it.
+const MOUNT_LEASE_INODE uint64 = ROOT_INODE + 1
+
+// how long the mount lease outlives the last renewal by the mount holding it, which bounds how long
+// a standby takes to notice that the mount is gone, and how often it is renewed
+const MOUNT_LEASE time.Duration = 10 * time.Second
+const MOUNT_LEASE_RENEW_INTERVAL time.Duration = 2 * time.Second
+
+// how long after the start of its last renewal a mount that cannot renew its lease stops writing:
+// two renewals before the lease runs out, so that the writes under way when it does can finish, and
+// a clock running slow does not let it write once a standby has taken over
+const MOUNT_LEASE_FENCE time.Duration = MOUNT_LEASE - 2*MOUNT_LEASE_RENEW_INTERVAL
+
+// the number of files changed last by the primary that a standby pulls into the cache once it takes
+// over, and how long it waits before following the changes again after losing the admin socket
+const STANDBY_WARM_FILES int = 64
+const STANDBY_RECONNECT_INTERVAL time.Duration = time.Second
+
+// whether the mount holds a lease on the file system, so that a standby can take over when it is
+// gone, from the config
+var MOUNT_LEASE_ENABLED bool
+
+// the lease of the mount on the file system, or nil if it holds none. Set by acquireMountLease.
+var mountLease *lockTable
+
+// the files to pull into the cache once the file system is mounted. Set by the standby command.
+var warmPaths []string
+
+/*
+Returns the lock that the mount lease is taken as.
+*/
+func mountLeaseLock() fileLock {
+	return fileLock{Write: true, End: math.MaxUint64}
+}
+
+/*
+Returns a new table to take the mount lease with, as a new holder.
+*/
+func newMountLease() *lockTable {
+	lease := newLockTable(backendLockStore, newUUID())
+	lease.lease = MOUNT_LEASE
+	return lease
+}
+
+/*
+Takes the mount lease of the file system and starts renewing it, if the config asks for one.
+Returns an error if another live process holds it. A standby that waited for the lease already
+holds it, and takes it again.
+*/
+func acquireMountLease() error {
+	if !MOUNT_LEASE_ENABLED {
+		return nil
+	}
+	if backendLockStore == nil {
+		return errors.New("MountLease needs the lock table, so Locks must be \"" + LOCKS_DYNAMODB + "\".")
+	}
+	if mountLease == nil {
+		mountLease = newMountLease()
+	}
+	acquired := time.Now()
+	conflict, err := mountLease.set(MOUNT_LEASE_INODE, mountLeaseLock(), false)
+	if err != nil {
+		return err
+	}
+	if conflict != nil {
+		left := time.Until(time.Unix(0, conflict.Expires)).Round(time.Second)
+		return errors.New("The file system is mounted by another process, whose lease runs out in " + left.String() +
+			" unless it is renewed. Run the standby command to take over when it is gone.")
+	}
+	go renewMountLease(mountLease, acquired)
+	return nil
+}
+
+/*
+Renews the mount lease every MOUNT_LEASE_RENEW_INTERVAL until it is released, given when the renewal
+that took it started. If it cannot be renewed within MOUNT_LEASE_FENCE of the start of the last
+renewal that did, or another process took it over, the mount is made read-only, since a standby may
+be writing to the file system soon. The lease lasts from when the lock table was written, which is
+after the renewal started, so the fence is counted from the start, and a renewal that hangs is
+aborted once the fence is reached.
+*/
+func renewMountLease(lease *lockTable, renewed time.Time) {
+	for {
+		time.Sleep(MOUNT_LEASE_RENEW_INTERVAL)
+		if mountLease != lease {
+			return
+		}
+		started := time.Now()
+		ctx, cancel := context.WithDeadline(context.Background(), renewed.Add(MOUNT_LEASE_FENCE))
+		restore := useAWSContext(ctx)
+		conflict, err := lease.set(MOUNT_LEASE_INODE, mountLeaseLock(), false)
+		restore()
+		cancel()
+		switch {
+		case conflict != nil:
+			health.makeReadOnly("another process took over the mount lease")
+			return
+		case err != nil:
+			fmt.Println("Error renewing the mount lease: " + err.Error())
+			if time.Since(renewed) >= MOUNT_LEASE_FENCE {
+				health.makeReadOnly("the mount lease was about to run out before it could be renewed: " + err.Error())
+				return
+			}
+		default:
+			renewed = started
+		}
+	}
+}
+
+/*
+Releases the mount lease, when the file system is unmounted, so that a standby takes over at once.
+*/
+func releaseMountLease() error {
+	lease := mountLease
+	if lease == nil {
+		return nil
+	}
+	mountLease = nil
+	return lease.releaseAll()
+}
+
+/*
+Waits until the mount lease of the file system can be taken, because the process holding it
+released it or stopped renewing it, then takes it.
+*/
+func waitForMountLease(ctx context.Context) error {
+	if mountLease == nil {
+		mountLease = newMountLease()
+	}
+	return mountLease.wait(ctx, MOUNT_LEASE_INODE, mountLeaseLock())
+}
+
+/*
+Struct keeping the paths of the files changed last, most recent last.
+*/
+type recentFiles struct {
+	lock  sync.Mutex
+	size  int
+	paths []string
+}
+
+/*
+Returns a pointer to a new recentFiles keeping up to size paths.
+*/
+func newRecentFiles(size int) *recentFiles {
+	return &recentFiles{size: size}
+}
+
+/*
+Records a change made to the file system, forgetting files that were deleted or renamed away.
+*/
+func (r *recentFiles) note(event *WatchEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if event.Op == "overflow" || event.Dir {
+		return
+	}
+	r.remove(event.Path)
+	switch event.Op {
+	case "create", "modify":
+		r.paths = append(r.paths, event.Path)
+	case "rename":
+		r.remove(event.NewPath)
+		r.paths = append(r.paths, event.NewPath)
+	}
+	if len(r.paths) > r.size {
+		r.paths = r.paths[len(r.paths)-r.size:]
+	}
+}
+
+/*
+Removes p from the paths. The caller must hold the lock.
+*/
+func (r *recentFiles) remove(p string) {
+	for i, recent := range r.paths {
+		if recent == p {
+			r.paths = append(r.paths[:i], r.paths[i+1:]...)
+			return
+		}
+	}
+}
+
+/*
+Returns the paths, most recently changed first.
+*/
+func (r *recentFiles) list() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	paths := make([]string, len(r.paths))
+	for i, p := range r.paths {
+		paths[len(paths)-1-i] = p
+	}
+	return paths
+}
+
+/*
+Follows the changes made by the mount serving the admin socket of the config at configPath,
+recording them in recent, until stop is closed. The connection is made again whenever it is lost,
+since the primary may be restarted while the standby waits.
+*/
+func followChanges(configPath string, recent *recentFiles, stop chan struct{}) {
+	for {
+		conn, dec, err := adminClientRequest(configPath, &adminRequest{Command: "watch", Path: "/"})
+		if err == nil {
+			go func() {
+				<-stop
+				conn.Close()
+			}()
+			// skip the reply saying the watch started
+			dec.Decode(new(adminResponse))
+			for {
+				event := new(WatchEvent)
+				if dec.Decode(event) != nil {
+					break
+				}
+				recent.note(event)
+			}
+			conn.Close()
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(STANDBY_RECONNECT_INTERVAL):
+		}
+	}
+}
+
+/*
+Pulls the blocks of the files at paths into the cache, in order, stopping before they would fill
+more than half of it. Files that are gone or that would not fit are skipped.
+*/
+func warmCache(filesys *FS, paths []string) {
+	pulled := 0
+	for _, p := range paths {
+		keys, err := prefetchKeys(filesys, p)
+		if err != nil {
+			continue
+		}
+		if pulled+len(keys) > cache.cacheCapacity/2 {
+			break
+		}
+		prefetchBlocks(keys)
+		pulled += len(keys)
+	}
+	if pulled > 0 {
+		fmt.Println("Pulled " + strconv.Itoa(pulled) + " blocks of the files changed last into the cache.")
+	}
+}
+
+/*
+Runs a process that stands by to mount the file system described by the config when the process
+holding its mount lease is gone. It connects to AWS, and checks that it can read the file system,
+ahead of time, and follows the changes the primary makes through its admin socket, if the config
+has one, while it is connected to it; there is no journal of the changes made before. The cache
+table is only written by the primary while it lives, so once the standby takes over, it pulls the
+files changed last into the cache while it serves.
+*/
+func standbyCommand(args []string) int {
+	if len(args) != 2 {
+		commandUsage("standby")
+		return 2
+	}
+	cacheSize, err := strconv.Atoi(args[1])
+	if err != nil || cacheSize <= 0 {
+		fmt.Println("Invalid argument supplied for the cache size.")
+		return 2
+	}
+	config := loadConfig(args[0])
+	if !MOUNT_LEASE_ENABLED {
+		fmt.Println("The config does not set MountLease, so the primary holds no lease to take over.")
+		return 1
+	}
+	initializeBackend(config, cacheSize)
+	auditLog, err = initializeAuditLog(config)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	super, err := getStoredDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err == nil {
+		// the superblock is read from S3 directly, since blocks read through the cache are written
+		// to the table the primary uses
+		var contents *superblockContents
+		contents, err = readSuperblock(super, getStoredDataByKey)
+		if err == nil {
+			err = checkFormatSupported(contents.info)
+		}
+		if err != nil {
+			fmt.Println(err.Error())
+			return 1
+		}
+	}
+
+	recent := newRecentFiles(STANDBY_WARM_FILES)
+	stop := make(chan struct{})
+	if config.AdminSocket != "" {
+		go followChanges(args[0], recent, stop)
+	}
+	fmt.Println("Standing by to mount the file system at " + mountpoint + ".")
+	err = waitForMountLease(context.Background())
+	close(stop)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	fmt.Println("Took over the mount lease, mounting the file system.")
+	// the mountpoint the primary left behind if it died, which cannot be mounted over
+	binding.unmount(mountpoint)
+	warmPaths = recent.list()
+	err = mount(mountpoint)
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	return 0
+}
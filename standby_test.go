@@ -0,0 +1,75 @@
+package main
+
+import (
+	"golang.org/x/net/context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+Checks that a mount holding the mount lease keeps others from mounting, and that a standby waiting
+for the lease takes it as soon as the mount releases it.
+*/
+func TestMountLease(t *testing.T) {
+	defer func() {
+		MOUNT_LEASE_ENABLED = false
+		backendLockStore = nil
+		mountLease = nil
+	}()
+	MOUNT_LEASE_ENABLED = true
+	backendLockStore = newMemLockStore()
+	if err := acquireMountLease(); err != nil {
+		t.Fatalf("acquireMountLease: %v", err)
+	}
+	primary := mountLease
+
+	// another process, which holds no lease yet
+	mountLease = nil
+	if err := acquireMountLease(); err == nil {
+		t.Fatalf("a second process took the mount lease held by the first")
+	}
+	mountLease = nil
+	taken := make(chan error)
+	go func() { taken <- waitForMountLease(context.Background()) }()
+	select {
+	case err := <-taken:
+		t.Fatalf("the standby took the lease while the primary held it: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := primary.releaseAll(); err != nil {
+		t.Fatalf("releaseAll: %v", err)
+	}
+	if err := <-taken; err != nil {
+		t.Fatalf("waitForMountLease: %v", err)
+	}
+	if err := acquireMountLease(); err != nil {
+		t.Fatalf("the standby could not mount with the lease it took: %v", err)
+	}
+}
+
+/*
+Checks that the files changed last are listed most recent first, without deleted files, directories,
+or the old names of renamed files, and that only the most recent are kept.
+*/
+func TestRecentFiles(t *testing.T) {
+	recent := newRecentFiles(3)
+	for _, event := range []WatchEvent{
+		{Op: "create", Path: "/a"},
+		{Op: "create", Path: "/dir", Dir: true},
+		{Op: "modify", Path: "/b"},
+		{Op: "modify", Path: "/a"},
+		{Op: "rename", Path: "/b", NewPath: "/c"},
+		{Op: "create", Path: "/d"},
+		{Op: "delete", Path: "/a"},
+		{Op: "overflow"},
+		{Op: "create", Path: "/e"},
+		{Op: "modify", Path: "/f"},
+	} {
+		event := event
+		recent.note(&event)
+	}
+	if paths := recent.list(); !reflect.DeepEqual(paths, []string{"/f", "/e", "/d"}) {
+		t.Fatalf("recent files %v", paths)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+/*
+Struct holding counters of what has been done to a file system over its lifetime. It is kept in the
+superblock, and the counters of each mount are added to it when the superblock is written.
+*/
+type LifetimeStats struct {
+	Mounts       uint64 // how many mounts have written the superblock
+	Requests     uint64 // the requests served, from FUSE, 9P, and HTTP alike
+	BytesWritten uint64
+	BytesRead    uint64
+	FilesCreated uint64
+	DirsCreated  uint64
+
+	// the data blocks deleted, and those of them that S3 Object Lock kept, which take up space in
+	// the bucket until their retention ends
+	BlocksDeleted  uint64
+	BlocksRetained uint64
+
+	// the blocks of zeros left as holes rather than stored, see SKIP_ZERO_BLOCKS
+	ZeroBlocksSkipped uint64
+
+	// the writes refused with EDQUOT, see QUOTA_BLOCKS
+	QuotaDenials uint64
+
+	// the operations refused with ESTALE on nodes of a file whose inode number was reused, see
+	// checkGeneration
+	StaleHandles uint64
+
+	// the entries refused with EMLINK or ENOSPC in directories at their limits, see checkRoom
+	DirLimitDenials uint64
+}
+
+// the counters of the current mount, updated with sync/atomic since requests are counted before
+// they take fsLock
+var mountStats LifetimeStats
+
+/*
+Adds n to the counter of the current mount.
+*/
+func countStat(counter *uint64, n uint64) {
+	atomic.AddUint64(counter, n)
+}
+
+/*
+Adds the counters of the current mount to s, counting one more mount, and starts the counters of the
+current mount again from zero so that they are not added twice.
+*/
+func (s *LifetimeStats) addMount() {
+	s.Mounts++
+	s.Requests += atomic.SwapUint64(&mountStats.Requests, 0)
+	s.BytesWritten += atomic.SwapUint64(&mountStats.BytesWritten, 0)
+	s.BytesRead += atomic.SwapUint64(&mountStats.BytesRead, 0)
+	s.FilesCreated += atomic.SwapUint64(&mountStats.FilesCreated, 0)
+	s.DirsCreated += atomic.SwapUint64(&mountStats.DirsCreated, 0)
+	s.BlocksDeleted += atomic.SwapUint64(&mountStats.BlocksDeleted, 0)
+	s.BlocksRetained += atomic.SwapUint64(&mountStats.BlocksRetained, 0)
+	s.ZeroBlocksSkipped += atomic.SwapUint64(&mountStats.ZeroBlocksSkipped, 0)
+	s.QuotaDenials += atomic.SwapUint64(&mountStats.QuotaDenials, 0)
+	s.StaleHandles += atomic.SwapUint64(&mountStats.StaleHandles, 0)
+	s.DirLimitDenials += atomic.SwapUint64(&mountStats.DirLimitDenials, 0)
+}
+
+/*
+Returns a copy of the counters of the current mount.
+*/
+func currentStats() *LifetimeStats {
+	return &LifetimeStats{
+		Requests:          atomic.LoadUint64(&mountStats.Requests),
+		BytesWritten:      atomic.LoadUint64(&mountStats.BytesWritten),
+		BytesRead:         atomic.LoadUint64(&mountStats.BytesRead),
+		FilesCreated:      atomic.LoadUint64(&mountStats.FilesCreated),
+		DirsCreated:       atomic.LoadUint64(&mountStats.DirsCreated),
+		BlocksDeleted:     atomic.LoadUint64(&mountStats.BlocksDeleted),
+		BlocksRetained:    atomic.LoadUint64(&mountStats.BlocksRetained),
+		ZeroBlocksSkipped: atomic.LoadUint64(&mountStats.ZeroBlocksSkipped),
+		QuotaDenials:      atomic.LoadUint64(&mountStats.QuotaDenials),
+		StaleHandles:      atomic.LoadUint64(&mountStats.StaleHandles),
+		DirLimitDenials:   atomic.LoadUint64(&mountStats.DirLimitDenials),
+	}
+}
+
+/*
+Prints the lifetime counters of the file system described by info, and the usage of the
+Intelligent-Tiering access tiers of its bucket if blocks are put in Intelligent-Tiering or were when
+it was last measured.
+*/
+func printStats(info *SuperblockInfo) {
+	stats := info.Stats
+	fmt.Printf("mounts:          %d\n", stats.Mounts)
+	fmt.Printf("requests:        %d\n", stats.Requests)
+	fmt.Printf("bytes written:   %d\n", stats.BytesWritten)
+	fmt.Printf("bytes read:      %d\n", stats.BytesRead)
+	fmt.Printf("files created:   %d\n", stats.FilesCreated)
+	fmt.Printf("dirs created:    %d\n", stats.DirsCreated)
+	fmt.Printf("blocks deleted:  %d\n", stats.BlocksDeleted)
+	fmt.Printf("blocks retained: %d (%d bytes reclaimable when their retention ends)\n", stats.BlocksRetained, stats.BlocksRetained*info.BlockSize)
+	fmt.Printf("zero blocks:     %d (%d bytes left as holes rather than stored)\n", stats.ZeroBlocksSkipped, stats.ZeroBlocksSkipped*info.BlockSize)
+	fmt.Printf("quota denials:   %d\n", stats.QuotaDenials)
+	fmt.Printf("stale handles:   %d\n", stats.StaleHandles)
+	fmt.Printf("dir limit hits:  %d\n", stats.DirLimitDenials)
+	if tieringSource != nil || info.Tiering.Time != 0 {
+		printTiering(&info.Tiering)
+	}
+}
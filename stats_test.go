@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"strconv"
+	"testing"
+)
+
+/*
+Checks that the counters of a mount are added to the superblock when it is written, and that those
+of later mounts are added to them rather than replacing them.
+*/
+func TestLifetimeStats(t *testing.T) {
+	mountStats = LifetimeStats{}
+	filesys, _ := newTestFs(t, 8)
+	for mount := 1; mount <= 2; mount++ {
+		root := testRoot(t, filesys)
+		ctx := context.Background()
+		if _, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir" + strconv.Itoa(mount)}); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		file := writeTestFile(t, root, "file"+strconv.Itoa(mount), testData(1000, 1), 400)
+		handle, _ := file.Open(ctx, new(fuse.OpenRequest), new(fuse.OpenResponse))
+		handle.(*FileHandle).Read(ctx, &fuse.ReadRequest{Size: 300}, new(fuse.ReadResponse))
+		filesys.Destroy()
+
+		cache = newCache(newMemStore(), 8)
+		super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+		if err != nil {
+			t.Fatalf("getDataByKey for superblock: %v", err)
+		}
+		filesys, err = makeFs(super)
+		if err != nil {
+			t.Fatalf("makeFs: %v", err)
+		}
+		stats := filesys.info.Stats
+		want := uint64(mount)
+		if stats.Mounts != want || stats.DirsCreated != want || stats.FilesCreated != want ||
+			stats.BytesWritten != 1000*want || stats.BytesRead != 300*want || stats.Requests < 6*want {
+			t.Fatalf("after %d mounts the superblock has %+v", mount, stats)
+		}
+	}
+}
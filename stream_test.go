@@ -0,0 +1,81 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+	"testing/quick"
+)
+
+/*
+Checks the IntStream compression/decompression functions and that its stack is working correctly.
+*/
+func TestIntStream(t *testing.T) {
+	testStream := &IntStream{
+		stack:   new(list.List),
+		lastInt: 1,
+	}
+	if nextNum := testStream.next(); nextNum != 2 {
+		t.Fatalf("next() = %d, want 2", nextNum)
+	}
+	compressedNum := testStream.compressStream()
+	testStream.lastInt = 100
+	testStream.decompressStream(compressedNum)
+	if testStream.lastInt != 2 {
+		t.Fatalf("lastInt after decompressStream = %d, want 2", testStream.lastInt)
+	}
+	testStream.put(29)
+	data, err := testStream.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	testStream.stack = new(list.List)
+	err = testStream.UnmarshalBinary(data)
+	if err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	nextNum := testStream.next()
+	nextNextNum := testStream.next()
+	if nextNum != 29 || nextNextNum != 3 {
+		t.Fatalf("next() after UnmarshalBinary = %d, %d, want 29, 3", nextNum, nextNextNum)
+	}
+}
+
+/*
+Checks that the last int and the stack of arbitrary streams survive compression and marshaling,
+so the stream hands out the same ints afterwards.
+*/
+func TestIntStreamRoundTrip(t *testing.T) {
+	roundTrip := func(lastInt uint64, freed []uint64) bool {
+		stream := &IntStream{
+			stack:   new(list.List),
+			lastInt: lastInt,
+		}
+		for _, n := range freed {
+			stream.put(n)
+		}
+		compressed := stream.compressStream()
+		data, err := stream.MarshalBinary()
+		if err != nil {
+			return false
+		}
+		newStream := new(IntStream)
+		newStream.decompressStream(compressed)
+		err = newStream.UnmarshalBinary(data)
+		if err != nil {
+			return false
+		}
+		if newStream.lastInt != lastInt || newStream.stack.Len() != len(freed) {
+			return false
+		}
+		// put is LIFO, so the freed ints come back in reverse order
+		for i := len(freed) - 1; i >= 0; i-- {
+			if newStream.next() != freed[i] {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const STRESS_FLAG = "stress"
+const STRESS_WORKERS int = 16
+const STRESS_OPS_PER_WORKER int = 200
+const STRESS_NUM_NAMES int = 24 // names shared by all workers, so that operations contend
+const STRESS_MAX_FILE_SIZE int = 3 * int(BLOCK_SIZE)
+
+/*
+Struct that counts the outcomes of the operations done by the stress test.
+*/
+type stressCounts struct {
+	ops      int64
+	expected int64 // failures that are expected from racing with other workers, like ENOENT
+	failures int64
+}
+
+/*
+Runs many goroutines doing a random mix of create/write/read/rename/delete operations on a shared
+set of names in the mounted file system. Meant to be run with a binary built with -race, to check
+that the FUSE handlers are safe to run concurrently. Operations that fail because another worker
+removed or renamed a file are expected; anything else, or a file whose contents are not one whole
+write, is reported as a failure.
+*/
+func runStressTest() {
+	// sleep here so the file system has time be initialized
+	time.Sleep(5 * time.Second)
+	dir := mountpoint + "/stressTest"
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		fmt.Println("error from MkdirAll in runStressTest: " + err.Error())
+		return
+	}
+	fmt.Printf("Running stress test with %d workers doing %d operations each.\n", STRESS_WORKERS, STRESS_OPS_PER_WORKER)
+	counts := new(stressCounts)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < STRESS_WORKERS; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			stressWorker(dir, rand.New(rand.NewSource(seed)), counts)
+		}(int64(w))
+	}
+	wg.Wait()
+	fmt.Printf("Stress test did %d operations in %v: %d expected failures, %d unexpected failures.\n",
+		counts.ops, time.Since(start), counts.expected, counts.failures)
+	err = os.RemoveAll(dir)
+	if err != nil {
+		fmt.Println("error from RemoveAll in runStressTest: " + err.Error())
+	}
+}
+
+/*
+Does STRESS_OPS_PER_WORKER random operations in dir.
+*/
+func stressWorker(dir string, r *rand.Rand, counts *stressCounts) {
+	name := func() string {
+		return dir + "/file" + strconv.Itoa(r.Intn(STRESS_NUM_NAMES))
+	}
+	for i := 0; i < STRESS_OPS_PER_WORKER; i++ {
+		var err error
+		switch r.Intn(5) {
+		case 0, 1:
+			err = ioutil.WriteFile(name(), stressContents(r.Int63(), r.Intn(STRESS_MAX_FILE_SIZE)), 0644)
+		case 2:
+			var data []byte
+			data, err = ioutil.ReadFile(name())
+			if err == nil && !validStressContents(data) {
+				fmt.Printf("stress test read a file with torn or corrupt contents (%d bytes)\n", len(data))
+				atomic.AddInt64(&counts.failures, 1)
+			}
+		case 3:
+			err = os.Rename(name(), name())
+		case 4:
+			err = os.Remove(name())
+		}
+		atomic.AddInt64(&counts.ops, 1)
+		if err != nil {
+			if os.IsNotExist(err) || os.IsExist(err) {
+				atomic.AddInt64(&counts.expected, 1)
+			} else {
+				fmt.Println("stress test operation failed: " + err.Error())
+				atomic.AddInt64(&counts.failures, 1)
+			}
+		}
+	}
+}
+
+/*
+Returns file contents that can be validated by validStressContents: a 20 byte decimal seed
+followed by size pseudo-random bytes generated from it.
+*/
+func stressContents(seed int64, size int) []byte {
+	header := fmt.Sprintf("%020d", seed)
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return append([]byte(header), data...)
+}
+
+/*
+Returns whether data is contents from a single call to stressContents. Empty files are valid,
+because a reader can see a file between its creation and its first write.
+*/
+func validStressContents(data []byte) bool {
+	if len(data) == 0 {
+		return true
+	}
+	if len(data) < 20 {
+		return false
+	}
+	seed, err := strconv.ParseInt(string(data[:20]), 10, 64)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(data, stressContents(seed, len(data)-20))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+/*
+Runs a random mix of create/write/read/rename/remove requests concurrently against the FUSE handlers,
+the way the kernel issues them. Run with -race to check that the handlers are safe to call concurrently.
+The workers share file names, so that files are removed and renamed while other workers hold them
+open, and the nodes of the other workers go stale.
+*/
+func TestConcurrentHandlers(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	workers := 8
+	opsPerWorker := 50
+	if testing.Short() {
+		opsPerWorker = 10
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			name := func() string {
+				return "file" + strconv.Itoa(r.Intn(8))
+			}
+			for i := 0; i < opsPerWorker; i++ {
+				var err error
+				switch r.Intn(4) {
+				case 0:
+					var handle interface{}
+					_, handle, err = root.Create(ctx, &fuse.CreateRequest{Name: name()}, &fuse.CreateResponse{})
+					if err == nil {
+						fh := handle.(*FileHandle)
+						data := testData(r.Intn(2*int(BLOCK_SIZE)), r.Int63())
+						err = fh.Write(ctx, &fuse.WriteRequest{Data: data}, &fuse.WriteResponse{})
+						fh.Release(ctx, &fuse.ReleaseRequest{})
+					}
+				case 1:
+					node, lookupErr := root.lookup(ctx, name())
+					if file, ok := node.(*File); ok && lookupErr == nil {
+						// another worker may have removed the file since, and given its number to another
+						var handle interface{}
+						handle, err = file.Open(ctx, &fuse.OpenRequest{}, &fuse.OpenResponse{})
+						if err == nil {
+							fh := handle.(*FileHandle)
+							fh.Read(ctx, &fuse.ReadRequest{Size: 4096}, &fuse.ReadResponse{})
+							fh.Release(ctx, &fuse.ReleaseRequest{})
+						} else if err == fuse.ESTALE {
+							err = nil
+						}
+					}
+				case 2:
+					err = root.Rename(ctx, &fuse.RenameRequest{OldName: name(), NewName: name()}, root)
+				case 3:
+					err = root.Remove(ctx, &fuse.RemoveRequest{Name: name()})
+				}
+				if err != nil && err != fuse.ENOENT {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+}
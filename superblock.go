@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode"
+)
+
+// marks a superblock payload that starts with a SuperblockInfo header. Superblocks written
+// before format versioning existed have no header, and are treated as format version 1.
+const SUPERBLOCK_MAGIC string = "CFSB"
+const LEGACY_FORMAT_VERSION uint32 = 1
+const FORMAT_VERSION uint32 = 15 // the format version written by this binary
+
+// version 2 added the SuperblockInfo header, version 3 added encryption, version 4 added
+// per-block and per-inode keys to encrypted file systems, version 5 added append-only and
+// immutable directories (which older versions would mistake for files), version 6 added cache hints
+// on files (which version 5 would mistake for directory flags), version 7 added keeping inodes
+// and directory entries as DynamoDB items (where older versions would find no root directory), and
+// version 8 added symbolic links (which older versions would take for files holding their target),
+// version 9 added the owners of inodes (which older versions would not set for the files they
+// create, leaving them the owner of the file that last had the inode number), version 10 added
+// the access and change times of inodes (which older versions would not set either), version
+// 11 added key schemes (under which older versions would look for blocks with the wrong keys),
+// version 12 added special files (which older versions would take for links with no target),
+// version 13 added inline directory tables (which older versions cannot decode), version 14 added
+// the types of entries to directory tables (which version 13 cannot decode), and version 15 added
+// the generations of inodes (which older versions would not set, leaving the files they create
+// without a generation block to read it from)
+var SUPPORTED_FORMAT_VERSIONS = []uint32{LEGACY_FORMAT_VERSION, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, FORMAT_VERSION}
+
+// the label and description given to file systems when they are created, from the config
+var FS_LABEL string
+var FS_DESCRIPTION string
+
+const MAX_LABEL_LENGTH = 64
+const MAX_DESCRIPTION_LENGTH = 1024
+
+/*
+Struct holding the descriptive information about a file system that is stored in its superblock.
+It is gob encoded, so fields can be added without breaking superblocks written by older versions.
+*/
+type SuperblockInfo struct {
+	FormatVersion  uint32
+	UUID           string
+	BlockSize      uint64
+	InodeSize      uint64
+	CreatedTime    int64
+	KMSKeyARN      string // the KMS key that wrapped WrappedKey, for display only
+	WrappedKey     []byte // the wrapped data encryption key, or nil if blocks are not encrypted
+	FileKeys       bool   // whether data blocks and inodes also have their own keys, for crypto-erase
+	Label          string // a short human-readable name, shown by info and in the mount name
+	Description    string // a longer human-readable description, shown by info
+	FirstUserInode uint64 // FIRST_USER_INODE, or 0 if the reserved inode numbers may be in use by files
+	MetadataItems  bool   // whether inodes and directory entries are items in a MetadataStore, not in blocks
+	InodeOwners    bool   // whether the owner of each inode is kept in owner blocks
+	InodeTimes     bool   // whether the access and change times of each inode are kept in times blocks
+	KeyScheme      string // how the keys of numbered blocks are made, see KeyScheme, or "" for KEY_SCHEME_MD5
+	Stats          LifetimeStats
+
+	// whether the generation of each inode is kept in generation blocks, see generation.go
+	InodeGenerations bool
+
+	// whether the parent of each inode is kept in parent blocks, see pathindex.go
+	PathIndex bool
+
+	// when the blocks in use went over the soft quota, in Unix seconds, or 0 if they are under it,
+	// so that the grace period is not started again by remounting, see SOFT_QUOTA_BLOCKS
+	SoftQuotaExceeded int64
+
+	// the last measured usage of the Intelligent-Tiering access tiers of the bucket, see tiering.go
+	Tiering TieringUsage
+
+	// the inodes of files whose last entry was removed while they were open, and which were still
+	// open when the superblock was written, so that they are deleted on the next mount, see
+	// deleteOrphans
+	Orphans []uint64
+
+	// the ID of the mount, or of the command, that wrote the superblock, so that a mount finding the
+	// blocks a crashed mount left in the cache table can tell whether they are still current, see
+	// recoverCacheTable
+	Writer string
+}
+
+/*
+Struct holding everything decoded from the superblock(s) of a file system.
+*/
+type superblockContents struct {
+	lastInode     [8]byte
+	lastData      [8]byte
+	rootInode     uint64
+	info          *SuperblockInfo
+	inodeListData []byte
+	overflowBytes uint64 // the bytes of inodeListData still in overflow superblocks, see readOverflow
+}
+
+/*
+Returns a pointer to a new SuperblockInfo for a file system being created now, with a random UUID.
+*/
+func newSuperblockInfo() *SuperblockInfo {
+	return &SuperblockInfo{
+		FormatVersion:  FORMAT_VERSION,
+		UUID:           newUUID(),
+		BlockSize:      BLOCK_SIZE,
+		InodeSize:      INODE_SIZE,
+		CreatedTime:    time.Now().Unix(),
+		Label:          FS_LABEL,
+		Description:    FS_DESCRIPTION,
+		FirstUserInode: FIRST_USER_INODE,
+		MetadataItems:  METADATA_ITEMS,
+		InodeOwners:    true,
+		InodeTimes:     true,
+		KeyScheme:      KEY_SCHEME,
+
+		InodeGenerations: true,
+		PathIndex:        PATH_INDEX,
+	}
+}
+
+/*
+Returns an error if label or description cannot be given to a file system. The label becomes part
+of the mount options, which are separated by commas, so it cannot contain them.
+*/
+func checkLabel(label, description string) error {
+	if len(label) > MAX_LABEL_LENGTH {
+		return fmt.Errorf("Label is longer than %d bytes.", MAX_LABEL_LENGTH)
+	}
+	if len(description) > MAX_DESCRIPTION_LENGTH {
+		return fmt.Errorf("Description is longer than %d bytes.", MAX_DESCRIPTION_LENGTH)
+	}
+	for _, r := range label {
+		if r == ',' || unicode.IsControl(r) {
+			return fmt.Errorf("Label %q contains a comma or control character.", label)
+		}
+	}
+	return nil
+}
+
+/*
+Returns a random (version 4) UUID in its standard string format.
+*/
+func newUUID() string {
+	var u [16]byte
+	_, err := rand.Read(u[:])
+	if err != nil {
+		fmt.Println("error generating UUID: " + err.Error())
+	}
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	s := hex.EncodeToString(u[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+/*
+Returns an error if the file system described by info cannot be used by this binary.
+*/
+func checkFormatSupported(info *SuperblockInfo) error {
+	for _, version := range SUPPORTED_FORMAT_VERSIONS {
+		if info.FormatVersion == version {
+			if info.BlockSize != BLOCK_SIZE || info.InodeSize != INODE_SIZE {
+				return fmt.Errorf("file system uses block size %d and inode size %d, but this binary uses %d and %d",
+					info.BlockSize, info.InodeSize, BLOCK_SIZE, INODE_SIZE)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("file system format version %d is not supported by this binary", info.FormatVersion)
+}
+
+/*
+Returns the variable length part of the superblock, consisting of the magic string, the gob encoded
+info, and the marshaled free inode list. The info is preceded by its length.
+*/
+func encodeSuperPayload(info *SuperblockInfo, inodeListData []byte) ([]byte, error) {
+	var infoBuf bytes.Buffer
+	enc := gob.NewEncoder(&infoBuf)
+	err := enc.Encode(info)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, 0, len(SUPERBLOCK_MAGIC)+8+infoBuf.Len()+len(inodeListData))
+	payload = append(payload, SUPERBLOCK_MAGIC...)
+	lenBuf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(lenBuf, uint64(infoBuf.Len()))
+	payload = append(payload, lenBuf...)
+	payload = append(payload, infoBuf.Bytes()...)
+	payload = append(payload, inodeListData...)
+	return payload, nil
+}
+
+/*
+Splits a superblock payload into its info and the marshaled free inode list. Payloads without
+the magic string are from before format versioning, and consist only of the inode list.
+*/
+func decodeSuperPayload(payload []byte) (*SuperblockInfo, []byte, error) {
+	headerLen := len(SUPERBLOCK_MAGIC) + 8
+	if len(payload) < headerLen || string(payload[:len(SUPERBLOCK_MAGIC)]) != SUPERBLOCK_MAGIC {
+		info := &SuperblockInfo{
+			FormatVersion: LEGACY_FORMAT_VERSION,
+			BlockSize:     BLOCK_SIZE,
+			InodeSize:     INODE_SIZE,
+		}
+		return info, payload, nil
+	}
+	infoLen := binary.LittleEndian.Uint64(payload[len(SUPERBLOCK_MAGIC):headerLen])
+	if infoLen > uint64(len(payload)-headerLen) {
+		return nil, nil, errors.New("Superblock info is larger than the superblock payload.")
+	}
+	infoEnd := uint64(headerLen) + infoLen
+	info := new(SuperblockInfo)
+	dec := gob.NewDecoder(bytes.NewReader(payload[headerLen:infoEnd]))
+	err := dec.Decode(info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, payload[infoEnd:], nil
+}
+
+/*
+Decodes the superblock stored in super, using fetch to retrieve any overflow superblocks.
+*/
+func readSuperblock(super *DataBlock, fetch func(key string) (*DataBlock, error)) (*superblockContents, error) {
+	contents, err := readSuperblockHead(super, fetch)
+	if err == nil && contents.overflowBytes > 0 {
+		err = contents.readOverflow(fetch)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+/*
+Decodes the superblock stored in super, leaving the part of the free inode list in overflow
+superblocks to be read by readOverflow, with its size in contents.overflowBytes. The info comes
+before the list, so it is only read from the overflow superblocks, using fetch, if it is too large
+for the first.
+*/
+func readSuperblockHead(super *DataBlock, fetch func(key string) (*DataBlock, error)) (*superblockContents, error) {
+	contents := new(superblockContents)
+	copy(contents.lastInode[:], super.Data[0:8])
+	copy(contents.lastData[:], super.Data[8:16])
+	contents.rootInode = binary.LittleEndian.Uint64(super.Data[16:24])
+	payloadSize := binary.LittleEndian.Uint64(super.Data[24:32])
+
+	payload := super.Data[32:]
+	if payloadSize <= uint64(len(payload)) {
+		payload = payload[:payloadSize]
+	} else {
+		contents.overflowBytes = payloadSize - uint64(len(payload))
+		if !infoFits(payload) {
+			// the info runs into the overflow superblocks, so they are read now
+			contents.inodeListData = append([]byte(nil), payload...)
+			err := contents.readOverflow(fetch)
+			if err != nil {
+				return nil, err
+			}
+			payload = contents.inodeListData
+		}
+	}
+	info, inodeListData, err := decodeSuperPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	contents.info = info
+	contents.inodeListData = append([]byte(nil), inodeListData...)
+	return contents, nil
+}
+
+/*
+Returns whether the info of a superblock payload, of which part is the start, ends within part.
+Payloads from before format versioning have no info.
+*/
+func infoFits(part []byte) bool {
+	headerLen := len(SUPERBLOCK_MAGIC) + 8
+	if len(part) < headerLen {
+		return false
+	}
+	if string(part[:len(SUPERBLOCK_MAGIC)]) != SUPERBLOCK_MAGIC {
+		return true
+	}
+	infoLen := binary.LittleEndian.Uint64(part[len(SUPERBLOCK_MAGIC):headerLen])
+	return infoLen <= uint64(len(part)-headerLen)
+}
+
+/*
+Appends the contents.overflowBytes bytes of the payload held by the overflow superblocks, retrieved
+with fetch, to contents.inodeListData.
+*/
+func (contents *superblockContents) readOverflow(fetch func(key string) (*DataBlock, error)) error {
+	var i uint64
+	for i = 1; contents.overflowBytes > 0; i++ {
+		key := S3_SUPERBLOCK_NAME + strconv.FormatUint(i, 10)
+		block, err := fetch(key)
+		if err != nil {
+			return fmt.Errorf("error getting superblock number %d: %v", i, err)
+		}
+		n := contents.overflowBytes
+		if n > BLOCK_SIZE {
+			n = BLOCK_SIZE
+		}
+		contents.inodeListData = append(contents.inodeListData, block.Data[:n]...)
+		contents.overflowBytes -= n
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+/*
+Writes superblocks into a map and returns a fetch function that reads them back, as used by readSuperblock.
+*/
+func superblockFetcher(superBlocks []*DataBlock) func(key string) (*DataBlock, error) {
+	blocks := make(map[string]*DataBlock)
+	for index, block := range superBlocks {
+		blocks[S3_SUPERBLOCK_NAME+strconv.Itoa(index)] = block
+	}
+	return func(key string) (*DataBlock, error) {
+		block, ok := blocks[key]
+		if !ok {
+			return new(DataBlock), errors.New("no superblock " + key)
+		}
+		return block, nil
+	}
+}
+
+/*
+Checks that arbitrary superblock contents survive being written and read, including free inode
+lists long enough to need overflow superblocks.
+*/
+func TestSuperblockRoundTrip(t *testing.T) {
+	roundTrip := func(lastInode, lastData, root uint64, info SuperblockInfo, listSeed int64, listBlocks uint8) bool {
+		// vary the list from empty to spanning a few overflow blocks
+		listData := testData(rand.New(rand.NewSource(listSeed)).Intn(int(listBlocks%4)*int(BLOCK_SIZE)+1), listSeed)
+		inodeStream := &IntStream{lastInt: lastInode}
+		dataStream := &IntStream{lastInt: lastData}
+		// gob does not distinguish an empty slice from nil
+		if len(info.WrappedKey) == 0 {
+			info.WrappedKey = nil
+		}
+		if len(info.Orphans) == 0 {
+			info.Orphans = nil
+		}
+		payload, err := encodeSuperPayload(&info, listData)
+		if err != nil {
+			return false
+		}
+		superBlocks := makeSuperblocks(inodeStream.compressStream(), dataStream.compressStream(), root, payload)
+		contents, err := readSuperblock(superBlocks[0], superblockFetcher(superBlocks))
+		if err != nil {
+			return false
+		}
+		return contents.lastInode == inodeStream.compressStream() &&
+			contents.lastData == dataStream.compressStream() &&
+			contents.rootInode == root &&
+			reflect.DeepEqual(*contents.info, info) &&
+			string(contents.inodeListData) == string(listData)
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 50}); err != nil {
+		t.Error(err)
+	}
+}
+
+/*
+Checks that a superblock written before format versioning, whose payload is only the free inode
+list, is read as format version 1.
+*/
+func TestLegacySuperblock(t *testing.T) {
+	stream := &IntStream{lastInt: 7}
+	listData := []byte{1, 2, 3, 4, 5}
+	superBlocks := makeSuperblocks(stream.compressStream(), stream.compressStream(), ROOT_INODE, listData)
+	contents, err := readSuperblock(superBlocks[0], superblockFetcher(superBlocks))
+	if err != nil {
+		t.Fatalf("readSuperblock: %v", err)
+	}
+	if contents.info.FormatVersion != LEGACY_FORMAT_VERSION {
+		t.Errorf("FormatVersion = %d, want %d", contents.info.FormatVersion, LEGACY_FORMAT_VERSION)
+	}
+	if string(contents.inodeListData) != string(listData) {
+		t.Errorf("inode list = %v, want %v", contents.inodeListData, listData)
+	}
+	if err := checkFormatSupported(contents.info); err != nil {
+		t.Errorf("legacy superblock not supported: %v", err)
+	}
+}
+
+/*
+Checks that new file systems get the label and description from the config, that the mount is named
+after the label, and that labels that cannot be passed as a mount option are refused.
+*/
+func TestSuperblockLabel(t *testing.T) {
+	FS_LABEL, FS_DESCRIPTION = "prod-logs", "application logs, kept for a year"
+	defer func() { FS_LABEL, FS_DESCRIPTION = "", "" }()
+	info := newSuperblockInfo()
+	if info.Label != FS_LABEL || info.Description != FS_DESCRIPTION {
+		t.Fatalf("new superblock has label %q and description %q", info.Label, info.Description)
+	}
+	if name := mountName(info.Label); name != "cloudfusion:prod-logs" {
+		t.Fatalf("mountName = %q", name)
+	}
+	if name := mountName(""); name != FS_NAME {
+		t.Fatalf("mountName of no label = %q", name)
+	}
+	if err := checkLabel(FS_LABEL, FS_DESCRIPTION); err != nil {
+		t.Fatalf("checkLabel: %v", err)
+	}
+	for _, label := range []string{"a,b", "a\nb", strings.Repeat("x", MAX_LABEL_LENGTH+1)} {
+		if checkLabel(label, "") == nil {
+			t.Errorf("label %q was accepted", label)
+		}
+	}
+}
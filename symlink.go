@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"path"
+	"syscall"
+)
+
+var _ = fs.NodeSymlinker(&Dir{})
+
+/*
+FUSE method that makes a symbolic link in the directory. The target is kept in the inode buffer of
+the link, so it cannot be longer than INODE_BUFFER_SIZE.
+*/
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	defer trackOp("Symlink")()
+	defer recoverPanic("Symlink")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Symlink")()
+	debugOp(path.Join(d.path, req.NewName), "Symlink", "parent=%d target=%s", d.inodeNum, req.Target)
+	if uint64(len(req.Target)) > INODE_BUFFER_SIZE {
+		return nil, fuse.Errno(syscall.ENAMETOOLONG)
+	}
+	err := checkDirWritable(d.inodeNum, true)
+	if err != nil {
+		return nil, err
+	}
+	err = checkStoreWritable()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := lookupEntry(d.inodeNum, d.inode, req.NewName)
+	if err != nil {
+		return nil, err
+	}
+	if exists != INVALID_INODE {
+		return nil, fuse.EEXIST
+	}
+	err = d.checkRoomFor(req.NewName)
+	if err != nil {
+		return nil, err
+	}
+	inode := createInode(INODE_SYMLINK)
+	inodeNum := nextInodeNum(d.inodeStream)
+	inode.init(d.inodeNum, inodeNum)
+	copy(inode.DataBuf[:], req.Target)
+	inode.updateSize(uint64(len(req.Target)))
+	err = setNewGeneration(inode, inodeNum)
+	if err == nil {
+		err = setNewOwner(inode, inodeNum, req.Header)
+	}
+	if err == nil {
+		err = putInode(inode, inodeNum)
+	}
+	if err == nil {
+		err = d.addFile(req.NewName, inodeNum)
+	}
+	if err != nil {
+		return nil, err
+	}
+	link := &File{
+		inode:       inode,
+		inodeNum:    inodeNum,
+		dirNum:      d.inodeNum,
+		inodeStream: d.inodeStream,
+		path:        path.Join(d.path, req.NewName),
+	}
+	liveNodes.add(inodeNum, link)
+	audit("symlink", req.Header, link.path, "", inodeNum)
+	notifyChange("create", link.path, "", false)
+	return link, nil
+}
+
+var _ = fs.NodeReadlinker(&File{})
+
+/*
+FUSE method that returns the target of a symbolic link.
+*/
+func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	defer trackOp("Readlink")()
+	defer recoverPanic("Readlink")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Readlink")()
+	debugOp(f.path, "Readlink", "inode=%d", f.inodeNum)
+	if !f.inode.isSymlink() {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return string(f.inode.DataBuf[:f.inode.Size]), nil
+}
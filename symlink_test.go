@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"os"
+	"strings"
+	"testing"
+)
+
+/*
+Checks that a symbolic link keeps its target, is reported as a link, and that names already in use
+and targets too long for the inode buffer are refused.
+*/
+func TestSymlink(t *testing.T) {
+	filesys, _ := newTestFs(t, 8)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	writeTestFile(t, root, "file", testData(100, 1), 100)
+	target := "../some/where/file"
+	if _, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "link", Target: target}); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if _, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "file", Target: target}); err != fuse.EEXIST {
+		t.Fatalf("Symlink over an existing file returned %v", err)
+	}
+	long := strings.Repeat("x", int(INODE_BUFFER_SIZE)+1)
+	if _, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: "long", Target: long}); err == nil {
+		t.Fatalf("made a link with a %d byte target", len(long))
+	}
+
+	node, err := root.lookup(ctx, "link")
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	link := node.(*File)
+	attr := new(fuse.Attr)
+	link.Attr(ctx, attr)
+	if attr.Mode&os.ModeSymlink == 0 || attr.Size != uint64(len(target)) {
+		t.Fatalf("link has mode %v and size %d", attr.Mode, attr.Size)
+	}
+	got, err := link.Readlink(ctx, new(fuse.ReadlinkRequest))
+	if err != nil || got != target {
+		t.Fatalf("Readlink = %q, %v", got, err)
+	}
+	node, _ = root.lookup(ctx, "file")
+	if _, err := node.(*File).Readlink(ctx, new(fuse.ReadlinkRequest)); err == nil {
+		t.Fatalf("Readlink of a regular file succeeded")
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "link"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 || report.files != 1 {
+		t.Fatalf("fsck: %+v", report)
+	}
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"os"
+	"path"
+	"strings"
+)
+
+// the kinds of entries sync copies. Special files are skipped.
+const SYNC_DIR byte = 1
+const SYNC_FILE byte = 2
+const SYNC_SYMLINK byte = 3
+
+/*
+Struct holding what sync knows of a file, directory, or link of one of the two file systems.
+*/
+type syncEntry struct {
+	kind     byte
+	inodeNum uint64
+	size     uint64
+	target   string   // the target of a link
+	chunks   [][]byte // the hashes of the chunks of a file, see chunkHashes
+}
+
+/*
+Struct describing a file, directory, or link of the source that the destination does not have as
+it is.
+*/
+type syncChange struct {
+	path    string
+	src     *syncEntry
+	replace bool     // whether the destination has an entry of another kind at path, removed first
+	chunks  []uint64 // the chunks of a file to copy
+	staged  *os.File // the staging file holding the chunks, at their offsets in the file
+}
+
+/*
+Struct counting what sync found and copied.
+*/
+type syncStats struct {
+	Unchanged int
+	Dirs      int
+	Files     int
+	Links     int
+	Removed   int
+	Skipped   int // special files, which are not copied
+	Chunks    int
+	Bytes     uint64
+}
+
+/*
+Returns the offset and length of chunk index of a file of size. The chunks of a file are the part of
+its data in the inode buffer, followed by the part in each data block, which the hashes of its data
+blocks are kept for, so that the chunks that differ are found without reading the data.
+*/
+func chunkRange(index, size uint64) (uint64, uint64) {
+	if index == 0 {
+		return 0, minUint64(size, INODE_BUFFER_SIZE)
+	}
+	offset := INODE_BUFFER_SIZE + (index-1)*BLOCK_SIZE
+	return offset, minUint64(BLOCK_SIZE, size-offset)
+}
+
+/*
+Returns the hashes of the chunks of the inode's data: the SHA-256 of the part in its buffer, and of
+each data block, holes counting as blocks of zeros, as in contentHash. Only the inode and the hash
+blocks are read. Must be called holding fsLock.
+*/
+func (i *Inode) chunkHashes() ([][]byte, error) {
+	bufSum := sha256.Sum256(i.DataBuf[:minUint64(i.Size, INODE_BUFFER_SIZE)])
+	chunks := [][]byte{bufSum[:]}
+	err := i.walkBlocks(true, func(blockNum uint64, indirect bool) error {
+		if indirect {
+			return nil
+		}
+		if blockNum == 0 {
+			chunks = append(chunks, zeroBlockHash[:])
+			return nil
+		}
+		sum, err := getBlockHash(blockNum)
+		chunks = append(chunks, append([]byte(nil), sum...))
+		return err
+	})
+	return chunks, err
+}
+
+/*
+Loads the config at configPath and opens the file system it describes, which must not be mounted,
+as the tool commands do. The file systems are opened one at a time, since the store and cache are
+global.
+*/
+func openSyncFs(configPath string) (*FS, error) {
+	config := loadConfig(configPath)
+	err := initializeToolBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	return openFs()
+}
+
+/*
+Returns every file, directory, and link of filesys by path, along with the paths in tree order,
+each directory before what is in it, and the entries of each directory in name order.
+*/
+func readSyncTree(filesys *FS) (map[string]*syncEntry, []string, error) {
+	root, err := filesys.Root()
+	if err != nil {
+		return nil, nil, err
+	}
+	entries := make(map[string]*syncEntry)
+	var order []string
+	var walk func(p string, node fs.Node) error
+	walk = func(p string, node fs.Node) error {
+		ctx := context.Background()
+		switch node := node.(type) {
+		case *Dir:
+			entries[p] = &syncEntry{kind: SYNC_DIR, inodeNum: node.inodeNum}
+			order = append(order, p)
+			var names []string
+			fsLock.Lock()
+			err := forEachEntry(node.inodeNum, node.inode, func(name string, inodeNum uint64) error {
+				names = append(names, name)
+				return nil
+			})
+			fsLock.Unlock()
+			if err != nil {
+				return errors.New(p + ": " + err.Error())
+			}
+			for _, name := range names {
+				child, err := node.lookup(ctx, name)
+				if err != nil {
+					return errors.New(path.Join(p, name) + ": " + err.Error())
+				}
+				err = walk(path.Join(p, name), child)
+				if err != nil {
+					return err
+				}
+			}
+		case *File:
+			fsLock.Lock()
+			entry := &syncEntry{inodeNum: node.inodeNum, size: node.inode.Size}
+			var err error
+			switch {
+			case node.inode.isSymlink():
+				entry.kind = SYNC_SYMLINK
+				entry.target = string(node.inode.DataBuf[:node.inode.Size])
+			case !node.inode.isSpecial():
+				entry.kind = SYNC_FILE
+				entry.chunks, err = node.inode.chunkHashes()
+			}
+			fsLock.Unlock()
+			if err != nil {
+				return errors.New(p + ": " + err.Error())
+			}
+			entries[p] = entry
+			order = append(order, p)
+		}
+		return nil
+	}
+	return entries, order, walk("/", root)
+}
+
+/*
+Returns the changes that make the destination tree dst match the source tree src, in the tree order
+of the source, and the paths of the destination to remove, outermost first, which are only those
+the source does not have if remove is set. Entries the destination has as they are in the source
+are counted as unchanged.
+*/
+func planSync(src map[string]*syncEntry, srcOrder []string, dst map[string]*syncEntry, dstOrder []string, remove bool, stats *syncStats) ([]*syncChange, []string) {
+	var changes []*syncChange
+	for _, p := range srcOrder {
+		s, d := src[p], dst[p]
+		if s.kind == 0 {
+			stats.Skipped++
+			continue
+		}
+		change := &syncChange{path: p, src: s, replace: d != nil && d.kind != s.kind}
+		if d == nil || change.replace {
+			d = nil
+		}
+		switch s.kind {
+		case SYNC_DIR:
+			if d != nil {
+				stats.Unchanged++
+				continue
+			}
+		case SYNC_SYMLINK:
+			if d != nil && d.target == s.target {
+				stats.Unchanged++
+				continue
+			}
+			// a link is replaced rather than changed
+			change.replace = d != nil || change.replace
+		case SYNC_FILE:
+			for index := range s.chunks {
+				if d == nil || index >= len(d.chunks) || !bytes.Equal(s.chunks[index], d.chunks[index]) {
+					change.chunks = append(change.chunks, uint64(index))
+				}
+			}
+			if d != nil && d.size == s.size && len(change.chunks) == 0 {
+				stats.Unchanged++
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	var removals []string
+	if remove {
+		for _, p := range dstOrder {
+			if _, ok := src[p]; ok || p == "/" {
+				continue
+			}
+			if len(removals) > 0 && strings.HasPrefix(p, removals[len(removals)-1]+"/") {
+				// removed along with the directory holding it
+				continue
+			}
+			removals = append(removals, p)
+		}
+	}
+	return changes, removals
+}
+
+/*
+Reads the chunks of the files changed from the source, writing each file's chunks to a staging file
+in dir at their offsets in the file, so that they can be written to the destination once it is
+opened in place of the source.
+*/
+func stageSyncChanges(changes []*syncChange, dir string) error {
+	for _, change := range changes {
+		if len(change.chunks) == 0 {
+			continue
+		}
+		staged, err := os.CreateTemp(dir, "chunks-")
+		if err != nil {
+			return err
+		}
+		change.staged = staged
+		fsLock.Lock()
+		inode, err := getInode(change.src.inodeNum)
+		for _, index := range change.chunks {
+			if err != nil {
+				break
+			}
+			offset, length := chunkRange(index, change.src.size)
+			var data []byte
+			data, err = inode.readFromData(offset, length)
+			if err == nil {
+				_, err = staged.WriteAt(data, int64(offset))
+			}
+		}
+		fsLock.Unlock()
+		if err != nil {
+			return errors.New(change.path + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+Returns the directory of filesys at p.
+*/
+func syncDir(filesys *FS, p string) (*Dir, error) {
+	node, err := lookupNode(filesys, p)
+	if err != nil {
+		return nil, errors.New(p + ": " + err.Error())
+	}
+	dir, ok := node.(*Dir)
+	if !ok {
+		return nil, errors.New(p + " is not a directory")
+	}
+	return dir, nil
+}
+
+/*
+Removes the entry at p of filesys, and everything under it if it is a directory.
+*/
+func removeSyncTree(filesys *FS, p string) error {
+	parent, err := syncDir(filesys, path.Dir(p))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	name := path.Base(p)
+	node, err := parent.lookup(ctx, name)
+	if err != nil {
+		return errors.New(p + ": " + err.Error())
+	}
+	dir, isDir := node.(*Dir)
+	if isDir {
+		var names []string
+		fsLock.Lock()
+		err = forEachEntry(dir.inodeNum, dir.inode, func(childName string, inodeNum uint64) error {
+			names = append(names, childName)
+			return nil
+		})
+		fsLock.Unlock()
+		for _, childName := range names {
+			if err != nil {
+				break
+			}
+			err = removeSyncTree(filesys, path.Join(p, childName))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = parent.Remove(ctx, &fuse.RemoveRequest{Header: copyHeader(), Name: name, Dir: isDir})
+	if err != nil {
+		return errors.New(p + ": " + err.Error())
+	}
+	return nil
+}
+
+/*
+Makes the destination file system filesys match the source by removing the paths removed and
+applying the changes, writing only the staged chunks of the files changed.
+*/
+func applySync(filesys *FS, changes []*syncChange, removals []string, stats *syncStats) error {
+	for _, p := range removals {
+		err := removeSyncTree(filesys, p)
+		if err != nil {
+			return err
+		}
+		stats.Removed++
+	}
+	ctx := context.Background()
+	for _, change := range changes {
+		if change.replace {
+			err := removeSyncTree(filesys, change.path)
+			if err != nil {
+				return err
+			}
+		}
+		parent, err := syncDir(filesys, path.Dir(change.path))
+		if err != nil {
+			return err
+		}
+		name := path.Base(change.path)
+		switch change.src.kind {
+		case SYNC_DIR:
+			_, err = parent.Mkdir(ctx, &fuse.MkdirRequest{Header: copyHeader(), Name: name, Mode: os.ModeDir | 0755})
+			stats.Dirs++
+		case SYNC_SYMLINK:
+			_, err = parent.Symlink(ctx, &fuse.SymlinkRequest{Header: copyHeader(), NewName: name, Target: change.src.target})
+			stats.Links++
+		case SYNC_FILE:
+			err = syncFileChunks(parent, name, change, stats)
+			stats.Files++
+		}
+		if err != nil {
+			return errors.New(change.path + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+/*
+Writes the staged chunks of a changed file to the file name in parent, creating it if it does not
+exist, and gives it the size of the source.
+*/
+func syncFileChunks(parent *Dir, name string, change *syncChange, stats *syncStats) error {
+	ctx := context.Background()
+	req := &fuse.CreateRequest{Header: copyHeader(), Name: name, Flags: fuse.OpenReadWrite, Mode: 0644}
+	node, handle, err := parent.Create(ctx, req, new(fuse.CreateResponse))
+	if err != nil {
+		return err
+	}
+	fh := handle.(*FileHandle)
+	for _, index := range change.chunks {
+		offset, length := chunkRange(index, change.src.size)
+		data := make([]byte, length)
+		_, err = change.staged.ReadAt(data, int64(offset))
+		if err == nil {
+			err = fh.Write(ctx, &fuse.WriteRequest{Header: copyHeader(), Offset: int64(offset), Data: data}, new(fuse.WriteResponse))
+		}
+		if err != nil {
+			break
+		}
+		stats.Chunks++
+		stats.Bytes += length
+	}
+	releaseErr := fh.Release(ctx, &fuse.ReleaseRequest{Header: copyHeader()})
+	if err == nil {
+		err = releaseErr
+	}
+	if err != nil {
+		return err
+	}
+	file := node.(*File)
+	if file.inode.Size == change.src.size {
+		return nil
+	}
+	// the destination was longer, or the source ends in a hole
+	setattr := &fuse.SetattrRequest{Header: copyHeader(), Valid: fuse.SetattrSize, Size: change.src.size}
+	return file.Setattr(ctx, setattr, new(fuse.SetattrResponse))
+}
+
+/*
+Makes the file system described by the config at dstConfig match the one described by srcConfig,
+neither of which may be mounted: directories and links the destination lacks are made, and files
+that differ are written, only the chunks (the inode buffer and data blocks) whose hashes differ
+being read and copied. The source is read first, staging the chunks to copy in a temporary
+directory, and then the destination is changed and written back as cp does. Entries the source
+does not have are removed only if remove is set. If dryRun is set, nothing is staged or changed.
+*/
+func syncFileSystems(srcConfig, dstConfig string, remove, dryRun bool) (*syncStats, error) {
+	dstFs, err := openSyncFs(dstConfig)
+	if err != nil {
+		return nil, err
+	}
+	dst, dstOrder, err := readSyncTree(dstFs)
+	if err != nil {
+		return nil, err
+	}
+	srcFs, err := openSyncFs(srcConfig)
+	if err != nil {
+		return nil, err
+	}
+	src, srcOrder, err := readSyncTree(srcFs)
+	if err != nil {
+		return nil, err
+	}
+	stats := new(syncStats)
+	changes, removals := planSync(src, srcOrder, dst, dstOrder, remove, stats)
+	for _, p := range removals {
+		fmt.Println("remove " + p)
+	}
+	for _, change := range changes {
+		fmt.Printf("update %s (%d chunks)\n", change.path, len(change.chunks))
+	}
+	if dryRun || (len(changes) == 0 && len(removals) == 0) {
+		return stats, nil
+	}
+	staging, err := os.MkdirTemp("", "cloudfusion-sync-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	defer func() {
+		for _, change := range changes {
+			if change.staged != nil {
+				change.staged.Close()
+			}
+		}
+	}()
+	err = stageSyncChanges(changes, staging)
+	if err != nil {
+		return nil, err
+	}
+	dstFs, err = openSyncFs(dstConfig)
+	if err != nil {
+		return nil, err
+	}
+	err = applySync(dstFs, changes, removals, stats)
+	// what was changed before a failure is kept, so the superblock has to record its inodes and blocks
+	dstFs.Destroy()
+	return stats, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"golang.org/x/net/context"
+	"os"
+	"reflect"
+	"testing"
+)
+
+/*
+Syncs a file system into another holding an older copy of its tree, and checks that only the blocks
+that differ are copied, that what the source lacks is removed, and that the trees then match.
+*/
+func TestSync(t *testing.T) {
+	ctx := context.Background()
+	same := testData(int(INODE_BUFFER_SIZE+3*BLOCK_SIZE), 1)
+	old := testData(int(INODE_BUFFER_SIZE+4*BLOCK_SIZE), 2)
+	changed := append([]byte(nil), old[:INODE_BUFFER_SIZE+3*BLOCK_SIZE]...)
+	copy(changed[INODE_BUFFER_SIZE+BLOCK_SIZE+10:], "changed")
+
+	dstFs, dstObjects := newTestFs(t, 64)
+	dstRoot := testRoot(t, dstFs)
+	writeTestFile(t, dstRoot, "same", same, 1<<16)
+	writeTestFile(t, dstRoot, "changed", old, 1<<16)
+	writeTestFile(t, dstRoot, "extra", testData(100, 3), 100)
+	dst, dstOrder, err := readSyncTree(dstFs)
+	if err != nil {
+		t.Fatalf("readSyncTree: %v", err)
+	}
+	dstFs.Destroy()
+
+	srcFs, _ := newTestFs(t, 64)
+	srcRoot := testRoot(t, srcFs)
+	writeTestFile(t, srcRoot, "same", same, 1<<16)
+	writeTestFile(t, srcRoot, "changed", changed, 1<<16)
+	node, err := srcRoot.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir", Mode: os.ModeDir | 0755})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	writeTestFile(t, node.(*Dir), "new", testData(1000, 4), 1000)
+	srcRoot.Symlink(ctx, &fuse.SymlinkRequest{NewName: "link", Target: "dir/new"})
+	src, srcOrder, err := readSyncTree(srcFs)
+	if err != nil {
+		t.Fatalf("readSyncTree: %v", err)
+	}
+
+	stats := new(syncStats)
+	changes, removals := planSync(src, srcOrder, dst, dstOrder, true, stats)
+	if stats.Unchanged != 2 || !reflect.DeepEqual(removals, []string{"/extra"}) || len(changes) != 4 {
+		t.Fatalf("%d unchanged, removals %v, %d changes", stats.Unchanged, removals, len(changes))
+	}
+	if changes[0].path != "/changed" || !reflect.DeepEqual(changes[0].chunks, []uint64{2}) {
+		t.Fatalf("the first change is %s with chunks %v, want /changed with chunk 2", changes[0].path, changes[0].chunks)
+	}
+	err = stageSyncChanges(changes, t.TempDir())
+	if err != nil {
+		t.Fatalf("stageSyncChanges: %v", err)
+	}
+	defer func() {
+		for _, change := range changes {
+			if change.staged != nil {
+				change.staged.Close()
+			}
+		}
+	}()
+
+	store = dstObjects
+	cache = newCache(newMemStore(), 64)
+	super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err != nil {
+		t.Fatalf("getDataByKey for superblock: %v", err)
+	}
+	dstFs, err = makeFs(super)
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	err = applySync(dstFs, changes, removals, stats)
+	if err != nil {
+		t.Fatalf("applySync: %v", err)
+	}
+	if stats.Chunks != 3 || stats.Removed != 1 || stats.Files != 2 || stats.Dirs != 1 || stats.Links != 1 {
+		t.Fatalf("sync stats %+v", stats)
+	}
+	synced, syncedOrder, err := readSyncTree(dstFs)
+	if err != nil {
+		t.Fatalf("readSyncTree: %v", err)
+	}
+	if !reflect.DeepEqual(syncedOrder, srcOrder) {
+		t.Fatalf("the synced tree has %v, want %v", syncedOrder, srcOrder)
+	}
+	for _, p := range srcOrder {
+		s, d := src[p], synced[p]
+		if s.kind != d.kind || s.size != d.size || s.target != d.target || !reflect.DeepEqual(s.chunks, d.chunks) {
+			t.Fatalf("%s differs after the sync", p)
+		}
+	}
+	file, _ := lookupNode(dstFs, "/changed")
+	fsLock.Lock()
+	got, _ := file.(*File).inode.readFromData(0, uint64(len(changed)))
+	fsLock.Unlock()
+	if !bytes.Equal(got, changed) {
+		t.Fatalf("the synced file differs")
+	}
+}
@@ -1,20 +1,20 @@
 package main
 
 import (
-	"container/list"
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"time"
 )
 
 /*
-Runs all tests associated with the program. A test failure does not result in a program halt or exit,
-because this would interfere with maintaining the state of the bucket/table.
+Runs all tests against the mounted file system. A test failure does not result in a program halt or exit,
+because this would interfere with maintaining the state of the bucket/table. Tests that do not need
+a mount (or AWS) are run with go test instead.
 */
 func runAllTests() {
-	inodeTableTest()
-	streamTest()
 	// sleep here so the file system has time be initialized
 	time.Sleep(5 * time.Second)
 	mkdirTest()
@@ -34,7 +34,7 @@ func runAllTests() {
 Tests writing, reading, and deleting a small file (239B) that fits in the inode buffer.
 */
 func smallWriteTest() {
-	errMessage := writeTest("smallFile.txt")
+	errMessage := writeTest("smallFile.txt", 239)
 	if errMessage != "" {
 		fmt.Println(errMessage + " in smallWriteTest")
 	} else {
@@ -46,7 +46,7 @@ func smallWriteTest() {
 Tests writing, reading, and deleting a medium file (120KB) that fits in several data blocks.
 */
 func mediumWriteTest() {
-	errMessage := writeTest("mediumFile.txt")
+	errMessage := writeTest("mediumFile.txt", 119999)
 	if errMessage != "" {
 		fmt.Println(errMessage + " in mediumWriteTest")
 	} else {
@@ -58,7 +58,7 @@ func mediumWriteTest() {
 Tests writing, reading, and deleting a larger file (420KB) that fits in the beginning of the singly indirect block.
 */
 func largeWriteTest() {
-	errMessage := writeTest("largeFile.txt")
+	errMessage := writeTest("largeFile.txt", 419999)
 	if errMessage != "" {
 		fmt.Println(errMessage + " in largeWriteTest")
 	} else {
@@ -71,7 +71,7 @@ Tests writing, reading, and deleting a large file (8MB) that fits in a larger po
 This is slow and fairly expensive, especially if run with a small cache size that requires writes back to S3.
 */
 func veryLargeWriteTest() {
-	errMessage := writeTest("veryLargeFile.txt")
+	errMessage := writeTest("veryLargeFile.txt", 7999999)
 	if errMessage != "" {
 		fmt.Println(errMessage + " in veryLargeWriteTest")
 	} else {
@@ -80,18 +80,23 @@ func veryLargeWriteTest() {
 }
 
 /*
-Generic test for writing/reading/deleting a single file. First the file is copied into the file
-system at the root, then it is read and the number of bytes read is checked against the original file.
-Finally, it is deleted from the file system. If the cache size is large enough, nothing will
+Returns size bytes of pseudo-random data that are the same every time for a given size, to be
+used as the contents of a test file.
+*/
+func testFileData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+/*
+Generic test for writing/reading/deleting a single file. First a file of the given size is written
+into the file system at the root, then it is read back and checked byte for byte against what was
+written. Finally, it is deleted from the file system. If the cache size is large enough, nothing will
 ever be written back to S3.
 */
-func writeTest(fileName string) string {
-	goPath := os.Getenv("GOPATH")
-	err := os.Chdir(goPath + "/bin/CloudFusionTests")
-	file, _ := os.Open(fileName)
-	data, _ := ioutil.ReadAll(file)
-	_ = file.Close()
-	fileLen := len(data)
+func writeTest(fileName string, size int) string {
+	data := testFileData(size)
 
 	path := mountpoint
 	newFile, err := os.Create(path + "/" + fileName)
@@ -112,9 +117,15 @@ func writeTest(fileName string) string {
 		return "error from opening new file"
 	}
 	newData, err := ioutil.ReadAll(newFile)
-	if err != nil || len(newData) != fileLen {
+	if err != nil {
 		return "error from reading new file"
 	}
+	if len(newData) != size {
+		return fmt.Sprintf("read %d bytes of %d written", len(newData), size)
+	}
+	if !bytes.Equal(newData, data) {
+		return "data read differs from data written"
+	}
 	err = newFile.Close()
 	if err != nil {
 		return "error from fileHandle close"
@@ -126,43 +137,6 @@ func writeTest(fileName string) string {
 	return ""
 }
 
-/*
-Unit tests for the IntStream struct that check it's compression/decompression functions
-and that it's stack is working correctly.
-*/
-func streamTest() {
-	testStream := &IntStream{
-		stack:   new(list.List),
-		lastInt: 1,
-	}
-	nextNum := testStream.next()
-	if nextNum != 2 {
-		fmt.Println("error from stream.next in streamTest")
-	}
-	compressedNum := testStream.compressStream()
-	testStream.lastInt = 100
-	testStream.decompressStream(compressedNum)
-	if testStream.lastInt != 2 {
-		fmt.Println("error from compress/decompress stream in streamTest")
-	}
-	testStream.put(29)
-	data, err := testStream.MarshalBinary()
-	if err != nil {
-		fmt.Println("error from stream.MarshalBinary in streamTest")
-	}
-	testStream.stack = new(list.List)
-	err = testStream.UnmarshalBinary(data)
-	if err != nil {
-		fmt.Println("error from stream.UnmarshalBinary in streamTest")
-	}
-	nextNum = testStream.next()
-	nextNextNum := testStream.next()
-	if nextNum != 29 || nextNextNum != 3 {
-		fmt.Println("error from stream.next after UnmarshalBinary in streamTest")
-	}
-	fmt.Println("streamTest passed")
-}
-
 /*
 Creates and deletes a directory from the root of the file system.
 */
@@ -181,30 +155,3 @@ func mkdirTest() {
 		fmt.Println("error from RemoveAll in mkdirTest")
 	}
 }
-
-/*
-Unit testing the inodeTable struct that checks its compression/decompression
-functionality.
-*/
-func inodeTableTest() {
-	table := new(InodeTable)
-	table.init(1, 27)
-	table.add("testFile", 5)
-	tableData, err := table.MarshalBinary()
-	if err != nil {
-		fmt.Println("error from MarshalBinary in inodeTableTest")
-	}
-	newTable := new(InodeTable)
-	err2 := newTable.UnmarshalBinary(tableData)
-	if err2 != nil {
-		fmt.Println("error from UnmarshalBinary in inodeTableTest")
-	}
-	if newTable.Table["."] != 27 || newTable.Table["testFile"] != 5 {
-		fmt.Println("incorrect values from table in inodeTableTest")
-	}
-	newTable.delete("testFile")
-	if newTable.Table["testFile"] != 0 {
-		fmt.Println("table delete failed in inodeTableTest")
-	}
-	fmt.Println("inodeTableTest passed")
-}
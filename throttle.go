@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// the most bytes per second put to S3, across evictions, flushes, and commands, or 0 for no limit,
+// so that a large flush of the cache does not take the whole network link of the host
+var S3_UPLOAD_BANDWIDTH int64 = 0
+
+// the most bytes per second read from S3, or 0 for no limit
+var S3_DOWNLOAD_BANDWIDTH int64 = 0
+
+// how long a limiter that has been idle may send at full speed before it is held to its rate, so
+// that single blocks read or written now and then are not delayed
+const BANDWIDTH_BURST time.Duration = time.Second
+
+// the most bytes of an object read from S3 before waiting for the download bandwidth, so that the
+// read of a large object is spread out rather than waiting once for all of it
+const BANDWIDTH_CHUNK_SIZE int = 64 << 10
+
+/*
+Struct limiting the bytes sent through it to a rate, in bytes per second. Each transfer pushes back
+the time the next can start by its size over the rate; transfers start at once while that time is
+within BANDWIDTH_BURST of the present.
+*/
+type bandwidthLimiter struct {
+	lock  sync.Mutex
+	rate  int64
+	ready time.Time // when the transfers already let through will have taken their share of the rate
+}
+
+/*
+Returns a pointer to a new limiter to rate bytes per second, or to none if rate is 0.
+*/
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	return &bandwidthLimiter{rate: rate}
+}
+
+/*
+Returns how long a transfer of n bytes has to wait to stay within the rate, counting it as sent.
+*/
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if earliest := now.Add(-BANDWIDTH_BURST); l.ready.Before(earliest) {
+		l.ready = earliest
+	}
+	l.ready = l.ready.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	if l.ready.After(now) {
+		return l.ready.Sub(now)
+	}
+	return 0
+}
+
+/*
+Waits until a transfer of n bytes fits in the rate.
+*/
+func (l *bandwidthLimiter) wait(n int) {
+	if delay := l.reserve(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+/*
+Reader that reads from another reader no faster than a limiter allows.
+*/
+type throttledReader struct {
+	inner   io.Reader
+	limiter *bandwidthLimiter
+}
+
+/*
+Reads up to BANDWIDTH_CHUNK_SIZE bytes from the inner reader, then waits for the limiter.
+*/
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > BANDWIDTH_CHUNK_SIZE {
+		p = p[:BANDWIDTH_CHUNK_SIZE]
+	}
+	n, err := r.inner.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
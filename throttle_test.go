@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+/*
+Checks that a limiter lets a burst through at once, then holds transfers to its rate, and that a
+limiter with no rate never waits.
+*/
+func TestBandwidthLimiter(t *testing.T) {
+	limiter := newBandwidthLimiter(1 << 20)
+	if delay := limiter.reserve(1 << 20); delay != 0 {
+		t.Fatalf("the first second of transfers waited %v", delay)
+	}
+	if delay := limiter.reserve(1 << 19); delay < 400*time.Millisecond || delay > 500*time.Millisecond {
+		t.Fatalf("half a second of transfers past the burst waited %v", delay)
+	}
+	unlimited := newBandwidthLimiter(0)
+	for i := 0; i < 10; i++ {
+		if delay := unlimited.reserve(1 << 30); delay != 0 {
+			t.Fatalf("a limiter with no rate waited %v", delay)
+		}
+	}
+}
+
+/*
+Checks that a throttled reader returns all of the data of the inner reader, no faster than its rate.
+*/
+func TestThrottledReader(t *testing.T) {
+	data := testData(3*BANDWIDTH_CHUNK_SIZE, 1)
+	limiter := newBandwidthLimiter(int64(len(data)) * 5)
+	// the burst is used up, so that the read is held to the rate
+	limiter.reserve(len(data) * 5)
+	start := time.Now()
+	got, err := ioutil.ReadAll(&throttledReader{inner: bytes.NewReader(data), limiter: limiter})
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, err %v", len(got), err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatalf("reading 200ms worth of data took %v", elapsed)
+	}
+}
+
+/*
+Checks that flushDueBlocks writes each block due to S3 and records the flush.
+*/
+func TestFlushDueBlocks(t *testing.T) {
+	newTestFs(t, 16)
+	cache.flush(0)
+	objects := newMemStore()
+	store = objects
+	block := new(DataBlock)
+	for _, key := range []string{"a", "b", "c"} {
+		putDataByKey(key, block)
+	}
+	lastFlush = time.Time{}
+	if err := flushDueBlocks(0); err != nil {
+		t.Fatalf("flushDueBlocks: %v", err)
+	}
+	if len(objects.items) != 3 || lastFlush.IsZero() {
+		t.Fatalf("flush wrote %d blocks, last flush at %v", len(objects.items), lastFlush)
+	}
+	if dirty, _ := cache.dirtyBlocks(); dirty != 0 {
+		t.Fatalf("%d dirty blocks after flushing", dirty)
+	}
+}
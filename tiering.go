@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"time"
+)
+
+// the value of StorageClass in the config that puts blocks in S3 Intelligent-Tiering, which moves
+// each object to cheaper access tiers as it goes unread
+const STORAGE_CLASS_INTELLIGENT_TIERING string = "INTELLIGENT_TIERING"
+
+// the storage class that objects are put to S3 with, from the config, or "" for S3 Standard
+var S3_STORAGE_CLASS string
+
+// how often a mount reads the usage of the access tiers of the bucket from CloudWatch. S3 reports
+// the size of a bucket to CloudWatch once a day, so reading it more often finds nothing new.
+const TIERING_REPORT_INTERVAL = 12 * time.Hour
+
+// the prices of the Intelligent-Tiering access tiers in us-east-1, in USD per GiB-month, with which
+// the savings over keeping every byte in the frequent access tier are estimated
+const FREQUENT_PRICE float64 = 0.023
+const INFREQUENT_PRICE float64 = 0.0125
+const ARCHIVE_INSTANT_PRICE float64 = 0.004
+const ARCHIVE_PRICE float64 = 0.0036
+const DEEP_ARCHIVE_PRICE float64 = 0.00099
+
+// the storage types of the Intelligent-Tiering access tiers in the BucketSizeBytes metric of S3
+var TIERING_STORAGE_TYPES = []string{"IntelligentTieringFAStorage", "IntelligentTieringIAStorage",
+	"IntelligentTieringAIAStorage", "IntelligentTieringAAStorage", "IntelligentTieringDAAStorage"}
+
+/*
+Struct holding how many bytes of the bucket are in each Intelligent-Tiering access tier, as last
+measured by S3. It is kept in the superblock, so that the stats command shows the last measurement
+made while the file system was mounted.
+*/
+type TieringUsage struct {
+	Time                int64 // when S3 measured the bucket, in seconds since the epoch, or 0 if it has not yet
+	FrequentBytes       uint64
+	InfrequentBytes     uint64
+	ArchiveInstantBytes uint64
+	ArchiveBytes        uint64
+	DeepArchiveBytes    uint64
+}
+
+// reads the current usage of the access tiers of the bucket, or is nil if blocks are not put in
+// Intelligent-Tiering. Set by initializeBackend and initializeToolBackend.
+var tieringSource func() (*TieringUsage, error)
+
+/*
+Returns an error if class is not a value of StorageClass in the config.
+*/
+func checkStorageClass(class string) error {
+	if class != "" && class != "STANDARD" && class != STORAGE_CLASS_INTELLIGENT_TIERING {
+		return fmt.Errorf("StorageClass must be \"STANDARD\" or %q, not %q.", STORAGE_CLASS_INTELLIGENT_TIERING, class)
+	}
+	return nil
+}
+
+/*
+Returns the function to set tieringSource to for the configured backend and storage class.
+*/
+func configuredTieringSource(config *Config) func() (*TieringUsage, error) {
+	if config.Backend == LOCAL_BACKEND || S3_STORAGE_CLASS != STORAGE_CLASS_INTELLIGENT_TIERING {
+		return nil
+	}
+	return cloudWatchTieringUsage
+}
+
+/*
+Returns the pointer to the field of usage holding the bytes of the access tier that S3 reports to
+CloudWatch under storageType.
+*/
+func (usage *TieringUsage) tierField(storageType string) *uint64 {
+	switch storageType {
+	case "IntelligentTieringFAStorage":
+		return &usage.FrequentBytes
+	case "IntelligentTieringIAStorage":
+		return &usage.InfrequentBytes
+	case "IntelligentTieringAIAStorage":
+		return &usage.ArchiveInstantBytes
+	case "IntelligentTieringAAStorage":
+		return &usage.ArchiveBytes
+	case "IntelligentTieringDAAStorage":
+		return &usage.DeepArchiveBytes
+	}
+	return nil
+}
+
+/*
+Reads the latest daily BucketSizeBytes metric of each access tier of the bucket from CloudWatch. The
+bucket of a file system holds only its blocks and audit log, so this is the usage of the file
+system. Returns a usage with Time 0 if S3 has not yet measured the bucket, which takes up to two
+days after it is created.
+*/
+func cloudWatchTieringUsage() (*TieringUsage, error) {
+	client := cloudwatch.New(session.New(newAWSConfig("monitoring", AWS_CLIENT_REGION)))
+	usage := new(TieringUsage)
+	now := time.Now()
+	for _, storageType := range TIERING_STORAGE_TYPES {
+		resp, err := client.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+			Namespace:  aws.String("AWS/S3"),
+			MetricName: aws.String("BucketSizeBytes"),
+			Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String("BucketName"), Value: aws.String(S3_BUCKET_NAME)},
+				{Name: aws.String("StorageType"), Value: aws.String(storageType)},
+			},
+			StartTime:  aws.Time(now.Add(-3 * 24 * time.Hour)),
+			EndTime:    aws.Time(now),
+			Period:     aws.Int64(24 * 60 * 60),
+			Statistics: aws.StringSlice([]string{cloudwatch.StatisticAverage}),
+		})
+		if err != nil {
+			return nil, errors.New("Could not read the Intelligent-Tiering usage of the bucket from CloudWatch: " + err.Error())
+		}
+		// tiers without objects have no datapoints
+		var latest *cloudwatch.Datapoint
+		for _, point := range resp.Datapoints {
+			if latest == nil || aws.TimeValue(point.Timestamp).After(aws.TimeValue(latest.Timestamp)) {
+				latest = point
+			}
+		}
+		if latest == nil {
+			continue
+		}
+		*usage.tierField(storageType) = uint64(aws.Float64Value(latest.Average))
+		if measured := aws.TimeValue(latest.Timestamp).Unix(); measured > usage.Time {
+			usage.Time = measured
+		}
+	}
+	return usage, nil
+}
+
+/*
+Reads the usage of the access tiers of the bucket from tieringSource and keeps it in the superblock
+info of the file system, leaving the last measurement if there is no new one.
+*/
+func refreshTiering(f *FS) error {
+	usage, err := tieringSource()
+	if err != nil {
+		return err
+	}
+	if usage.Time == 0 {
+		return nil
+	}
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	f.info.Tiering = *usage
+	return nil
+}
+
+/*
+Starts reading the usage of the access tiers of the bucket every TIERING_REPORT_INTERVAL while the
+file system is mounted, starting now. Does nothing if blocks are not put in Intelligent-Tiering.
+*/
+func startTieringReports(f *FS) {
+	if tieringSource == nil {
+		return
+	}
+	go func() {
+		for {
+			err := refreshTiering(f)
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+			time.Sleep(TIERING_REPORT_INTERVAL)
+		}
+	}()
+}
+
+/*
+Returns the bytes in all access tiers.
+*/
+func (usage *TieringUsage) totalBytes() uint64 {
+	return usage.FrequentBytes + usage.InfrequentBytes + usage.ArchiveInstantBytes + usage.ArchiveBytes + usage.DeepArchiveBytes
+}
+
+/*
+Returns the estimated monthly cost of storing usage in Intelligent-Tiering, and what storing all of
+it in the frequent access tier (the price of S3 Standard) would cost, in USD at the prices of
+us-east-1. The monitoring fee per object is left out.
+*/
+func (usage *TieringUsage) monthlyCost() (tiered float64, frequent float64) {
+	gib := func(bytes uint64) float64 { return float64(bytes) / (1 << 30) }
+	tiered = gib(usage.FrequentBytes)*FREQUENT_PRICE + gib(usage.InfrequentBytes)*INFREQUENT_PRICE +
+		gib(usage.ArchiveInstantBytes)*ARCHIVE_INSTANT_PRICE + gib(usage.ArchiveBytes)*ARCHIVE_PRICE +
+		gib(usage.DeepArchiveBytes)*DEEP_ARCHIVE_PRICE
+	frequent = gib(usage.totalBytes()) * FREQUENT_PRICE
+	return tiered, frequent
+}
+
+/*
+Prints how many bytes of the bucket are in each access tier, and what tiering saves.
+*/
+func printTiering(usage *TieringUsage) {
+	if usage.Time == 0 {
+		fmt.Println("tiering:         not measured yet (S3 measures buckets once a day)")
+		return
+	}
+	fmt.Printf("tiering as of:   %s\n", time.Unix(usage.Time, 0).UTC().Format("2006-01-02"))
+	fmt.Printf("frequent:        %d bytes\n", usage.FrequentBytes)
+	fmt.Printf("infrequent:      %d bytes\n", usage.InfrequentBytes)
+	fmt.Printf("archive instant: %d bytes\n", usage.ArchiveInstantBytes)
+	fmt.Printf("archive:         %d bytes\n", usage.ArchiveBytes)
+	fmt.Printf("deep archive:    %d bytes\n", usage.DeepArchiveBytes)
+	tiered, frequent := usage.monthlyCost()
+	fmt.Printf("tiering saves:   $%.2f of $%.2f a month (at us-east-1 prices, before monitoring fees)\n", frequent-tiered, frequent)
+}
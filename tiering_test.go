@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+/*
+Checks that the usage of the access tiers read while mounted is kept in the superblock, that a
+failed read or one with no measurement leaves the last usage, and that the savings over keeping
+everything in the frequent tier are estimated from it.
+*/
+func TestTieringUsage(t *testing.T) {
+	defer func() { tieringSource = nil }()
+	filesys, _ := newTestFs(t, 8)
+	measured := &TieringUsage{Time: 1700000000, FrequentBytes: 1 << 30, InfrequentBytes: 2 << 30, DeepArchiveBytes: 1 << 30}
+	var sourceErr error
+	var next *TieringUsage
+	tieringSource = func() (*TieringUsage, error) { return next, sourceErr }
+
+	next = measured
+	if err := refreshTiering(filesys); err != nil {
+		t.Fatalf("refreshTiering: %v", err)
+	}
+	next = new(TieringUsage)
+	refreshTiering(filesys)
+	sourceErr = errors.New("throttled")
+	if err := refreshTiering(filesys); err != sourceErr {
+		t.Fatalf("refreshTiering returned %v, want the error of the source", err)
+	}
+	filesys.Destroy()
+
+	cache = newCache(newMemStore(), 8)
+	super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err != nil {
+		t.Fatalf("getDataByKey for superblock: %v", err)
+	}
+	filesys, err = makeFs(super)
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	if filesys.info.Tiering != *measured {
+		t.Fatalf("the superblock has tiering usage %+v, want %+v", filesys.info.Tiering, *measured)
+	}
+
+	tiered, frequent := measured.monthlyCost()
+	wantTiered := FREQUENT_PRICE + 2*INFREQUENT_PRICE + DEEP_ARCHIVE_PRICE
+	if math.Abs(tiered-wantTiered) > 1e-9 || math.Abs(frequent-4*FREQUENT_PRICE) > 1e-9 {
+		t.Fatalf("monthly cost %f tiered and %f in the frequent tier, want %f and %f", tiered, frequent, wantTiered, 4*FREQUENT_PRICE)
+	}
+}
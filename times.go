@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// the bytes kept in a times block for each inode: its access time and then its change time, in
+// seconds since the epoch
+const TIMES_RECORD_SIZE uint64 = 16
+const TIMES_PER_BLOCK uint64 = BLOCK_SIZE / TIMES_RECORD_SIZE
+
+// the values of Atime in the config: whether reads update the access time of files always, only
+// when it is older than the last change or than RELATIME_INTERVAL (as the relatime mount option of
+// Linux does), or never. Each update is a write of the times block of the file, which reaches S3.
+const ATIME_STRICT string = "strictatime"
+const ATIME_RELATIVE string = "relatime"
+const ATIME_NONE string = "noatime"
+
+// how reads update access times, from the config
+var ATIME_MODE string = ATIME_RELATIVE
+
+// how old an access time gets before a read updates it under ATIME_RELATIVE, in seconds
+const RELATIME_INTERVAL int64 = 24 * 60 * 60
+
+// whether the mounted file system keeps the access and change time of each inode, which those
+// created before format version 10 do not, so that all three times of their files are the
+// modification time. Set by makeFs.
+var inodeTimes bool
+
+/*
+Returns an error if mode is not a value of Atime in the config.
+*/
+func checkAtimeMode(mode string) error {
+	switch mode {
+	case ATIME_STRICT, ATIME_RELATIVE, ATIME_NONE:
+		return nil
+	}
+	return fmt.Errorf("Atime must be %q, %q, or %q, not %q.", ATIME_STRICT, ATIME_RELATIVE, ATIME_NONE, mode)
+}
+
+/*
+Times block keys are of the format "HASH-timesBlockNUMBER", like those of owner blocks. Each times
+block holds the access and change times of TIMES_PER_BLOCK inodes.
+*/
+func genTimesBlockKey(inodeNum uint64) string {
+	return genRecordBlockKey("timesBlock", inodeNum, TIMES_PER_BLOCK)
+}
+
+/*
+Reads the access and change times of the inode with inodeNum into inode.
+*/
+func (i *Inode) readTimes(inodeNum uint64) error {
+	block, err := getDataByKey(genTimesBlockKey(inodeNum))
+	if err != nil {
+		return err
+	}
+	start := (inodeNum % TIMES_PER_BLOCK) * TIMES_RECORD_SIZE
+	i.Atime = int64(binary.LittleEndian.Uint64(block.Data[start : start+8]))
+	i.Ctime = int64(binary.LittleEndian.Uint64(block.Data[start+8 : start+16]))
+	i.storedTimes = [2]int64{i.Atime, i.Ctime}
+	return nil
+}
+
+/*
+Writes the access and change times of the inode with inodeNum to its times block, if the file system
+keeps them and they changed since they were read or last written. The copy of the inode in the inode
+cache is dropped, since it holds the old times.
+*/
+func (i *Inode) writeTimes(inodeNum uint64) error {
+	if !inodeTimes || i.storedTimes == [2]int64{i.Atime, i.Ctime} {
+		return nil
+	}
+	block, err := getRecordBlock(genTimesBlockKey(inodeNum), inodeNum, TIMES_PER_BLOCK)
+	if err != nil {
+		return err
+	}
+	start := (inodeNum % TIMES_PER_BLOCK) * TIMES_RECORD_SIZE
+	binary.LittleEndian.PutUint64(block.Data[start:start+8], uint64(i.Atime))
+	binary.LittleEndian.PutUint64(block.Data[start+8:start+16], uint64(i.Ctime))
+	err = putDataByKey(genTimesBlockKey(inodeNum), block)
+	if err != nil {
+		return err
+	}
+	i.storedTimes = [2]int64{i.Atime, i.Ctime}
+	inodes.invalidate(inodeNum)
+	return nil
+}
+
+/*
+Sets the change time of the inode to now, when its attributes, links, or data change. It is written
+along with the inode.
+*/
+func (i *Inode) changed() {
+	i.Ctime = time.Now().Unix()
+}
+
+/*
+Sets the access time of the inode with inodeNum to now after a read of it, as ATIME_MODE allows, and
+writes it. Under ATIME_RELATIVE, the access time is only updated if the inode was modified or
+changed since it was last accessed, or it was last accessed over RELATIME_INTERVAL ago, so that
+reading a file over and over only writes its times block once a day.
+*/
+func (i *Inode) accessed(inodeNum uint64) error {
+	if !inodeTimes || ATIME_MODE == ATIME_NONE {
+		return nil
+	}
+	now := time.Now().Unix()
+	if ATIME_MODE == ATIME_RELATIVE && i.Atime > i.UnixTime && i.Atime > i.Ctime && now-i.Atime < RELATIME_INTERVAL {
+		return nil
+	}
+	i.Atime = now
+	return i.writeTimes(inodeNum)
+}
+
+/*
+Sets the times of attr from the inode. File systems that do not keep access and change times give
+the modification time for all three, as they did before.
+*/
+func (i *Inode) attrTimes(attr *fuse.Attr) {
+	mtime := time.Unix(i.UnixTime, 0)
+	attr.Mtime = mtime
+	attr.Atime = mtime
+	attr.Ctime = mtime
+	attr.Crtime = mtime
+	if inodeTimes {
+		attr.Atime = time.Unix(i.Atime, 0)
+		attr.Ctime = time.Unix(i.Ctime, 0)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+/*
+Reads the file through a new handle and returns the access time it has afterwards, as read back
+from its times block.
+*/
+func readAndGetAtime(t *testing.T, file *File) int64 {
+	ctx := context.Background()
+	handle, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, new(fuse.OpenResponse))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := handle.(*FileHandle)
+	if err := fh.Read(ctx, &fuse.ReadRequest{Size: 10}, new(fuse.ReadResponse)); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	fh.Release(ctx, new(fuse.ReleaseRequest))
+	stored, err := getInode(file.inodeNum)
+	if err != nil {
+		t.Fatalf("getInode: %v", err)
+	}
+	return stored.Atime
+}
+
+/*
+Checks that reads update the access time of a file as ATIME_MODE allows, and that chown and links
+update its change time.
+*/
+func TestInodeTimes(t *testing.T) {
+	defer func(mode string) { ATIME_MODE = mode }(ATIME_MODE)
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	file := writeTestFile(t, root, "file", testData(100, 1), 100)
+	now := time.Now().Unix()
+	var attr fuse.Attr
+	file.Attr(ctx, &attr)
+	if attr.Ctime.Unix() < now-1 || attr.Atime.Unix() < now-1 {
+		t.Fatalf("new file has atime %v and ctime %v", attr.Atime, attr.Ctime)
+	}
+
+	// a recent access after the last change is kept under relatime
+	setTimes := func(atime, ctime, mtime int64) {
+		file.inode.Atime, file.inode.Ctime, file.inode.UnixTime = atime, ctime, mtime
+		if err := putInode(file.inode, file.inodeNum); err != nil {
+			t.Fatalf("putInode: %v", err)
+		}
+	}
+	ATIME_MODE = ATIME_RELATIVE
+	setTimes(now-10, now-20, now-20)
+	if atime := readAndGetAtime(t, file); atime != now-10 {
+		t.Fatalf("relatime updated a recent access time to %d", atime)
+	}
+	setTimes(now-2*RELATIME_INTERVAL, now-3*RELATIME_INTERVAL, now-3*RELATIME_INTERVAL)
+	if atime := readAndGetAtime(t, file); atime < now {
+		t.Fatalf("relatime kept an access time of two days ago")
+	}
+	setTimes(now-20, now-20, now-10)
+	if atime := readAndGetAtime(t, file); atime < now {
+		t.Fatalf("relatime kept an access time older than the last modification")
+	}
+	ATIME_MODE = ATIME_NONE
+	setTimes(now-2*RELATIME_INTERVAL, now-20, now-20)
+	if atime := readAndGetAtime(t, file); atime != now-2*RELATIME_INTERVAL {
+		t.Fatalf("noatime updated the access time to %d", atime)
+	}
+	ATIME_MODE = ATIME_STRICT
+	setTimes(now-10, now-20, now-20)
+	if atime := readAndGetAtime(t, file); atime < now {
+		t.Fatalf("strictatime kept the access time")
+	}
+
+	setTimes(now-10, now-100, now-100)
+	if err := file.Setattr(ctx, chownRequest(0, 1000, 100), new(fuse.SetattrResponse)); err != nil {
+		t.Fatalf("chown: %v", err)
+	}
+	if stored, _ := getInode(file.inodeNum); stored.Ctime < now || stored.UnixTime != now-100 {
+		t.Fatalf("chown left ctime %d and mtime %d", stored.Ctime, stored.UnixTime)
+	}
+	setTimes(now-10, now-100, now-100)
+	if _, err := root.Link(ctx, &fuse.LinkRequest{NewName: "link"}, file); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	if stored, _ := getInode(file.inodeNum); stored.Ctime < now {
+		t.Fatalf("link left ctime %d", stored.Ctime)
+	}
+
+	setAtime := &fuse.SetattrRequest{Valid: fuse.SetattrAtime, Atime: time.Unix(now-1000, 0)}
+	if err := file.Setattr(ctx, setAtime, new(fuse.SetattrResponse)); err != nil {
+		t.Fatalf("setting the access time: %v", err)
+	}
+	if stored, _ := getInode(file.inodeNum); stored.Atime != now-1000 {
+		t.Fatalf("access time %d after setting it to %d", stored.Atime, now-1000)
+	}
+}
+
+/*
+Checks that file systems without times blocks report the modification time as all three times and
+write no times block.
+*/
+func TestInodeTimesUnsupported(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	inodeTimes = false
+	root := testRoot(t, filesys)
+	file := writeTestFile(t, root, "file", testData(100, 1), 100)
+	readAndGetAtime(t, file)
+	var attr fuse.Attr
+	file.Attr(context.Background(), &attr)
+	if !attr.Atime.Equal(attr.Mtime) || !attr.Ctime.Equal(attr.Mtime) {
+		t.Fatalf("atime %v and ctime %v differ from mtime %v", attr.Atime, attr.Ctime, attr.Mtime)
+	}
+	var stored Inode
+	if err := stored.readTimes(file.inodeNum); err == nil && (stored.Atime != 0 || stored.Ctime != 0) {
+		t.Fatalf("the times of the file were written")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// how much of a file read-at reads from its blocks at a time
+const READ_AT_CHUNK uint64 = 1 << 20
+
+/*
+ObjectStore that reads every object as it was at a time in the past, from a store that keeps the
+earlier versions of its objects. It records the version of each object it reads, and refuses
+writes, so that a file system opened on it cannot change the objects it is reading.
+*/
+type asOfStore struct {
+	inner    VersionedStore
+	at       time.Time
+	lock     sync.Mutex
+	versions map[string]*objectVersion
+}
+
+var _ ObjectStore = (*asOfStore)(nil)
+
+/*
+Replaces the global store with one that reads every object as it was at the given time, and returns
+it. Returns an error if the store does not keep versions of its objects. Called once the backend is
+set up, before the file system is opened, so that the superblock and every inode and data block are
+read as they were then.
+*/
+func viewStoreAt(at time.Time) (*asOfStore, error) {
+	versions, ok := store.(VersionedStore)
+	if !ok {
+		return nil, errors.New("The backend does not keep earlier versions of blocks, so they cannot be read as of a time.")
+	}
+	view := &asOfStore{inner: versions, at: at, versions: make(map[string]*objectVersion)}
+	store = view
+	return view, nil
+}
+
+/*
+ObjectStore method that gets the version of the object with key that was current at the time of
+the store.
+*/
+func (s *asOfStore) GetObject(key string) ([]byte, error) {
+	data, version, err := s.inner.GetObjectAt(key, s.at)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.versions[key] = version
+	return data, nil
+}
+
+/*
+ObjectStore method that refuses to put an object, since the past cannot be changed.
+*/
+func (s *asOfStore) PutObject(key string, data []byte) error {
+	return errors.New("Cannot write block " + key + " to the file system as of " + s.at.Format(time.RFC3339) + ".")
+}
+
+/*
+ObjectStore method that refuses to delete an object, since the past cannot be changed.
+*/
+func (s *asOfStore) DeleteObject(key string) error {
+	return errors.New("Cannot delete block " + key + " from the file system as of " + s.at.Format(time.RFC3339) + ".")
+}
+
+/*
+Returns the version of the object with key that was read, or nil if it was not read.
+*/
+func (s *asOfStore) version(key string) *objectVersion {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.versions[key]
+}
+
+/*
+Returns the number of versions that were read, and the time that the latest of them was written.
+*/
+func (s *asOfStore) summary() (int, time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var latest time.Time
+	for _, version := range s.versions {
+		if version.Modified.After(latest) {
+			latest = version.Modified
+		}
+	}
+	return len(s.versions), latest
+}
+
+/*
+Returns the time given by arg, which is either a time in RFC 3339 format, such as
+"2024-05-01T12:00:00Z", or a duration such as "36h", meaning that long before now.
+*/
+func parseTimeArg(arg string, now time.Time) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, arg); err == nil {
+		return at, nil
+	}
+	ago, err := time.ParseDuration(arg)
+	if err != nil || ago < 0 {
+		return time.Time{}, errors.New("Invalid time " + arg + ": give a time such as 2024-05-01T12:00:00Z, or a duration such as 36h.")
+	}
+	return now.Add(-ago), nil
+}
+
+/*
+Writes the contents of file to w, reading READ_AT_CHUNK bytes of its blocks at a time. The file is
+read from its inode directly rather than through a handle, so that its access time is not updated.
+*/
+func writeFileData(file *File, w io.Writer) error {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	for offset := uint64(0); offset < file.inode.Size; offset += READ_AT_CHUNK {
+		data, err := file.inode.readFromData(offset, READ_AT_CHUNK)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Writes the file at a path in the file system described by the config to stdout as it was at a time
+in the past, or with -block, the block with a key, reading every block from the version that was in
+the bucket at that time. Versioning must be enabled on the bucket for earlier versions to be kept.
+Blocks that were only in the cache table of a mount at that time are read as they were last
+written back before it. The versions read are described on stderr, to help piece together what
+happened to a file, such as when it was corrupted.
+*/
+func readAtCommand(args []string) int {
+	flags := flag.NewFlagSet("read-at", flag.ContinueOnError)
+	block := flags.Bool("block", false, "read the block with the key PATH instead of a file")
+	if flags.Parse(args) != nil || flags.NArg() != 3 {
+		commandUsage("read-at")
+		flags.PrintDefaults()
+		return 2
+	}
+	at, err := parseTimeArg(flags.Arg(1), time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	config := loadConfig(flags.Arg(0))
+	if !config.Versioning {
+		fmt.Fprintln(os.Stderr, "Versioning is not set in the config, so the bucket may keep only the latest version of each block.")
+	}
+	err = initializeToolBackend(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	view, err := viewStoreAt(at)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	filesys, err := openFs()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	if filesys.info.MetadataItems {
+		// the items are kept in a DynamoDB table, which keeps no versions
+		fmt.Fprintln(os.Stderr, "The inodes of the file system are kept as items of MetadataStore, which have no earlier versions.")
+		return 1
+	}
+	if *block {
+		key := flags.Arg(2)
+		data, err := store.GetObject(key)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		os.Stdout.Write(data)
+		version := view.version(key)
+		fmt.Fprintf(os.Stderr, "Read version %s of block %s, written at %s.\n", version.ID, key,
+			version.Modified.Format(time.RFC3339))
+		return 0
+	}
+	p := path.Clean("/" + flags.Arg(2))
+	node, err := lookupNode(filesys, p)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not find "+p+" as of "+at.Format(time.RFC3339)+": "+err.Error())
+		return 1
+	}
+	file, ok := node.(*File)
+	if !ok {
+		fmt.Fprintln(os.Stderr, p+" was a directory as of "+at.Format(time.RFC3339)+".")
+		return 1
+	}
+	err = writeFileData(file, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	count, latest := view.summary()
+	fmt.Fprintf(os.Stderr, "Read %d blocks as of %s, the latest of them written at %s.\n", count,
+		at.Format(time.RFC3339), latest.Format(time.RFC3339))
+	return 0
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"errors"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+/*
+ObjectStore backed by memory that keeps every version of its objects, as a versioned bucket does,
+each written at the time now is set to.
+*/
+type versionedMemStore struct {
+	*MemStore
+	now     time.Time
+	history map[string][]memVersion
+}
+
+/*
+Struct holding a version of an object of a versionedMemStore.
+*/
+type memVersion struct {
+	data     []byte
+	deleted  bool
+	modified time.Time
+}
+
+/*
+Puts an object and records it as a new version.
+*/
+func (s *versionedMemStore) PutObject(key string, data []byte) error {
+	s.history[key] = append(s.history[key], memVersion{data: append([]byte(nil), data...), modified: s.now})
+	return s.MemStore.PutObject(key, data)
+}
+
+/*
+Deletes an object and records a delete marker.
+*/
+func (s *versionedMemStore) DeleteObject(key string) error {
+	s.history[key] = append(s.history[key], memVersion{deleted: true, modified: s.now})
+	return s.MemStore.DeleteObject(key)
+}
+
+/*
+Gets the last version of an object written no later than at.
+*/
+func (s *versionedMemStore) GetObjectAt(key string, at time.Time) ([]byte, *objectVersion, error) {
+	var current *memVersion
+	for i, version := range s.history[key] {
+		if !version.modified.After(at) {
+			current = &s.history[key][i]
+		}
+	}
+	if current == nil || current.deleted {
+		return nil, nil, errors.New("no version of " + key)
+	}
+	return current.data, &objectVersion{ID: current.modified.String(), Modified: current.modified}, nil
+}
+
+/*
+Checks that a file system opened on the versions of its blocks at a time reads files as they were
+then, including files removed since, and that it cannot be written.
+*/
+func TestReadAt(t *testing.T) {
+	filesys, objects := newTestFs(t, 64)
+	versions := &versionedMemStore{MemStore: objects, history: make(map[string][]memVersion)}
+	store = versions
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	versions.now = start
+	first := testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 1)
+	writeTestFile(t, testRoot(t, filesys), "file", first, 1<<16)
+	filesys.Destroy()
+
+	versions.now = start.Add(time.Hour)
+	cache = newCache(newMemStore(), 64)
+	super, err := getDataByKey(S3_SUPERBLOCK_NAME + "0")
+	if err != nil {
+		t.Fatalf("getDataByKey for superblock: %v", err)
+	}
+	filesys, err = makeFs(super)
+	if err != nil {
+		t.Fatalf("makeFs: %v", err)
+	}
+	root := testRoot(t, filesys)
+	if err := root.Remove(context.Background(), &fuse.RemoveRequest{Name: "file"}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	second := testData(int(INODE_BUFFER_SIZE+2*BLOCK_SIZE), 2)
+	writeTestFile(t, root, "later", second, 1<<16)
+	filesys.Destroy()
+
+	for _, c := range []struct {
+		at      time.Time
+		present string
+		absent  string
+		want    []byte
+	}{
+		{start.Add(time.Minute), "/file", "/later", first},
+		{start.Add(2 * time.Hour), "/later", "/file", second},
+	} {
+		store = versions
+		cache = newCache(newMemStore(), 64)
+		view, err := viewStoreAt(c.at)
+		if err != nil {
+			t.Fatalf("viewStoreAt: %v", err)
+		}
+		filesys, err := openFs()
+		if err != nil {
+			t.Fatalf("opening the file system as of %s: %v", c.at, err)
+		}
+		node, err := lookupNode(filesys, c.present)
+		if err != nil {
+			t.Fatalf("looking up %s as of %s: %v", c.present, c.at, err)
+		}
+		var out bytes.Buffer
+		err = writeFileData(node.(*File), &out)
+		if err != nil || !bytes.Equal(out.Bytes(), c.want) {
+			t.Fatalf("%s as of %s differs from what was written then: %v", c.present, c.at, err)
+		}
+		if _, err := lookupNode(filesys, c.absent); err != fuse.ENOENT {
+			t.Fatalf("looking up %s as of %s returned %v", c.absent, c.at, err)
+		}
+		if view.PutObject("x", []byte("x")) == nil || view.DeleteObject(S3_SUPERBLOCK_NAME+"0") == nil {
+			t.Fatalf("the file system as of %s can be changed", c.at)
+		}
+		if version := view.version(S3_SUPERBLOCK_NAME + "0"); version == nil || version.Modified.After(c.at) {
+			t.Fatalf("the superblock as of %s was read from version %+v", c.at, version)
+		}
+	}
+
+	store = versions
+	if _, err := viewStoreAt(start.Add(-time.Minute)); err != nil {
+		t.Fatalf("viewStoreAt: %v", err)
+	}
+	if _, err := openFs(); err == nil {
+		t.Fatalf("opened the file system before it was written")
+	}
+	if at, err := parseTimeArg("36h", start); err != nil || !at.Equal(start.Add(-36*time.Hour)) {
+		t.Fatalf("parseTimeArg of a duration returned %s, %v", at, err)
+	}
+}
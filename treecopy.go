@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/context"
+	"os"
+	"path"
+	"strings"
+)
+
+/*
+Struct counting what cloneTree copied.
+*/
+type copyStats struct {
+	Files        int
+	Dirs         int
+	Bytes        uint64
+	CopiedBlocks int // data blocks copied by the store itself, without being downloaded
+	ReadBlocks   int // data and indirect blocks that had to be read and written again
+}
+
+/*
+Copies the file or directory at src to dst, like cp -r: if dst is a directory, the copy is made in
+it under the name of src. Directories are only copied if recursive is set.
+
+Files are copied through the metadata: each new inode gets the size, buffer, and a copy of each
+block of its source, and the data blocks are copied by the store (server-side in S3) rather than
+being read and written again, unless the blocks are encrypted per file or with the key they are
+stored under, or are in the cache and may be newer than the stored copy. Blocks cannot be shared
+between files, since deleting a file deletes its blocks.
+*/
+func cloneTree(filesys *FS, src, dst string, recursive bool) (*copyStats, error) {
+	src = path.Clean("/" + src)
+	dst = path.Clean("/" + dst)
+	srcNode, err := lookupNode(filesys, src)
+	if err != nil {
+		return nil, errors.New(src + ": " + err.Error())
+	}
+	if _, isDir := srcNode.(*Dir); isDir && !recursive {
+		return nil, errors.New(src + " is a directory (use -r to copy it)")
+	}
+	target := dst
+	dstNode, err := lookupNode(filesys, dst)
+	if err == nil {
+		if _, isDir := dstNode.(*Dir); !isDir || src == "/" {
+			return nil, errors.New(dst + " already exists")
+		}
+		target = path.Join(dst, path.Base(src))
+		if _, err := lookupNode(filesys, target); err == nil {
+			return nil, errors.New(target + " already exists")
+		}
+	}
+	if _, isDir := srcNode.(*Dir); isDir && (src == "/" || target == src || strings.HasPrefix(target, src+"/")) {
+		return nil, errors.New("cannot copy " + src + " into itself")
+	}
+	parentNode, err := lookupNode(filesys, path.Dir(target))
+	if err != nil {
+		return nil, errors.New(path.Dir(target) + ": " + err.Error())
+	}
+	parent, ok := parentNode.(*Dir)
+	if !ok {
+		return nil, errors.New(path.Dir(target) + " is not a directory")
+	}
+	stats := new(copyStats)
+	return stats, copyNode(parent, path.Base(target), srcNode, stats)
+}
+
+/*
+Returns the header of the requests made by the cp command, as the user running it.
+*/
+func copyHeader() fuse.Header {
+	return fuse.Header{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid()), Pid: uint32(os.Getpid())}
+}
+
+/*
+Copies the file or directory node to name in parent, and everything under it.
+*/
+func copyNode(parent *Dir, name string, node fs.Node, stats *copyStats) error {
+	ctx := context.Background()
+	switch node := node.(type) {
+	case *Dir:
+		newNode, err := parent.Mkdir(ctx, &fuse.MkdirRequest{Header: copyHeader(), Name: name})
+		if err != nil {
+			return errors.New(path.Join(parent.path, name) + ": " + err.Error())
+		}
+		stats.Dirs++
+		// the names are read first, since Lookup takes fsLock
+		var names []string
+		fsLock.Lock()
+		err = forEachEntry(node.inodeNum, node.inode, func(childName string, childNum uint64) error {
+			names = append(names, childName)
+			return nil
+		})
+		fsLock.Unlock()
+		if err != nil {
+			return errors.New(node.path + ": " + err.Error())
+		}
+		for _, childName := range names {
+			child, err := node.lookup(ctx, childName)
+			if err != nil {
+				return errors.New(path.Join(node.path, childName) + ": " + err.Error())
+			}
+			err = copyNode(newNode.(*Dir), childName, child, stats)
+			if err != nil {
+				return err
+			}
+		}
+	case *File:
+		newNode, handle, err := parent.Create(ctx, &fuse.CreateRequest{Header: copyHeader(), Name: name}, new(fuse.CreateResponse))
+		if err != nil {
+			return errors.New(path.Join(parent.path, name) + ": " + err.Error())
+		}
+		fh := handle.(*FileHandle)
+		// this writes the new, empty inode, which the copy then replaces
+		err = fh.Release(ctx, new(fuse.ReleaseRequest))
+		if err == nil {
+			err = copyFileData(node.inodeNum, newNode.(*File).inodeNum, fh.appendOnly, stats)
+		}
+		if err != nil {
+			return errors.New(node.path + ": " + err.Error())
+		}
+		stats.Files++
+	}
+	return nil
+}
+
+/*
+Gives the inode with dstNum a copy of the data of the inode with srcNum. The blocks of files under
+append-only directories are locked, as if they had been written there.
+*/
+func copyFileData(srcNum, dstNum uint64, appendOnly bool, stats *copyStats) error {
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	if appendOnly && objectLockEnabled() {
+		lockingWrites = true
+		defer func() { lockingWrites = false }()
+	}
+	src, err := getInode(srcNum)
+	if err != nil {
+		return err
+	}
+	dst, err := getInode(dstNum)
+	if err != nil {
+		return err
+	}
+	dst.Size = src.Size
+	dst.DataBuf = src.DataBuf
+	dst.Data = src.Data
+	err = dst.cloneBlocks(stats)
+	if err != nil {
+		return err
+	}
+	stats.Bytes += dst.Size
+	return putInode(dst, dstNum)
+}
+
+/*
+Replaces every data and indirect block the inode uses with a copy, so that the inode no longer
+shares any block with the inode it was copied from. Holes stay holes. Mirrors forEachBlock.
+*/
+func (i *Inode) cloneBlocks(stats *copyStats) error {
+	i.usedBlocksKnown = false
+	numBlocks := i.numDataBlocks()
+	var err error
+	var j uint64
+	for j = 0; j < NUM_DATA_BLOCKS && numBlocks > 0; j++ {
+		i.Data[j], err = cloneDataBlock(i.Data[j], stats)
+		if err != nil {
+			return err
+		}
+		numBlocks--
+	}
+	for depth, index := range []uint8{IND_BLOCK, DOUB_IND_BLOCK, TRIP_IND_BLOCK} {
+		if numBlocks == 0 {
+			break
+		}
+		i.Data[index], err = cloneIndirect(i.Data[index], depth+1, &numBlocks, stats)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Copies an indirect block with the given depth (1 for singly indirect) and the blocks below it,
+until numBlocks data blocks have been copied, returning the number of the copy.
+*/
+func cloneIndirect(indBlockNum uint64, depth int, numBlocks *uint64, stats *copyStats) (uint64, error) {
+	if indBlockNum == 0 {
+		*numBlocks -= minUint64(indirectSpan(depth), *numBlocks)
+		return 0, nil
+	}
+	indBlock, err := getData(indBlockNum)
+	if err != nil {
+		return 0, err
+	}
+	var j uint64
+	for j = 0; j < BLOCK_SIZE && *numBlocks > 0; j = j + 8 {
+		blockNum := binary.LittleEndian.Uint64(indBlock.Data[j : j+8])
+		if depth == 1 {
+			blockNum, err = cloneDataBlock(blockNum, stats)
+			*numBlocks--
+		} else {
+			blockNum, err = cloneIndirect(blockNum, depth-1, numBlocks, stats)
+		}
+		if err != nil {
+			return 0, err
+		}
+		binary.LittleEndian.PutUint64(indBlock.Data[j:j+8], blockNum)
+	}
+	newNum := dataStream.next()
+	stats.ReadBlocks++
+	return newNum, putData(newNum, indBlock)
+}
+
+/*
+Copies the data block with blockNum to a new block, along with its hash, and returns the number of
+the copy, or 0 for a hole. The store copies the block itself when it can.
+*/
+func cloneDataBlock(blockNum uint64, stats *copyStats) (uint64, error) {
+	if blockNum == 0 {
+		return 0, nil
+	}
+	newNum := dataStream.next()
+	srcKey := genDataKey(blockNum)
+	dstKey := genDataKey(newNum)
+	copier, canCopy := store.(CopyingStore)
+	if canCopy && fileKeys == nil && cache.keyHash[srcKey] == nil {
+		err := copier.CopyObject(srcKey, dstKey)
+		if err == nil && lockingWrites {
+			err = lockBlock(dstKey)
+		}
+		if err != nil {
+			return 0, err
+		}
+		sum, err := getBlockHash(blockNum)
+		if err != nil {
+			return 0, err
+		}
+		stats.CopiedBlocks++
+		return newNum, storeBlockHash(newNum, sum)
+	}
+	data, err := getData(blockNum)
+	if err != nil {
+		return 0, err
+	}
+	err = putData(newNum, data)
+	if err == nil {
+		err = setBlockHash(newNum, data)
+	}
+	stats.ReadBlocks++
+	return newNum, err
+}
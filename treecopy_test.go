@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Copies a directory tree holding files up to past the singly indirect block, and checks that the
+copy has the same data, shares no block with the source (so that fsck finds no problem and removing
+the source leaves the copy intact), and that the data blocks were copied by the store.
+*/
+func TestCloneTree(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, _ := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "src"})
+	src := node.(*Dir)
+	node, _ = src.Mkdir(ctx, &fuse.MkdirRequest{Name: "sub"})
+	sub := node.(*Dir)
+	files := map[string][]byte{
+		"/src/big":       testData(int(FIRST_SINGLY_INDIRECT_BYTE+3*BLOCK_SIZE), 1),
+		"/src/sub/small": testData(100, 2),
+		"/src/sub/empty": nil,
+	}
+	writeTestFile(t, src, "big", files["/src/big"], 1<<16)
+	writeTestFile(t, sub, "small", files["/src/sub/small"], 100)
+	writeTestFile(t, sub, "empty", nil, 1)
+	// as in the cp command, the blocks are in the store and the cache starts empty
+	cache.empty()
+	cache = newCache(newMemStore(), 16)
+
+	if _, err := cloneTree(filesys, "/src", "/dst", false); err == nil {
+		t.Fatalf("copied a directory without recursive")
+	}
+	if _, err := cloneTree(filesys, "/src", "/src/sub", true); err == nil {
+		t.Fatalf("copied a directory into itself")
+	}
+	stats, err := cloneTree(filesys, "/src", "/dst", true)
+	if err != nil {
+		t.Fatalf("cloneTree: %v", err)
+	}
+	if stats.Files != 3 || stats.Dirs != 2 || stats.CopiedBlocks != int(NUM_DATA_BLOCKS)+3 || stats.ReadBlocks != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if _, err := cloneTree(filesys, "/src/big", "/dst/big", false); err == nil {
+		t.Fatalf("copied over an existing file")
+	}
+	// a directory as the destination gets the copy under the name of the source
+	if _, err := cloneTree(filesys, "/src/sub/small", "/dst", false); err != nil {
+		t.Fatalf("cloneTree of a file into a directory: %v", err)
+	}
+	files["/dst/small"] = files["/src/sub/small"]
+
+	report := fsck(filesys)
+	if len(report.problems) != 0 {
+		t.Fatalf("fsck found problems after copying: %v", report.problems)
+	}
+	srcNode, _ := root.lookup(ctx, "src")
+	srcNode.(*Dir).Remove(ctx, &fuse.RemoveRequest{Name: "big"})
+	for p, data := range files {
+		if p[:5] == "/src/" {
+			p = "/dst/" + p[5:]
+		}
+		node, err := lookupNode(filesys, p)
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		inode := node.(*File).inode
+		got, err := inode.readFromData(0, inode.Size)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: read %d bytes, err %v, want the %d of the source", p, len(got), err, len(data))
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"encoding/binary"
+	"golang.org/x/net/context"
+	"syscall"
+)
+
+var _ = fs.NodeSetattrer(&File{})
+
+/*
+FUSE method that changes the size, modified time, or access time of the file, as truncate(2),
+ftruncate(2), opening with O_TRUNC, and utimes(2) do, or its owner, as chown(2) does. Files under append-only directories can
+only be extended, and files open for writing through another lookup of them cannot be shrunk.
+*/
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	defer trackOp("Setattr")()
+	defer recoverPanic("Setattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Setattr")()
+	debugOp(f.path, "Setattr", "inode=%d valid=%v size=%d uid=%d gid=%d", f.inodeNum, req.Valid, req.Size, req.Uid, req.Gid)
+	err := checkGeneration(f.inode.Generation, f.inodeNum)
+	if err != nil {
+		return err
+	}
+	// the owner is not in the inode, so it is stored first, and kept when the inode is
+	err = chown(f.inode, f.inodeNum, f.path, req)
+	if err != nil {
+		return err
+	}
+	if !req.Valid.Size() && !req.Valid.Mtime() && !req.Valid.Atime() {
+		return nil
+	}
+	err = checkDirWritable(f.dirNum, req.Valid.Size() && req.Size >= f.inode.Size)
+	if err != nil {
+		return err
+	}
+	err = checkStoreWritable()
+	if err != nil {
+		return err
+	}
+	if req.Valid.Size() && req.Size != f.inode.Size {
+		if f.inode.isSymlink() || f.inode.isSpecial() {
+			return fuse.EPERM
+		}
+		if req.Size < f.inode.Size && openFiles.otherWriters(f.inodeNum, f.inode) {
+			// they would write back the blocks freed as part of the file
+			return fuse.Errno(syscall.EBUSY)
+		}
+		err = f.inode.truncate(req.Size)
+		if err != nil {
+			return err
+		}
+	}
+	if req.Valid.Mtime() {
+		f.inode.UnixTime = req.Mtime.Unix()
+	}
+	if req.Valid.Atime() {
+		f.inode.Atime = req.Atime.Unix()
+	}
+	f.inode.changed()
+	err = storeFileInode(f.inode, f.inodeNum)
+	if err == nil && req.Valid.Size() {
+		notifyChange("modify", f.path, "", false)
+	}
+	return err
+}
+
+/*
+Empties the file at p being opened for writing with O_TRUNC, which the kernel leaves to the open
+rather than sending a Setattr for when the truncation is atomic. The same checks are made as for
+truncating it with Setattr: files under append-only directories cannot be emptied, nor files open
+for writing through another lookup of them. Must be called before the handle being opened is added
+to openFiles.
+*/
+func truncateOnOpen(flags fuse.OpenFlags, inode *Inode, inodeNum uint64, p string, appendOnly bool) error {
+	if flags&fuse.OpenTruncate == 0 || flags.IsReadOnly() || inode.Size == 0 {
+		return nil
+	}
+	if appendOnly {
+		return fuse.EPERM
+	}
+	if openFiles.otherWriters(inodeNum, inode) {
+		return fuse.Errno(syscall.EBUSY)
+	}
+	err := checkStoreWritable()
+	if err != nil {
+		return err
+	}
+	err = inode.truncate(0)
+	if err != nil {
+		return err
+	}
+	inode.modified()
+	err = storeFileInode(inode, inodeNum)
+	if err == nil {
+		notifyChange("modify", p, "", false)
+	}
+	return err
+}
+
+/*
+Sets the size of the inode's data to size. Extending it leaves a hole past the old end, which reads
+as zeros without any block being written for it, beyond zeroing the rest of the block (or inode
+buffer) holding the old end. Shrinking it zeros the rest of the block holding the new end, so that
+a later extension reads zeros there, and frees the blocks past it.
+*/
+func (i *Inode) truncate(size uint64) error {
+	if size > i.Size {
+		end := minUint64(blockEnd(i.Size), size)
+		if end > i.Size {
+			i.writeToData(make([]byte, end-i.Size), i.Size)
+		}
+		i.updateSize(size)
+		return nil
+	}
+	end := minUint64(blockEnd(size), i.Size)
+	if end > size {
+		i.writeToData(make([]byte, end-size), size)
+	}
+	keep := uint64(0)
+	if size > INODE_BUFFER_SIZE {
+		keep = (size - INODE_BUFFER_SIZE + BLOCK_SIZE - 1) / BLOCK_SIZE
+	}
+	err := i.truncateBlocks(keep)
+	i.updateSize(size)
+	return err
+}
+
+/*
+Frees the data blocks of the inode past the first keep, along with the indirect blocks that no
+longer point to any, clearing the pointers to them so that writes past keep allocate new blocks.
+*/
+func (i *Inode) truncateBlocks(keep uint64) error {
+	i.usedBlocksKnown = false
+	have := i.numDataBlocks()
+	var j uint64
+	for j = keep; j < NUM_DATA_BLOCKS && j < have; j++ {
+		if i.Data[j] != 0 {
+			err := deleteBlock(i.Data[j])
+			if err != nil {
+				return err
+			}
+		}
+		i.Data[j] = 0
+	}
+	start := NUM_DATA_BLOCKS
+	span := BLOCK_POINTERS
+	for depth, slot := range []uint8{IND_BLOCK, DOUB_IND_BLOCK, TRIP_IND_BLOCK} {
+		if start >= have {
+			break
+		}
+		slotHave := minUint64(span, have-start)
+		var slotKeep uint64
+		if keep > start {
+			slotKeep = minUint64(keep-start, span)
+		}
+		if slotKeep < slotHave && i.Data[slot] != 0 {
+			blockNum, err := i.truncateIndirect(i.Data[slot], depth+1, slotKeep, slotHave, span)
+			if err != nil {
+				return err
+			}
+			i.Data[slot] = blockNum
+		}
+		start += span
+		span *= BLOCK_POINTERS
+	}
+	return nil
+}
+
+/*
+Frees the data blocks under the indirect block indBlockNum of the given depth (1 for singly
+indirect), which covers span data blocks of which the first have are used, past the first keep of
+them. Returns the number of the indirect block, or 0 if it was freed too since keep is 0. Holes,
+where no block was ever written, are passed over.
+*/
+func (i *Inode) truncateIndirect(indBlockNum uint64, depth int, keep, have, span uint64) (uint64, error) {
+	indBlock, err := getData(indBlockNum)
+	if err != nil {
+		return indBlockNum, err
+	}
+	childSpan := span / BLOCK_POINTERS
+	for start, j := uint64(0), uint64(0); start < have; start, j = start+childSpan, j+8 {
+		childHave := minUint64(childSpan, have-start)
+		var childKeep uint64
+		if keep > start {
+			childKeep = minUint64(keep-start, childSpan)
+		}
+		child := binary.LittleEndian.Uint64(indBlock.Data[j : j+8])
+		if childKeep >= childHave || child == 0 {
+			continue
+		}
+		if depth == 1 {
+			err = deleteBlock(child)
+			child = 0
+		} else {
+			child, err = i.truncateIndirect(child, depth-1, childKeep, childHave, childSpan)
+		}
+		if err != nil {
+			return indBlockNum, err
+		}
+		binary.LittleEndian.PutUint64(indBlock.Data[j:j+8], child)
+	}
+	if keep == 0 {
+		return 0, deleteBlock(indBlockNum)
+	}
+	return indBlockNum, putData(indBlockNum, indBlock)
+}
+
+/*
+Returns the end of the inode buffer or data block that holds the last byte of data of length
+offset, which is offset itself if that byte is the last of its block.
+*/
+func blockEnd(offset uint64) uint64 {
+	if offset <= INODE_BUFFER_SIZE {
+		return INODE_BUFFER_SIZE
+	}
+	return INODE_BUFFER_SIZE + (offset-INODE_BUFFER_SIZE+BLOCK_SIZE-1)/BLOCK_SIZE*BLOCK_SIZE
+}
+
+/*
+Returns the smaller of a and b.
+*/
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bytes"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+/*
+Returns the numbers of the data and indirect blocks of the inode.
+*/
+func inodeBlocks(t *testing.T, inode *Inode) []uint64 {
+	t.Helper()
+	var blocks []uint64
+	err := inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		blocks = append(blocks, blockNum)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("forEachBlock: %v", err)
+	}
+	return blocks
+}
+
+/*
+Checks that shrinking a file with Setattr frees the blocks past its new end, that extending it reads
+zeros past the old end, and that the modified time can be set.
+*/
+func TestSetattrSize(t *testing.T) {
+	filesys, objects := newTestFs(t, 8)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	data := testData(int(INODE_BUFFER_SIZE+20*BLOCK_SIZE), 1)
+	file := writeTestFile(t, root, "file", data, 1<<16)
+	before := inodeBlocks(t, file.inode)
+
+	shrunk := INODE_BUFFER_SIZE + 5*BLOCK_SIZE + 100
+	err := file.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: shrunk}, new(fuse.SetattrResponse))
+	if err != nil {
+		t.Fatalf("Setattr: %v", err)
+	}
+	after := inodeBlocks(t, file.inode)
+	if len(after) != 6 || file.inode.Data[IND_BLOCK] != 0 {
+		t.Fatalf("%d blocks left after shrinking to 6 blocks", len(after))
+	}
+	for _, blockNum := range before[6:] {
+		key := genDataKey(blockNum)
+		if cache.keyHash[key] != nil || objects.items[key] != nil {
+			t.Fatalf("block %d past the new end is still stored", blockNum)
+		}
+	}
+	checkFileData(t, root, "file", data[:shrunk])
+
+	extended := INODE_BUFFER_SIZE + 8*BLOCK_SIZE
+	err = file.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: extended}, new(fuse.SetattrResponse))
+	if err != nil {
+		t.Fatalf("Setattr: %v", err)
+	}
+	checkFileData(t, root, "file", append(append([]byte(nil), data[:shrunk]...), make([]byte, extended-shrunk)...))
+
+	mtime := time.Unix(1500000000, 0)
+	file.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrMtime, Mtime: mtime}, new(fuse.SetattrResponse))
+	if inode, _ := getInode(file.inodeNum); inode.UnixTime != mtime.Unix() {
+		t.Fatalf("stored mtime is %d", inode.UnixTime)
+	}
+	err = file.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 0}, new(fuse.SetattrResponse))
+	if err != nil || len(inodeBlocks(t, file.inode)) != 0 {
+		t.Fatalf("truncating to 0 left %d blocks, err %v", len(inodeBlocks(t, file.inode)), err)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 || report.bytes != 0 {
+		t.Fatalf("fsck: %+v", report)
+	}
+}
+
+/*
+Checks that opening a file for writing with O_TRUNC, through Open or through Create of an existing
+name, empties it and frees its blocks, and that opening it without O_TRUNC or only for reading keeps
+its data.
+*/
+func TestOpenTruncate(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	data := testData(int(INODE_BUFFER_SIZE+3*BLOCK_SIZE), 1)
+	file := writeTestFile(t, root, "file", data, len(data))
+
+	for _, flags := range []fuse.OpenFlags{fuse.OpenWriteOnly, fuse.OpenReadOnly | fuse.OpenTruncate} {
+		handle, err := file.Open(ctx, &fuse.OpenRequest{Flags: flags}, new(fuse.OpenResponse))
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		handle.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+		checkFileData(t, root, "file", data)
+	}
+
+	handle, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly | fuse.OpenTruncate}, new(fuse.OpenResponse))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	handle.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	if file.inode.Size != 0 || len(inodeBlocks(t, file.inode)) != 0 {
+		t.Fatalf("opening with O_TRUNC left size %d and blocks %v", file.inode.Size, inodeBlocks(t, file.inode))
+	}
+	checkFileData(t, root, "file", nil)
+
+	writeTestFile(t, root, "created", data, len(data))
+	node, handle, err := root.Create(ctx, &fuse.CreateRequest{Name: "created", Flags: fuse.OpenReadWrite | fuse.OpenTruncate}, new(fuse.CreateResponse))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	handle.(*FileHandle).Release(ctx, new(fuse.ReleaseRequest))
+	if created := node.(*File); created.inode.Size != 0 || len(inodeBlocks(t, created.inode)) != 0 {
+		t.Fatalf("creating an existing file with O_TRUNC left size %d", created.inode.Size)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Fatalf("fsck: %+v", report.problems)
+	}
+}
+
+/*
+Checks that truncating a sparse file frees the indirect blocks past the new end, passing over the
+holes under them.
+*/
+func TestTruncateSparse(t *testing.T) {
+	newTestFs(t, 16)
+	inode := createInode(0)
+	inode.init(ROOT_INODE, 2)
+	tail := testData(100, 1)
+	inode.writeToData(tail, FIRST_DOUBLY_INDIRECT_BYTE+IND_BLOCK_SIZE+10)
+	inode.writeToData(tail, FIRST_TRIPLY_INDIRECT_BYTE+10)
+	inode.writeToData(tail, FIRST_SINGLY_INDIRECT_BYTE)
+
+	err := inode.truncate(FIRST_DOUBLY_INDIRECT_BYTE + IND_BLOCK_SIZE + 50)
+	if err != nil || inode.Data[TRIP_IND_BLOCK] != 0 || inode.Data[DOUB_IND_BLOCK] == 0 {
+		t.Fatalf("truncating into the doubly indirect block left pointers %v, err %v", inode.Data, err)
+	}
+	got, _ := inode.readFromData(FIRST_DOUBLY_INDIRECT_BYTE+IND_BLOCK_SIZE, 100)
+	if len(got) != 50 || !bytes.Equal(got[10:], tail[:40]) {
+		t.Fatalf("the kept end of the data is %v", got)
+	}
+	if err := inode.truncate(FIRST_SINGLY_INDIRECT_BYTE + 100); err != nil || inode.Data[DOUB_IND_BLOCK] != 0 {
+		t.Fatalf("truncating into the singly indirect block left pointers %v, err %v", inode.Data, err)
+	}
+	if err := inode.truncate(0); err != nil || inode.Data != [NUM_DATA_BLOCKS + 3]uint64{} {
+		t.Fatalf("truncating to 0 left pointers %v, err %v", inode.Data, err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+/*
+Struct holding the results of verifying the blocks of a file system.
+*/
+type verifyReport struct {
+	inodes   int
+	objects  int
+	problems []string
+}
+
+/*
+Struct holding the state of a running verify.
+*/
+type verifier struct {
+	report  *verifyReport
+	checked map[string]error // result of reading each object, so objects shared by several inodes are read once
+	visited map[uint64]bool
+}
+
+/*
+Gets the object with key from store, checked against the store's checksum if it keeps one.
+*/
+func verifyObject(store ObjectStore, key string) ([]byte, error) {
+	if verifying, ok := store.(VerifyingStore); ok {
+		return verifying.VerifyObject(key)
+	}
+	return store.GetObject(key)
+}
+
+/*
+Reads every object holding the inodes and blocks of the file or directory at path p and everything
+below it directly from the store, reporting each object that cannot be read, fails its checksum or
+decryption, or is not the size of a block, along with the paths of the files it belongs to. Like fsck,
+the file system should not be mounted, and changes since the last clean unmount are not seen.
+*/
+func verify(filesys *FS, p string) (*verifyReport, error) {
+	v := &verifier{
+		report:  new(verifyReport),
+		checked: make(map[string]error),
+		visited: make(map[uint64]bool),
+	}
+	p = path.Clean("/" + p)
+	inodeNum, err := lookupPath(filesys, p)
+	if err != nil {
+		return nil, err
+	}
+	v.verifyInode(inodeNum, p)
+	return v.report, nil
+}
+
+/*
+Returns the number of the inode at path p, which must be absolute and clean.
+*/
+func lookupPath(filesys *FS, p string) (uint64, error) {
+	inodeNum := filesys.rootInode
+	if p == "/" {
+		return inodeNum, nil
+	}
+	for _, name := range strings.Split(p[1:], "/") {
+		inode, err := getInode(inodeNum)
+		if err != nil {
+			return 0, err
+		}
+		if !inode.isDir() {
+			return 0, errors.New(p + ": not a directory")
+		}
+		inodeNum, err = lookupEntry(inodeNum, inode, name)
+		if err != nil {
+			return 0, err
+		}
+		if inodeNum == INVALID_INODE {
+			return 0, errors.New(p + ": no such file or directory")
+		}
+	}
+	return inodeNum, nil
+}
+
+/*
+Reads the object with key from the store, recording a problem at path p if it is unreadable or
+corrupt. Returns the error, which is remembered so each object is only read once.
+*/
+func (v *verifier) checkObject(key string, what string, p string) error {
+	err, ok := v.checked[key]
+	if !ok {
+		var data []byte
+		data, err = verifyObject(store, key)
+		if err == nil && uint64(len(data)) != BLOCK_SIZE {
+			err = fmt.Errorf("object has size %d, not the size of a block", len(data))
+		}
+		v.checked[key] = err
+		v.report.objects++
+	}
+	if err != nil {
+		v.problem(p, "%s (%s): %v", what, key, err)
+	}
+	return err
+}
+
+/*
+Records a problem found at the given path.
+*/
+func (v *verifier) problem(p string, format string, args ...interface{}) {
+	v.report.problems = append(v.report.problems, p+": "+fmt.Sprintf(format, args...))
+}
+
+/*
+Verifies the objects of the inode with number inodeNum found at path p, and of everything below it.
+*/
+func (v *verifier) verifyInode(inodeNum uint64, p string) {
+	if v.visited[inodeNum] {
+		return
+	}
+	v.visited[inodeNum] = true
+	v.report.inodes++
+	if metadataStore == nil {
+		// inodes kept as items are in DynamoDB, not in objects
+		err := v.checkObject(genInodeBlockKey(inodeNum), fmt.Sprintf("inode %d", inodeNum), p)
+		if err != nil {
+			return
+		}
+	}
+	inode, err := getInode(inodeNum)
+	if err != nil {
+		v.problem(p, "cannot decode inode %d: %v", inodeNum, err)
+		return
+	}
+	var indirectErr error
+	err = inode.forEachBlock(func(blockNum uint64, indirect bool) error {
+		if indirect {
+			// forEachBlock stops if an indirect block is unreadable, as the blocks it points to cannot be found
+			indirectErr = v.checkObject(genDataKey(blockNum), fmt.Sprintf("indirect block %d", blockNum), p)
+			return indirectErr
+		}
+		err := v.checkObject(genDataKey(blockNum), fmt.Sprintf("block %d", blockNum), p)
+		if err == nil && fileKeys != nil {
+			_, err = fileKeys.getSalt(DATA_KEY_KIND, blockNum)
+			if err != nil {
+				v.problem(p, "block %d: %v", blockNum, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if err != indirectErr {
+			v.problem(p, "cannot read indirect block: %v", err)
+		}
+		return
+	}
+	if !inode.isDir() {
+		return
+	}
+	err = forEachEntry(inodeNum, inode, func(name string, childNum uint64) error {
+		v.verifyInode(childNum, path.Join(p, name))
+		return nil
+	})
+	if err != nil {
+		v.problem(p, "cannot read directory: %v", err)
+	}
+}
+
+/*
+Prints the results of a verify, returning true if no problems were found.
+*/
+func printVerifyReport(report *verifyReport) bool {
+	for _, problem := range report.problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d files and directories, %d objects read\n", report.inodes, report.objects)
+	if len(report.problems) > 0 {
+		fmt.Printf("%d problems found\n", len(report.problems))
+		return false
+	}
+	fmt.Println("all objects verified")
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+)
+
+/*
+Writes a directory holding two files to the file system, unmounts it, and mounts it again from
+objects with an empty cache, so that every block is read from the store.
+*/
+func writeVerifyTestFs(t *testing.T, filesys *FS, objects *MemStore) *FS {
+	t.Helper()
+	ctx := context.Background()
+	root := testRoot(t, filesys)
+	node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	for i, name := range []string{"a", "b"} {
+		err = crashWriteFile(ctx, node.(*Dir), name, testData(100*1000, int64(i)))
+		if err != nil {
+			t.Fatalf("writing %s: %v", name, err)
+		}
+	}
+	filesys.Destroy()
+	store = objects
+	cache = newCache(newMemStore(), TOOL_CACHE_SIZE)
+	remounted, err := openFs()
+	if err != nil {
+		t.Fatalf("openFs: %v", err)
+	}
+	return remounted
+}
+
+/*
+Returns the key of the first data block of the file at path p.
+*/
+func firstBlockKey(t *testing.T, filesys *FS, p string) string {
+	t.Helper()
+	inodeNum, err := lookupPath(filesys, p)
+	if err != nil {
+		t.Fatalf("lookupPath(%s): %v", p, err)
+	}
+	inode, err := getInode(inodeNum)
+	if err != nil {
+		t.Fatalf("getInode: %v", err)
+	}
+	return genDataKey(inode.Data[0])
+}
+
+/*
+Checks that verify reads every object of a healthy file system, and reports a truncated block
+and a missing block with the paths of the files they belong to, only when those files are under
+the path being verified.
+*/
+func TestVerify(t *testing.T) {
+	filesys, objects := newTestFs(t, 16)
+	filesys = writeVerifyTestFs(t, filesys, objects)
+	report, err := verify(filesys, "/")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if len(report.problems) != 0 || report.inodes != 4 {
+		t.Fatalf("verify of a healthy file system: %+v", report)
+	}
+
+	objects.put(firstBlockKey(t, filesys, "/dir/a"), []byte("truncated"))
+	objects.remove(firstBlockKey(t, filesys, "/dir/b"))
+	report, err = verify(filesys, "/")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if len(report.problems) != 2 || !strings.HasPrefix(report.problems[0], "/dir/a: block") ||
+		!strings.HasPrefix(report.problems[1], "/dir/b: block") {
+		t.Fatalf("verify of a corrupted file system found %v", report.problems)
+	}
+	report, err = verify(filesys, "dir/b")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if len(report.problems) != 1 || report.inodes != 1 {
+		t.Fatalf("verify of /dir/b: %+v", report)
+	}
+	if _, err := verify(filesys, "/dir/c"); err == nil {
+		t.Fatalf("verify of a missing path succeeded")
+	}
+}
+
+/*
+Checks that verify reports blocks of an encrypted file system that were changed in the store, since
+they fail to decrypt.
+*/
+func TestVerifyEncrypted(t *testing.T) {
+	defer resetEncryption()
+	filesys, objects := newEncryptedTestFs(t, 16)
+	filesys = writeVerifyTestFs(t, filesys, objects)
+	key := firstBlockKey(t, filesys, "/dir/a")
+	data, _ := objects.get(key)
+	data[len(data)/2] ^= 1
+	objects.put(key, data)
+	report, err := verify(filesys, "/")
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if len(report.problems) != 1 || !strings.HasPrefix(report.problems[0], "/dir/a: block") {
+		t.Fatalf("verify of a tampered block found %v", report.problems)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/context"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// the name of the virtual directory in the root of a mount, whose files show the state of the
+// mount, rendered when they are opened, as the files of /proc do
+const VIRTUAL_DIR_NAME string = ".cloudfusion"
+
+// the inode number of the directory holding the virtual directory, set to the root when the file
+// system is mounted with FUSE, or INVALID_INODE if there is none, as when it is served over 9P or
+// HTTP. The directory is not listed, so that tree walks like cp -r and fsck do not go into it, and
+// an entry of the same name stored before it existed is hidden behind it.
+var virtualDirParent uint64 = INVALID_INODE
+
+// the config the file system was mounted with, shown in the virtual config file
+var mountConfig *Config
+
+// the files of the virtual directory, by name, each returning its contents
+var virtualFiles = map[string]func() ([]byte, error){
+	"stats": func() ([]byte, error) {
+		return virtualJSON(currentStats())
+	},
+	"cache": func() ([]byte, error) {
+		return virtualJSON(currentMetrics())
+	},
+	"config": func() ([]byte, error) {
+		return virtualJSON(mountConfig)
+	},
+	"version": func() ([]byte, error) {
+		return []byte(versionText()), nil
+	},
+}
+
+/*
+Returns v as indented JSON ending with a newline, as the virtual files show it.
+*/
+func virtualJSON(v interface{}) ([]byte, error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+/*
+Returns whether name in the directory with inodeNum is the virtual directory.
+*/
+func isVirtualDir(inodeNum uint64, name string) bool {
+	return virtualDirParent != INVALID_INODE && inodeNum == virtualDirParent && name == VIRTUAL_DIR_NAME
+}
+
+/*
+Struct representing the virtual directory. It is read-only, and only held in memory.
+*/
+type VirtualDir struct{}
+
+var _ fs.Node = (*VirtualDir)(nil)
+
+/*
+FUSE method that returns metadata about the virtual directory.
+*/
+func (d *VirtualDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	defer trackOp("Attr")()
+	attr.Mode = os.ModeDir | 0555
+	attr.Nlink = 1
+	return nil
+}
+
+var _ = fs.NodeStringLookuper(&VirtualDir{})
+
+/*
+FUSE method that returns the virtual file with name.
+*/
+func (d *VirtualDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	defer trackOp("Lookup")()
+	if virtualFiles[name] == nil {
+		return nil, fuse.ENOENT
+	}
+	return &VirtualFile{name: name}, nil
+}
+
+var _ = fs.HandleReadDirAller(&VirtualDir{})
+
+/*
+FUSE method that lists the virtual files, in name order.
+*/
+func (d *VirtualDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	defer trackOp("ReadDir")()
+	names := make([]string, 0, len(virtualFiles))
+	for name := range virtualFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]fuse.Dirent, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+/*
+Struct representing a file in the virtual directory.
+*/
+type VirtualFile struct {
+	name string
+}
+
+var _ fs.Node = (*VirtualFile)(nil)
+
+/*
+FUSE method that returns metadata about a virtual file. Its size is given as 0, as the files of
+/proc do, since it is only known once the file is rendered.
+*/
+func (f *VirtualFile) Attr(ctx context.Context, attr *fuse.Attr) error {
+	defer trackOp("Attr")()
+	attr.Mode = 0444
+	attr.Nlink = 1
+	return nil
+}
+
+var _ = fs.NodeOpener(&VirtualFile{})
+
+/*
+FUSE method that renders the virtual file into the handle returned, which reads what it held when
+it was opened. Reads bypass the page cache, so that they are not cut short at the size of 0.
+Opening the file for writing fails with EACCES.
+*/
+func (f *VirtualFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	defer trackOp("Open")()
+	defer recoverPanic("Open")
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.Errno(syscall.EACCES)
+	}
+	data, err := virtualFiles[f.name]()
+	if err != nil {
+		return nil, err
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return &VirtualFileHandle{data: data}, nil
+}
+
+/*
+Struct representing a handle of a virtual file, holding what the file was rendered as.
+*/
+type VirtualFileHandle struct {
+	data []byte
+}
+
+var _ = fs.HandleReader(&VirtualFileHandle{})
+
+/*
+FUSE method that reads the rendered file from the offset of the request.
+*/
+func (fh *VirtualFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	defer trackOp("Read")()
+	if req.Offset >= int64(len(fh.data)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(fh.data)) {
+		end = int64(len(fh.data))
+	}
+	resp.Data = fh.data[req.Offset:end]
+	return nil
+}
+
+/*
+Returns the version of the binary and the format versions it supports, as the version command
+prints them.
+*/
+func versionText() string {
+	return fmt.Sprintf("%s version %s\nwrites format version: %d\nsupported format versions: %v\n",
+		progName, version, FORMAT_VERSION, SUPPORTED_FORMAT_VERSIONS)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+/*
+Checks that the virtual directory is only found in the root of a FUSE mount, that it lists its
+files, that they render the state of the mount and cannot be written, and that its name cannot be
+taken by an entry.
+*/
+func TestVirtualDir(t *testing.T) {
+	filesys, _ := newTestFs(t, 64)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	if _, err := root.lookup(ctx, VIRTUAL_DIR_NAME); err != fuse.ENOENT {
+		t.Fatalf("the virtual directory was found outside a FUSE mount: %v", err)
+	}
+	virtualDirParent = filesys.rootInode
+	defer func() { virtualDirParent = INVALID_INODE }()
+	mountStats = LifetimeStats{}
+	writeTestFile(t, root, "file", testData(1000, 1), 1000)
+
+	node, err := root.lookup(ctx, VIRTUAL_DIR_NAME)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	dir := node.(*VirtualDir)
+	entries, _ := dir.ReadDirAll(ctx)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if strings.Join(names, " ") != "cache config stats version" {
+		t.Fatalf("the virtual directory lists %v", names)
+	}
+	if _, err := dir.Lookup(ctx, "missing"); err != fuse.ENOENT {
+		t.Fatalf("looking up a missing virtual file returned %v", err)
+	}
+
+	node, _ = dir.Lookup(ctx, "stats")
+	file := node.(*VirtualFile)
+	if _, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{}); err != fuse.Errno(syscall.EACCES) {
+		t.Fatalf("opening a virtual file for writing returned %v", err)
+	}
+	resp := &fuse.OpenResponse{}
+	handle, err := file.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, resp)
+	if err != nil || resp.Flags&fuse.OpenDirectIO == 0 {
+		t.Fatalf("Open: %v, flags %v", err, resp.Flags)
+	}
+	var data []byte
+	for {
+		read := &fuse.ReadResponse{}
+		handle.(*VirtualFileHandle).Read(ctx, &fuse.ReadRequest{Offset: int64(len(data)), Size: 16}, read)
+		if len(read.Data) == 0 {
+			break
+		}
+		data = append(data, read.Data...)
+	}
+	var stats LifetimeStats
+	if err := json.Unmarshal(data, &stats); err != nil || stats.BytesWritten != 1000 || stats.FilesCreated != 1 {
+		t.Fatalf("the stats file holds %+v, err %v", stats, err)
+	}
+
+	_, err = root.Mkdir(ctx, &fuse.MkdirRequest{Name: VIRTUAL_DIR_NAME, Mode: os.ModeDir | 0755})
+	if err != fuse.EEXIST {
+		t.Fatalf("making a directory with the name of the virtual one returned %v", err)
+	}
+	err = root.Rename(ctx, &fuse.RenameRequest{OldName: "file", NewName: VIRTUAL_DIR_NAME}, root)
+	if err != fuse.EPERM {
+		t.Fatalf("renaming onto the virtual directory returned %v", err)
+	}
+	if _, err := root.lookup(ctx, "file"); err != nil {
+		t.Fatalf("the file renamed onto the virtual directory is gone: %v", err)
+	}
+	if rec := httpDo(newHTTPGateway(filesys, ""), "GET", "/files/"+VIRTUAL_DIR_NAME, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("GET of the virtual directory through the HTTP gateway: status %d", rec.Code)
+	}
+}
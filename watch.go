@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the number of events queued for a watcher that is not reading them before they are dropped
+const WATCH_QUEUE_SIZE int = 1024
+
+/*
+Struct representing a change to the file system, sent to watchers. Op is "create", "modify" (sent
+when a file that was written is closed), "delete", or "rename", for which NewPath is set; or
+"overflow" when events were dropped because the watcher fell behind.
+*/
+type WatchEvent struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path,omitempty"`
+	NewPath string    `json:"newPath,omitempty"`
+	Dir     bool      `json:"dir,omitempty"`
+}
+
+/*
+Struct representing a client watching for changes under a directory.
+*/
+type watcher struct {
+	root       string
+	events     chan *WatchEvent
+	overflowed bool // set when events were dropped, until the overflow event is queued
+}
+
+// the clients watching for changes
+var watchers = make(map[*watcher]bool)
+var watchersLock sync.Mutex
+
+/*
+Returns a new watcher of changes to root and everything under it.
+*/
+func addWatcher(root string) *watcher {
+	w := &watcher{root: path.Clean("/" + root), events: make(chan *WatchEvent, WATCH_QUEUE_SIZE)}
+	watchersLock.Lock()
+	watchers[w] = true
+	watchersLock.Unlock()
+	return w
+}
+
+/*
+Stops sending events to a watcher.
+*/
+func removeWatcher(w *watcher) {
+	watchersLock.Lock()
+	delete(watchers, w)
+	watchersLock.Unlock()
+}
+
+/*
+Returns whether p is the root of the watcher or under it.
+*/
+func (w *watcher) matches(p string) bool {
+	return w.root == "/" || p == w.root || strings.HasPrefix(p, w.root+"/")
+}
+
+/*
+Queues an event for a watcher without blocking, dropping it if the queue is full. The first event
+queued after events were dropped is an overflow event.
+*/
+func (w *watcher) send(event *WatchEvent) {
+	if w.overflowed {
+		select {
+		case w.events <- &WatchEvent{Time: event.Time, Op: "overflow"}:
+			w.overflowed = false
+		default:
+			return
+		}
+	}
+	select {
+	case w.events <- event:
+	default:
+		w.overflowed = true
+	}
+}
+
+/*
+Sends a change to the watchers of either of its paths. Called from the FUSE handlers after a change
+is made, with the paths the nodes were looked up at.
+*/
+func notifyChange(op string, p string, newPath string, isDir bool) {
+	watchersLock.Lock()
+	defer watchersLock.Unlock()
+	if len(watchers) == 0 {
+		return
+	}
+	event := &WatchEvent{Time: time.Now().UTC(), Op: op, Path: p, NewPath: newPath, Dir: isDir}
+	for w := range watchers {
+		if w.matches(p) || (newPath != "" && w.matches(newPath)) {
+			w.send(event)
+		}
+	}
+}
+
+/*
+Admin command that streams the changes under req.Path to the client as JSON lines, after a reply
+saying the watch has started, until the client disconnects.
+*/
+func watchCommand(req *adminRequest, conn net.Conn, enc *json.Encoder) error {
+	w := addWatcher(req.Path)
+	defer removeWatcher(w)
+	err := enc.Encode(&adminResponse{OK: true})
+	if err != nil {
+		return err
+	}
+	closed := make(chan bool)
+	go func() {
+		// the client sends nothing more, so reading only returns when it disconnects
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+	for {
+		select {
+		case event := <-w.events:
+			err = enc.Encode(event)
+			if err != nil {
+				return err
+			}
+		case <-closed:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bufio"
+	"encoding/json"
+	"golang.org/x/net/context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/*
+Watches a directory over the admin socket, and checks that the changes made under it through the
+FUSE handlers are streamed to the client, and changes elsewhere are not.
+*/
+func TestWatch(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	_, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "dir"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	node, _ := root.lookup(ctx, "dir")
+	dir := node.(*Dir)
+
+	socketPath := filepath.Join(t.TempDir(), "admin.sock")
+	err = startAdminSocket(socketPath)
+	if err != nil {
+		t.Fatalf("startAdminSocket: %v", err)
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("connecting to the admin socket: %v", err)
+	}
+	defer conn.Close()
+	json.NewEncoder(conn).Encode(&adminRequest{Command: "watch", Path: "/dir"})
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := reader.ReadBytes('\n')
+	if err != nil || string(line) != "{\"ok\":true}\n" {
+		t.Fatalf("watch reply %q, err %v", line, err)
+	}
+
+	_, handle, err := dir.Create(ctx, &fuse.CreateRequest{Name: "file"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	fh := handle.(*FileHandle)
+	fh.Write(ctx, &fuse.WriteRequest{Data: []byte("data")}, &fuse.WriteResponse{})
+	fh.Release(ctx, &fuse.ReleaseRequest{})
+	root.Mkdir(ctx, &fuse.MkdirRequest{Name: "elsewhere"})
+	dir.Rename(ctx, &fuse.RenameRequest{OldName: "file", NewName: "renamed"}, dir)
+	dir.Remove(ctx, &fuse.RemoveRequest{Name: "renamed"})
+
+	want := []WatchEvent{
+		{Op: "create", Path: "/dir/file"},
+		{Op: "modify", Path: "/dir/file"},
+		{Op: "rename", Path: "/dir/file", NewPath: "/dir/renamed"},
+		{Op: "delete", Path: "/dir/renamed"},
+	}
+	for _, w := range want {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("reading event %+v: %v", w, err)
+		}
+		var event WatchEvent
+		json.Unmarshal(line, &event)
+		if event.Op != w.Op || event.Path != w.Path || event.NewPath != w.NewPath || event.Dir {
+			t.Fatalf("got event %s, want %+v", line, w)
+		}
+	}
+}
+
+/*
+Checks that events are dropped rather than blocking the file system when a watcher falls behind,
+and that the watcher is told events were dropped.
+*/
+func TestWatchOverflow(t *testing.T) {
+	w := addWatcher("/")
+	defer removeWatcher(w)
+	for i := 0; i < WATCH_QUEUE_SIZE+10; i++ {
+		notifyChange("create", "/file", "", false)
+	}
+	for i := 0; i < WATCH_QUEUE_SIZE; i++ {
+		<-w.events
+	}
+	notifyChange("delete", "/file", "", false)
+	if event := <-w.events; event.Op != "overflow" {
+		t.Fatalf("first event after the queue drained is %s, want overflow", event.Op)
+	}
+	if event := <-w.events; event.Op != "delete" {
+		t.Fatalf("event after the overflow is %s, want delete", event.Op)
+	}
+}
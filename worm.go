@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+	"syscall"
+)
+
+// the extended attribute used to mark directories append-only or immutable, e.g. with
+// setfattr -n user.cloudfusion.worm -v immutable DIR
+const WORM_XATTR string = "user.cloudfusion.worm"
+
+// the values of WORM_XATTR and the flags they set
+var wormFlagNames = map[string]int8{
+	"append-only": DIR_FLAG_APPEND_ONLY,
+	"immutable":   DIR_FLAG_IMMUTABLE,
+}
+
+/*
+Returns the value of WORM_XATTR for the given directory flags, or "" if none are set.
+*/
+func wormFlagName(flags int8) string {
+	for name, flag := range wormFlagNames {
+		if flags&flag != 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+/*
+Returns the flags in effect for the directory with inodeNum: its own, and those of every directory
+above it, found by following the ".." entries up to the root.
+*/
+func inheritedDirFlags(inodeNum uint64) (int8, error) {
+	var flags int8
+	seen := make(map[uint64]bool)
+	for !seen[inodeNum] {
+		seen[inodeNum] = true
+		inode, err := getInode(inodeNum)
+		if err != nil {
+			return flags, err
+		}
+		flags |= inode.dirFlags()
+		// the root is its own parent
+		inodeNum, err = lookupEntry(inodeNum, inode, "..")
+		if err != nil {
+			return flags, err
+		}
+	}
+	return flags, nil
+}
+
+/*
+Returns fuse.EPERM if the directory with inodeNum, or one above it, is immutable, or if it is
+append-only and the operation does more than add a new entry to it.
+*/
+func checkDirWritable(inodeNum uint64, adding bool) error {
+	flags, err := inheritedDirFlags(inodeNum)
+	if err != nil {
+		return err
+	}
+	if flags&DIR_FLAG_IMMUTABLE != 0 || (flags&DIR_FLAG_APPEND_ONLY != 0 && !adding) {
+		return fuse.EPERM
+	}
+	return nil
+}
+
+var _ = fs.NodeSetxattrer(&Dir{})
+
+/*
+FUSE method that marks the directory append-only or immutable when WORM_XATTR is set. Anyone can
+set the flag, or make an append-only directory immutable, but only root can make it less strict.
+*/
+func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
+	defer trackOp("Setxattr")()
+	defer recoverPanic("Setxattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Setxattr")()
+	debugOp(d.path, "Setxattr", "inode=%d name=%s value=%q", d.inodeNum, req.Name, req.Xattr)
+	if err := health.check(); err != nil {
+		return err
+	}
+	if req.Name != WORM_XATTR {
+		return fuse.ENOTSUP
+	}
+	flag, ok := wormFlagNames[string(req.Xattr)]
+	if !ok {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	current := d.inode.dirFlags()
+	stricter := current == 0 || current == flag || (current == DIR_FLAG_APPEND_ONLY && flag == DIR_FLAG_IMMUTABLE)
+	if !stricter && req.Header.Uid != 0 {
+		return fuse.EPERM
+	}
+	d.inode.IsDir = 1 | flag
+	d.inode.changed()
+	err := putInode(d.inode, d.inodeNum)
+	if err != nil || !objectLockEnabled() {
+		return err
+	}
+	return lockTree(d.inodeNum)
+}
+
+var _ = fs.NodeGetxattrer(&Dir{})
+
+/*
+FUSE method that returns the value of WORM_XATTR if it is set on the directory itself.
+*/
+func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	defer trackOp("Getxattr")()
+	defer recoverPanic("Getxattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Getxattr")()
+	debugOp(d.path, "Getxattr", "inode=%d name=%s", d.inodeNum, req.Name)
+	name := wormFlagName(d.inode.dirFlags())
+	if req.Name != WORM_XATTR || name == "" {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(name)
+	return nil
+}
+
+var _ = fs.NodeListxattrer(&Dir{})
+
+/*
+FUSE method that lists WORM_XATTR if it is set on the directory.
+*/
+func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	defer trackOp("Listxattr")()
+	defer recoverPanic("Listxattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Listxattr")()
+	debugOp(d.path, "Listxattr", "inode=%d", d.inodeNum)
+	if d.inode.dirFlags() != 0 {
+		resp.Append(WORM_XATTR)
+	}
+	return nil
+}
+
+var _ = fs.NodeRemovexattrer(&Dir{})
+
+/*
+FUSE method that clears the append-only or immutable flag of the directory, which only root can do.
+*/
+func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
+	defer trackOp("Removexattr")()
+	defer recoverPanic("Removexattr")
+	fsLock.Lock()
+	defer fsLock.Unlock()
+	defer startBudget(ctx, "Removexattr")()
+	debugOp(d.path, "Removexattr", "inode=%d name=%s", d.inodeNum, req.Name)
+	if err := health.check(); err != nil {
+		return err
+	}
+	if req.Name != WORM_XATTR || d.inode.dirFlags() == 0 {
+		return fuse.ErrNoXattr
+	}
+	if req.Header.Uid != 0 {
+		return fuse.EPERM
+	}
+	d.inode.IsDir = 1
+	d.inode.changed()
+	return putInode(d.inode, d.inodeNum)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+/*
+Sets WORM_XATTR on dir to value, as the user with uid.
+*/
+func setWorm(t *testing.T, dir *Dir, value string, uid uint32) error {
+	t.Helper()
+	return dir.Setxattr(context.Background(), &fuse.SetxattrRequest{
+		Header: fuse.Header{Uid: uid},
+		Name:   WORM_XATTR,
+		Xattr:  []byte(value),
+	})
+}
+
+/*
+Checks that files can be added under an append-only directory and extended, but not overwritten,
+renamed, or removed, and that nothing can be changed under an immutable one, including in
+directories moved under it.
+*/
+func TestWormDirs(t *testing.T) {
+	filesys, _ := newTestFs(t, 16)
+	root := testRoot(t, filesys)
+	ctx := context.Background()
+	node, err := root.Mkdir(ctx, &fuse.MkdirRequest{Name: "logs"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	logs := node.(*Dir)
+	err = crashWriteFile(ctx, logs, "old", testData(100, 1))
+	if err != nil {
+		t.Fatalf("writing file: %v", err)
+	}
+	err = setWorm(t, logs, "append-only", 1000)
+	if err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+	resp := new(fuse.GetxattrResponse)
+	err = logs.Getxattr(ctx, &fuse.GetxattrRequest{Name: WORM_XATTR}, resp)
+	if err != nil || string(resp.Xattr) != "append-only" {
+		t.Fatalf("Getxattr = %q, %v", resp.Xattr, err)
+	}
+
+	node, err = logs.Mkdir(ctx, &fuse.MkdirRequest{Name: "2024"})
+	if err != nil {
+		t.Fatalf("Mkdir under append-only directory: %v", err)
+	}
+	sub := node.(*Dir)
+	_, handle, err := sub.Create(ctx, &fuse.CreateRequest{Name: "new"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatalf("Create under append-only directory: %v", err)
+	}
+	fh := handle.(*FileHandle)
+	for _, offset := range []int64{0, 10} {
+		err = fh.Write(ctx, &fuse.WriteRequest{Offset: offset, Data: testData(10, 2)}, &fuse.WriteResponse{})
+		if err != nil {
+			t.Fatalf("appending at %d: %v", offset, err)
+		}
+	}
+	err = fh.Write(ctx, &fuse.WriteRequest{Offset: 5, Data: testData(10, 2)}, &fuse.WriteResponse{})
+	if err != fuse.EPERM {
+		t.Errorf("overwrite under append-only directory = %v, want EPERM", err)
+	}
+	// the writeback cache rewrites the end of the file along with what is appended
+	rewrite := append(testData(10, 2), testData(5, 3)...)
+	err = fh.Write(ctx, &fuse.WriteRequest{Offset: 10, Data: rewrite}, &fuse.WriteResponse{})
+	if err != nil {
+		t.Errorf("appending with a rewrite of the existing bytes: %v", err)
+	}
+	fh.Release(ctx, &fuse.ReleaseRequest{})
+	if err := sub.Remove(ctx, &fuse.RemoveRequest{Name: "new"}); err != fuse.EPERM {
+		t.Errorf("Remove under append-only directory = %v, want EPERM", err)
+	}
+	if err := logs.Rename(ctx, &fuse.RenameRequest{OldName: "old", NewName: "renamed"}, root); err != fuse.EPERM {
+		t.Errorf("Rename out of append-only directory = %v, want EPERM", err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "logs", Dir: true}); err != fuse.EPERM {
+		t.Errorf("Remove of append-only directory = %v, want EPERM", err)
+	}
+	if err := logs.Removexattr(ctx, &fuse.RemovexattrRequest{Header: fuse.Header{Uid: 1000}, Name: WORM_XATTR}); err != fuse.EPERM {
+		t.Errorf("clearing the flag as a user = %v, want EPERM", err)
+	}
+
+	err = setWorm(t, logs, "immutable", 1000)
+	if err != nil {
+		t.Fatalf("making append-only directory immutable: %v", err)
+	}
+	if err := setWorm(t, logs, "append-only", 1000); err != fuse.EPERM {
+		t.Errorf("making immutable directory append-only as a user = %v, want EPERM", err)
+	}
+	if _, _, err := sub.Create(ctx, &fuse.CreateRequest{Name: "newer"}, &fuse.CreateResponse{}); err != fuse.EPERM {
+		t.Errorf("Create under immutable directory = %v, want EPERM", err)
+	}
+	node, _ = sub.lookup(ctx, "new")
+	_, err = node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	if err != fuse.EPERM {
+		t.Errorf("Open for writing under immutable directory = %v, want EPERM", err)
+	}
+	_, err = node.(*File).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Errorf("Open for reading under immutable directory: %v", err)
+	}
+
+	node, err = root.Mkdir(ctx, &fuse.MkdirRequest{Name: "moved"})
+	if err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	err = logs.Removexattr(ctx, &fuse.RemovexattrRequest{Header: fuse.Header{Uid: 0}, Name: WORM_XATTR})
+	if err != nil {
+		t.Fatalf("clearing the flag as root: %v", err)
+	}
+	err = root.Rename(ctx, &fuse.RenameRequest{OldName: "moved", NewName: "moved"}, logs)
+	if err != nil {
+		t.Fatalf("Rename into directory: %v", err)
+	}
+	setWorm(t, logs, "immutable", 0)
+	if _, err := node.(*Dir).Mkdir(ctx, &fuse.MkdirRequest{Name: "x"}); err != fuse.EPERM {
+		t.Errorf("Mkdir in directory moved under immutable directory = %v, want EPERM", err)
+	}
+	if report := fsck(filesys); len(report.problems) != 0 {
+		t.Errorf("fsck after moving a directory: %v", report.problems)
+	}
+}